@@ -24,12 +24,16 @@ import (
 	"encoding/json"
 	std_errors "errors"
 	"fmt"
+	"net"
+	"net/http"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/notices"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 )
 
@@ -62,6 +66,19 @@ type Parameters struct {
 	// Optional.
 	EstablishTunnelTimeoutSeconds *int
 
+	// Overrides config.DisableLocalSocksProxy. See config.go for details.
+	// nil means the value in the config file will be used.
+	// Programs which use PsiphonTunnel.Dial, DialContext, or NewHTTPClient
+	// may disable the local proxies, in which case the corresponding proxy
+	// port will be 0.
+	// Optional.
+	DisableLocalSocksProxy *bool
+
+	// Overrides config.DisableLocalHTTPProxy. See config.go for details.
+	// nil means the value in the config file will be used.
+	// Optional.
+	DisableLocalHTTPProxy *bool
+
 	// EmitDiagnosticNoticesToFile indicates whether to use the rotating log file
 	// facility to record diagnostic notices instead of sending diagnostic
 	// notices to noticeReceiver. Has no effect unless the tunnel
@@ -69,11 +86,16 @@ type Parameters struct {
 	EmitDiagnosticNoticesToFiles bool
 }
 
-// PsiphonTunnel is the tunnel object. It can be used for stopping the tunnel and
-// retrieving proxy ports.
+// PsiphonTunnel is the tunnel object. It can be used for stopping the tunnel,
+// retrieving proxy ports, dialing tunneled connections, and receiving notices.
 type PsiphonTunnel struct {
 	controllerWaitGroup sync.WaitGroup
 	stopController      context.CancelFunc
+	controller          *psiphon.Controller
+
+	noticeMutex         sync.Mutex
+	noticeChannel       chan notices.Notice
+	noticeChannelClosed bool
 
 	// The port on which the HTTP proxy is running
 	HTTPProxyPort int
@@ -91,9 +113,12 @@ type ClientParametersDelta map[string]interface{}
 type NoticeEvent struct {
 	Data      map[string]interface{} `json:"data"`
 	Type      string                 `json:"noticeType"`
+	Version   int                    `json:"noticeVersion"`
 	Timestamp string                 `json:"timestamp"`
 }
 
+const noticeChannelSize = 1000
+
 // ErrTimeout is returned when the tunnel establishment attempt fails due to timeout
 var ErrTimeout = std_errors.New("clientlib: tunnel establishment timeout")
 
@@ -147,6 +172,14 @@ func StartTunnel(ctx context.Context,
 		config.EstablishTunnelTimeoutSeconds = params.EstablishTunnelTimeoutSeconds
 	} // else use the value in config
 
+	if params.DisableLocalSocksProxy != nil {
+		config.DisableLocalSocksProxy = *params.DisableLocalSocksProxy
+	} // else use the value in config
+
+	if params.DisableLocalHTTPProxy != nil {
+		config.DisableLocalHTTPProxy = *params.DisableLocalHTTPProxy
+	} // else use the value in config
+
 	if config.UseNoticeFiles == nil && config.EmitDiagnosticNotices && params.EmitDiagnosticNoticesToFiles {
 		config.UseNoticeFiles = &psiphon.UseNoticeFiles{
 			RotatingFileSize:      0,
@@ -203,13 +236,19 @@ func StartTunnel(ctx context.Context,
 	errored := make(chan error)
 
 	// Create the tunnel object
-	tunnel = new(PsiphonTunnel)
+	tunnel = &PsiphonTunnel{
+		noticeChannel: make(chan notices.Notice, noticeChannelSize),
+	}
 
 	// Set up notice handling
 	psiphon.SetNoticeWriter(psiphon.NewNoticeReceiver(
 		func(notice []byte) {
 			var event NoticeEvent
 			err := json.Unmarshal(notice, &event)
+			var typedNotice notices.Notice
+			if err == nil {
+				typedNotice, _, err = notices.Decode(notice)
+			}
 			if err != nil {
 				// This is unexpected and probably indicates something fatal has occurred.
 				// We'll interpret it as a connection error and abort.
@@ -221,20 +260,18 @@ func StartTunnel(ctx context.Context,
 				return
 			}
 
-			if event.Type == "ListeningHttpProxyPort" {
-				port := event.Data["port"].(float64)
-				tunnel.HTTPProxyPort = int(port)
-			} else if event.Type == "ListeningSocksProxyPort" {
-				port := event.Data["port"].(float64)
-				tunnel.SOCKSProxyPort = int(port)
-			} else if event.Type == "EstablishTunnelTimeout" {
+			switch typedNotice := typedNotice.(type) {
+			case notices.ListeningHttpProxyPort:
+				tunnel.HTTPProxyPort = typedNotice.Port
+			case notices.ListeningSocksProxyPort:
+				tunnel.SOCKSProxyPort = typedNotice.Port
+			case notices.EstablishTunnelTimeout:
 				select {
 				case timedOut <- struct{}{}:
 				default:
 				}
-			} else if event.Type == "Tunnels" {
-				count := event.Data["count"].(float64)
-				if count > 0 {
+			case notices.Tunnels:
+				if typedNotice.Count > 0 {
 					select {
 					case connected <- struct{}{}:
 					default:
@@ -247,13 +284,17 @@ func StartTunnel(ctx context.Context,
 			if noticeReceiver != nil {
 				noticeReceiver(event)
 			}
+
+			tunnel.sendNotice(typedNotice)
 		}))
 
 	// Create the Psiphon controller
 	controller, err := psiphon.NewController(config)
 	if err != nil {
+		tunnel.closeNotices()
 		return nil, errors.TraceMsg(err, "psiphon.NewController failed")
 	}
+	tunnel.controller = controller
 
 	// Create a cancelable context that will be used for stopping the tunnel
 	var controllerCtx context.Context
@@ -294,5 +335,120 @@ func (tunnel *PsiphonTunnel) Stop() {
 
 	tunnel.controllerWaitGroup.Wait()
 
+	tunnel.closeNotices()
+
 	psiphon.CloseDataStore()
 }
+
+// Dial establishes a TCP connection to remoteAddr, a host:port address,
+// through the tunnel. The connection is subject to the same split tunnel
+// classification as connections made through the local proxies.
+//
+// Dial may be used when the local proxies are disabled.
+func (tunnel *PsiphonTunnel) Dial(remoteAddr string) (net.Conn, error) {
+	return tunnel.DialContext(context.Background(), "tcp", remoteAddr)
+}
+
+// DialContext is Dial with a context which may be used to interrupt the
+// dial. The network must be "tcp", "tcp4", or "tcp6"; the tunnel determines
+// the IP version used to reach the destination. DialContext has the
+// signature of net.Dialer.DialContext and may be used where a dial function
+// is expected.
+func (tunnel *PsiphonTunnel) DialContext(
+	ctx context.Context, network, remoteAddr string) (net.Conn, error) {
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.Tracef("unsupported network: %s", network)
+	}
+
+	if tunnel.controller == nil {
+		return nil, errors.TraceNew("tunnel not started")
+	}
+
+	// Controller.Dial doesn't take a context, so the dial is run in a
+	// goroutine. When ctx is done first, a connection that arrives later is
+	// closed.
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	resultChannel := make(chan dialResult, 1)
+
+	go func() {
+		conn, err := tunnel.controller.Dial(remoteAddr, false, nil)
+		resultChannel <- dialResult{conn: conn, err: err}
+	}()
+
+	select {
+	case result := <-resultChannel:
+		if result.err != nil {
+			return nil, errors.Trace(result.err)
+		}
+		return result.conn, nil
+	case <-ctx.Done():
+		go func() {
+			result := <-resultChannel
+			if result.conn != nil {
+				result.conn.Close()
+			}
+		}()
+		// ctx.Err() is returned as-is so that callers, including
+		// http.Transport, may identify cancellation.
+		return nil, ctx.Err()
+	}
+}
+
+// NewHTTPClient returns an http.Client which makes all requests through the
+// tunnel, using DialContext. Each call returns a client with its own
+// connection pool. Requests made after the tunnel is stopped will fail.
+func (tunnel *PsiphonTunnel) NewHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           tunnel.DialContext,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
+}
+
+// Notices returns a channel which receives the notices emitted by tunnel
+// core, decoded into typed notice values; see notices.Decode. The channel is
+// buffered and includes notices emitted during tunnel establishment. When
+// the buffer is full, new notices are discarded, so the channel should be
+// read promptly. The channel is closed when the tunnel is stopped.
+func (tunnel *PsiphonTunnel) Notices() <-chan notices.Notice {
+	return tunnel.noticeChannel
+}
+
+func (tunnel *PsiphonTunnel) sendNotice(notice notices.Notice) {
+	tunnel.noticeMutex.Lock()
+	defer tunnel.noticeMutex.Unlock()
+
+	if tunnel.noticeChannelClosed {
+		return
+	}
+
+	select {
+	case tunnel.noticeChannel <- notice:
+	default:
+	}
+}
+
+func (tunnel *PsiphonTunnel) closeNotices() {
+	tunnel.noticeMutex.Lock()
+	defer tunnel.noticeMutex.Unlock()
+
+	if tunnel.noticeChannelClosed {
+		return
+	}
+	tunnel.noticeChannelClosed = true
+	close(tunnel.noticeChannel)
+}
@@ -27,6 +27,8 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/notices"
 )
 
 var testDataDirName string
@@ -150,3 +152,25 @@ func TestStartTunnel(t *testing.T) {
 		})
 	}
 }
+
+func TestDialContextErrors(t *testing.T) {
+
+	tunnel := &PsiphonTunnel{noticeChannel: make(chan notices.Notice, noticeChannelSize)}
+
+	_, err := tunnel.DialContext(context.Background(), "udp", "example.org:53")
+	if err == nil {
+		t.Fatalf("unexpected success for unsupported network")
+	}
+
+	_, err = tunnel.Dial("example.org:80")
+	if err == nil {
+		t.Fatalf("unexpected success for unstarted tunnel")
+	}
+
+	tunnel.Stop()
+
+	_, ok := <-tunnel.Notices()
+	if ok {
+		t.Fatalf("notice channel not closed")
+	}
+}
@@ -60,6 +60,9 @@ func main() {
 	var interfaceName string
 	flag.StringVar(&interfaceName, "listenInterface", "", "bind local proxies to specified interface")
 
+	var torPluggableTransport bool
+	flag.BoolVar(&torPluggableTransport, "torPluggableTransport", false, "run as a Tor pluggable transport, launched by Tor")
+
 	var versionDetails bool
 	flag.BoolVar(&versionDetails, "version", false, "print build information and exit")
 	flag.BoolVar(&versionDetails, "v", false, "print build information and exit")
@@ -153,6 +156,21 @@ func main() {
 	}
 	psiphon.SetNoticeWriter(noticeWriter)
 
+	// In Tor pluggable transport mode, the notice writer is wrapped to report
+	// the local SOCKS proxy to Tor.
+
+	var torPTClient *torPluggableTransportClient
+	if torPluggableTransport {
+		var err error
+		torPTClient, err = newTorPluggableTransportClient()
+		if err != nil {
+			psiphon.SetEmitDiagnosticNotices(true, false)
+			psiphon.NoticeError("error initializing Tor pluggable transport: %s", err)
+			os.Exit(1)
+		}
+		psiphon.SetNoticeWriter(torPTClient.newNoticeWriter(noticeWriter))
+	}
+
 	// Handle required config file parameter
 
 	// EmitDiagnosticNotices is set by LoadConfig; force to true
@@ -185,6 +203,15 @@ func main() {
 		config.ListenInterface = interfaceName
 	}
 
+	if torPTClient != nil {
+		err := torPTClient.configure(config)
+		if err != nil {
+			psiphon.SetEmitDiagnosticNotices(true, false)
+			psiphon.NoticeError("error configuring Tor pluggable transport: %s", err)
+			os.Exit(1)
+		}
+	}
+
 	// Configure notice files
 
 	if useNoticeFiles {
@@ -210,6 +237,9 @@ func main() {
 	// All config fields should be set before calling Commit.
 
 	err = config.Commit(true)
+	if torPTClient != nil {
+		torPTClient.committed(err)
+	}
 	if err != nil {
 		psiphon.SetEmitDiagnosticNotices(true, false)
 		psiphon.NoticeError("error loading configuration file: %s", err)
@@ -302,6 +332,13 @@ func main() {
 	// writeProfilesSignal is nil and non-functional on Windows
 	writeProfilesSignal := makeSIGUSR2Channel()
 
+	// stdinClosedSignal is nil and non-functional when not in Tor pluggable
+	// transport mode.
+	var stdinClosedSignal <-chan struct{}
+	if torPTClient != nil {
+		stdinClosedSignal = torPTClient.stdinClosed()
+	}
+
 	// Wait for an OS signal or a Run stop signal, then stop Psiphon and exit
 
 	for exit := false; !exit; {
@@ -320,6 +357,11 @@ func main() {
 			stopController()
 			controllerWaitGroup.Wait()
 			exit = true
+		case <-stdinClosedSignal:
+			psiphon.NoticeInfo("shutdown by Tor")
+			stopController()
+			controllerWaitGroup.Wait()
+			exit = true
 		case <-controllerCtx.Done():
 			psiphon.NoticeInfo("shutdown by controller")
 			exit = true
@@ -0,0 +1,200 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	pt "github.com/Psiphon-Labs/goptlib"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/notices"
+)
+
+const (
+	TOR_PLUGGABLE_TRANSPORT_METHOD_NAME = "psiphon"
+)
+
+// torPluggableTransportClient implements the client side of the Tor
+// pluggable transport managed proxy protocol. When the console client is
+// launched by Tor, via ClientTransportPlugin, the local SOCKS proxy is
+// reported to Tor as the "psiphon" transport method. Tor then connects
+// through the SOCKS proxy to the bridge address in its Bridge line, and that
+// connection is port forwarded through the Psiphon tunnel. Only Psiphon
+// servers run with TorORPortForwarding, which connect the port forward to
+// Tor, are selected.
+//
+// The protocol messages are written to stdout; notices must not also be
+// written to stdout.
+type torPluggableTransportClient struct {
+	proxyURL   string
+	reportOnce sync.Once
+}
+
+// newTorPluggableTransportClient reads the managed proxy configuration which
+// Tor provides in the environment. Errors are reported to Tor before
+// newTorPluggableTransportClient returns.
+func newTorPluggableTransportClient() (*torPluggableTransportClient, error) {
+
+	clientInfo, err := pt.ClientSetup(
+		[]string{TOR_PLUGGABLE_TRANSPORT_METHOD_NAME})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	hasMethod := false
+	for _, methodName := range clientInfo.MethodNames {
+		if methodName == TOR_PLUGGABLE_TRANSPORT_METHOD_NAME {
+			hasMethod = true
+		} else {
+			pt.CmethodError(methodName, "no such method")
+		}
+	}
+	if !hasMethod {
+		pt.CmethodsDone()
+		return nil, errors.Tracef(
+			"Tor did not request the %s method", TOR_PLUGGABLE_TRANSPORT_METHOD_NAME)
+	}
+
+	return &torPluggableTransportClient{}, nil
+}
+
+// configure applies the managed proxy configuration to the Psiphon config.
+// configure must be called before config.Commit, and the config.Commit
+// result must be passed to committed.
+func (client *torPluggableTransportClient) configure(config *psiphon.Config) error {
+
+	// Tor connects to the SOCKS proxy, which must listen on the loopback
+	// interface, without credentials.
+
+	if config.ListenInterface != "" {
+		err := errors.TraceNew("ListenInterface is not supported")
+		client.reportError(err)
+		return err
+	}
+
+	if len(config.LocalProxyCredentials) > 0 {
+		err := errors.TraceNew("LocalProxyCredentials is not supported")
+		client.reportError(err)
+		return err
+	}
+
+	// Use the Tor state directory when no data root directory is configured.
+
+	if config.DataRootDirectory == "" {
+		stateDirectory, err := pt.MakeStateDir()
+		if err != nil {
+			client.reportError(err)
+			return errors.Trace(err)
+		}
+		config.DataRootDirectory = stateDirectory
+	}
+
+	config.RequireTorORPortForwarding = true
+
+	// TOR_PT_PROXY schemes, "http", "socks4a", and "socks5", are all
+	// supported upstream proxy types. The proxy is reported to Tor once
+	// config.Commit has validated it.
+
+	client.proxyURL = os.Getenv("TOR_PT_PROXY")
+	if client.proxyURL != "" {
+		config.UpstreamProxyURL = client.proxyURL
+	}
+
+	return nil
+}
+
+// committed reports the result of config.Commit, which validates any
+// TOR_PT_PROXY upstream proxy, to Tor. goptlib doesn't implement the proxy
+// messages.
+func (client *torPluggableTransportClient) committed(err error) {
+
+	if client.proxyURL != "" {
+		if err == nil {
+			fmt.Fprintln(pt.Stdout, "PROXY DONE")
+		} else {
+			fmt.Fprintf(pt.Stdout, "PROXY-ERROR %s\n", err)
+		}
+	}
+
+	if err != nil {
+		client.reportError(err)
+	}
+}
+
+// reportError reports a failure to launch the "psiphon" transport method.
+func (client *torPluggableTransportClient) reportError(err error) {
+	client.reportOnce.Do(func() {
+		pt.CmethodError(TOR_PLUGGABLE_TRANSPORT_METHOD_NAME, err.Error())
+		pt.CmethodsDone()
+	})
+}
+
+// newNoticeWriter wraps the notice writer, reporting the "psiphon" transport
+// method to Tor once the SOCKS proxy is listening.
+func (client *torPluggableTransportClient) newNoticeWriter(writer io.Writer) io.Writer {
+
+	return psiphon.NewNoticeReceiver(
+		func(notice []byte) {
+
+			writer.Write(append(notice, '\n'))
+
+			typedNotice, _, err := notices.Decode(notice)
+			if err != nil {
+				return
+			}
+
+			switch typedNotice := typedNotice.(type) {
+			case notices.ListeningSocksProxyPort:
+				client.reportOnce.Do(func() {
+					pt.Cmethod(
+						TOR_PLUGGABLE_TRANSPORT_METHOD_NAME,
+						"socks5",
+						&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: typedNotice.Port})
+					pt.CmethodsDone()
+				})
+			case notices.SocksProxyPortInUse:
+				client.reportError(
+					errors.Tracef("SOCKS proxy port in use: %d", typedNotice.Port))
+			}
+		})
+}
+
+// stdinClosed returns a channel which is closed when Tor requests that the
+// client exit when stdin is closed, and stdin is closed. Otherwise, the
+// channel is never closed.
+func (client *torPluggableTransportClient) stdinClosed() <-chan struct{} {
+
+	signal := make(chan struct{})
+
+	if os.Getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1" {
+		go func() {
+			io.Copy(ioutil.Discard, os.Stdin)
+			close(signal)
+		}()
+	}
+
+	return signal
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	pt "github.com/Psiphon-Labs/goptlib"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+)
+
+func TestTorPluggableTransportClient(t *testing.T) {
+
+	stateDirectory, err := ioutil.TempDir("", "psiphon-tor-pt-client-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(stateDirectory)
+
+	environment := map[string]string{
+		"TOR_PT_MANAGED_TRANSPORT_VER": "1",
+		"TOR_PT_STATE_LOCATION":        stateDirectory,
+		"TOR_PT_CLIENT_TRANSPORTS":     "psiphon,obfs4",
+		"TOR_PT_PROXY":                 "socks5://127.0.0.1:9050",
+	}
+	for key, value := range environment {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	var output bytes.Buffer
+	savedStdout := pt.Stdout
+	pt.Stdout = &output
+	defer func() { pt.Stdout = savedStdout }()
+
+	defer psiphon.SetNoticeWriter(ioutil.Discard)
+
+	client, err := newTorPluggableTransportClient()
+	if err != nil {
+		t.Fatalf("newTorPluggableTransportClient failed: %s", err)
+	}
+
+	// Test: the config uses the Tor state directory and proxy, and selects
+	// only Tor bridges.
+
+	config := &psiphon.Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+	}
+
+	err = client.configure(config)
+	if err != nil {
+		t.Fatalf("configure failed: %s", err)
+	}
+
+	if config.DataRootDirectory != stateDirectory ||
+		config.UpstreamProxyURL != environment["TOR_PT_PROXY"] ||
+		!config.RequireTorORPortForwarding {
+		t.Fatalf("unexpected config")
+	}
+
+	// Test: the proxy is reported only once the config is committed.
+
+	expectedOutput := "VERSION 1\n" +
+		"CMETHOD-ERROR obfs4 no such method\n"
+
+	if output.String() != expectedOutput {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+
+	client.committed(config.Commit(false))
+
+	expectedOutput += "PROXY DONE\n"
+
+	if output.String() != expectedOutput {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+
+	// Test: the SOCKS proxy is reported, once, when it's listening.
+
+	psiphon.SetNoticeWriter(client.newNoticeWriter(ioutil.Discard))
+
+	psiphon.NoticeListeningSocksProxyPort(1080)
+	psiphon.NoticeSocksProxyPortInUse(1080)
+
+	expectedOutput += "CMETHOD psiphon socks5 127.0.0.1:1080\n" +
+		"CMETHODS DONE\n"
+
+	if output.String() != expectedOutput {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+
+	// Test: an invalid proxy is reported to Tor, along with the method
+	// failure.
+
+	os.Setenv("TOR_PT_PROXY", "ftp://127.0.0.1:21")
+	output.Reset()
+
+	client, err = newTorPluggableTransportClient()
+	if err != nil {
+		t.Fatalf("newTorPluggableTransportClient failed: %s", err)
+	}
+
+	config = &psiphon.Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+	}
+
+	err = client.configure(config)
+	if err != nil {
+		t.Fatalf("configure failed: %s", err)
+	}
+
+	client.committed(config.Commit(false))
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 5 ||
+		!strings.HasPrefix(lines[2], "PROXY-ERROR ") ||
+		!strings.HasPrefix(lines[3], "CMETHOD-ERROR psiphon ") ||
+		lines[4] != "CMETHODS DONE" {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+
+	// Test: unsupported config is reported to Tor.
+
+	os.Unsetenv("TOR_PT_PROXY")
+	output.Reset()
+
+	client, err = newTorPluggableTransportClient()
+	if err != nil {
+		t.Fatalf("newTorPluggableTransportClient failed: %s", err)
+	}
+
+	err = client.configure(&psiphon.Config{ListenInterface: "any"})
+	if err == nil {
+		t.Fatalf("unexpected configure success")
+	}
+
+	lines = strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 4 ||
+		!strings.HasPrefix(lines[2], "CMETHOD-ERROR psiphon ") ||
+		lines[3] != "CMETHODS DONE" {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+
+	// Test: when Tor doesn't request the "psiphon" method, setup fails.
+
+	os.Setenv("TOR_PT_CLIENT_TRANSPORTS", "obfs4")
+	output.Reset()
+
+	_, err = newTorPluggableTransportClient()
+	if err == nil {
+		t.Fatalf("unexpected newTorPluggableTransportClient success")
+	}
+
+	expectedOutput = "VERSION 1\n" +
+		"CMETHOD-ERROR obfs4 no such method\n" +
+		"CMETHODS DONE\n"
+
+	if output.String() != expectedOutput {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+}
@@ -45,9 +45,12 @@ func main() {
 
 	var configFilename string
 	var generateServerIPaddress string
+	var generateServerIPv6address string
 	var generateServerNetworkInterface string
 	var generateProtocolPorts stringListFlag
 	var generateWebServerPort int
+	var generateDatagramChannelPort int
+	var generateTorORPortForwarding bool
 	var generateLogFilename string
 	var generateTrafficRulesConfigFilename string
 	var generateOSLConfigFilename string
@@ -66,6 +69,12 @@ func main() {
 		server.DEFAULT_SERVER_IP_ADDRESS,
 		"generate with this server `IP address`")
 
+	flag.StringVar(
+		&generateServerIPv6address,
+		"ipv6address",
+		"",
+		"generate with this additional server `IPv6 address`; blank for none")
+
 	flag.StringVar(
 		&generateServerNetworkInterface,
 		"interface",
@@ -83,6 +92,18 @@ func main() {
 		0,
 		"generate with web server `port`; 0 for no web server")
 
+	flag.IntVar(
+		&generateDatagramChannelPort,
+		"datagram",
+		0,
+		"generate with datagram channel UDP `port`; 0 for no datagram channel")
+
+	flag.BoolVar(
+		&generateTorORPortForwarding,
+		"torORPortForwarding",
+		false,
+		"generate a Tor bridge config, which must be launched by Tor")
+
 	flag.StringVar(
 		&generateLogFilename,
 		"logFilename",
@@ -132,10 +153,10 @@ func main() {
 	} else if args[0] == "generate" {
 
 		serverIPaddress := generateServerIPaddress
+		serverIPv6address := generateServerIPv6address
 
 		if generateServerNetworkInterface != "" {
-			// TODO: IPv6 support
-			serverIPv4Address, _, err := common.GetInterfaceIPAddresses(generateServerNetworkInterface)
+			serverIPv4Address, serverIPv6Address, err := common.GetInterfaceIPAddresses(generateServerNetworkInterface)
 			if err == nil && serverIPv4Address == nil {
 				err = fmt.Errorf("no IPv4 address for interface %s", generateServerNetworkInterface)
 			}
@@ -144,6 +165,13 @@ func main() {
 				os.Exit(1)
 			}
 			serverIPaddress = serverIPv4Address.String()
+
+			// Only a global unicast IPv6 address is usable by clients; a
+			// link-local address, for example, is ignored.
+			if serverIPv6address == "" &&
+				serverIPv6Address != nil && serverIPv6Address.IsGlobalUnicast() {
+				serverIPv6address = serverIPv6Address.String()
+			}
 		}
 
 		tunnelProtocolPorts := make(map[string]int)
@@ -172,8 +200,11 @@ func main() {
 				&server.GenerateConfigParams{
 					LogFilename:                generateLogFilename,
 					ServerIPAddress:            serverIPaddress,
+					ServerIPv6Address:          serverIPv6address,
 					EnableSSHAPIRequests:       true,
 					WebServerPort:              generateWebServerPort,
+					DatagramChannelPort:        generateDatagramChannelPort,
+					TorORPortForwarding:        generateTorORPortForwarding,
 					TunnelProtocolPorts:        tunnelProtocolPorts,
 					MarionetteFormat:           marionetteFormat,
 					TrafficRulesConfigFilename: generateTrafficRulesConfigFilename,
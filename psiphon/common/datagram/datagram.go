@@ -0,0 +1,778 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+Package datagram implements an obfuscated, unreliable datagram channel over
+UDP. A datagram channel runs alongside an SSH tunnel and carries traffic, such
+as UDP port forwards and packet tunnel packets, which suffers from the
+head-of-line blocking of a reliable stream.
+
+A datagram channel session is established through the SSH tunnel: the server
+creates a session and sends the session parameters, which are random keys and
+a session ID, to the client over the encrypted SSH channel. No handshake is
+sent in the clear.
+
+Each datagram is:
+
+	nonce     [24]byte  random
+	sessionID [8]byte   masked with XChaCha20(ObfuscationKey, nonce)
+	sealed    []byte    XChaCha20-Poly1305(SessionKey, nonce, plaintext)
+
+where the plaintext is:
+
+	sequence  uint64    send sequence number, for replay protection
+	type      byte      1: data, 2: keep alive, 3: path challenge, 4: path response
+	payload   []byte    data, or the challenge value for path challenges and responses
+
+Every byte on the wire is indistinguishable from random. The ObfuscationKey is
+shared by all sessions on a server listener, which demultiplexes datagrams
+by unmasking the session ID; the SessionKey is unique to the session.
+
+The client sends keep alives, which the server echoes, both to keep any NAT
+mapping open and to detect when the UDP path is blocked.
+
+The server sends datagrams only to a validated client address. When an
+authenticated, and not replayed, datagram is received from a new client
+address, as happens with NAT rebinding, the server sends a path challenge to
+that address, and switches to the new address only once the client echoes
+the challenge in a path response received from that address. This prevents
+an on-path attacker, which can't authenticate datagrams but can replay them
+from a spoofed address, from redirecting the server's datagrams. Each path
+challenge is sent in response to a received datagram, with a minimum
+interval, so path challenges don't amplify traffic to unvalidated addresses.
+*/
+package datagram
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	SESSION_ID_SIZE = 8
+	KEY_SIZE        = chacha20poly1305.KeySize
+
+	// OVERHEAD is the number of bytes each datagram adds to its payload.
+	OVERHEAD = chacha20poly1305.NonceSizeX + SESSION_ID_SIZE +
+		sequenceNumberSize + messageTypeSize + tagSize
+
+	// MAX_PAYLOAD_SIZE is the largest payload which fits in a single UDP
+	// datagram. Payloads larger than the path MTU are subject to IP
+	// fragmentation.
+	MAX_PAYLOAD_SIZE = maxUDPDatagramSize - OVERHEAD
+
+	sequenceNumberSize = 8
+	messageTypeSize    = 1
+	tagSize            = 16
+	pathChallengeSize  = 8
+	maxUDPDatagramSize = 65507
+	receiveQueueSize   = 256
+	replayWindowSize   = 64
+
+	establishKeepAlivePeriod = 200 * time.Millisecond
+	minPathChallengeInterval = 200 * time.Millisecond
+
+	messageTypeData          = 1
+	messageTypeKeepAlive     = 2
+	messageTypePathChallenge = 3
+	messageTypePathResponse  = 4
+)
+
+// SessionParameters are the values a client requires to use a datagram
+// channel session.
+type SessionParameters struct {
+	SessionID      []byte
+	SessionKey     []byte
+	ObfuscationKey []byte
+}
+
+// Conn is one end of a datagram channel session. Each Write sends one
+// datagram and each Read receives one datagram. Datagrams may be lost,
+// duplicated on the network, or reordered; Conn discards duplicates.
+//
+// Conn implements net.Conn.
+type Conn struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	sendSequenceNumber int64
+	lastReceiveTime    int64
+	readDeadline       int64
+
+	packetConn     net.PacketConn
+	listener       *Listener
+	sessionID      [SESSION_ID_SIZE]byte
+	obfuscationKey []byte
+	aead           cipher.AEAD
+
+	mutex             sync.Mutex
+	peerAddr          net.Addr
+	replayWindow      replayWindow
+	pathChallengeAddr net.Addr
+	pathChallenge     [pathChallengeSize]byte
+	pathChallengeTime monotime.Time
+
+	receivedDatagrams chan []byte
+	closeOnce         sync.Once
+	closedSignal      chan struct{}
+	closeErr          error
+	runWaitGroup      *sync.WaitGroup
+}
+
+func newConn(
+	packetConn net.PacketConn,
+	listener *Listener,
+	peerAddr net.Addr,
+	params *SessionParameters) (*Conn, error) {
+
+	if len(params.SessionID) != SESSION_ID_SIZE ||
+		len(params.SessionKey) != KEY_SIZE ||
+		len(params.ObfuscationKey) != KEY_SIZE {
+
+		return nil, errors.TraceNew("invalid session parameters")
+	}
+
+	aead, err := chacha20poly1305.NewX(params.SessionKey)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	conn := &Conn{
+		packetConn:        packetConn,
+		listener:          listener,
+		obfuscationKey:    params.ObfuscationKey,
+		aead:              aead,
+		peerAddr:          peerAddr,
+		receivedDatagrams: make(chan []byte, receiveQueueSize),
+		closedSignal:      make(chan struct{}),
+		runWaitGroup:      new(sync.WaitGroup),
+	}
+	copy(conn.sessionID[:], params.SessionID)
+
+	return conn, nil
+}
+
+// Dial establishes the client end of a datagram channel session. The client
+// sends datagrams to serverAddr using packetConn, which is owned by the
+// Conn and closed when the Conn is closed.
+//
+// Dial sends keep alives until the server responds, or until ctx is done, so
+// a successful Dial indicates that the UDP path to the server is not
+// blocked. After Dial, keep alives are sent every keepAlivePeriod, and the
+// Conn fails when nothing is received from the server for idleTimeout.
+func Dial(
+	ctx context.Context,
+	packetConn net.PacketConn,
+	serverAddr net.Addr,
+	params *SessionParameters,
+	keepAlivePeriod time.Duration,
+	idleTimeout time.Duration) (*Conn, error) {
+
+	conn, err := newConn(packetConn, nil, serverAddr, params)
+	if err != nil {
+		packetConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	// Establish the session by sending keep alives, with a short period,
+	// until an echo is received. Only the server can produce a datagram
+	// which authenticates with the session key. lastReceiveTime remains 0
+	// until a datagram is received.
+
+	conn.runWaitGroup.Add(1)
+	go conn.readPackets()
+
+	establishedSignal := make(chan struct{})
+
+	conn.runWaitGroup.Add(1)
+	go func() {
+		defer conn.runWaitGroup.Done()
+
+		establishTicker := time.NewTicker(establishKeepAlivePeriod)
+		for atomic.LoadInt64(&conn.lastReceiveTime) == 0 {
+			conn.writeDatagram(messageTypeKeepAlive, nil)
+			select {
+			case <-establishTicker.C:
+			case <-ctx.Done():
+				establishTicker.Stop()
+				return
+			case <-conn.closedSignal:
+				establishTicker.Stop()
+				return
+			}
+		}
+		establishTicker.Stop()
+		close(establishedSignal)
+
+		ticker := time.NewTicker(keepAlivePeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				lastReceiveTime := monotime.Time(atomic.LoadInt64(&conn.lastReceiveTime))
+				if monotime.Since(lastReceiveTime) > idleTimeout {
+					conn.closeWithError(errors.TraceNew("idle timeout"))
+					return
+				}
+				conn.writeDatagram(messageTypeKeepAlive, nil)
+			case <-conn.closedSignal:
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-establishedSignal:
+	case <-ctx.Done():
+		conn.Close()
+		return nil, errors.Trace(ctx.Err())
+	case <-conn.closedSignal:
+		conn.Close()
+		return nil, errors.Trace(conn.closeErr)
+	}
+
+	return conn, nil
+}
+
+// readPackets reads datagrams from a client packet conn.
+func (conn *Conn) readPackets() {
+	defer conn.runWaitGroup.Done()
+
+	buffer := make([]byte, maxUDPDatagramSize)
+	for {
+		n, addr, err := conn.packetConn.ReadFrom(buffer)
+		if err != nil {
+			conn.closeWithError(errors.Trace(err))
+			return
+		}
+		sessionID, ok := unmaskSessionID(conn.obfuscationKey, buffer[:n])
+		if !ok || sessionID != conn.sessionID {
+			continue
+		}
+		conn.receive(buffer[:n], addr)
+	}
+}
+
+// receive authenticates and handles a received datagram. Datagrams which
+// fail authentication, replays, and data datagrams received when the queue
+// is full are dropped.
+func (conn *Conn) receive(datagram []byte, addr net.Addr) {
+
+	nonce := datagram[0:chacha20poly1305.NonceSizeX]
+	sealed := datagram[chacha20poly1305.NonceSizeX+SESSION_ID_SIZE:]
+
+	plaintext, err := conn.aead.Open(nil, nonce, sealed, conn.sessionID[:])
+	if err != nil || len(plaintext) < sequenceNumberSize+messageTypeSize {
+		return
+	}
+
+	sequenceNumber := binary.BigEndian.Uint64(plaintext[0:sequenceNumberSize])
+	messageType := plaintext[sequenceNumberSize]
+	payload := plaintext[sequenceNumberSize+messageTypeSize:]
+
+	conn.mutex.Lock()
+	if !conn.replayWindow.check(sequenceNumber) {
+		conn.mutex.Unlock()
+		return
+	}
+	isValidatedPeer := true
+	var pathChallenge []byte
+	if conn.listener != nil {
+		isValidatedPeer, pathChallenge = conn.validatePeerAddr(addr, messageType, payload)
+	}
+	conn.mutex.Unlock()
+
+	if pathChallenge != nil {
+		conn.writeDatagramTo(addr, messageTypePathChallenge, pathChallenge)
+	}
+
+	// The client responds to a path challenge before lastReceiveTime is
+	// set, so that the response is sent before Dial returns.
+	if conn.listener == nil && messageType == messageTypePathChallenge {
+		conn.writeDatagram(messageTypePathResponse, payload)
+	}
+
+	atomic.StoreInt64(&conn.lastReceiveTime, int64(monotime.Now()))
+
+	switch messageType {
+
+	case messageTypeKeepAlive:
+
+		// The server echoes client keep alives; the client doesn't echo.
+		if conn.listener != nil && isValidatedPeer {
+			conn.writeDatagram(messageTypeKeepAlive, nil)
+		}
+
+	case messageTypeData:
+
+		if len(payload) == 0 {
+			return
+		}
+
+		select {
+		case conn.receivedDatagrams <- payload:
+		default:
+		}
+	}
+}
+
+// validatePeerAddr checks if addr, the source address of an authenticated
+// datagram received by the server, is the validated client address. When
+// it's not, and the datagram is a path response to the outstanding path
+// challenge sent to addr, addr becomes the validated client address.
+// Otherwise, validatePeerAddr returns a new path challenge to send to addr,
+// unless one was recently sent.
+//
+// validatePeerAddr must be called while holding conn.mutex.
+func (conn *Conn) validatePeerAddr(
+	addr net.Addr, messageType byte, payload []byte) (bool, []byte) {
+
+	if conn.peerAddr != nil && conn.peerAddr.String() == addr.String() {
+		return true, nil
+	}
+
+	isChallengedAddr := conn.pathChallengeAddr != nil &&
+		conn.pathChallengeAddr.String() == addr.String()
+
+	if isChallengedAddr &&
+		messageType == messageTypePathResponse &&
+		subtle.ConstantTimeCompare(payload, conn.pathChallenge[:]) == 1 {
+
+		conn.peerAddr = addr
+		conn.pathChallengeAddr = nil
+		return true, nil
+	}
+
+	if isChallengedAddr &&
+		monotime.Since(conn.pathChallengeTime) < minPathChallengeInterval {
+		return false, nil
+	}
+
+	_, err := rand.Read(conn.pathChallenge[:])
+	if err != nil {
+		return false, nil
+	}
+	conn.pathChallengeAddr = addr
+	conn.pathChallengeTime = monotime.Now()
+
+	return false, append([]byte(nil), conn.pathChallenge[:]...)
+}
+
+// writeDatagram sends a datagram to the peer. The server doesn't send
+// datagrams until it has validated the client address.
+func (conn *Conn) writeDatagram(messageType byte, payload []byte) error {
+
+	conn.mutex.Lock()
+	peerAddr := conn.peerAddr
+	conn.mutex.Unlock()
+
+	if peerAddr == nil {
+		return nil
+	}
+
+	return conn.writeDatagramTo(peerAddr, messageType, payload)
+}
+
+func (conn *Conn) writeDatagramTo(
+	addr net.Addr, messageType byte, payload []byte) error {
+
+	nonceSize := chacha20poly1305.NonceSizeX
+	datagram := make([]byte, nonceSize+SESSION_ID_SIZE, OVERHEAD+len(payload))
+
+	nonce := datagram[0:nonceSize]
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = maskSessionID(
+		conn.obfuscationKey, nonce, conn.sessionID, datagram[nonceSize:nonceSize+SESSION_ID_SIZE])
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	plaintext := make([]byte, sequenceNumberSize+messageTypeSize+len(payload))
+	sequenceNumber := atomic.AddInt64(&conn.sendSequenceNumber, 1)
+	binary.BigEndian.PutUint64(plaintext[0:sequenceNumberSize], uint64(sequenceNumber))
+	plaintext[sequenceNumberSize] = messageType
+	copy(plaintext[sequenceNumberSize+messageTypeSize:], payload)
+
+	datagram = conn.aead.Seal(datagram, nonce, plaintext, conn.sessionID[:])
+
+	_, err = conn.packetConn.WriteTo(datagram, addr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// Read receives the payload of one datagram. When b is smaller than the
+// payload, the excess bytes are discarded.
+func (conn *Conn) Read(b []byte) (int, error) {
+	payload, err := conn.readPayload()
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return copy(b, payload), nil
+}
+
+func (conn *Conn) readPayload() ([]byte, error) {
+
+	var timeout <-chan time.Time
+	readDeadline := atomic.LoadInt64(&conn.readDeadline)
+	if readDeadline != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, readDeadline)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case payload := <-conn.receivedDatagrams:
+		return payload, nil
+	case <-timeout:
+		return nil, errTimeout
+	case <-conn.closedSignal:
+		return nil, conn.closeErr
+	}
+}
+
+// Write sends b as the payload of one datagram. Write doesn't block on
+// delivery, and a nil error doesn't indicate that the datagram is
+// received.
+func (conn *Conn) Write(b []byte) (int, error) {
+
+	select {
+	case <-conn.closedSignal:
+		return 0, errors.Trace(conn.closeErr)
+	default:
+	}
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if len(b) > MAX_PAYLOAD_SIZE {
+		return 0, errors.TraceNew("payload too large")
+	}
+
+	err := conn.writeDatagram(messageTypeData, b)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return len(b), nil
+}
+
+// Close closes the Conn. Close on a client Conn closes the underlying
+// packet conn; Close on a server Conn removes the session from its
+// Listener.
+func (conn *Conn) Close() error {
+	conn.closeWithError(errors.TraceNew("closed"))
+	conn.runWaitGroup.Wait()
+	return nil
+}
+
+func (conn *Conn) closeWithError(err error) {
+	conn.closeOnce.Do(func() {
+		conn.closeErr = err
+		close(conn.closedSignal)
+		if conn.listener != nil {
+			conn.listener.removeSession(conn)
+		} else {
+			conn.packetConn.Close()
+		}
+	})
+}
+
+// IsClosed implements the common.Closer interface.
+func (conn *Conn) IsClosed() bool {
+	select {
+	case <-conn.closedSignal:
+		return true
+	default:
+	}
+	return false
+}
+
+// LocalAddr implements the net.Conn interface.
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.packetConn.LocalAddr()
+}
+
+// RemoteAddr implements the net.Conn interface. For a server Conn,
+// RemoteAddr returns nil until the client address is validated.
+func (conn *Conn) RemoteAddr() net.Addr {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.peerAddr
+}
+
+// SetDeadline implements the net.Conn interface. Writes don't block, so
+// only the read deadline is set.
+func (conn *Conn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements the net.Conn interface.
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	var readDeadline int64
+	if !t.IsZero() {
+		readDeadline = t.UnixNano()
+	}
+	atomic.StoreInt64(&conn.readDeadline, readDeadline)
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn interface. Writes don't block,
+// so SetWriteDeadline has no effect.
+func (conn *Conn) SetWriteDeadline(_ time.Time) error {
+	return nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout net.Error = timeoutError{}
+
+// Listener demultiplexes datagrams, received on a single server packet conn,
+// to datagram channel sessions.
+type Listener struct {
+	packetConn     net.PacketConn
+	obfuscationKey []byte
+
+	mutex    sync.Mutex
+	isClosed bool
+	sessions map[[SESSION_ID_SIZE]byte]*Conn
+
+	runWaitGroup *sync.WaitGroup
+}
+
+// Listen creates a Listener which receives datagrams on packetConn. The
+// Listener owns packetConn and closes it when the Listener is closed.
+func Listen(packetConn net.PacketConn) (*Listener, error) {
+
+	obfuscationKey, err := common.MakeSecureRandomBytes(KEY_SIZE)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	listener := &Listener{
+		packetConn:     packetConn,
+		obfuscationKey: obfuscationKey,
+		sessions:       make(map[[SESSION_ID_SIZE]byte]*Conn),
+		runWaitGroup:   new(sync.WaitGroup),
+	}
+
+	listener.runWaitGroup.Add(1)
+	go listener.readPackets()
+
+	return listener, nil
+}
+
+// NewSession creates a new datagram channel session. The returned
+// SessionParameters are to be sent to the client, through the tunnel.
+func (listener *Listener) NewSession() (*Conn, *SessionParameters, error) {
+
+	sessionID, err := common.MakeSecureRandomBytes(SESSION_ID_SIZE)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	sessionKey, err := common.MakeSecureRandomBytes(KEY_SIZE)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	params := &SessionParameters{
+		SessionID:      sessionID,
+		SessionKey:     sessionKey,
+		ObfuscationKey: listener.obfuscationKey,
+	}
+
+	conn, err := newConn(listener.packetConn, listener, nil, params)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if listener.isClosed {
+		return nil, nil, errors.TraceNew("listener is closed")
+	}
+
+	if _, ok := listener.sessions[conn.sessionID]; ok {
+		return nil, nil, errors.TraceNew("duplicate session ID")
+	}
+
+	listener.sessions[conn.sessionID] = conn
+
+	return conn, params, nil
+}
+
+func (listener *Listener) removeSession(conn *Conn) {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if listener.sessions[conn.sessionID] == conn {
+		delete(listener.sessions, conn.sessionID)
+	}
+}
+
+func (listener *Listener) readPackets() {
+	defer listener.runWaitGroup.Done()
+
+	buffer := make([]byte, maxUDPDatagramSize)
+	for {
+		n, addr, err := listener.packetConn.ReadFrom(buffer)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return
+		}
+
+		// Datagrams which don't correspond to a session, including any
+		// probes, are silently dropped.
+
+		sessionID, ok := unmaskSessionID(listener.obfuscationKey, buffer[:n])
+		if !ok {
+			continue
+		}
+
+		listener.mutex.Lock()
+		conn := listener.sessions[sessionID]
+		listener.mutex.Unlock()
+
+		if conn == nil {
+			continue
+		}
+
+		conn.receive(buffer[:n], addr)
+	}
+}
+
+// Close closes the Listener and all of its sessions.
+func (listener *Listener) Close() error {
+
+	listener.mutex.Lock()
+	listener.isClosed = true
+	sessions := listener.sessions
+	listener.sessions = make(map[[SESSION_ID_SIZE]byte]*Conn)
+	listener.mutex.Unlock()
+
+	for _, conn := range sessions {
+		conn.Close()
+	}
+
+	err := listener.packetConn.Close()
+	listener.runWaitGroup.Wait()
+
+	return errors.Trace(err)
+}
+
+// Addr returns the address the Listener is receiving datagrams on.
+func (listener *Listener) Addr() net.Addr {
+	return listener.packetConn.LocalAddr()
+}
+
+func maskSessionID(
+	obfuscationKey, nonce []byte, sessionID [SESSION_ID_SIZE]byte, dst []byte) error {
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(obfuscationKey, nonce)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cipher.XORKeyStream(dst, sessionID[:])
+	return nil
+}
+
+func unmaskSessionID(
+	obfuscationKey, datagram []byte) ([SESSION_ID_SIZE]byte, bool) {
+
+	var sessionID [SESSION_ID_SIZE]byte
+
+	if len(datagram) < OVERHEAD {
+		return sessionID, false
+	}
+
+	nonceSize := chacha20poly1305.NonceSizeX
+	cipher, err := chacha20.NewUnauthenticatedCipher(
+		obfuscationKey, datagram[0:nonceSize])
+	if err != nil {
+		return sessionID, false
+	}
+	cipher.XORKeyStream(sessionID[:], datagram[nonceSize:nonceSize+SESSION_ID_SIZE])
+
+	return sessionID, true
+}
+
+// replayWindow is a sliding window, as in RFC 4303 section 3.4.3, which
+// rejects sequence numbers already received or too old to check.
+type replayWindow struct {
+	highest uint64
+	bitmap  uint64
+}
+
+func (window *replayWindow) check(sequenceNumber uint64) bool {
+
+	if sequenceNumber == 0 {
+		return false
+	}
+
+	if sequenceNumber > window.highest {
+		shift := sequenceNumber - window.highest
+		if shift >= replayWindowSize {
+			window.bitmap = 1
+		} else {
+			window.bitmap = window.bitmap<<shift | 1
+		}
+		window.highest = sequenceNumber
+		return true
+	}
+
+	offset := window.highest - sequenceNumber
+	if offset >= replayWindowSize {
+		return false
+	}
+
+	mask := uint64(1) << offset
+	if window.bitmap&mask != 0 {
+		return false
+	}
+	window.bitmap |= mask
+	return true
+}
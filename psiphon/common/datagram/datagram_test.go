@@ -0,0 +1,338 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package datagram
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+)
+
+func TestDatagram(t *testing.T) {
+
+	serverPacketConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+
+	listener, err := Listen(serverPacketConn)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverConn, params, err := listener.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession failed: %s", err)
+	}
+
+	dial := func(params *SessionParameters) (*Conn, error) {
+		clientPacketConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 1*time.Second)
+		defer cancelFunc()
+		return Dial(
+			ctx, clientPacketConn, listener.Addr(), params, 100*time.Millisecond, 1*time.Second)
+	}
+
+	// A client with the wrong session key can't establish a session.
+
+	invalidParams := *params
+	invalidParams.SessionKey = prng.Bytes(KEY_SIZE)
+
+	_, err = dial(&invalidParams)
+	if err == nil {
+		t.Fatalf("unexpected Dial success")
+	}
+
+	clientConn, err := dial(params)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	// Exchange datagrams in both directions. Loopback UDP isn't expected to
+	// drop datagrams at this rate.
+
+	for i := 0; i < 10; i++ {
+
+		upstream := prng.Padding(1, 1500)
+		_, err = clientConn.Write(upstream)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+
+		buffer := make([]byte, MAX_PAYLOAD_SIZE)
+		serverConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err := serverConn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		if !bytes.Equal(upstream, buffer[:n]) {
+			t.Fatalf("unexpected upstream datagram")
+		}
+
+		downstream := prng.Padding(1, 1500)
+		_, err = serverConn.Write(downstream)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+
+		clientConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err = clientConn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		if !bytes.Equal(downstream, buffer[:n]) {
+			t.Fatalf("unexpected downstream datagram")
+		}
+	}
+
+	// Frames written together are received as separate datagrams,
+	// datagrams which aren't whole frames are dropped, and frames too large
+	// for a single datagram are dropped without failing the Write.
+
+	frameSize := func(header []byte) int {
+		return FRAME_HEADER_SIZE + int(binary.BigEndian.Uint16(header))
+	}
+	clientFramedConn := NewFramedConn(clientConn, frameSize)
+	serverFramedConn := NewFramedConn(serverConn, frameSize)
+
+	makeFrame := func(payload []byte) []byte {
+		frame := make([]byte, FRAME_HEADER_SIZE+len(payload))
+		binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+		copy(frame[FRAME_HEADER_SIZE:], payload)
+		return frame
+	}
+
+	frame1 := makeFrame([]byte("frame1"))
+	frame2 := makeFrame([]byte("frame2"))
+
+	_, err = clientFramedConn.Write(append(append([]byte(nil), frame1...), frame2...))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	_, err = clientConn.Write([]byte("not a frame"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	oversizedFrame := makeFrame(make([]byte, MAX_PAYLOAD_SIZE-FRAME_HEADER_SIZE+1))
+	_, err = clientFramedConn.Write(oversizedFrame)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	frame3 := makeFrame([]byte("frame3"))
+	_, err = clientFramedConn.Write(frame3)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	_, err = clientFramedConn.Write(frame3[:len(frame3)-1])
+	if err == nil {
+		t.Fatalf("unexpected Write success")
+	}
+
+	for _, expectedFrame := range [][]byte{frame1, frame2, frame3} {
+		serverFramedConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		frame := make([]byte, len(expectedFrame))
+		for i := 0; i < len(frame); {
+			n, err := serverFramedConn.Read(frame[i:])
+			if err != nil {
+				t.Fatalf("Read failed: %s", err)
+			}
+			i += n
+		}
+		if !bytes.Equal(expectedFrame, frame) {
+			t.Fatalf("unexpected frame: %s", frame)
+		}
+	}
+
+	// When the server stops responding, the client fails after the idle
+	// timeout.
+
+	serverConn.Close()
+
+	clientConn.SetReadDeadline(time.Time{})
+	errChannel := make(chan error, 1)
+	go func() {
+		_, err := clientConn.Read(make([]byte, 1))
+		errChannel <- err
+	}()
+
+	select {
+	case err := <-errChannel:
+		if err == nil {
+			t.Fatalf("unexpected Read success")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout awaiting idle timeout")
+	}
+}
+
+func TestPathValidation(t *testing.T) {
+
+	serverPacketConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+
+	listener, err := Listen(serverPacketConn)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverConn, params, err := listener.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession failed: %s", err)
+	}
+
+	clientPacketConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFunc()
+	clientConn, err := Dial(
+		ctx, clientPacketConn, listener.Addr(), params, 100*time.Millisecond, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer clientConn.Close()
+
+	expectReceived := func(conn *Conn, expected []byte) {
+		buffer := make([]byte, MAX_PAYLOAD_SIZE)
+		conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+		if !bytes.Equal(expected, buffer[:n]) {
+			t.Fatalf("unexpected datagram")
+		}
+	}
+
+	upstream := prng.Padding(1, 1500)
+	_, err = clientConn.Write(upstream)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	expectReceived(serverConn, upstream)
+
+	// An authenticated datagram from another address, which doesn't respond
+	// to the path challenge, doesn't redirect the server's datagrams. The
+	// other conn's sequence numbers are advanced to pass the replay check.
+
+	otherPacketConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	otherConn, err := newConn(otherPacketConn, nil, listener.Addr(), params)
+	if err != nil {
+		t.Fatalf("newConn failed: %s", err)
+	}
+	defer otherConn.Close()
+	otherConn.sendSequenceNumber = 1000
+
+	upstream = prng.Padding(1, 1500)
+	_, err = otherConn.Write(upstream)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	expectReceived(serverConn, upstream)
+
+	downstream := prng.Padding(1, 1500)
+	_, err = serverConn.Write(downstream)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	expectReceived(clientConn, downstream)
+
+	// Once the other address responds to a path challenge, as a client
+	// does after NAT rebinding, the server switches to that address.
+
+	otherConn.runWaitGroup.Add(1)
+	go otherConn.readPackets()
+
+	time.Sleep(minPathChallengeInterval)
+
+	upstream = prng.Padding(1, 1500)
+	_, err = otherConn.Write(upstream)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	expectReceived(serverConn, upstream)
+
+	deadline := time.Now().Add(1 * time.Second)
+	for serverConn.RemoteAddr() == nil ||
+		serverConn.RemoteAddr().String() != otherPacketConn.LocalAddr().String() {
+
+		if time.Now().After(deadline) {
+			t.Fatalf("server address not switched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	downstream = prng.Padding(1, 1500)
+	_, err = serverConn.Write(downstream)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	expectReceived(otherConn, downstream)
+}
+
+func TestReplayWindow(t *testing.T) {
+
+	var window replayWindow
+
+	testCases := []struct {
+		sequenceNumber uint64
+		expected       bool
+	}{
+		{0, false},
+		{1, true},
+		{1, false},
+		{3, true},
+		{2, true},
+		{2, false},
+		{100, true},
+		{37, true},
+		{36, false},
+		{37, false},
+		{101, true},
+		{100, false},
+	}
+
+	for _, testCase := range testCases {
+		if window.check(testCase.sequenceNumber) != testCase.expected {
+			t.Fatalf("unexpected result for %d", testCase.sequenceNumber)
+		}
+	}
+}
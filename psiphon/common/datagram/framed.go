@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package datagram
+
+import (
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+const (
+	FRAME_HEADER_SIZE = 2
+)
+
+// FrameSize returns the total size, including the header, of the frame
+// which starts with the specified FRAME_HEADER_SIZE byte header.
+type FrameSize func(header []byte) int
+
+// FramedConn adapts a datagram channel to carry a stream of length-prefixed
+// frames, such as udpgw messages or packet tunnel packets, without changing
+// the stream reader and writer. Each frame is sent in its own datagram, so a
+// lost datagram drops whole frames and the stream remains aligned on frame
+// boundaries.
+//
+// Each Write must consist of one or more whole frames. Write drops, as if
+// lost in transit, any frame which is larger than MAX_PAYLOAD_SIZE and so
+// can't be sent in a single datagram. Read returns the bytes of whole frames,
+// dropping any received datagram which isn't exactly one frame.
+type FramedConn struct {
+	*Conn
+	frameSize FrameSize
+
+	readMutex sync.Mutex
+	readFrame []byte
+}
+
+// NewFramedConn creates a new FramedConn.
+func NewFramedConn(conn *Conn, frameSize FrameSize) *FramedConn {
+	return &FramedConn{
+		Conn:      conn,
+		frameSize: frameSize,
+	}
+}
+
+// Read implements the net.Conn interface.
+func (conn *FramedConn) Read(b []byte) (int, error) {
+
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+
+	for len(conn.readFrame) == 0 {
+
+		frame, err := conn.Conn.readPayload()
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		if len(frame) < FRAME_HEADER_SIZE ||
+			conn.frameSize(frame[0:FRAME_HEADER_SIZE]) != len(frame) {
+			continue
+		}
+
+		conn.readFrame = frame
+	}
+
+	n := copy(b, conn.readFrame)
+	conn.readFrame = conn.readFrame[n:]
+
+	return n, nil
+}
+
+// Write implements the net.Conn interface.
+func (conn *FramedConn) Write(b []byte) (int, error) {
+
+	n := 0
+	for n < len(b) {
+
+		frame := b[n:]
+		if len(frame) < FRAME_HEADER_SIZE {
+			return n, errors.TraceNew("incomplete frame header")
+		}
+
+		size := conn.frameSize(frame[0:FRAME_HEADER_SIZE])
+		if size < FRAME_HEADER_SIZE || size > len(frame) {
+			return n, errors.TraceNew("incomplete frame")
+		}
+
+		if size <= MAX_PAYLOAD_SIZE {
+			_, err := conn.Conn.Write(frame[:size])
+			if err != nil {
+				return n, errors.Trace(err)
+			}
+		}
+
+		n += size
+	}
+
+	return n, nil
+}
@@ -0,0 +1,58 @@
+// +build ignore
+
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// generate writes the JSON Schema files for all notice types to the schema
+// directory. Run with "go generate" in the notices package directory.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/notices"
+)
+
+func main() {
+
+	err := os.MkdirAll("schema", 0755)
+	if err != nil {
+		fmt.Printf("MkdirAll failed: %s\n", err)
+		os.Exit(1)
+	}
+
+	for _, notice := range notices.GetNoticeTypes() {
+
+		schema, err := notices.JSONSchema(notice)
+		if err != nil {
+			fmt.Printf("JSONSchema failed: %s\n", err)
+			os.Exit(1)
+		}
+
+		err = ioutil.WriteFile(
+			filepath.Join("schema", notices.JSONSchemaFilename(notice)), schema, 0644)
+		if err != nil {
+			fmt.Printf("WriteFile failed: %s\n", err)
+			os.Exit(1)
+		}
+	}
+}
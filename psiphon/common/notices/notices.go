@@ -0,0 +1,291 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+Package notices defines the notices emitted by tunnel-core.
+
+Each notice type is a Go struct whose JSON encoding is the notice "data"
+payload. Notices are written in an envelope, one per line:
+
+	{"noticeType":"Tunnels","noticeVersion":1,"data":{"count":1},"timestamp":"2006-01-02T15:04:05.000Z"}
+
+Each notice type has a schema version, which is incremented whenever a change
+to the notice type is not backwards compatible; for example, when a field is
+removed, renamed, or changes type. Adding an optional field doesn't change
+the version. JSON Schema files for all notice types, generated from the
+structs, are in the schema directory.
+
+Decode parses an encoded notice into its struct type, so that programs which
+consume notices may type switch on the result and detect breaking changes
+at compile time.
+*/
+package notices
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+// Notice is implemented by all notice types.
+type Notice interface {
+
+	// NoticeType is the "noticeType" value identifying the notice.
+	NoticeType() string
+
+	// NoticeVersion is the schema version of the notice type.
+	NoticeVersion() int
+}
+
+// Generic is a notice with an unstructured data payload. Generic is used to
+// emit notices with dynamic types, such as metrics logged via common.Logger,
+// and Decode returns Generic for notices with unknown types or versions.
+type Generic struct {
+	Type    string
+	Version int
+	Data    map[string]interface{}
+}
+
+// NoticeType implements Notice.
+func (notice Generic) NoticeType() string { return notice.Type }
+
+// NoticeVersion implements Notice.
+func (notice Generic) NoticeVersion() int { return notice.Version }
+
+// MarshalJSON encodes the Generic data payload.
+func (notice Generic) MarshalJSON() ([]byte, error) {
+	if notice.Data == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(notice.Data)
+}
+
+type envelope struct {
+	NoticeType    string          `json:"noticeType"`
+	NoticeVersion int             `json:"noticeVersion"`
+	Data          json.RawMessage `json:"data"`
+	Timestamp     string          `json:"timestamp"`
+}
+
+// Encode returns the JSON encoding of the notice, in its envelope, with the
+// specified timestamp. The encoding doesn't include a trailing newline.
+func Encode(notice Notice, timestamp time.Time) ([]byte, error) {
+
+	data, err := json.Marshal(notice)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	encodedNotice, err := json.Marshal(
+		&envelope{
+			NoticeType:    notice.NoticeType(),
+			NoticeVersion: notice.NoticeVersion(),
+			Data:          data,
+			Timestamp:     timestamp.UTC().Format(common.RFC3339Milli),
+		})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return encodedNotice, nil
+}
+
+// Decode parses a JSON encoded notice. Notices with a known type and
+// version are returned as their struct type, as a value, not a pointer. All
+// other notices are returned as Generic. Notices without a "noticeVersion",
+// which were emitted before notice versioning, are treated as version 1.
+func Decode(encodedNotice []byte) (Notice, string, error) {
+
+	var object envelope
+	err := json.Unmarshal(encodedNotice, &object)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+
+	if object.NoticeType == "" {
+		return nil, "", errors.TraceNew("missing notice type")
+	}
+
+	version := object.NoticeVersion
+	if version == 0 {
+		version = 1
+	}
+
+	data := []byte(object.Data)
+	if len(data) == 0 || string(data) == "null" {
+		data = []byte("{}")
+	}
+
+	noticeType, ok := registeredNoticeTypes[object.NoticeType]
+	if ok && reflect.Zero(noticeType).Interface().(Notice).NoticeVersion() == version {
+		value := reflect.New(noticeType)
+		err := json.Unmarshal(data, value.Interface())
+		if err != nil {
+			return nil, "", errors.Trace(err)
+		}
+		return value.Elem().Interface().(Notice), object.Timestamp, nil
+	}
+
+	var payload map[string]interface{}
+	err = json.Unmarshal(data, &payload)
+	if err != nil {
+		return nil, "", errors.Trace(err)
+	}
+
+	return Generic{
+		Type:    object.NoticeType,
+		Version: version,
+		Data:    payload,
+	}, object.Timestamp, nil
+}
+
+// GetNoticeTypes returns a zero value of each registered notice type.
+func GetNoticeTypes() []Notice {
+	noticeTypes := make([]Notice, 0, len(allNoticeTypes))
+	for _, notice := range allNoticeTypes {
+		noticeTypes = append(noticeTypes, notice)
+	}
+	return noticeTypes
+}
+
+var registeredNoticeTypes = func() map[string]reflect.Type {
+	noticeTypes := make(map[string]reflect.Type)
+	for _, notice := range allNoticeTypes {
+		noticeTypes[notice.NoticeType()] = reflect.TypeOf(notice)
+	}
+	return noticeTypes
+}()
+
+// marshalWithExtraFields encodes value, a struct, and adds extraFields to
+// the encoded JSON object. Declared struct fields take precedence over extra
+// fields with the same name.
+func marshalWithExtraFields(
+	value interface{}, extraFields map[string]interface{}) ([]byte, error) {
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(extraFields) == 0 {
+		return data, nil
+	}
+
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for name, extraValue := range extraFields {
+		if _, ok := fields[name]; ok {
+			continue
+		}
+		fields[name], err = json.Marshal(extraValue)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	data, err = json.Marshal(fields)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return data, nil
+}
+
+// unmarshalExtraFields returns the fields in data, a JSON object, which
+// aren't declared in the struct type of value.
+func unmarshalExtraFields(
+	data []byte, value interface{}) (map[string]interface{}, error) {
+
+	var fields map[string]interface{}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for _, field := range getJSONFields(reflect.TypeOf(value)) {
+		delete(fields, field.name)
+	}
+
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	return fields, nil
+}
+
+type jsonField struct {
+	name      string
+	omitEmpty bool
+	fieldType reflect.Type
+}
+
+// getJSONFields returns the fields of a struct type as encoded by
+// encoding/json, including the fields of embedded structs.
+func getJSONFields(structType reflect.Type) []jsonField {
+
+	var fields []jsonField
+
+	for i := 0; i < structType.NumField(); i++ {
+
+		field := structType.Field(i)
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, getJSONFields(field.Type)...)
+			continue
+		}
+
+		if field.PkgPath != "" {
+			// Unexported field.
+			continue
+		}
+
+		name := field.Name
+		omitEmpty := false
+		tagValues := strings.Split(tag, ",")
+		if tagValues[0] != "" {
+			name = tagValues[0]
+		}
+		for _, option := range tagValues[1:] {
+			if option == "omitempty" {
+				omitEmpty = true
+			}
+		}
+
+		fields = append(fields, jsonField{
+			name:      name,
+			omitEmpty: omitEmpty,
+			fieldType: field.Type,
+		})
+	}
+
+	return fields
+}
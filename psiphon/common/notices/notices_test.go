@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package notices
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecode(t *testing.T) {
+
+	transformedHostName := true
+
+	testNotices := []Notice{
+		Tunnels{Count: 1},
+		Exiting{},
+		AvailableEgressRegions{Regions: []string{"CA", "US"}, Repeats: 2},
+		EstablishTunnelTimeout{Timeout: 5 * time.Minute},
+		ApplicationParameter{Key: "key", Value: json.RawMessage(`{"a":[1,2]}`)},
+		LivenessTest{
+			DiagnosticID: "ID",
+			Metrics:      &LivenessTestMetrics{Duration: "1s", UpstreamBytes: 1},
+			Success:      true,
+		},
+		Info{Message: Message{Message: "message"}},
+		Alert{
+			Message: Message{
+				Message: "message",
+				Trace:   "trace",
+				Fields:  map[string]interface{}{"field": "value"},
+			},
+		},
+		ConnectedServer{
+			DialParameters: DialParameters{
+				DiagnosticID:            "ID",
+				Protocol:                "OSSH",
+				CandidateNumber:         1,
+				MeekTransformedHostName: &transformedHostName,
+				DialDuration:            time.Second,
+				Metrics:                 map[string]interface{}{"metric": 1.0},
+			},
+		},
+		Generic{
+			Type:    "Metric",
+			Version: 1,
+			Data:    map[string]interface{}{"field": "value"},
+		},
+	}
+
+	timestamp := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+
+	for _, notice := range testNotices {
+
+		encodedNotice, err := Encode(notice, timestamp)
+		if err != nil {
+			t.Fatalf("Encode failed: %s", err)
+		}
+
+		decodedNotice, decodedTimestamp, err := Decode(encodedNotice)
+		if err != nil {
+			t.Fatalf("Decode failed: %s", err)
+		}
+
+		if !reflect.DeepEqual(notice, decodedNotice) {
+			t.Fatalf("unexpected decoded notice: %#v != %#v", notice, decodedNotice)
+		}
+
+		if decodedTimestamp != "2020-01-02T03:04:05.006Z" {
+			t.Fatalf("unexpected timestamp: %s", decodedTimestamp)
+		}
+	}
+
+	// Test: extra fields are top-level data fields, and don't override
+	// declared fields.
+
+	encodedNotice, err := Encode(
+		ConnectingServer{
+			DialParameters: DialParameters{
+				DiagnosticID: "ID",
+				Metrics: map[string]interface{}{
+					"diagnosticID": "metric",
+					"metric":       1,
+				},
+			},
+		},
+		timestamp)
+	if err != nil {
+		t.Fatalf("Encode failed: %s", err)
+	}
+
+	var object struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.Unmarshal(encodedNotice, &object)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+	if object.Data["diagnosticID"] != "ID" || object.Data["metric"] != 1.0 {
+		t.Fatalf("unexpected data: %+v", object.Data)
+	}
+}
+
+func TestDecodeVersions(t *testing.T) {
+
+	testCases := []struct {
+		description   string
+		encodedNotice string
+		expected      Notice
+	}{
+		{
+			"no version",
+			`{"noticeType":"Tunnels","data":{"count":1},"timestamp":"2020-01-02T03:04:05.000Z"}`,
+			Tunnels{Count: 1},
+		},
+		{
+			"current version",
+			`{"noticeType":"Tunnels","noticeVersion":1,"data":{"count":1},"timestamp":"2020-01-02T03:04:05.000Z"}`,
+			Tunnels{Count: 1},
+		},
+		{
+			"unknown version",
+			`{"noticeType":"Tunnels","noticeVersion":2,"data":{"count":"1"},"timestamp":"2020-01-02T03:04:05.000Z"}`,
+			Generic{Type: "Tunnels", Version: 2, Data: map[string]interface{}{"count": "1"}},
+		},
+		{
+			"unknown type",
+			`{"noticeType":"Unknown","noticeVersion":1,"data":{"count":1},"timestamp":"2020-01-02T03:04:05.000Z"}`,
+			Generic{Type: "Unknown", Version: 1, Data: map[string]interface{}{"count": 1.0}},
+		},
+		{
+			"no data",
+			`{"noticeType":"Exiting","noticeVersion":1,"timestamp":"2020-01-02T03:04:05.000Z"}`,
+			Exiting{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+			notice, _, err := Decode([]byte(testCase.encodedNotice))
+			if err != nil {
+				t.Fatalf("Decode failed: %s", err)
+			}
+			if !reflect.DeepEqual(notice, testCase.expected) {
+				t.Fatalf("unexpected notice: %#v", notice)
+			}
+		})
+	}
+
+	for _, encodedNotice := range []string{
+		`{"noticeVersion":1,"data":{},"timestamp":"2020-01-02T03:04:05.000Z"}`,
+		`{"noticeType":"Tunnels","noticeVersion":1,"data":{"count":"1"},"timestamp":"2020-01-02T03:04:05.000Z"}`,
+		`not JSON`,
+	} {
+		_, _, err := Decode([]byte(encodedNotice))
+		if err == nil {
+			t.Fatalf("unexpected success: %s", encodedNotice)
+		}
+	}
+}
+
+func TestJSONSchemaFiles(t *testing.T) {
+
+	noticeTypes := make(map[string]bool)
+
+	for _, notice := range GetNoticeTypes() {
+
+		if noticeTypes[notice.NoticeType()] {
+			t.Fatalf("duplicate notice type: %s", notice.NoticeType())
+		}
+		noticeTypes[notice.NoticeType()] = true
+
+		schema, err := JSONSchema(notice)
+		if err != nil {
+			t.Fatalf("JSONSchema failed: %s", err)
+		}
+
+		schemaFile, err := ioutil.ReadFile(
+			filepath.Join("schema", JSONSchemaFilename(notice)))
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+
+		if !bytes.Equal(schema, schemaFile) {
+			t.Fatalf(
+				"schema file for %s is not up to date; run go generate",
+				notice.NoticeType())
+		}
+	}
+
+	schemaFiles, err := filepath.Glob(filepath.Join("schema", "*.json"))
+	if err != nil {
+		t.Fatalf("Glob failed: %s", err)
+	}
+	if len(schemaFiles) != len(noticeTypes) {
+		t.Fatalf("unexpected schema file count: %d", len(schemaFiles))
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package notices
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+//go:generate go run generate.go
+
+// JSONSchemaFilename is the name of the JSON Schema file for the notice
+// type, within the schema directory.
+func JSONSchemaFilename(notice Notice) string {
+	return notice.NoticeType() + ".json"
+}
+
+// JSONSchema returns a JSON Schema, draft-07, describing the encoded notice,
+// including its envelope. The schema is generated from the notice struct
+// type.
+func JSONSchema(notice Notice) ([]byte, error) {
+
+	schema := map[string]interface{}{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title":   notice.NoticeType(),
+		"type":    "object",
+		"properties": map[string]interface{}{
+			"noticeType":    map[string]interface{}{"const": notice.NoticeType()},
+			"noticeVersion": map[string]interface{}{"const": notice.NoticeVersion()},
+			"data":          getJSONSchemaForType(reflect.TypeOf(notice)),
+			"timestamp":     map[string]interface{}{"type": "string", "format": "date-time"},
+		},
+		"required": []string{"noticeType", "noticeVersion", "data", "timestamp"},
+	}
+
+	encodedSchema, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return append(encodedSchema, '\n'), nil
+}
+
+var (
+	durationType   = reflect.TypeOf(time.Duration(0))
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+)
+
+func getJSONSchemaForType(valueType reflect.Type) map[string]interface{} {
+
+	// time.Duration is encoded as an integer number of nanoseconds and
+	// json.RawMessage may be any JSON value.
+
+	switch valueType {
+	case durationType:
+		return map[string]interface{}{"type": "integer"}
+	case rawMessageType:
+		return map[string]interface{}{}
+	}
+
+	switch valueType.Kind() {
+
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+
+	case reflect.Ptr:
+		schema := getJSONSchemaForType(valueType.Elem())
+		if schemaType, ok := schema["type"].(string); ok {
+			schema["type"] = []string{schemaType, "null"}
+		}
+		return schema
+
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  []string{"array", "null"},
+			"items": getJSONSchemaForType(valueType.Elem()),
+		}
+
+	case reflect.Map:
+		schema := map[string]interface{}{"type": []string{"object", "null"}}
+		if valueType.Elem().Kind() != reflect.Interface {
+			schema["additionalProperties"] = getJSONSchemaForType(valueType.Elem())
+		}
+		return schema
+
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		required := make([]string, 0)
+		for _, field := range getJSONFields(valueType) {
+			properties[field.name] = getJSONSchemaForType(field.fieldType)
+			if !field.omitEmpty {
+				required = append(required, field.name)
+			}
+		}
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+			"required":   required,
+		}
+	}
+
+	// Interface values may be any JSON value.
+	return map[string]interface{}{}
+}
@@ -0,0 +1,660 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package notices
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/buildinfo"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+// allNoticeTypes lists all notice types. When adding a notice type, add it
+// here and regenerate the JSON Schema files with "go generate".
+var allNoticeTypes = []Notice{
+	Info{},
+	Warning{},
+	Error{},
+	Alert{},
+	UserLog{},
+	CandidateServers{},
+	AvailableEgressRegions{},
+	ConnectingServer{},
+	ConnectedServer{},
+	RequestingTactics{},
+	RequestedTactics{},
+	ActiveTunnel{},
+	SocksProxyPortInUse{},
+	ListeningSocksProxyPort{},
+	HttpProxyPortInUse{},
+	ListeningHttpProxyPort{},
+	ListeningLocalControlAPI{},
+	ListeningLocalDNSProxy{},
+	ClientUpgradeAvailable{},
+	ClientIsLatestVersion{},
+	Homepage{},
+	ClientRegion{},
+	Tunnels{},
+	SessionId{},
+	Untunneled{},
+	SplitTunnelRegion{},
+	UpstreamProxyError{},
+	ClientUpgradeDownloadedBytes{},
+	ClientUpgradeDownloaded{},
+	BytesTransferred{},
+	TotalBytesTransferred{},
+	LocalProxyBytesTransferred{},
+	LocalProxyError{},
+	BuildInfo{},
+	Exiting{},
+	RemoteServerListResourceDownloadedBytes{},
+	RemoteServerListResourceDownloaded{},
+	SLOKSeeded{},
+	ServerTimestamp{},
+	ActiveAuthorizationIDs{},
+	BindToDevice{},
+	NetworkID{},
+	LivenessTest{},
+	TunnelResumed{},
+	PruneServerEntry{},
+	EstablishTunnelTimeout{},
+	Fragmentor{},
+	MeekHTTP2Streaming{},
+	ApplicationParameter{},
+	ServerAlert{},
+	InternalError{},
+}
+
+// Message is the payload of log message notices. Fields are additional
+// context fields, which are encoded as top-level data fields.
+type Message struct {
+	Message string                 `json:"message"`
+	Trace   string                 `json:"trace,omitempty"`
+	Fields  map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON encodes the message, including Fields.
+func (message Message) MarshalJSON() ([]byte, error) {
+	type fields Message
+	return marshalWithExtraFields(fields(message), message.Fields)
+}
+
+// UnmarshalJSON decodes the message, including Fields.
+func (message *Message) UnmarshalJSON(data []byte) error {
+	type fields Message
+	var value fields
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	value.Fields, err = unmarshalExtraFields(data, value)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	*message = Message(value)
+	return nil
+}
+
+// Info is an informational message. This is a diagnostic notice.
+type Info struct {
+	Message
+}
+
+func (Info) NoticeType() string { return "Info" }
+func (Info) NoticeVersion() int { return 1 }
+
+// Warning is a warning message; typically a recoverable error condition.
+// This is a diagnostic notice.
+type Warning struct {
+	Message
+}
+
+func (Warning) NoticeType() string { return "Warning" }
+func (Warning) NoticeVersion() int { return 1 }
+
+// Error is an error message; typically an unrecoverable error condition.
+// This is a diagnostic notice.
+type Error struct {
+	Message
+}
+
+func (Error) NoticeType() string { return "Error" }
+func (Error) NoticeVersion() int { return 1 }
+
+// Alert is a warning logged by another package via common.Logger. This is a
+// diagnostic notice.
+type Alert struct {
+	Message
+}
+
+func (Alert) NoticeType() string { return "Alert" }
+func (Alert) NoticeVersion() int { return 1 }
+
+// UserLog is a log message from the outer client user of tunnel-core. This
+// is a diagnostic notice.
+type UserLog struct {
+	Message string `json:"message"`
+}
+
+func (UserLog) NoticeType() string { return "UserLog" }
+func (UserLog) NoticeVersion() int { return 1 }
+
+// CandidateServers is how many possible servers are available for the
+// selected region and protocols. This is a diagnostic notice.
+type CandidateServers struct {
+	Region                                    string   `json:"region"`
+	InitialLimitTunnelProtocols               []string `json:"initialLimitTunnelProtocols"`
+	InitialLimitTunnelProtocolsCandidateCount int      `json:"initialLimitTunnelProtocolsCandidateCount"`
+	LimitTunnelProtocols                      []string `json:"limitTunnelProtocols"`
+	ReplayCandidateCount                      int      `json:"replayCandidateCount"`
+	InitialCount                              int      `json:"initialCount"`
+	Count                                     int      `json:"count"`
+}
+
+func (CandidateServers) NoticeType() string { return "CandidateServers" }
+func (CandidateServers) NoticeVersion() int { return 1 }
+
+// AvailableEgressRegions is the sorted list of regions available for
+// egress. Repeats is the number of consecutive repeats of the same list.
+type AvailableEgressRegions struct {
+	Regions []string `json:"regions"`
+	Repeats int      `json:"repeats,omitempty"`
+}
+
+func (AvailableEgressRegions) NoticeType() string { return "AvailableEgressRegions" }
+func (AvailableEgressRegions) NoticeVersion() int { return 1 }
+
+// DialParameters is the payload of notices reporting a server dial. The
+// fields following NetworkType are included only when network parameters
+// are emitted. Metrics are additional, protocol-specific dial metrics,
+// which are encoded as top-level data fields.
+type DialParameters struct {
+	DiagnosticID                   string                 `json:"diagnosticID"`
+	Region                         string                 `json:"region"`
+	Protocol                       string                 `json:"protocol"`
+	IsReplay                       bool                   `json:"isReplay"`
+	CandidateNumber                int                    `json:"candidateNumber"`
+	NetworkType                    string                 `json:"networkType"`
+	BPFProgramName                 string                 `json:"client_bpf,omitempty"`
+	SSHClientVersion               string                 `json:"SSHClientVersion,omitempty"`
+	UpstreamProxyType              string                 `json:"upstreamProxyType,omitempty"`
+	UpstreamProxyCustomHeaderNames string                 `json:"upstreamProxyCustomHeaderNames,omitempty"`
+	FrontingProviderID             string                 `json:"frontingProviderID,omitempty"`
+	MeekDialAddress                string                 `json:"meekDialAddress,omitempty"`
+	MeekResolvedIPAddress          string                 `json:"meekResolvedIPAddress,omitempty"`
+	MeekSNIServerName              string                 `json:"meekSNIServerName,omitempty"`
+	MeekHostHeader                 string                 `json:"meekHostHeader,omitempty"`
+	MeekTransformedHostName        *bool                  `json:"meekTransformedHostName,omitempty"`
+	UserAgent                      string                 `json:"userAgent,omitempty"`
+	TLSProfile                     string                 `json:"TLSProfile,omitempty"`
+	TLSVersion                     string                 `json:"TLSVersion,omitempty"`
+	DialPortNumber                 string                 `json:"dialPortNumber,omitempty"`
+	DialIPVersion                  string                 `json:"dialIPVersion,omitempty"`
+	QUICVersion                    string                 `json:"QUICVersion,omitempty"`
+	QUICDialSNIAddress             string                 `json:"QUICDialSNIAddress,omitempty"`
+	DialDuration                   time.Duration          `json:"dialDuration,omitempty"`
+	NetworkLatencyMultiplier       float64                `json:"networkLatencyMultiplier,omitempty"`
+	MultiHopEntryDiagnosticID      string                 `json:"multiHopEntryDiagnosticID,omitempty"`
+	TunnelResumption               bool                   `json:"tunnelResumption,omitempty"`
+	Metrics                        map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON encodes the dial parameters, including Metrics.
+func (params DialParameters) MarshalJSON() ([]byte, error) {
+	type fields DialParameters
+	return marshalWithExtraFields(fields(params), params.Metrics)
+}
+
+// UnmarshalJSON decodes the dial parameters, including Metrics.
+func (params *DialParameters) UnmarshalJSON(data []byte) error {
+	type fields DialParameters
+	var value fields
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	value.Metrics, err = unmarshalExtraFields(data, value)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	*params = DialParameters(value)
+	return nil
+}
+
+// ConnectingServer reports parameters and details for a single connection
+// attempt. This is a diagnostic notice.
+type ConnectingServer struct {
+	DialParameters
+}
+
+func (ConnectingServer) NoticeType() string { return "ConnectingServer" }
+func (ConnectingServer) NoticeVersion() int { return 1 }
+
+// ConnectedServer reports parameters and details for a single successful
+// connection. This is a diagnostic notice.
+type ConnectedServer struct {
+	DialParameters
+}
+
+func (ConnectedServer) NoticeType() string { return "ConnectedServer" }
+func (ConnectedServer) NoticeVersion() int { return 1 }
+
+// RequestingTactics reports parameters and details for a tactics request
+// attempt. This is a diagnostic notice.
+type RequestingTactics struct {
+	DialParameters
+}
+
+func (RequestingTactics) NoticeType() string { return "RequestingTactics" }
+func (RequestingTactics) NoticeVersion() int { return 1 }
+
+// RequestedTactics reports parameters and details for a successful tactics
+// request. This is a diagnostic notice.
+type RequestedTactics struct {
+	DialParameters
+}
+
+func (RequestedTactics) NoticeType() string { return "RequestedTactics" }
+func (RequestedTactics) NoticeVersion() int { return 1 }
+
+// ActiveTunnel is a successful connection that is used as an active tunnel
+// for port forwarding. This is a diagnostic notice.
+type ActiveTunnel struct {
+	DiagnosticID              string `json:"diagnosticID"`
+	Protocol                  string `json:"protocol"`
+	IsTCS                     bool   `json:"isTCS"`
+	MultiHopEntryDiagnosticID string `json:"multiHopEntryDiagnosticID,omitempty"`
+}
+
+func (ActiveTunnel) NoticeType() string { return "ActiveTunnel" }
+func (ActiveTunnel) NoticeVersion() int { return 1 }
+
+// SocksProxyPortInUse is a failure to use the configured LocalSocksProxyPort.
+type SocksProxyPortInUse struct {
+	Port int `json:"port"`
+}
+
+func (SocksProxyPortInUse) NoticeType() string { return "SocksProxyPortInUse" }
+func (SocksProxyPortInUse) NoticeVersion() int { return 1 }
+
+// ListeningSocksProxyPort is the selected port for the listening local SOCKS
+// proxy.
+type ListeningSocksProxyPort struct {
+	Port int `json:"port"`
+}
+
+func (ListeningSocksProxyPort) NoticeType() string { return "ListeningSocksProxyPort" }
+func (ListeningSocksProxyPort) NoticeVersion() int { return 1 }
+
+// HttpProxyPortInUse is a failure to use the configured LocalHttpProxyPort.
+type HttpProxyPortInUse struct {
+	Port int `json:"port"`
+}
+
+func (HttpProxyPortInUse) NoticeType() string { return "HttpProxyPortInUse" }
+func (HttpProxyPortInUse) NoticeVersion() int { return 1 }
+
+// ListeningHttpProxyPort is the selected port for the listening local HTTP
+// proxy.
+type ListeningHttpProxyPort struct {
+	Port int `json:"port"`
+}
+
+func (ListeningHttpProxyPort) NoticeType() string { return "ListeningHttpProxyPort" }
+func (ListeningHttpProxyPort) NoticeVersion() int { return 1 }
+
+// ListeningLocalControlAPI is the address of the listening local control API.
+type ListeningLocalControlAPI struct {
+	Address string `json:"address"`
+}
+
+func (ListeningLocalControlAPI) NoticeType() string { return "ListeningLocalControlAPI" }
+func (ListeningLocalControlAPI) NoticeVersion() int { return 1 }
+
+// ListeningLocalDNSProxy is the address of the listening local DNS proxy.
+type ListeningLocalDNSProxy struct {
+	Address string `json:"address"`
+}
+
+func (ListeningLocalDNSProxy) NoticeType() string { return "ListeningLocalDNSProxy" }
+func (ListeningLocalDNSProxy) NoticeVersion() int { return 1 }
+
+// ClientUpgradeAvailable is an available client upgrade, as per the
+// handshake.
+type ClientUpgradeAvailable struct {
+	Version string `json:"version"`
+}
+
+func (ClientUpgradeAvailable) NoticeType() string { return "ClientUpgradeAvailable" }
+func (ClientUpgradeAvailable) NoticeVersion() int { return 1 }
+
+// ClientIsLatestVersion reports that an upgrade check was made and the
+// client is already the latest version.
+type ClientIsLatestVersion struct {
+	AvailableVersion string `json:"availableVersion"`
+}
+
+func (ClientIsLatestVersion) NoticeType() string { return "ClientIsLatestVersion" }
+func (ClientIsLatestVersion) NoticeVersion() int { return 1 }
+
+// Homepage is a sponsor homepage, which the client should display.
+type Homepage struct {
+	URL string `json:"url"`
+}
+
+func (Homepage) NoticeType() string { return "Homepage" }
+func (Homepage) NoticeVersion() int { return 1 }
+
+// ClientRegion is the client's region, as determined by the server.
+type ClientRegion struct {
+	Region string `json:"region"`
+}
+
+func (ClientRegion) NoticeType() string { return "ClientRegion" }
+func (ClientRegion) NoticeVersion() int { return 1 }
+
+// Tunnels is how many active tunnels are available. When Count is 0, the
+// core is disconnected.
+type Tunnels struct {
+	Count int `json:"count"`
+}
+
+func (Tunnels) NoticeType() string { return "Tunnels" }
+func (Tunnels) NoticeVersion() int { return 1 }
+
+// SessionId is the session ID used across all tunnels established by the
+// controller. This is a diagnostic notice.
+type SessionId struct {
+	SessionId string `json:"sessionId"`
+}
+
+func (SessionId) NoticeType() string { return "SessionId" }
+func (SessionId) NoticeVersion() int { return 1 }
+
+// Untunneled indicates that an address has been classified as untunneled
+// and is being accessed directly. The address should remain private.
+type Untunneled struct {
+	Address string `json:"address"`
+}
+
+func (Untunneled) NoticeType() string { return "Untunneled" }
+func (Untunneled) NoticeVersion() int { return 1 }
+
+// SplitTunnelRegion reports that split tunnel is on for the given region.
+type SplitTunnelRegion struct {
+	Region string `json:"region"`
+}
+
+func (SplitTunnelRegion) NoticeType() string { return "SplitTunnelRegion" }
+func (SplitTunnelRegion) NoticeVersion() int { return 1 }
+
+// UpstreamProxyError reports an error when connecting to an upstream proxy.
+type UpstreamProxyError struct {
+	Message string `json:"message"`
+}
+
+func (UpstreamProxyError) NoticeType() string { return "UpstreamProxyError" }
+func (UpstreamProxyError) NoticeVersion() int { return 1 }
+
+// ClientUpgradeDownloadedBytes reports client upgrade download progress.
+// This is a diagnostic notice.
+type ClientUpgradeDownloadedBytes struct {
+	Bytes int64 `json:"bytes"`
+}
+
+func (ClientUpgradeDownloadedBytes) NoticeType() string { return "ClientUpgradeDownloadedBytes" }
+func (ClientUpgradeDownloadedBytes) NoticeVersion() int { return 1 }
+
+// ClientUpgradeDownloaded indicates that a client upgrade download is
+// complete and available in the specified file.
+type ClientUpgradeDownloaded struct {
+	Filename string `json:"filename"`
+}
+
+func (ClientUpgradeDownloaded) NoticeType() string { return "ClientUpgradeDownloaded" }
+func (ClientUpgradeDownloaded) NoticeVersion() int { return 1 }
+
+// BytesTransferred reports how many tunneled bytes have been transferred
+// since the last BytesTransferred notice.
+type BytesTransferred struct {
+	DiagnosticID string `json:"diagnosticID"`
+	Sent         int64  `json:"sent"`
+	Received     int64  `json:"received"`
+}
+
+func (BytesTransferred) NoticeType() string { return "BytesTransferred" }
+func (BytesTransferred) NoticeVersion() int { return 1 }
+
+// TotalBytesTransferred reports how many tunneled bytes have been
+// transferred in total. This is a diagnostic notice.
+type TotalBytesTransferred struct {
+	DiagnosticID string `json:"diagnosticID"`
+	Sent         int64  `json:"sent"`
+	Received     int64  `json:"received"`
+}
+
+func (TotalBytesTransferred) NoticeType() string { return "TotalBytesTransferred" }
+func (TotalBytesTransferred) NoticeVersion() int { return 1 }
+
+// LocalProxyBytesTransferred reports how many bytes have been transferred
+// through a local proxy by clients authenticated with a given username.
+type LocalProxyBytesTransferred struct {
+	ProxyType string `json:"proxyType"`
+	Username  string `json:"username"`
+	Sent      int64  `json:"sent"`
+	Received  int64  `json:"received"`
+}
+
+func (LocalProxyBytesTransferred) NoticeType() string { return "LocalProxyBytesTransferred" }
+func (LocalProxyBytesTransferred) NoticeVersion() int { return 1 }
+
+// LocalProxyError reports a local proxy error message. This is a diagnostic
+// notice.
+type LocalProxyError struct {
+	Message string `json:"message"`
+	Repeats int    `json:"repeats,omitempty"`
+}
+
+func (LocalProxyError) NoticeType() string { return "LocalProxyError" }
+func (LocalProxyError) NoticeVersion() int { return 1 }
+
+// BuildInfo reports build version info. This is a diagnostic notice.
+type BuildInfo struct {
+	BuildInfo *buildinfo.BuildInfo `json:"buildInfo"`
+}
+
+func (BuildInfo) NoticeType() string { return "BuildInfo" }
+func (BuildInfo) NoticeVersion() int { return 1 }
+
+// Exiting indicates that tunnel-core is exiting imminently.
+type Exiting struct {
+}
+
+func (Exiting) NoticeType() string { return "Exiting" }
+func (Exiting) NoticeVersion() int { return 1 }
+
+// RemoteServerListResourceDownloadedBytes reports remote server list
+// download progress. This is a diagnostic notice.
+type RemoteServerListResourceDownloadedBytes struct {
+	URL   string `json:"url"`
+	Bytes int64  `json:"bytes"`
+}
+
+func (RemoteServerListResourceDownloadedBytes) NoticeType() string {
+	return "RemoteServerListResourceDownloadedBytes"
+}
+func (RemoteServerListResourceDownloadedBytes) NoticeVersion() int { return 1 }
+
+// RemoteServerListResourceDownloaded indicates that a remote server list
+// download completed successfully. This is a diagnostic notice.
+type RemoteServerListResourceDownloaded struct {
+	URL string `json:"url"`
+}
+
+func (RemoteServerListResourceDownloaded) NoticeType() string {
+	return "RemoteServerListResourceDownloaded"
+}
+func (RemoteServerListResourceDownloaded) NoticeVersion() int { return 1 }
+
+// SLOKSeeded indicates that a SLOK was received from the Psiphon server.
+// This is a diagnostic notice.
+type SLOKSeeded struct {
+	SLOKID    string `json:"slokID"`
+	Duplicate bool   `json:"duplicate"`
+}
+
+func (SLOKSeeded) NoticeType() string { return "SLOKSeeded" }
+func (SLOKSeeded) NoticeVersion() int { return 1 }
+
+// ServerTimestamp reports the server side timestamp as seen in the handshake.
+type ServerTimestamp struct {
+	Timestamp string `json:"timestamp"`
+}
+
+func (ServerTimestamp) NoticeType() string { return "ServerTimestamp" }
+func (ServerTimestamp) NoticeVersion() int { return 1 }
+
+// ActiveAuthorizationIDs reports the authorizations the server has accepted.
+type ActiveAuthorizationIDs struct {
+	IDs []string `json:"IDs"`
+}
+
+func (ActiveAuthorizationIDs) NoticeType() string { return "ActiveAuthorizationIDs" }
+func (ActiveAuthorizationIDs) NoticeVersion() int { return 1 }
+
+// BindToDevice reports a socket bound to a device via the
+// DeviceBinder.
+type BindToDevice struct {
+	DeviceInfo string `json:"deviceInfo"`
+	Repeats    int    `json:"repeats,omitempty"`
+}
+
+func (BindToDevice) NoticeType() string { return "BindToDevice" }
+func (BindToDevice) NoticeVersion() int { return 1 }
+
+// NetworkID reports the current network ID.
+type NetworkID struct {
+	ID      string `json:"ID"`
+	Repeats int    `json:"repeats,omitempty"`
+}
+
+func (NetworkID) NoticeType() string { return "NetworkID" }
+func (NetworkID) NoticeVersion() int { return 1 }
+
+// LivenessTestMetrics are the results of a tunnel liveness test.
+type LivenessTestMetrics struct {
+	Duration                string
+	UpstreamBytes           int
+	SentUpstreamBytes       int
+	DownstreamBytes         int
+	ReceivedDownstreamBytes int
+}
+
+// LivenessTest reports the outcome of a tunnel liveness test. This is a
+// diagnostic notice.
+type LivenessTest struct {
+	DiagnosticID string               `json:"diagnosticID"`
+	Metrics      *LivenessTestMetrics `json:"metrics"`
+	Success      bool                 `json:"success"`
+}
+
+func (LivenessTest) NoticeType() string { return "LivenessTest" }
+func (LivenessTest) NoticeVersion() int { return 1 }
+
+// TunnelResumed reports that a tunnel survived a failure of its network
+// connection. Method is "resumption", when the session was resumed over a
+// new connection, or "migration", when the QUIC connection was migrated to
+// a new local address. This is a diagnostic notice.
+type TunnelResumed struct {
+	DiagnosticID string `json:"diagnosticID"`
+	Method       string `json:"method"`
+}
+
+func (TunnelResumed) NoticeType() string { return "TunnelResumed" }
+func (TunnelResumed) NoticeVersion() int { return 1 }
+
+// PruneServerEntry reports that a server entry was pruned. This is a
+// diagnostic notice.
+type PruneServerEntry struct {
+	ServerEntryTag string `json:"serverEntryTag"`
+}
+
+func (PruneServerEntry) NoticeType() string { return "PruneServerEntry" }
+func (PruneServerEntry) NoticeVersion() int { return 1 }
+
+// EstablishTunnelTimeout reports that the configured EstablishTunnelTimeout
+// duration was exceeded. Timeout is encoded in nanoseconds.
+type EstablishTunnelTimeout struct {
+	Timeout time.Duration `json:"timeout"`
+}
+
+func (EstablishTunnelTimeout) NoticeType() string { return "EstablishTunnelTimeout" }
+func (EstablishTunnelTimeout) NoticeVersion() int { return 1 }
+
+// Fragmentor reports fragmentor activity. This is a diagnostic notice.
+type Fragmentor struct {
+	DiagnosticID string `json:"diagnosticID"`
+	Message      string `json:"message"`
+}
+
+func (Fragmentor) NoticeType() string { return "Fragmentor" }
+func (Fragmentor) NoticeVersion() int { return 1 }
+
+// MeekHTTP2Streaming reports the outcome of an attempt to switch a meek
+// connection to HTTP/2 streaming. When Established is false, Error is the
+// reason and the meek connection continues polling. This is a diagnostic
+// notice.
+type MeekHTTP2Streaming struct {
+	DiagnosticID string `json:"diagnosticID"`
+	Established  bool   `json:"established"`
+	Error        string `json:"error,omitempty"`
+}
+
+func (MeekHTTP2Streaming) NoticeType() string { return "MeekHTTP2Streaming" }
+func (MeekHTTP2Streaming) NoticeVersion() int { return 1 }
+
+// ApplicationParameter is an application parameter key/value, as received
+// in the handshake. Value is arbitrary JSON.
+type ApplicationParameter struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (ApplicationParameter) NoticeType() string { return "ApplicationParameter" }
+func (ApplicationParameter) NoticeVersion() int { return 1 }
+
+// ServerAlert reports a server alert. This is a diagnostic notice.
+type ServerAlert struct {
+	Reason  string `json:"reason"`
+	Subject string `json:"subject"`
+	Repeats int    `json:"repeats,omitempty"`
+}
+
+func (ServerAlert) NoticeType() string { return "ServerAlert" }
+func (ServerAlert) NoticeVersion() int { return 1 }
+
+// InternalError is an error formatting or writing notices.
+type InternalError struct {
+	Message string `json:"message"`
+}
+
+func (InternalError) NoticeType() string { return "InternalError" }
+func (InternalError) NoticeVersion() int { return 1 }
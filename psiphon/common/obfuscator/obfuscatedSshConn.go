@@ -53,6 +53,10 @@ const (
 // determine when to stop obfuscation (after the first SSH_MSG_NEWKEYS is
 // sent and received).
 //
+// In stream mode, there's no SSH protocol parsing and all traffic following
+// the seed message is obfuscated. Stream mode is used to carry a non-SSH
+// protocol, such as tunnel resumption framing, which in turn carries SSH.
+//
 // WARNING: doesn't fully conform to net.Conn concurrency semantics: there's
 // no synchronization of access to the read/writeBuffers, so concurrent
 // calls to one of Read or Write will result in undefined behavior.
@@ -61,8 +65,9 @@ type ObfuscatedSSHConn struct {
 	net.Conn
 	mode            ObfuscatedSSHConnMode
 	obfuscator      *Obfuscator
-	readDeobfuscate func([]byte)
 	writeObfuscate  func([]byte)
+	reader          io.Reader
+	isStream        bool
 	readState       ObfuscatedSSHReadState
 	writeState      ObfuscatedSSHWriteState
 	readBuffer      *bytes.Buffer
@@ -186,8 +191,8 @@ func NewObfuscatedSSHConn(
 		Conn:            conn,
 		mode:            mode,
 		obfuscator:      obfuscator,
-		readDeobfuscate: readDeobfuscate,
 		writeObfuscate:  writeObfuscate,
+		reader:          &deobfuscatingReader{conn: conn, deobfuscate: readDeobfuscate},
 		readState:       OBFUSCATION_READ_STATE_IDENTIFICATION_LINES,
 		writeState:      writeState,
 		readBuffer:      new(bytes.Buffer),
@@ -198,6 +203,19 @@ func NewObfuscatedSSHConn(
 	}, nil
 }
 
+// deobfuscatingReader reads from the underlying conn and deobfuscates the
+// bytes read.
+type deobfuscatingReader struct {
+	conn        net.Conn
+	deobfuscate func([]byte)
+}
+
+func (reader *deobfuscatingReader) Read(buffer []byte) (int, error) {
+	n, err := reader.conn.Read(buffer)
+	reader.deobfuscate(buffer[:n])
+	return n, err
+}
+
 // NewClientObfuscatedSSHConn creates a client ObfuscatedSSHConn. See
 // documentation in NewObfuscatedSSHConn.
 func NewClientObfuscatedSSHConn(
@@ -216,6 +234,28 @@ func NewClientObfuscatedSSHConn(
 		nil)
 }
 
+// NewClientObfuscatedStreamConn creates a client ObfuscatedSSHConn in stream
+// mode. See documentation in NewObfuscatedSSHConn.
+func NewClientObfuscatedStreamConn(
+	conn net.Conn,
+	obfuscationKeyword string,
+	obfuscationPaddingPRNGSeed *prng.Seed,
+	minPadding, maxPadding *int) (*ObfuscatedSSHConn, error) {
+
+	obfuscatedConn, err := NewClientObfuscatedSSHConn(
+		conn,
+		obfuscationKeyword,
+		obfuscationPaddingPRNGSeed,
+		minPadding, maxPadding)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	obfuscatedConn.isStream = true
+
+	return obfuscatedConn, nil
+}
+
 // NewServerObfuscatedSSHConn creates a server ObfuscatedSSHConn. See
 // documentation in NewObfuscatedSSHConn.
 func NewServerObfuscatedSSHConn(
@@ -237,6 +277,33 @@ func NewServerObfuscatedSSHConn(
 		irregularLogger)
 }
 
+// DetectStreamMode reads the first len(streamPrefix) bytes sent by the
+// client and, when they match streamPrefix, switches a server
+// ObfuscatedSSHConn to stream mode. In either case, the bytes read are
+// returned by subsequent Read calls. DetectStreamMode must be called before
+// any Read or Write.
+func (conn *ObfuscatedSSHConn) DetectStreamMode(streamPrefix []byte) (bool, error) {
+
+	if conn.mode != OBFUSCATION_CONN_MODE_SERVER ||
+		conn.readState != OBFUSCATION_READ_STATE_IDENTIFICATION_LINES ||
+		conn.writeState != OBFUSCATION_WRITE_STATE_SERVER_SEND_IDENTIFICATION_LINE_PADDING {
+
+		return false, errors.TraceNew("invalid state")
+	}
+
+	prefix := make([]byte, len(streamPrefix))
+	_, err := io.ReadFull(conn.reader, prefix)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	conn.reader = io.MultiReader(bytes.NewReader(prefix), conn.reader)
+
+	conn.isStream = bytes.Equal(prefix, streamPrefix)
+
+	return conn.isStream, nil
+}
+
 // GetDerivedPRNG creates a new PRNG with a seed derived from the
 // ObfuscatedSSHConn padding seed and distinguished by the salt, which should
 // be a unique identifier for each usage context.
@@ -267,6 +334,13 @@ func (conn *ObfuscatedSSHConn) GetMetrics() common.LogFields {
 // Read wraps standard Read, transparently applying the obfuscation
 // transformations.
 func (conn *ObfuscatedSSHConn) Read(buffer []byte) (int, error) {
+	if conn.isStream {
+		n, err := conn.reader.Read(buffer)
+		if err != nil {
+			err = errors.Trace(err)
+		}
+		return n, err
+	}
 	if conn.readState == OBFUSCATION_READ_STATE_FINISHED {
 		return conn.Conn.Read(buffer)
 	}
@@ -280,6 +354,13 @@ func (conn *ObfuscatedSSHConn) Read(buffer []byte) (int, error) {
 // Write wraps standard Write, transparently applying the obfuscation
 // transformations.
 func (conn *ObfuscatedSSHConn) Write(buffer []byte) (int, error) {
+	if conn.isStream {
+		err := conn.obfuscateAndWrite(buffer)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		return len(buffer), nil
+	}
 	if conn.writeState == OBFUSCATION_WRITE_STATE_FINISHED {
 		return conn.Conn.Write(buffer)
 	}
@@ -341,7 +422,7 @@ func (conn *ObfuscatedSSHConn) readAndTransform(buffer []byte) (int, error) {
 		if conn.readBuffer.Len() == 0 {
 			for {
 				err := readSSHIdentificationLine(
-					conn.Conn, conn.readDeobfuscate, conn.readBuffer)
+					conn.reader, conn.readBuffer)
 				if err != nil {
 					return 0, errors.Trace(err)
 				}
@@ -360,7 +441,7 @@ func (conn *ObfuscatedSSHConn) readAndTransform(buffer []byte) (int, error) {
 	case OBFUSCATION_READ_STATE_KEX_PACKETS:
 		if conn.readBuffer.Len() == 0 {
 			isMsgNewKeys, err := readSSHPacket(
-				conn.Conn, conn.readDeobfuscate, conn.readBuffer)
+				conn.reader, conn.readBuffer)
 			if err != nil {
 				return 0, errors.Trace(err)
 			}
@@ -511,9 +592,32 @@ func (conn *ObfuscatedSSHConn) transformAndWrite(buffer []byte) error {
 	return nil
 }
 
+// obfuscateAndWrite obfuscates and writes bytes in stream mode. The client
+// seed message is sent before the first bytes.
+func (conn *ObfuscatedSSHConn) obfuscateAndWrite(buffer []byte) error {
+
+	if conn.writeState == OBFUSCATION_WRITE_STATE_CLIENT_SEND_SEED_MESSAGE {
+		_, err := conn.Conn.Write(conn.obfuscator.SendSeedMessage())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		conn.writeState = OBFUSCATION_WRITE_STATE_FINISHED
+	}
+
+	// The caller's buffer must not be modified.
+	sendData := make([]byte, len(buffer))
+	copy(sendData, buffer)
+	conn.writeObfuscate(sendData)
+	_, err := conn.Conn.Write(sendData)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
 func readSSHIdentificationLine(
-	conn net.Conn,
-	deobfuscate func([]byte),
+	reader io.Reader,
 	readBuffer *bytes.Buffer) error {
 
 	// TODO: less redundant string searching?
@@ -521,11 +625,10 @@ func readSSHIdentificationLine(
 	var validLine = false
 	readBuffer.Grow(SSH_MAX_SERVER_LINE_LENGTH)
 	for i := 0; i < SSH_MAX_SERVER_LINE_LENGTH; i++ {
-		_, err := io.ReadFull(conn, oneByte[:])
+		_, err := io.ReadFull(reader, oneByte[:])
 		if err != nil {
 			return errors.Trace(err)
 		}
-		deobfuscate(oneByte[:])
 		readBuffer.WriteByte(oneByte[0])
 		if bytes.HasSuffix(readBuffer.Bytes(), []byte("\r\n")) {
 			validLine = true
@@ -539,14 +642,13 @@ func readSSHIdentificationLine(
 }
 
 func readSSHPacket(
-	conn net.Conn,
-	deobfuscate func([]byte),
+	reader io.Reader,
 	readBuffer *bytes.Buffer) (bool, error) {
 
 	prefixOffset := readBuffer.Len()
 
 	readBuffer.Grow(SSH_PACKET_PREFIX_LENGTH)
-	n, err := readBuffer.ReadFrom(io.LimitReader(conn, SSH_PACKET_PREFIX_LENGTH))
+	n, err := readBuffer.ReadFrom(io.LimitReader(reader, SSH_PACKET_PREFIX_LENGTH))
 	if err == nil && n != SSH_PACKET_PREFIX_LENGTH {
 		err = std_errors.New("unxpected number of bytes read")
 	}
@@ -555,7 +657,6 @@ func readSSHPacket(
 	}
 
 	prefix := readBuffer.Bytes()[prefixOffset : prefixOffset+SSH_PACKET_PREFIX_LENGTH]
-	deobfuscate(prefix)
 
 	_, _, payloadLength, messageLength, err := getSSHPacketPrefix(prefix)
 	if err != nil {
@@ -564,7 +665,7 @@ func readSSHPacket(
 
 	remainingReadLength := messageLength - SSH_PACKET_PREFIX_LENGTH
 	readBuffer.Grow(remainingReadLength)
-	n, err = readBuffer.ReadFrom(io.LimitReader(conn, int64(remainingReadLength)))
+	n, err = readBuffer.ReadFrom(io.LimitReader(reader, int64(remainingReadLength)))
 	if err == nil && n != int64(remainingReadLength) {
 		err = std_errors.New("unxpected number of bytes read")
 	}
@@ -572,9 +673,6 @@ func readSSHPacket(
 		return false, errors.Trace(err)
 	}
 
-	remainingBytes := readBuffer.Bytes()[prefixOffset+SSH_PACKET_PREFIX_LENGTH:]
-	deobfuscate(remainingBytes)
-
 	isMsgNewKeys := false
 	if payloadLength > 0 {
 		packetType := int(readBuffer.Bytes()[prefixOffset+SSH_PACKET_PREFIX_LENGTH])
@@ -24,6 +24,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"errors"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -150,14 +151,32 @@ func TestObfuscator(t *testing.T) {
 
 func TestObfuscatedSSHConn(t *testing.T) {
 
+	t.Run("OSSH", func(t *testing.T) {
+		testObfuscatedSSHConn(t, false, false)
+	})
+
+	t.Run("OSSH with stream mode detection", func(t *testing.T) {
+		testObfuscatedSSHConn(t, false, true)
+	})
+
+	t.Run("stream mode", func(t *testing.T) {
+		testObfuscatedSSHConn(t, true, true)
+	})
+}
+
+func testObfuscatedSSHConn(t *testing.T, streamMode, detectStreamMode bool) {
+
 	keyword := prng.HexString(32)
 
-	serverAddress := "127.0.0.1:2222"
+	streamPrefix := []byte("\x00STREAM")
 
-	listener, err := net.Listen("tcp", serverAddress)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatalf("Listen failed: %s", err)
 	}
+	defer listener.Close()
+
+	serverAddress := listener.Addr().String()
 
 	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -184,8 +203,9 @@ func TestObfuscatedSSHConn(t *testing.T) {
 
 		conn, err := listener.Accept()
 
+		var obfuscatedConn *ObfuscatedSSHConn
 		if err == nil {
-			conn, err = NewServerObfuscatedSSHConn(
+			obfuscatedConn, err = NewServerObfuscatedSSHConn(
 				conn,
 				keyword,
 				NewSeedHistory(nil),
@@ -194,13 +214,28 @@ func TestObfuscatedSSHConn(t *testing.T) {
 				})
 		}
 
+		if err == nil && detectStreamMode {
+			var isStream bool
+			isStream, err = obfuscatedConn.DetectStreamMode(streamPrefix)
+			if err == nil && isStream != streamMode {
+				err = errors.New("unexpected stream mode")
+			}
+			if err == nil && isStream {
+				prefix := make([]byte, len(streamPrefix))
+				_, err = io.ReadFull(obfuscatedConn, prefix)
+				if err == nil && !bytes.Equal(prefix, streamPrefix) {
+					err = errors.New("unexpected stream prefix")
+				}
+			}
+		}
+
 		if err == nil {
 			config := &ssh.ServerConfig{
 				NoClientAuth: true,
 			}
 			config.AddHostKey(hostKey)
 
-			_, _, _, err = ssh.NewServerConn(conn, config)
+			_, _, _, err = ssh.NewServerConn(obfuscatedConn, config)
 		}
 
 		if err != nil {
@@ -221,11 +256,22 @@ func TestObfuscatedSSHConn(t *testing.T) {
 		}
 
 		if err == nil {
-			conn, err = NewClientObfuscatedSSHConn(
-				conn,
-				keyword,
-				paddingPRNGSeed,
-				nil, nil)
+			if streamMode {
+				conn, err = NewClientObfuscatedStreamConn(
+					conn,
+					keyword,
+					paddingPRNGSeed,
+					nil, nil)
+				if err == nil {
+					_, err = conn.Write(streamPrefix)
+				}
+			} else {
+				conn, err = NewClientObfuscatedSSHConn(
+					conn,
+					keyword,
+					paddingPRNGSeed,
+					nil, nil)
+			}
 		}
 
 		var KEXPRNGSeed *prng.Seed
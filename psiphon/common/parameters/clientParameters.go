@@ -126,6 +126,7 @@ const (
 	TunnelOperateShutdownTimeout                     = "TunnelOperateShutdownTimeout"
 	TunnelPortForwardDialTimeout                     = "TunnelPortForwardDialTimeout"
 	PacketTunnelReadTimeout                          = "PacketTunnelReadTimeout"
+	PacketTunnelUDPFlowIdleTimeout                   = "PacketTunnelUDPFlowIdleTimeout"
 	TunnelRateLimits                                 = "TunnelRateLimits"
 	AdditionalCustomHeaders                          = "AdditionalCustomHeaders"
 	SpeedTestPaddingMinBytes                         = "SpeedTestPaddingMinBytes"
@@ -142,8 +143,15 @@ const (
 	SSHKeepAliveProbeInactivePeriod                  = "SSHKeepAliveProbeInactivePeriod"
 	SSHKeepAliveNetworkConnectivityPollingPeriod     = "SSHKeepAliveNetworkConnectivityPollingPeriod"
 	SSHKeepAliveResetOnFailureProbability            = "SSHKeepAliveResetOnFailureProbability"
+	TunnelResumptionProbability                      = "TunnelResumptionProbability"
+	TunnelResumptionTimeout                          = "TunnelResumptionTimeout"
+	DatagramChannelProbability                       = "DatagramChannelProbability"
+	DatagramChannelEstablishTimeout                  = "DatagramChannelEstablishTimeout"
+	DatagramChannelKeepAlivePeriod                   = "DatagramChannelKeepAlivePeriod"
+	DatagramChannelIdleTimeout                       = "DatagramChannelIdleTimeout"
 	HTTPProxyOriginServerTimeout                     = "HTTPProxyOriginServerTimeout"
 	HTTPProxyMaxIdleConnectionsPerHost               = "HTTPProxyMaxIdleConnectionsPerHost"
+	SOCKSProxyUDPAssociationIdleTimeout              = "SOCKSProxyUDPAssociationIdleTimeout"
 	FetchRemoteServerListTimeout                     = "FetchRemoteServerListTimeout"
 	FetchRemoteServerListRetryPeriod                 = "FetchRemoteServerListRetryPeriod"
 	FetchRemoteServerListStalePeriod                 = "FetchRemoteServerListStalePeriod"
@@ -164,12 +172,17 @@ const (
 	SplitTunnelRoutesURLFormat                       = "SplitTunnelRoutesURLFormat"
 	SplitTunnelRoutesSignaturePublicKey              = "SplitTunnelRoutesSignaturePublicKey"
 	SplitTunnelDNSServer                             = "SplitTunnelDNSServer"
+	SplitTunnelPolicyReloadPeriod                    = "SplitTunnelPolicyReloadPeriod"
+	TunneledDNSRequestTimeout                        = "TunneledDNSRequestTimeout"
+	TunneledDNSCacheMaxEntries                       = "TunneledDNSCacheMaxEntries"
+	TunneledDNSCacheMaxTTL                           = "TunneledDNSCacheMaxTTL"
 	FetchUpgradeTimeout                              = "FetchUpgradeTimeout"
 	FetchUpgradeRetryPeriod                          = "FetchUpgradeRetryPeriod"
 	FetchUpgradeStalePeriod                          = "FetchUpgradeStalePeriod"
 	UpgradeDownloadURLs                              = "UpgradeDownloadURLs"
 	UpgradeDownloadClientVersionHeader               = "UpgradeDownloadClientVersionHeader"
 	TotalBytesTransferredNoticePeriod                = "TotalBytesTransferredNoticePeriod"
+	LocalProxyBytesTransferredNoticePeriod           = "LocalProxyBytesTransferredNoticePeriod"
 	MeekDialDomainsOnly                              = "MeekDialDomainsOnly"
 	MeekLimitBufferSizes                             = "MeekLimitBufferSizes"
 	MeekCookieMaxPadding                             = "MeekCookieMaxPadding"
@@ -196,8 +209,11 @@ const (
 	MeekMinLimitRequestPayloadLength                 = "MeekMinLimitRequestPayloadLength"
 	MeekMaxLimitRequestPayloadLength                 = "MeekMaxLimitRequestPayloadLength"
 	MeekRedialTLSProbability                         = "MeekRedialTLSProbability"
+	MeekHTTP2StreamingProbability                    = "MeekHTTP2StreamingProbability"
+	MeekHTTP2StreamingEstablishTimeout               = "MeekHTTP2StreamingEstablishTimeout"
 	TransformHostNameProbability                     = "TransformHostNameProbability"
 	PickUserAgentProbability                         = "PickUserAgentProbability"
+	ServerIPv6AddressProbability                     = "ServerIPv6AddressProbability"
 	LivenessTestMinUpstreamBytes                     = "LivenessTestMinUpstreamBytes"
 	LivenessTestMaxUpstreamBytes                     = "LivenessTestMaxUpstreamBytes"
 	LivenessTestMinDownstreamBytes                   = "LivenessTestMinDownstreamBytes"
@@ -220,6 +236,7 @@ const (
 	ReplayLivenessTest                               = "ReplayLivenessTest"
 	ReplayUserAgent                                  = "ReplayUserAgent"
 	ReplayAPIRequestPadding                          = "ReplayAPIRequestPadding"
+	ReplayTunnelResumption                           = "ReplayTunnelResumption"
 	ReplayLaterRoundMoveToFrontProbability           = "ReplayLaterRoundMoveToFrontProbability"
 	ReplayRetainFailedProbability                    = "ReplayRetainFailedProbability"
 	APIRequestUpstreamPaddingMinBytes                = "APIRequestUpstreamPaddingMinBytes"
@@ -285,6 +302,7 @@ var defaultClientParameters = map[string]struct {
 	TunnelOperateShutdownTimeout:             {value: 1 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
 	TunnelPortForwardDialTimeout:             {value: 10 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
 	PacketTunnelReadTimeout:                  {value: 10 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
+	PacketTunnelUDPFlowIdleTimeout:           {value: 60 * time.Second, minimum: 1 * time.Second},
 	TunnelRateLimits:                         {value: common.RateLimits{}},
 
 	// PrioritizeTunnelProtocols parameters are obsoleted by InitialLimitTunnelProtocols.
@@ -365,9 +383,19 @@ var defaultClientParameters = map[string]struct {
 	SSHKeepAliveNetworkConnectivityPollingPeriod: {value: 500 * time.Millisecond, minimum: 1 * time.Millisecond},
 	SSHKeepAliveResetOnFailureProbability:        {value: 0.0, minimum: 0.0},
 
+	TunnelResumptionProbability: {value: 1.0, minimum: 0.0},
+	TunnelResumptionTimeout:     {value: 20 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+
+	DatagramChannelProbability:      {value: 0.0, minimum: 0.0},
+	DatagramChannelEstablishTimeout: {value: 2 * time.Second, minimum: 100 * time.Millisecond, flags: useNetworkLatencyMultiplier},
+	DatagramChannelKeepAlivePeriod:  {value: 10 * time.Second, minimum: 1 * time.Second},
+	DatagramChannelIdleTimeout:      {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+
 	HTTPProxyOriginServerTimeout:       {value: 15 * time.Second, minimum: time.Duration(0), flags: useNetworkLatencyMultiplier},
 	HTTPProxyMaxIdleConnectionsPerHost: {value: 50, minimum: 0},
 
+	SOCKSProxyUDPAssociationIdleTimeout: {value: 60 * time.Second, minimum: 1 * time.Second},
+
 	FetchRemoteServerListTimeout:       {value: 30 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 	FetchRemoteServerListRetryPeriod:   {value: 30 * time.Second, minimum: 1 * time.Millisecond},
 	FetchRemoteServerListStalePeriod:   {value: 6 * time.Hour, minimum: 1 * time.Hour},
@@ -395,6 +423,11 @@ var defaultClientParameters = map[string]struct {
 	SplitTunnelRoutesURLFormat:          {value: ""},
 	SplitTunnelRoutesSignaturePublicKey: {value: ""},
 	SplitTunnelDNSServer:                {value: ""},
+	SplitTunnelPolicyReloadPeriod:       {value: 30 * time.Second, minimum: 1 * time.Second},
+
+	TunneledDNSRequestTimeout:  {value: 10 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
+	TunneledDNSCacheMaxEntries: {value: 1000, minimum: 0},
+	TunneledDNSCacheMaxTTL:     {value: 1 * time.Hour, minimum: 1 * time.Second},
 
 	FetchUpgradeTimeout:                {value: 60 * time.Second, minimum: 1 * time.Second, flags: useNetworkLatencyMultiplier},
 	FetchUpgradeRetryPeriod:            {value: 30 * time.Second, minimum: 1 * time.Millisecond},
@@ -402,7 +435,8 @@ var defaultClientParameters = map[string]struct {
 	UpgradeDownloadURLs:                {value: DownloadURLs{}},
 	UpgradeDownloadClientVersionHeader: {value: ""},
 
-	TotalBytesTransferredNoticePeriod: {value: 5 * time.Minute, minimum: 1 * time.Second},
+	TotalBytesTransferredNoticePeriod:      {value: 5 * time.Minute, minimum: 1 * time.Second},
+	LocalProxyBytesTransferredNoticePeriod: {value: 1 * time.Minute, minimum: 1 * time.Second},
 
 	// The meek server times out inactive sessions after 45 seconds, so this
 	// is a soft max for MeekMaxPollInterval,  MeekRoundTripTimeout, and
@@ -443,9 +477,20 @@ var defaultClientParameters = map[string]struct {
 	MeekMaxLimitRequestPayloadLength: {value: 65536, minimum: 1},
 	MeekRedialTLSProbability:         {value: 0.0, minimum: 0.0},
 
+	// MeekHTTP2StreamingProbability is the probability that a meek
+	// connection which negotiates HTTP/2 will attempt to relay traffic over
+	// a long-lived streaming request instead of polling. The attempt falls
+	// back to polling when the server doesn't accept the stream within
+	// MeekHTTP2StreamingEstablishTimeout.
+
+	MeekHTTP2StreamingProbability:      {value: 0.0, minimum: 0.0},
+	MeekHTTP2StreamingEstablishTimeout: {value: 5 * time.Second, minimum: 1 * time.Millisecond, flags: useNetworkLatencyMultiplier},
+
 	TransformHostNameProbability: {value: 0.5, minimum: 0.0},
 	PickUserAgentProbability:     {value: 0.5, minimum: 0.0},
 
+	ServerIPv6AddressProbability: {value: 0.5, minimum: 0.0},
+
 	LivenessTestMinUpstreamBytes:   {value: 0, minimum: 0},
 	LivenessTestMaxUpstreamBytes:   {value: 0, minimum: 0},
 	LivenessTestMinDownstreamBytes: {value: 0, minimum: 0},
@@ -469,6 +514,7 @@ var defaultClientParameters = map[string]struct {
 	ReplayLivenessTest:                     {value: true},
 	ReplayUserAgent:                        {value: true},
 	ReplayAPIRequestPadding:                {value: true},
+	ReplayTunnelResumption:                 {value: true},
 	ReplayLaterRoundMoveToFrontProbability: {value: 0.0, minimum: 0.0},
 	ReplayRetainFailedProbability:          {value: 0.5, minimum: 0.0},
 
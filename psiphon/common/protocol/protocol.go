@@ -27,6 +27,7 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/transports"
 )
 
 const (
@@ -42,6 +43,9 @@ const (
 	TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH        = "MARIONETTE-OSSH"
 	TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH          = "TAPDANCE-OSSH"
 	TUNNEL_PROTOCOL_CONJOUR_OBFUSCATED_SSH           = "CONJOUR-OSSH"
+	TUNNEL_PROTOCOL_WEBSOCKET                        = "WS-OSSH"
+	TUNNEL_PROTOCOL_WEBSOCKET_TLS                    = "WSS-OSSH"
+	TUNNEL_PROTOCOL_FRONTED_WEBSOCKET_TLS            = "FRONTED-WSS-OSSH"
 
 	SERVER_ENTRY_SOURCE_EMBEDDED   = "EMBEDDED"
 	SERVER_ENTRY_SOURCE_REMOTE     = "REMOTE"
@@ -52,6 +56,9 @@ const (
 
 	CAPABILITY_SSH_API_REQUESTS            = "ssh-api-requests"
 	CAPABILITY_UNTUNNELED_WEB_API_REQUESTS = "handshake"
+	CAPABILITY_TUNNEL_RESUMPTION           = "tunnel-resumption"
+	CAPABILITY_DATAGRAM_CHANNEL            = "datagram-channel"
+	CAPABILITY_TOR_OR_PORT_FORWARDING      = "tor-orport-forwarding"
 
 	CLIENT_CAPABILITY_SERVER_REQUESTS = "server-requests"
 
@@ -61,8 +68,14 @@ const (
 	PSIPHON_API_OSL_REQUEST_NAME       = "psiphon-osl"
 	PSIPHON_API_ALERT_REQUEST_NAME     = "psiphon-alert"
 
-	PSIPHON_API_ALERT_DISALLOWED_TRAFFIC = "disallowed-traffic"
-	PSIPHON_API_ALERT_UNSAFE_TRAFFIC     = "unsafe-traffic"
+	PSIPHON_API_DATAGRAM_CHANNEL_REQUEST_NAME = "psiphon-datagram-channel"
+
+	DATAGRAM_CHANNEL_PURPOSE_UDPGW         = "udpgw"
+	DATAGRAM_CHANNEL_PURPOSE_PACKET_TUNNEL = "packet-tunnel"
+
+	PSIPHON_API_ALERT_DISALLOWED_TRAFFIC  = "disallowed-traffic"
+	PSIPHON_API_ALERT_UNSAFE_TRAFFIC      = "unsafe-traffic"
+	PSIPHON_API_ALERT_DATA_QUOTA_EXCEEDED = "data-quota-exceeded"
 
 	// PSIPHON_API_CLIENT_VERIFICATION_REQUEST_NAME may still be used by older Android clients
 	PSIPHON_API_CLIENT_VERIFICATION_REQUEST_NAME = "psiphon-client-verification"
@@ -76,13 +89,18 @@ const (
 	RANDOM_STREAM_CHANNEL_TYPE = "random@psiphon.ca"
 
 	PSIPHON_API_HANDSHAKE_AUTHORIZATIONS = "authorizations"
+
+	// MEEK_HTTP2_STREAMING_HEADER is set in a meek request to request a
+	// long-lived, bidirectional HTTP/2 stream, and is echoed in the response
+	// when the meek server accepts the stream.
+	MEEK_HTTP2_STREAMING_HEADER = "X-Psiphon-Meek-Stream"
 )
 
 type TunnelProtocols []string
 
 func (t TunnelProtocols) Validate() error {
 	for _, p := range t {
-		if !common.Contains(SupportedTunnelProtocols, p) {
+		if !IsSupportedTunnelProtocol(p) {
 			return errors.Tracef("invalid tunnel protocol: %s", p)
 		}
 	}
@@ -92,7 +110,7 @@ func (t TunnelProtocols) Validate() error {
 func (t TunnelProtocols) PruneInvalid() TunnelProtocols {
 	u := make(TunnelProtocols, 0)
 	for _, p := range t {
-		if common.Contains(SupportedTunnelProtocols, p) {
+		if IsSupportedTunnelProtocol(p) {
 			u = append(u, p)
 		}
 	}
@@ -112,6 +130,54 @@ var SupportedTunnelProtocols = TunnelProtocols{
 	TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH,
 	TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH,
 	TUNNEL_PROTOCOL_CONJOUR_OBFUSCATED_SSH,
+	TUNNEL_PROTOCOL_WEBSOCKET,
+	TUNNEL_PROTOCOL_WEBSOCKET_TLS,
+	TUNNEL_PROTOCOL_FRONTED_WEBSOCKET_TLS,
+}
+
+// GetSupportedTunnelProtocols returns the built-in tunnel protocols,
+// SupportedTunnelProtocols, followed by any tunnel protocols added via the
+// transports registry.
+func GetSupportedTunnelProtocols() TunnelProtocols {
+	supportedProtocols := append(TunnelProtocols(nil), SupportedTunnelProtocols...)
+	for _, p := range transports.TunnelProtocols() {
+		if !common.Contains(supportedProtocols, p) {
+			supportedProtocols = append(supportedProtocols, p)
+		}
+	}
+	return supportedProtocols
+}
+
+// IsSupportedTunnelProtocol indicates if the tunnel protocol is a built-in
+// tunnel protocol or was added via the transports registry.
+func IsSupportedTunnelProtocol(protocol string) bool {
+	return common.Contains(SupportedTunnelProtocols, protocol) ||
+		transports.Get(protocol) != nil
+}
+
+// getAddedTransportProperties returns the transport properties for a tunnel
+// protocol added via the transports registry. The properties of built-in
+// tunnel protocols are defined by the predicates in this package, and nil is
+// returned for built-in and unknown tunnel protocols.
+//
+// For added tunnel protocols, GetCapability, TunnelProtocolUsesTCP,
+// TunnelProtocolIsResourceIntensive,
+// TunnelProtocolIsCompatibleWithFragmentor, TunnelProtocolSupportsReplay,
+// TunnelProtocolSupportsServerIPv6Address, and
+// TunnelProtocolSupportsUpstreamProxy return the registered Properties.
+// TunnelProtocolUsesSSH and TunnelProtocolUsesObfuscatedSSH return true, as
+// all transports carry obfuscated SSH. The remaining predicates identify
+// specific built-in tunnel protocols, such as meek or QUIC variants, and
+// return false for added tunnel protocols.
+func getAddedTransportProperties(protocol string) *transports.Properties {
+	if common.Contains(SupportedTunnelProtocols, protocol) {
+		return nil
+	}
+	transport := transports.Get(protocol)
+	if transport == nil {
+		return nil
+	}
+	return transport.Properties()
 }
 
 var DefaultDisabledTunnelProtocols = TunnelProtocols{
@@ -131,6 +197,9 @@ var SupportedServerEntrySources = TunnelProtocols{
 }
 
 func TunnelProtocolUsesTCP(protocol string) bool {
+	if properties := getAddedTransportProperties(protocol); properties != nil {
+		return properties.UsesTCP
+	}
 	// Limitation: Marionette network protocol depends on its format configuration.
 	return protocol != TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH &&
 		protocol != TUNNEL_PROTOCOL_FRONTED_MEEK_QUIC_OBFUSCATED_SSH &&
@@ -154,18 +223,33 @@ func TunnelProtocolUsesMeek(protocol string) bool {
 func TunnelProtocolUsesFrontedMeek(protocol string) bool {
 	return protocol == TUNNEL_PROTOCOL_FRONTED_MEEK ||
 		protocol == TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP ||
-		protocol == TUNNEL_PROTOCOL_FRONTED_MEEK_QUIC_OBFUSCATED_SSH
+		protocol == TUNNEL_PROTOCOL_FRONTED_MEEK_QUIC_OBFUSCATED_SSH ||
+		protocol == TUNNEL_PROTOCOL_FRONTED_WEBSOCKET_TLS
 }
 
 func TunnelProtocolUsesMeekHTTP(protocol string) bool {
 	return protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK ||
-		protocol == TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP
+		protocol == TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP ||
+		protocol == TUNNEL_PROTOCOL_WEBSOCKET
 }
 
 func TunnelProtocolUsesMeekHTTPS(protocol string) bool {
 	return protocol == TUNNEL_PROTOCOL_FRONTED_MEEK ||
 		protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS ||
-		protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET
+		protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET ||
+		protocol == TUNNEL_PROTOCOL_WEBSOCKET_TLS ||
+		protocol == TUNNEL_PROTOCOL_FRONTED_WEBSOCKET_TLS
+}
+
+// TunnelProtocolUsesWebSocket indicates if the protocol is a meek variant
+// which, instead of polling with HTTP round trips, upgrades its initial meek
+// HTTP request to a WebSocket connection that carries the obfuscated SSH
+// stream. WebSocket protocols are served by the meek server and use the meek
+// dial parameters and meek cookie.
+func TunnelProtocolUsesWebSocket(protocol string) bool {
+	return protocol == TUNNEL_PROTOCOL_WEBSOCKET ||
+		protocol == TUNNEL_PROTOCOL_WEBSOCKET_TLS ||
+		protocol == TUNNEL_PROTOCOL_FRONTED_WEBSOCKET_TLS
 }
 
 func TunnelProtocolUsesObfuscatedSessionTickets(protocol string) bool {
@@ -195,6 +279,9 @@ func TunnelProtocolUsesDarkDecoys(protocol string) bool {
 }
 
 func TunnelProtocolIsResourceIntensive(protocol string) bool {
+	if properties := getAddedTransportProperties(protocol); properties != nil {
+		return properties.IsResourceIntensive
+	}
 	return TunnelProtocolUsesMeek(protocol) ||
 		TunnelProtocolUsesQUIC(protocol) ||
 		TunnelProtocolUsesMarionette(protocol) ||
@@ -202,13 +289,51 @@ func TunnelProtocolIsResourceIntensive(protocol string) bool {
 }
 
 func TunnelProtocolIsCompatibleWithFragmentor(protocol string) bool {
+	if properties := getAddedTransportProperties(protocol); properties != nil {
+		return properties.IsCompatibleWithFragmentor
+	}
 	return protocol == TUNNEL_PROTOCOL_SSH ||
 		protocol == TUNNEL_PROTOCOL_OBFUSCATED_SSH ||
 		protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK ||
 		protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS ||
 		protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET ||
 		protocol == TUNNEL_PROTOCOL_FRONTED_MEEK ||
-		protocol == TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP
+		protocol == TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP ||
+		TunnelProtocolUsesWebSocket(protocol)
+}
+
+// TunnelProtocolSupportsReplay indicates if successful dial parameters for
+// the protocol may be stored and replayed. All built-in protocols support
+// replay.
+func TunnelProtocolSupportsReplay(protocol string) bool {
+	if properties := getAddedTransportProperties(protocol); properties != nil {
+		return properties.IsCompatibleWithReplay
+	}
+	return true
+}
+
+// TunnelProtocolSupportsServerIPv6Address indicates if the protocol's server
+// listener may run on, and its clients may dial, the server IPv6 address.
+// Marionette listens on a fixed set of IPv4 format ports and TapDance
+// traffic arrives via IPv4 stations.
+func TunnelProtocolSupportsServerIPv6Address(protocol string) bool {
+	if properties := getAddedTransportProperties(protocol); properties != nil {
+		return properties.SupportsServerIPv6Address
+	}
+	return !TunnelProtocolUsesMarionette(protocol) &&
+		!TunnelProtocolUsesTapdance(protocol)
+}
+
+// TunnelProtocolSupportsUpstreamProxy indicates if the protocol may be dialed
+// through an upstream proxy.
+//
+// TODO: Marionette UDP formats are incompatible with upstream proxies, but
+// not currently supported.
+func TunnelProtocolSupportsUpstreamProxy(protocol string) bool {
+	if properties := getAddedTransportProperties(protocol); properties != nil {
+		return properties.SupportsUpstreamProxy
+	}
+	return !TunnelProtocolUsesQUIC(protocol)
 }
 
 func TunnelProtocolRequiresTLS12SessionTickets(protocol string) bool {
@@ -220,6 +345,24 @@ func TunnelProtocolSupportsPassthrough(protocol string) bool {
 		protocol == TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET
 }
 
+// TunnelProtocolSupportsMultiHopExit indicates if the protocol may be used to
+// connect to a multi-hop exit server. Exit connections are dialed through an
+// entry server TCP port forward, so only protocols that dial a plain TCP
+// connection to the server are supported.
+func TunnelProtocolSupportsMultiHopExit(protocol string) bool {
+	return protocol == TUNNEL_PROTOCOL_SSH ||
+		protocol == TUNNEL_PROTOCOL_OBFUSCATED_SSH
+}
+
+// TunnelProtocolSupportsResumption indicates if tunnels using the protocol
+// may resume after the underlying connection fails. Resumption requires
+// redialing the same server and an obfuscation layer which conceals the
+// resumption session secret; QUIC-OSSH instead uses QUIC connection
+// migration, and meek protocols have their own session resumption.
+func TunnelProtocolSupportsResumption(protocol string) bool {
+	return protocol == TUNNEL_PROTOCOL_OBFUSCATED_SSH
+}
+
 func UseClientTunnelProtocol(
 	clientProtocol string,
 	serverProtocols TunnelProtocols) bool {
@@ -453,6 +596,21 @@ type AlertRequest struct {
 	Subject string `json:"subject"`
 }
 
+// DatagramChannelRequest requests a datagram channel session, which is to
+// carry either udpgw messages or packet tunnel packets.
+type DatagramChannelRequest struct {
+	Purpose string `json:"purpose"`
+}
+
+// DatagramChannelResponse specifies the server UDP port and the session
+// parameters for a new datagram channel session.
+type DatagramChannelResponse struct {
+	Port           int    `json:"port"`
+	SessionID      []byte `json:"session_id"`
+	SessionKey     []byte `json:"session_key"`
+	ObfuscationKey []byte `json:"obfuscation_key"`
+}
+
 func DeriveSSHServerKEXPRNGSeed(obfuscatedKey string) (*prng.Seed, error) {
 	// By convention, the obfuscatedKey will often be a hex-encoded 32 byte value,
 	// but this isn't strictly required or validated, so we use SHA256 to map the
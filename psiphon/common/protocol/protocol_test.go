@@ -20,9 +20,14 @@
 package protocol
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"reflect"
 	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/transports"
 )
 
 func TestTunnelProtocolValidation(t *testing.T) {
@@ -52,6 +57,170 @@ func TestTunnelProtocolValidation(t *testing.T) {
 	}
 }
 
+func TestTunnelProtocolSupportsMultiHopExit(t *testing.T) {
+
+	// Multi-hop exit connections are dialed through a TCP port forward, so
+	// exit protocols must not require any other network transport.
+
+	exitProtocolCount := 0
+
+	for _, p := range SupportedTunnelProtocols {
+		if !TunnelProtocolSupportsMultiHopExit(p) {
+			continue
+		}
+		exitProtocolCount += 1
+		if !TunnelProtocolUsesTCP(p) ||
+			TunnelProtocolUsesMeek(p) ||
+			TunnelProtocolUsesQUIC(p) ||
+			TunnelProtocolUsesMarionette(p) ||
+			TunnelProtocolUsesTapdance(p) {
+			t.Errorf("unexpected multi-hop exit protocol: %s", p)
+		}
+	}
+
+	if exitProtocolCount == 0 {
+		t.Errorf("no multi-hop exit protocols")
+	}
+}
+
+func TestTunnelProtocolSupportsResumption(t *testing.T) {
+
+	// The resumption preamble, which includes the session secret, must be
+	// sent within an obfuscation layer.
+
+	for _, p := range SupportedTunnelProtocols {
+		if !TunnelProtocolSupportsResumption(p) {
+			continue
+		}
+		if !TunnelProtocolUsesObfuscatedSSH(p) ||
+			TunnelProtocolUsesMeek(p) ||
+			TunnelProtocolUsesQUIC(p) {
+			t.Errorf("unexpected resumption protocol: %s", p)
+		}
+	}
+}
+
+type testTransport struct {
+	properties *transports.Properties
+}
+
+func (t *testTransport) Properties() *transports.Properties {
+	return t.properties
+}
+
+func (t *testTransport) Dial(
+	_ context.Context, _ *transports.DialArgs) (net.Conn, error) {
+	return nil, nil
+}
+
+func (t *testTransport) Listen(_ *transports.ListenArgs) (net.Listener, error) {
+	return nil, nil
+}
+
+type testConditionallyEnabledComponents struct {
+}
+
+func (testConditionallyEnabledComponents) QUICEnabled() bool {
+	return false
+}
+
+func (testConditionallyEnabledComponents) MarionetteEnabled() bool {
+	return false
+}
+
+func (testConditionallyEnabledComponents) TapdanceEnabled() bool {
+	return false
+}
+
+func TestAddedTunnelProtocol(t *testing.T) {
+
+	addedProtocol := "TEST-TRANSPORT-OSSH"
+
+	if IsSupportedTunnelProtocol(addedProtocol) {
+		t.Fatalf("unexpected supported tunnel protocol")
+	}
+
+	// UsesTCP is set and SupportsUpstreamProxy is not, to test that upstream
+	// proxy support is not inferred from UsesTCP.
+
+	transports.Register(
+		addedProtocol,
+		&testTransport{
+			properties: &transports.Properties{
+				Capability:                "TEST-TRANSPORT",
+				UsesTCP:                   true,
+				IsResourceIntensive:       true,
+				IsCompatibleWithReplay:    false,
+				SupportsServerIPv6Address: true,
+				SupportsUpstreamProxy:     false,
+			},
+		})
+
+	// Unregister the test transport so that the test may be repeated, as with
+	// -count, and doesn't affect other tests.
+
+	defer func() {
+		transports.Unregister(addedProtocol)
+		if IsSupportedTunnelProtocol(addedProtocol) ||
+			common.Contains(GetSupportedTunnelProtocols(), addedProtocol) {
+			t.Fatalf("unexpected supported tunnel protocol")
+		}
+	}()
+
+	err := TunnelProtocols{TUNNEL_PROTOCOL_OBFUSCATED_SSH, addedProtocol}.Validate()
+	if err != nil {
+		t.Fatalf("unexpected Validate error: %s", err)
+	}
+
+	if !common.Contains(GetSupportedTunnelProtocols(), addedProtocol) ||
+		common.Contains(SupportedTunnelProtocols, addedProtocol) {
+		t.Fatalf("unexpected supported tunnel protocols")
+	}
+
+	if GetCapability(addedProtocol) != "TEST-TRANSPORT" ||
+		!TunnelProtocolUsesTCP(addedProtocol) ||
+		!TunnelProtocolUsesObfuscatedSSH(addedProtocol) ||
+		TunnelProtocolUsesMeek(addedProtocol) ||
+		!TunnelProtocolIsResourceIntensive(addedProtocol) ||
+		TunnelProtocolIsCompatibleWithFragmentor(addedProtocol) ||
+		TunnelProtocolSupportsReplay(addedProtocol) ||
+		!TunnelProtocolSupportsServerIPv6Address(addedProtocol) ||
+		TunnelProtocolSupportsUpstreamProxy(addedProtocol) {
+		t.Fatalf("unexpected added tunnel protocol properties")
+	}
+
+	// Properties of built-in tunnel protocols are unaffected by the registry.
+
+	if !TunnelProtocolUsesTCP(TUNNEL_PROTOCOL_OBFUSCATED_SSH) ||
+		GetCapability(TUNNEL_PROTOCOL_OBFUSCATED_SSH) != "OSSH" {
+		t.Fatalf("unexpected built-in tunnel protocol properties")
+	}
+
+	serverEntry := &ServerEntry{
+		Capabilities: []string{"OSSH", "TEST-TRANSPORT"},
+	}
+
+	for _, testCase := range []struct {
+		useUpstreamProxy  bool
+		excludeIntensive  bool
+		expectedProtocols []string
+	}{
+		{false, false, []string{TUNNEL_PROTOCOL_OBFUSCATED_SSH, addedProtocol}},
+		{true, false, []string{TUNNEL_PROTOCOL_OBFUSCATED_SSH}},
+		{false, true, []string{TUNNEL_PROTOCOL_OBFUSCATED_SSH}},
+	} {
+		supportedProtocols := serverEntry.GetSupportedProtocols(
+			testConditionallyEnabledComponents{},
+			testCase.useUpstreamProxy,
+			nil,
+			testCase.excludeIntensive)
+
+		if !reflect.DeepEqual(supportedProtocols, testCase.expectedProtocols) {
+			t.Fatalf("unexpected supported protocols: %+v", supportedProtocols)
+		}
+	}
+}
+
 func TestTLSProfileValidation(t *testing.T) {
 
 	// Test: valid profiles
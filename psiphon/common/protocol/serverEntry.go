@@ -46,6 +46,7 @@ import (
 type ServerEntry struct {
 	Tag                           string   `json:"tag"`
 	IpAddress                     string   `json:"ipAddress"`
+	IPv6Address                   string   `json:"ipv6Address"`
 	WebServerPort                 string   `json:"webServerPort"` // not an int
 	WebServerSecret               string   `json:"webServerSecret"`
 	WebServerCertificate          string   `json:"webServerCertificate"`
@@ -61,6 +62,8 @@ type ServerEntry struct {
 	Region                        string   `json:"region"`
 	FrontingProviderID            string   `json:"frontingProviderID"`
 	MeekServerPort                int      `json:"meekServerPort"`
+	WebSocketServerPort           int      `json:"webSocketServerPort"`
+	WebSocketTLSServerPort        int      `json:"webSocketTLSServerPort"`
 	MeekCookieEncryptionPublicKey string   `json:"meekCookieEncryptionPublicKey"`
 	MeekObfuscatedKey             string   `json:"meekObfuscatedKey"`
 	MeekFrontingHost              string   `json:"meekFrontingHost"`
@@ -430,6 +433,9 @@ func NewServerEntrySignatureKeyPair() (string, string, error) {
 // GetCapability returns the server capability corresponding
 // to the tunnel protocol.
 func GetCapability(protocol string) string {
+	if properties := getAddedTransportProperties(protocol); properties != nil {
+		return properties.Capability
+	}
 	return strings.TrimSuffix(protocol, "-OSSH")
 }
 
@@ -481,11 +487,9 @@ func (serverEntry *ServerEntry) GetSupportedProtocols(
 
 	supportedProtocols := make([]string, 0)
 
-	for _, protocol := range SupportedTunnelProtocols {
+	for _, protocol := range GetSupportedTunnelProtocols() {
 
-		// TODO: Marionette UDP formats are incompatible with
-		// useUpstreamProxy, but not currently supported
-		if useUpstreamProxy && TunnelProtocolUsesQUIC(protocol) {
+		if useUpstreamProxy && !TunnelProtocolSupportsUpstreamProxy(protocol) {
 			continue
 		}
 
@@ -547,6 +551,24 @@ func (serverEntry *ServerEntry) SupportsSSHAPIRequests() bool {
 	return serverEntry.hasCapability(CAPABILITY_SSH_API_REQUESTS)
 }
 
+// SupportsTunnelResumption returns true when the server supports resuming
+// tunnels for protocols where TunnelProtocolSupportsResumption is true.
+func (serverEntry *ServerEntry) SupportsTunnelResumption() bool {
+	return serverEntry.hasCapability(CAPABILITY_TUNNEL_RESUMPTION)
+}
+
+// SupportsDatagramChannel returns true when the server supports datagram
+// channels for udpgw messages and packet tunnel packets.
+func (serverEntry *ServerEntry) SupportsDatagramChannel() bool {
+	return serverEntry.hasCapability(CAPABILITY_DATAGRAM_CHANNEL)
+}
+
+// SupportsTorORPortForwarding returns true when the server is a Tor bridge
+// which connects port forwards to its Tor ORPort.
+func (serverEntry *ServerEntry) SupportsTorORPortForwarding() bool {
+	return serverEntry.hasCapability(CAPABILITY_TOR_OR_PORT_FORWARDING)
+}
+
 func (serverEntry *ServerEntry) GetUntunneledWebRequestPorts() []string {
 	ports := make([]string, 0)
 	if serverEntry.hasCapability(CAPABILITY_UNTUNNELED_WEB_API_REQUESTS) {
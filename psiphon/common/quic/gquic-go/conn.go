@@ -7,6 +7,8 @@ import (
 
 type connection interface {
 	Write([]byte) error
+	// [Psiphon]
+	WriteTo([]byte, net.Addr) error
 	Read([]byte) (int, net.Addr, error)
 	Close() error
 	LocalAddr() net.Addr
@@ -24,7 +26,16 @@ type conn struct {
 var _ connection = &conn{}
 
 func (c *conn) Write(p []byte) error {
-	_, err := c.pconn.WriteTo(p, c.currentAddr)
+	// [Psiphon]
+	// currentAddr may be changed concurrently by SetCurrentRemoteAddr.
+	_, err := c.pconn.WriteTo(p, c.RemoteAddr())
+	return err
+}
+
+// [Psiphon]
+// WriteTo writes to an address other than the current remote address.
+func (c *conn) WriteTo(p []byte, addr net.Addr) error {
+	_, err := c.pconn.WriteTo(p, addr)
 	return err
 }
 
@@ -19,6 +19,8 @@ type packer interface {
 	MaybePackAckPacket() (*packedPacket, error)
 	PackRetransmission(packet *ackhandler.Packet) ([]*packedPacket, error)
 	PackConnectionClose(*wire.ConnectionCloseFrame) (*packedPacket, error)
+	// [Psiphon]
+	PackPingPacket() (*packedPacket, error)
 
 	HandleTransportParameters(*handshake.TransportParameters)
 	ChangeDestConnectionID(protocol.ConnectionID)
@@ -142,6 +144,22 @@ func (p *packetPacker) PackConnectionClose(ccf *wire.ConnectionCloseFrame) (*pac
 	}, err
 }
 
+// [Psiphon]
+// PackPingPacket packs a packet that ONLY contains a PingFrame. The peer
+// acknowledges the packet, which is used to validate a new peer address.
+func (p *packetPacker) PackPingPacket() (*packedPacket, error) {
+	frames := []wire.Frame{&wire.PingFrame{}}
+	encLevel, sealer := p.cryptoSetup.GetSealer()
+	header := p.getHeader(encLevel)
+	raw, err := p.writeAndSealPacket(header, frames, sealer)
+	return &packedPacket{
+		header:          header,
+		raw:             raw,
+		frames:          frames,
+		encryptionLevel: encLevel,
+	}, err
+}
+
 func (p *packetPacker) MaybePackAckPacket() (*packedPacket, error) {
 	ack := p.acks.GetAckFrame()
 	if ack == nil {
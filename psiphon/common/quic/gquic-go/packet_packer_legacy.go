@@ -87,6 +87,22 @@ func (p *packetPackerLegacy) PackConnectionClose(ccf *wire.ConnectionCloseFrame)
 	}, err
 }
 
+// [Psiphon]
+// PackPingPacket packs a packet that ONLY contains a PingFrame. The peer
+// acknowledges the packet, which is used to validate a new peer address.
+func (p *packetPackerLegacy) PackPingPacket() (*packedPacket, error) {
+	frames := []wire.Frame{&wire.PingFrame{}}
+	encLevel, sealer := p.cryptoSetup.GetSealer()
+	header := p.getHeader(encLevel)
+	raw, err := p.writeAndSealPacket(header, frames, sealer)
+	return &packedPacket{
+		header:          header,
+		raw:             raw,
+		frames:          frames,
+		encryptionLevel: encLevel,
+	}, err
+}
+
 func (p *packetPackerLegacy) MaybePackAckPacket() (*packedPacket, error) {
 	ack := p.acks.GetAckFrame()
 	if ack == nil {
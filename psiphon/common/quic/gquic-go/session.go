@@ -66,6 +66,13 @@ var (
 	newCryptoSetupClient = handshake.NewCryptoSetupClient
 )
 
+// [Psiphon]
+// Client migration path validation limits; see validateMigration.
+const (
+	migrationAmplificationFactor  = 3
+	migrationMinChallengeInterval = 100 * time.Millisecond
+)
+
 type closeError struct {
 	err       error
 	remote    bool
@@ -136,6 +143,15 @@ type session struct {
 
 	peerParams *handshake.TransportParameters
 
+	// [Psiphon]
+	// Client migration path validation state; see validateMigration.
+	migrationAddr          net.Addr
+	migrationChallenge     protocol.PacketNumber
+	migrationChallengeSent bool
+	migrationChallengeTime time.Time
+	migrationBytesReceived protocol.ByteCount
+	migrationBytesSent     protocol.ByteCount
+
 	timer *utils.Timer
 	// keepAlivePingSent stores whether a Ping frame was sent to the peer or not
 	// it is reset as soon as we receive a packet from the peer
@@ -681,6 +697,22 @@ func (s *session) handlePacketImpl(p *receivedPacket) error {
 		}
 	}
 
+	// [Psiphon]
+	// Support client connection migration, as Psiphon clients may move to a
+	// new local address when the network changes. After decrypting, so the
+	// packet is not attacker-controlled, validate the client's new address.
+	// Only the most recent packet is considered, so that delayed packets
+	// from the old address don't trigger validation.
+	if s.perspective == protocol.PerspectiveServer &&
+		s.handshakeComplete &&
+		p.remoteAddr != nil &&
+		hdr.PacketNumber > s.largestRcvdPacketNumber &&
+		!isSameAddr(p.remoteAddr, s.conn.RemoteAddr()) {
+
+		s.validateMigration(
+			p.remoteAddr, protocol.ByteCount(len(hdr.Raw)+len(p.data)))
+	}
+
 	s.lastRcvdPacketNumber = hdr.PacketNumber
 	// Only do this after decrypting, so we are sure the packet is not attacker-controlled
 	s.largestRcvdPacketNumber = utils.MaxPacketNumber(s.largestRcvdPacketNumber, hdr.PacketNumber)
@@ -697,6 +729,93 @@ func (s *session) handlePacketImpl(p *receivedPacket) error {
 	return s.handleFrames(packet.frames, packet.encryptionLevel)
 }
 
+// [Psiphon]
+// validateMigration performs path validation for a new client address.
+//
+// The source address of an authenticated packet may still be spoofed, by an
+// on-path attacker which rewrites or races the packet. So the server doesn't
+// switch to sending to the new address until the client acknowledges a PING
+// packet sent only to the new address; until then, all other packets are
+// sent to the current, validated address.
+//
+// The gQUIC frame format has no PATH_CHALLENGE frame, so the challenge is
+// the packet number of the PING packet, which the client can acknowledge
+// only if it receives the packet. To limit amplification, the bytes sent to
+// an unvalidated address are limited to a multiple of the bytes received
+// from it, and challenges are retransmitted at most once per RTT.
+func (s *session) validateMigration(addr net.Addr, packetSize protocol.ByteCount) {
+
+	if s.migrationAddr == nil || !isSameAddr(addr, s.migrationAddr) {
+		s.migrationAddr = addr
+		s.migrationChallengeSent = false
+		s.migrationBytesReceived = 0
+		s.migrationBytesSent = 0
+	}
+
+	s.migrationBytesReceived += packetSize
+
+	if s.migrationChallengeSent &&
+		time.Since(s.migrationChallengeTime) < utils.MaxDuration(
+			s.rttStats.SmoothedOrInitialRTT(), migrationMinChallengeInterval) {
+		return
+	}
+
+	if s.migrationBytesSent >= migrationAmplificationFactor*s.migrationBytesReceived {
+		return
+	}
+
+	packet, err := s.packer.PackPingPacket()
+	if err != nil {
+		s.logger.Debugf("Packing migration challenge failed: %s", err)
+		return
+	}
+	defer putPacketBuffer(&packet.raw)
+
+	s.sentPacketHandler.SentPacket(packet.ToAckHandlerPacket())
+	s.logPacket(packet)
+
+	// A failure to write to the new address doesn't affect the session,
+	// which continues sending to the current address.
+	err = s.conn.WriteTo(packet.raw, addr)
+	if err != nil {
+		s.logger.Debugf("Sending migration challenge failed: %s", err)
+	}
+
+	s.migrationChallenge = packet.header.PacketNumber
+	s.migrationChallengeSent = true
+	s.migrationChallengeTime = time.Now()
+	s.migrationBytesSent += protocol.ByteCount(len(packet.raw))
+}
+
+// [Psiphon]
+// checkMigrationChallenge completes path validation when the client
+// acknowledges the migration challenge, switching to sending to the client's
+// new address.
+func (s *session) checkMigrationChallenge(frame *wire.AckFrame) {
+
+	if !s.migrationChallengeSent || !frame.AcksPacket(s.migrationChallenge) {
+		return
+	}
+
+	s.logger.Debugf("Client migrated to %s", s.migrationAddr.String())
+	s.conn.SetCurrentRemoteAddr(s.migrationAddr)
+	s.rttStats.OnConnectionMigration()
+
+	s.migrationAddr = nil
+	s.migrationChallengeSent = false
+}
+
+// [Psiphon]
+// isSameAddr avoids allocating address strings for the common UDP case.
+func isSameAddr(a, b net.Addr) bool {
+	udpA, okA := a.(*net.UDPAddr)
+	udpB, okB := b.(*net.UDPAddr)
+	if okA && okB {
+		return udpA.Port == udpB.Port && udpA.IP.Equal(udpB.IP) && udpA.Zone == udpB.Zone
+	}
+	return a.String() == b.String()
+}
+
 func (s *session) handleFrames(fs []wire.Frame, encLevel protocol.EncryptionLevel) error {
 	for _, ff := range fs {
 		var err error
@@ -836,6 +955,10 @@ func (s *session) handleAckFrame(frame *wire.AckFrame, encLevel protocol.Encrypt
 	if err := s.sentPacketHandler.ReceivedAck(frame, s.lastRcvdPacketNumber, encLevel, s.lastNetworkActivityTime); err != nil {
 		return err
 	}
+	// [Psiphon]
+	if s.perspective == protocol.PerspectiveServer {
+		s.checkMigrationChallenge(frame)
+	}
 	s.receivedPacketHandler.IgnoreBelow(s.sentPacketHandler.GetLowestPacketNotConfirmedAcked())
 	return nil
 }
@@ -202,10 +202,18 @@ func Dial(
 		return nil, errors.Tracef("unsupported version: %s", negotiateQUICVersion)
 	}
 
+	var migratableConn *migratablePacketConn
+
 	if isObfuscated(negotiateQUICVersion) {
+
+		// Migration is supported only for obfuscated QUIC: the server
+		// identifies the obfuscation mode of a flow by client address, and
+		// treats packets from a new address as obfuscated.
+		migratableConn = newMigratablePacketConn(packetConn)
+
 		var err error
 		packetConn, err = NewObfuscatedPacketConn(
-			packetConn, false, obfuscationKey, obfuscationPaddingSeed)
+			migratableConn, false, obfuscationKey, obfuscationPaddingSeed)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -240,9 +248,10 @@ func Dial(
 
 		resultChannel <- dialResult{
 			conn: &Conn{
-				packetConn: packetConn,
-				session:    session,
-				stream:     stream,
+				packetConn:     packetConn,
+				migratableConn: migratableConn,
+				session:        session,
+				stream:         stream,
 			},
 		}
 	}()
@@ -269,8 +278,9 @@ func Dial(
 
 // Conn is a net.Conn and psiphon/common.Closer.
 type Conn struct {
-	packetConn net.PacketConn
-	session    quicSession
+	packetConn     net.PacketConn
+	migratableConn *migratablePacketConn
+	session        quicSession
 
 	deferredAcceptStream bool
 
@@ -284,6 +294,28 @@ type Conn struct {
 	isClosed int32
 }
 
+// Migrate moves a dialed QUIC connection to a new packet conn, with a new
+// local address, without interrupting the QUIC session; for example, after
+// the client network has changed. The previous packet conn is closed. The
+// server switches to sending to the new address once it receives a packet
+// sent from the new address and then validates the new address, which takes
+// a round trip.
+//
+// Migrate is supported only for client connections using the
+// QUIC_VERSION_OBFUSCATED version; otherwise, Migrate returns an error and
+// packetConn is closed.
+func (conn *Conn) Migrate(packetConn net.PacketConn) error {
+	if conn.migratableConn == nil {
+		packetConn.Close()
+		return errors.TraceNew("migration not supported")
+	}
+	err := conn.migratableConn.migrate(packetConn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
 func (conn *Conn) doDeferredAcceptStream() error {
 	conn.acceptMutex.Lock()
 	defer conn.acceptMutex.Unlock()
@@ -414,6 +446,91 @@ func (conn *Conn) SetWriteDeadline(t time.Time) error {
 	return conn.stream.SetWriteDeadline(t)
 }
 
+// migratablePacketConn is a net.PacketConn with a replaceable underlying
+// packet conn. A ReadFrom blocked on the previous packet conn when it's
+// replaced continues reading from the new packet conn, so the QUIC session
+// read loop isn't interrupted.
+type migratablePacketConn struct {
+	mutex      sync.Mutex
+	packetConn net.PacketConn
+	isClosed   bool
+}
+
+func newMigratablePacketConn(packetConn net.PacketConn) *migratablePacketConn {
+	return &migratablePacketConn{packetConn: packetConn}
+}
+
+func (conn *migratablePacketConn) getPacketConn() net.PacketConn {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.packetConn
+}
+
+func (conn *migratablePacketConn) migrate(packetConn net.PacketConn) error {
+	conn.mutex.Lock()
+	if conn.isClosed {
+		conn.mutex.Unlock()
+		packetConn.Close()
+		return errors.TraceNew("closed")
+	}
+	previousPacketConn := conn.packetConn
+	conn.packetConn = packetConn
+	conn.mutex.Unlock()
+
+	// Interrupts any ReadFrom blocked on previousPacketConn.
+	previousPacketConn.Close()
+
+	return nil
+}
+
+func (conn *migratablePacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		packetConn := conn.getPacketConn()
+
+		n, addr, err := packetConn.ReadFrom(p)
+		if err != nil && n == 0 {
+			conn.mutex.Lock()
+			migrated := !conn.isClosed && conn.packetConn != packetConn
+			conn.mutex.Unlock()
+			if migrated {
+				continue
+			}
+		}
+
+		// Do not wrap any err returned by packetConn.ReadFrom.
+		return n, addr, err
+	}
+}
+
+func (conn *migratablePacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	// Do not wrap any err returned by packetConn.WriteTo.
+	return conn.getPacketConn().WriteTo(p, addr)
+}
+
+func (conn *migratablePacketConn) Close() error {
+	conn.mutex.Lock()
+	conn.isClosed = true
+	packetConn := conn.packetConn
+	conn.mutex.Unlock()
+	return packetConn.Close()
+}
+
+func (conn *migratablePacketConn) LocalAddr() net.Addr {
+	return conn.getPacketConn().LocalAddr()
+}
+
+func (conn *migratablePacketConn) SetDeadline(t time.Time) error {
+	return conn.getPacketConn().SetDeadline(t)
+}
+
+func (conn *migratablePacketConn) SetReadDeadline(t time.Time) error {
+	return conn.getPacketConn().SetReadDeadline(t)
+}
+
+func (conn *migratablePacketConn) SetWriteDeadline(t time.Time) error {
+	return conn.getPacketConn().SetWriteDeadline(t)
+}
+
 // QUICTransporter implements the psiphon.transporter interface, used in
 // psiphon.MeekConn for HTTP requests, which requires a RoundTripper and
 // CloseIdleConnections.
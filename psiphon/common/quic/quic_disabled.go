@@ -56,6 +56,16 @@ func Dial(
 	return nil, errors.TraceNew("operation is not enabled")
 }
 
+// Conn is a stub; Dial never returns a Conn when QUIC is disabled.
+type Conn struct {
+	net.Conn
+}
+
+func (conn *Conn) Migrate(packetConn net.PacketConn) error {
+	packetConn.Close()
+	return errors.TraceNew("operation is not enabled")
+}
+
 type QUICTransporter struct {
 }
 
@@ -33,6 +33,7 @@ import (
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -340,3 +341,95 @@ func getFunctionName(pc uintptr) string {
 	}
 	return funcName
 }
+
+func TestQUICMigration(t *testing.T) {
+
+	obfuscationKey := prng.HexString(32)
+
+	listener, err := Listen(nil, "127.0.0.1:0", obfuscationKey)
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	serverAddress := listener.Addr().String()
+
+	serverConns := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		serverConns <- conn
+		_, _ = io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	remoteAddr, err := net.ResolveUDPAddr("udp", serverAddress)
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr failed: %s", err)
+	}
+
+	packetConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+
+	obfuscationPaddingSeed, err := prng.NewSeed()
+	if err != nil {
+		t.Fatalf("NewSeed failed: %s", err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancelFunc()
+
+	conn, err := Dial(
+		ctx,
+		packetConn,
+		remoteAddr,
+		serverAddress,
+		protocol.QUIC_VERSION_OBFUSCATED,
+		obfuscationKey,
+		obfuscationPaddingSeed)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	echo := func() {
+		b := prng.Padding(65536, 65536)
+		_, err := conn.Write(b)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		_, err = io.ReadFull(conn, b)
+		if err != nil {
+			t.Fatalf("ReadFull failed: %s", err)
+		}
+	}
+
+	echo()
+
+	serverConn := <-serverConns
+
+	if serverConn.RemoteAddr().String() != packetConn.LocalAddr().String() {
+		t.Fatalf("unexpected server remote address: %s", serverConn.RemoteAddr())
+	}
+
+	migratedPacketConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+
+	err = conn.(*Conn).Migrate(migratedPacketConn)
+	if err != nil {
+		t.Fatalf("Migrate failed: %s", err)
+	}
+
+	echo()
+
+	if serverConn.RemoteAddr().String() != migratedPacketConn.LocalAddr().String() {
+		t.Fatalf("unexpected server remote address: %s", serverConn.RemoteAddr())
+	}
+}
@@ -0,0 +1,1007 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+Package resumption implements a reliable stream over a replaceable network
+connection. When the underlying connection fails, the client dials a new
+connection and resumes the session, and any data that was sent but not
+acknowledged is retransmitted. Applications using the stream, such as an SSH
+client and server, see no interruption beyond a delay.
+
+This is the same concept as meek session resumption, where a meek session
+spans many HTTP requests, each of which may fail and be retried. Here, a
+session spans a sequence of stream connections.
+
+A client opens a connection with a preamble:
+
+	magic     [8]byte   PREAMBLE_MAGIC
+	type      byte      1: new session, 2: resume session
+	sessionID [16]byte  random session ID
+	secret    [32]byte  random session secret
+	received  uint64    total bytes received by the client in the session
+
+The server responds with:
+
+	status    byte      0: OK, 1: rejected
+	received  uint64    total bytes received by the server in the session
+
+Then both peers send frames:
+
+	data      byte(1), uint16 payload length, payload
+	ack       byte(2), uint64 total bytes consumed by the application
+	close     byte(3)
+
+A close frame ends the session, and distinguishes closing the Conn from
+failure of the underlying connection, which the peer can't otherwise
+detect.
+
+The preamble magic starts with a 0 byte, so the server can distinguish
+preambles from SSH streams, which start with "SSH-", and accept both.
+
+The preamble isn't encrypted or authenticated by this package, so the
+underlying connection must provide confidentiality; for example, an
+obfuscated SSH conn in stream mode. The session secret isn't bound to any
+keys of the application protocol, so anyone who can recover the preamble,
+such as an observer with the obfuscation key, can resume the session and
+take over the underlying connection. Applications should not rely on
+resumption for confidentiality or integrity; SSH, for example, continues
+to protect the stream.
+*/
+package resumption
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	std_errors "errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+const (
+	PREAMBLE_MAGIC         = "\x00PSIRSM1"
+	SESSION_ID_SIZE        = 16
+	SECRET_SIZE            = 32
+	MAX_FRAME_PAYLOAD_SIZE = 16384
+	MAX_SEND_BUFFER_SIZE   = 262144
+	ACK_THRESHOLD          = 65536
+	DEFAULT_RESUME_TIMEOUT = 20 * time.Second
+	RESUME_RETRY_DELAY     = 1 * time.Second
+	CLOSE_FRAME_TIMEOUT    = 1 * time.Second
+	READ_BUFFER_SIZE       = 32768
+	preambleTypeNew        = 1
+	preambleTypeResume     = 2
+	responseStatusOK       = 0
+	responseStatusRejected = 1
+	frameTypeData          = 1
+	frameTypeAck           = 2
+	frameTypeClose         = 3
+	preambleSize           = len(PREAMBLE_MAGIC) + 1 + SESSION_ID_SIZE + SECRET_SIZE + 8
+	responseSize           = 1 + 8
+	dataFrameHeaderSize    = 1 + 2
+	ackFrameSize           = 1 + 8
+)
+
+var errSessionRejected = std_errors.New("session rejected")
+
+// ClientConfig specifies the behavior of a client Conn.
+type ClientConfig struct {
+
+	// Dial establishes a new underlying connection, to the same server, for
+	// resuming the session. The connection must provide the same
+	// obfuscation layer as the initial connection. Dial must respect ctx
+	// cancellation.
+	Dial func(ctx context.Context) (net.Conn, error)
+
+	// ResumeTimeout is the maximum time to spend resuming the session after
+	// the underlying connection fails. When the session isn't resumed in
+	// time, the Conn is closed. The default is DEFAULT_RESUME_TIMEOUT.
+	ResumeTimeout time.Duration
+
+	// OnResumed is an optional callback which is invoked after the session
+	// has been resumed.
+	OnResumed func()
+}
+
+// Conn is a resumable net.Conn and common.Closer.
+//
+// Read and Write are unaffected by failures of the underlying connection:
+// writes are buffered, up to MAX_SEND_BUFFER_SIZE unacknowledged bytes,
+// and reads block, until the session is resumed or the resume timeout
+// expires.
+type Conn struct {
+	isClient      bool
+	sessionID     [SESSION_ID_SIZE]byte
+	secret        [SECRET_SIZE]byte
+	resumeTimeout time.Duration
+	dial          func(ctx context.Context) (net.Conn, error)
+	onResumed     func()
+	sessions      *Sessions
+	runCtx        context.Context
+	stopRunning   context.CancelFunc
+	signalAck     chan struct{}
+
+	// writeCallMutex serializes Write calls and frameMutex serializes frame
+	// writes to the underlying connection. frameMutex is never held while
+	// waiting on cond.
+	writeCallMutex sync.Mutex
+	frameMutex     sync.Mutex
+
+	mutex            sync.Mutex
+	cond             *sync.Cond
+	underlying       net.Conn
+	generation       int
+	resumeTimer      *time.Timer
+	isClosed         bool
+	closeErr         error
+	readBuffer       []byte
+	receivedOffset   uint64
+	consumedOffset   uint64
+	ackedOffset      uint64
+	sendBuffer       []byte
+	sendBufferOffset uint64
+}
+
+func newConn(
+	isClient bool,
+	sessionID [SESSION_ID_SIZE]byte,
+	secret [SECRET_SIZE]byte,
+	resumeTimeout time.Duration) *Conn {
+
+	if resumeTimeout <= 0 {
+		resumeTimeout = DEFAULT_RESUME_TIMEOUT
+	}
+
+	runCtx, stopRunning := context.WithCancel(context.Background())
+
+	conn := &Conn{
+		isClient:      isClient,
+		sessionID:     sessionID,
+		secret:        secret,
+		resumeTimeout: resumeTimeout,
+		runCtx:        runCtx,
+		stopRunning:   stopRunning,
+		signalAck:     make(chan struct{}, 1),
+	}
+	conn.cond = sync.NewCond(&conn.mutex)
+
+	go conn.sendAcks()
+
+	return conn
+}
+
+// NewClientConn starts a new session over the underlying connection, conn.
+// NewClientConn sends the preamble but doesn't wait for the server response,
+// so no round trip is added to the connection establishment. The returned
+// Conn takes ownership of conn.
+func NewClientConn(conn net.Conn, config *ClientConfig) (*Conn, error) {
+
+	if config.Dial == nil {
+		return nil, errors.TraceNew("missing dial")
+	}
+
+	randomBytes, err := common.MakeSecureRandomBytes(SESSION_ID_SIZE + SECRET_SIZE)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var sessionID [SESSION_ID_SIZE]byte
+	var secret [SECRET_SIZE]byte
+	copy(sessionID[:], randomBytes)
+	copy(secret[:], randomBytes[SESSION_ID_SIZE:])
+
+	resumableConn := newConn(true, sessionID, secret, config.ResumeTimeout)
+	resumableConn.dial = config.Dial
+	resumableConn.onResumed = config.OnResumed
+
+	_, err = conn.Write(resumableConn.makePreamble(preambleTypeNew, 0))
+	if err != nil {
+		resumableConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	// The server response is read by the frame reader, before the first
+	// frame.
+	err = resumableConn.attach(conn, 0, 0, false, true)
+	if err != nil {
+		resumableConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return resumableConn, nil
+}
+
+func (conn *Conn) makePreamble(preambleType byte, receivedOffset uint64) []byte {
+	preamble := make([]byte, 0, preambleSize)
+	preamble = append(preamble, PREAMBLE_MAGIC...)
+	preamble = append(preamble, preambleType)
+	preamble = append(preamble, conn.sessionID[:]...)
+	preamble = append(preamble, conn.secret[:]...)
+	var offset [8]byte
+	binary.BigEndian.PutUint64(offset[:], receivedOffset)
+	return append(preamble, offset[:]...)
+}
+
+func makeResponse(status byte, receivedOffset uint64) []byte {
+	response := make([]byte, responseSize)
+	response[0] = status
+	binary.BigEndian.PutUint64(response[1:], receivedOffset)
+	return response
+}
+
+func readResponse(underlying net.Conn) (uint64, error) {
+	var response [responseSize]byte
+	_, err := io.ReadFull(underlying, response[:])
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if response[0] != responseStatusOK {
+		return 0, errors.Trace(errSessionRejected)
+	}
+	return binary.BigEndian.Uint64(response[1:]), nil
+}
+
+// attach makes underlying the current underlying connection, replacing and
+// closing any existing underlying connection, and retransmits all
+// unacknowledged data. peerReceivedOffset is the total bytes received by
+// the peer. When generation is > 0, attach fails if another underlying
+// connection was attached or failed since the caller observed generation.
+func (conn *Conn) attach(
+	underlying net.Conn,
+	peerReceivedOffset uint64,
+	generation int,
+	writeResponse bool,
+	readResponse bool) error {
+
+	conn.frameMutex.Lock()
+	defer conn.frameMutex.Unlock()
+
+	conn.mutex.Lock()
+
+	if conn.isClosed || (generation > 0 && generation != conn.generation) {
+		conn.mutex.Unlock()
+		underlying.Close()
+		return errors.TraceNew("session changed")
+	}
+
+	sendBufferEnd := conn.sendBufferOffset + uint64(len(conn.sendBuffer))
+	if peerReceivedOffset < conn.sendBufferOffset ||
+		peerReceivedOffset > sendBufferEnd {
+
+		conn.mutex.Unlock()
+		underlying.Close()
+		err := errors.Tracef(
+			"unexpected peer received offset: %d, %d, %d",
+			peerReceivedOffset, conn.sendBufferOffset, sendBufferEnd)
+		conn.closeWithError(err)
+		return err
+	}
+	conn.trimSendBuffer(peerReceivedOffset)
+
+	previousUnderlying := conn.underlying
+	conn.underlying = underlying
+	conn.generation += 1
+	generation = conn.generation
+
+	if conn.resumeTimer != nil {
+		conn.resumeTimer.Stop()
+		conn.resumeTimer = nil
+	}
+
+	// The response reports the received offset and so also acknowledges
+	// all received data.
+	conn.ackedOffset = conn.receivedOffset
+	receivedOffset := conn.receivedOffset
+
+	retransmit := append([]byte(nil), conn.sendBuffer...)
+
+	conn.mutex.Unlock()
+
+	if previousUnderlying != nil {
+		previousUnderlying.Close()
+	}
+
+	var err error
+	if writeResponse {
+		_, err = underlying.Write(makeResponse(responseStatusOK, receivedOffset))
+	}
+	for err == nil && len(retransmit) > 0 {
+		n := len(retransmit)
+		if n > MAX_FRAME_PAYLOAD_SIZE {
+			n = MAX_FRAME_PAYLOAD_SIZE
+		}
+		err = writeDataFrame(underlying, retransmit[:n])
+		retransmit = retransmit[n:]
+	}
+	if err != nil {
+		conn.fail(generation, err)
+		return nil
+	}
+
+	go conn.readFrames(underlying, generation, readResponse)
+
+	return nil
+}
+
+// fail handles a failure of the underlying connection. When the failed
+// connection is still current, it's closed and the session enters the
+// resuming state. fail must not be called while holding conn.mutex.
+func (conn *Conn) fail(generation int, _ error) {
+
+	conn.mutex.Lock()
+
+	if conn.isClosed ||
+		generation != conn.generation ||
+		conn.underlying == nil {
+
+		conn.mutex.Unlock()
+		return
+	}
+
+	underlying := conn.underlying
+	conn.underlying = nil
+
+	// Bump the generation so that frames read from the failed connection, but
+	// not yet processed, are discarded; and so that the resume timer, and
+	// any resume, apply only to this failure.
+	conn.generation += 1
+	generation = conn.generation
+
+	conn.resumeTimer = time.AfterFunc(conn.resumeTimeout, func() {
+		conn.mutex.Lock()
+		expired := generation == conn.generation
+		conn.mutex.Unlock()
+		if expired {
+			conn.closeWithError(errors.TraceNew("resume timed out"))
+		}
+	})
+
+	conn.mutex.Unlock()
+
+	underlying.Close()
+
+	if conn.isClient {
+		go conn.resume(generation)
+	}
+}
+
+// Interrupt closes the current underlying connection, which causes a
+// client to immediately start resuming the session. Interrupt may be
+// called when the underlying connection is suspected to have failed, for
+// example when the network has changed or a keep alive has timed out.
+// Interrupt returns false when the Conn is closed or already resuming.
+func (conn *Conn) Interrupt() bool {
+	conn.mutex.Lock()
+	generation := conn.generation
+	ok := !conn.isClosed && conn.underlying != nil
+	conn.mutex.Unlock()
+
+	if ok {
+		conn.fail(generation, errors.TraceNew("interrupted"))
+	}
+	return ok
+}
+
+func (conn *Conn) resume(generation int) {
+
+	ctx, cancelFunc := context.WithTimeout(conn.runCtx, conn.resumeTimeout)
+	defer cancelFunc()
+
+	for {
+		err := conn.resumeOnce(ctx, generation)
+		if err == nil {
+			if conn.onResumed != nil {
+				conn.onResumed()
+			}
+			return
+		}
+
+		if ctx.Err() != nil {
+			// The resume timer will close the Conn.
+			return
+		}
+
+		if std_errors.Is(err, errSessionRejected) {
+			// The server no longer has the session; for example, its
+			// resume timeout has expired. Retrying is futile.
+			conn.closeWithError(err)
+			return
+		}
+
+		timer := time.NewTimer(RESUME_RETRY_DELAY)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (conn *Conn) resumeOnce(ctx context.Context, generation int) error {
+
+	underlying, err := conn.dial(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Bound the resume handshake; the deadline is cleared on success.
+	deadline, _ := ctx.Deadline()
+	err = underlying.SetDeadline(deadline)
+	if err != nil {
+		underlying.Close()
+		return errors.Trace(err)
+	}
+
+	// No data is received while the session is resuming, so receivedOffset
+	// is stable.
+	conn.mutex.Lock()
+	receivedOffset := conn.receivedOffset
+	conn.mutex.Unlock()
+
+	_, err = underlying.Write(conn.makePreamble(preambleTypeResume, receivedOffset))
+	if err != nil {
+		underlying.Close()
+		return errors.Trace(err)
+	}
+
+	peerReceivedOffset, err := readResponse(underlying)
+	if err != nil {
+		underlying.Close()
+		return errors.Trace(err)
+	}
+
+	err = underlying.SetDeadline(time.Time{})
+	if err != nil {
+		underlying.Close()
+		return errors.Trace(err)
+	}
+
+	err = conn.attach(underlying, peerReceivedOffset, generation, false, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (conn *Conn) readFrames(
+	underlying net.Conn, generation int, readResponseFirst bool) {
+
+	var err error
+	defer func() {
+		conn.fail(generation, err)
+	}()
+
+	if readResponseFirst {
+		var peerReceivedOffset uint64
+		peerReceivedOffset, err = readResponse(underlying)
+		if err == nil && peerReceivedOffset != 0 {
+			err = errors.TraceNew("unexpected peer received offset")
+		}
+		if err != nil {
+			// The new session was rejected, or the initial connection failed
+			// before the session was established: there's no session to
+			// resume.
+			conn.closeWithError(err)
+			return
+		}
+	}
+
+	reader := bufio.NewReaderSize(underlying, READ_BUFFER_SIZE)
+	var header [ackFrameSize]byte
+	payload := make([]byte, MAX_FRAME_PAYLOAD_SIZE)
+
+	for {
+		_, err = io.ReadFull(reader, header[:1])
+		if err != nil {
+			err = errors.Trace(err)
+			return
+		}
+
+		switch header[0] {
+
+		case frameTypeData:
+
+			_, err = io.ReadFull(reader, header[1:dataFrameHeaderSize])
+			if err != nil {
+				err = errors.Trace(err)
+				return
+			}
+			length := int(binary.BigEndian.Uint16(header[1:dataFrameHeaderSize]))
+			if length == 0 || length > MAX_FRAME_PAYLOAD_SIZE {
+				err = errors.Tracef("invalid data frame length: %d", length)
+				conn.closeWithError(err)
+				return
+			}
+			_, err = io.ReadFull(reader, payload[:length])
+			if err != nil {
+				err = errors.Trace(err)
+				return
+			}
+
+			conn.mutex.Lock()
+			if conn.isClosed || generation != conn.generation {
+				conn.mutex.Unlock()
+				return
+			}
+			// The peer never has more than MAX_SEND_BUFFER_SIZE unacknowledged
+			// bytes in flight, and acknowledgements are for consumed bytes,
+			// so the read buffer is bounded.
+			if len(conn.readBuffer)+length > MAX_SEND_BUFFER_SIZE {
+				conn.mutex.Unlock()
+				err = errors.TraceNew("read buffer overflow")
+				conn.closeWithError(err)
+				return
+			}
+			conn.readBuffer = append(conn.readBuffer, payload[:length]...)
+			conn.receivedOffset += uint64(length)
+			conn.cond.Broadcast()
+			conn.mutex.Unlock()
+
+		case frameTypeAck:
+
+			_, err = io.ReadFull(reader, header[1:ackFrameSize])
+			if err != nil {
+				err = errors.Trace(err)
+				return
+			}
+			ackedOffset := binary.BigEndian.Uint64(header[1:ackFrameSize])
+
+			conn.mutex.Lock()
+			if conn.isClosed || generation != conn.generation {
+				conn.mutex.Unlock()
+				return
+			}
+			if ackedOffset > conn.sendBufferOffset+uint64(len(conn.sendBuffer)) {
+				conn.mutex.Unlock()
+				err = errors.Tracef("invalid ack offset: %d", ackedOffset)
+				conn.closeWithError(err)
+				return
+			}
+			conn.trimSendBuffer(ackedOffset)
+			conn.cond.Broadcast()
+			conn.mutex.Unlock()
+
+		case frameTypeClose:
+
+			conn.closeWithError(io.EOF)
+			return
+
+		default:
+			err = errors.Tracef("invalid frame type: %d", header[0])
+			conn.closeWithError(err)
+			return
+		}
+	}
+}
+
+// trimSendBuffer discards sent data up to the specified stream offset,
+// which the peer has received. Must be called while holding conn.mutex.
+func (conn *Conn) trimSendBuffer(offset uint64) {
+	if offset <= conn.sendBufferOffset {
+		return
+	}
+	n := int(offset - conn.sendBufferOffset)
+	conn.sendBuffer = conn.sendBuffer[n:]
+	conn.sendBufferOffset = offset
+	if len(conn.sendBuffer) == 0 {
+		conn.sendBuffer = nil
+	}
+}
+
+// sendAcks runs for the lifetime of the Conn and sends acknowledgements
+// when signaled by Read. Acknowledgements are sent by this goroutine, and
+// not by Read or readFrames, so that neither blocks on writes.
+func (conn *Conn) sendAcks() {
+	for {
+		select {
+		case <-conn.signalAck:
+		case <-conn.runCtx.Done():
+			return
+		}
+
+		conn.frameMutex.Lock()
+
+		conn.mutex.Lock()
+		underlying := conn.underlying
+		generation := conn.generation
+		consumedOffset := conn.consumedOffset
+		if underlying != nil {
+			conn.ackedOffset = consumedOffset
+		}
+		conn.mutex.Unlock()
+
+		var err error
+		if underlying != nil {
+			var frame [ackFrameSize]byte
+			frame[0] = frameTypeAck
+			binary.BigEndian.PutUint64(frame[1:], consumedOffset)
+			_, err = underlying.Write(frame[:])
+		}
+
+		conn.frameMutex.Unlock()
+
+		if err != nil {
+			conn.fail(generation, err)
+		}
+	}
+}
+
+func writeDataFrame(underlying net.Conn, payload []byte) error {
+	frame := make([]byte, dataFrameHeaderSize+len(payload))
+	frame[0] = frameTypeData
+	binary.BigEndian.PutUint16(frame[1:dataFrameHeaderSize], uint16(len(payload)))
+	copy(frame[dataFrameHeaderSize:], payload)
+	_, err := underlying.Write(frame)
+	return errors.Trace(err)
+}
+
+// Read implements net.Conn.Read.
+func (conn *Conn) Read(buffer []byte) (int, error) {
+
+	if len(buffer) == 0 {
+		return 0, nil
+	}
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	for len(conn.readBuffer) == 0 && !conn.isClosed {
+		conn.cond.Wait()
+	}
+
+	if len(conn.readBuffer) == 0 {
+		return 0, conn.closeErr
+	}
+
+	n := copy(buffer, conn.readBuffer)
+	conn.readBuffer = conn.readBuffer[n:]
+	if len(conn.readBuffer) == 0 {
+		conn.readBuffer = nil
+	}
+	conn.consumedOffset += uint64(n)
+
+	if conn.consumedOffset-conn.ackedOffset >= ACK_THRESHOLD {
+		select {
+		case conn.signalAck <- struct{}{}:
+		default:
+		}
+	}
+
+	return n, nil
+}
+
+// Write implements net.Conn.Write. Write blocks while the send buffer is
+// full. While the session is resuming, written data is buffered and
+// sent once the session is resumed.
+func (conn *Conn) Write(buffer []byte) (int, error) {
+
+	conn.writeCallMutex.Lock()
+	defer conn.writeCallMutex.Unlock()
+
+	written := 0
+
+	for written < len(buffer) {
+
+		n := len(buffer) - written
+		if n > MAX_FRAME_PAYLOAD_SIZE {
+			n = MAX_FRAME_PAYLOAD_SIZE
+		}
+		payload := buffer[written : written+n]
+
+		// Since Write calls are serialized, the send buffer can only shrink
+		// between waiting for space and appending.
+
+		conn.mutex.Lock()
+		for !conn.isClosed && len(conn.sendBuffer)+n > MAX_SEND_BUFFER_SIZE {
+			conn.cond.Wait()
+		}
+		if conn.isClosed {
+			err := conn.closeErr
+			conn.mutex.Unlock()
+			return written, errors.Trace(err)
+		}
+		conn.mutex.Unlock()
+
+		conn.frameMutex.Lock()
+
+		conn.mutex.Lock()
+		conn.sendBuffer = append(conn.sendBuffer, payload...)
+		underlying := conn.underlying
+		generation := conn.generation
+		conn.mutex.Unlock()
+
+		var err error
+		if underlying != nil {
+			err = writeDataFrame(underlying, payload)
+		}
+
+		conn.frameMutex.Unlock()
+
+		if err != nil {
+			// The data is buffered and will be retransmitted when the session
+			// is resumed.
+			conn.fail(generation, err)
+		}
+
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close implements net.Conn.Close. Close sends a close frame to the peer,
+// when connected, closes the underlying connection, and ends the session;
+// the session can't be resumed.
+func (conn *Conn) Close() error {
+
+	conn.mutex.Lock()
+	underlying := conn.underlying
+	conn.mutex.Unlock()
+
+	if underlying != nil {
+
+		// The write deadline bounds both this write and any concurrent
+		// frame write which would otherwise block acquiring frameMutex.
+		_ = underlying.SetWriteDeadline(time.Now().Add(CLOSE_FRAME_TIMEOUT))
+
+		conn.frameMutex.Lock()
+		conn.mutex.Lock()
+		isCurrent := !conn.isClosed && conn.underlying == underlying
+		conn.mutex.Unlock()
+		if isCurrent {
+			_, _ = underlying.Write([]byte{frameTypeClose})
+		}
+		conn.frameMutex.Unlock()
+	}
+
+	conn.closeWithError(io.EOF)
+	return nil
+}
+
+func (conn *Conn) closeWithError(err error) {
+
+	conn.mutex.Lock()
+	if conn.isClosed {
+		conn.mutex.Unlock()
+		return
+	}
+	conn.isClosed = true
+	conn.closeErr = err
+	underlying := conn.underlying
+	conn.underlying = nil
+	if conn.resumeTimer != nil {
+		conn.resumeTimer.Stop()
+		conn.resumeTimer = nil
+	}
+	conn.cond.Broadcast()
+	conn.mutex.Unlock()
+
+	conn.stopRunning()
+
+	if underlying != nil {
+		underlying.Close()
+	}
+
+	if conn.sessions != nil {
+		conn.sessions.remove(conn)
+	}
+}
+
+// IsClosed implements the common.Closer interface.
+func (conn *Conn) IsClosed() bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return conn.isClosed
+}
+
+// IsResuming indicates whether the underlying connection has failed and
+// the session has not yet been resumed.
+func (conn *Conn) IsResuming() bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	return !conn.isClosed && conn.underlying == nil
+}
+
+// LocalAddr implements net.Conn.LocalAddr, returning the local address of
+// the current underlying connection, if any.
+func (conn *Conn) LocalAddr() net.Addr {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.underlying == nil {
+		return nil
+	}
+	return conn.underlying.LocalAddr()
+}
+
+// RemoteAddr implements net.Conn.RemoteAddr, returning the remote address
+// of the current underlying connection, if any.
+func (conn *Conn) RemoteAddr() net.Addr {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.underlying == nil {
+		return nil
+	}
+	return conn.underlying.RemoteAddr()
+}
+
+// Stub implementation of net.Conn.SetDeadline
+func (conn *Conn) SetDeadline(t time.Time) error {
+	return errors.TraceNew("not supported")
+}
+
+// Stub implementation of net.Conn.SetReadDeadline
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	return errors.TraceNew("not supported")
+}
+
+// Stub implementation of net.Conn.SetWriteDeadline
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	return errors.TraceNew("not supported")
+}
+
+// Sessions is the server-side registry of resumable sessions.
+type Sessions struct {
+	resumeTimeout time.Duration
+	mutex         sync.Mutex
+	sessions      map[[SESSION_ID_SIZE]byte]*Conn
+}
+
+// NewSessions initializes a new Sessions. Server-side sessions are closed
+// when not resumed within resumeTimeout, which should exceed the client
+// resume timeout.
+func NewSessions(resumeTimeout time.Duration) *Sessions {
+	return &Sessions{
+		resumeTimeout: resumeTimeout,
+		sessions:      make(map[[SESSION_ID_SIZE]byte]*Conn),
+	}
+}
+
+// Accept reads the preamble, if any, from a newly accepted connection.
+//
+// When conn doesn't start with a preamble, Accept returns a net.Conn which
+// replays the bytes read by Accept and then reads from conn; the client is
+// not using resumption. When the client starts a new session, Accept
+// returns the new session Conn. In both cases, isResumed is false.
+//
+// When the client resumes an existing session, Accept attaches conn to
+// that session and returns the existing session Conn, with isResumed true.
+// The caller must not use the returned Conn to read or write; it's already
+// in use by the caller that accepted the session.
+//
+// The caller should set a deadline or otherwise ensure Accept doesn't block
+// indefinitely.
+func (sessions *Sessions) Accept(conn net.Conn) (net.Conn, bool, error) {
+
+	magic := make([]byte, len(PREAMBLE_MAGIC))
+	_, err := io.ReadFull(conn, magic)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	if string(magic) != PREAMBLE_MAGIC {
+		return &prefixedConn{Conn: conn, prefix: magic}, false, nil
+	}
+
+	var preamble [preambleSize]byte
+	_, err = io.ReadFull(conn, preamble[len(PREAMBLE_MAGIC):])
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	fields := preamble[len(PREAMBLE_MAGIC):]
+	preambleType := fields[0]
+	var sessionID [SESSION_ID_SIZE]byte
+	copy(sessionID[:], fields[1:])
+	var secret [SECRET_SIZE]byte
+	copy(secret[:], fields[1+SESSION_ID_SIZE:])
+	peerReceivedOffset := binary.BigEndian.Uint64(fields[1+SESSION_ID_SIZE+SECRET_SIZE:])
+
+	switch preambleType {
+
+	case preambleTypeNew:
+
+		if peerReceivedOffset != 0 {
+			return nil, false, errors.TraceNew("unexpected received offset")
+		}
+
+		resumableConn := newConn(false, sessionID, secret, sessions.resumeTimeout)
+		resumableConn.sessions = sessions
+
+		sessions.mutex.Lock()
+		_, ok := sessions.sessions[sessionID]
+		if !ok {
+			sessions.sessions[sessionID] = resumableConn
+		}
+		sessions.mutex.Unlock()
+
+		if ok {
+			// Session IDs are random, so this is not expected.
+			resumableConn.stopRunning()
+			_, _ = conn.Write(makeResponse(responseStatusRejected, 0))
+			return nil, false, errors.TraceNew("duplicate session ID")
+		}
+
+		err = resumableConn.attach(conn, 0, 0, true, false)
+		if err != nil {
+			return nil, false, errors.Trace(err)
+		}
+
+		return resumableConn, false, nil
+
+	case preambleTypeResume:
+
+		sessions.mutex.Lock()
+		resumableConn, ok := sessions.sessions[sessionID]
+		sessions.mutex.Unlock()
+
+		if !ok || subtle.ConstantTimeCompare(secret[:], resumableConn.secret[:]) != 1 {
+			_, _ = conn.Write(makeResponse(responseStatusRejected, 0))
+			return nil, false, errors.TraceNew("unknown session")
+		}
+
+		// The server may not yet have detected that the previous underlying
+		// connection failed; attach replaces it.
+		err = resumableConn.attach(conn, peerReceivedOffset, 0, true, false)
+		if err != nil {
+			return nil, false, errors.Trace(err)
+		}
+
+		return resumableConn, true, nil
+	}
+
+	return nil, false, errors.Tracef("invalid preamble type: %d", preambleType)
+}
+
+func (sessions *Sessions) remove(conn *Conn) {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	if sessions.sessions[conn.sessionID] == conn {
+		delete(sessions.sessions, conn.sessionID)
+	}
+}
+
+// Count returns the number of sessions.
+func (sessions *Sessions) Count() int {
+	sessions.mutex.Lock()
+	defer sessions.mutex.Unlock()
+	return len(sessions.sessions)
+}
+
+// prefixedConn is a net.Conn which replays prefix before reading from the
+// wrapped conn.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (conn *prefixedConn) Read(buffer []byte) (int, error) {
+	if len(conn.prefix) > 0 {
+		n := copy(buffer, conn.prefix)
+		conn.prefix = conn.prefix[n:]
+		return n, nil
+	}
+	return conn.Conn.Read(buffer)
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package resumption
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+)
+
+type testServer struct {
+	listener        net.Listener
+	sessions        *Sessions
+	mutex           sync.Mutex
+	underlyingConns []net.Conn
+	resumedCount    int32
+}
+
+func newTestServer(t *testing.T, resumeTimeout time.Duration) *testServer {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+
+	server := &testServer{
+		listener: listener,
+		sessions: NewSessions(resumeTimeout),
+	}
+
+	go func() {
+		for {
+			underlyingConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.mutex.Lock()
+			server.underlyingConns = append(server.underlyingConns, underlyingConn)
+			server.mutex.Unlock()
+
+			go func() {
+				conn, isResumed, err := server.sessions.Accept(underlyingConn)
+				if err != nil {
+					underlyingConn.Close()
+					return
+				}
+				if isResumed {
+					atomic.AddInt32(&server.resumedCount, 1)
+					return
+				}
+
+				// Echo all received data.
+				_, _ = io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return server
+}
+
+func (server *testServer) closeUnderlyingConns() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, conn := range server.underlyingConns {
+		conn.Close()
+	}
+	server.underlyingConns = nil
+}
+
+func (server *testServer) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", server.listener.Addr().String())
+}
+
+func TestResumption(t *testing.T) {
+
+	server := newTestServer(t, DEFAULT_RESUME_TIMEOUT)
+	defer server.listener.Close()
+
+	underlyingConn, err := server.dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+
+	var clientResumedCount int32
+
+	conn, err := NewClientConn(
+		underlyingConn,
+		&ClientConfig{
+			Dial:          server.dial,
+			ResumeTimeout: 5 * time.Second,
+			OnResumed: func() {
+				atomic.AddInt32(&clientResumedCount, 1)
+			},
+		})
+	if err != nil {
+		t.Fatalf("NewClientConn failed: %s", err)
+	}
+	defer conn.Close()
+
+	// Send enough data to exceed the send buffer size, so that data is
+	// acknowledged, trimmed, and retransmitted, while interrupting the
+	// underlying connection from both the client and server sides.
+
+	sendData := prng.Padding(4*MAX_SEND_BUFFER_SIZE, 4*MAX_SEND_BUFFER_SIZE)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		for i := 0; i < len(sendData); i += 65536 {
+			_, err := conn.Write(sendData[i : i+65536])
+			if err != nil {
+				writeErr <- err
+				return
+			}
+			switch i {
+			case 262144:
+				conn.Interrupt()
+			case 655360:
+				server.closeUnderlyingConns()
+			}
+		}
+		writeErr <- nil
+	}()
+
+	receiveData := make([]byte, len(sendData))
+	_, err = io.ReadFull(conn, receiveData)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+
+	err = <-writeErr
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	if !bytes.Equal(sendData, receiveData) {
+		t.Fatalf("unexpected received data")
+	}
+
+	if atomic.LoadInt32(&clientResumedCount) < 2 ||
+		atomic.LoadInt32(&server.resumedCount) != atomic.LoadInt32(&clientResumedCount) {
+
+		t.Fatalf("unexpected resumed counts: %d, %d",
+			atomic.LoadInt32(&clientResumedCount),
+			atomic.LoadInt32(&server.resumedCount))
+	}
+
+	conn.Close()
+
+	// The server-side session is closed when the echo completes.
+	deadline := time.Now().Add(5 * time.Second)
+	for server.sessions.Count() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected session count: %d", server.sessions.Count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestResumeTimeout(t *testing.T) {
+
+	server := newTestServer(t, 100*time.Millisecond)
+	defer server.listener.Close()
+
+	underlyingConn, err := server.dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+
+	// Delay resuming until after the server-side session has expired. The
+	// server rejects the resume and the client closes the Conn without
+	// waiting for its own resume timeout.
+
+	conn, err := NewClientConn(
+		underlyingConn,
+		&ClientConfig{
+			Dial: func(ctx context.Context) (net.Conn, error) {
+				time.Sleep(500 * time.Millisecond)
+				return server.dial(ctx)
+			},
+			ResumeTimeout: 5 * time.Second,
+		})
+	if err != nil {
+		t.Fatalf("NewClientConn failed: %s", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("data"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	buffer := make([]byte, 4)
+	_, err = io.ReadFull(conn, buffer)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+
+	startTime := time.Now()
+
+	if !conn.Interrupt() {
+		t.Fatalf("Interrupt failed")
+	}
+
+	_, err = conn.Read(buffer)
+	if err == nil {
+		t.Fatalf("unexpected Read success")
+	}
+
+	if !conn.IsClosed() || time.Since(startTime) > 2*time.Second {
+		t.Fatalf("unexpected close after %s", time.Since(startTime))
+	}
+}
+
+func TestAcceptWithoutPreamble(t *testing.T) {
+
+	server := NewSessions(DEFAULT_RESUME_TIMEOUT)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	message := []byte("SSH-2.0-Test\r\n")
+
+	go func() {
+		_, _ = clientConn.Write(message)
+	}()
+
+	conn, isResumed, err := server.Accept(serverConn)
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	if isResumed {
+		t.Fatalf("unexpected resumed")
+	}
+	if _, ok := conn.(*Conn); ok {
+		t.Fatalf("unexpected session")
+	}
+
+	buffer := make([]byte, len(message))
+	_, err = io.ReadFull(conn, buffer)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+	if !bytes.Equal(buffer, message) {
+		t.Fatalf("unexpected message: %s", string(buffer))
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package builtin registers transports for the tunnel protocols defined in
+// the protocol package. The client and server import builtin for its side
+// effects.
+package builtin
+
+import (
+	"context"
+	"net"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/marionette"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tapdance"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/transports"
+)
+
+func init() {
+	for _, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+
+		var transport transports.Transport
+		properties := makeProperties(tunnelProtocol)
+
+		if protocol.TunnelProtocolUsesMeek(tunnelProtocol) {
+			transport = &meekTransport{properties: properties}
+		} else if protocol.TunnelProtocolUsesQUIC(tunnelProtocol) {
+			transport = &quicTransport{properties: properties}
+		} else if protocol.TunnelProtocolUsesMarionette(tunnelProtocol) {
+			transport = &marionetteTransport{properties: properties}
+		} else if protocol.TunnelProtocolUsesTapdance(tunnelProtocol) {
+			transport = &tapdanceTransport{properties: properties}
+		} else {
+			transport = &tcpTransport{properties: properties}
+		}
+
+		transports.Register(tunnelProtocol, transport)
+	}
+}
+
+// makeProperties derives transport properties from the protocol package
+// predicates, which define the built-in tunnel protocols.
+func makeProperties(tunnelProtocol string) *transports.Properties {
+	return &transports.Properties{
+		Capability:                 protocol.GetCapability(tunnelProtocol),
+		UsesTCP:                    protocol.TunnelProtocolUsesTCP(tunnelProtocol),
+		IsResourceIntensive:        protocol.TunnelProtocolIsResourceIntensive(tunnelProtocol),
+		IsCompatibleWithFragmentor: protocol.TunnelProtocolIsCompatibleWithFragmentor(tunnelProtocol),
+		IsCompatibleWithReplay:     protocol.TunnelProtocolSupportsReplay(tunnelProtocol),
+		SupportsServerIPv6Address:  protocol.TunnelProtocolSupportsServerIPv6Address(tunnelProtocol),
+		SupportsUpstreamProxy:      protocol.TunnelProtocolSupportsUpstreamProxy(tunnelProtocol),
+	}
+}
+
+// tcpTransport is a direct TCP connection, used by SSH and OSSH.
+type tcpTransport struct {
+	properties *transports.Properties
+}
+
+func (t *tcpTransport) Properties() *transports.Properties {
+	return t.properties
+}
+
+func (t *tcpTransport) Dial(
+	ctx context.Context, args *transports.DialArgs) (net.Conn, error) {
+
+	conn, err := args.NetDialer.DialContext(ctx, "tcp", args.DialAddress)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+func (t *tcpTransport) Listen(args *transports.ListenArgs) (net.Listener, error) {
+	listener, err := args.ListenTCP()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return listener, nil
+}
+
+// meekTransport is meek, which is implemented by the client and server
+// packages. The server runs its meek HTTP server on the TCP listener.
+type meekTransport struct {
+	properties *transports.Properties
+}
+
+func (t *meekTransport) Properties() *transports.Properties {
+	return t.properties
+}
+
+func (t *meekTransport) Dial(
+	ctx context.Context, args *transports.DialArgs) (net.Conn, error) {
+
+	if args.DialMeek == nil {
+		return nil, errors.TraceNew("missing meek dialer")
+	}
+	conn, err := args.DialMeek(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+func (t *meekTransport) Listen(args *transports.ListenArgs) (net.Listener, error) {
+
+	// For FRONTED-MEEK-QUIC-OSSH, no listener implemented. The edge-to-server
+	// hop uses HTTPS and the client tunnel protocol is distinguished using
+	// protocol.MeekCookieData.ClientTunnelProtocol.
+	if protocol.TunnelProtocolUsesFrontedMeekQUIC(args.TunnelProtocol) {
+		return nil, nil
+	}
+
+	listener, err := args.ListenTCP()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return listener, nil
+}
+
+type quicTransport struct {
+	properties *transports.Properties
+}
+
+func (t *quicTransport) Properties() *transports.Properties {
+	return t.properties
+}
+
+func (t *quicTransport) Dial(
+	ctx context.Context, args *transports.DialArgs) (net.Conn, error) {
+
+	packetConn, remoteAddr, err := args.DialUDP(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	conn, err := quic.Dial(
+		ctx,
+		packetConn,
+		remoteAddr,
+		args.QUICDialSNIAddress,
+		args.QUICVersion,
+		args.ObfuscatedKey,
+		args.ObfuscatedQUICPaddingSeed)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+func (t *quicTransport) Listen(args *transports.ListenArgs) (net.Listener, error) {
+	listener, err := quic.Listen(
+		args.Logger,
+		args.ListenAddress,
+		args.ObfuscatedKey)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return listener, nil
+}
+
+type marionetteTransport struct {
+	properties *transports.Properties
+}
+
+func (t *marionetteTransport) Properties() *transports.Properties {
+	return t.properties
+}
+
+func (t *marionetteTransport) Dial(
+	ctx context.Context, args *transports.DialArgs) (net.Conn, error) {
+
+	conn, err := marionette.Dial(
+		ctx,
+		args.NetDialer,
+		args.MarionetteFormat,
+		args.DialAddress)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+func (t *marionetteTransport) Listen(args *transports.ListenArgs) (net.Listener, error) {
+	listener, err := marionette.Listen(
+		args.ListenIPAddress,
+		args.MarionetteFormat)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return listener, nil
+}
+
+type tapdanceTransport struct {
+	properties *transports.Properties
+}
+
+func (t *tapdanceTransport) Properties() *transports.Properties {
+	return t.properties
+}
+
+func (t *tapdanceTransport) Dial(
+	ctx context.Context, args *transports.DialArgs) (net.Conn, error) {
+
+	conn, err := tapdance.Dial(
+		ctx,
+		args.EmitDiagnosticLogs,
+		args.DataDirectory,
+		args.NetDialer,
+		args.DialAddress)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+func (t *tapdanceTransport) Listen(args *transports.ListenArgs) (net.Listener, error) {
+
+	// TapDance stations relay client traffic to the server over TCP.
+	tcpListener, err := args.ListenTCP()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	listener, err := tapdance.Listen(tcpListener)
+	if err != nil {
+		tcpListener.Close()
+		return nil, errors.Trace(err)
+	}
+	return listener, nil
+}
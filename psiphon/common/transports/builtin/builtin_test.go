@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package builtin
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/transports"
+)
+
+func TestBuiltinTransports(t *testing.T) {
+
+	if !reflect.DeepEqual(
+		transports.TunnelProtocols(), []string(protocol.SupportedTunnelProtocols)) {
+
+		t.Fatalf("unexpected registered tunnel protocols: %+v", transports.TunnelProtocols())
+	}
+
+	for _, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+		transport := transports.Get(tunnelProtocol)
+		if transport == nil {
+			t.Fatalf("missing transport: %s", tunnelProtocol)
+		}
+		if transport.Properties().Capability != protocol.GetCapability(tunnelProtocol) {
+			t.Fatalf("unexpected capability: %s", tunnelProtocol)
+		}
+	}
+}
+
+func TestTCPTransport(t *testing.T) {
+
+	transport := transports.Get(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+
+	listener, err := transport.Listen(
+		&transports.ListenArgs{
+			TunnelProtocol: protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			ListenAddress:  "127.0.0.1:0",
+			ListenTCP: func() (net.Listener, error) {
+				return net.Listen("tcp", "127.0.0.1:0")
+			},
+		})
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	conn, err := transport.Dial(
+		context.Background(),
+		&transports.DialArgs{
+			TunnelProtocol: protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			DialAddress:    listener.Addr().String(),
+			NetDialer:      &net.Dialer{},
+		})
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+
+	message := []byte("message")
+	_, err = conn.Write(message)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	buffer := make([]byte, len(message))
+	_, err = io.ReadFull(conn, buffer)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+
+	// FRONTED-MEEK-QUIC-OSSH has no listener.
+
+	listener, err = transports.Get(
+		protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_QUIC_OBFUSCATED_SSH).Listen(
+		&transports.ListenArgs{
+			TunnelProtocol: protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_QUIC_OBFUSCATED_SSH,
+		})
+	if err != nil || listener != nil {
+		t.Fatalf("unexpected listener")
+	}
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+Package transports is a registry of tunnel transports, the network protocols
+which carry the obfuscated SSH tunnel between the client and the server.
+
+Each tunnel protocol, such as "QUIC-OSSH", is run by a registered Transport,
+which implements both the client dial side and the server listen side. A new
+transport may be added as a self-contained package which calls Register in
+its init function; the client, the server, and the protocol package, which
+consults the registered Properties for tunnel protocols it doesn't define,
+then support the new tunnel protocol without further changes.
+
+The built-in tunnel protocols are registered by the builtin package.
+*/
+package transports
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+)
+
+// Transport is a tunnel transport.
+type Transport interface {
+
+	// Properties returns the static properties of the transport.
+	Properties() *Properties
+
+	// Dial establishes a client connection to the server. The returned conn
+	// is wrapped in the obfuscated SSH layer.
+	Dial(ctx context.Context, args *DialArgs) (net.Conn, error)
+
+	// Listen creates a server listener. Listen may return a nil listener,
+	// and no error, when the tunnel protocol has no server listener; for
+	// example, when another protocol's listener receives its connections.
+	Listen(args *ListenArgs) (net.Listener, error)
+}
+
+// Properties describes how a tunnel protocol may be used. The protocol
+// package uses Properties for tunnel protocols which are added via the
+// registry.
+type Properties struct {
+
+	// Capability is the server entry capability indicating that the server
+	// runs the tunnel protocol.
+	Capability string
+
+	// UsesTCP indicates that the transport dials TCP connections.
+	UsesTCP bool
+
+	// IsResourceIntensive indicates that the transport uses significant
+	// memory or CPU, so that the client limits concurrent dials.
+	IsResourceIntensive bool
+
+	// IsCompatibleWithFragmentor indicates that the transport's TCP
+	// connections may be fragmented.
+	IsCompatibleWithFragmentor bool
+
+	// IsCompatibleWithReplay indicates that the client may store and replay
+	// successful dial parameters for the tunnel protocol.
+	IsCompatibleWithReplay bool
+
+	// SupportsServerIPv6Address indicates that the client may dial, and the
+	// server listens on, the server IPv6 address.
+	SupportsServerIPv6Address bool
+
+	// SupportsUpstreamProxy indicates that the client may dial the transport
+	// through an upstream proxy. Only connections dialed with
+	// DialArgs.NetDialer use the upstream proxy.
+	SupportsUpstreamProxy bool
+}
+
+// DialArgs are the client inputs to Transport.Dial.
+type DialArgs struct {
+
+	// TunnelProtocol is the tunnel protocol being dialed.
+	TunnelProtocol string
+
+	// DialAddress is the server IP address and port to dial.
+	DialAddress string
+
+	// ObfuscatedKey is the server entry's obfuscated SSH key.
+	ObfuscatedKey string
+
+	// MarionetteFormat is the server entry's Marionette format.
+	MarionetteFormat string
+
+	// NetDialer dials TCP connections, applying the client's upstream proxy,
+	// device binding, BPF, and fragmentor configuration.
+	NetDialer common.NetDialer
+
+	// DialUDP creates a UDP packet conn, applying the client's device
+	// binding, and resolves DialAddress.
+	DialUDP func(ctx context.Context) (net.PacketConn, *net.UDPAddr, error)
+
+	// DialMeek dials a meek connection. Meek is implemented by the client,
+	// which supplies DialMeek for the meek tunnel protocols.
+	DialMeek func(ctx context.Context) (net.Conn, error)
+
+	// DataDirectory is a directory in which transports may store
+	// persistent state.
+	DataDirectory string
+
+	// EmitDiagnosticLogs indicates that transports may emit their own
+	// diagnostic logs.
+	EmitDiagnosticLogs bool
+
+	// QUICDialSNIAddress, QUICVersion, and ObfuscatedQUICPaddingSeed are
+	// the QUIC dial parameters.
+	QUICDialSNIAddress        string
+	QUICVersion               string
+	ObfuscatedQUICPaddingSeed *prng.Seed
+}
+
+// ListenArgs are the server inputs to Transport.Listen.
+type ListenArgs struct {
+
+	// TunnelProtocol is the tunnel protocol being run.
+	TunnelProtocol string
+
+	// ListenIPAddress and ListenAddress are the IP address, and the IP
+	// address and port, to listen on.
+	ListenIPAddress string
+	ListenAddress   string
+
+	// ObfuscatedKey is the server's obfuscated SSH key.
+	ObfuscatedKey string
+
+	// MarionetteFormat is the server's Marionette format.
+	MarionetteFormat string
+
+	// ListenTCP creates a TCP listener on ListenAddress, applying the
+	// server's BPF configuration.
+	ListenTCP func() (net.Listener, error)
+
+	// Logger is used for transport logging.
+	Logger common.Logger
+}
+
+var registry = struct {
+	mutex           sync.Mutex
+	transports      map[string]Transport
+	tunnelProtocols []string
+}{
+	transports: make(map[string]Transport),
+}
+
+// Register registers the transport for the specified tunnel protocol.
+// Register panics if a transport is already registered for the tunnel
+// protocol, as that is a programming error. Register is intended to be
+// called from package init functions.
+func Register(tunnelProtocol string, transport Transport) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if _, ok := registry.transports[tunnelProtocol]; ok {
+		panic("duplicate transport: " + tunnelProtocol)
+	}
+	registry.transports[tunnelProtocol] = transport
+	registry.tunnelProtocols = append(registry.tunnelProtocols, tunnelProtocol)
+}
+
+// Unregister removes the transport for the specified tunnel protocol, if
+// any. Unregister is intended for tests which register a transport.
+func Unregister(tunnelProtocol string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if _, ok := registry.transports[tunnelProtocol]; !ok {
+		return
+	}
+	delete(registry.transports, tunnelProtocol)
+	for i, p := range registry.tunnelProtocols {
+		if p == tunnelProtocol {
+			registry.tunnelProtocols = append(
+				registry.tunnelProtocols[:i:i], registry.tunnelProtocols[i+1:]...)
+			break
+		}
+	}
+}
+
+// Get returns the transport for the specified tunnel protocol, or nil when
+// no transport is registered.
+func Get(tunnelProtocol string) Transport {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return registry.transports[tunnelProtocol]
+}
+
+// TunnelProtocols returns the registered tunnel protocols, in registration
+// order.
+func TunnelProtocols() []string {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	return append([]string(nil), registry.tunnelProtocols...)
+}
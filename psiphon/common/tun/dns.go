@@ -0,0 +1,279 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/goarista/monotime"
+)
+
+const (
+	RESOLVED_DOMAINS_MAX_ENTRIES = 4096
+	RESOLVED_DOMAIN_MIN_TTL      = 1 * time.Minute
+	RESOLVED_DOMAIN_MAX_TTL      = 1 * time.Hour
+)
+
+// resolvedDomains maps IP addresses to the domain names that resolved to
+// those addresses, as observed in transparent DNS responses. This mapping
+// allows the server to associate packet tunnel flows, which are to IP
+// addresses, with domains, for traffic rules and flow activity updaters.
+//
+// When multiple domains resolve to the same IP address, as is common with
+// CDNs, the most recently resolved domain is used.
+//
+// Entries expire after the DNS record TTL, clamped to
+// [RESOLVED_DOMAIN_MIN_TTL, RESOLVED_DOMAIN_MAX_TTL]; the lower bound allows
+// for clients that don't strictly respect short TTLs. When there are
+// RESOLVED_DOMAINS_MAX_ENTRIES unexpired entries, new resolutions are not
+// recorded.
+type resolvedDomains struct {
+	mutex   sync.Mutex
+	entries map[[net.IPv6len]byte]resolvedDomain
+}
+
+type resolvedDomain struct {
+	domain string
+	expiry monotime.Time
+}
+
+func newResolvedDomains() *resolvedDomains {
+	return &resolvedDomains{
+		entries: make(map[[net.IPv6len]byte]resolvedDomain),
+	}
+}
+
+// update records the A and AAAA answers in the DNS response message. Invalid
+// messages are ignored.
+func (r *resolvedDomains) update(message []byte) {
+
+	domain, answers, ok := parseDNSResponse(message)
+	if !ok || len(answers) == 0 {
+		return
+	}
+
+	now := monotime.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, answer := range answers {
+
+		if _, ok := r.entries[answer.IPAddress]; !ok &&
+			len(r.entries) >= RESOLVED_DOMAINS_MAX_ENTRIES {
+
+			r.reapLocked(now)
+			if len(r.entries) >= RESOLVED_DOMAINS_MAX_ENTRIES {
+				return
+			}
+		}
+
+		TTL := answer.TTL
+		if TTL < RESOLVED_DOMAIN_MIN_TTL {
+			TTL = RESOLVED_DOMAIN_MIN_TTL
+		} else if TTL > RESOLVED_DOMAIN_MAX_TTL {
+			TTL = RESOLVED_DOMAIN_MAX_TTL
+		}
+
+		r.entries[answer.IPAddress] = resolvedDomain{
+			domain: domain,
+			expiry: now.Add(TTL),
+		}
+	}
+}
+
+// lookup returns the domain that most recently resolved to the IP address,
+// which is in 16-byte form, or "" when there is no unexpired resolution.
+func (r *resolvedDomains) lookup(IPAddress [net.IPv6len]byte) string {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry, ok := r.entries[IPAddress]
+	if !ok || monotime.Now().After(entry.expiry) {
+		return ""
+	}
+	return entry.domain
+}
+
+// reap deletes all expired entries.
+func (r *resolvedDomains) reap() {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.reapLocked(monotime.Now())
+}
+
+func (r *resolvedDomains) reapLocked(now monotime.Time) {
+	for IPAddress, entry := range r.entries {
+		if now.After(entry.expiry) {
+			delete(r.entries, IPAddress)
+		}
+	}
+}
+
+const (
+	dnsHeaderLength      = 12
+	dnsTypeA             = 1
+	dnsTypeAAAA          = 28
+	dnsClassIN           = 1
+	dnsMaxCompressionPtr = 16
+)
+
+type dnsAnswer struct {
+	IPAddress [net.IPv6len]byte
+	TTL       time.Duration
+}
+
+// parseDNSResponse parses a DNS response message, returning the single
+// question domain and all A and AAAA answers. All answers are attributed to
+// the question domain, which includes answers at the end of CNAME chains.
+//
+// Only successful responses with exactly one question are accepted, which
+// covers the responses to typical stub resolver queries. IPv4 answers are
+// returned in 16-byte form, as in flowID.
+func parseDNSResponse(message []byte) (string, []dnsAnswer, bool) {
+
+	if len(message) < dnsHeaderLength {
+		return "", nil, false
+	}
+
+	flags := binary.BigEndian.Uint16(message[2:4])
+	isResponse := flags&0x8000 != 0
+	responseCode := flags & 0x000F
+
+	questionCount := binary.BigEndian.Uint16(message[4:6])
+	answerCount := binary.BigEndian.Uint16(message[6:8])
+
+	if !isResponse || responseCode != 0 || questionCount != 1 {
+		return "", nil, false
+	}
+
+	domain, offset, ok := parseDNSName(message, dnsHeaderLength)
+	if !ok || domain == "" {
+		return "", nil, false
+	}
+
+	// Skip QTYPE and QCLASS.
+	offset += 4
+	if offset > len(message) {
+		return "", nil, false
+	}
+
+	var answers []dnsAnswer
+
+	for i := 0; i < int(answerCount); i++ {
+
+		_, offset, ok = parseDNSName(message, offset)
+		if !ok || offset+10 > len(message) {
+			return "", nil, false
+		}
+
+		recordType := binary.BigEndian.Uint16(message[offset : offset+2])
+		recordClass := binary.BigEndian.Uint16(message[offset+2 : offset+4])
+		TTL := binary.BigEndian.Uint32(message[offset+4 : offset+8])
+		dataLength := int(binary.BigEndian.Uint16(message[offset+8 : offset+10]))
+		offset += 10
+
+		if offset+dataLength > len(message) {
+			return "", nil, false
+		}
+		data := message[offset : offset+dataLength]
+		offset += dataLength
+
+		if recordClass != dnsClassIN {
+			continue
+		}
+
+		var answer dnsAnswer
+
+		if recordType == dnsTypeA && dataLength == net.IPv4len {
+			copy(answer.IPAddress[:], v4InV6Prefix)
+			copy(answer.IPAddress[len(v4InV6Prefix):], data)
+		} else if recordType == dnsTypeAAAA && dataLength == net.IPv6len {
+			copy(answer.IPAddress[:], data)
+		} else {
+			continue
+		}
+
+		answer.TTL = time.Duration(TTL) * time.Second
+
+		answers = append(answers, answer)
+	}
+
+	return domain, answers, true
+}
+
+// parseDNSName parses the possibly compressed domain name starting at offset
+// in message. The returned domain is lower case, with no trailing dot. The
+// returned offset is the offset following the name at its original
+// location.
+func parseDNSName(message []byte, offset int) (string, int, bool) {
+
+	var labels []string
+	nextOffset := -1
+	pointerCount := 0
+
+	for {
+
+		if offset >= len(message) {
+			return "", 0, false
+		}
+
+		length := int(message[offset])
+
+		if length == 0 {
+			offset += 1
+			break
+		}
+
+		if length&0xC0 == 0xC0 {
+
+			if offset+1 >= len(message) || pointerCount >= dnsMaxCompressionPtr {
+				return "", 0, false
+			}
+			pointerCount += 1
+
+			if nextOffset == -1 {
+				nextOffset = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(message[offset:offset+2]) & 0x3FFF)
+			continue
+		}
+
+		if length&0xC0 != 0 || offset+1+length > len(message) {
+			return "", 0, false
+		}
+
+		labels = append(labels, string(message[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+
+	if nextOffset == -1 {
+		nextOffset = offset
+	}
+
+	return strings.ToLower(strings.Join(labels, ".")), nextOffset, true
+}
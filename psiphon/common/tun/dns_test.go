@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tun
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestResolvedDomains(t *testing.T) {
+
+	IPv4Address := net.ParseIP("192.0.2.1").To4()
+	IPv6Address := net.ParseIP("2001:db8::1")
+
+	// Response to a query for "WWW.Example.com", with a CNAME answer
+	// followed by A and AAAA answers for the CNAME target. All answer names
+	// use compression pointers.
+
+	message := []byte{
+		0x12, 0x34, // ID
+		0x81, 0x80, // QR, RD, RA, RCODE 0
+		0x00, 0x01, // QDCOUNT
+		0x00, 0x03, // ANCOUNT
+		0x00, 0x00, // NSCOUNT
+		0x00, 0x00, // ARCOUNT
+	}
+
+	// Question at offset 12.
+	message = append(message, 3, 'W', 'W', 'W', 7, 'E', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0)
+	message = append(message, 0x00, 0x01, 0x00, 0x01)
+
+	appendRecord := func(name []byte, recordType uint16, TTL uint32, data []byte) {
+		message = append(message, name...)
+		header := make([]byte, 10)
+		binary.BigEndian.PutUint16(header[0:2], recordType)
+		binary.BigEndian.PutUint16(header[2:4], dnsClassIN)
+		binary.BigEndian.PutUint32(header[4:8], TTL)
+		binary.BigEndian.PutUint16(header[8:10], uint16(len(data)))
+		message = append(message, header...)
+		message = append(message, data...)
+	}
+
+	// CNAME www.example.com -> cdn.example.com; the CNAME target is at
+	// offset cnameOffset.
+	cnameOffset := len(message) + 2 + 10
+	appendRecord([]byte{0xC0, 12}, 5, 300, []byte{3, 'c', 'd', 'n', 0xC0, 16})
+
+	cnamePointer := []byte{0xC0 | byte(cnameOffset>>8), byte(cnameOffset)}
+	appendRecord(cnamePointer, dnsTypeA, 10, IPv4Address)
+	appendRecord(cnamePointer, dnsTypeAAAA, 86400, IPv6Address)
+
+	domain, answers, ok := parseDNSResponse(message)
+	if !ok {
+		t.Fatalf("parseDNSResponse failed")
+	}
+	if domain != "www.example.com" || len(answers) != 2 {
+		t.Fatalf("unexpected response: %s %d", domain, len(answers))
+	}
+	if answers[0].TTL != 10e9 || answers[1].TTL != 86400e9 {
+		t.Fatalf("unexpected TTLs")
+	}
+
+	resolvedDomains := newResolvedDomains()
+	resolvedDomains.update(message)
+
+	var ID flowID
+	ID.set(nil, 0, IPv4Address, 443, internetProtocolTCP)
+	if resolvedDomains.lookup(ID.upstreamIPAddress) != "www.example.com" {
+		t.Fatalf("unexpected IPv4 lookup result")
+	}
+
+	ID.set(nil, 0, IPv6Address, 443, internetProtocolTCP)
+	if resolvedDomains.lookup(ID.upstreamIPAddress) != "www.example.com" {
+		t.Fatalf("unexpected IPv6 lookup result")
+	}
+
+	ID.set(nil, 0, net.ParseIP("192.0.2.2").To4(), 443, internetProtocolTCP)
+	if resolvedDomains.lookup(ID.upstreamIPAddress) != "" {
+		t.Fatalf("unexpected lookup result")
+	}
+
+	// Truncated, query, and pointer loop messages are rejected.
+
+	for i := 0; i < len(message); i++ {
+		_, _, ok := parseDNSResponse(message[:i])
+		if ok {
+			t.Fatalf("unexpected parseDNSResponse success for truncated message: %d", i)
+		}
+	}
+
+	query := append([]byte(nil), message...)
+	query[2] &= 0x7F
+	_, _, ok = parseDNSResponse(query)
+	if ok {
+		t.Fatalf("unexpected parseDNSResponse success for query")
+	}
+
+	loop := append([]byte(nil), message[:12]...)
+	loop = append(loop, 0xC0, 12)
+	_, _, ok = parseDNSResponse(loop)
+	if ok {
+		t.Fatalf("unexpected parseDNSResponse success for pointer loop")
+	}
+}
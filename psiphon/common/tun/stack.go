@@ -0,0 +1,2060 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tun
+
+import (
+	"context"
+	"encoding/binary"
+	std_errors "errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+)
+
+/*
+
+Stack is a minimal userspace TCP/IP stack which terminates the TCP and UDP
+flows in a packet tunnel. Where Server relays client packets to a tun device
+and relies on the host kernel to NAT and route them, Stack parses client
+packets itself and presents each flow as a connection object, StackTCPConn
+or StackUDPConn. The Stack user, psiphond, then dials each flow as an
+ordinary port forward. No tun device, network configuration, or NAT is
+required, so Stack may be used in unprivileged environments.
+
+The TCP implementation is intentionally small. It is the passive side of
+each connection and supports:
+
+- the MSS and window scale options; SACK and timestamps are not negotiated
+- in-order receive; out-of-order segments are dropped and duplicate ACKs
+  sent, prompting the client to retransmit
+- RFC 6298 retransmission timeouts, fast retransmit on three duplicate ACKs,
+  and Reno-style slow start and congestion avoidance
+- zero window probes
+- half close in both directions
+
+The transport between the client and Stack, an SSH channel in psiphond, is
+reliable; packets are lost only when the downstream packet queue overflows.
+The congestion control exists mainly to limit such overflows.
+
+Transparent DNS, as in Server, is supported by the Stack user: flows to the
+transparent DNS resolver addresses are reported via IsTransparentDNS, and
+domains resolved by UDP transparent DNS responses are recorded and
+associated with subsequent flows; see Hostname.
+
+*/
+
+const (
+	STACK_TCP_RECEIVE_BUFFER_SIZE = 64 * 1024
+	STACK_TCP_SEND_BUFFER_SIZE    = 64 * 1024
+	STACK_UDP_QUEUE_SIZE          = 64
+	STACK_MAX_FLOWS               = 4096
+
+	stackTCPWindowShift          = 2
+	stackTCPDefaultMSS           = 536
+	stackTCPInitialWindow        = 10
+	stackTCPInitialRTO           = 1 * time.Second
+	stackTCPMinRTO               = 200 * time.Millisecond
+	stackTCPMaxRTO               = 60 * time.Second
+	stackTCPMaxRetransmissions   = 12
+	stackTCPDelayedACKTimeout    = 20 * time.Millisecond
+	stackTCPFinWait2Timeout      = 60 * time.Second
+	stackTCPDuplicateACKTheshold = 3
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+
+	tcpOptionEnd         = 0
+	tcpOptionNOP         = 1
+	tcpOptionMSS         = 2
+	tcpOptionWindowScale = 3
+)
+
+var errStackConnClosed = std_errors.New("connection closed")
+var errStackConnReset = std_errors.New("connection reset")
+var errStackStopped = std_errors.New("stack stopped")
+var errStackDeadlineExceeded = &stackTimeoutError{}
+
+// stackTimeoutError is returned when a StackTCPConn or StackUDPConn
+// deadline is exceeded. It implements net.Error.
+type stackTimeoutError struct{}
+
+func (e *stackTimeoutError) Error() string   { return "i/o timeout" }
+func (e *stackTimeoutError) Timeout() bool   { return true }
+func (e *stackTimeoutError) Temporary() bool { return true }
+
+// StackConfig specifies the configuration of a Stack.
+type StackConfig struct {
+
+	// Logger is used for logging events.
+	Logger common.Logger
+
+	// Transport is the channel transport, such as an SSH channel, over
+	// which client packets are read and written. Packets are framed as
+	// in Channel.
+	Transport io.ReadWriteCloser
+
+	// Device is a tun device from which client packets are read and to
+	// which packets are written. Device is an alternative to Transport,
+	// for running a Stack on the client side; exactly one of Transport
+	// and Device must be set. The Stack takes ownership of the Device
+	// and closes it when stopped.
+	Device *Device
+
+	// AllowPrivateSubnetDestinations permits flows to destinations in
+	// the packet tunnel private subnets, such as a local network DNS
+	// resolver. When false, as in the server case, only the transparent
+	// DNS resolver addresses are permitted in those subnets. On the client
+	// side, the server applies its own destination rules to the port
+	// forwards made for each flow.
+	AllowPrivateSubnetDestinations bool
+
+	// MTU is the packet MTU. If <= 0, a default is used.
+	MTU int
+
+	// DownstreamPacketQueueSize specifies the size of the downstream
+	// packet queue, as in ServerConfig.DownstreamPacketQueueSize. If
+	// <= 0, a default is used.
+	DownstreamPacketQueueSize int
+
+	// MaxFlows specifies the maximum number of concurrent TCP and UDP
+	// flows. New TCP flows beyond the limit are reset, and new UDP flows
+	// are dropped. If <= 0, STACK_MAX_FLOWS is used.
+	MaxFlows int
+
+	// HandleTCPConn is invoked for each new TCP connection initiated by the
+	// client. The handler must eventually call either Accept, to complete the
+	// TCP handshake, or Reject. HandleTCPConn is called from the Stack packet
+	// processing goroutine and must not block.
+	HandleTCPConn func(conn *StackTCPConn)
+
+	// HandleUDPConn is invoked for each new UDP flow initiated by the
+	// client. The handler reads and writes datagrams using the conn, and
+	// must call Close when the flow is done or is not permitted.
+	// HandleUDPConn is called from the Stack packet processing goroutine and
+	// must not block.
+	HandleUDPConn func(conn *StackUDPConn)
+}
+
+// Stack is a userspace TCP/IP stack that terminates packet tunnel client
+// flows.
+type Stack struct {
+	config            *StackConfig
+	mtu               int
+	maxFlows          int
+	packetIO          stackPacketIO
+	downstreamMutex   sync.Mutex
+	downstreamPackets *PacketQueue
+	resolvedDomains   *resolvedDomains
+	flowsMutex        sync.Mutex
+	tcpConns          map[flowID]*StackTCPConn
+	udpConns          map[flowID]*StackUDPConn
+	nextIPv4ID        uint32
+	runContext        context.Context
+	stopRunning       context.CancelFunc
+	workers           *sync.WaitGroup
+}
+
+// stackPacketIO is the source and sink of client packets for a Stack.
+// Both Channel and Device implement stackPacketIO.
+type stackPacketIO interface {
+	ReadPacket() ([]byte, error)
+	WriteFramedPackets(packetBuffer []byte) error
+	Close() error
+}
+
+// NewStack initializes a new Stack.
+func NewStack(config *StackConfig) (*Stack, error) {
+
+	if (config.Transport == nil) == (config.Device == nil) ||
+		config.HandleTCPConn == nil ||
+		config.HandleUDPConn == nil {
+		return nil, errors.TraceNew("missing required config")
+	}
+
+	MTU := getMTU(config.MTU)
+
+	var packetIO stackPacketIO
+	if config.Transport != nil {
+		packetIO = NewChannel(config.Transport, getChannelMTU(MTU))
+	} else {
+		packetIO = config.Device
+	}
+
+	downstreamPacketQueueSize := DEFAULT_DOWNSTREAM_PACKET_QUEUE_SIZE
+	if config.DownstreamPacketQueueSize > 0 {
+		downstreamPacketQueueSize = config.DownstreamPacketQueueSize
+	}
+
+	maxFlows := STACK_MAX_FLOWS
+	if config.MaxFlows > 0 {
+		maxFlows = config.MaxFlows
+	}
+
+	runContext, stopRunning := context.WithCancel(context.Background())
+
+	return &Stack{
+		config:            config,
+		mtu:               MTU,
+		maxFlows:          maxFlows,
+		packetIO:          packetIO,
+		downstreamPackets: NewPacketQueue(downstreamPacketQueueSize),
+		resolvedDomains:   newResolvedDomains(),
+		tcpConns:          make(map[flowID]*StackTCPConn),
+		udpConns:          make(map[flowID]*StackUDPConn),
+		runContext:        runContext,
+		stopRunning:       stopRunning,
+		workers:           new(sync.WaitGroup),
+	}, nil
+}
+
+// Start starts relaying packets. When the transport or device fails or is
+// closed, the Stack stops.
+func (stack *Stack) Start() {
+
+	stack.workers.Add(2)
+	go stack.runUpstream()
+	go stack.runDownstream()
+}
+
+// Stop halts the Stack, resetting all TCP connections and closing all UDP
+// flows, and closes the transport or device.
+func (stack *Stack) Stop() {
+
+	stack.stopRunning()
+	stack.packetIO.Close()
+	stack.workers.Wait()
+	stack.closeAllConns()
+}
+
+func (stack *Stack) runUpstream() {
+	defer stack.workers.Done()
+
+	// When the transport fails, stop the downstream worker and release all
+	// flows.
+	defer stack.closeAllConns()
+	defer stack.stopRunning()
+
+	for {
+		packet, err := stack.packetIO.ReadPacket()
+		if err != nil {
+			select {
+			case <-stack.runContext.Done():
+				// No error is logged on shutdown.
+				return
+			default:
+			}
+			if stack.config.Device != nil {
+				// As in Client, device read errors may be temporary.
+				stack.config.Logger.WithTraceFields(
+					common.LogFields{"error": err}).Info("read device packet failed")
+				continue
+			}
+			stack.config.Logger.WithTraceFields(
+				common.LogFields{"error": err}).Debug("read channel packet failed")
+			return
+		}
+
+		stack.handlePacket(packet)
+	}
+}
+
+func (stack *Stack) runDownstream() {
+	defer stack.workers.Done()
+
+	for {
+		packetBuffer, ok := stack.downstreamPackets.DequeueFramedPackets(stack.runContext)
+		if !ok {
+			// Dequeue aborted due to stack.runContext.Done()
+			return
+		}
+
+		err := stack.packetIO.WriteFramedPackets(packetBuffer)
+
+		stack.downstreamPackets.Replace(packetBuffer)
+
+		if err != nil {
+			if stack.config.Device != nil {
+				// As with dropped packets, device write failures are
+				// recovered from by TCP retransmission.
+				stack.config.Logger.WithTraceFields(
+					common.LogFields{"error": err}).Info("write device packets failed")
+				continue
+			}
+			stack.config.Logger.WithTraceFields(
+				common.LogFields{"error": err}).Debug("write channel packets failed")
+			stack.stopRunning()
+			stack.packetIO.Close()
+			return
+		}
+	}
+}
+
+func (stack *Stack) closeAllConns() {
+
+	stack.flowsMutex.Lock()
+	tcpConns := make([]*StackTCPConn, 0, len(stack.tcpConns))
+	for _, conn := range stack.tcpConns {
+		tcpConns = append(tcpConns, conn)
+	}
+	udpConns := make([]*StackUDPConn, 0, len(stack.udpConns))
+	for _, conn := range stack.udpConns {
+		udpConns = append(udpConns, conn)
+	}
+	stack.flowsMutex.Unlock()
+
+	for _, conn := range tcpConns {
+		conn.mutex.Lock()
+		conn.abortLocked(errStackStopped, false)
+		conn.mutex.Unlock()
+	}
+
+	for _, conn := range udpConns {
+		conn.Close()
+	}
+}
+
+// enqueueDownstreamPacket queues a packet to be written to the transport.
+// When the queue is full, the packet is dropped.
+func (stack *Stack) enqueueDownstreamPacket(packet []byte) {
+
+	// PacketQueue.Enqueue is not safe for concurrent calls.
+	stack.downstreamMutex.Lock()
+	stack.downstreamPackets.Enqueue(packet)
+	stack.downstreamMutex.Unlock()
+}
+
+// isPermittedDestination applies the same destination rules as
+// processPacket: only global unicast destinations are permitted; and, of the
+// private packet tunnel subnets, only the transparent DNS resolver addresses,
+// unless allowPrivateSubnets is set.
+func isPermittedDestination(IPAddress net.IP, allowPrivateSubnets bool) bool {
+
+	if !IPAddress.IsGlobalUnicast() {
+		return false
+	}
+
+	if allowPrivateSubnets {
+		return true
+	}
+
+	if IPv4Address := IPAddress.To4(); IPv4Address != nil {
+		return IPv4Address.Equal(transparentDNSResolverIPv4Address) ||
+			!privateSubnetIPv4.Contains(IPv4Address)
+	}
+
+	return IPAddress.Equal(transparentDNSResolverIPv6Address) ||
+		!privateSubnetIPv6.Contains(IPAddress)
+}
+
+func isTransparentDNSDestination(IPAddress net.IP, port int) bool {
+	return port == portNumberDNS &&
+		(IPAddress.Equal(transparentDNSResolverIPv4Address) ||
+			IPAddress.Equal(transparentDNSResolverIPv6Address))
+}
+
+// handlePacket parses an upstream client packet and dispatches it to the
+// corresponding flow. Invalid and disallowed packets are dropped.
+func (stack *Stack) handlePacket(packet []byte) {
+
+	if len(packet) < 1 {
+		return
+	}
+
+	version := packet[0] >> 4
+
+	var protocol internetProtocol
+	var sourceIPAddress, destinationIPAddress net.IP
+	var payload []byte
+
+	if version == 4 {
+
+		// As in processPacket, IP options are not supported. Fragments are
+		// also not supported.
+
+		if len(packet) < 20 || packet[0]&0x0F != 5 {
+			return
+		}
+
+		totalLength := int(binary.BigEndian.Uint16(packet[2:4]))
+		if totalLength < 20 || totalLength > len(packet) {
+			return
+		}
+
+		fragmentInfo := binary.BigEndian.Uint16(packet[6:8])
+		if fragmentInfo&0x3FFF != 0 {
+			return
+		}
+
+		protocol = internetProtocol(packet[9])
+		sourceIPAddress = packet[12:16]
+		destinationIPAddress = packet[16:20]
+		payload = packet[20:totalLength]
+
+	} else if version == 6 {
+
+		// IPv6 extension headers are not supported.
+
+		if len(packet) < 40 {
+			return
+		}
+
+		payloadLength := int(binary.BigEndian.Uint16(packet[4:6]))
+		if 40+payloadLength > len(packet) {
+			return
+		}
+
+		protocol = internetProtocol(packet[6])
+		sourceIPAddress = packet[8:24]
+		destinationIPAddress = packet[24:40]
+		payload = packet[40 : 40+payloadLength]
+
+	} else {
+		return
+	}
+
+	if !isPermittedDestination(
+		destinationIPAddress, stack.config.AllowPrivateSubnetDestinations) {
+		return
+	}
+
+	switch protocol {
+	case internetProtocolTCP:
+		stack.handleTCPSegment(sourceIPAddress, destinationIPAddress, payload)
+	case internetProtocolUDP:
+		stack.handleUDPDatagram(sourceIPAddress, destinationIPAddress, payload)
+	}
+}
+
+func (stack *Stack) handleUDPDatagram(
+	sourceIPAddress, destinationIPAddress net.IP, datagram []byte) {
+
+	if len(datagram) < 8 {
+		return
+	}
+
+	sourcePort := binary.BigEndian.Uint16(datagram[0:2])
+	destinationPort := binary.BigEndian.Uint16(datagram[2:4])
+	length := int(binary.BigEndian.Uint16(datagram[4:6]))
+
+	if sourcePort == 0 || destinationPort == 0 ||
+		length < 8 || length > len(datagram) {
+		return
+	}
+
+	var ID flowID
+	ID.set(sourceIPAddress, sourcePort, destinationIPAddress, destinationPort, internetProtocolUDP)
+
+	stack.flowsMutex.Lock()
+
+	conn, ok := stack.udpConns[ID]
+	isNew := false
+
+	if !ok {
+
+		if len(stack.tcpConns)+len(stack.udpConns) >= stack.maxFlows {
+			stack.flowsMutex.Unlock()
+			return
+		}
+
+		conn = newStackUDPConn(
+			stack, ID, sourceIPAddress, destinationIPAddress,
+			int(sourcePort), int(destinationPort))
+		stack.udpConns[ID] = conn
+		isNew = true
+	}
+
+	stack.flowsMutex.Unlock()
+
+	if isNew {
+		stack.config.HandleUDPConn(conn)
+	}
+
+	conn.enqueue(datagram[8:length])
+}
+
+func (stack *Stack) removeUDPConn(conn *StackUDPConn) {
+	stack.flowsMutex.Lock()
+	if stack.udpConns[conn.flow] == conn {
+		delete(stack.udpConns, conn.flow)
+	}
+	stack.flowsMutex.Unlock()
+}
+
+func (stack *Stack) removeTCPConn(conn *StackTCPConn) {
+	stack.flowsMutex.Lock()
+	if stack.tcpConns[conn.flow] == conn {
+		delete(stack.tcpConns, conn.flow)
+	}
+	stack.flowsMutex.Unlock()
+}
+
+// tcpSegment is a parsed TCP segment.
+type tcpSegment struct {
+	sourcePort       uint16
+	destinationPort  uint16
+	seq              uint32
+	ack              uint32
+	flags            byte
+	window           uint16
+	MSS              int
+	windowShift      int
+	hasWindowShift   bool
+	payload          []byte
+	sequenceConsumed uint32
+}
+
+func parseTCPSegment(data []byte) (*tcpSegment, bool) {
+
+	if len(data) < 20 {
+		return nil, false
+	}
+
+	dataOffset := 4 * int(data[12]>>4)
+	if dataOffset < 20 || dataOffset > len(data) {
+		return nil, false
+	}
+
+	segment := &tcpSegment{
+		sourcePort:      binary.BigEndian.Uint16(data[0:2]),
+		destinationPort: binary.BigEndian.Uint16(data[2:4]),
+		seq:             binary.BigEndian.Uint32(data[4:8]),
+		ack:             binary.BigEndian.Uint32(data[8:12]),
+		flags:           data[13],
+		window:          binary.BigEndian.Uint16(data[14:16]),
+		payload:         data[dataOffset:],
+	}
+
+	if segment.sourcePort == 0 || segment.destinationPort == 0 {
+		return nil, false
+	}
+
+	if segment.flags&tcpFlagSYN != 0 {
+
+		// Options are only inspected in SYN segments.
+
+		options := data[20:dataOffset]
+		for len(options) > 0 {
+			kind := options[0]
+			if kind == tcpOptionEnd {
+				break
+			}
+			if kind == tcpOptionNOP {
+				options = options[1:]
+				continue
+			}
+			if len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+				break
+			}
+			length := int(options[1])
+			if kind == tcpOptionMSS && length == 4 {
+				segment.MSS = int(binary.BigEndian.Uint16(options[2:4]))
+			} else if kind == tcpOptionWindowScale && length == 3 {
+				segment.windowShift = int(options[2])
+				if segment.windowShift > 14 {
+					segment.windowShift = 14
+				}
+				segment.hasWindowShift = true
+			}
+			options = options[length:]
+		}
+	}
+
+	segment.sequenceConsumed = uint32(len(segment.payload))
+	if segment.flags&tcpFlagSYN != 0 {
+		segment.sequenceConsumed += 1
+	}
+	if segment.flags&tcpFlagFIN != 0 {
+		segment.sequenceConsumed += 1
+	}
+
+	return segment, true
+}
+
+func (stack *Stack) handleTCPSegment(
+	sourceIPAddress, destinationIPAddress net.IP, data []byte) {
+
+	segment, ok := parseTCPSegment(data)
+	if !ok {
+		return
+	}
+
+	var ID flowID
+	ID.set(
+		sourceIPAddress, segment.sourcePort,
+		destinationIPAddress, segment.destinationPort,
+		internetProtocolTCP)
+
+	stack.flowsMutex.Lock()
+	conn, ok := stack.tcpConns[ID]
+	stack.flowsMutex.Unlock()
+
+	if ok {
+		conn.handleSegment(segment)
+		return
+	}
+
+	if segment.flags&tcpFlagRST != 0 {
+		return
+	}
+
+	if segment.flags&(tcpFlagSYN|tcpFlagACK) != tcpFlagSYN {
+
+		// Reset segments for unknown connections, as per RFC 793, "Reset
+		// Generation".
+
+		if segment.flags&tcpFlagACK != 0 {
+			stack.sendTCPReset(
+				destinationIPAddress, segment.destinationPort,
+				sourceIPAddress, segment.sourcePort,
+				segment.ack, 0, false)
+		} else {
+			stack.sendTCPReset(
+				destinationIPAddress, segment.destinationPort,
+				sourceIPAddress, segment.sourcePort,
+				0, segment.seq+segment.sequenceConsumed, true)
+		}
+		return
+	}
+
+	stack.flowsMutex.Lock()
+
+	if len(stack.tcpConns)+len(stack.udpConns) >= stack.maxFlows {
+		stack.flowsMutex.Unlock()
+		stack.sendTCPReset(
+			destinationIPAddress, segment.destinationPort,
+			sourceIPAddress, segment.sourcePort,
+			0, segment.seq+1, true)
+		return
+	}
+
+	conn = newStackTCPConn(stack, ID, sourceIPAddress, destinationIPAddress, segment)
+	stack.tcpConns[ID] = conn
+
+	stack.flowsMutex.Unlock()
+
+	stack.config.HandleTCPConn(conn)
+}
+
+func (stack *Stack) sendTCPReset(
+	sourceIPAddress net.IP, sourcePort uint16,
+	destinationIPAddress net.IP, destinationPort uint16,
+	seq, ack uint32, withACK bool) {
+
+	flags := byte(tcpFlagRST)
+	if withACK {
+		flags |= tcpFlagACK
+	}
+
+	stack.sendTCPSegment(
+		sourceIPAddress, sourcePort,
+		destinationIPAddress, destinationPort,
+		seq, ack, flags, 0, nil, nil)
+}
+
+// sendTCPSegment constructs an IP packet containing the specified TCP
+// segment and enqueues it for sending to the client.
+func (stack *Stack) sendTCPSegment(
+	sourceIPAddress net.IP, sourcePort uint16,
+	destinationIPAddress net.IP, destinationPort uint16,
+	seq, ack uint32,
+	flags byte,
+	window uint16,
+	options []byte,
+	payload []byte) {
+
+	TCPHeaderLength := 20 + len(options)
+	segmentLength := TCPHeaderLength + len(payload)
+
+	packet, segment := stack.makePacket(
+		sourceIPAddress, destinationIPAddress, internetProtocolTCP, segmentLength)
+
+	binary.BigEndian.PutUint16(segment[0:2], sourcePort)
+	binary.BigEndian.PutUint16(segment[2:4], destinationPort)
+	binary.BigEndian.PutUint32(segment[4:8], seq)
+	binary.BigEndian.PutUint32(segment[8:12], ack)
+	segment[12] = byte(TCPHeaderLength/4) << 4
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:16], window)
+	copy(segment[20:], options)
+	copy(segment[TCPHeaderLength:], payload)
+
+	checksum := transportChecksum(
+		sourceIPAddress, destinationIPAddress, internetProtocolTCP, segment)
+	binary.BigEndian.PutUint16(segment[16:18], checksum)
+
+	stack.enqueueDownstreamPacket(packet)
+}
+
+// sendUDPDatagram constructs an IP packet containing the specified UDP
+// datagram and enqueues it for sending to the client.
+func (stack *Stack) sendUDPDatagram(
+	sourceIPAddress net.IP, sourcePort uint16,
+	destinationIPAddress net.IP, destinationPort uint16,
+	payload []byte) {
+
+	datagramLength := 8 + len(payload)
+
+	packet, datagram := stack.makePacket(
+		sourceIPAddress, destinationIPAddress, internetProtocolUDP, datagramLength)
+
+	binary.BigEndian.PutUint16(datagram[0:2], sourcePort)
+	binary.BigEndian.PutUint16(datagram[2:4], destinationPort)
+	binary.BigEndian.PutUint16(datagram[4:6], uint16(datagramLength))
+	copy(datagram[8:], payload)
+
+	checksum := transportChecksum(
+		sourceIPAddress, destinationIPAddress, internetProtocolUDP, datagram)
+	if checksum == 0 {
+		// A computed UDP checksum of 0 is transmitted as all ones.
+		checksum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(datagram[6:8], checksum)
+
+	stack.enqueueDownstreamPacket(packet)
+}
+
+// makePacket allocates a packet and fills in the IP header. The returned
+// payload is a slice of the packet, to be filled in by the caller.
+func (stack *Stack) makePacket(
+	sourceIPAddress, destinationIPAddress net.IP,
+	protocol internetProtocol,
+	payloadLength int) ([]byte, []byte) {
+
+	if IPv4SourceAddress := sourceIPAddress.To4(); IPv4SourceAddress != nil {
+
+		packet := make([]byte, 20+payloadLength)
+
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+		binary.BigEndian.PutUint16(packet[4:6], uint16(atomic.AddUint32(&stack.nextIPv4ID, 1)))
+		binary.BigEndian.PutUint16(packet[6:8], 0x4000) // Don't fragment
+		packet[8] = 64
+		packet[9] = byte(protocol)
+		copy(packet[12:16], IPv4SourceAddress)
+		copy(packet[16:20], destinationIPAddress.To4())
+
+		binary.BigEndian.PutUint16(packet[10:12], internetChecksum(0, packet[0:20]))
+
+		return packet, packet[20:]
+	}
+
+	packet := make([]byte, 40+payloadLength)
+
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], uint16(payloadLength))
+	packet[6] = byte(protocol)
+	packet[7] = 64
+	copy(packet[8:24], sourceIPAddress.To16())
+	copy(packet[24:40], destinationIPAddress.To16())
+
+	return packet, packet[40:]
+}
+
+// internetChecksum computes the RFC 1071 checksum of data, starting from the
+// specified partial sum.
+func internetChecksum(sum uint32, data []byte) uint16 {
+
+	for len(data) >= 2 {
+		sum += uint32(data[0])<<8 | uint32(data[1])
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+
+	return ^uint16(sum)
+}
+
+// transportChecksum computes a TCP or UDP checksum, including the IP
+// pseudo-header. The checksum field in segment must be zero.
+func transportChecksum(
+	sourceIPAddress, destinationIPAddress net.IP,
+	protocol internetProtocol,
+	segment []byte) uint16 {
+
+	var sum uint32
+
+	addSum := func(data []byte) {
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(data[i])<<8 | uint32(data[i+1])
+		}
+	}
+
+	if IPv4SourceAddress := sourceIPAddress.To4(); IPv4SourceAddress != nil {
+		addSum(IPv4SourceAddress)
+		addSum(destinationIPAddress.To4())
+	} else {
+		addSum(sourceIPAddress.To16())
+		addSum(destinationIPAddress.To16())
+	}
+
+	sum += uint32(protocol)
+	sum += uint32(len(segment))
+
+	return internetChecksum(sum, segment)
+}
+
+// stackConnWaiter implements blocking, with deadlines, for StackTCPConn and
+// StackUDPConn operations. Waiters obtain the current signal channel while
+// holding the conn mutex, release the mutex, and wait for the signal, which
+// is broadcast by closing the channel whenever the conn state changes.
+type stackConnWaiter struct {
+	signal        chan struct{}
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStackConnWaiter() stackConnWaiter {
+	return stackConnWaiter{signal: make(chan struct{})}
+}
+
+// broadcastLocked wakes all waiters. The conn mutex must be held.
+func (waiter *stackConnWaiter) broadcastLocked() {
+	close(waiter.signal)
+	waiter.signal = make(chan struct{})
+}
+
+// waitLocked releases mutex, waits for a broadcast or the deadline, and
+// reacquires mutex. waitLocked returns false when the deadline is exceeded.
+func (waiter *stackConnWaiter) waitLocked(mutex *sync.Mutex, deadline time.Time) bool {
+
+	signal := waiter.signal
+
+	if deadline.IsZero() {
+		mutex.Unlock()
+		<-signal
+		mutex.Lock()
+		return true
+	}
+
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	mutex.Unlock()
+	select {
+	case <-signal:
+	case <-timer.C:
+	}
+	timer.Stop()
+	mutex.Lock()
+
+	return time.Now().Before(deadline)
+}
+
+const (
+	tcpStatePending = iota
+	tcpStateSynReceived
+	tcpStateEstablished
+	tcpStateClosed
+)
+
+// StackTCPConn is a TCP connection initiated by a packet tunnel client and
+// terminated by a Stack. StackTCPConn implements net.Conn. LocalAddr is the
+// client's destination address and RemoteAddr is the client's source
+// address.
+type StackTCPConn struct {
+	stack                   *Stack
+	flow                    flowID
+	localIPAddress          net.IP
+	localPort               uint16
+	remoteIPAddress         net.IP
+	remotePort              uint16
+	hostname                string
+	mutex                   sync.Mutex
+	waiter                  stackConnWaiter
+	state                   int
+	err                     error
+	readClosed              bool
+	writeClosed             bool
+	mss                     int
+	windowScaling           bool
+	peerWindowShift         int
+	rcvNxt                  uint32
+	receiveBuffer           []byte
+	peerFIN                 bool
+	advertisedWindow        int
+	ackPending              int
+	delayedACKTimer         *time.Timer
+	iss                     uint32
+	sndUna                  uint32
+	sndNxt                  uint32
+	sndMax                  uint32
+	sndWnd                  int
+	sendBuffer              []byte
+	finSent                 bool
+	finSeq                  uint32
+	finAcked                bool
+	cwnd                    int
+	ssthresh                int
+	duplicateACKs           int
+	srtt                    time.Duration
+	rttvar                  time.Duration
+	rto                     time.Duration
+	rttTiming               bool
+	rttSeq                  uint32
+	rttStart                time.Time
+	retransmitTimer         *time.Timer
+	retransmitTimerArmed    bool
+	retransmissions         int
+	finWait2Timer           *time.Timer
+	receivedInitialSequence uint32
+}
+
+func newStackTCPConn(
+	stack *Stack,
+	ID flowID,
+	sourceIPAddress, destinationIPAddress net.IP,
+	segment *tcpSegment) *StackTCPConn {
+
+	// The maximum segment size is derived from the MTU and the client's MSS
+	// option. When the option is absent, the RFC 1122 default applies.
+
+	IPHeaderLength := 40
+	localIPAddress := append(net.IP(nil), destinationIPAddress...)
+	remoteIPAddress := append(net.IP(nil), sourceIPAddress...)
+	if len(sourceIPAddress) == net.IPv4len {
+		IPHeaderLength = 20
+	}
+
+	MSS := stack.mtu - IPHeaderLength - 20
+	peerMSS := stackTCPDefaultMSS
+	if segment.MSS > 0 {
+		peerMSS = segment.MSS
+	}
+	if peerMSS < MSS {
+		MSS = peerMSS
+	}
+
+	conn := &StackTCPConn{
+		stack:                   stack,
+		flow:                    ID,
+		localIPAddress:          localIPAddress,
+		localPort:               segment.destinationPort,
+		remoteIPAddress:         remoteIPAddress,
+		remotePort:              segment.sourcePort,
+		hostname:                stack.resolvedDomains.lookup(ID.upstreamIPAddress),
+		waiter:                  newStackConnWaiter(),
+		state:                   tcpStatePending,
+		mss:                     MSS,
+		windowScaling:           segment.hasWindowShift,
+		peerWindowShift:         segment.windowShift,
+		receivedInitialSequence: segment.seq,
+		rcvNxt:                  segment.seq + 1,
+		sndWnd:                  int(segment.window),
+		iss:                     uint32(prng.Int63()),
+		rto:                     stackTCPInitialRTO,
+	}
+
+	conn.cwnd = stackTCPInitialWindow * MSS
+	conn.ssthresh = STACK_TCP_SEND_BUFFER_SIZE
+
+	return conn
+}
+
+// Hostname returns the domain most recently resolved, via transparent DNS,
+// to the connection's destination IP address, or "" when there is no such
+// domain.
+func (conn *StackTCPConn) Hostname() string {
+	return conn.hostname
+}
+
+// IsTransparentDNS indicates whether the connection is to a transparent DNS
+// resolver address. The Stack user is expected to relay such connections
+// to a DNS resolver.
+func (conn *StackTCPConn) IsTransparentDNS() bool {
+	return isTransparentDNSDestination(conn.localIPAddress, int(conn.localPort))
+}
+
+// LocalAddr returns the client's destination address.
+func (conn *StackTCPConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: conn.localIPAddress, Port: int(conn.localPort)}
+}
+
+// RemoteAddr returns the client's source address.
+func (conn *StackTCPConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: conn.remoteIPAddress, Port: int(conn.remotePort)}
+}
+
+// Accept completes the TCP handshake with the client. Data may be written
+// immediately, and will be sent once the handshake completes.
+func (conn *StackTCPConn) Accept() error {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.state != tcpStatePending {
+		if conn.err != nil {
+			return errors.Trace(conn.err)
+		}
+		return errors.TraceNew("unexpected state")
+	}
+
+	conn.state = tcpStateSynReceived
+	conn.sndUna = conn.iss
+	conn.sndNxt = conn.iss + 1
+	conn.sndMax = conn.sndNxt
+
+	conn.sendSYNACKLocked()
+	conn.armRetransmitTimerLocked()
+
+	return nil
+}
+
+// Reject refuses the connection by sending a TCP reset to the client.
+func (conn *StackTCPConn) Reject() {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.state != tcpStatePending {
+		return
+	}
+
+	conn.abortLocked(errStackConnClosed, true)
+}
+
+// Read implements net.Conn.Read. When the client has closed its side of the
+// connection, Read returns io.EOF.
+func (conn *StackTCPConn) Read(buffer []byte) (int, error) {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	for {
+		if conn.readClosed {
+			return 0, errors.Trace(errStackConnClosed)
+		}
+		if len(conn.receiveBuffer) > 0 {
+			break
+		}
+		if conn.peerFIN {
+			return 0, io.EOF
+		}
+		if conn.err != nil {
+			return 0, errors.Trace(conn.err)
+		}
+		if !conn.waiter.waitLocked(&conn.mutex, conn.waiter.readDeadline) {
+			return 0, errStackDeadlineExceeded
+		}
+	}
+
+	n := copy(buffer, conn.receiveBuffer)
+	conn.receiveBuffer = conn.receiveBuffer[n:]
+	if len(conn.receiveBuffer) == 0 {
+		// Release the underlying array.
+		conn.receiveBuffer = nil
+	}
+
+	// Send a window update when the advertised window has substantially
+	// opened, which avoids stalling a client that has filled the window.
+
+	if conn.state == tcpStateEstablished {
+		window := conn.advertisableWindowLocked()
+		if window-conn.advertisedWindow >= STACK_TCP_RECEIVE_BUFFER_SIZE/4 ||
+			(conn.advertisedWindow < conn.mss && window >= conn.mss) {
+			conn.sendACKLocked()
+		}
+	}
+
+	return n, nil
+}
+
+// Write implements net.Conn.Write. Write blocks while the send buffer is
+// full.
+func (conn *StackTCPConn) Write(buffer []byte) (int, error) {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	written := 0
+
+	for written < len(buffer) {
+
+		if conn.writeClosed {
+			return written, errors.Trace(errStackConnClosed)
+		}
+		if conn.err != nil {
+			return written, errors.Trace(conn.err)
+		}
+		if conn.state == tcpStatePending {
+			return written, errors.TraceNew("not accepted")
+		}
+
+		available := STACK_TCP_SEND_BUFFER_SIZE - len(conn.sendBuffer)
+		if available <= 0 {
+			if !conn.waiter.waitLocked(&conn.mutex, conn.waiter.writeDeadline) {
+				return written, errStackDeadlineExceeded
+			}
+			continue
+		}
+
+		n := len(buffer) - written
+		if n > available {
+			n = available
+		}
+		conn.sendBuffer = append(conn.sendBuffer, buffer[written:written+n]...)
+		written += n
+
+		conn.outputLocked()
+	}
+
+	return written, nil
+}
+
+// CloseWrite sends a FIN to the client once all written data is sent.
+func (conn *StackTCPConn) CloseWrite() error {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.state == tcpStatePending {
+		conn.abortLocked(errStackConnClosed, true)
+		return nil
+	}
+
+	conn.writeClosed = true
+	conn.waiter.broadcastLocked()
+	conn.outputLocked()
+	conn.checkDoneLocked()
+
+	return nil
+}
+
+// Close implements net.Conn.Close. Any data already written is still
+// delivered to the client, followed by a FIN. If received data remains
+// unread, or more data is received, the connection is instead reset, as is
+// conventional.
+func (conn *StackTCPConn) Close() error {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.state == tcpStatePending {
+		conn.abortLocked(errStackConnClosed, true)
+		return nil
+	}
+
+	if conn.state == tcpStateClosed {
+		return nil
+	}
+
+	if len(conn.receiveBuffer) > 0 {
+		conn.abortLocked(errStackConnClosed, true)
+		return nil
+	}
+
+	conn.readClosed = true
+	conn.writeClosed = true
+	conn.waiter.broadcastLocked()
+	conn.outputLocked()
+	conn.checkDoneLocked()
+
+	return nil
+}
+
+// SetDeadline implements net.Conn.SetDeadline.
+func (conn *StackTCPConn) SetDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.waiter.readDeadline = t
+	conn.waiter.writeDeadline = t
+	conn.waiter.broadcastLocked()
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.SetReadDeadline.
+func (conn *StackTCPConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.waiter.readDeadline = t
+	conn.waiter.broadcastLocked()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.SetWriteDeadline.
+func (conn *StackTCPConn) SetWriteDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.waiter.writeDeadline = t
+	conn.waiter.broadcastLocked()
+	return nil
+}
+
+// abortLocked closes the connection immediately, optionally sending a reset
+// to the client.
+func (conn *StackTCPConn) abortLocked(err error, sendReset bool) {
+
+	if conn.state == tcpStateClosed {
+		return
+	}
+
+	if sendReset {
+		seq := conn.sndNxt
+		if conn.state == tcpStatePending {
+			seq = 0
+		}
+		conn.stack.sendTCPReset(
+			conn.localIPAddress, conn.localPort,
+			conn.remoteIPAddress, conn.remotePort,
+			seq, conn.rcvNxt, true)
+	}
+
+	conn.state = tcpStateClosed
+	if conn.err == nil {
+		conn.err = err
+	}
+	conn.stopTimersLocked()
+	conn.waiter.broadcastLocked()
+
+	conn.stack.removeTCPConn(conn)
+}
+
+// checkDoneLocked removes a connection once both sides have sent FINs and
+// the client has acknowledged the Stack's FIN. A connection which has been
+// closed locally, but which the client doesn't close, is eventually reset.
+func (conn *StackTCPConn) checkDoneLocked() {
+
+	if conn.state != tcpStateEstablished || !conn.finAcked {
+		return
+	}
+
+	if conn.peerFIN {
+		conn.state = tcpStateClosed
+		if conn.err == nil {
+			conn.err = errStackConnClosed
+		}
+		conn.stopTimersLocked()
+		conn.waiter.broadcastLocked()
+		conn.stack.removeTCPConn(conn)
+		return
+	}
+
+	if conn.readClosed && conn.finWait2Timer == nil {
+		conn.finWait2Timer = time.AfterFunc(stackTCPFinWait2Timeout, func() {
+			conn.mutex.Lock()
+			defer conn.mutex.Unlock()
+			conn.abortLocked(errStackConnClosed, true)
+		})
+	}
+}
+
+func (conn *StackTCPConn) stopTimersLocked() {
+	if conn.retransmitTimer != nil {
+		conn.retransmitTimer.Stop()
+	}
+	conn.retransmitTimerArmed = false
+	if conn.delayedACKTimer != nil {
+		conn.delayedACKTimer.Stop()
+	}
+	if conn.finWait2Timer != nil {
+		conn.finWait2Timer.Stop()
+	}
+}
+
+// receiveWindowLocked returns the available receive buffer space.
+func (conn *StackTCPConn) receiveWindowLocked() int {
+	window := STACK_TCP_RECEIVE_BUFFER_SIZE - len(conn.receiveBuffer)
+	if window < 0 {
+		window = 0
+	}
+	return window
+}
+
+// advertisableWindowLocked returns the available receive buffer space,
+// limited to what may be represented in the TCP header window field.
+func (conn *StackTCPConn) advertisableWindowLocked() int {
+
+	window := conn.receiveWindowLocked()
+
+	shift := uint(0)
+	if conn.windowScaling {
+		shift = stackTCPWindowShift
+	}
+	window >>= shift
+	if window > 0xFFFF {
+		window = 0xFFFF
+	}
+
+	return window << shift
+}
+
+// windowFieldLocked returns the TCP header window value advertising the
+// available receive buffer space.
+func (conn *StackTCPConn) windowFieldLocked() uint16 {
+
+	conn.advertisedWindow = conn.advertisableWindowLocked()
+
+	if conn.windowScaling {
+		return uint16(conn.advertisedWindow >> stackTCPWindowShift)
+	}
+	return uint16(conn.advertisedWindow)
+}
+
+func (conn *StackTCPConn) sendSYNACKLocked() {
+
+	var options []byte
+
+	// MSS option.
+	options = append(options, tcpOptionMSS, 4, byte(conn.mss>>8), byte(conn.mss))
+
+	// Window scaling is enabled only when the client sent the option.
+	if conn.windowScaling {
+		options = append(options, tcpOptionNOP, tcpOptionWindowScale, 3, stackTCPWindowShift)
+	}
+
+	// The SYN-ACK window is never scaled.
+	window := conn.receiveWindowLocked()
+	if window > 0xFFFF {
+		window = 0xFFFF
+	}
+	conn.advertisedWindow = window
+
+	conn.stack.sendTCPSegment(
+		conn.localIPAddress, conn.localPort,
+		conn.remoteIPAddress, conn.remotePort,
+		conn.iss, conn.rcvNxt,
+		tcpFlagSYN|tcpFlagACK,
+		uint16(window),
+		options,
+		nil)
+}
+
+func (conn *StackTCPConn) sendACKLocked() {
+
+	conn.ackPending = 0
+	if conn.delayedACKTimer != nil {
+		conn.delayedACKTimer.Stop()
+	}
+
+	conn.stack.sendTCPSegment(
+		conn.localIPAddress, conn.localPort,
+		conn.remoteIPAddress, conn.remotePort,
+		conn.sndNxt, conn.rcvNxt,
+		tcpFlagACK,
+		conn.windowFieldLocked(),
+		nil,
+		nil)
+}
+
+func (conn *StackTCPConn) scheduleACKLocked() {
+
+	// Delayed ACKs, as per RFC 1122: at least every second full segment is
+	// acknowledged immediately.
+
+	conn.ackPending += 1
+	if conn.ackPending >= 2 {
+		conn.sendACKLocked()
+		return
+	}
+
+	if conn.delayedACKTimer == nil {
+		conn.delayedACKTimer = time.AfterFunc(stackTCPDelayedACKTimeout, func() {
+			conn.mutex.Lock()
+			defer conn.mutex.Unlock()
+			if conn.state == tcpStateEstablished && conn.ackPending > 0 {
+				conn.sendACKLocked()
+			}
+		})
+	} else {
+		conn.delayedACKTimer.Reset(stackTCPDelayedACKTimeout)
+	}
+}
+
+func (conn *StackTCPConn) sendDataLocked(seq uint32, data []byte, flags byte) {
+
+	conn.ackPending = 0
+	if conn.delayedACKTimer != nil {
+		conn.delayedACKTimer.Stop()
+	}
+
+	conn.stack.sendTCPSegment(
+		conn.localIPAddress, conn.localPort,
+		conn.remoteIPAddress, conn.remotePort,
+		seq, conn.rcvNxt,
+		tcpFlagACK|flags,
+		conn.windowFieldLocked(),
+		nil,
+		data)
+}
+
+// inFlightLocked returns the number of sent, unacknowledged data bytes.
+func (conn *StackTCPConn) inFlightLocked() int {
+	inFlight := int(conn.sndNxt - conn.sndUna)
+	if conn.finSent &&
+		seqGreater(conn.sndNxt, conn.finSeq) &&
+		!seqGreater(conn.sndUna, conn.finSeq) {
+		// The FIN is in flight.
+		inFlight -= 1
+	}
+	return inFlight
+}
+
+// outputLocked sends as much buffered data as the client's receive window
+// and the congestion window permit, followed by a FIN when the write side
+// is closed and all data is sent.
+func (conn *StackTCPConn) outputLocked() {
+
+	if conn.state != tcpStateEstablished {
+		return
+	}
+
+	for {
+		inFlight := conn.inFlightLocked()
+		unsent := len(conn.sendBuffer) - inFlight
+
+		window := conn.sndWnd
+		if conn.cwnd < window {
+			window = conn.cwnd
+		}
+
+		if unsent > 0 && window-inFlight > 0 {
+
+			n := unsent
+			if n > window-inFlight {
+				n = window - inFlight
+			}
+			if n > conn.mss {
+				n = conn.mss
+			}
+
+			flags := byte(0)
+			if n == unsent {
+				flags |= tcpFlagPSH
+			}
+
+			conn.sendDataLocked(
+				conn.sndNxt, conn.sendBuffer[inFlight:inFlight+n], flags)
+
+			if !conn.rttTiming {
+				conn.rttTiming = true
+				conn.rttSeq = conn.sndNxt
+				conn.rttStart = time.Now()
+			}
+
+			conn.sndNxt += uint32(n)
+			if seqGreater(conn.sndNxt, conn.sndMax) {
+				conn.sndMax = conn.sndNxt
+			}
+
+			conn.armRetransmitTimerLocked()
+			continue
+		}
+
+		if unsent == 0 && conn.writeClosed {
+
+			// The FIN sequence number is fixed when the FIN is first sent.
+			// The FIN is sent again after a retransmission timeout resets
+			// sndNxt.
+
+			if !conn.finSent {
+				conn.finSeq = conn.sndNxt
+				conn.finSent = true
+			}
+		}
+
+		if unsent == 0 && conn.finSent && conn.sndNxt == conn.finSeq {
+
+			conn.sendDataLocked(conn.sndNxt, nil, tcpFlagFIN)
+
+			conn.sndNxt += 1
+			if seqGreater(conn.sndNxt, conn.sndMax) {
+				conn.sndMax = conn.sndNxt
+			}
+
+			conn.armRetransmitTimerLocked()
+		}
+
+		if unsent > 0 && inFlight == 0 && conn.sndWnd == 0 {
+			// Zero window: the retransmit timer sends window probes.
+			conn.armRetransmitTimerLocked()
+		}
+
+		return
+	}
+}
+
+func (conn *StackTCPConn) armRetransmitTimerLocked() {
+
+	if conn.retransmitTimerArmed {
+		return
+	}
+	conn.retransmitTimerArmed = true
+
+	if conn.retransmitTimer == nil {
+		conn.retransmitTimer = time.AfterFunc(conn.rto, conn.retransmit)
+	} else {
+		conn.retransmitTimer.Reset(conn.rto)
+	}
+}
+
+func (conn *StackTCPConn) restartRetransmitTimerLocked() {
+	if conn.retransmitTimer != nil {
+		conn.retransmitTimer.Stop()
+	}
+	conn.retransmitTimerArmed = false
+	conn.armRetransmitTimerLocked()
+}
+
+func (conn *StackTCPConn) stopRetransmitTimerLocked() {
+	if conn.retransmitTimer != nil {
+		conn.retransmitTimer.Stop()
+	}
+	conn.retransmitTimerArmed = false
+}
+
+// retransmit handles retransmission timeouts. Unacknowledged data is resent
+// starting from the oldest unacknowledged sequence number (go-back-N).
+func (conn *StackTCPConn) retransmit() {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if !conn.retransmitTimerArmed {
+		return
+	}
+	conn.retransmitTimerArmed = false
+
+	if conn.state != tcpStateSynReceived && conn.state != tcpStateEstablished {
+		return
+	}
+
+	conn.retransmissions += 1
+	if conn.retransmissions > stackTCPMaxRetransmissions {
+		conn.abortLocked(errStackConnReset, true)
+		return
+	}
+
+	conn.rto *= 2
+	if conn.rto > stackTCPMaxRTO {
+		conn.rto = stackTCPMaxRTO
+	}
+
+	// Karn's algorithm: don't sample the RTT of retransmitted segments.
+	conn.rttTiming = false
+
+	if conn.state == tcpStateSynReceived {
+		conn.sendSYNACKLocked()
+		conn.armRetransmitTimerLocked()
+		return
+	}
+
+	inFlight := conn.inFlightLocked()
+	unsent := len(conn.sendBuffer) - inFlight
+
+	if conn.sndNxt == conn.sndUna && unsent > 0 && conn.sndWnd == 0 {
+
+		// Zero window probe: send one byte beyond the window.
+
+		conn.sendDataLocked(conn.sndNxt, conn.sendBuffer[0:1], 0)
+		conn.sndNxt += 1
+		if seqGreater(conn.sndNxt, conn.sndMax) {
+			conn.sndMax = conn.sndNxt
+		}
+		conn.armRetransmitTimerLocked()
+		return
+	}
+
+	if conn.sndNxt == conn.sndUna {
+		return
+	}
+
+	conn.ssthresh = inFlight / 2
+	if conn.ssthresh < 2*conn.mss {
+		conn.ssthresh = 2 * conn.mss
+	}
+	conn.cwnd = conn.mss
+	conn.duplicateACKs = 0
+
+	// When the client's window is now zero, outputLocked sends nothing and
+	// arms the timer for a subsequent window probe.
+
+	conn.sndNxt = conn.sndUna
+	conn.outputLocked()
+}
+
+// updateRTTLocked updates the RTT estimate and retransmission timeout, as
+// per RFC 6298.
+func (conn *StackTCPConn) updateRTTLocked(sample time.Duration) {
+
+	if conn.srtt == 0 {
+		conn.srtt = sample
+		conn.rttvar = sample / 2
+	} else {
+		delta := conn.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		conn.rttvar = (3*conn.rttvar + delta) / 4
+		conn.srtt = (7*conn.srtt + sample) / 8
+	}
+
+	conn.rto = conn.srtt + 4*conn.rttvar
+	if conn.rto < stackTCPMinRTO {
+		conn.rto = stackTCPMinRTO
+	} else if conn.rto > stackTCPMaxRTO {
+		conn.rto = stackTCPMaxRTO
+	}
+}
+
+// seqGreater returns true when sequence number a is after b, accounting for
+// wraparound.
+func seqGreater(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// handleSegment processes a segment received from the client.
+func (conn *StackTCPConn) handleSegment(segment *tcpSegment) {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.state == tcpStateClosed {
+		return
+	}
+
+	if segment.flags&tcpFlagRST != 0 {
+
+		// Accept resets in the receive window. Before Accept, rcvNxt is
+		// the next sequence number after the SYN.
+
+		offset := segment.seq - conn.rcvNxt
+		if offset < uint32(STACK_TCP_RECEIVE_BUFFER_SIZE) ||
+			segment.seq == conn.receivedInitialSequence {
+			conn.abortLocked(errStackConnReset, false)
+		}
+		return
+	}
+
+	if segment.flags&tcpFlagSYN != 0 {
+
+		// A retransmitted SYN. Before Accept, the client will continue to
+		// retransmit until the Stack user responds. After Accept, the
+		// SYN-ACK may have been lost.
+
+		if conn.state == tcpStateSynReceived &&
+			segment.seq == conn.receivedInitialSequence {
+			conn.sendSYNACKLocked()
+		} else if conn.state == tcpStateEstablished {
+			conn.sendACKLocked()
+		}
+		return
+	}
+
+	if conn.state == tcpStatePending || segment.flags&tcpFlagACK == 0 {
+		return
+	}
+
+	conn.handleACKLocked(segment)
+
+	if conn.state != tcpStateEstablished {
+		return
+	}
+
+	conn.handleDataLocked(segment)
+
+	conn.outputLocked()
+	conn.checkDoneLocked()
+}
+
+func (conn *StackTCPConn) handleACKLocked(segment *tcpSegment) {
+
+	window := int(segment.window)
+	if conn.windowScaling {
+		window <<= uint(conn.peerWindowShift)
+	}
+
+	if conn.state == tcpStateSynReceived {
+
+		if segment.ack != conn.iss+1 {
+			conn.stack.sendTCPReset(
+				conn.localIPAddress, conn.localPort,
+				conn.remoteIPAddress, conn.remotePort,
+				segment.ack, 0, false)
+			return
+		}
+
+		conn.state = tcpStateEstablished
+		conn.sndUna = segment.ack
+		conn.sndWnd = window
+		conn.retransmissions = 0
+		conn.stopRetransmitTimerLocked()
+		conn.waiter.broadcastLocked()
+		return
+	}
+
+	// Any ACK from the client indicates that it's still reachable.
+	conn.retransmissions = 0
+
+	if seqGreater(segment.ack, conn.sndMax) {
+		// Acknowledges data never sent.
+		conn.sendACKLocked()
+		return
+	}
+
+	if seqGreater(segment.ack, conn.sndUna) {
+
+		acked := int(segment.ack - conn.sndUna)
+
+		if conn.finSent && seqGreater(segment.ack, conn.finSeq) {
+			conn.finAcked = true
+			acked -= 1
+		}
+
+		if acked > len(conn.sendBuffer) {
+			acked = len(conn.sendBuffer)
+		}
+		conn.sendBuffer = conn.sendBuffer[acked:]
+		if len(conn.sendBuffer) == 0 {
+			conn.sendBuffer = nil
+		}
+
+		conn.sndUna = segment.ack
+		if seqGreater(conn.sndUna, conn.sndNxt) {
+			conn.sndNxt = conn.sndUna
+		}
+
+		if conn.rttTiming && seqGreater(segment.ack, conn.rttSeq) {
+			conn.rttTiming = false
+			conn.updateRTTLocked(time.Since(conn.rttStart))
+		}
+
+		if conn.cwnd < conn.ssthresh {
+			conn.cwnd += acked
+		} else if conn.cwnd > 0 {
+			conn.cwnd += conn.mss * conn.mss / conn.cwnd
+		}
+		if conn.cwnd > STACK_TCP_SEND_BUFFER_SIZE {
+			conn.cwnd = STACK_TCP_SEND_BUFFER_SIZE
+		}
+
+		conn.duplicateACKs = 0
+		conn.sndWnd = window
+
+		if conn.sndNxt == conn.sndUna {
+			conn.stopRetransmitTimerLocked()
+		} else {
+			conn.restartRetransmitTimerLocked()
+		}
+
+		conn.waiter.broadcastLocked()
+		return
+	}
+
+	if segment.ack == conn.sndUna &&
+		len(segment.payload) == 0 &&
+		segment.flags&tcpFlagFIN == 0 &&
+		window == conn.sndWnd &&
+		conn.sndNxt != conn.sndUna {
+
+		conn.duplicateACKs += 1
+
+		if conn.duplicateACKs == stackTCPDuplicateACKTheshold {
+
+			// Fast retransmit of the oldest unacknowledged segment.
+
+			inFlight := conn.inFlightLocked()
+
+			conn.ssthresh = inFlight / 2
+			if conn.ssthresh < 2*conn.mss {
+				conn.ssthresh = 2 * conn.mss
+			}
+			conn.cwnd = conn.ssthresh
+			conn.rttTiming = false
+
+			n := inFlight
+			if n > conn.mss {
+				n = conn.mss
+			}
+			if n > 0 {
+				conn.sendDataLocked(conn.sndUna, conn.sendBuffer[0:n], 0)
+			} else if conn.finSent {
+				conn.sendDataLocked(conn.finSeq, nil, tcpFlagFIN)
+			}
+			conn.restartRetransmitTimerLocked()
+		}
+		return
+	}
+
+	conn.sndWnd = window
+}
+
+func (conn *StackTCPConn) handleDataLocked(segment *tcpSegment) {
+
+	payload := segment.payload
+	hasFIN := segment.flags&tcpFlagFIN != 0
+
+	if len(payload) == 0 && !hasFIN {
+		return
+	}
+
+	if conn.peerFIN {
+		// Retransmitted FIN, or data after FIN.
+		conn.sendACKLocked()
+		return
+	}
+
+	seq := segment.seq
+
+	// Trim any prefix that was already received.
+
+	if seqGreater(conn.rcvNxt, seq) {
+		duplicate := int(conn.rcvNxt - seq)
+		if duplicate > len(payload) {
+			if hasFIN && duplicate == len(payload)+1 {
+				// The FIN was already received.
+				conn.sendACKLocked()
+				return
+			}
+			duplicate = len(payload)
+			hasFIN = false
+		}
+		payload = payload[duplicate:]
+		seq = conn.rcvNxt
+		if len(payload) == 0 && !hasFIN {
+			conn.sendACKLocked()
+			return
+		}
+	}
+
+	if seq != conn.rcvNxt {
+		// Out of order. The duplicate ACK prompts the client to retransmit.
+		conn.sendACKLocked()
+		return
+	}
+
+	if len(payload) > 0 && conn.readClosed {
+		// Data arriving after Close is discarded and the connection reset.
+		conn.abortLocked(errStackConnClosed, true)
+		return
+	}
+
+	window := conn.receiveWindowLocked()
+	if len(payload) > window {
+		payload = payload[:window]
+		hasFIN = false
+	}
+
+	if len(payload) > 0 {
+		conn.receiveBuffer = append(conn.receiveBuffer, payload...)
+		conn.rcvNxt += uint32(len(payload))
+	}
+
+	if hasFIN {
+		conn.peerFIN = true
+		conn.rcvNxt += 1
+	}
+
+	conn.waiter.broadcastLocked()
+
+	if hasFIN || len(payload) < len(segment.payload) {
+		conn.sendACKLocked()
+	} else {
+		conn.scheduleACKLocked()
+	}
+}
+
+// StackUDPConn is a UDP flow initiated by a packet tunnel client and
+// terminated by a Stack. Each Read returns one datagram sent by the client
+// and each Write sends one datagram to the client. StackUDPConn implements
+// net.Conn. LocalAddr is the client's destination address and RemoteAddr is
+// the client's source address.
+type StackUDPConn struct {
+	stack           *Stack
+	flow            flowID
+	localIPAddress  net.IP
+	localPort       uint16
+	remoteIPAddress net.IP
+	remotePort      uint16
+	hostname        string
+	mutex           sync.Mutex
+	waiter          stackConnWaiter
+	closed          bool
+	queue           [][]byte
+}
+
+func newStackUDPConn(
+	stack *Stack,
+	ID flowID,
+	sourceIPAddress, destinationIPAddress net.IP,
+	sourcePort, destinationPort int) *StackUDPConn {
+
+	return &StackUDPConn{
+		stack:           stack,
+		flow:            ID,
+		localIPAddress:  append(net.IP(nil), destinationIPAddress...),
+		localPort:       uint16(destinationPort),
+		remoteIPAddress: append(net.IP(nil), sourceIPAddress...),
+		remotePort:      uint16(sourcePort),
+		hostname:        stack.resolvedDomains.lookup(ID.upstreamIPAddress),
+		waiter:          newStackConnWaiter(),
+	}
+}
+
+// Hostname returns the domain most recently resolved, via transparent DNS,
+// to the flow's destination IP address, or "" when there is no such domain.
+func (conn *StackUDPConn) Hostname() string {
+	return conn.hostname
+}
+
+// IsTransparentDNS indicates whether the flow is to a transparent DNS
+// resolver address. The Stack user is expected to relay such flows to a
+// DNS resolver. Responses written to the flow are inspected to record
+// resolved domains.
+func (conn *StackUDPConn) IsTransparentDNS() bool {
+	return isTransparentDNSDestination(conn.localIPAddress, int(conn.localPort))
+}
+
+// LocalAddr returns the client's destination address.
+func (conn *StackUDPConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: conn.localIPAddress, Port: int(conn.localPort)}
+}
+
+// RemoteAddr returns the client's source address.
+func (conn *StackUDPConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: conn.remoteIPAddress, Port: int(conn.remotePort)}
+}
+
+// enqueue adds a datagram received from the client to the read queue. When
+// the queue is full, the datagram is dropped.
+func (conn *StackUDPConn) enqueue(datagram []byte) {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.closed || len(conn.queue) >= STACK_UDP_QUEUE_SIZE {
+		return
+	}
+
+	// Copy the datagram; the packet buffer will be reused.
+	conn.queue = append(conn.queue, append([]byte(nil), datagram...))
+	conn.waiter.broadcastLocked()
+}
+
+// Read implements net.Conn.Read. Datagrams larger than buffer are
+// truncated.
+func (conn *StackUDPConn) Read(buffer []byte) (int, error) {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	for len(conn.queue) == 0 {
+		if conn.closed {
+			return 0, errors.Trace(errStackConnClosed)
+		}
+		if !conn.waiter.waitLocked(&conn.mutex, conn.waiter.readDeadline) {
+			return 0, errStackDeadlineExceeded
+		}
+	}
+
+	datagram := conn.queue[0]
+	conn.queue[0] = nil
+	conn.queue = conn.queue[1:]
+
+	return copy(buffer, datagram), nil
+}
+
+// Write implements net.Conn.Write. Write doesn't block; when the downstream
+// packet queue is full, the datagram is dropped.
+func (conn *StackUDPConn) Write(buffer []byte) (int, error) {
+
+	conn.mutex.Lock()
+	closed := conn.closed
+	conn.mutex.Unlock()
+
+	if closed {
+		return 0, errors.Trace(errStackConnClosed)
+	}
+
+	IPHeaderLength := 40
+	if len(conn.localIPAddress) == net.IPv4len {
+		IPHeaderLength = 20
+	}
+	if IPHeaderLength+8+len(buffer) > conn.stack.mtu {
+		return 0, errors.TraceNew("datagram exceeds MTU")
+	}
+
+	if conn.IsTransparentDNS() {
+		conn.stack.resolvedDomains.update(buffer)
+	}
+
+	conn.stack.sendUDPDatagram(
+		conn.localIPAddress, conn.localPort,
+		conn.remoteIPAddress, conn.remotePort,
+		buffer)
+
+	return len(buffer), nil
+}
+
+// Close implements net.Conn.Close.
+func (conn *StackUDPConn) Close() error {
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.closed {
+		return nil
+	}
+
+	conn.closed = true
+	conn.queue = nil
+	conn.waiter.broadcastLocked()
+
+	conn.stack.removeUDPConn(conn)
+
+	return nil
+}
+
+// SetDeadline implements net.Conn.SetDeadline. Only the read deadline
+// applies, as Write doesn't block.
+func (conn *StackUDPConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.SetReadDeadline.
+func (conn *StackUDPConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.waiter.readDeadline = t
+	conn.waiter.broadcastLocked()
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.SetWriteDeadline.
+func (conn *StackUDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,511 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+func TestStack(t *testing.T) {
+	t.Run("IPv4", func(t *testing.T) {
+		testStack(t, net.ParseIP("192.168.0.2").To4(), net.ParseIP("192.0.2.1").To4())
+	})
+	t.Run("IPv6", func(t *testing.T) {
+		testStack(t, net.ParseIP("fd00::2"), net.ParseIP("2001:db8::1"))
+	})
+}
+
+func testStack(t *testing.T, clientIPAddress, serverIPAddress net.IP) {
+
+	client, err := newTestStackClient(clientIPAddress, 0)
+	if err != nil {
+		t.Fatalf("newTestStackClient failed: %s", err)
+	}
+	defer client.stop()
+
+	// Test: connection is rejected
+
+	client.sendTCP(serverIPAddress, 1001, 80, 1000, 0, tcpFlagSYN, nil)
+
+	conn := client.awaitTCPConn(t)
+	conn.Reject()
+
+	packet := client.awaitPacket(t)
+	if packet.flags != tcpFlagRST|tcpFlagACK || packet.ack != 1001 {
+		t.Fatalf("unexpected reject packet: %+v", packet)
+	}
+
+	// Test: handshake, data transfer, and close
+
+	client.sendTCP(serverIPAddress, 1002, 80, 5000, 0, tcpFlagSYN, nil)
+
+	conn = client.awaitTCPConn(t)
+	if conn.LocalAddr().String() != (&net.TCPAddr{IP: serverIPAddress, Port: 80}).String() {
+		t.Fatalf("unexpected local address: %s", conn.LocalAddr())
+	}
+
+	err = conn.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+
+	packet = client.awaitPacket(t)
+	if packet.flags != tcpFlagSYN|tcpFlagACK || packet.ack != 5001 {
+		t.Fatalf("unexpected SYN-ACK packet: %+v", packet)
+	}
+	serverSeq := packet.seq + 1
+
+	client.sendTCP(serverIPAddress, 1002, 80, 5001, serverSeq, tcpFlagACK|tcpFlagPSH, []byte("hello"))
+
+	buffer := make([]byte, 1024)
+	n, err := conn.Read(buffer)
+	if err != nil || string(buffer[:n]) != "hello" {
+		t.Fatalf("unexpected Read result: %s, %v", string(buffer[:n]), err)
+	}
+
+	_, err = conn.Write([]byte("world"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	// The data segment carries any pending ACK.
+	packet = client.awaitPacket(t)
+	if packet.seq != serverSeq || packet.ack != 5006 || string(packet.payload) != "world" {
+		t.Fatalf("unexpected data packet: %+v", packet)
+	}
+	serverSeq += 5
+
+	client.sendTCP(serverIPAddress, 1002, 80, 5006, serverSeq, tcpFlagACK|tcpFlagFIN, nil)
+
+	packet = client.awaitPacket(t)
+	if packet.flags != tcpFlagACK || packet.ack != 5007 {
+		t.Fatalf("unexpected FIN ACK packet: %+v", packet)
+	}
+
+	_, err = conn.Read(buffer)
+	if err != io.EOF {
+		t.Fatalf("unexpected Read result: %v", err)
+	}
+
+	conn.Close()
+
+	packet = client.awaitPacket(t)
+	if packet.flags != tcpFlagACK|tcpFlagFIN || packet.seq != serverSeq {
+		t.Fatalf("unexpected FIN packet: %+v", packet)
+	}
+
+	client.sendTCP(serverIPAddress, 1002, 80, 5007, serverSeq+1, tcpFlagACK, nil)
+
+	err = client.awaitCondition(func() bool {
+		client.stack.flowsMutex.Lock()
+		defer client.stack.flowsMutex.Unlock()
+		return len(client.stack.tcpConns) == 0
+	})
+	if err != nil {
+		t.Fatalf("connection not removed: %s", err)
+	}
+
+	// Test: unacknowledged data is retransmitted
+
+	client.sendTCP(serverIPAddress, 1003, 443, 9000, 0, tcpFlagSYN, nil)
+	conn = client.awaitTCPConn(t)
+	conn.Accept()
+	packet = client.awaitPacket(t)
+	serverSeq = packet.seq + 1
+	client.sendTCP(serverIPAddress, 1003, 443, 9001, serverSeq, tcpFlagACK, nil)
+
+	_, err = conn.Write([]byte("retransmit"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	packet = client.awaitPacket(t)
+	if packet.seq != serverSeq || string(packet.payload) != "retransmit" {
+		t.Fatalf("unexpected data packet: %+v", packet)
+	}
+
+	packet = client.awaitPacket(t)
+	if packet.seq != serverSeq || string(packet.payload) != "retransmit" {
+		t.Fatalf("unexpected retransmitted packet: %+v", packet)
+	}
+
+	// Test: client reset closes the connection
+
+	client.sendTCP(serverIPAddress, 1003, 443, 9001, 0, tcpFlagRST, nil)
+
+	_, err = conn.Read(buffer)
+	if err == nil {
+		t.Fatalf("unexpected Read success")
+	}
+
+	// Test: segments for unknown connections are reset
+
+	client.sendTCP(serverIPAddress, 1004, 443, 100, 200, tcpFlagACK, nil)
+
+	packet = client.awaitPacket(t)
+	if packet.flags != tcpFlagRST || packet.seq != 200 {
+		t.Fatalf("unexpected reset packet: %+v", packet)
+	}
+
+	// Test: transparent DNS over UDP, and domains resolved via transparent
+	// DNS are associated with subsequent flows
+
+	DNSResolverIPAddress := transparentDNSResolverIPv4Address
+	if len(clientIPAddress) == net.IPv6len {
+		DNSResolverIPAddress = transparentDNSResolverIPv6Address
+	}
+
+	query := []byte("query")
+	client.sendUDP(DNSResolverIPAddress, 2000, portNumberDNS, query)
+
+	UDPConn := client.awaitUDPConn(t)
+	if !UDPConn.IsTransparentDNS() {
+		t.Fatalf("unexpected IsTransparentDNS result")
+	}
+
+	n, err = UDPConn.Read(buffer)
+	if err != nil || !bytes.Equal(buffer[:n], query) {
+		t.Fatalf("unexpected Read result: %x, %v", buffer[:n], err)
+	}
+
+	response := makeTestDNSResponse("www.example.com", serverIPAddress)
+	_, err = UDPConn.Write(response)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	packet = client.awaitPacket(t)
+	if !packet.sourceIPAddress.Equal(DNSResolverIPAddress) ||
+		packet.sourcePort != portNumberDNS ||
+		packet.destinationPort != 2000 ||
+		!bytes.Equal(packet.payload, response) {
+		t.Fatalf("unexpected DNS response packet: %+v", packet)
+	}
+
+	UDPConn.Close()
+
+	client.sendTCP(serverIPAddress, 1005, 443, 100, 0, tcpFlagSYN, nil)
+	conn = client.awaitTCPConn(t)
+	if conn.Hostname() != "www.example.com" {
+		t.Fatalf("unexpected hostname: %s", conn.Hostname())
+	}
+	conn.Reject()
+	client.awaitPacket(t)
+
+	// Test: disallowed destinations are dropped
+
+	privateIPAddress := net.ParseIP("10.0.0.3").To4()
+	if len(clientIPAddress) == net.IPv6len {
+		privateIPAddress = net.ParseIP("fd19:ca83:e6d5:1c44::3")
+	}
+
+	client.sendUDP(privateIPAddress, 2001, 1234, query)
+	client.sendTCP(privateIPAddress, 1006, 443, 100, 0, tcpFlagSYN, nil)
+
+	select {
+	case <-client.UDPConns:
+		t.Fatalf("unexpected UDP conn")
+	case <-client.TCPConns:
+		t.Fatalf("unexpected TCP conn")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestStackMaxFlows(t *testing.T) {
+
+	clientIPAddress := net.ParseIP("192.168.0.2").To4()
+	serverIPAddress := net.ParseIP("192.0.2.1").To4()
+
+	client, err := newTestStackClient(clientIPAddress, 2)
+	if err != nil {
+		t.Fatalf("newTestStackClient failed: %s", err)
+	}
+	defer client.stop()
+
+	client.sendTCP(serverIPAddress, 1001, 80, 1000, 0, tcpFlagSYN, nil)
+	client.awaitTCPConn(t)
+
+	client.sendUDP(serverIPAddress, 2001, 53, []byte("query"))
+	UDPConn := client.awaitUDPConn(t)
+
+	// Test: new flows beyond the limit are reset or dropped
+
+	client.sendTCP(serverIPAddress, 1002, 80, 2000, 0, tcpFlagSYN, nil)
+
+	packet := client.awaitPacket(t)
+	if packet.destinationPort != 1002 || packet.flags&tcpFlagRST == 0 || packet.ack != 2001 {
+		t.Fatalf("unexpected reset packet: %+v", packet)
+	}
+
+	client.sendUDP(serverIPAddress, 2002, 53, []byte("query"))
+
+	select {
+	case <-client.UDPConns:
+		t.Fatalf("unexpected UDP conn")
+	case <-client.TCPConns:
+		t.Fatalf("unexpected TCP conn")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Test: closed flows no longer count against the limit
+
+	UDPConn.Close()
+
+	client.sendUDP(serverIPAddress, 2003, 53, []byte("query"))
+	client.awaitUDPConn(t)
+}
+
+type testStackPacket struct {
+	sourceIPAddress net.IP
+	sourcePort      uint16
+	destinationPort uint16
+	seq             uint32
+	ack             uint32
+	flags           byte
+	payload         []byte
+}
+
+type testStackClient struct {
+	IPAddress net.IP
+	stack     *Stack
+	channel   *Channel
+	packets   chan *testStackPacket
+	errors    chan error
+	TCPConns  chan *StackTCPConn
+	UDPConns  chan *StackUDPConn
+}
+
+func newTestStackClient(IPAddress net.IP, maxFlows int) (*testStackClient, error) {
+
+	stackConn, clientConn := net.Pipe()
+
+	client := &testStackClient{
+		IPAddress: IPAddress,
+		channel:   NewChannel(clientConn, DEFAULT_MTU),
+		packets:   make(chan *testStackPacket, 16),
+		errors:    make(chan error, 1),
+		TCPConns:  make(chan *StackTCPConn, 16),
+		UDPConns:  make(chan *StackUDPConn, 16),
+	}
+
+	stack, err := NewStack(&StackConfig{
+		Logger:        newTestLogger(false),
+		Transport:     stackConn,
+		MaxFlows:      maxFlows,
+		HandleTCPConn: func(conn *StackTCPConn) { client.TCPConns <- conn },
+		HandleUDPConn: func(conn *StackUDPConn) { client.UDPConns <- conn },
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	client.stack = stack
+
+	stack.Start()
+
+	go func() {
+		for {
+			packet, err := client.channel.ReadPacket()
+			if err != nil {
+				return
+			}
+			parsedPacket, err := parseTestStackPacket(packet)
+			if err != nil {
+				client.errors <- err
+				return
+			}
+			client.packets <- parsedPacket
+		}
+	}()
+
+	return client, nil
+}
+
+func (client *testStackClient) stop() {
+	client.stack.Stop()
+}
+
+func (client *testStackClient) sendTCP(
+	serverIPAddress net.IP, sourcePort, destinationPort uint16,
+	seq, ack uint32, flags byte, payload []byte) {
+
+	packet, segment := client.stack.makePacket(
+		client.IPAddress, serverIPAddress, internetProtocolTCP, 20+len(payload))
+
+	binary.BigEndian.PutUint16(segment[0:2], sourcePort)
+	binary.BigEndian.PutUint16(segment[2:4], destinationPort)
+	binary.BigEndian.PutUint32(segment[4:8], seq)
+	binary.BigEndian.PutUint32(segment[8:12], ack)
+	segment[12] = 5 << 4
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:16], 0xFFFF)
+	copy(segment[20:], payload)
+	binary.BigEndian.PutUint16(
+		segment[16:18],
+		transportChecksum(client.IPAddress, serverIPAddress, internetProtocolTCP, segment))
+
+	client.channel.WritePacket(packet)
+}
+
+func (client *testStackClient) sendUDP(
+	serverIPAddress net.IP, sourcePort, destinationPort uint16, payload []byte) {
+
+	packet, datagram := client.stack.makePacket(
+		client.IPAddress, serverIPAddress, internetProtocolUDP, 8+len(payload))
+
+	binary.BigEndian.PutUint16(datagram[0:2], sourcePort)
+	binary.BigEndian.PutUint16(datagram[2:4], destinationPort)
+	binary.BigEndian.PutUint16(datagram[4:6], uint16(8+len(payload)))
+	copy(datagram[8:], payload)
+
+	client.channel.WritePacket(packet)
+}
+
+func (client *testStackClient) awaitPacket(t *testing.T) *testStackPacket {
+	select {
+	case packet := <-client.packets:
+		return packet
+	case err := <-client.errors:
+		t.Fatalf("invalid packet: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout awaiting packet")
+	}
+	return nil
+}
+
+func (client *testStackClient) awaitTCPConn(t *testing.T) *StackTCPConn {
+	select {
+	case conn := <-client.TCPConns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout awaiting TCP conn")
+	}
+	return nil
+}
+
+func (client *testStackClient) awaitUDPConn(t *testing.T) *StackUDPConn {
+	select {
+	case conn := <-client.UDPConns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout awaiting UDP conn")
+	}
+	return nil
+}
+
+func (client *testStackClient) awaitCondition(condition func() bool) error {
+	for i := 0; i < 50; i++ {
+		if condition() {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return errors.TraceNew("timeout")
+}
+
+// parseTestStackPacket parses and validates a packet sent by the Stack.
+func parseTestStackPacket(packet []byte) (*testStackPacket, error) {
+
+	var sourceIPAddress, destinationIPAddress net.IP
+	var protocol internetProtocol
+	var payload []byte
+
+	if packet[0]>>4 == 4 {
+		if internetChecksum(0, packet[0:20]) != 0 {
+			return nil, errors.TraceNew("invalid IP checksum")
+		}
+		if int(binary.BigEndian.Uint16(packet[2:4])) != len(packet) {
+			return nil, errors.TraceNew("invalid IP length")
+		}
+		protocol = internetProtocol(packet[9])
+		sourceIPAddress = packet[12:16]
+		destinationIPAddress = packet[16:20]
+		payload = packet[20:]
+	} else {
+		if int(binary.BigEndian.Uint16(packet[4:6])) != len(packet)-40 {
+			return nil, errors.TraceNew("invalid IP length")
+		}
+		protocol = internetProtocol(packet[6])
+		sourceIPAddress = packet[8:24]
+		destinationIPAddress = packet[24:40]
+		payload = packet[40:]
+	}
+
+	if transportChecksum(sourceIPAddress, destinationIPAddress, protocol, payload) != 0 {
+		return nil, errors.TraceNew("invalid transport checksum")
+	}
+
+	parsedPacket := &testStackPacket{
+		sourceIPAddress: append(net.IP(nil), sourceIPAddress...),
+	}
+
+	if protocol == internetProtocolTCP {
+		segment, ok := parseTCPSegment(payload)
+		if !ok {
+			return nil, errors.TraceNew("invalid TCP segment")
+		}
+		parsedPacket.sourcePort = segment.sourcePort
+		parsedPacket.destinationPort = segment.destinationPort
+		parsedPacket.seq = segment.seq
+		parsedPacket.ack = segment.ack
+		parsedPacket.flags = segment.flags
+		parsedPacket.payload = append([]byte(nil), segment.payload...)
+	} else {
+		parsedPacket.sourcePort = binary.BigEndian.Uint16(payload[0:2])
+		parsedPacket.destinationPort = binary.BigEndian.Uint16(payload[2:4])
+		parsedPacket.payload = append([]byte(nil), payload[8:]...)
+	}
+
+	return parsedPacket, nil
+}
+
+// makeTestDNSResponse makes a DNS response message with a single A or AAAA
+// answer.
+func makeTestDNSResponse(domain string, IPAddress net.IP) []byte {
+
+	message := []byte{0, 0, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0}
+
+	var name []byte
+	for _, label := range bytes.Split([]byte(domain), []byte(".")) {
+		name = append(name, byte(len(label)))
+		name = append(name, label...)
+	}
+	name = append(name, 0)
+
+	recordType := byte(dnsTypeAAAA)
+	if len(IPAddress) == net.IPv4len {
+		recordType = dnsTypeA
+	}
+
+	message = append(message, name...)
+	message = append(message, 0, recordType, 0, 1)
+
+	message = append(message, 0xC0, 12)
+	message = append(message, 0, recordType, 0, 1, 0, 0, 0x0E, 0x10, 0, byte(len(IPAddress)))
+	message = append(message, IPAddress...)
+
+	return message
+}
@@ -138,12 +138,25 @@ import (
 
 	"github.com/Psiphon-Labs/goarista/monotime"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/datagram"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
 )
 
+// DEFAULT_MTU is set so that a packet relayed over a datagram channel, with
+// the channel header, datagram channel overhead, and IPv6 and UDP headers,
+// isn't subject to IP fragmentation on a path with a typical 1500 byte MTU.
+//
+// Older clients use LEGACY_MTU, so the server accepts packets up to that
+// size regardless of its configured MTU; see getChannelMTU.
+const (
+	datagramChannelPathMTU  = 1500
+	datagramChannelOverhead = 40 + 8 + datagram.OVERHEAD + channelHeaderSize
+)
+
 const (
-	DEFAULT_MTU                          = 1500
+	DEFAULT_MTU                          = datagramChannelPathMTU - datagramChannelOverhead
+	LEGACY_MTU                           = 1500
 	DEFAULT_DOWNSTREAM_PACKET_QUEUE_SIZE = 32768 * 16
 	DEFAULT_UPSTREAM_PACKET_QUEUE_SIZE   = 32768
 	DEFAULT_IDLE_SESSION_EXPIRY_SECONDS  = 300
@@ -326,9 +339,10 @@ func (server *Server) Stop() {
 }
 
 // AllowedPortChecker is a function which returns true when it is
-// permitted to relay packets to the specified upstream IP address
-// and/or port.
-type AllowedPortChecker func(upstreamIPAddress net.IP, port int) bool
+// permitted to relay packets to the specified upstream hostname (if
+// known -- may be ""), IP address, and/or port.
+type AllowedPortChecker func(
+	upstreamHostname string, upstreamIPAddress net.IP, port int) bool
 
 // FlowActivityUpdater defines an interface for receiving updates for
 // flow activity. Values passed to UpdateProgress are bytes transferred
@@ -360,8 +374,9 @@ type MetricsUpdater func(
 // checkAllowedTCPPortFunc/checkAllowedUDPPortFunc are callbacks used
 // to enforce traffic rules. For each TCP/UDP packet, the corresponding
 // function is called to check if traffic to the packet's port is
-// permitted. These callbacks must be efficient and safe for concurrent
-// calls.
+// permitted. The upstream hostname is the domain most recently resolved
+// to the upstream IP address via transparent DNS, if any. These
+// callbacks must be efficient and safe for concurrent calls.
 //
 // flowActivityUpdaterMaker is a callback invoked for each new packet
 // flow; it may create updaters to track flow activity.
@@ -442,6 +457,7 @@ func (server *Server) ClientConnected(
 			metrics:                  new(packetMetrics),
 			DNSResolverIPv4Addresses: append([]net.IP(nil), DNSResolverIPv4Addresses...),
 			DNSResolverIPv6Addresses: append([]net.IP(nil), server.config.GetDNSResolverIPv6Addresses()...),
+			resolvedDomains:          newResolvedDomains(),
 			workers:                  new(sync.WaitGroup),
 		}
 
@@ -462,7 +478,7 @@ func (server *Server) ClientConnected(
 
 	server.resumeSession(
 		clientSession,
-		NewChannel(transport, MTU),
+		NewChannel(transport, getChannelMTU(MTU)),
 		checkAllowedTCPPortFunc,
 		checkAllowedUDPPortFunc,
 		flowActivityUpdaterMaker,
@@ -1070,6 +1086,7 @@ type session struct {
 	assignedIPv6Address      net.IP
 	setOriginalIPv6Address   int32
 	originalIPv6Address      net.IP
+	resolvedDomains          *resolvedDomains
 	flows                    sync.Map
 	workers                  *sync.WaitGroup
 	mutex                    sync.Mutex
@@ -1254,10 +1271,12 @@ func (session *session) isTrackingFlow(ID flowID) bool {
 // - OSLs
 // - domain bytes transferred [TODO]
 //
-// The applicationData from the first packet in the flow is
-// inspected to determine any associated hostname, using HTTP or
-// TLS payload. The session's FlowActivityUpdaterMaker is invoked
-// to determine a list of updaters to track flow activity.
+// The hostname associated with the flow is the domain most recently
+// resolved to the upstream IP address via transparent DNS, if any.
+// [TODO: otherwise, the applicationData from the first packet in the
+// flow is inspected to determine any associated hostname, using HTTP or
+// TLS payload.] The session's FlowActivityUpdaterMaker is invoked to
+// determine a list of updaters to track flow activity.
 //
 // Updaters receive reports with the number of application data
 // bytes in each flow packet. This number, totalled for all packets
@@ -1285,9 +1304,9 @@ func (session *session) startTrackingFlow(
 		session.reapFlows()
 	}
 
-	var hostname string
+	hostname := session.resolvedDomains.lookup(ID.upstreamIPAddress)
 	//lint:ignore SA9003 intentionally empty branch
-	if ID.protocol == internetProtocolTCP {
+	if hostname == "" && ID.protocol == internetProtocolTCP {
 		// TODO: implement
 		// hostname = common.ExtractHostnameFromTCPFlow(applicationData)
 	}
@@ -1361,6 +1380,7 @@ func (session *session) reapFlows() {
 		}
 		return true
 	})
+	session.resolvedDomains.reap()
 }
 
 type packetMetrics struct {
@@ -2154,7 +2174,7 @@ func processPacket(
 				return false
 			}
 		} else if protocol == internetProtocolUDP {
-			dataOffset := 28
+			dataOffset = 28
 			if len(packet) < dataOffset {
 				metrics.rejectedPacket(direction, packetRejectUDPProtocolLength)
 				return false
@@ -2208,7 +2228,7 @@ func processPacket(
 				return false
 			}
 		} else if protocol == internetProtocolUDP {
-			dataOffset := 48
+			dataOffset = 48
 			if len(packet) < dataOffset {
 				metrics.rejectedPacket(direction, packetRejectUDPProtocolLength)
 				return false
@@ -2344,7 +2364,12 @@ func processPacket(
 
 	if !doTransparentDNS && !isTrackingFlow {
 
-		// Enforce traffic rules (allowed TCP/UDP ports).
+		// Enforce traffic rules (allowed TCP/UDP ports and domains).
+
+		var upstreamHostname string
+		if isServer {
+			upstreamHostname = session.resolvedDomains.lookup(ID.upstreamIPAddress)
+		}
 
 		checkPort := 0
 		if direction == packetDirectionServerUpstream ||
@@ -2365,7 +2390,8 @@ func processPacket(
 			if !invalidPort && isServer {
 				checkAllowedTCPPortFunc := session.getCheckAllowedTCPPortFunc()
 				if checkAllowedTCPPortFunc == nil ||
-					!checkAllowedTCPPortFunc(net.IP(ID.upstreamIPAddress[:]), checkPort) {
+					!checkAllowedTCPPortFunc(
+						upstreamHostname, net.IP(ID.upstreamIPAddress[:]), checkPort) {
 					invalidPort = true
 				}
 			}
@@ -2382,7 +2408,8 @@ func processPacket(
 			if !invalidPort && isServer {
 				checkAllowedUDPPortFunc := session.getCheckAllowedUDPPortFunc()
 				if checkAllowedUDPPortFunc == nil ||
-					!checkAllowedUDPPortFunc(net.IP(ID.upstreamIPAddress[:]), checkPort) {
+					!checkAllowedUDPPortFunc(
+						upstreamHostname, net.IP(ID.upstreamIPAddress[:]), checkPort) {
 					invalidPort = true
 				}
 			}
@@ -2500,6 +2527,16 @@ func processPacket(
 		}
 	}
 
+	// Record domains resolved via transparent DNS, for traffic rules and
+	// flow tracking. Only UDP DNS responses are inspected.
+
+	if doTransparentDNS &&
+		direction == packetDirectionServerDownstream &&
+		protocol == internetProtocolUDP {
+
+		session.resolvedDomains.update(applicationData)
+	}
+
 	// Start/update flow tracking, only once past all possible packet rejects
 
 	if doFlowTracking {
@@ -2730,6 +2767,30 @@ func (device *Device) WritePacket(packet []byte) error {
 	return nil
 }
 
+// WriteFramedPackets writes each packet in a buffer of pre-framed
+// packets, as returned by PacketQueue.DequeueFramedPackets, to the
+// tun device.
+func (device *Device) WriteFramedPackets(packetBuffer []byte) error {
+
+	for len(packetBuffer) >= channelHeaderSize {
+
+		size := int(binary.BigEndian.Uint16(packetBuffer))
+		packetBuffer = packetBuffer[channelHeaderSize:]
+		if size > len(packetBuffer) {
+			return errors.TraceNew("invalid packet frame")
+		}
+
+		err := device.WritePacket(packetBuffer[:size])
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		packetBuffer = packetBuffer[size:]
+	}
+
+	return nil
+}
+
 // Close interrupts any blocking Read/Write calls and
 // tears down the tun device.
 func (device *Device) Close() error {
@@ -2753,6 +2814,13 @@ const (
 	channelHeaderSize = 2
 )
 
+// ChannelFrameSize returns the total size of the Channel packet frame which
+// starts with the specified header. ChannelFrameSize may be used to carry
+// Channel I/O over a datagram transport.
+func ChannelFrameSize(header []byte) int {
+	return channelHeaderSize + int(binary.BigEndian.Uint16(header))
+}
+
 // NewChannel initializes a new Channel.
 func NewChannel(transport io.ReadWriteCloser, MTU int) *Channel {
 	return &Channel{
@@ -389,7 +389,7 @@ func (server *testServer) run() {
 
 			sessionID := prng.HexString(SESSION_ID_LENGTH)
 
-			checkAllowedPortFunc := func(net.IP, int) bool { return true }
+			checkAllowedPortFunc := func(string, net.IP, int) bool { return true }
 
 			server.tunServer.ClientConnected(
 				sessionID,
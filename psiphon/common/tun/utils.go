@@ -116,3 +116,13 @@ func getMTU(configMTU int) int {
 	}
 	return configMTU
 }
+
+// getChannelMTU returns the maximum packet size a server will read from a
+// client channel. Clients may use an MTU larger than the server MTU, such
+// as LEGACY_MTU, and those packets are accepted.
+func getChannelMTU(MTU int) int {
+	if MTU < LEGACY_MTU {
+		return LEGACY_MTU
+	}
+	return MTU
+}
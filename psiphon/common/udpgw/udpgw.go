@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+Package udpgw defines the udpgw protocol constants shared by the client
+udpgw implementation and the server udpgw port forward multiplexer. The
+udpgw protocol multiplexes many UDP flows over a single stream.
+
+udpgw message layout:
+
+	| 2 byte size | 3 byte header | 6 or 18 byte address | variable length packet |
+
+The size is little endian and excludes the size field itself. The header
+is a 1 byte flags field followed by a little endian 2 byte connID. The
+address is a 4 or 16 byte IP address followed by a big endian 2 byte port.
+
+The udpgw protocol and original server implementation:
+Copyright (c) 2009, Ambroz Bizjak <ambrop7@gmail.com>
+https://github.com/ambrop72/badvpn
+*/
+package udpgw
+
+import (
+	"encoding/binary"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/datagram"
+)
+
+// TODO: express and/or calculate PROTOCOL_MAX_PAYLOAD_SIZE as function of MTU?
+const (
+	PROTOCOL_FLAG_KEEPALIVE = 1 << 0
+	PROTOCOL_FLAG_REBIND    = 1 << 1
+	PROTOCOL_FLAG_DNS       = 1 << 2
+	PROTOCOL_FLAG_IPV6      = 1 << 3
+
+	PROTOCOL_MAX_PREAMBLE_SIZE = 23
+	PROTOCOL_MAX_PAYLOAD_SIZE  = 32768
+	PROTOCOL_MAX_MESSAGE_SIZE  = PROTOCOL_MAX_PREAMBLE_SIZE + PROTOCOL_MAX_PAYLOAD_SIZE
+)
+
+// FrameSize returns the total size of the udpgw message which starts with
+// the specified header. FrameSize is a datagram.FrameSize, for carrying udpgw
+// messages over a datagram.FramedConn.
+func FrameSize(header []byte) int {
+	return datagram.FRAME_HEADER_SIZE + int(binary.LittleEndian.Uint16(header))
+}
@@ -0,0 +1,531 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+/*
+Package websocket implements the subset of the WebSocket protocol, RFC 6455,
+that is required to relay a byte stream, such as an obfuscated SSH tunnel,
+over a WebSocket connection.
+
+Both the client and server opening handshakes are implemented. Conn
+implements net.Conn: Write sends data in binary frames and Read returns the
+payloads of received data frames, with no message boundaries. Ping frames
+are answered and close frames end the stream. Extensions, subprotocols, and
+text message UTF-8 validation are not supported.
+*/
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+)
+
+const (
+	WEBSOCKET_VERSION              = "13"
+	MAX_CONTROL_FRAME_PAYLOAD_SIZE = 125
+
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	keyLength  = 16
+
+	opcodeContinuation = 0x0
+	opcodeText         = 0x1
+	opcodeBinary       = 0x2
+	opcodeClose        = 0x8
+	opcodePing         = 0x9
+	opcodePong         = 0xA
+
+	closeStatusNormal = 1000
+	closeFrameTimeout = 1 * time.Second
+)
+
+// IsUpgradeRequest indicates whether the HTTP request is a WebSocket opening
+// handshake request.
+func IsUpgradeRequest(request *http.Request) bool {
+	return request.Method == http.MethodGet &&
+		headerContainsToken(request.Header, "Connection", "upgrade") &&
+		headerContainsToken(request.Header, "Upgrade", "websocket")
+}
+
+// ClientHandshake performs the client side of the WebSocket opening
+// handshake over conn, which is typically a TCP or TLS connection to the
+// server or to a front. The WebSocket handshake headers are added to
+// request, which should otherwise contain the method, URL, Host and any
+// additional headers to send.
+//
+// On success, ClientHandshake returns a Conn which wraps conn. On failure,
+// the caller is responsible for closing conn. ClientHandshake may be
+// interrupted by cancelling ctx, in which case conn is closed.
+func ClientHandshake(
+	ctx context.Context, conn net.Conn, request *http.Request) (*Conn, error) {
+
+	key := base64.StdEncoding.EncodeToString(prng.Bytes(keyLength))
+
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	request.Header.Set("Sec-WebSocket-Version", WEBSOCKET_VERSION)
+
+	reader := bufio.NewReader(conn)
+
+	resultChannel := make(chan error, 1)
+
+	go func() {
+		resultChannel <- func() error {
+
+			err := request.Write(conn)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			response, err := http.ReadResponse(reader, request)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			response.Body.Close()
+
+			if response.StatusCode != http.StatusSwitchingProtocols {
+				return errors.Tracef(
+					"unexpected response status code: %d", response.StatusCode)
+			}
+
+			if !headerContainsToken(response.Header, "Connection", "upgrade") ||
+				!headerContainsToken(response.Header, "Upgrade", "websocket") {
+				return errors.TraceNew("missing upgrade response headers")
+			}
+
+			if response.Header.Get("Sec-WebSocket-Accept") != makeAcceptValue(key) {
+				return errors.TraceNew("invalid Sec-WebSocket-Accept")
+			}
+
+			return nil
+		}()
+	}()
+
+	var err error
+	select {
+	case err = <-resultChannel:
+	case <-ctx.Done():
+		err = ctx.Err()
+		// Interrupt the goroutine
+		conn.Close()
+		<-resultChannel
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return newConn(conn, reader, true), nil
+}
+
+// Upgrade performs the server side of the WebSocket opening handshake in
+// response to an upgrade request, as identified by IsUpgradeRequest.
+// responseHeader specifies optional additional headers to send in the
+// handshake response.
+//
+// Upgrade hijacks the underlying HTTP connection, which must be HTTP/1.1,
+// and clears any deadlines set on it by the http.Server. On success, the
+// caller owns the returned Conn and must close it. When the request is not a
+// valid upgrade request, Upgrade responds with an error status and the
+// connection is not hijacked.
+func Upgrade(
+	responseWriter http.ResponseWriter,
+	request *http.Request,
+	responseHeader http.Header) (*Conn, error) {
+
+	if !IsUpgradeRequest(request) {
+		http.Error(responseWriter, "", http.StatusBadRequest)
+		return nil, errors.TraceNew("not an upgrade request")
+	}
+
+	if request.Header.Get("Sec-WebSocket-Version") != WEBSOCKET_VERSION {
+		responseWriter.Header().Set("Sec-WebSocket-Version", WEBSOCKET_VERSION)
+		http.Error(responseWriter, "", http.StatusUpgradeRequired)
+		return nil, errors.TraceNew("unsupported version")
+	}
+
+	key := request.Header.Get("Sec-WebSocket-Key")
+	decodedKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decodedKey) != keyLength {
+		http.Error(responseWriter, "", http.StatusBadRequest)
+		return nil, errors.TraceNew("invalid Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := responseWriter.(http.Hijacker)
+	if !ok {
+		http.Error(responseWriter, "", http.StatusInternalServerError)
+		return nil, errors.TraceNew("hijack unsupported")
+	}
+
+	conn, readWriter, err := hijacker.Hijack()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	var response strings.Builder
+	response.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	response.WriteString("Upgrade: websocket\r\n")
+	response.WriteString("Connection: Upgrade\r\n")
+	response.WriteString("Sec-WebSocket-Accept: " + makeAcceptValue(key) + "\r\n")
+	for name, values := range responseHeader {
+		for _, value := range values {
+			response.WriteString(name + ": " + value + "\r\n")
+		}
+	}
+	response.WriteString("\r\n")
+
+	// Any data buffered by the http.Server but not yet written, such as a
+	// response header, is discarded; nothing should be written to the
+	// responseWriter before calling Upgrade.
+
+	_, err = conn.Write([]byte(response.String()))
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	// The hijacked bufio.Reader may contain frame data sent by the client
+	// immediately after the handshake request. This data is copied, as the
+	// hijacked bufio.Reader reads through the http.Server connection reader
+	// and is not used after the handshake.
+
+	var reader *bufio.Reader
+	if buffered := readWriter.Reader.Buffered(); buffered > 0 {
+		data, _ := readWriter.Reader.Peek(buffered)
+		reader = bufio.NewReader(
+			io.MultiReader(bytes.NewReader(append([]byte(nil), data...)), conn))
+	} else {
+		reader = bufio.NewReader(conn)
+	}
+
+	return newConn(conn, reader, false), nil
+}
+
+func makeAcceptValue(key string) string {
+	hash := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Conn is a WebSocket connection. Conn implements net.Conn and supports
+// net.Conn concurrency semantics. Deadlines and addresses are those of the
+// underlying connection.
+type Conn struct {
+	net.Conn
+	isClient bool
+	reader   *bufio.Reader
+
+	readMutex      sync.Mutex
+	readRemaining  uint64
+	readMasked     bool
+	readMaskKey    [4]byte
+	readMaskOffset int
+	receivedClosed bool
+	writeMutex     sync.Mutex
+	sentClose      bool
+	closeOnce      sync.Once
+	closeErr       error
+	isClosed       int32
+	controlBuffer  [MAX_CONTROL_FRAME_PAYLOAD_SIZE]byte
+	headerBuffer   [14]byte
+}
+
+func newConn(conn net.Conn, reader *bufio.Reader, isClient bool) *Conn {
+	return &Conn{
+		Conn:     conn,
+		isClient: isClient,
+		reader:   reader,
+	}
+}
+
+// Read reads the payloads of received data frames. Read returns io.EOF when
+// the peer has sent a close frame.
+func (conn *Conn) Read(buffer []byte) (int, error) {
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+
+	if len(buffer) == 0 {
+		return 0, nil
+	}
+
+	for conn.readRemaining == 0 {
+		if conn.receivedClosed {
+			return 0, io.EOF
+		}
+		err := conn.readFrameHeader()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(buffer)) > conn.readRemaining {
+		buffer = buffer[:conn.readRemaining]
+	}
+
+	n, err := conn.reader.Read(buffer)
+	if conn.readMasked {
+		conn.readMaskOffset = applyMask(
+			conn.readMaskKey, conn.readMaskOffset, buffer[:n])
+	}
+	conn.readRemaining -= uint64(n)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return n, errors.Trace(err)
+	}
+
+	return n, nil
+}
+
+// readFrameHeader reads frame headers until the header of a data frame is
+// read, handling any control frames. readFrameHeader may set readRemaining
+// to 0 for an empty data frame.
+func (conn *Conn) readFrameHeader() error {
+
+	for {
+
+		header := conn.headerBuffer[:2]
+		_, err := io.ReadFull(conn.reader, header)
+		if err != nil {
+			if err == io.EOF {
+				// The underlying connection closed at a frame boundary.
+				return io.EOF
+			}
+			return errors.Trace(err)
+		}
+
+		isFinal := header[0]&0x80 != 0
+		opcode := header[0] & 0x0F
+		isMasked := header[1]&0x80 != 0
+		length := uint64(header[1] & 0x7F)
+
+		if header[0]&0x70 != 0 {
+			return errors.TraceNew("unexpected reserved bits")
+		}
+
+		// Clients must mask all frames and servers must not mask any frames.
+		if isMasked == conn.isClient {
+			return errors.TraceNew("unexpected frame masking")
+		}
+
+		switch length {
+		case 126:
+			_, err = io.ReadFull(conn.reader, conn.headerBuffer[:2])
+			length = uint64(binary.BigEndian.Uint16(conn.headerBuffer[:2]))
+		case 127:
+			_, err = io.ReadFull(conn.reader, conn.headerBuffer[:8])
+			length = binary.BigEndian.Uint64(conn.headerBuffer[:8])
+			if err == nil && length&(1<<63) != 0 {
+				err = errors.TraceNew("invalid frame length")
+			}
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		var maskKey [4]byte
+		if isMasked {
+			_, err = io.ReadFull(conn.reader, maskKey[:])
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		switch opcode {
+
+		case opcodeContinuation, opcodeText, opcodeBinary:
+			conn.readRemaining = length
+			conn.readMasked = isMasked
+			conn.readMaskKey = maskKey
+			conn.readMaskOffset = 0
+			return nil
+
+		case opcodeClose, opcodePing, opcodePong:
+
+			if !isFinal || length > MAX_CONTROL_FRAME_PAYLOAD_SIZE {
+				return errors.TraceNew("invalid control frame")
+			}
+
+			payload := conn.controlBuffer[:length]
+			_, err = io.ReadFull(conn.reader, payload)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if isMasked {
+				applyMask(maskKey, 0, payload)
+			}
+
+			switch opcode {
+			case opcodePing:
+				err = conn.writeFrame(opcodePong, payload)
+				if err != nil {
+					return errors.Trace(err)
+				}
+			case opcodeClose:
+
+				// Echo the status code, if any, as required, and end the
+				// stream. The underlying connection is closed by Close.
+
+				conn.receivedClosed = true
+				if len(payload) > 2 {
+					payload = payload[:2]
+				}
+				_ = conn.writeFrame(opcodeClose, payload)
+				return io.EOF
+			}
+
+		default:
+			return errors.Tracef("unexpected opcode: %d", opcode)
+		}
+	}
+}
+
+// Write sends the data in a single binary frame.
+func (conn *Conn) Write(buffer []byte) (int, error) {
+	err := conn.writeFrame(opcodeBinary, buffer)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return len(buffer), nil
+}
+
+func (conn *Conn) writeFrame(opcode byte, payload []byte) error {
+
+	// The frame header and payload are sent in a single underlying Write, as
+	// the frame must be copied anyway when the client masks the payload.
+
+	length := len(payload)
+
+	headerLength := 2
+	if length > 65535 {
+		headerLength += 8
+	} else if length > 125 {
+		headerLength += 2
+	}
+	if conn.isClient {
+		headerLength += 4
+	}
+
+	frame := make([]byte, headerLength+length)
+
+	frame[0] = 0x80 | opcode
+	offset := 2
+	if length > 65535 {
+		frame[1] = 127
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+		offset += 8
+	} else if length > 125 {
+		frame[1] = 126
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+		offset += 2
+	} else {
+		frame[1] = byte(length)
+	}
+
+	copy(frame[headerLength:], payload)
+
+	if conn.isClient {
+		frame[1] |= 0x80
+		var maskKey [4]byte
+		copy(maskKey[:], prng.Bytes(4))
+		copy(frame[offset:], maskKey[:])
+		applyMask(maskKey, 0, frame[headerLength:])
+	}
+
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	if conn.sentClose {
+		return errors.TraceNew("sent close frame")
+	}
+	if opcode == opcodeClose {
+		conn.sentClose = true
+	}
+
+	_, err := conn.Conn.Write(frame)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// Close sends a close frame, when one has not already been sent, and closes
+// the underlying connection. Close doesn't wait for the peer to respond with
+// its own close frame.
+func (conn *Conn) Close() error {
+	conn.closeOnce.Do(func() {
+		atomic.StoreInt32(&conn.isClosed, 1)
+
+		// The write deadline ensures that neither sending the close frame nor
+		// any blocked Write delays closing the underlying connection.
+		_ = conn.Conn.SetWriteDeadline(time.Now().Add(closeFrameTimeout))
+
+		var payload [2]byte
+		binary.BigEndian.PutUint16(payload[:], closeStatusNormal)
+		_ = conn.writeFrame(opcodeClose, payload[:])
+		conn.closeErr = conn.Conn.Close()
+	})
+	return conn.closeErr
+}
+
+// IsClosed implements the common.Closer interface.
+func (conn *Conn) IsClosed() bool {
+	return atomic.LoadInt32(&conn.isClosed) == 1
+}
+
+// applyMask XORs data with the mask key, starting from the specified offset
+// into the key, and returns the offset following data.
+func applyMask(maskKey [4]byte, offset int, data []byte) int {
+	for i := range data {
+		data[i] ^= maskKey[offset&3]
+		offset++
+	}
+	return offset & 3
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+)
+
+func TestWebSocket(t *testing.T) {
+
+	serverReadErr := make(chan error, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+
+			if request.Header.Get("Cookie") != "test-cookie" {
+				http.Error(responseWriter, "", http.StatusForbidden)
+				return
+			}
+
+			conn, err := Upgrade(
+				responseWriter, request, http.Header{"X-Test": {"test"}})
+			if err != nil {
+				t.Errorf("Upgrade failed: %s", err)
+				return
+			}
+			defer conn.Close()
+
+			// Echo all received data.
+			_, err = io.Copy(conn, conn)
+			serverReadErr <- err
+		}))
+	defer server.Close()
+
+	dial := func(cookie string) (*Conn, error) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		request, _ := http.NewRequest("GET", server.URL, nil)
+		request.Header.Set("Cookie", cookie)
+		ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFunc()
+		wsConn, err := ClientHandshake(ctx, conn, request)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return wsConn, nil
+	}
+
+	_, err := dial("invalid-cookie")
+	if err == nil {
+		t.Fatalf("unexpected handshake success")
+	}
+
+	conn, err := dial("test-cookie")
+	if err != nil {
+		t.Fatalf("ClientHandshake failed: %s", err)
+	}
+	defer conn.Close()
+
+	// Exercise each frame length encoding, with an interleaved ping which
+	// the server must answer without disrupting the data stream.
+
+	frameSizes := []int{1, 125, 126, 65535, 65536, 200000}
+
+	var sendData []byte
+	for _, size := range frameSizes {
+		sendData = append(sendData, prng.Padding(size, size)...)
+	}
+
+	writeErr := make(chan error, 1)
+	go func() {
+		offset := 0
+		for i, size := range frameSizes {
+			if i == 3 {
+				err := conn.writeFrame(opcodePing, []byte("ping"))
+				if err != nil {
+					writeErr <- err
+					return
+				}
+			}
+			_, err := conn.Write(sendData[offset : offset+size])
+			if err != nil {
+				writeErr <- err
+				return
+			}
+			offset += size
+		}
+		writeErr <- nil
+	}()
+
+	receiveData := make([]byte, len(sendData))
+	_, err = io.ReadFull(conn, receiveData)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+
+	err = <-writeErr
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	if !bytes.Equal(sendData, receiveData) {
+		t.Fatalf("unexpected received data")
+	}
+
+	// Closing the client sends a close frame, which ends the server stream.
+
+	conn.Close()
+
+	if !conn.IsClosed() {
+		t.Fatalf("unexpected IsClosed")
+	}
+
+	select {
+	case err := <-serverReadErr:
+		if err != nil {
+			t.Fatalf("unexpected server error: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout awaiting server close")
+	}
+}
+
+func TestUpgradeInvalidRequest(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(responseWriter http.ResponseWriter, request *http.Request) {
+			conn, err := Upgrade(responseWriter, request, nil)
+			if err == nil {
+				conn.Close()
+			}
+		}))
+	defer server.Close()
+
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Version", WEBSOCKET_VERSION)
+	request.Header.Set("Sec-WebSocket-Key", "invalid")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Do failed: %s", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected response status code: %d", response.StatusCode)
+	}
+}
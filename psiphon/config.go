@@ -26,7 +26,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -39,6 +41,7 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/upstreamproxy"
 )
 
 const (
@@ -128,6 +131,28 @@ type Config struct {
 	// in any country is selected.
 	EgressRegion string
 
+	// EnableMultiHop enables multi-hop tunnels. Each tunnel is a chain of two
+	// Psiphon servers: the client connects to an entry server, and then
+	// connects to an exit server through a TCP port forward established via
+	// the entry server. Port forwards are made through the exit server, so
+	// the entry server doesn't see port forward destinations and the exit
+	// server doesn't see the client IP address. EgressRegion, when set,
+	// selects the exit server region.
+	//
+	// The exit server connection is limited to the SSH and OSSH protocols.
+	EnableMultiHop bool
+
+	// MultiHopEntryRegion is a ISO 3166-1 alpha-2 country code which
+	// indicates which country to select multi-hop entry servers from. For the
+	// default, "", entry servers in any country may be selected.
+	MultiHopEntryRegion string
+
+	// RequireTorORPortForwarding limits server candidates to Tor bridges:
+	// servers with the "tor-orport-forwarding" capability, which connect
+	// port forwards to Tor. With EnableMultiHop, only the exit server is
+	// required to be a Tor bridge.
+	RequireTorORPortForwarding bool
+
 	// ListenInterface specifies which interface to listen on.  If no
 	// interface is provided then listen on 127.0.0.1. If 'any' is provided
 	// then use 0.0.0.0. If there are multiple IP addresses on an interface
@@ -142,6 +167,20 @@ type Config struct {
 	// free port (a notice reporting the selected port is emitted).
 	LocalSocksProxyPort int
 
+	// UdpgwServerAddress specifies the udpgw server address, host:port,
+	// which the Psiphon server intercepts to relay UDP traffic. When set,
+	// the local SOCKS proxy supports the SOCKS5 UDP ASSOCIATE command, with
+	// UDP datagrams relayed over a single udpgw port forward. When not set,
+	// UDP ASSOCIATE requests are rejected.
+	//
+	// The Psiphon server retains only one udpgw port forward per client, so
+	// this option should not be used when an external udpgw client, such as
+	// tun2socks, is also using the tunnel. The udpgw port forward is shared
+	// with PacketTunnelUserspaceStack.
+	//
+	// The typical value is "127.0.0.1:7300".
+	UdpgwServerAddress string
+
 	// LocalHttpProxyPort specifies a port number for the local HTTP proxy
 	// running at 127.0.0.1. For the default value, 0, the system selects a
 	// free port (a notice reporting the selected port is emitted).
@@ -150,6 +189,48 @@ type Config struct {
 	// DisableLocalHTTPProxy disables running the local HTTP proxy.
 	DisableLocalHTTPProxy bool
 
+	// LocalProxyCredentials specifies username/password credentials which
+	// local SOCKS and HTTP proxy clients must present. When set, SOCKS5
+	// clients must use RFC 1929 username/password authentication, SOCKS4a
+	// clients are rejected, and HTTP proxy clients must send a
+	// "Proxy-Authorization: Basic" header with CONNECT and absolute-URI
+	// requests. URL proxy requests, such as "/tunneled/<origin URL>", are
+	// authenticated only when not received from a loopback peer. When
+	// omitted, no authentication is required.
+	//
+	// Credentials are recommended when ListenInterface is set to a
+	// non-loopback interface. Bytes transferred through the local proxies
+	// are reported per username with LocalProxyBytesTransferred notices.
+	LocalProxyCredentials []LocalProxyCredential
+
+	// LocalControlAPIAddress specifies an address on which to run a local
+	// control API, an HTTP server which allows other local processes to
+	// query the status of, and control, the running Controller. The address
+	// may be either "unix:<path>", for a Unix domain socket, or
+	// "<IP>:<port>", where IP must be a loopback address. For the default,
+	// blank, no control API is run.
+	//
+	// The control API endpoints are:
+	//
+	// GET /status: returns the active tunnels, with server region, tunnel
+	// protocol, and bytes transferred.
+	// POST /terminate-next-active-tunnel: calls TerminateNextActiveTunnel.
+	// POST /dynamic-config: calls SetDynamicConfig with the JSON body
+	// {"sponsor_id": <string>, "authorizations": [<string>, ...]}.
+	// GET /exchange-payload: returns {"payload": ExportExchangePayload()}.
+	// POST /exchange-payload: calls ImportExchangePayload with the JSON body
+	// {"payload": <string>}.
+	// POST /stop: stops the Controller.
+	LocalControlAPIAddress string
+
+	// LocalControlAPIToken is a secret token which control API requests
+	// must present in the header "Authorization: Bearer <token>".
+	// LocalControlAPIToken is required when LocalControlAPIAddress is a TCP
+	// address, as any local process may connect. For Unix domain sockets,
+	// access is restricted by the socket file permissions, and the token is
+	// optional.
+	LocalControlAPIToken string
+
 	// NetworkLatencyMultiplier is a multiplier that is to be applied to
 	// default network event timeouts. Set this to tune performance for
 	// slow networks.
@@ -160,8 +241,8 @@ type Config struct {
 	// include:
 	// "SSH", "OSSH", "UNFRONTED-MEEK-OSSH", "UNFRONTED-MEEK-HTTPS-OSSH",
 	// "UNFRONTED-MEEK-SESSION-TICKET-OSSH", "FRONTED-MEEK-OSSH",
-	// "FRONTED-MEEK-HTTP-OSSH", "QUIC-OSSH", "MARIONETTE-OSSH", and
-	// "TAPDANCE-OSSH".
+	// "FRONTED-MEEK-HTTP-OSSH", "QUIC-OSSH", "MARIONETTE-OSSH",
+	// "TAPDANCE-OSSH", "WS-OSSH", "WSS-OSSH", and "FRONTED-WSS-OSSH".
 	// For the default, an empty list, all protocols are used.
 	LimitTunnelProtocols []string
 
@@ -218,6 +299,20 @@ type Config struct {
 	// the default is TUNNEL_POOL_SIZE, which is recommended.
 	TunnelPoolSize int
 
+	// TunnelPoolPolicy specifies how new port forwards are assigned to the
+	// tunnels in the pool when TunnelPoolSize > 1. With
+	// TUNNEL_POOL_POLICY_ROUND_ROBIN, the default when omitted, the active
+	// tunnels are used in turn. With TUNNEL_POOL_POLICY_WEIGHTED, tunnels are
+	// selected at random, weighted by measured throughput and round trip
+	// time, and tunnels with recent port forward failures are avoided.
+	TunnelPoolPolicy string
+
+	// TunnelPoolStripeDownloads specifies that large client upgrade
+	// downloads are split into ranges which are downloaded concurrently
+	// through all active tunnels. TunnelPoolStripeDownloads has an effect
+	// only when TunnelPoolSize > 1.
+	TunnelPoolStripeDownloads bool
+
 	// StaggerConnectionWorkersMilliseconds adds a specified delay before
 	// making each server candidate available to connection workers. This
 	// option is enabled when StaggerConnectionWorkersMilliseconds > 0.
@@ -267,6 +362,16 @@ type Config struct {
 	// This parameter is only applicable to library deployments.
 	IPv6Synthesizer IPv6Synthesizer
 
+	// DatastoreBackend is an optional DatastoreBackend to be used by
+	// OpenDataStore in place of the default, file-based datastore. When set,
+	// no datastore files are created or opened, and Commit neither creates
+	// data directories nor migrates legacy files. NewMemoryDatastoreBackend
+	// provides a non-persistent backend suitable for short-lived processes
+	// and tests.
+	//
+	// This parameter is only applicable to library deployments.
+	DatastoreBackend DatastoreBackend
+
 	// DnsServerGetter is an interface that enables tunnel-core to call into
 	// the host application to discover the native network DNS server
 	// settings. See: DnsServerGetter doc.
@@ -364,9 +469,44 @@ type Config struct {
 
 	// SplitTunnelDNSServer specifies a DNS server to use when resolving port
 	// forward target domain names to IP addresses for classification. The DNS
-	// server must support TCP requests.
+	// server must support TCP requests. SplitTunnelDNSServer is not required,
+	// and is not used, when a tunneled DNS-over-HTTPS or DNS-over-TLS
+	// resolver is configured.
 	SplitTunnelDNSServer string
 
+	// SplitTunnelPolicyFilename is the path of an optional, local split
+	// tunnel policy file. The policy is a JSON-encoded list of rules, each
+	// matching destination domains, CIDRs, and ports, with an action of
+	// "tunnel", "direct", or "block". The policy applies to all port forwards
+	// made via the local SOCKS and HTTP proxies and is evaluated before any
+	// region-based split tunnel classification. The file is periodically
+	// checked for changes and reloaded; see SplitTunnelPolicy for the format.
+	SplitTunnelPolicyFilename string
+
+	// TunneledDNSOverHTTPSURL specifies a DNS-over-HTTPS (RFC 8484) resolver
+	// URL, such as "https://1.1.1.1/dns-query". When set, DNS requests made
+	// via the local DNS proxy, by PacketTunnelUserspaceStack flows, and for
+	// split tunnel classification are sent, through the tunnel, to this
+	// resolver. Responses are cached according to their TTLs.
+	//
+	// At most one of TunneledDNSOverHTTPSURL and
+	// TunneledDNSOverTLSServerAddress may be set.
+	TunneledDNSOverHTTPSURL string
+
+	// TunneledDNSOverTLSServerAddress specifies a DNS-over-TLS (RFC 7858)
+	// resolver address, "<host>:<port>", such as "1.1.1.1:853". This is an
+	// alternative to TunneledDNSOverHTTPSURL. The host, a domain name or IP
+	// address, is used to verify the resolver's certificate.
+	TunneledDNSOverTLSServerAddress string
+
+	// LocalDNSProxyAddress specifies an "<IP>:<port>" address, such as
+	// "127.0.0.1:53", on which to run a local DNS proxy. The DNS proxy
+	// accepts both UDP and TCP requests and resolves them using the
+	// TunneledDNSOverHTTPSURL or TunneledDNSOverTLSServerAddress resolver,
+	// one of which must be set. For the default, blank, no local DNS proxy
+	// is run.
+	LocalDNSProxyAddress string
+
 	// UpgradeDownloadURLs is list of URLs which specify locations from which
 	// to download a host client upgrade file, when one is available. The core
 	// tunnel controller provides a resumable download facility which
@@ -394,7 +534,8 @@ type Config struct {
 	// certs. When set, this toggles use of the trusted CA certs, specified in
 	// TrustedCACertificatesFilename, for tunneled TLS connections that expect
 	// server certificates signed with public certificate authorities
-	// (currently, only upgrade downloads). This option is used with stock Go
+	// (currently, upgrade downloads and tunneled DNS-over-HTTPS and
+	// DNS-over-TLS requests). This option is used with stock Go
 	// TLS in cases where Go may fail to obtain a list of root CAs from the
 	// operating system.
 	TrustedCACertificatesFilename string
@@ -451,9 +592,22 @@ type Config struct {
 	// a packet tunnel is established through the server and packets are
 	// relayed via the tun device file descriptor. The file descriptor is
 	// duped in NewController. When PacketTunnelTunDeviceFileDescriptor is
-	// set, TunnelPoolSize must be 1.
+	// set, TunnelPoolSize must be 1, unless PacketTunnelUserspaceStack is
+	// set.
 	PacketTunnelTunFileDescriptor int
 
+	// PacketTunnelUserspaceStack specifies that, instead of relaying packets
+	// to the server's packet tunnel, TCP and UDP flows read from the
+	// PacketTunnelTunFileDescriptor tun device are terminated locally in a
+	// userspace TCP/IP stack. TCP flows are sent through ordinary port
+	// forwards and UDP flows through the udpgw port forward, so this mode
+	// works with servers that don't run a packet tunnel. DNS flows, UDP
+	// flows to port 53, are relayed to the server's DNS resolver.
+	//
+	// PacketTunnelUserspaceStack requires PacketTunnelTunFileDescriptor and
+	// UdpgwServerAddress.
+	PacketTunnelUserspaceStack bool
+
 	// SessionID specifies a client session ID to use in the Psiphon API. The
 	// session ID should be a randomly generated value that is used only for a
 	// single session, which is defined as the period between a user starting
@@ -799,6 +953,10 @@ func (config *Config) IsCommitted() bool {
 // fails. It is better to not endlessly retry file migrations on each Commit()
 // because file system errors are expected to be rare and persistent files will
 // be re-populated over time.
+//
+// When DatastoreBackend is set, no migration is performed and no data
+// directories are created, except for the Psiphon data directory when
+// notice files are configured.
 func (config *Config) Commit(migrateFromLegacyFields bool) error {
 
 	// Do SetEmitDiagnosticNotices first, to ensure config file errors are
@@ -825,9 +983,17 @@ func (config *Config) Commit(migrateFromLegacyFields bool) error {
 		config.DataRootDirectory = wd
 	}
 
+	// A DatastoreBackend replaces the persistent files that would otherwise
+	// be created in, or migrated to, the data directories.
+	if config.DatastoreBackend != nil {
+		migrateFromLegacyFields = false
+	}
+
 	// Create root directory
 	dataDirectoryPath := config.GetPsiphonDataDirectory()
-	if !common.FileExists(dataDirectoryPath) {
+	if (config.DatastoreBackend == nil || config.UseNoticeFiles != nil) &&
+		!common.FileExists(dataDirectoryPath) {
+
 		err := os.Mkdir(dataDirectoryPath, os.ModePerm)
 		if err != nil {
 			return errors.Tracef("failed to create datastore directory %s with error: %s", dataDirectoryPath, err.Error())
@@ -929,30 +1095,33 @@ func (config *Config) Commit(migrateFromLegacyFields bool) error {
 
 	// Supply default values.
 
-	// Create datastore directory.
-	dataStoreDirectoryPath := config.GetDataStoreDirectory()
-	if !common.FileExists(dataStoreDirectoryPath) {
-		err := os.Mkdir(dataStoreDirectoryPath, os.ModePerm)
-		if err != nil {
-			return errors.Tracef("failed to create datastore directory %s with error: %s", dataStoreDirectoryPath, err.Error())
+	if config.DatastoreBackend == nil {
+
+		// Create datastore directory.
+		dataStoreDirectoryPath := config.GetDataStoreDirectory()
+		if !common.FileExists(dataStoreDirectoryPath) {
+			err := os.Mkdir(dataStoreDirectoryPath, os.ModePerm)
+			if err != nil {
+				return errors.Tracef("failed to create datastore directory %s with error: %s", dataStoreDirectoryPath, err.Error())
+			}
 		}
-	}
 
-	// Create OSL directory.
-	oslDirectoryPath := config.GetObfuscatedServerListDownloadDirectory()
-	if !common.FileExists(oslDirectoryPath) {
-		err := os.Mkdir(oslDirectoryPath, os.ModePerm)
-		if err != nil {
-			return errors.Tracef("failed to create osl directory %s with error: %s", oslDirectoryPath, err.Error())
+		// Create OSL directory.
+		oslDirectoryPath := config.GetObfuscatedServerListDownloadDirectory()
+		if !common.FileExists(oslDirectoryPath) {
+			err := os.Mkdir(oslDirectoryPath, os.ModePerm)
+			if err != nil {
+				return errors.Tracef("failed to create osl directory %s with error: %s", oslDirectoryPath, err.Error())
+			}
 		}
-	}
 
-	// Create tapdance directory
-	tapdanceDirectoryPath := config.GetTapdanceDirectory()
-	if !common.FileExists(tapdanceDirectoryPath) {
-		err := os.Mkdir(tapdanceDirectoryPath, os.ModePerm)
-		if err != nil {
-			return errors.Tracef("failed to create tapdance directory %s with error: %s", tapdanceDirectoryPath, err.Error())
+		// Create tapdance directory
+		tapdanceDirectoryPath := config.GetTapdanceDirectory()
+		if !common.FileExists(tapdanceDirectoryPath) {
+			err := os.Mkdir(tapdanceDirectoryPath, os.ModePerm)
+			if err != nil {
+				return errors.Tracef("failed to create tapdance directory %s with error: %s", tapdanceDirectoryPath, err.Error())
+			}
 		}
 	}
 
@@ -1008,11 +1177,45 @@ func (config *Config) Commit(migrateFromLegacyFields bool) error {
 		if config.SplitTunnelRoutesSignaturePublicKey == "" {
 			return errors.TraceNew("missing SplitTunnelRoutesSignaturePublicKey")
 		}
-		if config.SplitTunnelDNSServer == "" {
+		if config.SplitTunnelDNSServer == "" && !config.hasTunneledDNSResolver() {
 			return errors.TraceNew("missing SplitTunnelDNSServer")
 		}
 	}
 
+	if config.TunneledDNSOverHTTPSURL != "" {
+		if config.TunneledDNSOverTLSServerAddress != "" {
+			return errors.TraceNew("invalid tunneled DNS resolver configuration")
+		}
+		dohURL, err := url.Parse(config.TunneledDNSOverHTTPSURL)
+		if err != nil || dohURL.Scheme != "https" || dohURL.Host == "" {
+			return errors.TraceNew("invalid TunneledDNSOverHTTPSURL")
+		}
+	}
+
+	if config.TunneledDNSOverTLSServerAddress != "" {
+		_, _, err := net.SplitHostPort(config.TunneledDNSOverTLSServerAddress)
+		if err != nil {
+			return errors.Tracef("invalid TunneledDNSOverTLSServerAddress: %s", err)
+		}
+	}
+
+	if config.LocalDNSProxyAddress != "" {
+		if !config.hasTunneledDNSResolver() {
+			return errors.TraceNew("missing tunneled DNS resolver for LocalDNSProxyAddress")
+		}
+		_, _, err := net.SplitHostPort(config.LocalDNSProxyAddress)
+		if err != nil {
+			return errors.Tracef("invalid LocalDNSProxyAddress: %s", err)
+		}
+	}
+
+	if !common.Contains(
+		[]string{"", TUNNEL_POOL_POLICY_ROUND_ROBIN, TUNNEL_POOL_POLICY_WEIGHTED},
+		config.TunnelPoolPolicy) {
+
+		return errors.TraceNew("invalid TunnelPoolPolicy")
+	}
+
 	if config.UpgradeDownloadURLs != nil {
 		if config.UpgradeDownloadClientVersionHeader == "" {
 			return errors.TraceNew("missing UpgradeDownloadClientVersionHeader")
@@ -1021,10 +1224,60 @@ func (config *Config) Commit(migrateFromLegacyFields bool) error {
 
 	// This constraint is expected by logic in Controller.runTunnels().
 
-	if config.PacketTunnelTunFileDescriptor > 0 && config.TunnelPoolSize != 1 {
+	if config.PacketTunnelTunFileDescriptor > 0 &&
+		!config.PacketTunnelUserspaceStack &&
+		config.TunnelPoolSize != 1 {
 		return errors.TraceNew("packet tunnel mode requires TunnelPoolSize to be 1")
 	}
 
+	if config.PacketTunnelUserspaceStack &&
+		(config.PacketTunnelTunFileDescriptor <= 0 || config.UdpgwServerAddress == "") {
+		return errors.TraceNew(
+			"userspace packet tunnel mode requires PacketTunnelTunFileDescriptor and UdpgwServerAddress")
+	}
+
+	// Multi-hop exit connections are dialed through entry server port
+	// forwards, which require a completed handshake.
+
+	if config.EnableMultiHop && config.DisableApi {
+		return errors.TraceNew("multi-hop mode is not compatible with DisableApi")
+	}
+
+	if config.LocalControlAPIAddress != "" &&
+		!strings.HasPrefix(config.LocalControlAPIAddress, "unix:") {
+
+		host, _, err := net.SplitHostPort(config.LocalControlAPIAddress)
+		if err != nil {
+			return errors.Tracef("invalid LocalControlAPIAddress: %s", err)
+		}
+		IP := net.ParseIP(host)
+		if IP == nil || !IP.IsLoopback() {
+			return errors.TraceNew("LocalControlAPIAddress must be a loopback address")
+		}
+		if config.LocalControlAPIToken == "" {
+			return errors.TraceNew("LocalControlAPIAddress requires LocalControlAPIToken")
+		}
+	}
+
+	if config.UpstreamProxyURL != "" {
+		err := upstreamproxy.ValidateProxyURI(config.UpstreamProxyURL)
+		if err != nil {
+			return errors.Tracef("invalid UpstreamProxyURL: %s", err)
+		}
+	}
+
+	if config.UdpgwServerAddress != "" {
+		_, _, err := net.SplitHostPort(config.UdpgwServerAddress)
+		if err != nil {
+			return errors.Tracef("invalid UdpgwServerAddress: %s", err)
+		}
+	}
+
+	err = validateLocalProxyCredentials(config.LocalProxyCredentials)
+	if err != nil {
+		return errors.Tracef("invalid LocalProxyCredentials: %s", err)
+	}
+
 	// SessionID must be PSIPHON_API_CLIENT_SESSION_ID_LENGTH lowercase hex-encoded bytes.
 
 	if config.SessionID == "" {
@@ -1305,6 +1558,13 @@ func (config *Config) UseUpstreamProxy() bool {
 	return config.UpstreamProxyURL != ""
 }
 
+// hasTunneledDNSResolver indicates if a tunneled DNS-over-HTTPS or
+// DNS-over-TLS resolver has been configured.
+func (config *Config) hasTunneledDNSResolver() bool {
+	return config.TunneledDNSOverHTTPSURL != "" ||
+		config.TunneledDNSOverTLSServerAddress != ""
+}
+
 // GetNetworkID returns the current network ID. When NetworkIDGetter
 // is set, this calls into the host application; otherwise, a default
 // value is returned.
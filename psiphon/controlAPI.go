@@ -0,0 +1,402 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+const (
+	CONTROL_API_IO_TIMEOUT       = 10 * time.Second
+	CONTROL_API_MAX_REQUEST_SIZE = 65536
+)
+
+// ControlAPIStatus is the response to a control API status request.
+type ControlAPIStatus struct {
+	Tunnels []ControlAPITunnelStatus `json:"tunnels"`
+}
+
+// ControlAPITunnelStatus describes a single active tunnel.
+type ControlAPITunnelStatus struct {
+	DiagnosticID    string    `json:"diagnostic_id"`
+	ServerRegion    string    `json:"server_region"`
+	TunnelProtocol  string    `json:"protocol"`
+	EstablishedTime time.Time `json:"established_time"`
+	BytesUp         int64     `json:"bytes_up"`
+	BytesDown       int64     `json:"bytes_down"`
+}
+
+// controlAPIServer is the local control API server run by the Controller
+// when config.LocalControlAPIAddress is set. See the LocalControlAPIAddress
+// comment for a list of supported requests.
+type controlAPIServer struct {
+	controller *Controller
+	listener   net.Listener
+	server     *http.Server
+	waitGroup  *sync.WaitGroup
+}
+
+func newControlAPIServer(controller *Controller) (*controlAPIServer, error) {
+
+	address := controller.config.LocalControlAPIAddress
+
+	var listener net.Listener
+	var err error
+	if strings.HasPrefix(address, "unix:") {
+
+		socketPath := strings.TrimPrefix(address, "unix:")
+
+		err = removeStaleUnixSocket(socketPath)
+		if err == nil {
+			listener, err = listenPrivateUnixSocket(socketPath)
+		}
+
+	} else {
+
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	controlAPI := &controlAPIServer{
+		controller: controller,
+		listener:   listener,
+		waitGroup:  new(sync.WaitGroup),
+	}
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/status", controlAPI.statusHandler)
+	serveMux.HandleFunc("/terminate-next-active-tunnel", controlAPI.terminateNextActiveTunnelHandler)
+	serveMux.HandleFunc("/dynamic-config", controlAPI.dynamicConfigHandler)
+	serveMux.HandleFunc("/exchange-payload", controlAPI.exchangePayloadHandler)
+	serveMux.HandleFunc("/stop", controlAPI.stopHandler)
+
+	controlAPI.server = &http.Server{
+		Handler:      controlAPI.authorize(serveMux),
+		ReadTimeout:  CONTROL_API_IO_TIMEOUT,
+		WriteTimeout: CONTROL_API_IO_TIMEOUT,
+	}
+
+	controlAPI.waitGroup.Add(1)
+	go func() {
+		defer controlAPI.waitGroup.Done()
+
+		// Note: will be interrupted by server.Close() call made by close()
+		err := controlAPI.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			NoticeWarning("control API server failed: %s", errors.Trace(err))
+		}
+	}()
+
+	NoticeListeningLocalControlAPI(listener.Addr().String())
+
+	return controlAPI, nil
+}
+
+// listenPrivateUnixSocket listens on a Unix domain socket at socketPath which
+// only the current user may connect to.
+//
+// Changing the socket file permissions after net.Listen leaves a window in
+// which other local users may connect, and setting the process umask around
+// net.Listen affects files concurrently created by other goroutines. Instead,
+// the socket is bound in a new, private 0700 directory, where its permissions
+// are set before it is renamed into place at socketPath.
+//
+// Limitation: the socket is bound to a temporary path which is longer than
+// socketPath, so socketPath must be somewhat shorter than the platform Unix
+// domain socket path limit.
+func listenPrivateUnixSocket(socketPath string) (net.Listener, error) {
+
+	privateDirectory, err := ioutil.TempDir(filepath.Dir(socketPath), ".control-api-")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer os.RemoveAll(privateDirectory)
+
+	privateSocketPath := filepath.Join(privateDirectory, "socket")
+
+	listener, err := net.ListenUnix(
+		"unix", &net.UnixAddr{Name: privateSocketPath, Net: "unix"})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// The listener's socket file is renamed, so the UnixListener can't unlink
+	// it on close; privateUnixSocketListener unlinks socketPath instead.
+	listener.SetUnlinkOnClose(false)
+
+	err = os.Chmod(privateSocketPath, 0600)
+	if err == nil {
+		err = os.Rename(privateSocketPath, socketPath)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return &privateUnixSocketListener{
+		UnixListener: listener,
+		address:      &net.UnixAddr{Name: socketPath, Net: "unix"},
+	}, nil
+}
+
+// removeStaleUnixSocket removes any stale socket file left behind by a
+// previous run which didn't shut down cleanly. So as to never delete an
+// unrelated file, such as when the socket path is misconfigured, any file at
+// socketPath which is not a socket results in an error.
+func removeStaleUnixSocket(socketPath string) error {
+
+	fileInfo, err := os.Lstat(socketPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Trace(err)
+	}
+
+	if fileInfo.Mode()&os.ModeSocket == 0 {
+		return errors.Tracef("existing file is not a socket: %s", socketPath)
+	}
+
+	err = os.Remove(socketPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// privateUnixSocketListener is a listener created by listenPrivateUnixSocket.
+type privateUnixSocketListener struct {
+	*net.UnixListener
+	address   *net.UnixAddr
+	closeOnce sync.Once
+}
+
+func (listener *privateUnixSocketListener) Addr() net.Addr {
+	return listener.address
+}
+
+func (listener *privateUnixSocketListener) Close() error {
+	err := listener.UnixListener.Close()
+	listener.closeOnce.Do(func() {
+		_ = os.Remove(listener.address.Name)
+	})
+	return err
+}
+
+// close stops the control API server and waits for it to stop serving.
+func (controlAPI *controlAPIServer) close() {
+	controlAPI.server.Close()
+	controlAPI.waitGroup.Wait()
+	NoticeInfo("control API server stopped")
+}
+
+func (controlAPI *controlAPIServer) authorize(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		token := controlAPI.controller.config.LocalControlAPIToken
+		if token != "" {
+			expected := "Bearer " + token
+			if subtle.ConstantTimeCompare(
+				[]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (controlAPI *controlAPIServer) statusHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeControlAPIResponse(w, controlAPI.controller.getControlAPIStatus())
+}
+
+func (controlAPI *controlAPIServer) terminateNextActiveTunnelHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	controlAPI.controller.TerminateNextActiveTunnel()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (controlAPI *controlAPIServer) dynamicConfigHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		SponsorID      string   `json:"sponsor_id"`
+		Authorizations []string `json:"authorizations"`
+	}
+
+	err := readControlAPIRequest(r, &request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// As with SetDynamicConfig, a blank sponsor ID leaves the current value
+	// unchanged.
+	controlAPI.controller.SetDynamicConfig(request.SponsorID, request.Authorizations)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (controlAPI *controlAPIServer) exchangePayloadHandler(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+
+	case http.MethodGet:
+
+		payload := controlAPI.controller.ExportExchangePayload()
+		if payload == "" {
+			// ExportExchangePayload emits a notice with the failure reason.
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		writeControlAPIResponse(w, map[string]string{"payload": payload})
+
+	case http.MethodPost:
+
+		var request struct {
+			Payload string `json:"payload"`
+		}
+
+		err := readControlAPIRequest(r, &request)
+		if err != nil || request.Payload == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		imported := controlAPI.controller.ImportExchangePayload(request.Payload)
+
+		writeControlAPIResponse(w, map[string]bool{"imported": imported})
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (controlAPI *controlAPIServer) stopHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	NoticeInfo("controller stop requested by control API")
+
+	w.WriteHeader(http.StatusOK)
+
+	// stopRunning only cancels the run context; Controller.Run then closes
+	// this server after the response is sent.
+	controlAPI.controller.stopRunning()
+}
+
+func readControlAPIRequest(r *http.Request, request interface{}) error {
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, CONTROL_API_MAX_REQUEST_SIZE))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = json.Unmarshal(body, request)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func writeControlAPIResponse(w http.ResponseWriter, response interface{}) {
+
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		NoticeWarning("control API response failed: %s", errors.Trace(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(responseJSON)
+}
+
+// getControlAPIStatus returns the status of the controller's active tunnels.
+func (controller *Controller) getControlAPIStatus() *ControlAPIStatus {
+
+	controller.tunnelMutex.Lock()
+	tunnels := make([]*Tunnel, len(controller.tunnels))
+	copy(tunnels, controller.tunnels)
+	controller.tunnelMutex.Unlock()
+
+	status := &ControlAPIStatus{
+		Tunnels: make([]ControlAPITunnelStatus, 0, len(tunnels)),
+	}
+
+	for _, tunnel := range tunnels {
+
+		tunnel.mutex.Lock()
+		establishedTime := tunnel.establishedTime
+		tunnel.mutex.Unlock()
+
+		bytesUp, bytesDown := tunnel.GetTotalBytesTransferred()
+
+		status.Tunnels = append(status.Tunnels, ControlAPITunnelStatus{
+			DiagnosticID:    tunnel.dialParams.ServerEntry.GetDiagnosticID(),
+			ServerRegion:    tunnel.dialParams.ServerEntry.Region,
+			TunnelProtocol:  tunnel.dialParams.TunnelProtocol,
+			EstablishedTime: establishedTime.UTC(),
+			BytesUp:         bytesUp,
+			BytesDown:       bytesDown,
+		})
+	}
+
+	return status
+}
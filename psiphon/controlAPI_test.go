@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestControlAPI(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-control-api-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	socketPath := filepath.Join(testDataDirName, "control.sock")
+
+	config := &Config{
+		PropagationChannelId:   "0",
+		SponsorId:              "0",
+		DataRootDirectory:      testDataDirName,
+		LocalControlAPIAddress: "unix:" + socketPath,
+		LocalControlAPIToken:   "token",
+	}
+
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	runCtx, stopRunning := context.WithCancel(context.Background())
+	defer stopRunning()
+
+	controller := &Controller{
+		config:      config,
+		runCtx:      runCtx,
+		stopRunning: stopRunning,
+	}
+
+	// Test: an existing file which is not a socket is not removed
+
+	err = ioutil.WriteFile(socketPath, []byte("data"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	_, err = newControlAPIServer(controller)
+	if err == nil {
+		t.Fatalf("unexpected newControlAPIServer success")
+	}
+
+	data, err := ioutil.ReadFile(socketPath)
+	if err != nil || string(data) != "data" {
+		t.Fatalf("unexpected file contents: %s, %v", data, err)
+	}
+
+	err = os.Remove(socketPath)
+	if err != nil {
+		t.Fatalf("Remove failed: %s", err)
+	}
+
+	// Test: a stale socket file is replaced
+
+	staleListener, err := net.ListenUnix(
+		"unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Fatalf("ListenUnix failed: %s", err)
+	}
+	staleListener.SetUnlinkOnClose(false)
+	staleListener.Close()
+
+	controlAPI, err := newControlAPIServer(controller)
+	if err != nil {
+		t.Fatalf("newControlAPIServer failed: %s", err)
+	}
+	defer controlAPI.close()
+
+	// Test: the socket is accessible only to the current user, and no
+	// temporary files remain
+
+	fileInfo, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if fileInfo.Mode()&os.ModeSocket == 0 || fileInfo.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket file mode: %s", fileInfo.Mode())
+	}
+
+	fileInfos, err := ioutil.ReadDir(testDataDirName)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %s", err)
+	}
+	for _, fileInfo := range fileInfos {
+		if strings.HasPrefix(fileInfo.Name(), ".control-api-") {
+			t.Fatalf("unexpected temporary file: %s", fileInfo.Name())
+		}
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+
+	request := func(method, path, token, body string) *http.Response {
+		req, err := http.NewRequest(method, "http://control"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		return response
+	}
+
+	response := request("GET", "/status", "", "")
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status without token: %d", response.StatusCode)
+	}
+
+	response = request("GET", "/status", "invalid", "")
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unexpected status with invalid token: %d", response.StatusCode)
+	}
+
+	response = request("GET", "/status", "token", "")
+	var status ControlAPIStatus
+	err = json.NewDecoder(response.Body).Decode(&status)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("Decode failed: %s", err)
+	}
+	if response.StatusCode != http.StatusOK || status.Tunnels == nil || len(status.Tunnels) != 0 {
+		t.Fatalf("unexpected status response: %d %+v", response.StatusCode, status)
+	}
+
+	response = request("POST", "/dynamic-config", "token",
+		`{"sponsor_id": "1", "authorizations": ["a"]}`)
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected dynamic config status: %d", response.StatusCode)
+	}
+	if config.GetSponsorID() != "1" ||
+		len(config.GetAuthorizations()) != 1 || config.GetAuthorizations()[0] != "a" {
+		t.Fatalf("unexpected dynamic config")
+	}
+
+	response = request("POST", "/dynamic-config", "token", `{`)
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected invalid dynamic config status: %d", response.StatusCode)
+	}
+
+	response = request("GET", "/stop", "token", "")
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected stop status: %d", response.StatusCode)
+	}
+
+	response = request("POST", "/stop", "token", "")
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected stop status: %d", response.StatusCode)
+	}
+
+	select {
+	case <-runCtx.Done():
+	default:
+		t.Fatalf("controller not stopped")
+	}
+
+	// Test: the socket file is removed on close
+
+	controlAPI.close()
+
+	_, err = os.Stat(socketPath)
+	if !os.IsNotExist(err) {
+		t.Fatalf("unexpected socket file after close: %v", err)
+	}
+}
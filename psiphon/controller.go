@@ -29,6 +29,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -58,8 +59,12 @@ type Controller struct {
 	startedConnectedReporter                bool
 	isEstablishing                          bool
 	protocolSelectionConstraints            *protocolSelectionConstraints
+	multiHopEntryConstraints                *protocolSelectionConstraints
+	multiHopEntryIteratorMutex              sync.Mutex
+	multiHopEntryIterator                   *ServerEntryIterator
 	concurrentEstablishTunnelsMutex         sync.Mutex
 	establishConnectTunnelCount             int
+	establishHasIPv6Route                   bool
 	concurrentEstablishTunnels              int
 	concurrentIntensiveEstablishTunnels     int
 	peakConcurrentEstablishTunnels          int
@@ -70,6 +75,8 @@ type Controller struct {
 	candidateServerEntries                  chan *candidateServerEntry
 	untunneledDialConfig                    *DialConfig
 	splitTunnelClassifier                   *SplitTunnelClassifier
+	tunneledDNSResolver                     *tunneledDNSResolver
+	splitTunnelPolicy                       *SplitTunnelPolicy
 	signalFetchCommonRemoteServerList       chan struct{}
 	signalFetchObfuscatedServerLists        chan struct{}
 	signalDownloadUpgrade                   chan string
@@ -78,6 +85,7 @@ type Controller struct {
 	serverAffinityDoneBroadcast             chan struct{}
 	packetTunnelClient                      *tun.Client
 	packetTunnelTransport                   *PacketTunnelTransport
+	userspacePacketTunnel                   *userspacePacketTunnel
 	staggerMutex                            sync.Mutex
 }
 
@@ -129,9 +137,45 @@ func NewController(config *Config) (controller *Controller, err error) {
 		signalRestartEstablishing: make(chan struct{}, 1),
 	}
 
-	controller.splitTunnelClassifier = NewSplitTunnelClassifier(config, controller)
+	if config.hasTunneledDNSResolver() {
 
-	if config.PacketTunnelTunFileDescriptor > 0 {
+		// The tunneled DNS resolver is used by the local DNS proxy, the
+		// userspace packet tunnel, and split tunnel classification. Like the
+		// packet tunnel, its lifetime is the lifetime of the Controller, and
+		// it makes its requests through whichever tunnel is active.
+
+		controller.tunneledDNSResolver, err = newTunneledDNSResolver(
+			config, controller)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	controller.splitTunnelClassifier = newSplitTunnelClassifier(
+		config, controller, controller.tunneledDNSResolver)
+
+	if config.SplitTunnelPolicyFilename != "" {
+		controller.splitTunnelPolicy, err = NewSplitTunnelPolicy(
+			config.SplitTunnelPolicyFilename)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if config.PacketTunnelTunFileDescriptor > 0 &&
+		config.PacketTunnelUserspaceStack {
+
+		// Run a userspace packet tunnel, which sends flows through port
+		// forwards. Like the packet tunnel client, the lifetime of the
+		// userspace packet tunnel is the lifetime of the Controller.
+
+		controller.userspacePacketTunnel, err = newUserspacePacketTunnel(
+			config, controller)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+	} else if config.PacketTunnelTunFileDescriptor > 0 {
 
 		// Run a packet tunnel client. The lifetime of the tun.Client is the
 		// lifetime of the Controller, so it exists across tunnel establishments
@@ -194,8 +238,17 @@ func (controller *Controller) Run(ctx context.Context) {
 		listenIP = IPv4Address.String()
 	}
 
+	// A single udpgw client is shared by all local udpgw users, as the server
+	// retains only one udpgw port forward per client.
+	var udpgwClient *udpgwClient
+	if controller.config.UdpgwServerAddress != "" {
+		udpgwClient = newUdpgwClient(controller, controller.config.UdpgwServerAddress)
+		defer udpgwClient.close()
+	}
+
 	if !controller.config.DisableLocalSocksProxy {
-		socksProxy, err := NewSocksProxy(controller.config, controller, listenIP)
+		socksProxy, err := newSocksProxy(
+			controller.config, controller, udpgwClient, controller.splitTunnelPolicy, listenIP)
 		if err != nil {
 			NoticeWarning("error initializing local SOCKS proxy: %s", err)
 			return
@@ -212,6 +265,25 @@ func (controller *Controller) Run(ctx context.Context) {
 		defer httpProxy.Close()
 	}
 
+	if controller.config.LocalDNSProxyAddress != "" {
+		dnsProxy, err := newLocalDNSProxy(
+			controller.config, controller, controller.tunneledDNSResolver)
+		if err != nil {
+			NoticeWarning("error initializing local DNS proxy: %s", err)
+			return
+		}
+		defer dnsProxy.close()
+	}
+
+	if controller.config.LocalControlAPIAddress != "" {
+		controlAPI, err := newControlAPIServer(controller)
+		if err != nil {
+			NoticeWarning("error initializing local control API: %s", err)
+			return
+		}
+		defer controlAPI.close()
+	}
+
 	if !controller.config.DisableRemoteServerListFetcher {
 
 		if controller.config.RemoteServerListURLs != nil {
@@ -245,10 +317,20 @@ func (controller *Controller) Run(ctx context.Context) {
 	controller.runWaitGroup.Add(1)
 	go controller.establishTunnelWatcher()
 
+	if controller.splitTunnelPolicy != nil {
+		controller.runWaitGroup.Add(1)
+		go controller.splitTunnelPolicyReloader()
+	}
+
 	if controller.packetTunnelClient != nil {
 		controller.packetTunnelClient.Start()
 	}
 
+	if controller.userspacePacketTunnel != nil {
+		controller.userspacePacketTunnel.start(
+			udpgwClient, controller.tunneledDNSResolver)
+	}
+
 	// Wait while running
 
 	<-controller.runCtx.Done()
@@ -258,6 +340,10 @@ func (controller *Controller) Run(ctx context.Context) {
 		controller.packetTunnelClient.Stop()
 	}
 
+	if controller.userspacePacketTunnel != nil {
+		controller.userspacePacketTunnel.stop()
+	}
+
 	// All workers -- runTunnels, establishment workers, and auxilliary
 	// workers such as fetch remote server list and untunneled uprade
 	// download -- operate with the controller run context and will all
@@ -267,6 +353,10 @@ func (controller *Controller) Run(ctx context.Context) {
 
 	controller.splitTunnelClassifier.Shutdown()
 
+	if controller.tunneledDNSResolver != nil {
+		controller.tunneledDNSResolver.close()
+	}
+
 	NoticeInfo("exiting controller")
 
 	NoticeExiting()
@@ -439,6 +529,37 @@ func (controller *Controller) establishTunnelWatcher() {
 	NoticeInfo("exiting establish tunnel watcher")
 }
 
+// splitTunnelPolicyReloader periodically checks the split tunnel policy file
+// for changes and reloads the policy. When a reload fails, the previous
+// policy remains in effect.
+func (controller *Controller) splitTunnelPolicyReloader() {
+	defer controller.runWaitGroup.Done()
+
+	period := controller.config.GetClientParameters().Get().Duration(
+		parameters.SplitTunnelPolicyReloadPeriod)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-ticker.C:
+		case <-controller.runCtx.Done():
+			break loop
+		}
+
+		reloaded, err := controller.splitTunnelPolicy.Reload()
+		if err != nil {
+			NoticeWarning("failed to reload split tunnel policy: %s", errors.Trace(err))
+		} else if reloaded {
+			NoticeInfo("reloaded split tunnel policy")
+		}
+	}
+
+	NoticeInfo("exiting split tunnel policy reloader")
+}
+
 // connectedReporter sends periodic "connected" requests to the Psiphon API.
 // These requests are for server-side unique user stats calculation. See the
 // comment in DoConnectedRequest for a description of the request mechanism.
@@ -572,12 +693,18 @@ downloadLoop:
 			// no active tunnel, the untunneledDialConfig will be used.
 			tunnel := controller.getNextActiveTunnel()
 
+			var stripeTunnels []*Tunnel
+			if tunnel != nil && controller.config.TunnelPoolStripeDownloads {
+				stripeTunnels = controller.getStripeTunnels(tunnel)
+			}
+
 			err := DownloadUpgrade(
 				controller.runCtx,
 				controller.config,
 				attempt,
 				handshakeVersion,
 				tunnel,
+				stripeTunnels,
 				controller.untunneledDialConfig)
 
 			if err == nil {
@@ -731,10 +858,17 @@ loop:
 				break
 			}
 
+			multiHopEntryDiagnosticID := ""
+			if connectedTunnel.dialParams.MultiHopEntryTunnel != nil {
+				multiHopEntryDiagnosticID = connectedTunnel.dialParams.
+					MultiHopEntryTunnel.dialParams.ServerEntry.GetDiagnosticID()
+			}
+
 			NoticeActiveTunnel(
 				connectedTunnel.dialParams.ServerEntry.GetDiagnosticID(),
 				connectedTunnel.dialParams.TunnelProtocol,
-				connectedTunnel.dialParams.ServerEntry.SupportsSSHAPIRequests())
+				connectedTunnel.dialParams.ServerEntry.SupportsSSHAPIRequests(),
+				multiHopEntryDiagnosticID)
 
 			if isFirstTunnel {
 
@@ -841,6 +975,37 @@ func (controller *Controller) SignalTunnelFailure(tunnel *Tunnel) {
 	}
 }
 
+// multiHopEntryTunnelOwner is the TunnelOwner for multi-hop entry tunnels.
+// Entry tunnels aren't in the pool of active tunnels; an entry tunnel failure
+// is signaled as a failure of the corresponding active exit tunnel, if any.
+type multiHopEntryTunnelOwner struct {
+	controller *Controller
+}
+
+func (owner *multiHopEntryTunnelOwner) SignalSeededNewSLOK() {
+	owner.controller.SignalSeededNewSLOK()
+}
+
+func (owner *multiHopEntryTunnelOwner) SignalTunnelFailure(entryTunnel *Tunnel) {
+
+	var exitTunnel *Tunnel
+
+	owner.controller.tunnelMutex.Lock()
+	for _, activeTunnel := range owner.controller.tunnels {
+		if activeTunnel.dialParams.MultiHopEntryTunnel == entryTunnel {
+			exitTunnel = activeTunnel
+			break
+		}
+	}
+	owner.controller.tunnelMutex.Unlock()
+
+	// When the exit tunnel isn't yet active, its activation or operation
+	// will fail once the entry tunnel is closed.
+	if exitTunnel != nil {
+		owner.controller.SignalTunnelFailure(exitTunnel)
+	}
+}
+
 // discardTunnel disposes of a successful connection that is no longer required.
 func (controller *Controller) discardTunnel(tunnel *Tunnel) {
 	NoticeInfo("discard tunnel: %s", tunnel.dialParams.ServerEntry.GetDiagnosticID())
@@ -959,19 +1124,39 @@ func (controller *Controller) terminateAllTunnels() {
 }
 
 // getNextActiveTunnel returns the next tunnel from the pool of active
-// tunnels. Currently, tunnel selection order is simple round-robin.
+// tunnels. Tunnel selection is round-robin or, with
+// TUNNEL_POOL_POLICY_WEIGHTED, weighted by measured tunnel performance; see
+// selectWeightedTunnel.
 func (controller *Controller) getNextActiveTunnel() (tunnel *Tunnel) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
 	if len(controller.tunnels) == 0 {
 		return nil
 	}
+	if controller.config.TunnelPoolPolicy == TUNNEL_POOL_POLICY_WEIGHTED {
+		return selectWeightedTunnel(controller.tunnels)
+	}
 	tunnel = controller.tunnels[controller.nextTunnel]
 	controller.nextTunnel =
 		(controller.nextTunnel + 1) % len(controller.tunnels)
 	return tunnel
 }
 
+// getStripeTunnels returns the active tunnels, other than the specified
+// tunnel, which may be used to stripe a download. Degraded tunnels are
+// omitted.
+func (controller *Controller) getStripeTunnels(tunnel *Tunnel) []*Tunnel {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	var stripeTunnels []*Tunnel
+	for _, activeTunnel := range controller.tunnels {
+		if activeTunnel != tunnel && !activeTunnel.isDegraded() {
+			stripeTunnels = append(stripeTunnels, activeTunnel)
+		}
+	}
+	return stripeTunnels
+}
+
 // isActiveTunnelServerEntry is used to check if there's already
 // an existing tunnel to a candidate server.
 func (controller *Controller) isActiveTunnelServerEntry(
@@ -993,6 +1178,32 @@ func (controller *Controller) isActiveTunnelServerEntry(
 func (controller *Controller) Dial(
 	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (conn net.Conn, err error) {
 
+	// Apply the local split tunnel policy, when configured. Policy verdicts
+	// take precedence over region-based split tunnel classification. Direct
+	// and blocked destinations don't require an active tunnel.
+	isPolicyTunneled := false
+	if !alwaysTunnel && controller.splitTunnelPolicy != nil {
+
+		host, portStr, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		switch controller.splitTunnelPolicy.Classify(host, port) {
+		case SPLIT_TUNNEL_POLICY_ACTION_BLOCK:
+			return nil, errors.Trace(errSplitTunnelPolicyBlocked)
+		case SPLIT_TUNNEL_POLICY_ACTION_DIRECT:
+			NoticeUntunneled(host)
+			return controller.DirectDial(remoteAddr)
+		case SPLIT_TUNNEL_POLICY_ACTION_TUNNEL:
+			isPolicyTunneled = true
+		}
+	}
+
 	tunnel := controller.getNextActiveTunnel()
 	if tunnel == nil {
 		return nil, errors.TraceNew("no active tunnels")
@@ -1000,7 +1211,8 @@ func (controller *Controller) Dial(
 
 	// Perform split tunnel classification when feature is enabled, and if the remote
 	// address is classified as untunneled, dial directly.
-	if !alwaysTunnel && controller.config.SplitTunnelDNSServer != "" {
+	if !alwaysTunnel && !isPolicyTunneled &&
+		(controller.config.SplitTunnelDNSServer != "" || controller.tunneledDNSResolver != nil) {
 
 		host, _, err := net.SplitHostPort(remoteAddr)
 		if err != nil {
@@ -1026,6 +1238,23 @@ func (controller *Controller) Dial(
 	return tunneledConn, nil
 }
 
+// DialDatagramChannel establishes a datagram channel, for the specified
+// purpose, with the server of the next active tunnel.
+func (controller *Controller) DialDatagramChannel(purpose string) (net.Conn, error) {
+
+	tunnel := controller.getNextActiveTunnel()
+	if tunnel == nil {
+		return nil, errors.TraceNew("no active tunnels")
+	}
+
+	conn, err := tunnel.DialDatagramChannel(purpose)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return conn, nil
+}
+
 // DirectDial dials an untunneled TCP connection within the controller run context.
 func (controller *Controller) DirectDial(remoteAddr string) (conn net.Conn, err error) {
 	return DialTCP(controller.runCtx, remoteAddr, controller.untunneledDialConfig)
@@ -1159,6 +1388,36 @@ func (p *protocolSelectionConstraints) selectProtocol(
 
 }
 
+// multiHopExitConstraints returns the protocol selection constraints for
+// multi-hop exit servers, merged from p, the configured constraints, which
+// apply to the entry server.
+//
+// The exit server is dialed through the entry tunnel, so no upstream proxy
+// is used and InitialLimitTunnelProtocols, which prioritizes protocols
+// exposed to the network, applies only to the entry server. When
+// LimitTunnelProtocols includes any multi-hop exit protocols, the exit
+// protocols are limited to those; otherwise, LimitTunnelProtocols applies
+// only to the entry server and any multi-hop exit protocol may be used.
+func (p *protocolSelectionConstraints) multiHopExitConstraints() *protocolSelectionConstraints {
+
+	exitProtocols := getMultiHopExitTunnelProtocols()
+
+	limitProtocols := make(protocol.TunnelProtocols, 0)
+	for _, tunnelProtocol := range p.limitProtocols {
+		if common.Contains(exitProtocols, tunnelProtocol) {
+			limitProtocols = append(limitProtocols, tunnelProtocol)
+		}
+	}
+	if len(limitProtocols) == 0 {
+		limitProtocols = exitProtocols
+	}
+
+	return &protocolSelectionConstraints{
+		limitProtocols:       limitProtocols,
+		replayCandidateCount: p.replayCandidateCount,
+	}
+}
+
 type candidateServerEntry struct {
 	serverEntry                *protocol.ServerEntry
 	isServerAffinityCandidate  bool
@@ -1215,6 +1474,11 @@ func (controller *Controller) startEstablishing() {
 	// controller.serverAffinityDoneBroadcast.
 	controller.serverAffinityDoneBroadcast = make(chan struct{})
 
+	// Check for an IPv6 route once per establishment, rather than once per
+	// candidate, as the check performs a socket operation. The result is
+	// read, without locking, by the establishment goroutines launched below.
+	controller.establishHasIPv6Route = hasIPv6Route(controller.untunneledDialConfig)
+
 	controller.establishWaitGroup.Add(1)
 	go controller.launchEstablishing()
 }
@@ -1290,6 +1554,35 @@ func (controller *Controller) launchEstablishing() {
 
 	p.Close()
 
+	// In multi-hop mode, the protocol limits apply to the entry server
+	// connection, the only connection exposed to the network. Candidate
+	// server entries, drawn from the main iterator, are exit servers, which
+	// must support one of the multi-hop exit protocols; the exit constraints
+	// are merged from the configured constraints, as in
+	// multiHopExitConstraints. Entry servers are drawn from a separate
+	// iterator, filtered by MultiHopEntryRegion.
+
+	initialConstraints := controller.protocolSelectionConstraints
+
+	if controller.config.EnableMultiHop {
+
+		controller.multiHopEntryConstraints = controller.protocolSelectionConstraints
+
+		controller.protocolSelectionConstraints =
+			controller.multiHopEntryConstraints.multiHopExitConstraints()
+
+		iterator, err := NewMultiHopEntryServerEntryIterator(controller.config)
+		if err != nil {
+			NoticeWarning("failed to iterate multi-hop entry candidates: %s", err)
+			controller.SignalComponentFailure()
+			return
+		}
+
+		controller.multiHopEntryIteratorMutex.Lock()
+		controller.multiHopEntryIterator = iterator
+		controller.multiHopEntryIteratorMutex.Unlock()
+	}
+
 	// When TargetServerEntry is used, override any worker pool size config or
 	// tactic parameter and use a pool size of 1. The typical use case for
 	// TargetServerEntry is to test a specific server with a single connection
@@ -1322,24 +1615,27 @@ func (controller *Controller) launchEstablishing() {
 	// LimitTunnelProtocols remains a hard limit, as using prohibited
 	// protocols may have some bad effect, such as a firewall blocking all
 	// traffic from a host.
+	//
+	// In multi-hop mode, InitialLimitTunnelProtocols applies to the entry
+	// server, and the check is made against the entry constraints.
 
-	if controller.protocolSelectionConstraints.initialLimitProtocolsCandidateCount > 0 {
+	if initialConstraints.initialLimitProtocolsCandidateCount > 0 {
 
 		egressRegion := "" // no egress region
 
 		initialCount, count := CountServerEntriesWithConstraints(
 			controller.config.UseUpstreamProxy(),
 			egressRegion,
-			controller.protocolSelectionConstraints)
+			initialConstraints)
 
 		if initialCount == 0 {
 			NoticeCandidateServers(
 				egressRegion,
-				controller.protocolSelectionConstraints,
+				initialConstraints,
 				initialCount,
 				count)
 			NoticeWarning("skipping initial limit tunnel protocols")
-			controller.protocolSelectionConstraints.initialLimitProtocolsCandidateCount = 0
+			initialConstraints.initialLimitProtocolsCandidateCount = 0
 
 			// Since we were unable to satisfy the InitialLimitTunnelProtocols
 			// tactic, trigger RSL, OSL, and upgrade fetches to potentially
@@ -1403,6 +1699,13 @@ func (controller *Controller) stopEstablishing() {
 	controller.candidateServerEntries = nil
 	controller.serverAffinityDoneBroadcast = nil
 
+	controller.multiHopEntryIteratorMutex.Lock()
+	if controller.multiHopEntryIterator != nil {
+		controller.multiHopEntryIterator.Close()
+		controller.multiHopEntryIterator = nil
+	}
+	controller.multiHopEntryIteratorMutex.Unlock()
+
 	controller.concurrentEstablishTunnelsMutex.Lock()
 	peakConcurrent := controller.peakConcurrentEstablishTunnels
 	peakConcurrentIntensive := controller.peakConcurrentIntensiveEstablishTunnels
@@ -1556,7 +1859,8 @@ func (controller *Controller) doFetchTactics(
 		selectProtocol,
 		serverEntry,
 		true,
-		0)
+		0,
+		controller.establishHasIPv6Route)
 	if dialParams == nil {
 		// MakeDialParameters may return nil, nil when the server entry can't
 		// satisfy protocol selection criteria. This case in not expected
@@ -1924,7 +2228,44 @@ loop:
 			selectProtocol,
 			candidateServerEntry.serverEntry,
 			false,
-			controller.establishConnectTunnelCount)
+			controller.establishConnectTunnelCount,
+			controller.establishHasIPv6Route)
+
+		// In multi-hop mode, the candidate is the exit server. Select an
+		// entry server and its dial parameters, which may also be a replay.
+		// The candidate is skipped when no entry server is available.
+		//
+		// Selecting an entry server may scan many datastore server entries,
+		// so concurrentEstablishTunnelsMutex is released in the meantime.
+		// The candidate's establishConnectTunnelCount is reserved before
+		// releasing the mutex, so that InitialLimitTunnelProtocolsCandidateCount
+		// is applied consistently to entry servers; a candidate skipped for
+		// lack of an entry server still consumes its count. While the mutex
+		// is released, the concurrent intensive establish tunnels limit, as
+		// applied to the entry protocol via excludeIntensive, may be briefly
+		// exceeded.
+
+		establishConnectTunnelCount := controller.establishConnectTunnelCount
+		isConnectTunnelCountReserved := false
+
+		var entryDialParams *DialParameters
+		if dialParams != nil && err == nil && controller.config.EnableMultiHop {
+
+			controller.establishConnectTunnelCount += 1
+			isConnectTunnelCountReserved = true
+
+			controller.concurrentEstablishTunnelsMutex.Unlock()
+
+			entryDialParams, err = controller.makeMultiHopEntryDialParameters(
+				candidateServerEntry.serverEntry, establishConnectTunnelCount, excludeIntensive)
+
+			controller.concurrentEstablishTunnelsMutex.Lock()
+
+			if entryDialParams == nil {
+				dialParams = nil
+			}
+		}
+
 		if dialParams == nil || err != nil {
 
 			controller.concurrentEstablishTunnelsMutex.Unlock()
@@ -1950,10 +2291,14 @@ loop:
 		// Increment establishConnectTunnelCount only after selectProtocol has
 		// succeeded to ensure InitialLimitTunnelProtocolsCandidateCount
 		// candidates use InitialLimitTunnelProtocols.
-		establishConnectTunnelCount := controller.establishConnectTunnelCount
-		controller.establishConnectTunnelCount += 1
+		if !isConnectTunnelCountReserved {
+			controller.establishConnectTunnelCount += 1
+		}
 
 		isIntensive := protocol.TunnelProtocolIsResourceIntensive(dialParams.TunnelProtocol)
+		if entryDialParams != nil {
+			isIntensive = protocol.TunnelProtocolIsResourceIntensive(entryDialParams.TunnelProtocol)
+		}
 
 		if isIntensive {
 			controller.concurrentIntensiveEstablishTunnels += 1
@@ -1999,11 +2344,27 @@ loop:
 		// reclaim as much as possible.
 		DoGarbageCollection()
 
-		tunnel, err := ConnectTunnel(
-			controller.establishCtx,
-			controller.config,
-			candidateServerEntry.adjustedEstablishStartTime,
-			dialParams)
+		var tunnel *Tunnel
+
+		if entryDialParams != nil {
+			dialParams.MultiHopEntryTunnel, err = controller.connectMultiHopEntryTunnel(
+				candidateServerEntry.adjustedEstablishStartTime,
+				entryDialParams)
+		}
+
+		if err == nil {
+			tunnel, err = ConnectTunnel(
+				controller.establishCtx,
+				controller.config,
+				candidateServerEntry.adjustedEstablishStartTime,
+				dialParams)
+
+			// Once connected, the exit tunnel owns the entry tunnel and
+			// closes it in Tunnel.Close.
+			if err != nil && dialParams.MultiHopEntryTunnel != nil {
+				dialParams.MultiHopEntryTunnel.Close(true)
+			}
+		}
 
 		controller.concurrentEstablishTunnelsMutex.Lock()
 		if isIntensive {
@@ -2070,6 +2431,123 @@ loop:
 	}
 }
 
+// makeMultiHopEntryDialParameters selects the next multi-hop entry server
+// candidate, excluding the exit server, and makes its dial parameters,
+// applying the entry protocol selection constraints. nil is returned when no
+// entry server is available.
+//
+// connectTunnelCount is the establishConnectTunnelCount reserved for the exit
+// server candidate. The caller must not hold concurrentEstablishTunnelsMutex.
+func (controller *Controller) makeMultiHopEntryDialParameters(
+	exitServerEntry *protocol.ServerEntry,
+	connectTunnelCount int,
+	excludeIntensive bool) (*DialParameters, error) {
+
+	controller.multiHopEntryIteratorMutex.Lock()
+	defer controller.multiHopEntryIteratorMutex.Unlock()
+
+	canReplay := func(serverEntry *protocol.ServerEntry, replayProtocol string) bool {
+		return controller.multiHopEntryConstraints.canReplay(
+			connectTunnelCount,
+			excludeIntensive,
+			serverEntry,
+			replayProtocol)
+	}
+
+	selectProtocol := func(serverEntry *protocol.ServerEntry) (string, bool) {
+		return controller.multiHopEntryConstraints.selectProtocol(
+			connectTunnelCount,
+			excludeIntensive,
+			serverEntry)
+	}
+
+	// The iterator is reset, at most once, when it reaches the end of its
+	// cycle. Entry candidates are shared by all establishment workers, so
+	// the same entry server may be selected for multiple exit servers.
+
+	isReset := false
+
+	for {
+		serverEntry, err := controller.multiHopEntryIterator.Next()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if serverEntry == nil {
+			if isReset {
+				return nil, nil
+			}
+			err := controller.multiHopEntryIterator.Reset()
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			isReset = true
+			continue
+		}
+
+		if serverEntry.IpAddress == exitServerEntry.IpAddress {
+			continue
+		}
+
+		dialParams, err := MakeDialParameters(
+			controller.config,
+			canReplay,
+			selectProtocol,
+			serverEntry,
+			false,
+			connectTunnelCount,
+			controller.establishHasIPv6Route)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if dialParams == nil {
+			continue
+		}
+
+		dialParams.IsMultiHopEntry = true
+
+		return dialParams, nil
+	}
+}
+
+// connectMultiHopEntryTunnel connects and activates a multi-hop entry
+// tunnel. The entry tunnel must be activated, completing the handshake,
+// before the entry server will permit the port forward to the exit server.
+func (controller *Controller) connectMultiHopEntryTunnel(
+	adjustedEstablishStartTime time.Time,
+	entryDialParams *DialParameters) (*Tunnel, error) {
+
+	entryTunnel, err := ConnectTunnel(
+		controller.establishCtx,
+		controller.config,
+		adjustedEstablishStartTime,
+		entryDialParams)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = entryTunnel.Activate(
+		controller.establishCtx, &multiHopEntryTunnelOwner{controller: controller})
+	if err != nil {
+		entryTunnel.Close(true)
+		return nil, errors.Trace(err)
+	}
+
+	return entryTunnel, nil
+}
+
+// getMultiHopExitTunnelProtocols returns the supported tunnel protocols which
+// may be used to connect to a multi-hop exit server.
+func getMultiHopExitTunnelProtocols() protocol.TunnelProtocols {
+	exitProtocols := make(protocol.TunnelProtocols, 0)
+	for _, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+		if protocol.TunnelProtocolSupportsMultiHopExit(tunnelProtocol) {
+			exitProtocols = append(exitProtocols, tunnelProtocol)
+		}
+	}
+	return exitProtocols
+}
+
 func (controller *Controller) isStopEstablishing() bool {
 	select {
 	case <-controller.establishCtx.Done():
@@ -54,32 +54,151 @@ var (
 	datastoreServerEntryFetchGCThreshold        = 20
 
 	datastoreMutex    sync.RWMutex
-	activeDatastoreDB *datastoreDB
+	activeDatastoreDB DatastoreBackend
 )
 
+// datastoreBuckets lists all buckets in use.
+var datastoreBuckets = [][]byte{
+	datastoreServerEntriesBucket,
+	datastoreServerEntryTagsBucket,
+	datastoreServerEntryTombstoneTagsBucket,
+	datastoreSplitTunnelRouteETagsBucket,
+	datastoreSplitTunnelRouteDataBucket,
+	datastoreUrlETagsBucket,
+	datastoreKeyValueBucket,
+	datastoreRemoteServerListStatsBucket,
+	datastoreFailedTunnelStatsBucket,
+	datastoreSLOKsBucket,
+	datastoreTacticsBucket,
+	datastoreSpeedTestSamplesBucket,
+	datastoreDialParametersBucket,
+}
+
+// DatastoreBackend is a transactional, bucketed key/value store used for all
+// persistent client data, including server entries, dial parameters,
+// tactics, and stats.
+//
+// By default, the backend compiled in via build tags (BoltDB, or Badger or
+// files with the BADGER_DB or FILES_DB tags) is used, with data stored under
+// the config DataRootDirectory. A different backend, such as the one returned
+// by NewMemoryDatastoreBackend, may be supplied via Config.DatastoreBackend.
+//
+// Callers must not retain key or value slices beyond the scope of the
+// transaction in which they were obtained.
+type DatastoreBackend interface {
+
+	// Close releases the backend. No further transactions are started after
+	// Close is called.
+	Close() error
+
+	// View runs fn in a read-only transaction.
+	View(fn func(tx DatastoreTx) error) error
+
+	// Update runs fn in a read-write transaction. When fn returns an error,
+	// backends that support rollback should discard the transaction's
+	// changes.
+	Update(fn func(tx DatastoreTx) error) error
+}
+
+// DatastoreTx is a DatastoreBackend transaction.
+type DatastoreTx interface {
+
+	// Bucket returns the named bucket, which is created as required.
+	Bucket(name []byte) DatastoreBucket
+
+	// ClearBucket deletes all keys in the named bucket.
+	ClearBucket(name []byte) error
+}
+
+// DatastoreBucket is a set of key/value pairs within a DatastoreTx.
+type DatastoreBucket interface {
+
+	// Get returns the value for the key, or nil when the key is not found.
+	Get(key []byte) []byte
+
+	// Put sets the value for the key.
+	Put(key, value []byte) error
+
+	// Delete removes the key, if present.
+	Delete(key []byte) error
+
+	// Cursor returns a new cursor for iterating over the bucket. The caller
+	// must call Close when done with the cursor.
+	Cursor() DatastoreCursor
+}
+
+// DatastoreCursor iterates over the key/value pairs in a DatastoreBucket.
+// Iteration order is backend-specific. Each returned key and value is valid
+// only until the next cursor call.
+type DatastoreCursor interface {
+	FirstKey() []byte
+	NextKey() []byte
+	First() ([]byte, []byte)
+	Next() ([]byte, []byte)
+	Close()
+}
+
 // OpenDataStore opens and initializes the singleton data store instance.
+//
+// When the datastore file is locked or corrupt, OpenDataStore will reset the
+// datastore, deleting all of its contents.
 func OpenDataStore(config *Config) error {
 
-	datastoreMutex.Lock()
+	err := openDataStore(config, true, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
 
-	existingDB := activeDatastoreDB
+	_ = resetAllPersistentStatsToUnreported()
 
-	if existingDB != nil {
-		datastoreMutex.Unlock()
-		return errors.TraceNew("db already open")
-	}
+	return nil
+}
 
-	newDB, err := datastoreOpenDB(config.GetDataStoreDirectory())
+// OpenDataStoreWithoutReset opens the singleton data store instance, as
+// OpenDataStore does, but fails when the datastore can't be opened rather
+// than resetting the datastore, and leaves persistent stats unmodified.
+// OpenDataStoreWithoutReset is intended for tools which inspect or modify
+// an existing client datastore.
+//
+// When readOnly is set, the datastore is opened in read-only mode and all
+// update transactions will fail.
+func OpenDataStoreWithoutReset(config *Config, readOnly bool) error {
+
+	err := openDataStore(config, false, readOnly)
 	if err != nil {
-		datastoreMutex.Unlock()
 		return errors.Trace(err)
 	}
 
-	activeDatastoreDB = newDB
+	return nil
+}
+
+func openDataStore(config *Config, retryWithReset, readOnly bool) error {
 
-	datastoreMutex.Unlock()
+	datastoreMutex.Lock()
+	defer datastoreMutex.Unlock()
 
-	_ = resetAllPersistentStatsToUnreported()
+	if activeDatastoreDB != nil {
+		return errors.TraceNew("db already open")
+	}
+
+	if config.DatastoreBackend != nil {
+
+		if readOnly {
+			return errors.TraceNew("read-only mode not supported")
+		}
+
+		activeDatastoreDB = config.DatastoreBackend
+
+	} else {
+
+		newDB, err := datastoreOpenDB(
+			config.GetDataStoreDirectory(), retryWithReset, readOnly)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		activeDatastoreDB = newDB
+	}
 
 	return nil
 }
@@ -94,7 +213,7 @@ func CloseDataStore() {
 		return
 	}
 
-	err := activeDatastoreDB.close()
+	err := activeDatastoreDB.Close()
 	if err != nil {
 		NoticeWarning("failed to close database: %s", errors.Trace(err))
 	}
@@ -102,7 +221,7 @@ func CloseDataStore() {
 	activeDatastoreDB = nil
 }
 
-func datastoreView(fn func(tx *datastoreTx) error) error {
+func datastoreView(fn func(tx DatastoreTx) error) error {
 
 	datastoreMutex.RLock()
 	defer datastoreMutex.RUnlock()
@@ -111,14 +230,14 @@ func datastoreView(fn func(tx *datastoreTx) error) error {
 		return errors.TraceNew("database not open")
 	}
 
-	err := activeDatastoreDB.view(fn)
+	err := activeDatastoreDB.View(fn)
 	if err != nil {
 		err = errors.Trace(err)
 	}
 	return err
 }
 
-func datastoreUpdate(fn func(tx *datastoreTx) error) error {
+func datastoreUpdate(fn func(tx DatastoreTx) error) error {
 
 	datastoreMutex.RLock()
 	defer datastoreMutex.RUnlock()
@@ -127,7 +246,7 @@ func datastoreUpdate(fn func(tx *datastoreTx) error) error {
 		return errors.TraceNew("database not open")
 	}
 
-	err := activeDatastoreDB.update(fn)
+	err := activeDatastoreDB.Update(fn)
 	if err != nil {
 		err = errors.Trace(err)
 	}
@@ -165,18 +284,18 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 	// values (e.g., many servers support all protocols), performance
 	// is expected to be acceptable.
 
-	err = datastoreUpdate(func(tx *datastoreTx) error {
+	err = datastoreUpdate(func(tx DatastoreTx) error {
 
-		serverEntries := tx.bucket(datastoreServerEntriesBucket)
-		serverEntryTags := tx.bucket(datastoreServerEntryTagsBucket)
-		serverEntryTombstoneTags := tx.bucket(datastoreServerEntryTombstoneTagsBucket)
+		serverEntries := tx.Bucket(datastoreServerEntriesBucket)
+		serverEntryTags := tx.Bucket(datastoreServerEntryTagsBucket)
+		serverEntryTombstoneTags := tx.Bucket(datastoreServerEntryTombstoneTagsBucket)
 
 		serverEntryID := []byte(serverEntryFields.GetIPAddress())
 
 		// Check not only that the entry exists, but is valid. This
 		// will replace in the rare case where the data is corrupt.
 		existingConfigurationVersion := -1
-		existingData := serverEntries.get(serverEntryID)
+		existingData := serverEntries.Get(serverEntryID)
 		if existingData != nil {
 			var existingServerEntry *protocol.ServerEntry
 			err := json.Unmarshal(existingData, &existingServerEntry)
@@ -216,7 +335,7 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 		// and then restored; in this case, it's desired for pruned server entries
 		// to be restored.
 		if serverEntryFields.GetLocalSource() == protocol.SERVER_ENTRY_SOURCE_EMBEDDED {
-			if serverEntryTombstoneTags.get(serverEntryTagBytes) != nil {
+			if serverEntryTombstoneTags.Get(serverEntryTagBytes) != nil {
 				return nil
 			}
 		}
@@ -226,12 +345,12 @@ func StoreServerEntry(serverEntryFields protocol.ServerEntryFields, replaceIfExi
 			return errors.Trace(err)
 		}
 
-		err = serverEntries.put(serverEntryID, data)
+		err = serverEntries.Put(serverEntryID, data)
 		if err != nil {
 			return errors.Trace(err)
 		}
 
-		err = serverEntryTags.put(serverEntryTagBytes, serverEntryID)
+		err = serverEntryTags.Put(serverEntryTagBytes, serverEntryID)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -306,14 +425,14 @@ func StreamingStoreServerEntries(
 // PromoteServerEntry sets the server affinity server entry ID to the
 // specified server entry IP address.
 func PromoteServerEntry(config *Config, ipAddress string) error {
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(func(tx DatastoreTx) error {
 
 		serverEntryID := []byte(ipAddress)
 
 		// Ensure the corresponding server entry exists before
 		// setting server affinity.
-		bucket := tx.bucket(datastoreServerEntriesBucket)
-		data := bucket.get(serverEntryID)
+		bucket := tx.Bucket(datastoreServerEntriesBucket)
+		data := bucket.Get(serverEntryID)
 		if data == nil {
 			NoticeWarning(
 				"PromoteServerEntry: ignoring unknown server entry: %s",
@@ -321,8 +440,8 @@ func PromoteServerEntry(config *Config, ipAddress string) error {
 			return nil
 		}
 
-		bucket = tx.bucket(datastoreKeyValueBucket)
-		err := bucket.put(datastoreAffinityServerEntryIDKey, serverEntryID)
+		bucket = tx.Bucket(datastoreKeyValueBucket)
+		err := bucket.Put(datastoreAffinityServerEntryIDKey, serverEntryID)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -337,7 +456,7 @@ func PromoteServerEntry(config *Config, ipAddress string) error {
 			return errors.Trace(err)
 		}
 
-		err = bucket.put(datastoreLastServerEntryFilterKey, currentFilter)
+		err = bucket.Put(datastoreLastServerEntryFilterKey, currentFilter)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -354,20 +473,20 @@ func PromoteServerEntry(config *Config, ipAddress string) error {
 // DeleteServerEntryAffinity clears server affinity if set to the specified
 // server.
 func DeleteServerEntryAffinity(ipAddress string) error {
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(func(tx DatastoreTx) error {
 
 		serverEntryID := []byte(ipAddress)
 
-		bucket := tx.bucket(datastoreKeyValueBucket)
+		bucket := tx.Bucket(datastoreKeyValueBucket)
 
-		affinityServerEntryID := bucket.get(datastoreAffinityServerEntryIDKey)
+		affinityServerEntryID := bucket.Get(datastoreAffinityServerEntryIDKey)
 
 		if bytes.Equal(affinityServerEntryID, serverEntryID) {
-			err := bucket.delete(datastoreAffinityServerEntryIDKey)
+			err := bucket.Delete(datastoreAffinityServerEntryIDKey)
 			if err != nil {
 				return errors.Trace(err)
 			}
-			err = bucket.delete(datastoreLastServerEntryFilterKey)
+			err = bucket.Delete(datastoreLastServerEntryFilterKey)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -399,10 +518,10 @@ func hasServerEntryFilterChanged(config *Config) (bool, error) {
 	}
 
 	changed := false
-	err = datastoreView(func(tx *datastoreTx) error {
+	err = datastoreView(func(tx DatastoreTx) error {
 
-		bucket := tx.bucket(datastoreKeyValueBucket)
-		previousFilter := bucket.get(datastoreLastServerEntryFilterKey)
+		bucket := tx.Bucket(datastoreKeyValueBucket)
+		previousFilter := bucket.Get(datastoreLastServerEntryFilterKey)
 
 		// When not found, previousFilter will be nil; ensures this
 		// results in "changed", even if currentFilter is len(0).
@@ -427,6 +546,7 @@ type ServerEntryIterator struct {
 	serverEntryIDs               [][]byte
 	serverEntryIndex             int
 	isTacticsServerEntryIterator bool
+	isMultiHopEntryIterator      bool
 	isTargetServerEntryIterator  bool
 	hasNextTargetServerEntry     bool
 	targetServerEntry            *protocol.ServerEntry
@@ -492,6 +612,25 @@ func NewTacticsServerEntryIterator(config *Config) (*ServerEntryIterator, error)
 	return iterator, nil
 }
 
+// NewMultiHopEntryServerEntryIterator creates a new ServerEntryIterator
+// which selects multi-hop entry server candidates. Candidates are filtered by
+// MultiHopEntryRegion instead of EgressRegion, and TargetServerEntry and
+// server affinity don't apply.
+func NewMultiHopEntryServerEntryIterator(config *Config) (*ServerEntryIterator, error) {
+
+	iterator := &ServerEntryIterator{
+		config:                  config,
+		isMultiHopEntryIterator: true,
+	}
+
+	err := iterator.reset(true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return iterator, nil
+}
+
 // newTargetServerEntryIterator is a helper for initializing the TargetServerEntry case
 func newTargetServerEntryIterator(config *Config, isTactics bool) (bool, *ServerEntryIterator, error) {
 
@@ -518,6 +657,10 @@ func newTargetServerEntryIterator(config *Config, isTactics bool) (bool, *Server
 			return false, nil, errors.TraceNew("TargetServerEntry does not support EgressRegion")
 		}
 
+		if config.RequireTorORPortForwarding && !serverEntry.SupportsTorORPortForwarding() {
+			return false, nil, errors.TraceNew("TargetServerEntry does not support TorORPortForwarding")
+		}
+
 		limitTunnelProtocols := config.GetClientParameters().Get().TunnelProtocols(parameters.LimitTunnelProtocols)
 		if len(limitTunnelProtocols) > 0 {
 			// At the ServerEntryIterator level, only limitTunnelProtocols is applied;
@@ -574,9 +717,9 @@ func (iterator *ServerEntryIterator) reset(isInitialRound bool) error {
 
 	var serverEntryIDs [][]byte
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(func(tx DatastoreTx) error {
 
-		bucket := tx.bucket(datastoreKeyValueBucket)
+		bucket := tx.Bucket(datastoreKeyValueBucket)
 
 		serverEntryIDs = make([][]byte, 0)
 		shuffleHead := 0
@@ -589,16 +732,16 @@ func (iterator *ServerEntryIterator) reset(isInitialRound bool) error {
 		if isInitialRound &&
 			iterator.applyServerAffinity {
 
-			affinityServerEntryID = bucket.get(datastoreAffinityServerEntryIDKey)
+			affinityServerEntryID = bucket.Get(datastoreAffinityServerEntryIDKey)
 			if affinityServerEntryID != nil {
 				serverEntryIDs = append(serverEntryIDs, append([]byte(nil), affinityServerEntryID...))
 				shuffleHead = 1
 			}
 		}
 
-		bucket = tx.bucket(datastoreServerEntriesBucket)
-		cursor := bucket.cursor()
-		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+		bucket = tx.Bucket(datastoreServerEntriesBucket)
+		cursor := bucket.Cursor()
+		for key := cursor.FirstKey(); key != nil; key = cursor.NextKey() {
 			if affinityServerEntryID != nil {
 				if bytes.Equal(affinityServerEntryID, key) {
 					continue
@@ -606,7 +749,7 @@ func (iterator *ServerEntryIterator) reset(isInitialRound bool) error {
 			}
 			serverEntryIDs = append(serverEntryIDs, append([]byte(nil), key...))
 		}
-		cursor.close()
+		cursor.Close()
 
 		// Randomly shuffle the entire list of server IDs, excluding the
 		// server affinity candidate.
@@ -633,19 +776,19 @@ func (iterator *ServerEntryIterator) reset(isInitialRound bool) error {
 
 			networkID := []byte(iterator.config.GetNetworkID())
 
-			dialParamsBucket := tx.bucket(datastoreDialParametersBucket)
+			dialParamsBucket := tx.Bucket(datastoreDialParametersBucket)
 			i := shuffleHead
 			j := len(serverEntryIDs) - 1
 			for {
 				for ; i < j; i++ {
 					key := makeDialParametersKey(serverEntryIDs[i], networkID)
-					if dialParamsBucket.get(key) == nil {
+					if dialParamsBucket.Get(key) == nil {
 						break
 					}
 				}
 				for ; i < j; j-- {
 					key := makeDialParametersKey(serverEntryIDs[j], networkID)
-					if dialParamsBucket.get(key) != nil {
+					if dialParamsBucket.Get(key) != nil {
 						break
 					}
 				}
@@ -712,9 +855,9 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 
 		serverEntry = nil
 
-		err = datastoreView(func(tx *datastoreTx) error {
-			serverEntries := tx.bucket(datastoreServerEntriesBucket)
-			value := serverEntries.get(serverEntryID)
+		err = datastoreView(func(tx DatastoreTx) error {
+			serverEntries := tx.Bucket(datastoreServerEntriesBucket)
+			value := serverEntries.Get(serverEntryID)
 			if value == nil {
 				return nil
 			}
@@ -757,15 +900,15 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 			serverEntry.Tag = protocol.GenerateServerEntryTag(
 				serverEntry.IpAddress, serverEntry.WebServerSecret)
 
-			err = datastoreUpdate(func(tx *datastoreTx) error {
+			err = datastoreUpdate(func(tx DatastoreTx) error {
 
-				serverEntries := tx.bucket(datastoreServerEntriesBucket)
-				serverEntryTags := tx.bucket(datastoreServerEntryTagsBucket)
+				serverEntries := tx.Bucket(datastoreServerEntriesBucket)
+				serverEntryTags := tx.Bucket(datastoreServerEntryTagsBucket)
 
 				// We must reload and store back the server entry _fields_ to preserve any
 				// currently unrecognized fields, for future compatibility.
 
-				value := serverEntries.get(serverEntryID)
+				value := serverEntries.Get(serverEntryID)
 				if value == nil {
 					return nil
 				}
@@ -797,12 +940,12 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 					return errors.Trace(err)
 				}
 
-				serverEntries.put(serverEntryID, jsonServerEntryFields)
+				serverEntries.Put(serverEntryID, jsonServerEntryFields)
 				if err != nil {
 					return errors.Trace(err)
 				}
 
-				serverEntryTags.put([]byte(serverEntryTag), serverEntryID)
+				serverEntryTags.Put([]byte(serverEntryTag), serverEntryID)
 				if err != nil {
 					return errors.Trace(err)
 				}
@@ -831,10 +974,19 @@ func (iterator *ServerEntryIterator) Next() (*protocol.ServerEntry, error) {
 				break
 			}
 
+		} else if iterator.isMultiHopEntryIterator {
+
+			if iterator.config.MultiHopEntryRegion == "" ||
+				serverEntry.Region == iterator.config.MultiHopEntryRegion {
+				break
+			}
+
 		} else {
 
-			if iterator.config.EgressRegion == "" ||
-				serverEntry.Region == iterator.config.EgressRegion {
+			if (iterator.config.EgressRegion == "" ||
+				serverEntry.Region == iterator.config.EgressRegion) &&
+				(!iterator.config.RequireTorORPortForwarding ||
+					serverEntry.SupportsTorORPortForwarding()) {
 				break
 			}
 		}
@@ -875,22 +1027,20 @@ func pruneServerEntry(config *Config, serverEntryTag string) error {
 	minimumAgeForPruning := config.GetClientParameters().Get().Duration(
 		parameters.ServerEntryMinimumAgeForPruning)
 
-	return datastoreUpdate(func(tx *datastoreTx) error {
+	return datastoreUpdate(func(tx DatastoreTx) error {
 
-		serverEntries := tx.bucket(datastoreServerEntriesBucket)
-		serverEntryTags := tx.bucket(datastoreServerEntryTagsBucket)
-		serverEntryTombstoneTags := tx.bucket(datastoreServerEntryTombstoneTagsBucket)
-		keyValues := tx.bucket(datastoreKeyValueBucket)
-		dialParameters := tx.bucket(datastoreDialParametersBucket)
+		serverEntries := tx.Bucket(datastoreServerEntriesBucket)
+		serverEntryTags := tx.Bucket(datastoreServerEntryTagsBucket)
+		serverEntryTombstoneTags := tx.Bucket(datastoreServerEntryTombstoneTagsBucket)
 
 		serverEntryTagBytes := []byte(serverEntryTag)
 
-		serverEntryID := serverEntryTags.get(serverEntryTagBytes)
+		serverEntryID := serverEntryTags.Get(serverEntryTagBytes)
 		if serverEntryID == nil {
 			return errors.TraceNew("server entry tag not found")
 		}
 
-		serverEntryJson := serverEntries.get(serverEntryID)
+		serverEntryJson := serverEntries.Get(serverEntryID)
 		if serverEntryJson == nil {
 			return errors.TraceNew("server entry not found")
 		}
@@ -918,45 +1068,15 @@ func pruneServerEntry(config *Config, serverEntryTag string) error {
 		// associated with another tag. The pruned tag is still deleted.
 		deleteServerEntry := (serverEntry.Tag == serverEntryTag)
 
-		err = serverEntryTags.delete(serverEntryTagBytes)
+		err = serverEntryTags.Delete(serverEntryTagBytes)
 		if err != nil {
 			errors.Trace(err)
 		}
 
 		if deleteServerEntry {
-
-			err = serverEntries.delete(serverEntryID)
+			err = deleteServerEntryRecord(tx, serverEntryID)
 			if err != nil {
-				errors.Trace(err)
-			}
-
-			affinityServerEntryID := keyValues.get(datastoreAffinityServerEntryIDKey)
-			if bytes.Equal(affinityServerEntryID, serverEntryID) {
-				err = keyValues.delete(datastoreAffinityServerEntryIDKey)
-				if err != nil {
-					return errors.Trace(err)
-				}
-				err = keyValues.delete(datastoreLastServerEntryFilterKey)
-				if err != nil {
-					return errors.Trace(err)
-				}
-			}
-
-			// TODO: expose boltdb Seek functionality to skip to first matching record.
-			cursor := dialParameters.cursor()
-			defer cursor.close()
-			foundFirstMatch := false
-			for key, _ := cursor.first(); key != nil; key, _ = cursor.next() {
-				// Dial parameters key has serverID as a prefix; see makeDialParametersKey.
-				if bytes.HasPrefix(key, serverEntryID) {
-					foundFirstMatch = true
-					err := dialParameters.delete(key)
-					if err != nil {
-						return errors.Trace(err)
-					}
-				} else if foundFirstMatch {
-					break
-				}
+				return errors.Trace(err)
 			}
 		}
 
@@ -970,7 +1090,7 @@ func pruneServerEntry(config *Config, serverEntryTag string) error {
 		// safe mechanism to restore pruned server entries through all non-embedded
 		// sources.
 		if serverEntry.LocalSource == protocol.SERVER_ENTRY_SOURCE_EMBEDDED {
-			err = serverEntryTombstoneTags.put(serverEntryTagBytes, []byte{1})
+			err = serverEntryTombstoneTags.Put(serverEntryTagBytes, []byte{1})
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -980,12 +1100,58 @@ func pruneServerEntry(config *Config, serverEntryTag string) error {
 	})
 }
 
+// deleteServerEntryRecord deletes the server entry record and associated
+// affinity and dial parameters records. Server entry tag and tombstone
+// records are not modified.
+func deleteServerEntryRecord(tx DatastoreTx, serverEntryID []byte) error {
+
+	serverEntries := tx.Bucket(datastoreServerEntriesBucket)
+	keyValues := tx.Bucket(datastoreKeyValueBucket)
+	dialParameters := tx.Bucket(datastoreDialParametersBucket)
+
+	err := serverEntries.Delete(serverEntryID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	affinityServerEntryID := keyValues.Get(datastoreAffinityServerEntryIDKey)
+	if bytes.Equal(affinityServerEntryID, serverEntryID) {
+		err = keyValues.Delete(datastoreAffinityServerEntryIDKey)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = keyValues.Delete(datastoreLastServerEntryFilterKey)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// TODO: expose boltdb Seek functionality to skip to first matching record.
+	cursor := dialParameters.Cursor()
+	defer cursor.Close()
+	foundFirstMatch := false
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		// Dial parameters key has serverID as a prefix; see makeDialParametersKey.
+		if bytes.HasPrefix(key, serverEntryID) {
+			foundFirstMatch = true
+			err := dialParameters.Delete(key)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		} else if foundFirstMatch {
+			break
+		}
+	}
+
+	return nil
+}
+
 func scanServerEntries(scanner func(*protocol.ServerEntry)) error {
-	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreServerEntriesBucket)
-		cursor := bucket.cursor()
+	err := datastoreView(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreServerEntriesBucket)
+		cursor := bucket.Cursor()
 		n := 0
-		for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
 			var serverEntry *protocol.ServerEntry
 			err := json.Unmarshal(value, &serverEntry)
 			if err != nil {
@@ -1002,7 +1168,7 @@ func scanServerEntries(scanner func(*protocol.ServerEntry)) error {
 				n = 0
 			}
 		}
-		cursor.close()
+		cursor.Close()
 		return nil
 	})
 
@@ -1110,15 +1276,15 @@ func ReportAvailableRegions(config *Config, constraints *protocolSelectionConstr
 // used to make efficient web requests for updates to the data.
 func SetSplitTunnelRoutes(region, etag string, data []byte) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSplitTunnelRouteETagsBucket)
-		err := bucket.put([]byte(region), []byte(etag))
+	err := datastoreUpdate(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreSplitTunnelRouteETagsBucket)
+		err := bucket.Put([]byte(region), []byte(etag))
 		if err != nil {
 			return errors.Trace(err)
 		}
 
-		bucket = tx.bucket(datastoreSplitTunnelRouteDataBucket)
-		err = bucket.put([]byte(region), data)
+		bucket = tx.Bucket(datastoreSplitTunnelRouteDataBucket)
+		err = bucket.Put([]byte(region), data)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -1138,9 +1304,9 @@ func GetSplitTunnelRoutesETag(region string) (string, error) {
 
 	var etag string
 
-	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSplitTunnelRouteETagsBucket)
-		etag = string(bucket.get([]byte(region)))
+	err := datastoreView(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreSplitTunnelRouteETagsBucket)
+		etag = string(bucket.Get([]byte(region)))
 		return nil
 	})
 
@@ -1156,9 +1322,9 @@ func GetSplitTunnelRoutesData(region string) ([]byte, error) {
 
 	var data []byte
 
-	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSplitTunnelRouteDataBucket)
-		value := bucket.get([]byte(region))
+	err := datastoreView(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreSplitTunnelRouteDataBucket)
+		value := bucket.Get([]byte(region))
 		if value != nil {
 			// Must make a copy as slice is only valid within transaction.
 			data = make([]byte, len(value))
@@ -1178,9 +1344,9 @@ func GetSplitTunnelRoutesData(region string) ([]byte, error) {
 // encoded or decoded or otherwise canonicalized.
 func SetUrlETag(url, etag string) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreUrlETagsBucket)
-		err := bucket.put([]byte(url), []byte(etag))
+	err := datastoreUpdate(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreUrlETagsBucket)
+		err := bucket.Put([]byte(url), []byte(etag))
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -1199,9 +1365,9 @@ func GetUrlETag(url string) (string, error) {
 
 	var etag string
 
-	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreUrlETagsBucket)
-		etag = string(bucket.get([]byte(url)))
+	err := datastoreView(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreUrlETagsBucket)
+		etag = string(bucket.Get([]byte(url)))
 		return nil
 	})
 
@@ -1214,9 +1380,9 @@ func GetUrlETag(url string) (string, error) {
 // SetKeyValue stores a key/value pair.
 func SetKeyValue(key, value string) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreKeyValueBucket)
-		err := bucket.put([]byte(key), []byte(value))
+	err := datastoreUpdate(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreKeyValueBucket)
+		err := bucket.Put([]byte(key), []byte(value))
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -1235,9 +1401,9 @@ func GetKeyValue(key string) (string, error) {
 
 	var value string
 
-	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreKeyValueBucket)
-		value = string(bucket.get([]byte(key)))
+	err := datastoreView(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreKeyValueBucket)
+		value = string(bucket.Get([]byte(key)))
 		return nil
 	})
 
@@ -1285,15 +1451,15 @@ func StorePersistentStat(config *Config, statType string, stat []byte) error {
 	maxStoreRecords := config.GetClientParameters().Get().Int(
 		parameters.PersistentStatsMaxStoreRecords)
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket([]byte(statType))
+	err := datastoreUpdate(func(tx DatastoreTx) error {
+		bucket := tx.Bucket([]byte(statType))
 
 		count := 0
-		cursor := bucket.cursor()
-		for key, _ := cursor.first(); key != nil; key, _ = cursor.next() {
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
 			count++
 		}
-		cursor.close()
+		cursor.Close()
 
 		// TODO: assuming newer metrics are more useful, replace oldest record
 		// instead of discarding?
@@ -1303,7 +1469,7 @@ func StorePersistentStat(config *Config, statType string, stat []byte) error {
 			return nil
 		}
 
-		err := bucket.put(stat, persistentStatStateUnreported)
+		err := bucket.Put(stat, persistentStatStateUnreported)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -1324,18 +1490,18 @@ func CountUnreportedPersistentStats() int {
 
 	unreported := 0
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(func(tx DatastoreTx) error {
 
 		for _, statType := range persistentStatTypes {
 
-			bucket := tx.bucket([]byte(statType))
-			cursor := bucket.cursor()
-			for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			bucket := tx.Bucket([]byte(statType))
+			cursor := bucket.Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
 				if bytes.Equal(value, persistentStatStateUnreported) {
 					unreported++
 				}
 			}
-			cursor.close()
+			cursor.Close()
 		}
 		return nil
 	})
@@ -1361,15 +1527,15 @@ func TakeOutUnreportedPersistentStats(config *Config) (map[string][][]byte, erro
 	maxSendBytes := config.GetClientParameters().Get().Int(
 		parameters.PersistentStatsMaxSendBytes)
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(func(tx DatastoreTx) error {
 
 		sendBytes := 0
 
 		for _, statType := range persistentStatTypes {
 
-			bucket := tx.bucket([]byte(statType))
-			cursor := bucket.cursor()
-			for key, value := cursor.first(); key != nil; key, value = cursor.next() {
+			bucket := tx.Bucket([]byte(statType))
+			cursor := bucket.Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
 
 				// Perform a test JSON unmarshaling. In case of data corruption or a bug,
 				// delete and skip the record.
@@ -1379,7 +1545,7 @@ func TakeOutUnreportedPersistentStats(config *Config) (map[string][][]byte, erro
 					NoticeWarning(
 						"Invalid key in TakeOutUnreportedPersistentStats: %s: %s",
 						string(key), err)
-					bucket.delete(key)
+					bucket.Delete(key)
 					continue
 				}
 
@@ -1401,10 +1567,10 @@ func TakeOutUnreportedPersistentStats(config *Config) (map[string][][]byte, erro
 				}
 
 			}
-			cursor.close()
+			cursor.Close()
 
 			for _, key := range stats[statType] {
-				err := bucket.put(key, persistentStatStateReporting)
+				err := bucket.Put(key, persistentStatStateReporting)
 				if err != nil {
 					return errors.Trace(err)
 				}
@@ -1425,13 +1591,13 @@ func TakeOutUnreportedPersistentStats(config *Config) (map[string][][]byte, erro
 // stat records to StateUnreported.
 func PutBackUnreportedPersistentStats(stats map[string][][]byte) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(func(tx DatastoreTx) error {
 
 		for _, statType := range persistentStatTypes {
 
-			bucket := tx.bucket([]byte(statType))
+			bucket := tx.Bucket([]byte(statType))
 			for _, key := range stats[statType] {
-				err := bucket.put(key, persistentStatStateUnreported)
+				err := bucket.Put(key, persistentStatStateUnreported)
 				if err != nil {
 					return errors.Trace(err)
 				}
@@ -1452,13 +1618,13 @@ func PutBackUnreportedPersistentStats(stats map[string][][]byte) error {
 // stat records that were successfully reported.
 func ClearReportedPersistentStats(stats map[string][][]byte) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(func(tx DatastoreTx) error {
 
 		for _, statType := range persistentStatTypes {
 
-			bucket := tx.bucket([]byte(statType))
+			bucket := tx.Bucket([]byte(statType))
 			for _, key := range stats[statType] {
-				err := bucket.delete(key)
+				err := bucket.Delete(key)
 				if err != nil {
 					return err
 				}
@@ -1481,23 +1647,23 @@ func ClearReportedPersistentStats(stats map[string][][]byte) error {
 // persistent records in StateReporting were reported or not.
 func resetAllPersistentStatsToUnreported() error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
+	err := datastoreUpdate(func(tx DatastoreTx) error {
 
 		for _, statType := range persistentStatTypes {
 
-			bucket := tx.bucket([]byte(statType))
+			bucket := tx.Bucket([]byte(statType))
 			resetKeys := make([][]byte, 0)
-			cursor := bucket.cursor()
-			for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+			cursor := bucket.Cursor()
+			for key := cursor.FirstKey(); key != nil; key = cursor.NextKey() {
 				resetKeys = append(resetKeys, key)
 			}
-			cursor.close()
+			cursor.Close()
 			// TODO: data mutation is done outside cursor. Is this
 			// strictly necessary in this case? As is, this means
 			// all stats need to be loaded into memory at once.
 			// https://godoc.org/github.com/boltdb/bolt#Cursor
 			for _, key := range resetKeys {
-				err := bucket.put(key, persistentStatStateUnreported)
+				err := bucket.Put(key, persistentStatStateUnreported)
 				if err != nil {
 					return errors.Trace(err)
 				}
@@ -1519,13 +1685,13 @@ func CountSLOKs() int {
 
 	count := 0
 
-	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSLOKsBucket)
-		cursor := bucket.cursor()
-		for key := cursor.firstKey(); key != nil; key = cursor.nextKey() {
+	err := datastoreView(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreSLOKsBucket)
+		cursor := bucket.Cursor()
+		for key := cursor.FirstKey(); key != nil; key = cursor.NextKey() {
 			count++
 		}
-		cursor.close()
+		cursor.Close()
 		return nil
 	})
 
@@ -1540,8 +1706,8 @@ func CountSLOKs() int {
 // DeleteSLOKs deletes all SLOK records.
 func DeleteSLOKs() error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
-		return tx.clearBucket(datastoreSLOKsBucket)
+	err := datastoreUpdate(func(tx DatastoreTx) error {
+		return tx.ClearBucket(datastoreSLOKsBucket)
 	})
 
 	if err != nil {
@@ -1557,10 +1723,10 @@ func SetSLOK(id, key []byte) (bool, error) {
 
 	var duplicate bool
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSLOKsBucket)
-		duplicate = bucket.get(id) != nil
-		err := bucket.put([]byte(id), []byte(key))
+	err := datastoreUpdate(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreSLOKsBucket)
+		duplicate = bucket.Get(id) != nil
+		err := bucket.Put([]byte(id), []byte(key))
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -1580,9 +1746,9 @@ func GetSLOK(id []byte) ([]byte, error) {
 
 	var key []byte
 
-	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(datastoreSLOKsBucket)
-		key = bucket.get(id)
+	err := datastoreView(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreSLOKsBucket)
+		key = bucket.Get(id)
 		return nil
 	})
 
@@ -1681,18 +1847,18 @@ func GetAffinityServerEntryAndDialParameters(
 	var serverEntryFields protocol.ServerEntryFields
 	var dialParams *DialParameters
 
-	err := datastoreView(func(tx *datastoreTx) error {
+	err := datastoreView(func(tx DatastoreTx) error {
 
-		keyValues := tx.bucket(datastoreKeyValueBucket)
-		serverEntries := tx.bucket(datastoreServerEntriesBucket)
-		dialParameters := tx.bucket(datastoreDialParametersBucket)
+		keyValues := tx.Bucket(datastoreKeyValueBucket)
+		serverEntries := tx.Bucket(datastoreServerEntriesBucket)
+		dialParameters := tx.Bucket(datastoreDialParametersBucket)
 
-		affinityServerEntryID := keyValues.get(datastoreAffinityServerEntryIDKey)
+		affinityServerEntryID := keyValues.Get(datastoreAffinityServerEntryIDKey)
 		if affinityServerEntryID == nil {
 			return errors.TraceNew("no affinity server available")
 		}
 
-		serverEntryRecord := serverEntries.get(affinityServerEntryID)
+		serverEntryRecord := serverEntries.Get(affinityServerEntryID)
 		if serverEntryRecord == nil {
 			return errors.TraceNew("affinity server entry not found")
 		}
@@ -1708,7 +1874,7 @@ func GetAffinityServerEntryAndDialParameters(
 			[]byte(serverEntryFields.GetIPAddress()),
 			[]byte(networkID))
 
-		dialParamsRecord := dialParameters.get(dialParamsKey)
+		dialParamsRecord := dialParameters.Get(dialParamsKey)
 		if dialParamsRecord != nil {
 			err := json.Unmarshal(dialParamsRecord, &dialParams)
 			if err != nil {
@@ -1727,9 +1893,9 @@ func GetAffinityServerEntryAndDialParameters(
 
 func setBucketValue(bucket, key, value []byte) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket(bucket)
-		err := bucket.put(key, value)
+	err := datastoreUpdate(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(bucket)
+		err := bucket.Put(key, value)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -1747,9 +1913,9 @@ func getBucketValue(bucket, key []byte) ([]byte, error) {
 
 	var value []byte
 
-	err := datastoreView(func(tx *datastoreTx) error {
-		bucket := tx.bucket(bucket)
-		value = bucket.get(key)
+	err := datastoreView(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(bucket)
+		value = bucket.Get(key)
 		return nil
 	})
 
@@ -1762,9 +1928,9 @@ func getBucketValue(bucket, key []byte) ([]byte, error) {
 
 func deleteBucketValue(bucket, key []byte) error {
 
-	err := datastoreUpdate(func(tx *datastoreTx) error {
-		bucket := tx.bucket(bucket)
-		return bucket.delete(key)
+	err := datastoreUpdate(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(bucket)
+		return bucket.Delete(key)
 	})
 
 	if err != nil {
@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+// DatastoreDump is a JSON-serializable copy of datastore records, keyed by
+// bucket name. DatastoreDump is intended for inspection and debugging, and
+// for transferring server entries between datastores.
+type DatastoreDump struct {
+	Buckets map[string][]*DatastoreDumpRecord `json:"buckets"`
+}
+
+// DatastoreDumpRecord is a single datastore key/value record. Each of the
+// key and value is represented in the most readable form possible: values
+// that are valid JSON, such as server entries and dial parameters, are
+// embedded as-is; other UTF-8 keys and values are represented as strings;
+// and all remaining binary data is base64 encoded.
+type DatastoreDumpRecord struct {
+	Key         string          `json:"key,omitempty"`
+	KeyBase64   []byte          `json:"keyBase64,omitempty"`
+	Value       json.RawMessage `json:"value,omitempty"`
+	ValueString string          `json:"valueString,omitempty"`
+	ValueBase64 []byte          `json:"valueBase64,omitempty"`
+}
+
+func newDatastoreDumpRecord(key, value []byte) *DatastoreDumpRecord {
+
+	// Copy keys and values, which are only valid during the transaction.
+
+	record := &DatastoreDumpRecord{}
+
+	if utf8.Valid(key) {
+		record.Key = string(key)
+	} else {
+		record.KeyBase64 = append([]byte(nil), key...)
+	}
+
+	trimmedValue := bytes.TrimSpace(value)
+	if len(trimmedValue) > 0 &&
+		(trimmedValue[0] == '{' || trimmedValue[0] == '[') &&
+		json.Valid(trimmedValue) {
+
+		record.Value = append(json.RawMessage(nil), trimmedValue...)
+
+	} else if utf8.Valid(value) {
+		record.ValueString = string(value)
+	} else {
+		record.ValueBase64 = append([]byte(nil), value...)
+	}
+
+	return record
+}
+
+// GetKey returns the record's key.
+func (record *DatastoreDumpRecord) GetKey() []byte {
+	if record.KeyBase64 != nil {
+		return record.KeyBase64
+	}
+	return []byte(record.Key)
+}
+
+// GetValue returns the record's value.
+func (record *DatastoreDumpRecord) GetValue() []byte {
+	if record.Value != nil {
+		return record.Value
+	}
+	if record.ValueBase64 != nil {
+		return record.ValueBase64
+	}
+	return []byte(record.ValueString)
+}
+
+// GetDatastoreBucketNames returns the names of all datastore buckets.
+func GetDatastoreBucketNames() []string {
+	names := make([]string, len(datastoreBuckets))
+	for i, bucket := range datastoreBuckets {
+		names[i] = string(bucket)
+	}
+	return names
+}
+
+// DumpDataStore returns a copy of all records in the specified buckets. When
+// bucketNames is empty, all buckets are dumped. The datastore must be open.
+func DumpDataStore(bucketNames []string) (*DatastoreDump, error) {
+
+	allBucketNames := GetDatastoreBucketNames()
+
+	if len(bucketNames) == 0 {
+		bucketNames = allBucketNames
+	}
+
+	for _, bucketName := range bucketNames {
+		if !common.Contains(allBucketNames, bucketName) {
+			return nil, errors.Tracef("unknown bucket: %s", bucketName)
+		}
+	}
+
+	dump := &DatastoreDump{
+		Buckets: make(map[string][]*DatastoreDumpRecord),
+	}
+
+	err := datastoreView(func(tx DatastoreTx) error {
+
+		for _, bucketName := range bucketNames {
+
+			records := make([]*DatastoreDumpRecord, 0)
+
+			cursor := tx.Bucket([]byte(bucketName)).Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+				records = append(records, newDatastoreDumpRecord(key, value))
+			}
+			cursor.Close()
+
+			dump.Buckets[bucketName] = records
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return dump, nil
+}
+
+// ImportDataStoreServerEntries stores the server entries in the dump
+// serverEntries bucket, as with StoreServerEntry. Other buckets in the dump
+// are ignored. The return value is the number of server entries imported.
+//
+// Server entry local source and timestamp fields, if present in the dump,
+// are retained.
+func ImportDataStoreServerEntries(
+	dump *DatastoreDump, replaceIfExists bool) (int, error) {
+
+	records := dump.Buckets[string(datastoreServerEntriesBucket)]
+
+	count := 0
+	for _, record := range records {
+
+		var serverEntryFields protocol.ServerEntryFields
+		err := json.Unmarshal(record.GetValue(), &serverEntryFields)
+		if err != nil {
+			return count, errors.Trace(err)
+		}
+
+		err = StoreServerEntry(serverEntryFields, replaceIfExists)
+		if err != nil {
+			return count, errors.Trace(err)
+		}
+
+		count += 1
+	}
+
+	return count, nil
+}
+
+// ServerEntryFilter selects server entries. A server entry matches when it
+// matches all of the non-empty filter lists, and matches a list when it
+// matches any item in the list.
+type ServerEntryFilter struct {
+
+	// Regions is a list of server entry regions.
+	Regions []string
+
+	// TunnelProtocols is a list of tunnel protocols, any of which must be
+	// supported by the server entry.
+	TunnelProtocols []string
+
+	// LocalSources is a list of server entry sources, such as "EMBEDDED" or
+	// "REMOTE".
+	LocalSources []string
+}
+
+// IsEmpty returns true when the filter has no criteria, and so matches all
+// server entries.
+func (filter *ServerEntryFilter) IsEmpty() bool {
+	return len(filter.Regions) == 0 &&
+		len(filter.TunnelProtocols) == 0 &&
+		len(filter.LocalSources) == 0
+}
+
+// Matches returns true when the server entry is selected by the filter.
+func (filter *ServerEntryFilter) Matches(serverEntry *protocol.ServerEntry) bool {
+
+	if len(filter.Regions) > 0 &&
+		!common.Contains(filter.Regions, serverEntry.Region) {
+		return false
+	}
+
+	if len(filter.LocalSources) > 0 &&
+		!common.Contains(filter.LocalSources, serverEntry.LocalSource) {
+		return false
+	}
+
+	if len(filter.TunnelProtocols) > 0 {
+		supported := false
+		for _, tunnelProtocol := range filter.TunnelProtocols {
+			if serverEntry.SupportsProtocol(tunnelProtocol) {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DeleteServerEntries deletes all server entries matching the filter, along
+// with associated tag, affinity, and dial parameters records. The return
+// value is the number of server entries deleted.
+//
+// Unlike PruneServerEntry, DeleteServerEntries is not subject to an age
+// check and sets no tombstones, so deleted server entries may be
+// reimported.
+func DeleteServerEntries(filter *ServerEntryFilter) (int, error) {
+
+	count := 0
+
+	err := datastoreUpdate(func(tx DatastoreTx) error {
+
+		serverEntries := tx.Bucket(datastoreServerEntriesBucket)
+		serverEntryTags := tx.Bucket(datastoreServerEntryTagsBucket)
+
+		// Collect matching server entries before deleting, as not all
+		// backend cursors support deletes during iteration.
+
+		var serverEntryIDs [][]byte
+		var serverEntryTagList []string
+
+		cursor := serverEntries.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			var serverEntry *protocol.ServerEntry
+			err := json.Unmarshal(value, &serverEntry)
+			if err != nil {
+				NoticeWarning("DeleteServerEntries: %s", errors.Trace(err))
+				continue
+			}
+			if filter.Matches(serverEntry) {
+				serverEntryIDs = append(serverEntryIDs, append([]byte(nil), key...))
+				serverEntryTagList = append(serverEntryTagList, serverEntry.Tag)
+			}
+		}
+		cursor.Close()
+
+		for i, serverEntryID := range serverEntryIDs {
+
+			err := deleteServerEntryRecord(tx, serverEntryID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			serverEntryTagBytes := []byte(serverEntryTagList[i])
+			if bytes.Equal(serverEntryTags.Get(serverEntryTagBytes), serverEntryID) {
+				err = serverEntryTags.Delete(serverEntryTagBytes)
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+
+		count = len(serverEntryIDs)
+
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestDataStoreExport(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-export-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	config := &Config{
+		SponsorId:            "0",
+		PropagationChannelId: "0",
+		DataRootDirectory:    testDataDirName,
+		DatastoreBackend:     NewMemoryDatastoreBackend(),
+	}
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	// Populate the datastore with server entries from two regions and two
+	// sources, a dial parameters record, and a binary SLOK.
+
+	regions := []string{"US", "CA"}
+	sources := []string{protocol.SERVER_ENTRY_SOURCE_EMBEDDED, protocol.SERVER_ENTRY_SOURCE_REMOTE}
+	serverEntryCount := 8
+
+	for i := 0; i < serverEntryCount; i++ {
+		fields := make(protocol.ServerEntryFields)
+		fields["ipAddress"] = fmt.Sprintf("192.168.0.%d", i)
+		fields["sshPort"] = 22
+		fields["sshUsername"] = prng.HexString(16)
+		fields["sshPassword"] = prng.HexString(16)
+		fields["sshHostKey"] = prng.HexString(16)
+		fields["capabilities"] = []string{"SSH", "ssh-api-requests"}
+		fields["region"] = regions[i%2]
+		fields["configurationVersion"] = 1
+		fields.SetLocalSource(sources[(i/2)%2])
+		fields.SetLocalTimestamp(
+			common.TruncateTimestampToHour(common.GetCurrentTimestamp()))
+
+		err = StoreServerEntry(fields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	err = SetDialParameters("192.168.0.1", "networkID", &DialParameters{})
+	if err != nil {
+		t.Fatalf("SetDialParameters failed: %s", err)
+	}
+
+	slokID := []byte{0xff, 0x00, 0xfe}
+	slokKey := []byte{0x01, 0x80, 0x02}
+	_, err = SetSLOK(slokID, slokKey)
+	if err != nil {
+		t.Fatalf("SetSLOK failed: %s", err)
+	}
+
+	// Test: dump all buckets
+
+	dump, err := DumpDataStore(nil)
+	if err != nil {
+		t.Fatalf("DumpDataStore failed: %s", err)
+	}
+
+	if len(dump.Buckets) != len(datastoreBuckets) {
+		t.Fatalf("unexpected bucket count: %d", len(dump.Buckets))
+	}
+
+	serverEntryRecords := dump.Buckets[string(datastoreServerEntriesBucket)]
+	if len(serverEntryRecords) != serverEntryCount {
+		t.Fatalf("unexpected server entry record count: %d", len(serverEntryRecords))
+	}
+	for _, record := range serverEntryRecords {
+		if record.Value == nil {
+			t.Fatalf("unexpected non-JSON server entry record")
+		}
+	}
+
+	if len(dump.Buckets[string(datastoreDialParametersBucket)]) != 1 {
+		t.Fatalf("unexpected dial parameters record count")
+	}
+
+	slokRecords := dump.Buckets[string(datastoreSLOKsBucket)]
+	if len(slokRecords) != 1 ||
+		!bytes.Equal(slokRecords[0].GetKey(), slokID) ||
+		!bytes.Equal(slokRecords[0].GetValue(), slokKey) {
+		t.Fatalf("unexpected SLOK records")
+	}
+
+	// Test: dump round trips through JSON
+
+	dumpJSON, err := json.Marshal(dump)
+	if err != nil {
+		t.Fatalf("Marshal failed: %s", err)
+	}
+
+	var unmarshaledDump *DatastoreDump
+	err = json.Unmarshal(dumpJSON, &unmarshaledDump)
+	if err != nil {
+		t.Fatalf("Unmarshal failed: %s", err)
+	}
+
+	slokRecords = unmarshaledDump.Buckets[string(datastoreSLOKsBucket)]
+	if len(slokRecords) != 1 ||
+		!bytes.Equal(slokRecords[0].GetKey(), slokID) ||
+		!bytes.Equal(slokRecords[0].GetValue(), slokKey) {
+		t.Fatalf("unexpected unmarshaled SLOK records")
+	}
+
+	// Test: dump selected buckets
+
+	partialDump, err := DumpDataStore([]string{string(datastoreSLOKsBucket)})
+	if err != nil {
+		t.Fatalf("DumpDataStore failed: %s", err)
+	}
+	if len(partialDump.Buckets) != 1 {
+		t.Fatalf("unexpected bucket count: %d", len(partialDump.Buckets))
+	}
+
+	_, err = DumpDataStore([]string{"unknown"})
+	if err == nil {
+		t.Fatalf("unexpected DumpDataStore success")
+	}
+
+	// Test: delete by region and source
+
+	count, err := DeleteServerEntries(&ServerEntryFilter{
+		Regions:      []string{"CA"},
+		LocalSources: []string{protocol.SERVER_ENTRY_SOURCE_EMBEDDED},
+	})
+	if err != nil {
+		t.Fatalf("DeleteServerEntries failed: %s", err)
+	}
+	if count != serverEntryCount/4 || CountServerEntries() != serverEntryCount-count {
+		t.Fatalf("unexpected delete count: %d", count)
+	}
+
+	// The dial parameters for the deleted 192.168.0.1 are also deleted.
+
+	dialParams, err := GetDialParameters("192.168.0.1", "networkID")
+	if err != nil || dialParams != nil {
+		t.Fatalf("unexpected dial parameters after delete")
+	}
+
+	// Test: delete by protocol
+
+	count, err = DeleteServerEntries(&ServerEntryFilter{
+		TunnelProtocols: []string{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+	})
+	if err != nil {
+		t.Fatalf("DeleteServerEntries failed: %s", err)
+	}
+	if count != 0 {
+		t.Fatalf("unexpected delete count: %d", count)
+	}
+
+	count, err = DeleteServerEntries(&ServerEntryFilter{
+		TunnelProtocols: []string{protocol.TUNNEL_PROTOCOL_SSH},
+	})
+	if err != nil {
+		t.Fatalf("DeleteServerEntries failed: %s", err)
+	}
+	if count != serverEntryCount-serverEntryCount/4 || CountServerEntries() != 0 {
+		t.Fatalf("unexpected delete count: %d", count)
+	}
+
+	// Test: import from dump restores all deleted server entries, including
+	// pruned embedded server entries
+
+	count, err = ImportDataStoreServerEntries(unmarshaledDump, false)
+	if err != nil {
+		t.Fatalf("ImportDataStoreServerEntries failed: %s", err)
+	}
+	if count != serverEntryCount || CountServerEntries() != serverEntryCount {
+		t.Fatalf("unexpected import count: %d", count)
+	}
+}
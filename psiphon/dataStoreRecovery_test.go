@@ -22,6 +22,7 @@
 package psiphon
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
@@ -31,6 +32,7 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/Psiphon-Labs/bolt"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
@@ -291,3 +293,127 @@ func TestBoltResiliency(t *testing.T) {
 
 	CloseDataStore()
 }
+
+func TestOpenDataStoreWithoutReset(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datastore-without-reset-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	config, err := LoadConfig([]byte(fmt.Sprintf(`
+    {
+        "DataRootDirectory" : "%s",
+        "ClientPlatform" : "",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0"
+    }`, testDataDirName)))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	filename := filepath.Join(config.GetDataStoreDirectory(), "psiphon.boltdb")
+
+	// Test: read-only open fails, and doesn't create the datastore file, when
+	// there is no datastore.
+
+	err = OpenDataStoreWithoutReset(config, true)
+	if err == nil {
+		CloseDataStore()
+		t.Fatalf("unexpected read-only open of missing datastore")
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("unexpected datastore file: %v", err)
+	}
+
+	err = OpenDataStoreWithoutReset(config, false)
+	if err != nil {
+		t.Fatalf("OpenDataStoreWithoutReset failed: %s", err)
+	}
+	err = SetKeyValue("key", "value")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+	CloseDataStore()
+
+	checkValue := func() {
+		err := OpenDataStoreWithoutReset(config, true)
+		if err != nil {
+			t.Fatalf("OpenDataStoreWithoutReset failed: %s", err)
+		}
+		defer CloseDataStore()
+		value, err := GetKeyValue("key")
+		if err != nil || value != "value" {
+			t.Fatalf("unexpected value: %s, %v", value, err)
+		}
+	}
+
+	// Test: opening a locked datastore fails without resetting it.
+
+	lockDB, err := bolt.Open(filename, 0600, nil)
+	if err != nil {
+		t.Fatalf("bolt.Open failed: %s", err)
+	}
+
+	for _, readOnly := range []bool{false, true} {
+		err = OpenDataStoreWithoutReset(config, readOnly)
+		if err == nil {
+			CloseDataStore()
+			t.Fatalf("unexpected open of locked datastore")
+		}
+	}
+
+	lockDB.Close()
+
+	checkValue()
+
+	// Test: read-only mode doesn't modify the datastore.
+
+	err = OpenDataStoreWithoutReset(config, true)
+	if err != nil {
+		t.Fatalf("OpenDataStoreWithoutReset failed: %s", err)
+	}
+	err = SetKeyValue("key", "modified")
+	if err == nil {
+		t.Fatalf("unexpected read-only update")
+	}
+	_, err = DumpDataStore(nil)
+	if err != nil {
+		t.Fatalf("DumpDataStore failed: %s", err)
+	}
+	CloseDataStore()
+
+	checkValue()
+
+	// Test: opening a corrupt datastore fails without resetting it.
+
+	corrupt := bytes.Repeat([]byte{0xff}, 65536)
+	err = ioutil.WriteFile(filename, corrupt, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	for _, readOnly := range []bool{false, true} {
+		err = OpenDataStoreWithoutReset(config, readOnly)
+		if err == nil {
+			CloseDataStore()
+			t.Fatalf("unexpected open of corrupt datastore")
+		}
+	}
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %s", err)
+	}
+	if !bytes.Equal(contents, corrupt) {
+		t.Fatalf("unexpected datastore reset")
+	}
+}
@@ -52,13 +52,16 @@ type datastoreCursor struct {
 	prefix         []byte
 }
 
-func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
+func datastoreOpenDB(
+	rootDataDirectory string, _, readOnly bool) (*datastoreDB, error) {
 
 	dbDirectory := filepath.Join(rootDataDirectory, "psiphon.badgerdb")
 
-	err := os.MkdirAll(dbDirectory, 0700)
-	if err != nil {
-		return nil, errors.Trace(err)
+	if !readOnly {
+		err := os.MkdirAll(dbDirectory, 0700)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 	}
 
 	opts := badger.DefaultOptions
@@ -74,26 +77,29 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 	opts.NumLevelZeroTables = 1
 	opts.NumLevelZeroTablesStall = 2
 	opts.NumCompactors = 1
+	opts.ReadOnly = readOnly
 
 	db, err := badger.Open(opts)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	for {
-		if db.RunValueLogGC(0.5) != nil {
-			break
+	if !readOnly {
+		for {
+			if db.RunValueLogGC(0.5) != nil {
+				break
+			}
 		}
 	}
 
 	return &datastoreDB{badgerDB: db}, nil
 }
 
-func (db *datastoreDB) close() error {
+func (db *datastoreDB) Close() error {
 	return db.badgerDB.Close()
 }
 
-func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
+func (db *datastoreDB) View(fn func(tx DatastoreTx) error) error {
 	return db.badgerDB.View(
 		func(tx *badger.Txn) error {
 			err := fn(&datastoreTx{badgerTx: tx})
@@ -104,7 +110,7 @@ func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
 		})
 }
 
-func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
+func (db *datastoreDB) Update(fn func(tx DatastoreTx) error) error {
 	return db.badgerDB.Update(
 		func(tx *badger.Txn) error {
 			err := fn(&datastoreTx{badgerTx: tx})
@@ -115,17 +121,17 @@ func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
 		})
 }
 
-func (tx *datastoreTx) bucket(name []byte) *datastoreBucket {
+func (tx *datastoreTx) Bucket(name []byte) DatastoreBucket {
 	return &datastoreBucket{
 		name: name,
 		tx:   tx,
 	}
 }
 
-func (tx *datastoreTx) clearBucket(name []byte) error {
-	b := tx.bucket(name)
-	c := b.cursor()
-	for key := c.firstKey(); key != nil; key = c.nextKey() {
+func (tx *datastoreTx) ClearBucket(name []byte) error {
+	b := tx.Bucket(name)
+	c := b.Cursor()
+	for key := c.FirstKey(); key != nil; key = c.NextKey() {
 		err := tx.badgerTx.Delete(key)
 		if err != nil {
 			return errors.Trace(err)
@@ -134,7 +140,7 @@ func (tx *datastoreTx) clearBucket(name []byte) error {
 	return nil
 }
 
-func (b *datastoreBucket) get(key []byte) []byte {
+func (b *datastoreBucket) Get(key []byte) []byte {
 	keyWithPrefix := append(b.name, key...)
 	item, err := b.tx.badgerTx.Get(keyWithPrefix)
 	if err != nil {
@@ -155,7 +161,7 @@ func (b *datastoreBucket) get(key []byte) []byte {
 	return value
 }
 
-func (b *datastoreBucket) put(key, value []byte) error {
+func (b *datastoreBucket) Put(key, value []byte) error {
 	keyWithPrefix := append(b.name, key...)
 	err := b.tx.badgerTx.Set(keyWithPrefix, value)
 	if err != nil {
@@ -164,7 +170,7 @@ func (b *datastoreBucket) put(key, value []byte) error {
 	return nil
 }
 
-func (b *datastoreBucket) delete(key []byte) error {
+func (b *datastoreBucket) Delete(key []byte) error {
 	keyWithPrefix := append(b.name, key...)
 	err := b.tx.badgerTx.Delete(keyWithPrefix)
 	if err != nil {
@@ -173,14 +179,14 @@ func (b *datastoreBucket) delete(key []byte) error {
 	return nil
 }
 
-func (b *datastoreBucket) cursor() *datastoreCursor {
+func (b *datastoreBucket) Cursor() DatastoreCursor {
 	opts := badger.DefaultIteratorOptions
 	opts.PrefetchValues = false
 	iterator := b.tx.badgerTx.NewIterator(opts)
 	return &datastoreCursor{badgerIterator: iterator, prefix: b.name}
 }
 
-func (c *datastoreCursor) firstKey() []byte {
+func (c *datastoreCursor) FirstKey() []byte {
 	c.badgerIterator.Seek(c.prefix)
 	return c.currentKey()
 }
@@ -193,12 +199,12 @@ func (c *datastoreCursor) currentKey() []byte {
 	return item.Key()[len(c.prefix):]
 }
 
-func (c *datastoreCursor) nextKey() []byte {
+func (c *datastoreCursor) NextKey() []byte {
 	c.badgerIterator.Next()
 	return c.currentKey()
 }
 
-func (c *datastoreCursor) first() ([]byte, []byte) {
+func (c *datastoreCursor) First() ([]byte, []byte) {
 	c.badgerIterator.Seek(c.prefix)
 	return c.current()
 }
@@ -215,11 +221,11 @@ func (c *datastoreCursor) current() ([]byte, []byte) {
 	return item.Key()[len(c.prefix):], value
 }
 
-func (c *datastoreCursor) next() ([]byte, []byte) {
+func (c *datastoreCursor) Next() ([]byte, []byte) {
 	c.badgerIterator.Next()
 	return c.current()
 }
 
-func (c *datastoreCursor) close() {
+func (c *datastoreCursor) Close() {
 	c.badgerIterator.Close()
 }
@@ -53,14 +53,19 @@ type datastoreCursor struct {
 	boltCursor *bolt.Cursor
 }
 
-func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
+func datastoreOpenDB(
+	rootDataDirectory string, retryWithReset, readOnly bool) (*datastoreDB, error) {
+
+	if !retryWithReset || readOnly {
+		return tryDatastoreOpenDB(rootDataDirectory, false, readOnly)
+	}
 
 	var db *datastoreDB
 	var err error
 
 	for retry := 0; retry < 3; retry++ {
 
-		db, err = tryDatastoreOpenDB(rootDataDirectory, retry > 0)
+		db, err = tryDatastoreOpenDB(rootDataDirectory, retry > 0, false)
 		if err == nil {
 			break
 		}
@@ -74,7 +79,8 @@ func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
 	return db, err
 }
 
-func tryDatastoreOpenDB(rootDataDirectory string, reset bool) (retdb *datastoreDB, reterr error) {
+func tryDatastoreOpenDB(
+	rootDataDirectory string, reset, readOnly bool) (retdb *datastoreDB, reterr error) {
 
 	// Testing indicates that the bolt Check function can raise SIGSEGV due to
 	// invalid mmap buffer accesses in cases such as opening a valid but
@@ -103,7 +109,21 @@ func tryDatastoreOpenDB(rootDataDirectory string, reset bool) (retdb *datastoreD
 		os.Remove(filename)
 	}
 
-	newDB, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	// In read-only mode, bolt takes a shared lock, so the open will still time
+	// out when a client has the datastore open. bolt.Open creates any missing
+	// datastore file, even in read-only mode, so check for it first.
+
+	if readOnly {
+		_, err := os.Stat(filename)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	newDB, err := bolt.Open(
+		filename,
+		0600,
+		&bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -115,26 +135,33 @@ func tryDatastoreOpenDB(rootDataDirectory string, reset bool) (retdb *datastoreD
 		return tx.SynchronousCheck()
 	})
 	if err != nil {
+		newDB.Close()
 		return nil, errors.Trace(err)
 	}
 
-	err = newDB.Update(func(tx *bolt.Tx) error {
-		requiredBuckets := [][]byte{
-			datastoreServerEntriesBucket,
-			datastoreServerEntryTagsBucket,
-			datastoreServerEntryTombstoneTagsBucket,
-			datastoreSplitTunnelRouteETagsBucket,
-			datastoreSplitTunnelRouteDataBucket,
-			datastoreUrlETagsBucket,
-			datastoreKeyValueBucket,
-			datastoreRemoteServerListStatsBucket,
-			datastoreFailedTunnelStatsBucket,
-			datastoreSLOKsBucket,
-			datastoreTacticsBucket,
-			datastoreSpeedTestSamplesBucket,
-			datastoreDialParametersBucket,
+	if readOnly {
+
+		// Buckets can't be created in read-only mode, and datastoreBucket
+		// assumes that every bucket exists.
+
+		err = newDB.View(func(tx *bolt.Tx) error {
+			for _, bucket := range datastoreBuckets {
+				if tx.Bucket(bucket) == nil {
+					return errors.Tracef("missing bucket: %s", bucket)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			newDB.Close()
+			return nil, errors.Trace(err)
 		}
-		for _, bucket := range requiredBuckets {
+
+		return &datastoreDB{boltDB: newDB}, nil
+	}
+
+	err = newDB.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range datastoreBuckets {
 			_, err := tx.CreateBucketIfNotExists(bucket)
 			if err != nil {
 				return err
@@ -182,7 +209,7 @@ func (db *datastoreDB) setDatastoreFailed(r interface{}) {
 	NoticeWarning("Datastore failed: %s", errors.Tracef("panic: %v", r))
 }
 
-func (db *datastoreDB) close() error {
+func (db *datastoreDB) Close() error {
 
 	// Limitation: there is no panic recover in this case. We assume boltDB.Close
 	// does not make  mmap accesses and prefer to not continue with the datastore
@@ -193,7 +220,7 @@ func (db *datastoreDB) close() error {
 	return db.boltDB.Close()
 }
 
-func (db *datastoreDB) view(fn func(tx *datastoreTx) error) (reterr error) {
+func (db *datastoreDB) View(fn func(tx DatastoreTx) error) (reterr error) {
 
 	// Any bolt function that performs mmap buffer accesses can raise SIGBUS  due
 	// to underlying storage changes, such as a truncation of the datastore file
@@ -229,7 +256,7 @@ func (db *datastoreDB) view(fn func(tx *datastoreTx) error) (reterr error) {
 		})
 }
 
-func (db *datastoreDB) update(fn func(tx *datastoreTx) error) (reterr error) {
+func (db *datastoreDB) Update(fn func(tx DatastoreTx) error) (reterr error) {
 
 	// Begin recovery preamble
 	if db.isDatastoreFailed() {
@@ -255,7 +282,7 @@ func (db *datastoreDB) update(fn func(tx *datastoreTx) error) (reterr error) {
 		})
 }
 
-func (tx *datastoreTx) bucket(name []byte) (retbucket *datastoreBucket) {
+func (tx *datastoreTx) Bucket(name []byte) (retbucket DatastoreBucket) {
 
 	// Begin recovery preamble
 	if tx.db.isDatastoreFailed() {
@@ -274,7 +301,7 @@ func (tx *datastoreTx) bucket(name []byte) (retbucket *datastoreBucket) {
 	return &datastoreBucket{db: tx.db, boltBucket: tx.boltTx.Bucket(name)}
 }
 
-func (tx *datastoreTx) clearBucket(name []byte) (reterr error) {
+func (tx *datastoreTx) ClearBucket(name []byte) (reterr error) {
 
 	// Begin recovery preamble
 	if tx.db.isDatastoreFailed() {
@@ -301,7 +328,7 @@ func (tx *datastoreTx) clearBucket(name []byte) (reterr error) {
 	return nil
 }
 
-func (b *datastoreBucket) get(key []byte) (retvalue []byte) {
+func (b *datastoreBucket) Get(key []byte) (retvalue []byte) {
 
 	// Begin recovery preamble
 	if b.db.isDatastoreFailed() {
@@ -320,7 +347,7 @@ func (b *datastoreBucket) get(key []byte) (retvalue []byte) {
 	return b.boltBucket.Get(key)
 }
 
-func (b *datastoreBucket) put(key, value []byte) (reterr error) {
+func (b *datastoreBucket) Put(key, value []byte) (reterr error) {
 
 	// Begin recovery preamble
 	if b.db.isDatastoreFailed() {
@@ -343,7 +370,7 @@ func (b *datastoreBucket) put(key, value []byte) (reterr error) {
 	return nil
 }
 
-func (b *datastoreBucket) delete(key []byte) (reterr error) {
+func (b *datastoreBucket) Delete(key []byte) (reterr error) {
 
 	// Begin recovery preamble
 	if b.db.isDatastoreFailed() {
@@ -366,26 +393,26 @@ func (b *datastoreBucket) delete(key []byte) (reterr error) {
 	return nil
 }
 
-func (b *datastoreBucket) cursor() (retcursor datastoreCursor) {
+func (b *datastoreBucket) Cursor() (retcursor DatastoreCursor) {
 
 	// Begin recovery preamble
 	if b.db.isDatastoreFailed() {
-		return datastoreCursor{db: b.db, boltCursor: nil}
+		return &datastoreCursor{db: b.db, boltCursor: nil}
 	}
 	panicOnFault := debug.SetPanicOnFault(true)
 	defer debug.SetPanicOnFault(panicOnFault)
 	defer func() {
 		if r := recover(); r != nil {
 			b.db.setDatastoreFailed(r)
-			retcursor = datastoreCursor{db: b.db, boltCursor: nil}
+			retcursor = &datastoreCursor{db: b.db, boltCursor: nil}
 		}
 	}()
 	// End recovery preamble
 
-	return datastoreCursor{db: b.db, boltCursor: b.boltBucket.Cursor()}
+	return &datastoreCursor{db: b.db, boltCursor: b.boltBucket.Cursor()}
 }
 
-func (c *datastoreCursor) firstKey() (retkey []byte) {
+func (c *datastoreCursor) FirstKey() (retkey []byte) {
 
 	// Begin recovery preamble
 	if c.db.isDatastoreFailed() {
@@ -405,7 +432,7 @@ func (c *datastoreCursor) firstKey() (retkey []byte) {
 	return key
 }
 
-func (c *datastoreCursor) nextKey() (retkey []byte) {
+func (c *datastoreCursor) NextKey() (retkey []byte) {
 
 	// Begin recovery preamble
 	if c.db.isDatastoreFailed() {
@@ -425,7 +452,7 @@ func (c *datastoreCursor) nextKey() (retkey []byte) {
 	return key
 }
 
-func (c *datastoreCursor) first() (retkey, retvalue []byte) {
+func (c *datastoreCursor) First() (retkey, retvalue []byte) {
 
 	// Begin recovery preamble
 	if c.db.isDatastoreFailed() {
@@ -445,7 +472,7 @@ func (c *datastoreCursor) first() (retkey, retvalue []byte) {
 	return c.boltCursor.First()
 }
 
-func (c *datastoreCursor) next() (retkey, retvalue []byte) {
+func (c *datastoreCursor) Next() (retkey, retvalue []byte) {
 
 	// Begin recovery preamble
 	if c.db.isDatastoreFailed() {
@@ -465,6 +492,6 @@ func (c *datastoreCursor) next() (retkey, retvalue []byte) {
 	return c.boltCursor.Next()
 }
 
-func (c *datastoreCursor) close() {
+func (c *datastoreCursor) Close() {
 	// BoltDB doesn't close cursors.
 }
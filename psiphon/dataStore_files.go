@@ -75,7 +75,14 @@ type datastoreCursor struct {
 	lastBuffer *bytes.Buffer
 }
 
-func datastoreOpenDB(rootDataDirectory string) (*datastoreDB, error) {
+func datastoreOpenDB(
+	rootDataDirectory string, _, readOnly bool) (*datastoreDB, error) {
+
+	// Reads may complete partial put commits and create bucket directories, so
+	// read-only mode is not supported.
+	if readOnly {
+		return nil, errors.TraceNew("read-only mode not supported")
+	}
 
 	dataDirectory := filepath.Join(rootDataDirectory, "psiphon.filesdb")
 	err := os.MkdirAll(dataDirectory, 0700)
@@ -124,7 +131,7 @@ func (db *datastoreDB) readBuffer(filename string) (*bytes.Buffer, error) {
 	return buffer, nil
 }
 
-func (db *datastoreDB) close() error {
+func (db *datastoreDB) Close() error {
 	// close will await any active view and update transactions via this lock.
 	db.lock.Lock()
 	defer db.lock.Unlock()
@@ -132,7 +139,7 @@ func (db *datastoreDB) close() error {
 	return nil
 }
 
-func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
+func (db *datastoreDB) View(fn func(tx DatastoreTx) error) error {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 	if db.closed {
@@ -147,7 +154,7 @@ func (db *datastoreDB) view(fn func(tx *datastoreTx) error) error {
 	return nil
 }
 
-func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
+func (db *datastoreDB) Update(fn func(tx DatastoreTx) error) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 	if db.closed {
@@ -162,7 +169,7 @@ func (db *datastoreDB) update(fn func(tx *datastoreTx) error) error {
 	return nil
 }
 
-func (tx *datastoreTx) bucket(name []byte) *datastoreBucket {
+func (tx *datastoreTx) Bucket(name []byte) DatastoreBucket {
 	bucketDirectory := filepath.Join(tx.db.dataDirectory, hex.EncodeToString(name))
 	err := os.MkdirAll(bucketDirectory, 0700)
 	if err != nil {
@@ -178,7 +185,7 @@ func (tx *datastoreTx) bucket(name []byte) *datastoreBucket {
 	}
 }
 
-func (tx *datastoreTx) clearBucket(name []byte) error {
+func (tx *datastoreTx) ClearBucket(name []byte) error {
 	bucketDirectory := filepath.Join(tx.db.dataDirectory, hex.EncodeToString(name))
 	err := os.RemoveAll(bucketDirectory)
 	if err != nil {
@@ -194,7 +201,7 @@ func (tx *datastoreTx) releaseBuffers() {
 	tx.buffers = nil
 }
 
-func (b *datastoreBucket) get(key []byte) []byte {
+func (b *datastoreBucket) Get(key []byte) []byte {
 	if b.tx == nil {
 		return nil
 	}
@@ -213,7 +220,7 @@ func (b *datastoreBucket) get(key []byte) []byte {
 	return valueBuffer.Bytes()
 }
 
-func (b *datastoreBucket) put(key, value []byte) error {
+func (b *datastoreBucket) Put(key, value []byte) error {
 	if b.tx == nil {
 		return errors.TraceNew("bucket not found")
 	}
@@ -262,7 +269,7 @@ func datastoreApplyCommit(filename string) error {
 	return nil
 }
 
-func (b *datastoreBucket) delete(key []byte) error {
+func (b *datastoreBucket) Delete(key []byte) error {
 	if b.tx == nil {
 		return errors.TraceNew("bucket not found")
 	}
@@ -277,7 +284,7 @@ func (b *datastoreBucket) delete(key []byte) error {
 	return nil
 }
 
-func (b *datastoreBucket) cursor() *datastoreCursor {
+func (b *datastoreBucket) Cursor() DatastoreCursor {
 	if b.tx == nil {
 		// The original datastore interface does not return an error from
 		// Cursor, so emit notice, and return zero-value cursor for which all
@@ -311,7 +318,7 @@ func (c *datastoreCursor) advance() {
 	}
 }
 
-func (c *datastoreCursor) firstKey() []byte {
+func (c *datastoreCursor) FirstKey() []byte {
 	if c.bucket == nil {
 		return nil
 	}
@@ -339,7 +346,7 @@ func (c *datastoreCursor) currentKey() []byte {
 	return key
 }
 
-func (c *datastoreCursor) nextKey() []byte {
+func (c *datastoreCursor) NextKey() []byte {
 	if c.bucket == nil {
 		return nil
 	}
@@ -347,7 +354,7 @@ func (c *datastoreCursor) nextKey() []byte {
 	return c.currentKey()
 }
 
-func (c *datastoreCursor) first() ([]byte, []byte) {
+func (c *datastoreCursor) First() ([]byte, []byte) {
 	if c.bucket == nil {
 		return nil, nil
 	}
@@ -379,7 +386,7 @@ func (c *datastoreCursor) current() ([]byte, []byte) {
 	return key, valueBuffer.Bytes()
 }
 
-func (c *datastoreCursor) next() ([]byte, []byte) {
+func (c *datastoreCursor) Next() ([]byte, []byte) {
 	if c.bucket == nil {
 		return nil, nil
 	}
@@ -387,7 +394,7 @@ func (c *datastoreCursor) next() ([]byte, []byte) {
 	return c.current()
 }
 
-func (c *datastoreCursor) close() {
+func (c *datastoreCursor) Close() {
 	if c.lastBuffer != nil {
 		c.bucket.tx.db.putBuffer(c.lastBuffer)
 		c.lastBuffer = nil
@@ -0,0 +1,276 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+// memoryDatastore is a DatastoreBackend which keeps all data in memory and
+// persists nothing. It's intended for short-lived processes and tests, which
+// don't require data to survive a process restart.
+//
+// Update transactions are serialized and are atomic: changes are recorded
+// per key in the transaction, and are applied to the stored buckets only when
+// the transaction function returns without error. Recording changes per key,
+// rather than copying each modified bucket, keeps the cost of small updates
+// independent of the bucket size.
+//
+// Close doesn't discard data, so the same memoryDatastore may be reopened via
+// OpenDataStore within a process.
+type memoryDatastore struct {
+	mutex   sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+type memoryDatastoreTx struct {
+	db        *memoryDatastore
+	canUpdate bool
+	changes   map[string]*memoryDatastoreBucketChanges
+}
+
+// memoryDatastoreBucketChanges records the changes made to a bucket in an
+// update transaction. When cleared is set, all stored keys are deleted before
+// writes are applied.
+type memoryDatastoreBucketChanges struct {
+	cleared bool
+	writes  map[string]memoryDatastoreWrite
+}
+
+type memoryDatastoreWrite struct {
+	value   []byte
+	deleted bool
+}
+
+type memoryDatastoreBucket struct {
+	tx   *memoryDatastoreTx
+	name string
+}
+
+type memoryDatastoreCursor struct {
+	bucket *memoryDatastoreBucket
+	keys   []string
+	index  int
+}
+
+// NewMemoryDatastoreBackend creates a new, empty in-memory DatastoreBackend.
+func NewMemoryDatastoreBackend() DatastoreBackend {
+	return &memoryDatastore{
+		buckets: make(map[string]map[string][]byte),
+	}
+}
+
+func (db *memoryDatastore) Close() error {
+	return nil
+}
+
+func (db *memoryDatastore) View(fn func(tx DatastoreTx) error) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	err := fn(&memoryDatastoreTx{db: db})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (db *memoryDatastore) Update(fn func(tx DatastoreTx) error) error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	tx := &memoryDatastoreTx{
+		db:        db,
+		canUpdate: true,
+		changes:   make(map[string]*memoryDatastoreBucketChanges),
+	}
+	err := fn(tx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for name, changes := range tx.changes {
+		bucket := db.buckets[name]
+		if bucket == nil || changes.cleared {
+			bucket = make(map[string][]byte)
+			db.buckets[name] = bucket
+		}
+		for key, write := range changes.writes {
+			if write.deleted {
+				delete(bucket, key)
+			} else {
+				bucket[key] = write.value
+			}
+		}
+	}
+	return nil
+}
+
+func (tx *memoryDatastoreTx) Bucket(name []byte) DatastoreBucket {
+	return &memoryDatastoreBucket{tx: tx, name: string(name)}
+}
+
+func (tx *memoryDatastoreTx) ClearBucket(name []byte) error {
+	if !tx.canUpdate {
+		return errors.TraceNew("non-update transaction")
+	}
+	tx.changes[string(name)] = &memoryDatastoreBucketChanges{
+		cleared: true,
+		writes:  make(map[string]memoryDatastoreWrite),
+	}
+	return nil
+}
+
+// bucketChanges returns the changes made to the bucket in this transaction,
+// or nil when there are none.
+func (tx *memoryDatastoreTx) bucketChanges(name string) *memoryDatastoreBucketChanges {
+	if tx.changes == nil {
+		return nil
+	}
+	return tx.changes[name]
+}
+
+// writeBucketChanges returns the changes made to the bucket in this
+// transaction, to which new changes may be added.
+func (tx *memoryDatastoreTx) writeBucketChanges(name string) *memoryDatastoreBucketChanges {
+	changes, ok := tx.changes[name]
+	if !ok {
+		changes = &memoryDatastoreBucketChanges{
+			writes: make(map[string]memoryDatastoreWrite),
+		}
+		tx.changes[name] = changes
+	}
+	return changes
+}
+
+// get returns a copy of the current value for the key, including any changes
+// made in this transaction. A copy is returned so that callers which modify
+// the returned slice don't modify the stored value.
+func (b *memoryDatastoreBucket) get(key string) ([]byte, bool) {
+	changes := b.tx.bucketChanges(b.name)
+	if changes != nil {
+		if write, ok := changes.writes[key]; ok {
+			if write.deleted {
+				return nil, false
+			}
+			return append([]byte{}, write.value...), true
+		}
+		if changes.cleared {
+			return nil, false
+		}
+	}
+	value, ok := b.tx.db.buckets[b.name][key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, value...), true
+}
+
+func (b *memoryDatastoreBucket) Get(key []byte) []byte {
+	value, _ := b.get(string(key))
+	return value
+}
+
+func (b *memoryDatastoreBucket) Put(key, value []byte) error {
+	if !b.tx.canUpdate {
+		return errors.TraceNew("non-update transaction")
+	}
+	// Copy the value, as the caller may reuse its buffer.
+	b.tx.writeBucketChanges(b.name).writes[string(key)] =
+		memoryDatastoreWrite{value: append([]byte{}, value...)}
+	return nil
+}
+
+func (b *memoryDatastoreBucket) Delete(key []byte) error {
+	if !b.tx.canUpdate {
+		return errors.TraceNew("non-update transaction")
+	}
+	b.tx.writeBucketChanges(b.name).writes[string(key)] =
+		memoryDatastoreWrite{deleted: true}
+	return nil
+}
+
+func (b *memoryDatastoreBucket) Cursor() DatastoreCursor {
+
+	// The cursor iterates over a snapshot of the keys, in sorted order, taken
+	// when the cursor is created. This allows for deletes during iteration.
+	// Keys deleted after the cursor is created are skipped.
+
+	changes := b.tx.bucketChanges(b.name)
+
+	var keys []string
+	if changes == nil || !changes.cleared {
+		for key := range b.tx.db.buckets[b.name] {
+			if changes != nil {
+				if _, ok := changes.writes[key]; ok {
+					continue
+				}
+			}
+			keys = append(keys, key)
+		}
+	}
+	if changes != nil {
+		for key, write := range changes.writes {
+			if !write.deleted {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	return &memoryDatastoreCursor{bucket: b, keys: keys}
+}
+
+func (c *memoryDatastoreCursor) FirstKey() []byte {
+	c.index = 0
+	key, _ := c.current()
+	return key
+}
+
+func (c *memoryDatastoreCursor) NextKey() []byte {
+	c.index += 1
+	key, _ := c.current()
+	return key
+}
+
+func (c *memoryDatastoreCursor) First() ([]byte, []byte) {
+	c.index = 0
+	return c.current()
+}
+
+func (c *memoryDatastoreCursor) Next() ([]byte, []byte) {
+	c.index += 1
+	return c.current()
+}
+
+func (c *memoryDatastoreCursor) current() ([]byte, []byte) {
+	for ; c.index < len(c.keys); c.index++ {
+		key := c.keys[c.index]
+		value, ok := c.bucket.get(key)
+		if ok {
+			return []byte(key), value
+		}
+		// Skip keys deleted since the cursor was created.
+	}
+	return nil, nil
+}
+
+func (c *memoryDatastoreCursor) Close() {
+}
@@ -0,0 +1,297 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestMemoryDatastore(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-memory-datastore-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	config := &Config{
+		SponsorId:            "0",
+		PropagationChannelId: "0",
+		DataRootDirectory:    testDataDirName,
+		DatastoreBackend:     NewMemoryDatastoreBackend(),
+	}
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+
+	// Test: key/value round trip
+
+	err = SetKeyValue("key", "value")
+	if err != nil {
+		t.Fatalf("SetKeyValue failed: %s", err)
+	}
+
+	value, err := GetKeyValue("key")
+	if err != nil || value != "value" {
+		t.Fatalf("GetKeyValue failed: %s %s", value, err)
+	}
+
+	// Test: store server entries
+
+	serverEntryCount := 10
+
+	for i := 0; i < serverEntryCount; i++ {
+		fields := make(protocol.ServerEntryFields)
+		fields["ipAddress"] = fmt.Sprintf("192.168.0.%d", i)
+		fields["sshPort"] = 22
+		fields["sshUsername"] = prng.HexString(16)
+		fields["sshPassword"] = prng.HexString(16)
+		fields["sshHostKey"] = prng.HexString(16)
+		fields["capabilities"] = []string{"SSH", "ssh-api-requests"}
+		fields["region"] = "US"
+		fields["configurationVersion"] = 1
+		fields.SetLocalSource(protocol.SERVER_ENTRY_SOURCE_EMBEDDED)
+		fields.SetLocalTimestamp(
+			common.TruncateTimestampToHour(common.GetCurrentTimestamp()))
+
+		err = StoreServerEntry(fields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	if CountServerEntries() != serverEntryCount {
+		t.Fatalf("unexpected server entry count")
+	}
+
+	// Test: failed update is rolled back
+
+	err = datastoreUpdate(func(tx DatastoreTx) error {
+		err := tx.Bucket(datastoreKeyValueBucket).Put([]byte("key"), []byte("rollback"))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return errors.TraceNew("rollback")
+	})
+	if err == nil {
+		t.Fatalf("unexpected update success")
+	}
+
+	value, err = GetKeyValue("key")
+	if err != nil || value != "value" {
+		t.Fatalf("unexpected value after rollback: %s %s", value, err)
+	}
+
+	// Test: modifying a retrieved value doesn't modify the stored value
+
+	err = datastoreView(func(tx DatastoreTx) error {
+		value := tx.Bucket(datastoreKeyValueBucket).Get([]byte("key"))
+		if value == nil {
+			return errors.TraceNew("missing value")
+		}
+		value[0] = 'x'
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("datastoreView failed: %s", err)
+	}
+
+	value, err = GetKeyValue("key")
+	if err != nil || value != "value" {
+		t.Fatalf("unexpected value after modification: %s %s", value, err)
+	}
+
+	// Test: deletes during cursor iteration
+
+	err = datastoreUpdate(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreServerEntriesBucket)
+		cursor := bucket.Cursor()
+		defer cursor.Close()
+		count := 0
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			count += 1
+			if count%2 == 0 {
+				err := bucket.Delete(key)
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+		if count != serverEntryCount {
+			return errors.Tracef("unexpected cursor count: %d", count)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("datastoreUpdate failed: %s", err)
+	}
+
+	if CountServerEntries() != serverEntryCount/2 {
+		t.Fatalf("unexpected server entry count after deletes")
+	}
+
+	// Test: cursors reflect changes made in the transaction, and FirstKey and
+	// NextKey skip keys deleted after the cursor is created
+
+	checkedCursor := false
+
+	err = datastoreUpdate(func(tx DatastoreTx) error {
+		bucket := tx.Bucket(datastoreServerEntriesBucket)
+
+		var keys [][]byte
+		cursor := bucket.Cursor()
+		for key := cursor.FirstKey(); key != nil; key = cursor.NextKey() {
+			keys = append(keys, key)
+		}
+		cursor.Close()
+		if len(keys) != serverEntryCount/2 {
+			return errors.Tracef("unexpected cursor count: %d", len(keys))
+		}
+
+		err := bucket.Delete(keys[0])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = bucket.Put([]byte("added"), []byte{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		cursor = bucket.Cursor()
+		defer cursor.Close()
+
+		err = bucket.Delete(keys[1])
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		count := 0
+		for key := cursor.FirstKey(); key != nil; key = cursor.NextKey() {
+			if string(key) == string(keys[0]) || string(key) == string(keys[1]) {
+				return errors.Tracef("unexpected deleted key: %s", key)
+			}
+			count += 1
+		}
+		if count != len(keys)-1 {
+			return errors.Tracef("unexpected cursor count: %d", count)
+		}
+
+		if bucket.Get(keys[1]) != nil || bucket.Get([]byte("added")) == nil {
+			return errors.TraceNew("unexpected Get result")
+		}
+
+		checkedCursor = true
+
+		return errors.TraceNew("rollback")
+	})
+	if !checkedCursor {
+		t.Fatalf("datastoreUpdate failed: %s", err)
+	}
+	if err == nil {
+		t.Fatalf("unexpected update success")
+	}
+
+	if CountServerEntries() != serverEntryCount/2 {
+		t.Fatalf("unexpected server entry count after rollback")
+	}
+
+	// Test: cleared bucket
+
+	err = datastoreUpdate(func(tx DatastoreTx) error {
+		err := tx.ClearBucket(datastoreKeyValueBucket)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		bucket := tx.Bucket(datastoreKeyValueBucket)
+		if bucket.Get([]byte("key")) != nil {
+			return errors.TraceNew("unexpected value after clear")
+		}
+		err = bucket.Put([]byte("key"), []byte("value"))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = bucket.Put([]byte("cleared"), []byte("value"))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return bucket.Delete([]byte("cleared"))
+	})
+	if err != nil {
+		t.Fatalf("datastoreUpdate failed: %s", err)
+	}
+
+	err = datastoreView(func(tx DatastoreTx) error {
+		cursor := tx.Bucket(datastoreKeyValueBucket).Cursor()
+		defer cursor.Close()
+		key := cursor.FirstKey()
+		if string(key) != "key" || cursor.NextKey() != nil {
+			return errors.TraceNew("unexpected keys after clear")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("datastoreView failed: %s", err)
+	}
+
+	// Test: data is retained when the backend is closed and reopened
+
+	CloseDataStore()
+
+	err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer CloseDataStore()
+
+	value, err = GetKeyValue("key")
+	if err != nil || value != "value" {
+		t.Fatalf("unexpected value after reopen: %s %s", value, err)
+	}
+
+	if CountServerEntries() != serverEntryCount/2 {
+		t.Fatalf("unexpected server entry count after reopen")
+	}
+
+	// Test: no datastore files or data directories are created
+
+	files, err := ioutil.ReadDir(testDataDirName)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %s", err)
+	}
+	if len(files) > 0 {
+		t.Fatalf("unexpected data files: %d", len(files))
+	}
+}
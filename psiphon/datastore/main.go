@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+)
+
+func main() {
+
+	var configFilename string
+	flag.StringVar(&configFilename, "config", "", "client configuration input file")
+
+	var dataRootDirectory string
+	flag.StringVar(&dataRootDirectory, "dataRootDirectory", "", "client data root directory")
+
+	var buckets string
+	flag.StringVar(&buckets, "buckets", "", "comma-separated list of buckets to dump (defaults to all)")
+
+	var inputFilename string
+	flag.StringVar(&inputFilename, "input", "", "dump input file (defaults to stdin)")
+
+	var outputFilename string
+	flag.StringVar(&outputFilename, "output", "", "dump output file (defaults to stdout)")
+
+	var replace bool
+	flag.BoolVar(&replace, "replace", false, "replace existing server entries on import")
+
+	var regions string
+	flag.StringVar(&regions, "regions", "", "comma-separated list of server entry regions to prune")
+
+	var protocols string
+	flag.StringVar(&protocols, "protocols", "", "comma-separated list of tunnel protocols to prune")
+
+	var sources string
+	flag.StringVar(&sources, "sources", "", "comma-separated list of server entry sources to prune")
+
+	var noticeFilename string
+	flag.StringVar(&noticeFilename, "notices", "", "notices output file (defaults to none)")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage:\n\n"+
+				"%s <flags> dump      outputs datastore buckets as JSON\n"+
+				"%s <flags> import    stores the server entries in a JSON dump\n"+
+				"%s <flags> prune     deletes server entries matching the specified regions, protocols, and sources\n\n",
+			os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	args := flag.Args()
+
+	var command string
+	if len(args) >= 1 {
+		command = args[0]
+	}
+
+	if command != "dump" && command != "import" && command != "prune" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if configFilename == "" && dataRootDirectory == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	err := run(
+		configFilename,
+		dataRootDirectory,
+		noticeFilename,
+		command == "dump",
+		func() error {
+			switch command {
+			case "dump":
+				return dump(splitList(buckets), outputFilename)
+			case "import":
+				return importServerEntries(inputFilename, replace)
+			default:
+				return prune(&psiphon.ServerEntryFilter{
+					Regions:         splitList(regions),
+					TunnelProtocols: splitList(protocols),
+					LocalSources:    splitList(sources),
+				})
+			}
+		})
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func run(
+	configFilename, dataRootDirectory, noticeFilename string,
+	readOnly bool,
+	commandFunc func() error) error {
+
+	noticeWriter := ioutil.Discard
+	if noticeFilename != "" {
+		noticeFile, err := os.OpenFile(
+			noticeFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("open notice file failed: %s", err)
+		}
+		defer noticeFile.Close()
+		noticeWriter = noticeFile
+	}
+	psiphon.SetNoticeWriter(noticeWriter)
+
+	// When no client config is specified, a minimal config suffices for
+	// datastore operations.
+
+	configJSON := []byte(`{"PropagationChannelId" : "0", "SponsorId" : "0"}`)
+	if configFilename != "" {
+		var err error
+		configJSON, err = ioutil.ReadFile(configFilename)
+		if err != nil {
+			return fmt.Errorf("read config file failed: %s", err)
+		}
+	}
+
+	config, err := psiphon.LoadConfig(configJSON)
+	if err != nil {
+		return fmt.Errorf("load config failed: %s", err)
+	}
+
+	if dataRootDirectory != "" {
+		config.DataRootDirectory = dataRootDirectory
+	}
+
+	// Don't migrate legacy files, as this tool should not modify anything
+	// outside of the datastore.
+
+	err = config.Commit(false)
+	if err != nil {
+		return fmt.Errorf("commit config failed: %s", err)
+	}
+
+	// The datastore may be opened by only one process at a time, so the
+	// client must not be running. Unlike the client, fail when the datastore
+	// is locked or corrupt rather than resetting it. Dumps open the datastore
+	// read-only, so as to not modify it in any way.
+
+	err = psiphon.OpenDataStoreWithoutReset(config, readOnly)
+	if err != nil {
+		return fmt.Errorf("open datastore failed: %s", err)
+	}
+	defer psiphon.CloseDataStore()
+
+	return commandFunc()
+}
+
+func dump(buckets []string, outputFilename string) error {
+
+	datastoreDump, err := psiphon.DumpDataStore(buckets)
+	if err != nil {
+		return fmt.Errorf("dump datastore failed: %s", err)
+	}
+
+	output, err := json.MarshalIndent(datastoreDump, "", "    ")
+	if err != nil {
+		return fmt.Errorf("marshal dump failed: %s", err)
+	}
+	output = append(output, '\n')
+
+	if outputFilename == "" {
+		_, err = os.Stdout.Write(output)
+	} else {
+		err = ioutil.WriteFile(outputFilename, output, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("write dump failed: %s", err)
+	}
+
+	return nil
+}
+
+func importServerEntries(inputFilename string, replace bool) error {
+
+	var input io.Reader = os.Stdin
+	if inputFilename != "" {
+		inputFile, err := os.Open(inputFilename)
+		if err != nil {
+			return fmt.Errorf("open input file failed: %s", err)
+		}
+		defer inputFile.Close()
+		input = inputFile
+	}
+
+	var datastoreDump psiphon.DatastoreDump
+	err := json.NewDecoder(input).Decode(&datastoreDump)
+	if err != nil {
+		return fmt.Errorf("decode dump failed: %s", err)
+	}
+
+	count, err := psiphon.ImportDataStoreServerEntries(&datastoreDump, replace)
+	if err != nil {
+		return fmt.Errorf("import server entries failed after %d: %s", count, err)
+	}
+
+	fmt.Printf("imported %d server entries\n", count)
+
+	return nil
+}
+
+func prune(filter *psiphon.ServerEntryFilter) error {
+
+	// Require explicit criteria, to avoid accidentally deleting all server
+	// entries.
+
+	if filter.IsEmpty() {
+		return fmt.Errorf("prune requires at least one of regions, protocols, or sources")
+	}
+
+	count, err := psiphon.DeleteServerEntries(filter)
+	if err != nil {
+		return fmt.Errorf("prune server entries failed: %s", err)
+	}
+
+	fmt.Printf("pruned %d server entries\n", count)
+
+	return nil
+}
@@ -27,6 +27,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -56,6 +57,11 @@ import (
 // to "", and set to the resolved IP address once that part of the dial
 // process has completed.
 //
+// For multi-hop tunnels, IsMultiHopEntry is set in the dial parameters of the
+// entry tunnel, and MultiHopEntryTunnel, set in the exit dial parameters, is
+// the activated entry tunnel through which the exit server is dialed. Each
+// hop has its own dial parameters, stored and replayed independently.
+//
 // DialParameters is not safe for concurrent use.
 type DialParameters struct {
 	ServerEntry     *protocol.ServerEntry `json:"-"`
@@ -72,6 +78,9 @@ type DialParameters struct {
 
 	TunnelProtocol string
 
+	UseServerIPv6Address bool
+	ServerIPAddress      string `json:"-"`
+
 	DirectDialAddress              string
 	DialPortNumber                 string
 	UpstreamProxyType              string   `json:"-"`
@@ -117,11 +126,16 @@ type DialParameters struct {
 
 	APIRequestPaddingSeed *prng.Seed
 
+	TunnelResumption bool
+
 	DialConnMetrics          common.MetricsSource `json:"-"`
 	ObfuscatedSSHConnMetrics common.MetricsSource `json:"-"`
 
 	DialDuration time.Duration `json:"-"`
 
+	IsMultiHopEntry     bool    `json:"-"`
+	MultiHopEntryTunnel *Tunnel `json:"-"`
+
 	dialConfig *DialConfig
 	meekConfig *MeekConfig
 }
@@ -139,6 +153,11 @@ type DialParameters struct {
 // MakeDialParameters will return nil/nil in cases where the candidate server
 // entry should be skipped.
 //
+// hasIPv6Route indicates whether the host has a route to the IPv6 internet,
+// and may select the server IPv6 address. The caller is expected to check the
+// route once per establishment, using hasIPv6Route, rather than per
+// candidate.
+//
 // To support replay, the caller must call DialParameters.Succeeded when a
 // successful tunnel is established with the returned DialParameters; and must
 // call DialParameters.Failed when a tunnel dial or activation fails, except
@@ -149,7 +168,8 @@ func MakeDialParameters(
 	selectProtocol func(serverEntry *protocol.ServerEntry) (string, bool),
 	serverEntry *protocol.ServerEntry,
 	isTactics bool,
-	candidateNumber int) (*DialParameters, error) {
+	candidateNumber int,
+	hasIPv6Route bool) (*DialParameters, error) {
 
 	networkID := config.GetNetworkID()
 
@@ -169,6 +189,7 @@ func MakeDialParameters(
 	replayLivenessTest := p.Bool(parameters.ReplayLivenessTest)
 	replayUserAgent := p.Bool(parameters.ReplayUserAgent)
 	replayAPIRequestPadding := p.Bool(parameters.ReplayAPIRequestPadding)
+	replayTunnelResumption := p.Bool(parameters.ReplayTunnelResumption)
 
 	// Check for existing dial parameters for this server/network ID.
 
@@ -223,6 +244,7 @@ func MakeDialParameters(
 
 	if dialParams != nil {
 		if config.DisableReplay ||
+			!protocol.TunnelProtocolSupportsReplay(dialParams.TunnelProtocol) ||
 			!canReplay(serverEntry, dialParams.TunnelProtocol) {
 
 			// In these ephemeral cases, existing dial parameters may still be valid
@@ -326,6 +348,31 @@ func MakeDialParameters(
 		dialParams.TunnelProtocol = selectedProtocol
 	}
 
+	// Select the server IP address family. IPv6 is used only when the server
+	// entry has an IPv6 address, the protocol dials the server IP address
+	// directly, and the host has an IPv6 route. A replayed IPv6 selection is
+	// dropped when IPv6 is no longer available, such as after a network change
+	// that retains the network ID.
+
+	canUseServerIPv6Address :=
+		serverEntry.IPv6Address != "" &&
+			protocolSupportsServerIPv6Address(dialParams.TunnelProtocol) &&
+			!config.UseUpstreamProxy() &&
+			hasIPv6Route
+
+	if !isReplay {
+		dialParams.UseServerIPv6Address =
+			canUseServerIPv6Address &&
+				p.WeightedCoinFlip(parameters.ServerIPv6AddressProbability)
+	} else if !canUseServerIPv6Address {
+		dialParams.UseServerIPv6Address = false
+	}
+
+	dialParams.ServerIPAddress = serverEntry.IpAddress
+	if dialParams.UseServerIPv6Address {
+		dialParams.ServerIPAddress = serverEntry.IPv6Address
+	}
+
 	if (!isReplay || !replayBPF) &&
 		ClientBPFEnabled() &&
 		protocol.TunnelProtocolUsesTCP(dialParams.TunnelProtocol) {
@@ -448,16 +495,13 @@ func MakeDialParameters(
 		} else if protocol.TunnelProtocolUsesMeekHTTP(dialParams.TunnelProtocol) {
 
 			dialParams.MeekHostHeader = ""
-			hostname := serverEntry.IpAddress
+			hostname := dialParams.ServerIPAddress
 			if p.WeightedCoinFlip(parameters.TransformHostNameProbability) {
 				hostname = values.GetHostName()
 				dialParams.MeekTransformedHostName = true
 			}
-			if serverEntry.MeekServerPort == 80 {
-				dialParams.MeekHostHeader = hostname
-			} else {
-				dialParams.MeekHostHeader = fmt.Sprintf("%s:%d", hostname, serverEntry.MeekServerPort)
-			}
+			dialParams.MeekHostHeader = makeHostHeader(
+				hostname, getMeekServerPort(serverEntry, dialParams.TunnelProtocol), 80)
 		} else if protocol.TunnelProtocolUsesQUIC(dialParams.TunnelProtocol) {
 
 			dialParams.QUICDialSNIAddress = fmt.Sprintf(
@@ -497,22 +541,37 @@ func MakeDialParameters(
 		}
 	}
 
+	if !isReplay || !replayTunnelResumption {
+
+		// Tunnels may survive network changes and brief outages by resuming
+		// the obfuscated SSH session over a new connection or, for obfuscated
+		// QUIC, by migrating the QUIC connection.
+
+		dialParams.TunnelResumption =
+			serverEntry.SupportsTunnelResumption() &&
+				(protocol.TunnelProtocolSupportsResumption(dialParams.TunnelProtocol) ||
+					(protocol.TunnelProtocolUsesQUIC(dialParams.TunnelProtocol) &&
+						!protocol.TunnelProtocolUsesMeek(dialParams.TunnelProtocol) &&
+						protocol.QUICVersionIsObfuscated(dialParams.QUICVersion))) &&
+				p.WeightedCoinFlip(parameters.TunnelResumptionProbability)
+	}
+
 	// Set dial address fields. This portion of configuration is
 	// deterministic, given the parameters established or replayed so far.
 
 	switch dialParams.TunnelProtocol {
 
 	case protocol.TUNNEL_PROTOCOL_SSH:
-		dialParams.DirectDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshPort)
+		dialParams.DirectDialAddress = net.JoinHostPort(dialParams.ServerIPAddress, strconv.Itoa(serverEntry.SshPort))
 
 	case protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH:
-		dialParams.DirectDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedPort)
+		dialParams.DirectDialAddress = net.JoinHostPort(dialParams.ServerIPAddress, strconv.Itoa(serverEntry.SshObfuscatedPort))
 
 	case protocol.TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH:
-		dialParams.DirectDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedTapdancePort)
+		dialParams.DirectDialAddress = net.JoinHostPort(dialParams.ServerIPAddress, strconv.Itoa(serverEntry.SshObfuscatedTapdancePort))
 
 	case protocol.TUNNEL_PROTOCOL_QUIC_OBFUSCATED_SSH:
-		dialParams.DirectDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedQUICPort)
+		dialParams.DirectDialAddress = net.JoinHostPort(dialParams.ServerIPAddress, strconv.Itoa(serverEntry.SshObfuscatedQUICPort))
 
 	case protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_QUIC_OBFUSCATED_SSH:
 		dialParams.MeekDialAddress = fmt.Sprintf("%s:443", dialParams.MeekFrontingDialAddress)
@@ -522,9 +581,11 @@ func MakeDialParameters(
 		}
 	case protocol.TUNNEL_PROTOCOL_MARIONETTE_OBFUSCATED_SSH:
 		// Note: port comes from marionnete "format"
-		dialParams.DirectDialAddress = serverEntry.IpAddress
+		dialParams.DirectDialAddress = dialParams.ServerIPAddress
+
+	case protocol.TUNNEL_PROTOCOL_FRONTED_MEEK,
+		protocol.TUNNEL_PROTOCOL_FRONTED_WEBSOCKET_TLS:
 
-	case protocol.TUNNEL_PROTOCOL_FRONTED_MEEK:
 		dialParams.MeekDialAddress = fmt.Sprintf("%s:443", dialParams.MeekFrontingDialAddress)
 		dialParams.MeekHostHeader = dialParams.MeekFrontingHost
 		if serverEntry.MeekFrontingDisableSNI {
@@ -537,29 +598,26 @@ func MakeDialParameters(
 		dialParams.MeekDialAddress = fmt.Sprintf("%s:80", dialParams.MeekFrontingDialAddress)
 		dialParams.MeekHostHeader = dialParams.MeekFrontingHost
 
-	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK:
-		dialParams.MeekDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+		protocol.TUNNEL_PROTOCOL_WEBSOCKET:
+
+		port := getMeekServerPort(serverEntry, dialParams.TunnelProtocol)
+		dialParams.MeekDialAddress = net.JoinHostPort(dialParams.ServerIPAddress, strconv.Itoa(port))
 		if !dialParams.MeekTransformedHostName {
-			if serverEntry.MeekServerPort == 80 {
-				dialParams.MeekHostHeader = serverEntry.IpAddress
-			} else {
-				dialParams.MeekHostHeader = dialParams.MeekDialAddress
-			}
+			dialParams.MeekHostHeader = makeHostHeader(dialParams.ServerIPAddress, port, 80)
 		}
 
 	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
-		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET:
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET,
+		protocol.TUNNEL_PROTOCOL_WEBSOCKET_TLS:
 
-		dialParams.MeekDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
+		port := getMeekServerPort(serverEntry, dialParams.TunnelProtocol)
+		dialParams.MeekDialAddress = net.JoinHostPort(dialParams.ServerIPAddress, strconv.Itoa(port))
 		if !dialParams.MeekTransformedHostName {
 			// Note: IP address in SNI field will be omitted.
-			dialParams.MeekSNIServerName = serverEntry.IpAddress
-		}
-		if serverEntry.MeekServerPort == 443 {
-			dialParams.MeekHostHeader = serverEntry.IpAddress
-		} else {
-			dialParams.MeekHostHeader = dialParams.MeekDialAddress
+			dialParams.MeekSNIServerName = dialParams.ServerIPAddress
 		}
+		dialParams.MeekHostHeader = makeHostHeader(dialParams.ServerIPAddress, port, 443)
 
 	default:
 		return nil, errors.Tracef(
@@ -655,6 +713,7 @@ func MakeDialParameters(
 			UseQUIC:                       protocol.TunnelProtocolUsesFrontedMeekQUIC(dialParams.TunnelProtocol),
 			QUICVersion:                   dialParams.QUICVersion,
 			UseHTTPS:                      protocol.TunnelProtocolUsesMeekHTTPS(dialParams.TunnelProtocol),
+			UseWebSocket:                  protocol.TunnelProtocolUsesWebSocket(dialParams.TunnelProtocol),
 			TLSProfile:                    dialParams.TLSProfile,
 			NoDefaultTLSSessionID:         dialParams.NoDefaultTLSSessionID,
 			RandomizedTLSProfileSeed:      dialParams.RandomizedTLSProfileSeed,
@@ -761,6 +820,19 @@ func (dialParams *DialParameters) GetTLSVersionForMetrics() string {
 	return tlsVersion
 }
 
+// GetIPVersionForMetrics returns the IP version, "4" or "6", of the server
+// IP address dialed. "" is returned for protocols, such as fronted meek,
+// which don't dial the server IP address.
+func (dialParams *DialParameters) GetIPVersionForMetrics() string {
+	if !protocolSupportsServerIPv6Address(dialParams.TunnelProtocol) {
+		return ""
+	}
+	if dialParams.UseServerIPv6Address {
+		return "6"
+	}
+	return "4"
+}
+
 // ExchangedDialParameters represents the subset of DialParameters that is
 // shared in a client-to-client exchange of server connection info.
 //
@@ -816,7 +888,7 @@ func NewExchangedDialParameters(dialParams *DialParameters) *ExchangedDialParame
 // Validate checks that the ExchangedDialParameters contains only valid values
 // and is compatible with the specified server entry.
 func (dialParams *ExchangedDialParameters) Validate(serverEntry *protocol.ServerEntry) error {
-	if !common.Contains(protocol.SupportedTunnelProtocols, dialParams.TunnelProtocol) {
+	if !protocol.IsSupportedTunnelProtocol(dialParams.TunnelProtocol) {
 		return errors.Tracef("unknown tunnel protocol: %s", dialParams.TunnelProtocol)
 	}
 	if !serverEntry.SupportsProtocol(dialParams.TunnelProtocol) {
@@ -1005,3 +1077,48 @@ func makeDialCustomHeaders(
 	}
 	return dialCustomHeaders
 }
+
+// protocolSupportsServerIPv6Address indicates whether the tunnel protocol
+// dials the server IP address directly and so may use a server entry IPv6
+// address. Fronted meek dials a CDN; see also
+// protocol.TunnelProtocolSupportsServerIPv6Address.
+func protocolSupportsServerIPv6Address(tunnelProtocol string) bool {
+	return !protocol.TunnelProtocolUsesFrontedMeek(tunnelProtocol) &&
+		protocol.TunnelProtocolSupportsServerIPv6Address(tunnelProtocol)
+}
+
+// protocolDialsServerIPAddress indicates whether the tunnel protocol dials
+// the server IP address directly, so that other direct traffic to the server
+// IP address doesn't reveal the server to a network observer. Fronted meek
+// dials a CDN and TapDance dials a station.
+func protocolDialsServerIPAddress(tunnelProtocol string) bool {
+	return !protocol.TunnelProtocolUsesFrontedMeek(tunnelProtocol) &&
+		!protocol.TunnelProtocolUsesTapdance(tunnelProtocol)
+}
+
+// getMeekServerPort returns the server entry port to dial for the specified
+// unfronted meek or WebSocket tunnel protocol. The WebSocket protocols may
+// be run on ports other than the meek port, as each meek server listener
+// is either HTTP or HTTPS.
+func getMeekServerPort(serverEntry *protocol.ServerEntry, tunnelProtocol string) int {
+	switch tunnelProtocol {
+	case protocol.TUNNEL_PROTOCOL_WEBSOCKET:
+		return serverEntry.WebSocketServerPort
+	case protocol.TUNNEL_PROTOCOL_WEBSOCKET_TLS:
+		return serverEntry.WebSocketTLSServerPort
+	}
+	return serverEntry.MeekServerPort
+}
+
+// makeHostHeader returns an HTTP Host header value for the host and port.
+// The port is omitted when it's the default port for the scheme, and IPv6
+// addresses are bracketed.
+func makeHostHeader(host string, port, defaultPort int) string {
+	if port != defaultPort {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
@@ -108,7 +108,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 
 	// Test: expected dial parameter fields set
 
-	dialParams, err := MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0)
+	dialParams, err := MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0, false)
 	if err != nil {
 		t.Fatalf("MakeDialParameters failed: %s", err)
 	}
@@ -158,6 +158,22 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 		t.Fatalf("missing meek fields")
 	}
 
+	expectedDialPortNumber := ""
+	switch tunnelProtocol {
+	case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_HTTPS,
+		protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK_SESSION_TICKET:
+		expectedDialPortNumber = "5"
+	case protocol.TUNNEL_PROTOCOL_WEBSOCKET:
+		expectedDialPortNumber = "6"
+	case protocol.TUNNEL_PROTOCOL_WEBSOCKET_TLS:
+		expectedDialPortNumber = "7"
+	}
+	if expectedDialPortNumber != "" &&
+		dialParams.DialPortNumber != expectedDialPortNumber {
+		t.Fatalf("unexpected meek dial port: %s", dialParams.DialPortNumber)
+	}
+
 	if protocol.TunnelProtocolUsesFrontedMeek(tunnelProtocol) &&
 		(dialParams.MeekFrontingDialAddress == "" ||
 			dialParams.MeekFrontingHost == "") {
@@ -205,7 +221,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 
 	dialParams.Failed(clientConfig)
 
-	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0)
+	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0, false)
 	if err != nil {
 		t.Fatalf("MakeDialParameters failed: %s", err)
 	}
@@ -220,7 +236,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 
 	testNetworkID = prng.HexString(8)
 
-	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0)
+	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0, false)
 	if err != nil {
 		t.Fatalf("MakeDialParameters failed: %s", err)
 	}
@@ -237,7 +253,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 
 	dialParams.Succeeded()
 
-	replayDialParams, err := MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0)
+	replayDialParams, err := MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0, false)
 	if err != nil {
 		t.Fatalf("MakeDialParameters failed: %s", err)
 	}
@@ -323,7 +339,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 		t.Fatalf("SetClientParameters failed: %s", err)
 	}
 
-	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0)
+	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0, false)
 	if err != nil {
 		t.Fatalf("MakeDialParameters failed: %s", err)
 	}
@@ -338,7 +354,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 
 	time.Sleep(1 * time.Second)
 
-	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0)
+	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0, false)
 	if err != nil {
 		t.Fatalf("MakeDialParameters failed: %s", err)
 	}
@@ -353,7 +369,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 
 	serverEntries[0].ConfigurationVersion += 1
 
-	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0)
+	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0, false)
 	if err != nil {
 		t.Fatalf("MakeDialParameters failed: %s", err)
 	}
@@ -377,14 +393,14 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 		t.Fatalf("SetClientParameters failed: %s", err)
 	}
 
-	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0)
+	dialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0, false)
 	if err != nil {
 		t.Fatalf("MakeDialParameters failed: %s", err)
 	}
 
 	dialParams.Succeeded()
 
-	replayDialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0)
+	replayDialParams, err = MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntries[0], false, 0, false)
 	if err != nil {
 		t.Fatalf("MakeDialParameters failed: %s", err)
 	}
@@ -432,7 +448,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 
 		if i%10 == 0 {
 
-			dialParams, err := MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntry, false, 0)
+			dialParams, err := MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntry, false, 0, false)
 			if err != nil {
 				t.Fatalf("MakeDialParameters failed: %s", err)
 			}
@@ -461,7 +477,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 				t.Fatalf("ServerEntryIterator.Next failed: %s", err)
 			}
 
-			dialParams, err := MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntry, false, 0)
+			dialParams, err := MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntry, false, 0, false)
 			if err != nil {
 				t.Fatalf("MakeDialParameters failed: %s", err)
 			}
@@ -483,7 +499,7 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 				t.Fatalf("ServerEntryIterator.Next failed: %s", err)
 			}
 
-			dialParams, err := MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntry, false, 0)
+			dialParams, err := MakeDialParameters(clientConfig, canReplay, selectProtocol, serverEntry, false, 0, false)
 			if err != nil {
 				t.Fatalf("MakeDialParameters failed: %s", err)
 			}
@@ -501,6 +517,217 @@ func runDialParametersAndReplay(t *testing.T, tunnelProtocol string) {
 	}
 }
 
+func TestDialParametersServerIPv6Address(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-dial-parameters-ipv6-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	clientConfig := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataRootDirectory:    testDataDirName,
+		NetworkIDGetter:      new(testNetworkGetter),
+	}
+
+	err = clientConfig.Commit(false)
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	applyParameters := make(map[string]interface{})
+	applyParameters[parameters.TransformHostNameProbability] = 0.0
+	applyParameters[parameters.ServerIPv6AddressProbability] = 1.0
+	err = clientConfig.SetClientParameters("tag1", true, applyParameters)
+	if err != nil {
+		t.Fatalf("SetClientParameters failed: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	// IPv6 is selected only when the host has an IPv6 route. Both cases are
+	// exercised regardless of the actual host network configuration.
+
+	for _, hasIPv6Route := range []bool{false, true} {
+		for _, tunnelProtocol := range []string{
+			protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+			protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+			protocol.TUNNEL_PROTOCOL_FRONTED_MEEK} {
+
+			serverEntry := makeMockServerEntries(tunnelProtocol, 1)[0]
+			serverEntry.IPv6Address = "2001:db8::1"
+
+			canReplay := func(serverEntry *protocol.ServerEntry, replayProtocol string) bool {
+				return false
+			}
+
+			selectProtocol := func(serverEntry *protocol.ServerEntry) (string, bool) {
+				return tunnelProtocol, true
+			}
+
+			dialParams, err := MakeDialParameters(
+				clientConfig, canReplay, selectProtocol, serverEntry, false, 0, hasIPv6Route)
+			if err != nil {
+				t.Fatalf("MakeDialParameters failed: %s", err)
+			}
+
+			useIPv6 := hasIPv6Route && protocolSupportsServerIPv6Address(tunnelProtocol)
+
+			if dialParams.UseServerIPv6Address != useIPv6 {
+				t.Fatalf("unexpected IPv6 selection for %s", tunnelProtocol)
+			}
+
+			expectedIPVersion := "4"
+			if useIPv6 {
+				expectedIPVersion = "6"
+			}
+			if !protocolSupportsServerIPv6Address(tunnelProtocol) {
+				expectedIPVersion = ""
+			}
+			if dialParams.GetIPVersionForMetrics() != expectedIPVersion {
+				t.Fatalf("unexpected IP version for %s: %s",
+					tunnelProtocol, dialParams.GetIPVersionForMetrics())
+			}
+
+			if !useIPv6 {
+				continue
+			}
+
+			switch tunnelProtocol {
+			case protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH:
+				if dialParams.DirectDialAddress != "[2001:db8::1]:2" {
+					t.Fatalf("unexpected dial address: %s", dialParams.DirectDialAddress)
+				}
+			case protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK:
+				if dialParams.MeekDialAddress != "[2001:db8::1]:5" ||
+					dialParams.MeekHostHeader != "[2001:db8::1]:5" {
+					t.Fatalf("unexpected meek fields: %s %s",
+						dialParams.MeekDialAddress, dialParams.MeekHostHeader)
+				}
+			}
+
+			// Test: a replayed IPv6 selection is retained while there is an
+			// IPv6 route, and dropped when there is no longer an IPv6 route.
+
+			dialParams.Succeeded()
+
+			canReplay = func(serverEntry *protocol.ServerEntry, replayProtocol string) bool {
+				return true
+			}
+
+			for _, replayHasIPv6Route := range []bool{true, false} {
+
+				replayDialParams, err := MakeDialParameters(
+					clientConfig, canReplay, selectProtocol, serverEntry, false, 0, replayHasIPv6Route)
+				if err != nil {
+					t.Fatalf("MakeDialParameters failed: %s", err)
+				}
+
+				if !replayDialParams.IsReplay ||
+					replayDialParams.UseServerIPv6Address != replayHasIPv6Route {
+					t.Fatalf("unexpected replay IPv6 selection for %s", tunnelProtocol)
+				}
+			}
+		}
+	}
+
+	if makeHostHeader("2001:db8::1", 80, 80) != "[2001:db8::1]" ||
+		makeHostHeader("192.0.2.1", 80, 80) != "192.0.2.1" ||
+		makeHostHeader("192.0.2.1", 8080, 80) != "192.0.2.1:8080" {
+		t.Fatalf("unexpected host header")
+	}
+}
+
+func TestServerEntryIteratorRequireTorORPortForwarding(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-tor-orport-iterator-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	clientConfig := &Config{
+		PropagationChannelId:       "0",
+		SponsorId:                  "0",
+		DataRootDirectory:          testDataDirName,
+		NetworkIDGetter:            new(testNetworkGetter),
+		RequireTorORPortForwarding: true,
+	}
+
+	err = clientConfig.Commit(false)
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	// Only every other server entry is a Tor bridge.
+
+	serverEntries := makeMockServerEntries(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, 10)
+
+	for i, serverEntry := range serverEntries {
+
+		if i%2 == 0 {
+			serverEntry.Capabilities = []string{protocol.CAPABILITY_TOR_OR_PORT_FORWARDING}
+		}
+
+		data, err := json.Marshal(serverEntry)
+		if err != nil {
+			t.Fatalf("json.Marshal failed: %s", err)
+		}
+
+		var serverEntryFields protocol.ServerEntryFields
+		err = json.Unmarshal(data, &serverEntryFields)
+		if err != nil {
+			t.Fatalf("json.Unmarshal failed: %s", err)
+		}
+
+		err = StoreServerEntry(serverEntryFields, false)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	_, iterator, err := NewServerEntryIterator(clientConfig)
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	defer iterator.Close()
+
+	count := 0
+	for {
+		serverEntry, err := iterator.Next()
+		if err != nil {
+			t.Fatalf("ServerEntryIterator.Next failed: %s", err)
+		}
+		if serverEntry == nil {
+			break
+		}
+		if !serverEntry.SupportsTorORPortForwarding() {
+			t.Fatalf("unexpected server entry")
+		}
+		count++
+	}
+
+	if count != len(serverEntries)/2 {
+		t.Fatalf("unexpected server entry count: %d", count)
+	}
+}
+
 func makeMockServerEntries(tunnelProtocol string, count int) []*protocol.ServerEntry {
 
 	serverEntries := make([]*protocol.ServerEntry, count)
@@ -513,6 +740,8 @@ func makeMockServerEntries(tunnelProtocol string, count int) []*protocol.ServerE
 			SshObfuscatedQUICPort:      3,
 			SshObfuscatedTapdancePort:  4,
 			MeekServerPort:             5,
+			WebSocketServerPort:        6,
+			WebSocketTLSServerPort:     7,
 			MeekFrontingHosts:          []string{"www1.example.org", "www2.example.org", "www3.example.org"},
 			MeekFrontingAddressesRegex: "[a-z0-9]{1,64}.example.org",
 			LocalSource:                protocol.SERVER_ENTRY_SOURCE_EMBEDDED,
@@ -184,7 +184,8 @@ func TestServerEntryExchange(t *testing.T) {
 				selectProtocol,
 				serverEntry,
 				false,
-				0)
+				0,
+				false)
 			if err != nil {
 				t.Fatalf("MakeDialParameters failed: %s", err)
 			}
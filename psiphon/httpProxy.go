@@ -75,8 +75,15 @@ import (
 // Origin URLs must include the scheme prefix ("http://" or "https://") and must be
 // URL encoded.
 //
+// When config.LocalProxyCredentials is set, requests must include
+// "Proxy-Authorization: Basic" credentials. URL proxy requests are made by
+// clients, such as media players, which aren't configured to use a proxy and
+// can't send proxy credentials, so URL proxy requests from loopback peers
+// are exempt; URL proxy requests from other peers, such as other hosts on
+// the LAN when ListenInterface is set, must include credentials.
 type HttpProxy struct {
 	tunneler               Tunneler
+	authenticator          *localProxyAuthenticator
 	listener               net.Listener
 	serveWaitGroup         *sync.WaitGroup
 	httpProxyTunneledRelay *http.Transport
@@ -163,6 +170,7 @@ func NewHttpProxy(
 
 	proxy = &HttpProxy{
 		tunneler:               tunneler,
+		authenticator:          newLocalProxyAuthenticator(config, _HTTP_PROXY_TYPE),
 		listener:               listener,
 		serveWaitGroup:         new(sync.WaitGroup),
 		httpProxyTunneledRelay: httpProxyTunneledRelay,
@@ -207,6 +215,9 @@ func (proxy *HttpProxy) Close() {
 	proxy.httpProxyTunneledRelay.CloseIdleConnections()
 	proxy.urlProxyTunneledRelay.CloseIdleConnections()
 	proxy.urlProxyDirectRelay.CloseIdleConnections()
+	if proxy.authenticator != nil {
+		proxy.authenticator.close()
+	}
 }
 
 // ServeHTTP receives HTTP requests and proxies them. CONNECT requests
@@ -226,6 +237,32 @@ func (proxy *HttpProxy) Close() {
 // license that can be found in the LICENSE file.
 //
 func (proxy *HttpProxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+
+	isURLProxyRequest := request.Method != "CONNECT" && !request.URL.IsAbs()
+
+	requireAuthentication := proxy.authenticator != nil &&
+		!(isURLProxyRequest && isLoopbackRequest(request))
+
+	if requireAuthentication {
+		stats, ok := proxy.authenticator.authenticateHTTPRequest(request)
+		if !ok {
+			responseWriter.Header().Set("Proxy-Authenticate", `Basic realm="Psiphon"`)
+			http.Error(
+				responseWriter,
+				http.StatusText(http.StatusProxyAuthRequired),
+				http.StatusProxyAuthRequired)
+			return
+		}
+		request.Body = &localProxyAccountingReader{
+			ReadCloser: request.Body,
+			stats:      stats,
+		}
+		responseWriter = &localProxyAccountingResponseWriter{
+			ResponseWriter: responseWriter,
+			stats:          stats,
+		}
+	}
+
 	if request.Method == "CONNECT" {
 		conn := hijack(responseWriter)
 		if conn == nil {
@@ -239,13 +276,24 @@ func (proxy *HttpProxy) ServeHTTP(responseWriter http.ResponseWriter, request *h
 				NoticeWarning("%s", errors.Trace(err))
 			}
 		}()
-	} else if request.URL.IsAbs() {
+	} else if !isURLProxyRequest {
 		proxy.httpProxyHandler(responseWriter, request)
 	} else {
 		proxy.urlProxyHandler(responseWriter, request)
 	}
 }
 
+// isLoopbackRequest indicates whether the request was received from a
+// loopback peer.
+func isLoopbackRequest(request *http.Request) bool {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	IP := net.ParseIP(host)
+	return IP != nil && IP.IsLoopback()
+}
+
 func (proxy *HttpProxy) httpConnectHandler(localConn net.Conn, target string) (err error) {
 	defer localConn.Close()
 	defer proxy.openConns.Remove(localConn)
@@ -255,6 +303,9 @@ func (proxy *HttpProxy) httpConnectHandler(localConn net.Conn, target string) (e
 	// open connection for data which will never arrive.
 	remoteConn, err := proxy.tunneler.Dial(target, false, localConn)
 	if err != nil {
+		if std_errors.Is(err, errSplitTunnelPolicyBlocked) {
+			_, _ = localConn.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+		}
 		return errors.Trace(err)
 	}
 	defer remoteConn.Close()
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -139,43 +140,158 @@ func TestLimitTunnelProtocols(t *testing.T) {
 		t.Fatalf("unexpected server entries")
 	}
 
-	serverEntries := make([]map[string]interface{}, len(protocol.SupportedTunnelProtocols))
+	storeLimitProtocolsTestServerEntries(t)
 
-	for i, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+	controller, err := NewController(clientConfig)
+	if err != nil {
+		t.Fatalf("error creating client controller: %s", err)
+	}
 
-		_, _, _, _, encodedServerEntry, err := server.GenerateConfig(
-			&server.GenerateConfigParams{
-				ServerIPAddress:      fmt.Sprintf("0.1.0.0"),
-				EnableSSHAPIRequests: true,
-				WebServerPort:        8000,
-				TunnelProtocolPorts:  map[string]int{tunnelProtocol: 4000},
-			})
-		if err != nil {
-			t.Fatalf("error generating server config: %s", err)
-		}
+	ctx, cancelFunc := context.WithCancel(context.Background())
 
-		serverEntryFields, err := protocol.DecodeServerEntryFields(
-			string(encodedServerEntry),
-			common.GetCurrentTimestamp(),
-			protocol.SERVER_ENTRY_SOURCE_REMOTE)
-		if err != nil {
-			t.Fatalf("error decoding server entry: %s", err)
-		}
+	controllerWaitGroup := new(sync.WaitGroup)
 
-		serverEntries[i] = serverEntryFields
+	controllerWaitGroup.Add(1)
+	go func() {
+		defer controllerWaitGroup.Done()
+		controller.Run(ctx)
+	}()
+
+	time.Sleep(10 * time.Second)
+
+	cancelFunc()
+
+	controllerWaitGroup.Wait()
+
+	t.Logf("initial-connecting and connecting count: %d/%d", initialConnectingCount, connectingCount)
+
+	if initialConnectingCount != initialLimitTunnelProtocolsCandidateCount {
+		t.Fatalf("unexpected initial-connecting count")
 	}
 
-	for i := 0; i < 1000; i++ {
+	if connectingCount < 3*initialLimitTunnelProtocolsCandidateCount {
+		t.Fatalf("unexpected connecting count")
+	}
+}
 
-		serverEntryFields := serverEntries[i%len(protocol.SupportedTunnelProtocols)]
+func TestMultiHopLimitTunnelProtocols(t *testing.T) {
 
-		serverEntryFields["ipAddress"] = fmt.Sprintf("0.1.%d.%d", (i>>8)&0xFF, i&0xFF)
+	// Test: the multi-hop exit constraints are merged from the configured
+	// constraints, which apply to the entry server.
 
-		err = StoreServerEntry(serverEntryFields, true)
-		if err != nil {
-			t.Fatalf("error storing server entry: %s", err)
-		}
+	constraints := &protocolSelectionConstraints{
+		useUpstreamProxy:                    true,
+		initialLimitProtocols:               protocol.TunnelProtocols{"OSSH"},
+		initialLimitProtocolsCandidateCount: 10,
+		limitProtocols:                      protocol.TunnelProtocols{"OSSH", "UNFRONTED-MEEK-OSSH"},
+		replayCandidateCount:                5,
+	}
+
+	exitConstraints := constraints.multiHopExitConstraints()
+
+	if exitConstraints.useUpstreamProxy ||
+		exitConstraints.hasInitialProtocols() ||
+		!reflect.DeepEqual(exitConstraints.limitProtocols, protocol.TunnelProtocols{"OSSH"}) ||
+		exitConstraints.replayCandidateCount != 5 {
+		t.Fatalf("unexpected exit constraints: %+v", exitConstraints)
+	}
+
+	constraints.limitProtocols = protocol.TunnelProtocols{"UNFRONTED-MEEK-OSSH"}
+
+	exitConstraints = constraints.multiHopExitConstraints()
+
+	if !reflect.DeepEqual(exitConstraints.limitProtocols, getMultiHopExitTunnelProtocols()) {
+		t.Fatalf("unexpected exit constraints: %+v", exitConstraints)
+	}
+
+	// Test: the configured initial and limit tunnel protocols apply to the
+	// entry server connections, which are the only connections dialed as
+	// all candidate entry servers are unreachable.
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-multi-hop-limit-tunnel-protocols-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
 	}
+	defer os.RemoveAll(testDataDirName)
+
+	initialLimitTunnelProtocols := protocol.TunnelProtocols{"UNFRONTED-MEEK-HTTPS-OSSH"}
+	initialLimitTunnelProtocolsCandidateCount := 50
+	limitTunnelProtocols := protocol.TunnelProtocols{"UNFRONTED-MEEK-OSSH"}
+
+	var noticeMutex sync.Mutex
+	initialConnectingCount := 0
+	connectingCount := 0
+	exitConnectingCount := 0
+	unexpectedProtocols := make(map[string]bool)
+
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err != nil || noticeType != "ConnectingServer" {
+				return
+			}
+
+			noticeMutex.Lock()
+			defer noticeMutex.Unlock()
+
+			if payload["multiHopEntryDiagnosticID"] != nil {
+				exitConnectingCount += 1
+				return
+			}
+
+			connectingCount += 1
+
+			protocol := payload["protocol"].(string)
+
+			if common.Contains(initialLimitTunnelProtocols, protocol) {
+				initialConnectingCount += 1
+			} else if !common.Contains(limitTunnelProtocols, protocol) {
+				unexpectedProtocols[protocol] = true
+			}
+		}))
+
+	clientConfigJSON := `
+    {
+        "ClientPlatform" : "Windows",
+        "ClientVersion" : "0",
+        "SponsorId" : "0",
+        "PropagationChannelId" : "0",
+        "DisableRemoteServerListFetcher" : true,
+        "EnableMultiHop" : true
+    }`
+	clientConfig, err := LoadConfig([]byte(clientConfigJSON))
+	if err != nil {
+		t.Fatalf("error processing configuration file: %s", err)
+	}
+
+	clientConfig.DataRootDirectory = testDataDirName
+
+	err = clientConfig.Commit(false)
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	applyParameters := make(map[string]interface{})
+
+	applyParameters[parameters.ConnectionWorkerPoolSize] = 10
+	applyParameters[parameters.TunnelConnectTimeout] = "1s"
+	applyParameters[parameters.EstablishTunnelPausePeriod] = "1s"
+	applyParameters[parameters.InitialLimitTunnelProtocols] = initialLimitTunnelProtocols
+	applyParameters[parameters.InitialLimitTunnelProtocolsCandidateCount] = initialLimitTunnelProtocolsCandidateCount
+	applyParameters[parameters.LimitTunnelProtocols] = limitTunnelProtocols
+
+	err = clientConfig.SetClientParameters("", true, applyParameters)
+	if err != nil {
+		t.Fatalf("error setting client parameters: %s", err)
+	}
+
+	err = OpenDataStore(clientConfig)
+	if err != nil {
+		t.Fatalf("error initializing client datastore: %s", err)
+	}
+	defer CloseDataStore()
+
+	storeLimitProtocolsTestServerEntries(t)
 
 	controller, err := NewController(clientConfig)
 	if err != nil {
@@ -192,19 +308,73 @@ func TestLimitTunnelProtocols(t *testing.T) {
 		controller.Run(ctx)
 	}()
 
-	time.Sleep(10 * time.Second)
+	time.Sleep(5 * time.Second)
 
 	cancelFunc()
 
 	controllerWaitGroup.Wait()
 
+	noticeMutex.Lock()
+	defer noticeMutex.Unlock()
+
 	t.Logf("initial-connecting and connecting count: %d/%d", initialConnectingCount, connectingCount)
 
+	if len(unexpectedProtocols) > 0 {
+		t.Fatalf("unexpected protocols: %+v", unexpectedProtocols)
+	}
+
+	if exitConnectingCount != 0 {
+		t.Fatalf("unexpected exit connecting count")
+	}
+
 	if initialConnectingCount != initialLimitTunnelProtocolsCandidateCount {
 		t.Fatalf("unexpected initial-connecting count")
 	}
 
-	if connectingCount < 3*initialLimitTunnelProtocolsCandidateCount {
+	if connectingCount <= initialLimitTunnelProtocolsCandidateCount {
 		t.Fatalf("unexpected connecting count")
 	}
 }
+
+// storeLimitProtocolsTestServerEntries stores unreachable server entries for
+// all supported tunnel protocols.
+func storeLimitProtocolsTestServerEntries(t *testing.T) {
+
+	serverEntries := make([]map[string]interface{}, len(protocol.SupportedTunnelProtocols))
+
+	for i, tunnelProtocol := range protocol.SupportedTunnelProtocols {
+
+		_, _, _, _, encodedServerEntry, err := server.GenerateConfig(
+			&server.GenerateConfigParams{
+				ServerIPAddress:      fmt.Sprintf("0.1.0.0"),
+				EnableSSHAPIRequests: true,
+				WebServerPort:        8000,
+				TunnelProtocolPorts:  map[string]int{tunnelProtocol: 4000},
+			})
+		if err != nil {
+			t.Fatalf("error generating server config: %s", err)
+		}
+
+		serverEntryFields, err := protocol.DecodeServerEntryFields(
+			string(encodedServerEntry),
+			common.GetCurrentTimestamp(),
+			protocol.SERVER_ENTRY_SOURCE_REMOTE)
+		if err != nil {
+			t.Fatalf("error decoding server entry: %s", err)
+		}
+
+		serverEntries[i] = serverEntryFields
+	}
+
+	for i := 0; i < 1000; i++ {
+
+		serverEntryFields := serverEntries[i%len(protocol.SupportedTunnelProtocols)]
+
+		serverEntryFields["ipAddress"] = fmt.Sprintf("0.1.%d.%d", (i>>8)&0xFF, i&0xFF)
+
+		err := StoreServerEntry(serverEntryFields, true)
+		if err != nil {
+			t.Fatalf("error storing server entry: %s", err)
+		}
+	}
+}
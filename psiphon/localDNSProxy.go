@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"sync"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+var _LOCAL_DNS_PROXY_TYPE = "DNS"
+
+// localDNSProxy is a DNS server which accepts UDP and TCP requests on
+// LocalDNSProxyAddress and resolves them with a tunneledDNSResolver. Local
+// applications, including those using the local SOCKS and HTTP proxies, may
+// use the DNS proxy to obtain tunneled, encrypted DNS resolution.
+type localDNSProxy struct {
+	tunneler               Tunneler
+	resolver               *tunneledDNSResolver
+	packetConn             net.PacketConn
+	listener               net.Listener
+	serveWaitGroup         *sync.WaitGroup
+	openConns              *common.Conns
+	stopListeningBroadcast chan struct{}
+}
+
+// newLocalDNSProxy initializes a new local DNS proxy. It begins listening
+// for UDP requests and TCP connections, starts goroutines that run the read
+// and accept loops, and returns leaving those loops running.
+func newLocalDNSProxy(
+	config *Config,
+	tunneler Tunneler,
+	resolver *tunneledDNSResolver) (*localDNSProxy, error) {
+
+	packetConn, err := net.ListenPacket("udp", config.LocalDNSProxyAddress)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// The TCP listener uses the UDP listener's address, so that both use
+	// the same port when LocalDNSProxyAddress specifies port 0.
+
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		packetConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	proxy := &localDNSProxy{
+		tunneler:               tunneler,
+		resolver:               resolver,
+		packetConn:             packetConn,
+		listener:               listener,
+		serveWaitGroup:         new(sync.WaitGroup),
+		openConns:              common.NewConns(),
+		stopListeningBroadcast: make(chan struct{}),
+	}
+
+	proxy.serveWaitGroup.Add(2)
+	go proxy.serveUDP()
+	go proxy.serveTCP()
+
+	NoticeListeningLocalDNSProxy(packetConn.LocalAddr().String())
+
+	return proxy, nil
+}
+
+// close terminates the listeners, closes all open TCP connections, and waits
+// for all request handlers to complete.
+func (proxy *localDNSProxy) close() {
+	close(proxy.stopListeningBroadcast)
+	proxy.packetConn.Close()
+	proxy.listener.Close()
+	proxy.openConns.CloseAll()
+	proxy.serveWaitGroup.Wait()
+}
+
+func (proxy *localDNSProxy) serveUDP() {
+	defer proxy.serveWaitGroup.Done()
+
+	buffer := make([]byte, dns.MaxMsgSize)
+
+loop:
+	for {
+		n, addr, err := proxy.packetConn.ReadFrom(buffer)
+		select {
+		case <-proxy.stopListeningBroadcast:
+			break loop
+		default:
+		}
+		if err != nil {
+			NoticeWarning("DNS proxy read error: %s", err)
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				// Temporary error, keep running
+				continue
+			}
+			// Fatal error, stop the proxy
+			proxy.tunneler.SignalComponentFailure()
+			break loop
+		}
+
+		// Requests are handled concurrently, as each may require a resolver
+		// round trip through the tunnel.
+
+		requestPacket := append([]byte(nil), buffer[:n]...)
+
+		proxy.serveWaitGroup.Add(1)
+		go func() {
+			defer proxy.serveWaitGroup.Done()
+			responsePacket, err := proxy.resolver.handleRequestPacket(requestPacket, true)
+			if err == nil {
+				_, err = proxy.packetConn.WriteTo(responsePacket, addr)
+			}
+			if err != nil {
+				NoticeLocalProxyError(_LOCAL_DNS_PROXY_TYPE, errors.Trace(err))
+			}
+		}()
+	}
+	NoticeInfo("DNS proxy UDP listener stopped")
+}
+
+func (proxy *localDNSProxy) serveTCP() {
+	defer proxy.serveWaitGroup.Done()
+
+loop:
+	for {
+		conn, err := proxy.listener.Accept()
+		select {
+		case <-proxy.stopListeningBroadcast:
+			if err == nil {
+				conn.Close()
+			}
+			break loop
+		default:
+		}
+		if err != nil {
+			NoticeWarning("DNS proxy accept error: %s", err)
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				// Temporary error, keep running
+				continue
+			}
+			// Fatal error, stop the proxy
+			proxy.tunneler.SignalComponentFailure()
+			break loop
+		}
+
+		proxy.serveWaitGroup.Add(1)
+		go func() {
+			defer proxy.serveWaitGroup.Done()
+			defer conn.Close()
+			if !proxy.openConns.Add(conn) {
+				return
+			}
+			defer proxy.openConns.Remove(conn)
+			err := proxy.resolver.serveStream(conn)
+			if err != nil {
+				NoticeLocalProxyError(_LOCAL_DNS_PROXY_TYPE, errors.Trace(err))
+			}
+		}()
+	}
+	NoticeInfo("DNS proxy TCP listener stopped")
+}
@@ -0,0 +1,283 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+)
+
+// LocalProxyCredential is a username and password which a local SOCKS or
+// HTTP proxy client may use to authenticate. See
+// Config.LocalProxyCredentials.
+type LocalProxyCredential struct {
+	Username string
+	Password string
+}
+
+func validateLocalProxyCredentials(credentials []LocalProxyCredential) error {
+
+	usernames := make(map[string]bool)
+
+	for _, credential := range credentials {
+
+		// RFC 1929 limits the username and password to 255 bytes each, and
+		// the HTTP Basic authentication scheme can't represent usernames
+		// containing ":".
+
+		if len(credential.Username) < 1 || len(credential.Username) > 255 ||
+			strings.Contains(credential.Username, ":") {
+			return errors.Tracef("invalid username: %s", credential.Username)
+		}
+
+		if len(credential.Password) < 1 || len(credential.Password) > 255 {
+			return errors.Tracef("invalid password for username: %s", credential.Username)
+		}
+
+		if usernames[credential.Username] {
+			return errors.Tracef("duplicate username: %s", credential.Username)
+		}
+		usernames[credential.Username] = true
+	}
+
+	return nil
+}
+
+// localProxyAuthenticator checks local proxy client credentials and
+// accounts for bytes transferred by authenticated clients. Per-username byte
+// totals are periodically reported in LocalProxyBytesTransferred notices.
+type localProxyAuthenticator struct {
+	proxyType     string
+	credentials   []LocalProxyCredential
+	stats         map[string]*localProxyCredentialStats
+	stopBroadcast chan struct{}
+	waitGroup     *sync.WaitGroup
+}
+
+type localProxyCredentialStats struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	bytesSent        int64
+	bytesReceived    int64
+	reportedSent     int64
+	reportedReceived int64
+}
+
+// newLocalProxyAuthenticator creates a localProxyAuthenticator for the
+// specified proxy type. When no credentials are configured, no
+// authentication is required and newLocalProxyAuthenticator returns nil.
+func newLocalProxyAuthenticator(
+	config *Config, proxyType string) *localProxyAuthenticator {
+
+	if len(config.LocalProxyCredentials) == 0 {
+		return nil
+	}
+
+	authenticator := &localProxyAuthenticator{
+		proxyType:     proxyType,
+		credentials:   config.LocalProxyCredentials,
+		stats:         make(map[string]*localProxyCredentialStats),
+		stopBroadcast: make(chan struct{}),
+		waitGroup:     new(sync.WaitGroup),
+	}
+
+	for _, credential := range config.LocalProxyCredentials {
+		authenticator.stats[credential.Username] = &localProxyCredentialStats{}
+	}
+
+	p := config.GetClientParameters().Get()
+	noticePeriod := p.Duration(parameters.LocalProxyBytesTransferredNoticePeriod)
+
+	authenticator.waitGroup.Add(1)
+	go authenticator.run(noticePeriod)
+
+	return authenticator
+}
+
+// close stops the notice reporter and reports final totals.
+func (authenticator *localProxyAuthenticator) close() {
+	close(authenticator.stopBroadcast)
+	authenticator.waitGroup.Wait()
+}
+
+func (authenticator *localProxyAuthenticator) run(noticePeriod time.Duration) {
+	defer authenticator.waitGroup.Done()
+
+	ticker := time.NewTicker(noticePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			authenticator.reportBytesTransferred()
+		case <-authenticator.stopBroadcast:
+			authenticator.reportBytesTransferred()
+			return
+		}
+	}
+}
+
+// reportBytesTransferred emits a notice for each username with bytes
+// transferred since the previous report.
+func (authenticator *localProxyAuthenticator) reportBytesTransferred() {
+
+	for _, credential := range authenticator.credentials {
+
+		stats := authenticator.stats[credential.Username]
+
+		sent := atomic.LoadInt64(&stats.bytesSent)
+		received := atomic.LoadInt64(&stats.bytesReceived)
+
+		if sent == stats.reportedSent && received == stats.reportedReceived {
+			continue
+		}
+
+		NoticeLocalProxyBytesTransferred(
+			authenticator.proxyType, credential.Username, sent, received)
+
+		stats.reportedSent = sent
+		stats.reportedReceived = received
+	}
+}
+
+// authenticate checks the username and password and, when valid, returns
+// the stats for the username.
+func (authenticator *localProxyAuthenticator) authenticate(
+	username, password string) (*localProxyCredentialStats, bool) {
+
+	// All credentials are checked, using constant time comparisons, so that
+	// response timing doesn't reveal valid usernames.
+
+	var stats *localProxyCredentialStats
+
+	for _, credential := range authenticator.credentials {
+		usernameMatch := subtle.ConstantTimeCompare(
+			[]byte(username), []byte(credential.Username))
+		passwordMatch := subtle.ConstantTimeCompare(
+			[]byte(password), []byte(credential.Password))
+		if usernameMatch&passwordMatch == 1 {
+			stats = authenticator.stats[credential.Username]
+		}
+	}
+
+	return stats, stats != nil
+}
+
+// authenticateHTTPRequest checks the "Proxy-Authorization: Basic"
+// credentials in the request.
+func (authenticator *localProxyAuthenticator) authenticateHTTPRequest(
+	request *http.Request) (*localProxyCredentialStats, bool) {
+
+	const prefix = "Basic "
+
+	authorization := request.Header.Get("Proxy-Authorization")
+	if len(authorization) < len(prefix) ||
+		!strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return nil, false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return nil, false
+	}
+
+	credentials := strings.SplitN(string(decoded), ":", 2)
+	if len(credentials) != 2 {
+		return nil, false
+	}
+
+	return authenticator.authenticate(credentials[0], credentials[1])
+}
+
+// localProxyAccountingConn counts bytes relayed for an authenticated local
+// proxy client. Bytes read from the conn are bytes sent by the client.
+type localProxyAccountingConn struct {
+	net.Conn
+	stats *localProxyCredentialStats
+}
+
+func newLocalProxyAccountingConn(
+	conn net.Conn, stats *localProxyCredentialStats) *localProxyAccountingConn {
+
+	return &localProxyAccountingConn{Conn: conn, stats: stats}
+}
+
+func (conn *localProxyAccountingConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	atomic.AddInt64(&conn.stats.bytesSent, int64(n))
+	return n, err
+}
+
+func (conn *localProxyAccountingConn) Write(buffer []byte) (int, error) {
+	n, err := conn.Conn.Write(buffer)
+	atomic.AddInt64(&conn.stats.bytesReceived, int64(n))
+	return n, err
+}
+
+// localProxyAccountingReader counts HTTP request body bytes sent by an
+// authenticated local proxy client.
+type localProxyAccountingReader struct {
+	io.ReadCloser
+	stats *localProxyCredentialStats
+}
+
+func (reader *localProxyAccountingReader) Read(buffer []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(buffer)
+	atomic.AddInt64(&reader.stats.bytesSent, int64(n))
+	return n, err
+}
+
+// localProxyAccountingResponseWriter counts HTTP response body bytes
+// received by an authenticated local proxy client. Hijacked connections are
+// also counted.
+type localProxyAccountingResponseWriter struct {
+	http.ResponseWriter
+	stats *localProxyCredentialStats
+}
+
+func (writer *localProxyAccountingResponseWriter) Write(buffer []byte) (int, error) {
+	n, err := writer.ResponseWriter.Write(buffer)
+	atomic.AddInt64(&writer.stats.bytesReceived, int64(n))
+	return n, err
+}
+
+func (writer *localProxyAccountingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := writer.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.TraceNew("responseWriter is not an http.Hijacker")
+	}
+	conn, readWriter, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return newLocalProxyAccountingConn(conn, writer.stats), readWriter, nil
+}
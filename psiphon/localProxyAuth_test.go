@@ -0,0 +1,391 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+func TestLocalProxyAuthentication(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-local-proxy-auth-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	var noticesMutex sync.Mutex
+	bytesTransferred := make(map[string][2]int64)
+
+	SetNoticeWriter(NewNoticeReceiver(
+		func(notice []byte) {
+			noticeType, payload, err := GetNotice(notice)
+			if err != nil || noticeType != "LocalProxyBytesTransferred" {
+				return
+			}
+			noticesMutex.Lock()
+			defer noticesMutex.Unlock()
+			key := fmt.Sprintf("%s-%s", payload["proxyType"], payload["username"])
+			bytesTransferred[key] = [2]int64{
+				int64(payload["sent"].(float64)),
+				int64(payload["received"].(float64)),
+			}
+		}))
+	defer SetNoticeWriter(ioutil.Discard)
+
+	// Test: invalid credentials are rejected
+
+	invalidCredentials := [][]LocalProxyCredential{
+		{{Username: "", Password: "password"}},
+		{{Username: "user:name", Password: "password"}},
+		{{Username: "username", Password: ""}},
+		{{Username: "username", Password: "a"}, {Username: "username", Password: "b"}},
+	}
+
+	for _, credentials := range invalidCredentials {
+		config := &Config{
+			PropagationChannelId:  "0",
+			SponsorId:             "0",
+			DataRootDirectory:     testDataDirName,
+			LocalProxyCredentials: credentials,
+		}
+		err = config.Commit(false)
+		if err == nil {
+			t.Fatalf("unexpected Commit success: %+v", credentials)
+		}
+	}
+
+	config := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataRootDirectory:    testDataDirName,
+		LocalProxyCredentials: []LocalProxyCredential{
+			{Username: "alice", Password: "alice-password"},
+			{Username: "bob", Password: "bob-password"},
+		},
+	}
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("Commit failed: %s", err)
+	}
+
+	tunneler := &testEchoTunneler{}
+
+	socksProxy, err := NewSocksProxy(config, tunneler, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+
+	httpProxy, err := NewHttpProxy(config, tunneler, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewHttpProxy failed: %s", err)
+	}
+
+	socksAddr := socksProxy.listener.Addr().String()
+	httpAddr := httpProxy.listener.Addr().String()
+
+	payload := []byte("payload")
+
+	// Test: SOCKS5 without authentication is rejected
+
+	conn, err := net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	_, _ = conn.Write([]byte{0x05, 0x01, 0x00})
+	response := make([]byte, 2)
+	_, err = io.ReadFull(conn, response)
+	if err != nil || !bytes.Equal(response, []byte{0x05, 0xFF}) {
+		t.Fatalf("unexpected SOCKS5 no authentication response: %x", response)
+	}
+	conn.Close()
+
+	// Test: SOCKS4a is rejected
+
+	conn, err = net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	_, _ = conn.Write([]byte{0x04, 0x01, 0x00, 0x50, 192, 0, 2, 1, 0x00})
+	response = make([]byte, 8)
+	_, err = io.ReadFull(conn, response)
+	if err != nil || response[1] != 0x5B {
+		t.Fatalf("unexpected SOCKS4a response: %x", response)
+	}
+	conn.Close()
+
+	// Test: SOCKS5 with an invalid password is rejected
+
+	conn, err = net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	err = testSocksAuthenticate(conn, "alice", "bob-password")
+	if err == nil {
+		t.Fatalf("unexpected SOCKS5 authentication success")
+	}
+	conn.Close()
+
+	// Test: SOCKS5 with valid credentials is relayed and counted
+
+	conn, err = net.Dial("tcp", socksAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	err = testSocksAuthenticate(conn, "alice", "alice-password")
+	if err != nil {
+		t.Fatalf("testSocksAuthenticate failed: %s", err)
+	}
+	_, _ = conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 192, 0, 2, 1, 0x00, 0x50})
+	response = make([]byte, 10)
+	_, err = io.ReadFull(conn, response)
+	if err != nil || response[1] != 0x00 {
+		t.Fatalf("unexpected SOCKS5 CONNECT response: %x", response)
+	}
+	err = testEcho(conn, payload)
+	if err != nil {
+		t.Fatalf("testEcho failed: %s", err)
+	}
+	conn.Close()
+
+	// Test: HTTP CONNECT without credentials is rejected
+
+	conn, err = net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	httpResponse, err := testHTTPConnect(conn, "")
+	if err != nil || httpResponse.StatusCode != http.StatusProxyAuthRequired ||
+		httpResponse.Header.Get("Proxy-Authenticate") == "" {
+		t.Fatalf("unexpected HTTP CONNECT response: %+v %v", httpResponse, err)
+	}
+	conn.Close()
+
+	// Test: HTTP CONNECT with valid credentials is relayed and counted
+
+	conn, err = net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	httpResponse, err = testHTTPConnect(conn, "bob:bob-password")
+	if err != nil || httpResponse.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected HTTP CONNECT response: %+v %v", httpResponse, err)
+	}
+	err = testEcho(conn, payload)
+	if err != nil {
+		t.Fatalf("testEcho failed: %s", err)
+	}
+	conn.Close()
+
+	// Test: HTTP absolute-URI request without credentials is rejected
+
+	proxyURL, _ := url.Parse("http://" + httpAddr)
+	httpClient := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+	}
+	httpResponse, err = httpClient.Get("http://192.0.2.1/")
+	if err != nil || httpResponse.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("unexpected HTTP proxy response: %+v %v", httpResponse, err)
+	}
+	httpResponse.Body.Close()
+
+	// Test: URL proxy request from a loopback peer without credentials isn't
+	// rejected for missing credentials. The URL proxy closes the connection,
+	// without a response, as the origin URL is missing.
+
+	httpResponse, err = http.Get("http://" + httpAddr + "/direct/")
+	if err == nil {
+		httpResponse.Body.Close()
+		if httpResponse.StatusCode == http.StatusProxyAuthRequired {
+			t.Fatalf("unexpected URL proxy response: %+v", httpResponse)
+		}
+	}
+
+	// Test: URL proxy request from a non-loopback peer, such as another host
+	// on the LAN, without credentials is rejected
+
+	for _, remoteAddr := range []string{"192.168.0.2:50000", "[fd00::2]:50000"} {
+		request := httptest.NewRequest(
+			"GET", "/tunneled/"+url.QueryEscape("http://192.0.2.1/"), nil)
+		request.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		httpProxy.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusProxyAuthRequired ||
+			recorder.Header().Get("Proxy-Authenticate") == "" {
+			t.Fatalf("unexpected URL proxy response: %d", recorder.Code)
+		}
+	}
+
+	// Closing the proxies emits final LocalProxyBytesTransferred notices.
+
+	socksProxy.Close()
+	httpProxy.Close()
+
+	noticesMutex.Lock()
+	defer noticesMutex.Unlock()
+
+	// For HTTP CONNECT, the bytes received include the proxy's CONNECT
+	// response.
+	connectResponseLength := len("HTTP/1.1 200 OK\r\n\r\n")
+
+	expectedBytesTransferred := map[string][2]int64{
+		"SOCKS-alice": {int64(len(payload)), int64(len(payload))},
+		"HTTP-bob":    {int64(len(payload)), int64(len(payload) + connectResponseLength)},
+	}
+
+	if len(bytesTransferred) != len(expectedBytesTransferred) {
+		t.Fatalf("unexpected bytes transferred notices: %+v", bytesTransferred)
+	}
+	for key, expected := range expectedBytesTransferred {
+		if bytesTransferred[key] != expected {
+			t.Fatalf("unexpected bytes transferred for %s: %+v", key, bytesTransferred[key])
+		}
+	}
+}
+
+func testSocksAuthenticate(conn net.Conn, username, password string) error {
+
+	_, err := conn.Write([]byte{0x05, 0x02, 0x00, 0x02})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	response := make([]byte, 2)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !bytes.Equal(response, []byte{0x05, 0x02}) {
+		return errors.TraceNew("unexpected method response")
+	}
+
+	request := []byte{0x01, byte(len(username))}
+	request = append(request, username...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+
+	_, err = conn.Write(request)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !bytes.Equal(response, []byte{0x01, 0x00}) {
+		return errors.TraceNew("authentication failed")
+	}
+
+	return nil
+}
+
+func testHTTPConnect(conn net.Conn, credentials string) (*http.Response, error) {
+
+	request := "CONNECT 192.0.2.1:443 HTTP/1.1\r\nHost: 192.0.2.1:443\r\n"
+	if credentials != "" {
+		request += "Proxy-Authorization: Basic " +
+			base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+	}
+	request += "\r\n"
+
+	_, err := conn.Write([]byte(request))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Read the response without buffering, so no relayed bytes are consumed.
+	response, err := http.ReadResponse(
+		bufio.NewReaderSize(&testByteReader{conn: conn}, 16), nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return response, nil
+}
+
+func testEcho(conn net.Conn, payload []byte) error {
+
+	_, err := conn.Write(payload)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	echo := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, echo)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !bytes.Equal(echo, payload) {
+		return errors.TraceNew("unexpected echo")
+	}
+
+	return nil
+}
+
+// testByteReader reads one byte at a time.
+type testByteReader struct {
+	conn net.Conn
+}
+
+func (reader *testByteReader) Read(buffer []byte) (int, error) {
+	if len(buffer) == 0 {
+		return 0, nil
+	}
+	return reader.conn.Read(buffer[:1])
+}
+
+// testEchoTunneler is a Tunneler which echoes all data sent through
+// tunneled connections.
+type testEchoTunneler struct {
+}
+
+func (tunneler *testEchoTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	clientConn, serverConn := net.Pipe()
+
+	go func() {
+		defer serverConn.Close()
+		_, _ = io.Copy(serverConn, serverConn)
+	}()
+
+	return clientConn, nil
+}
+
+func (tunneler *testEchoTunneler) DirectDial(remoteAddr string) (net.Conn, error) {
+	return nil, errors.TraceNew("not supported")
+}
+
+func (tunneler *testEchoTunneler) SignalComponentFailure() {
+}
@@ -26,6 +26,7 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	std_errors "errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -45,6 +46,7 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/websocket"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/upstreamproxy"
 	"golang.org/x/crypto/nacl/box"
 )
@@ -87,6 +89,13 @@ type MeekConfig struct {
 	// Ignored when UseQUIC is true.
 	UseHTTPS bool
 
+	// UseWebSocket indicates whether to upgrade the initial meek HTTP
+	// request to a WebSocket connection, which then carries all tunnel
+	// traffic, instead of relaying traffic with polling HTTP round trips.
+	// Ignored when UseQUIC or RoundTripperOnly is true. When UseHTTPS is
+	// true and the server negotiates HTTP/2, meek relaying is used instead.
+	UseWebSocket bool
+
 	// TLSProfile specifies the value for CustomTLSConfig.TLSProfile for all
 	// underlying TLS connections created by this meek connection.
 	TLSProfile string
@@ -154,8 +163,17 @@ type MeekConfig struct {
 //
 // MeekConn also operates in unfronted mode, in which plain HTTP connections are made without routing
 // through a CDN.
+//
+// In WebSocket mode, the initial meek HTTP request, with the meek cookie, is an upgrade request and
+// all tunnel traffic is then relayed over the resulting WebSocket connection, with no polling.
+//
+// In HTTP/2 streaming mode, when HTTP/2 is negotiated, the first polling round trip is followed by
+// a single, long-lived request which carries upstream traffic in its request body and downstream
+// traffic in its response body, with no polling. Polling continues while the stream is pending and
+// when the server does not accept the stream.
 type MeekConn struct {
 	clientParameters          *parameters.ClientParameters
+	diagnosticID              string
 	networkLatencyMultiplier  float64
 	isQUIC                    bool
 	url                       *url.URL
@@ -172,6 +190,10 @@ type MeekConn struct {
 	runCtx                    context.Context
 	stopRunning               context.CancelFunc
 	relayWaitGroup            *sync.WaitGroup
+	useHTTP2Streaming         bool
+
+	// For WebSocket mode
+	webSocketConn net.Conn
 
 	// For round tripper mode
 	roundTripperOnly              bool
@@ -218,6 +240,8 @@ func DialMeek(
 	cleanupStopRunning := true
 	cleanupCachedTLSDialer := true
 	var cachedTLSDialer *cachedTLSDialer
+	cleanupWebSocketConn := true
+	var webSocketConn net.Conn
 
 	// Cleanup in error cases
 	defer func() {
@@ -227,10 +251,18 @@ func DialMeek(
 		if cleanupCachedTLSDialer && cachedTLSDialer != nil {
 			cachedTLSDialer.close()
 		}
+		if cleanupWebSocketConn && webSocketConn != nil {
+			webSocketConn.Close()
+		}
 	}()
 
+	useWebSocket := meekConfig.UseWebSocket &&
+		!meekConfig.UseQUIC &&
+		!meekConfig.RoundTripperOnly
+
 	meek = &MeekConn{
 		clientParameters:         meekConfig.ClientParameters,
+		diagnosticID:             meekConfig.DiagnosticID,
 		networkLatencyMultiplier: meekConfig.NetworkLatencyMultiplier,
 		isClosed:                 false,
 		runCtx:                   runCtx,
@@ -413,23 +445,64 @@ func DialMeek(
 			return nil, errors.Trace(err)
 		}
 
-		cachedTLSDialer = newCachedTLSDialer(preConn, tlsDialer)
+		// WebSocket upgrades require HTTP/1.1. The ClientHello retains the
+		// ALPN of the TLS profile, which typically offers "h2", so as not to
+		// deviate from the mimicked browser. When the server negotiates
+		// HTTP/2, fall back to relaying with meek over HTTP/2; the meek
+		// server accepts both WebSocket upgrades and meek requests.
+
+		if useWebSocket && IsTLSConnUsingHTTP2(preConn) {
+			NoticeInfo(
+				"negotiated HTTP/2 for %s; using meek instead of WebSocket",
+				meekConfig.DiagnosticID)
+			useWebSocket = false
+		}
+
+		if useWebSocket {
+
+			// In WebSocket mode, the pre-dialed connection is upgraded and
+			// there are no subsequent dials, so no HTTP transport is created.
+
+			webSocketConn = preConn
 
-		if IsTLSConnUsingHTTP2(preConn) {
-			NoticeInfo("negotiated HTTP/2 for %s", meekConfig.DiagnosticID)
-			transport = &http2.Transport{
-				DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
-					return cachedTLSDialer.dial(network, addr)
-				},
-			}
 		} else {
-			transport = &http.Transport{
-				DialTLS: func(network, addr string) (net.Conn, error) {
-					return cachedTLSDialer.dial(network, addr)
-				},
+
+			cachedTLSDialer = newCachedTLSDialer(preConn, tlsDialer)
+
+			if IsTLSConnUsingHTTP2(preConn) {
+				NoticeInfo("negotiated HTTP/2 for %s", meekConfig.DiagnosticID)
+				transport = &http2.Transport{
+					DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+						return cachedTLSDialer.dial(network, addr)
+					},
+				}
+				meek.useHTTP2Streaming = !meek.roundTripperOnly &&
+					meek.getCustomClientParameters().WeightedCoinFlip(
+						parameters.MeekHTTP2StreamingProbability)
+			} else {
+				transport = &http.Transport{
+					DialTLS: func(network, addr string) (net.Conn, error) {
+						return cachedTLSDialer.dial(network, addr)
+					},
+				}
 			}
 		}
 
+	} else if useWebSocket {
+
+		scheme = "http"
+
+		// The WebSocket upgrade is made on a single TCP connection to
+		// meekConfig.DialAddress. Unlike the HTTP transport case below, an
+		// HTTP upstream proxy must support CONNECT.
+
+		var err error
+		webSocketConn, err = NewTCPDialer(dialConfig)(
+			ctx, "tcp", meekConfig.DialAddress)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
 	} else {
 
 		scheme = "http"
@@ -512,6 +585,21 @@ func DialMeek(
 	meek.cachedTLSDialer = cachedTLSDialer
 	meek.transport = transport
 
+	if useWebSocket {
+
+		meek.webSocketConn, err = meek.upgradeToWebSocket(ctx, webSocketConn)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		// stopRunning and webSocketConn will now be closed in meek.Close().
+		// No relay resources are allocated in WebSocket mode.
+		cleanupStopRunning = false
+		cleanupWebSocketConn = false
+
+		return meek, nil
+	}
+
 	// stopRunning and cachedTLSDialer will now be closed in meek.Close()
 	cleanupStopRunning = false
 	cleanupCachedTLSDialer = false
@@ -570,6 +658,30 @@ func DialMeek(
 	return meek, nil
 }
 
+// upgradeToWebSocket sends the meek cookie in a WebSocket upgrade request on
+// conn, and returns the resulting WebSocket connection, which carries the
+// tunnel traffic. As in relay mode, the server uses the cookie to create a
+// new session and applies meek rate limiting.
+func (meek *MeekConn) upgradeToWebSocket(
+	ctx context.Context, conn net.Conn) (net.Conn, error) {
+
+	request, err := http.NewRequest("GET", meek.url.String(), nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	meek.addAdditionalHeaders(request)
+
+	request.AddCookie(meek.cookie)
+
+	webSocketConn, err := websocket.ClientHandshake(ctx, conn, request)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return webSocketConn, nil
+}
+
 type cachedTLSDialer struct {
 	usedCachedConn int32
 	cachedConn     net.Conn
@@ -627,6 +739,12 @@ func (meek *MeekConn) Close() (err error) {
 	meek.isClosed = true
 	meek.mutex.Unlock()
 
+	if !isClosed && meek.webSocketConn != nil {
+		meek.stopRunning()
+		meek.webSocketConn.Close()
+		return nil
+	}
+
 	if !isClosed {
 		meek.stopRunning()
 		if meek.cachedTLSDialer != nil {
@@ -762,6 +880,9 @@ func (meek *MeekConn) Read(buffer []byte) (n int, err error) {
 	if meek.IsClosed() {
 		return 0, errors.TraceNew("meek connection is closed")
 	}
+	if meek.webSocketConn != nil {
+		return meek.webSocketConn.Read(buffer)
+	}
 	// Block until there is received data to consume
 	var receiveBuffer *bytes.Buffer
 	select {
@@ -784,6 +905,9 @@ func (meek *MeekConn) Write(buffer []byte) (n int, err error) {
 	if meek.IsClosed() {
 		return 0, errors.TraceNew("meek connection is closed")
 	}
+	if meek.webSocketConn != nil {
+		return meek.webSocketConn.Write(buffer)
+	}
 	// Repeats until all n bytes are written
 	n = len(buffer)
 	for len(buffer) > 0 {
@@ -873,16 +997,24 @@ func (meek *MeekConn) relay() {
 	timeout := time.NewTimer(interval)
 	defer timeout.Stop()
 
+	attemptedStreaming := false
+
+	// streamResult receives the result of a pending HTTP/2 streaming
+	// request, and is nil when no streaming request is pending.
+	var streamResult chan *meekStream
+
 	for {
 		timeout.Reset(interval)
 
 		// Block until there is payload to send or it is time to poll
 		var sendBuffer *bytes.Buffer
+		var stream *meekStream
 		select {
 		case sendBuffer = <-meek.partialSendBuffer:
 		case sendBuffer = <-meek.fullSendBuffer:
 		case <-timeout.C:
 			// In the polling case, send an empty payload
+		case stream = <-streamResult:
 		case <-meek.runCtx.Done():
 			// Drop through to second Done() check
 		}
@@ -894,6 +1026,20 @@ func (meek *MeekConn) relay() {
 		default:
 		}
 
+		// The streaming request has completed. No round trip is in flight,
+		// so all polling response payload has been received and, if the
+		// stream was accepted, it may now relay all further traffic.
+
+		if stream != nil {
+			streamResult = nil
+			NoticeMeekHTTP2Streaming(meek.diagnosticID, stream.err)
+			if stream.err == nil {
+				meek.relayAcceptedStream(stream)
+				return
+			}
+			continue
+		}
+
 		sendPayloadSize := 0
 		if sendBuffer != nil {
 			sendPayloadSize = sendBuffer.Len()
@@ -910,6 +1056,24 @@ func (meek *MeekConn) relay() {
 
 		receivedPayloadSize, err := meek.relayRoundTrip(sendBuffer)
 
+		// When the server rejects the round trip because the stream has been
+		// accepted, the request payload remains in the send buffer and is
+		// sent over the stream once the streaming response arrives.
+
+		if std_errors.Is(err, errMeekStreamActive) && streamResult != nil {
+			select {
+			case stream = <-streamResult:
+			case <-meek.runCtx.Done():
+				return
+			}
+			NoticeMeekHTTP2Streaming(meek.diagnosticID, stream.err)
+			if stream.err == nil {
+				meek.relayAcceptedStream(stream)
+				return
+			}
+			err = stream.err
+		}
+
 		if err != nil {
 			select {
 			case <-meek.runCtx.Done():
@@ -923,6 +1087,20 @@ func (meek *MeekConn) relay() {
 			return
 		}
 
+		// Once the first round trip has established the meek session,
+		// attempt to switch to HTTP/2 streaming. Polling continues while the
+		// streaming request is pending. A stream, once accepted, relays all
+		// further traffic; otherwise, polling continues.
+
+		if meek.useHTTP2Streaming && !attemptedStreaming {
+			attemptedStreaming = true
+
+			streamResult, err = meek.startStream()
+			if err != nil {
+				NoticeMeekHTTP2Streaming(meek.diagnosticID, err)
+			}
+		}
+
 		// Periodically re-dial the underlying TLS connection.
 
 		if prng.FlipWeightedCoin(meek.redialTLSProbability) {
@@ -972,6 +1150,214 @@ func (meek *MeekConn) relay() {
 	}
 }
 
+// meekStream is the result of an HTTP/2 streaming request. When err is nil,
+// the server has accepted the stream.
+type meekStream struct {
+	ctx        context.Context
+	response   *http.Response
+	bodyReader *io.PipeReader
+	bodyWriter *io.PipeWriter
+	cancelFunc context.CancelFunc
+	err        error
+}
+
+// errMeekStreamActive indicates that the server rejected a polling request
+// because it has accepted a stream for the meek session.
+var errMeekStreamActive = std_errors.New("meek stream active")
+
+// startStream sends a streaming request: a single, long-lived HTTP/2
+// request which, once accepted, carries upstream traffic in its request body
+// and downstream traffic in its response body.
+//
+// No payload is sent until the server accepts the stream, by responding
+// with the echoed streaming header, so when the stream is not accepted the
+// caller may continue polling with no loss of data. The streaming request
+// runs concurrently with polling, and the returned channel receives the
+// result.
+func (meek *MeekConn) startStream() (chan *meekStream, error) {
+
+	bodyReader, bodyWriter := io.Pipe()
+
+	// The request, including the meek cookie, is initialized here, in the
+	// relay goroutine, as polling round trips may update the cookie.
+
+	request, cancelFunc, err := meek.newRequest(
+		meek.runCtx, nil, bodyReader, 0)
+	if err != nil {
+		bodyWriter.Close()
+		return nil, errors.Trace(err)
+	}
+
+	request.Header.Set(protocol.MEEK_HTTP2_STREAMING_HEADER, "1")
+
+	establishTimeout := meek.getCustomClientParameters().Duration(
+		parameters.MeekHTTP2StreamingEstablishTimeout)
+
+	streamResult := make(chan *meekStream, 1)
+
+	meek.relayWaitGroup.Add(1)
+	go func() {
+		defer meek.relayWaitGroup.Done()
+
+		stream := &meekStream{
+			ctx:        request.Context(),
+			bodyReader: bodyReader,
+			bodyWriter: bodyWriter,
+			cancelFunc: cancelFunc,
+		}
+
+		stream.response, stream.err = meek.awaitStream(
+			request, cancelFunc, establishTimeout)
+
+		if stream.err != nil {
+			cancelFunc()
+			bodyWriter.Close()
+		}
+
+		streamResult <- stream
+	}()
+
+	return streamResult, nil
+}
+
+// awaitStream sends the streaming request and awaits the server response.
+func (meek *MeekConn) awaitStream(
+	request *http.Request,
+	cancelFunc context.CancelFunc,
+	establishTimeout time.Duration) (*http.Response, error) {
+
+	// A server which doesn't support streaming will await the end of the
+	// request body, so the stream is abandoned if the response doesn't
+	// arrive in time. Abandoning the stream doesn't disrupt the meek
+	// session, as no payload has been sent.
+
+	establishTimer := time.AfterFunc(establishTimeout, cancelFunc)
+
+	response, err := meek.transport.RoundTrip(request)
+
+	if !establishTimer.Stop() && err == nil {
+		response.Body.Close()
+		return nil, errors.TraceNew("establish timeout exceeded")
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if response.StatusCode != http.StatusOK ||
+		response.Header.Get(protocol.MEEK_HTTP2_STREAMING_HEADER) == "" {
+
+		response.Body.Close()
+		return nil, errors.Tracef(
+			"stream not accepted: status code %d", response.StatusCode)
+	}
+
+	return response, nil
+}
+
+// relayAcceptedStream relays all further traffic over an accepted stream. A
+// stream cannot be retried, as the server doesn't retain streamed response
+// payload; so relayAcceptedStream closes the meek connection when the
+// stream fails.
+func (meek *MeekConn) relayAcceptedStream(stream *meekStream) {
+
+	err := meek.relayStream(stream)
+
+	select {
+	case <-meek.runCtx.Done():
+		return
+	default:
+	}
+	NoticeWarning("%s", errors.Trace(err))
+	go meek.Close()
+}
+
+// relayStream sends and receives tunneled traffic over an accepted stream,
+// returning when the stream fails or the meek connection is closed.
+func (meek *MeekConn) relayStream(stream *meekStream) error {
+
+	defer stream.bodyWriter.Close()
+
+	// Relay until either direction fails. Then cancel the request and close
+	// the request body, which interrupts the other direction.
+
+	relayErrors := make(chan error, 2)
+
+	go func() {
+		relayErrors <- meek.readStream(stream.ctx, stream.response.Body)
+	}()
+
+	go func() {
+		relayErrors <- meek.writeStream(stream.ctx, stream.bodyWriter)
+	}()
+
+	err := <-relayErrors
+
+	stream.cancelFunc()
+	stream.bodyReader.Close()
+	stream.response.Body.Close()
+
+	<-relayErrors
+
+	return errors.Trace(err)
+}
+
+// readStream reads the stream response body into the receive buffer. Unlike
+// readPayload, which reads fixed-size chunks of a complete response, each
+// read is relayed as soon as it completes.
+func (meek *MeekConn) readStream(
+	ctx context.Context, responseBody io.Reader) error {
+
+	buffer := make([]byte, meek.readPayloadChunkLength)
+
+	for {
+		n, err := responseBody.Read(buffer)
+
+		if n > 0 {
+			// Block until there is capacity in the receive buffer
+			var receiveBuffer *bytes.Buffer
+			select {
+			case receiveBuffer = <-meek.emptyReceiveBuffer:
+			case receiveBuffer = <-meek.partialReceiveBuffer:
+			case <-ctx.Done():
+				return errors.Trace(ctx.Err())
+			}
+			receiveBuffer.Write(buffer[:n])
+			meek.replaceReceiveBuffer(receiveBuffer)
+		}
+
+		if err == io.EOF {
+			return errors.TraceNew("stream closed by server")
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// writeStream writes the send buffer to the stream request body, whenever
+// the send buffer contains data.
+func (meek *MeekConn) writeStream(
+	ctx context.Context, requestBody io.Writer) error {
+
+	for {
+		var sendBuffer *bytes.Buffer
+		select {
+		case sendBuffer = <-meek.partialSendBuffer:
+		case sendBuffer = <-meek.fullSendBuffer:
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		}
+
+		_, err := requestBody.Write(sendBuffer.Bytes())
+
+		sendBuffer.Truncate(0)
+		meek.replaceSendBuffer(sendBuffer)
+
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
 // readCloseSignaller is an io.ReadCloser wrapper for an io.Reader
 // that is passed, as the request body, to http.Transport.RoundTrip.
 // readCloseSignaller adds the AwaitClosed call, which is used
@@ -1204,6 +1590,25 @@ func (meek *MeekConn) relayRoundTrip(sendBuffer *bytes.Buffer) (int64, error) {
 
 		if err == nil {
 
+			// The server rejects a request, without reading its payload, once
+			// it has accepted a stream for the meek session. This is handled
+			// only for the first try: after a failed try, the server may
+			// have relayed the request payload and prepared a response which
+			// the stream won't deliver.
+
+			if try == 0 &&
+				response.StatusCode == http.StatusConflict &&
+				meek.useHTTP2Streaming {
+
+				response.Body.Close()
+				cancelFunc()
+				if sendBuffer != nil {
+					meek.replaceSendBuffer(sendBuffer)
+					sendBuffer = nil
+				}
+				return 0, errors.Trace(errMeekStreamActive)
+			}
+
 			if response.StatusCode != expectedStatusCode &&
 				// Certain http servers return 200 OK where we expect 206, so accept that.
 				!(expectedStatusCode == http.StatusPartialContent && response.StatusCode == http.StatusOK) {
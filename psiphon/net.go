@@ -33,6 +33,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Psiphon-Labs/dns"
@@ -261,6 +262,64 @@ func WaitForNetworkConnectivity(
 	}
 }
 
+// ipv6RouteProbeAddress is the destination used by hasIPv6Route. The address
+// is in the IPv6 documentation prefix, 2001:db8::/32 (RFC 3849), which isn't
+// routed on the internet but which is covered by any default IPv6 route. No
+// packets are sent to this address.
+const ipv6RouteProbeAddress = "[2001:db8::1]:53"
+
+// hasIPv6Route indicates whether the host has a route to the global IPv6
+// internet. The check connects a UDP socket, which performs a route lookup
+// but sends no packets, and checks that the selected source address is a
+// global unicast address. The socket is bound using the DialConfig
+// DeviceBinder, so that the route lookup matches that of dials using the
+// same DialConfig.
+//
+// A route doesn't guarantee IPv6 connectivity; dials that use IPv6 may still
+// fail, in which case replay of those dial parameters is abandoned as usual.
+func hasIPv6Route(config *DialConfig) bool {
+
+	dialer := &net.Dialer{}
+
+	if config.DeviceBinder != nil {
+		dialer.Control = func(_, _ string, rawConn syscall.RawConn) error {
+			var bindErr error
+			err := rawConn.Control(func(fd uintptr) {
+				_, bindErr = config.DeviceBinder.BindToDevice(int(fd))
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if bindErr != nil {
+				return errors.Tracef("BindToDevice failed: %s", bindErr)
+			}
+			return nil
+		}
+	}
+
+	conn, err := dialer.Dial("udp6", ipv6RouteProbeAddress)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	return isGlobalIPv6Address(localAddr.IP)
+}
+
+// isGlobalIPv6Address indicates whether IP is an IPv6 global unicast address.
+// Unlike net.IP.IsGlobalUnicast, unique local addresses, fc00::/7, which
+// aren't routed on the internet, are excluded.
+func isGlobalIPv6Address(IP net.IP) bool {
+	return IP.To4() == nil &&
+		IP.IsGlobalUnicast() &&
+		IP[0]&0xfe != 0xfc
+}
+
 // ResolveIP uses a custom dns stack to make a DNS query over the
 // given TCP or UDP conn. This is used, e.g., when we need to ensure
 // that a DNS connection bypasses a VPN interface (BindToDevice) or
@@ -434,11 +493,44 @@ func ResumeDownload(
 	downloadFilename string,
 	ifNoneMatchETag string) (int64, string, error) {
 
+	return ResumeStripedDownload(
+		ctx,
+		[]*http.Client{httpClient},
+		downloadURL,
+		userAgent,
+		downloadFilename,
+		ifNoneMatchETag)
+}
+
+// ResumeStripedDownload is ResumeDownload with multiple HTTP clients, each
+// typically dialing through a different tunnel. The first request is made
+// with the first client. When the response indicates that at least
+// 2*DOWNLOAD_STRIPE_MIN_BYTES remain, the remaining range is split into up
+// to len(httpClients) stripes; the first response body supplies the first
+// stripe while the remaining stripes are requested concurrently, one per
+// client, and each stripe is written into the partial download file at its
+// offset.
+//
+// Striping requires the server to support range requests and to return an
+// ETag, which is sent with each stripe request to ensure all stripes are
+// from the same object. When any stripe fails, the partial download is
+// truncated to its contiguous, completed prefix, which may be resumed as
+// usual.
+func ResumeStripedDownload(
+	ctx context.Context,
+	httpClients []*http.Client,
+	downloadURL string,
+	userAgent string,
+	downloadFilename string,
+	ifNoneMatchETag string) (int64, string, error) {
+
 	partialFilename := fmt.Sprintf("%s.part", downloadFilename)
 
 	partialETagFilename := fmt.Sprintf("%s.part.etag", downloadFilename)
 
-	file, err := os.OpenFile(partialFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	// The partial download file isn't opened with O_APPEND as stripes are
+	// written with WriteAt.
+	file, err := os.OpenFile(partialFilename, os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return 0, "", errors.Trace(err)
 	}
@@ -517,7 +609,7 @@ func ResumeDownload(
 		request.Header.Add("If-None-Match", ifNoneMatchETag)
 	}
 
-	response, err := httpClient.Do(request)
+	response, err := httpClients[0].Do(request)
 
 	// The resumeable download may ask for bytes past the resource range
 	// since it doesn't store the "completed download" state. In this case,
@@ -569,15 +661,75 @@ func ResumeDownload(
 	// succeeds in this one request.
 	ioutil.WriteFile(partialETagFilename, []byte(responseETag), 0600)
 
-	// A partial download occurs when this copy is interrupted. The io.Copy
-	// will fail, leaving a partial download in place (.part and .part.etag).
-	n, err := io.Copy(NewSyncFileWriter(file), response.Body)
+	stripes := makeDownloadStripes(
+		response, responseETag, fileInfo.Size(), len(httpClients))
+
+	waitGroup := new(sync.WaitGroup)
+
+	if len(stripes) > 1 {
+
+		// When the download is striped, the response to the initial,
+		// open-ended range request is discarded and the first stripe is
+		// requested with a bounded range, like all other stripes. Otherwise,
+		// the host server would continue to send the remainder of the object,
+		// duplicating the other stripes, until the connection is closed. This
+		// costs one additional round trip.
+
+		response.Body.Close()
+
+		for i := 0; i < len(stripes); i++ {
+			waitGroup.Add(1)
+			go func(stripe *downloadStripe, httpClient *http.Client) {
+				defer waitGroup.Done()
+				stripe.err = downloadStripeRange(
+					ctx, httpClient, downloadURL, userAgent, responseETag, file, stripe)
+			}(&stripes[i], httpClients[i])
+		}
+
+	} else {
+
+		// A partial download occurs when this copy is interrupted. The copy
+		// will fail, leaving a partial download in place (.part and .part.etag).
+		stripes[0].err = copyDownloadStripe(file, &stripes[0], response.Body)
+	}
+
+	waitGroup.Wait()
 
 	// From this point, n bytes are indicated as downloaded, even if there is
 	// an error; the caller may use this to report partial download progress.
 
-	if err != nil {
-		return n, "", errors.Trace(err)
+	for _, stripe := range stripes {
+		if stripe.err == nil {
+			continue
+		}
+
+		// Discard any data following the first incomplete stripe so that the
+		// partial download is contiguous. When there's only one stripe, the
+		// partial download is already contiguous. Only the retained,
+		// contiguous bytes are indicated as downloaded, as discarded bytes
+		// will be downloaded again when the download is resumed.
+		n := stripes[0].written
+		if len(stripes) > 1 {
+			size := fileInfo.Size()
+			for _, stripe := range stripes {
+				size += stripe.written
+				if stripe.written < stripe.length {
+					break
+				}
+			}
+			err := file.Truncate(size)
+			if err != nil {
+				NoticeWarning("truncate partial download failed: %s", err)
+			}
+			n = size - fileInfo.Size()
+		}
+
+		return n, "", errors.Trace(stripe.err)
+	}
+
+	var n int64
+	for _, stripe := range stripes {
+		n += stripe.written
 	}
 
 	// Ensure the file is flushed to disk. The deferred close
@@ -599,3 +751,130 @@ func ResumeDownload(
 
 	return n, responseETag, nil
 }
+
+// DOWNLOAD_STRIPE_MIN_BYTES is the minimum length of each stripe in a
+// striped download.
+const DOWNLOAD_STRIPE_MIN_BYTES = 1024 * 1024
+
+type downloadStripe struct {
+	offset  int64
+	length  int64
+	written int64
+	err     error
+}
+
+// makeDownloadStripes splits the remainder of a download into stripes,
+// given the response to the initial, open-ended range request. When the
+// download can't or shouldn't be striped, a single stripe with length -1,
+// meaning the entire response body, is returned.
+func makeDownloadStripes(
+	response *http.Response,
+	responseETag string,
+	offset int64,
+	maxStripes int) []downloadStripe {
+
+	stripes := []downloadStripe{{offset: offset, length: -1}}
+
+	if maxStripes < 2 ||
+		response.StatusCode != http.StatusPartialContent ||
+		responseETag == "" {
+		return stripes
+	}
+
+	var first, last, total int64
+	_, err := fmt.Sscanf(
+		response.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &total)
+	if err != nil || first != offset || last != total-1 {
+		return stripes
+	}
+
+	remaining := total - offset
+	count := remaining / DOWNLOAD_STRIPE_MIN_BYTES
+	if count > int64(maxStripes) {
+		count = int64(maxStripes)
+	}
+	if count < 2 {
+		return stripes
+	}
+
+	stripeLength := remaining / count
+
+	stripes = make([]downloadStripe, count)
+	for i := range stripes {
+		stripes[i].offset = offset + int64(i)*stripeLength
+		stripes[i].length = stripeLength
+	}
+	stripes[count-1].length = remaining - (count-1)*stripeLength
+
+	return stripes
+}
+
+// downloadStripeRange requests and copies a single download stripe. The
+// request includes an If-Match header with the ETag of the initial
+// response, so that all stripes are from the same object.
+func downloadStripeRange(
+	ctx context.Context,
+	httpClient *http.Client,
+	downloadURL string,
+	userAgent string,
+	eTag string,
+	file *os.File,
+	stripe *downloadStripe) error {
+
+	request, err := http.NewRequest("GET", downloadURL, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	request = request.WithContext(ctx)
+
+	request.Header.Set("User-Agent", userAgent)
+
+	request.Header.Add(
+		"Range",
+		fmt.Sprintf("bytes=%d-%d", stripe.offset, stripe.offset+stripe.length-1))
+
+	request.Header.Add("If-Match", eTag)
+
+	response, err := httpClient.Do(request)
+
+	if err == nil && response.StatusCode != http.StatusPartialContent {
+		response.Body.Close()
+		err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
+	}
+	if err != nil {
+
+		// Redact URL from "net/http" error message.
+		if !GetEmitNetworkParameters() {
+			errStr := err.Error()
+			err = std_errors.New(strings.Replace(errStr, downloadURL, "[redacted]", -1))
+		}
+
+		return errors.Trace(err)
+	}
+	defer response.Body.Close()
+
+	var first int64
+	_, err = fmt.Sscanf(response.Header.Get("Content-Range"), "bytes %d-", &first)
+	if err != nil || first != stripe.offset {
+		return errors.TraceNew("unexpected content range")
+	}
+
+	return copyDownloadStripe(file, stripe, response.Body)
+}
+
+// copyDownloadStripe copies the stripe data from body into file at the
+// stripe offset, recording the number of bytes written in the stripe.
+func copyDownloadStripe(
+	file *os.File, stripe *downloadStripe, body io.Reader) error {
+
+	writer := NewSyncFileWriterAt(file, stripe.offset)
+
+	var err error
+	if stripe.length < 0 {
+		stripe.written, err = io.Copy(writer, body)
+	} else {
+		stripe.written, err = io.CopyN(writer, body, stripe.length)
+	}
+	return errors.Trace(err)
+}
@@ -0,0 +1,234 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	std_errors "errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+)
+
+type testRoundTripper struct {
+	requestCount int32
+	fail         bool
+	lastRange    atomic.Value
+}
+
+func (roundTripper *testRoundTripper) RoundTrip(
+	request *http.Request) (*http.Response, error) {
+
+	atomic.AddInt32(&roundTripper.requestCount, 1)
+	roundTripper.lastRange.Store(request.Header.Get("Range"))
+	if roundTripper.fail {
+		return nil, std_errors.New("round trip failed")
+	}
+	return http.DefaultTransport.RoundTrip(request)
+}
+
+func TestResumeStripedDownload(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-striped-download-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	content := prng.Bytes(3*DOWNLOAD_STRIPE_MIN_BYTES + 12345)
+
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"test-etag"`)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		}))
+	defer server.Close()
+
+	makeClients := func(failIndex int) ([]*http.Client, []*testRoundTripper) {
+		var clients []*http.Client
+		var roundTrippers []*testRoundTripper
+		for i := 0; i < 3; i++ {
+			roundTripper := &testRoundTripper{fail: i == failIndex}
+			roundTrippers = append(roundTrippers, roundTripper)
+			clients = append(clients, &http.Client{Transport: roundTripper})
+		}
+		return clients, roundTrippers
+	}
+
+	checkDownload := func(downloadFilename string) {
+		downloaded, err := ioutil.ReadFile(downloadFilename)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %s", err)
+		}
+		if !bytes.Equal(downloaded, content) {
+			t.Fatalf("unexpected downloaded content")
+		}
+		if _, err := os.Stat(downloadFilename + ".part"); !os.IsNotExist(err) {
+			t.Fatalf("unexpected partial download file")
+		}
+	}
+
+	// Test: the download is striped across all clients.
+
+	downloadFilename := filepath.Join(testDataDirName, "download1")
+
+	clients, roundTrippers := makeClients(-1)
+
+	n, eTag, err := ResumeStripedDownload(
+		context.Background(), clients, server.URL, "", downloadFilename, "")
+	if err != nil {
+		t.Fatalf("ResumeStripedDownload failed: %s", err)
+	}
+	if n != int64(len(content)) || eTag != `"test-etag"` {
+		t.Fatalf("unexpected result: %d, %s", n, eTag)
+	}
+	// The first client sends the initial, open-ended range request and then
+	// requests the first stripe with a bounded range.
+	for i, roundTripper := range roundTrippers {
+		expectedRequestCount := int32(1)
+		if i == 0 {
+			expectedRequestCount = 2
+		}
+		if atomic.LoadInt32(&roundTripper.requestCount) != expectedRequestCount {
+			t.Fatalf("unexpected request count for client %d", i)
+		}
+	}
+	firstStripeRange := fmt.Sprintf("bytes=0-%d", len(content)/3-1)
+	if roundTrippers[0].lastRange.Load().(string) != firstStripeRange {
+		t.Fatalf("unexpected first stripe range: %s", roundTrippers[0].lastRange.Load())
+	}
+	checkDownload(downloadFilename)
+
+	// Test: when a stripe fails, the partial download is truncated to the
+	// completed first stripe, even though the last stripe succeeds, and the
+	// download may then be resumed.
+
+	downloadFilename = filepath.Join(testDataDirName, "download2")
+
+	clients, _ = makeClients(1)
+
+	n, _, err = ResumeStripedDownload(
+		context.Background(), clients, server.URL, "", downloadFilename, "")
+	if err == nil {
+		t.Fatalf("unexpected ResumeStripedDownload success")
+	}
+
+	fileInfo, err := os.Stat(downloadFilename + ".part")
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	firstStripeLength := int64(len(content) / 3)
+	if fileInfo.Size() != firstStripeLength {
+		t.Fatalf("unexpected partial download size: %d", fileInfo.Size())
+	}
+	if n != firstStripeLength {
+		t.Fatalf("unexpected downloaded bytes: %d", n)
+	}
+
+	n, _, err = ResumeDownload(
+		context.Background(), &http.Client{}, server.URL, "", downloadFilename, "")
+	if err != nil {
+		t.Fatalf("ResumeDownload failed: %s", err)
+	}
+	if n != int64(len(content))-firstStripeLength {
+		t.Fatalf("unexpected resumed bytes: %d", n)
+	}
+	checkDownload(downloadFilename)
+
+	// Test: small downloads aren't striped.
+
+	content = content[:DOWNLOAD_STRIPE_MIN_BYTES]
+
+	downloadFilename = filepath.Join(testDataDirName, "download3")
+
+	clients, roundTrippers = makeClients(-1)
+
+	_, _, err = ResumeStripedDownload(
+		context.Background(), clients, server.URL, "", downloadFilename, "")
+	if err != nil {
+		t.Fatalf("ResumeStripedDownload failed: %s", err)
+	}
+	if atomic.LoadInt32(&roundTrippers[1].requestCount) != 0 {
+		t.Fatalf("unexpected stripe request")
+	}
+	checkDownload(downloadFilename)
+}
+
+type testDeviceBinder struct {
+	bindCount int32
+}
+
+func (binder *testDeviceBinder) BindToDevice(fileDescriptor int) (string, error) {
+	atomic.AddInt32(&binder.bindCount, 1)
+	return "", std_errors.New("bind failed")
+}
+
+func TestHasIPv6Route(t *testing.T) {
+
+	testCases := []struct {
+		IP       string
+		isGlobal bool
+	}{
+		{"2600::1", true},
+		{"2a00:1450:4001::1", true},
+		{"fd00::1", false},
+		{"fc00::1", false},
+		{"fe80::1", false},
+		{"::1", false},
+		{"192.0.2.1", false},
+		{"::ffff:192.0.2.1", false},
+	}
+
+	for _, testCase := range testCases {
+		if isGlobalIPv6Address(net.ParseIP(testCase.IP)) != testCase.isGlobal {
+			t.Fatalf("unexpected isGlobalIPv6Address result for %s", testCase.IP)
+		}
+	}
+
+	// Test: the route check socket is bound using the DeviceBinder, and the
+	// check fails when binding fails.
+
+	binder := &testDeviceBinder{}
+
+	if hasIPv6Route(&DialConfig{DeviceBinder: binder}) {
+		t.Fatalf("unexpected IPv6 route")
+	}
+
+	// When the host has no IPv6 support at all, the socket isn't created and
+	// the DeviceBinder isn't invoked.
+
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err == nil {
+		conn.Close()
+		if atomic.LoadInt32(&binder.bindCount) != 1 {
+			t.Fatalf("unexpected bind count: %d", binder.bindCount)
+		}
+	}
+}
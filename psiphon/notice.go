@@ -34,6 +34,7 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/buildinfo"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/notices"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/stacktrace"
@@ -102,15 +103,18 @@ func GetEmitNetworkParameters() bool {
 //
 // Notices are encoded in JSON. Here's an example:
 //
-// {"data":{"message":"shutdown operate tunnel"},"noticeType":"Info","timestamp":"2006-01-02T15:04:05.999999999Z07:00"}
+// {"noticeType":"Info","noticeVersion":1,"data":{"message":"shutdown operate tunnel"},"timestamp":"2006-01-02T15:04:05.999Z"}
 //
 // All notices have the following fields:
 // - "noticeType": the type of notice, which indicates the meaning of the notice along with what's in the data payload.
+// - "noticeVersion": the schema version of the notice type.
 // - "data": additional structured data payload. For example, the "ListeningSocksProxyPort" notice type has a "port" integer
 // data in its payload.
 // - "timestamp": UTC timezone, RFC3339Milli format timestamp for notice event
 //
-// See the Notice* functions for details on each notice meaning and payload.
+// See the Notice* functions for details on each notice meaning, and the
+// notices package for each notice payload type, JSON Schema, and a typed
+// decoder.
 //
 func SetNoticeWriter(writer io.Writer) {
 
@@ -206,25 +210,13 @@ const (
 )
 
 // outputNotice encodes a notice in JSON and writes it to the output writer.
-func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args ...interface{}) {
+func (nl *noticeLogger) outputNotice(notice notices.Notice, noticeFlags uint32) {
 
 	if (noticeFlags&noticeIsDiagnostic != 0) && !GetEmitDiagnosticNotices() {
 		return
 	}
 
-	obj := make(map[string]interface{})
-	noticeData := make(map[string]interface{})
-	obj["noticeType"] = noticeType
-	obj["data"] = noticeData
-	obj["timestamp"] = time.Now().UTC().Format(common.RFC3339Milli)
-	for i := 0; i < len(args)-1; i += 2 {
-		name, ok := args[i].(string)
-		value := args[i+1]
-		if ok {
-			noticeData[name] = value
-		}
-	}
-	encodedJson, err := json.Marshal(obj)
+	encodedJson, err := notices.Encode(notice, time.Now())
 	var output []byte
 	if err == nil {
 		output = append(encodedJson, byte('\n'))
@@ -285,7 +277,7 @@ func (nl *noticeLogger) outputNotice(noticeType string, noticeFlags uint32, args
 // A NoticeInteralError handler must not call a Notice function.
 func makeNoticeInternalError(errorMessage string) []byte {
 	// Format an Alert Notice (_without_ using json.Marshal, since that can fail)
-	alertNoticeFormat := "{\"noticeType\":\"InternalError\",\"timestamp\":\"%s\",\"data\":{\"message\":\"%s\"}}\n"
+	alertNoticeFormat := "{\"noticeType\":\"InternalError\",\"noticeVersion\":1,\"timestamp\":\"%s\",\"data\":{\"message\":\"%s\"}}\n"
 	return []byte(fmt.Sprintf(alertNoticeFormat, time.Now().UTC().Format(common.RFC3339Milli), errorMessage))
 
 }
@@ -371,29 +363,29 @@ func (nl *noticeLogger) outputNoticeToRotatingFile(output []byte) error {
 // NoticeInfo is an informational message
 func NoticeInfo(format string, args ...interface{}) {
 	singletonNoticeLogger.outputNotice(
-		"Info", noticeIsDiagnostic,
-		"message", fmt.Sprintf(format, args...))
+		notices.Info{Message: notices.Message{Message: fmt.Sprintf(format, args...)}},
+		noticeIsDiagnostic)
 }
 
 // NoticeWarning is a warning message; typically a recoverable error condition
 func NoticeWarning(format string, args ...interface{}) {
 	singletonNoticeLogger.outputNotice(
-		"Warning", noticeIsDiagnostic,
-		"message", fmt.Sprintf(format, args...))
+		notices.Warning{Message: notices.Message{Message: fmt.Sprintf(format, args...)}},
+		noticeIsDiagnostic)
 }
 
 // NoticeError is an error message; typically an unrecoverable error condition
 func NoticeError(format string, args ...interface{}) {
 	singletonNoticeLogger.outputNotice(
-		"Error", noticeIsDiagnostic,
-		"message", fmt.Sprintf(format, args...))
+		notices.Error{Message: notices.Message{Message: fmt.Sprintf(format, args...)}},
+		noticeIsDiagnostic)
 }
 
 // NoticeUserLog is a log message from the outer client user of tunnel-core
 func NoticeUserLog(message string) {
 	singletonNoticeLogger.outputNotice(
-		"UserLog", noticeIsDiagnostic,
-		"message", message)
+		notices.UserLog{Message: message},
+		noticeIsDiagnostic)
 }
 
 // NoticeCandidateServers is how many possible servers are available for the selected region and protocols
@@ -404,14 +396,16 @@ func NoticeCandidateServers(
 	count int) {
 
 	singletonNoticeLogger.outputNotice(
-		"CandidateServers", noticeIsDiagnostic,
-		"region", region,
-		"initialLimitTunnelProtocols", constraints.initialLimitProtocols,
-		"initialLimitTunnelProtocolsCandidateCount", constraints.initialLimitProtocolsCandidateCount,
-		"limitTunnelProtocols", constraints.limitProtocols,
-		"replayCandidateCount", constraints.replayCandidateCount,
-		"initialCount", initialCount,
-		"count", count)
+		notices.CandidateServers{
+			Region:                      region,
+			InitialLimitTunnelProtocols: constraints.initialLimitProtocols,
+			InitialLimitTunnelProtocolsCandidateCount: constraints.initialLimitProtocolsCandidateCount,
+			LimitTunnelProtocols:                      constraints.limitProtocols,
+			ReplayCandidateCount:                      constraints.replayCandidateCount,
+			InitialCount:                              initialCount,
+			Count:                                     count,
+		},
+		noticeIsDiagnostic)
 }
 
 // NoticeAvailableEgressRegions is what regions are available for egress from.
@@ -421,177 +415,184 @@ func NoticeAvailableEgressRegions(regions []string) {
 	sort.Strings(sortedRegions)
 	repetitionMessage := strings.Join(sortedRegions, "")
 	outputRepetitiveNotice(
-		"AvailableEgressRegions", repetitionMessage, 0,
-		"AvailableEgressRegions", 0, "regions", sortedRegions)
-}
-
-func noticeWithDialParameters(noticeType string, dialParams *DialParameters) {
+		"AvailableEgressRegions", repetitionMessage, 0, 0,
+		func(repeats int) notices.Notice {
+			return notices.AvailableEgressRegions{Regions: sortedRegions, Repeats: repeats}
+		})
+}
+
+func getDialParametersNoticeFields(dialParams *DialParameters) notices.DialParameters {
+
+	fields := notices.DialParameters{
+		DiagnosticID:     dialParams.ServerEntry.GetDiagnosticID(),
+		Region:           dialParams.ServerEntry.Region,
+		Protocol:         dialParams.TunnelProtocol,
+		IsReplay:         dialParams.IsReplay,
+		CandidateNumber:  dialParams.CandidateNumber,
+		NetworkType:      dialParams.GetNetworkType(),
+		TunnelResumption: dialParams.TunnelResumption,
+	}
 
-	args := []interface{}{
-		"diagnosticID", dialParams.ServerEntry.GetDiagnosticID(),
-		"region", dialParams.ServerEntry.Region,
-		"protocol", dialParams.TunnelProtocol,
-		"isReplay", dialParams.IsReplay,
-		"candidateNumber", dialParams.CandidateNumber,
-		"networkType", dialParams.GetNetworkType(),
+	if dialParams.MultiHopEntryTunnel != nil {
+		fields.MultiHopEntryDiagnosticID =
+			dialParams.MultiHopEntryTunnel.dialParams.ServerEntry.GetDiagnosticID()
 	}
 
 	if GetEmitNetworkParameters() {
 
-		if dialParams.BPFProgramName != "" {
-			args = append(args, "client_bpf", dialParams.BPFProgramName)
-		}
+		fields.BPFProgramName = dialParams.BPFProgramName
 
 		if dialParams.SelectedSSHClientVersion {
-			args = append(args, "SSHClientVersion", dialParams.SSHClientVersion)
+			fields.SSHClientVersion = dialParams.SSHClientVersion
 		}
 
-		if dialParams.UpstreamProxyType != "" {
-			args = append(args, "upstreamProxyType", dialParams.UpstreamProxyType)
-		}
+		fields.UpstreamProxyType = dialParams.UpstreamProxyType
 
 		if dialParams.UpstreamProxyCustomHeaderNames != nil {
-			args = append(args, "upstreamProxyCustomHeaderNames", strings.Join(dialParams.UpstreamProxyCustomHeaderNames, ","))
+			fields.UpstreamProxyCustomHeaderNames = strings.Join(dialParams.UpstreamProxyCustomHeaderNames, ",")
 		}
 
-		if dialParams.FrontingProviderID != "" {
-			args = append(args, "frontingProviderID", dialParams.FrontingProviderID)
-		}
-
-		if dialParams.MeekDialAddress != "" {
-			args = append(args, "meekDialAddress", dialParams.MeekDialAddress)
-		}
-
-		meekResolvedIPAddress := dialParams.MeekResolvedIPAddress.Load().(string)
-		if meekResolvedIPAddress != "" {
-			args = append(args, "meekResolvedIPAddress", meekResolvedIPAddress)
-		}
-
-		if dialParams.MeekSNIServerName != "" {
-			args = append(args, "meekSNIServerName", dialParams.MeekSNIServerName)
-		}
-
-		if dialParams.MeekHostHeader != "" {
-			args = append(args, "meekHostHeader", dialParams.MeekHostHeader)
-		}
+		fields.FrontingProviderID = dialParams.FrontingProviderID
+		fields.MeekDialAddress = dialParams.MeekDialAddress
+		fields.MeekResolvedIPAddress = dialParams.MeekResolvedIPAddress.Load().(string)
+		fields.MeekSNIServerName = dialParams.MeekSNIServerName
+		fields.MeekHostHeader = dialParams.MeekHostHeader
 
 		// MeekTransformedHostName is meaningful when meek is used, which is when MeekDialAddress != ""
 		if dialParams.MeekDialAddress != "" {
-			args = append(args, "meekTransformedHostName", dialParams.MeekTransformedHostName)
+			meekTransformedHostName := dialParams.MeekTransformedHostName
+			fields.MeekTransformedHostName = &meekTransformedHostName
 		}
 
 		if dialParams.SelectedUserAgent {
-			args = append(args, "userAgent", dialParams.UserAgent)
+			fields.UserAgent = dialParams.UserAgent
 		}
 
 		if dialParams.SelectedTLSProfile {
-			args = append(args, "TLSProfile", dialParams.TLSProfile)
-			args = append(args, "TLSVersion", dialParams.GetTLSVersionForMetrics())
-		}
-
-		if dialParams.DialPortNumber != "" {
-			args = append(args, "dialPortNumber", dialParams.DialPortNumber)
+			fields.TLSProfile = dialParams.TLSProfile
+			fields.TLSVersion = dialParams.GetTLSVersionForMetrics()
 		}
 
-		if dialParams.QUICVersion != "" {
-			args = append(args, "QUICVersion", dialParams.QUICVersion)
-		}
-
-		if dialParams.QUICDialSNIAddress != "" {
-			args = append(args, "QUICDialSNIAddress", dialParams.QUICDialSNIAddress)
-		}
+		fields.DialPortNumber = dialParams.DialPortNumber
+		fields.DialIPVersion = dialParams.GetIPVersionForMetrics()
+		fields.QUICVersion = dialParams.QUICVersion
+		fields.QUICDialSNIAddress = dialParams.QUICDialSNIAddress
 
 		if dialParams.DialDuration > 0 {
-			args = append(args, "dialDuration", dialParams.DialDuration)
+			fields.DialDuration = dialParams.DialDuration
 		}
 
-		if dialParams.NetworkLatencyMultiplier != 0.0 {
-			args = append(args, "networkLatencyMultiplier", dialParams.NetworkLatencyMultiplier)
-		}
+		fields.NetworkLatencyMultiplier = dialParams.NetworkLatencyMultiplier
 
-		if dialParams.DialConnMetrics != nil {
-			metrics := dialParams.DialConnMetrics.GetMetrics()
-			for name, value := range metrics {
-				args = append(args, name, value)
-			}
-		}
+		for _, metricsSource := range []common.MetricsSource{
+			dialParams.DialConnMetrics, dialParams.ObfuscatedSSHConnMetrics} {
 
-		if dialParams.ObfuscatedSSHConnMetrics != nil {
-			metrics := dialParams.ObfuscatedSSHConnMetrics.GetMetrics()
-			for name, value := range metrics {
-				args = append(args, name, value)
+			if metricsSource == nil {
+				continue
+			}
+			for name, value := range metricsSource.GetMetrics() {
+				if fields.Metrics == nil {
+					fields.Metrics = make(map[string]interface{})
+				}
+				fields.Metrics[name] = value
 			}
 		}
 	}
 
-	singletonNoticeLogger.outputNotice(
-		noticeType, noticeIsDiagnostic,
-		args...)
+	return fields
 }
 
 // NoticeConnectingServer reports parameters and details for a single connection attempt
 func NoticeConnectingServer(dialParams *DialParameters) {
-	noticeWithDialParameters("ConnectingServer", dialParams)
+	singletonNoticeLogger.outputNotice(
+		notices.ConnectingServer{DialParameters: getDialParametersNoticeFields(dialParams)},
+		noticeIsDiagnostic)
 }
 
 // NoticeConnectedServer reports parameters and details for a single successful connection
 func NoticeConnectedServer(dialParams *DialParameters) {
-	noticeWithDialParameters("ConnectedServer", dialParams)
+	singletonNoticeLogger.outputNotice(
+		notices.ConnectedServer{DialParameters: getDialParametersNoticeFields(dialParams)},
+		noticeIsDiagnostic)
 }
 
 // NoticeRequestingTactics reports parameters and details for a tactics request attempt
 func NoticeRequestingTactics(dialParams *DialParameters) {
-	noticeWithDialParameters("RequestingTactics", dialParams)
+	singletonNoticeLogger.outputNotice(
+		notices.RequestingTactics{DialParameters: getDialParametersNoticeFields(dialParams)},
+		noticeIsDiagnostic)
 }
 
 // NoticeRequestedTactics reports parameters and details for a successful tactics request
 func NoticeRequestedTactics(dialParams *DialParameters) {
-	noticeWithDialParameters("RequestedTactics", dialParams)
+	singletonNoticeLogger.outputNotice(
+		notices.RequestedTactics{DialParameters: getDialParametersNoticeFields(dialParams)},
+		noticeIsDiagnostic)
 }
 
-// NoticeActiveTunnel is a successful connection that is used as an active tunnel for port forwarding
-func NoticeActiveTunnel(diagnosticID, protocol string, isTCS bool) {
+// NoticeActiveTunnel is a successful connection that is used as an active tunnel for port forwarding.
+// multiHopEntryDiagnosticID is set when the tunnel is a multi-hop exit tunnel.
+func NoticeActiveTunnel(diagnosticID, protocol string, isTCS bool, multiHopEntryDiagnosticID string) {
 	singletonNoticeLogger.outputNotice(
-		"ActiveTunnel", noticeIsDiagnostic,
-		"diagnosticID", diagnosticID,
-		"protocol", protocol,
-		"isTCS", isTCS)
+		notices.ActiveTunnel{
+			DiagnosticID:              diagnosticID,
+			Protocol:                  protocol,
+			IsTCS:                     isTCS,
+			MultiHopEntryDiagnosticID: multiHopEntryDiagnosticID,
+		},
+		noticeIsDiagnostic)
 }
 
 // NoticeSocksProxyPortInUse is a failure to use the configured LocalSocksProxyPort
 func NoticeSocksProxyPortInUse(port int) {
 	singletonNoticeLogger.outputNotice(
-		"SocksProxyPortInUse", 0,
-		"port", port)
+		notices.SocksProxyPortInUse{Port: port},
+		0)
 }
 
 // NoticeListeningSocksProxyPort is the selected port for the listening local SOCKS proxy
 func NoticeListeningSocksProxyPort(port int) {
 	singletonNoticeLogger.outputNotice(
-		"ListeningSocksProxyPort", 0,
-		"port", port)
+		notices.ListeningSocksProxyPort{Port: port},
+		0)
 }
 
 // NoticeHttpProxyPortInUse is a failure to use the configured LocalHttpProxyPort
 func NoticeHttpProxyPortInUse(port int) {
 	singletonNoticeLogger.outputNotice(
-		"HttpProxyPortInUse", 0,
-		"port", port)
+		notices.HttpProxyPortInUse{Port: port},
+		0)
 }
 
 // NoticeListeningHttpProxyPort is the selected port for the listening local HTTP proxy
 func NoticeListeningHttpProxyPort(port int) {
 	singletonNoticeLogger.outputNotice(
-		"ListeningHttpProxyPort", 0,
-		"port", port)
+		notices.ListeningHttpProxyPort{Port: port},
+		0)
+}
+
+// NoticeListeningLocalControlAPI is the address of the listening local
+// control API.
+func NoticeListeningLocalControlAPI(address string) {
+	singletonNoticeLogger.outputNotice(
+		notices.ListeningLocalControlAPI{Address: address},
+		0)
+}
+
+// NoticeListeningLocalDNSProxy is the address of the listening local DNS
+// proxy.
+func NoticeListeningLocalDNSProxy(address string) {
+	singletonNoticeLogger.outputNotice(
+		notices.ListeningLocalDNSProxy{Address: address},
+		0)
 }
 
 // NoticeClientUpgradeAvailable is an available client upgrade, as per the handshake. The
 // client should download and install an upgrade.
 func NoticeClientUpgradeAvailable(version string) {
 	singletonNoticeLogger.outputNotice(
-		"ClientUpgradeAvailable", 0,
-		"version", version)
+		notices.ClientUpgradeAvailable{Version: version},
+		0)
 }
 
 // NoticeClientIsLatestVersion reports that an upgrade check was made and the client
@@ -599,8 +600,8 @@ func NoticeClientUpgradeAvailable(version string) {
 // if known.
 func NoticeClientIsLatestVersion(availableVersion string) {
 	singletonNoticeLogger.outputNotice(
-		"ClientIsLatestVersion", 0,
-		"availableVersion", availableVersion)
+		notices.ClientIsLatestVersion{AvailableVersion: availableVersion},
+		0)
 }
 
 // NoticeHomepages emits a series of NoticeHomepage, the sponsor homepages. The client
@@ -615,8 +616,8 @@ func NoticeHomepages(urls []string) {
 			noticeFlags |= noticeSyncHomepages
 		}
 		singletonNoticeLogger.outputNotice(
-			"Homepage", noticeFlags,
-			"url", url)
+			notices.Homepage{URL: url},
+			noticeFlags)
 	}
 }
 
@@ -624,8 +625,8 @@ func NoticeHomepages(urls []string) {
 // reported to the client in the handshake.
 func NoticeClientRegion(region string) {
 	singletonNoticeLogger.outputNotice(
-		"ClientRegion", 0,
-		"region", region)
+		notices.ClientRegion{Region: region},
+		0)
 }
 
 // NoticeTunnels is how many active tunnels are available. The client should use this to
@@ -633,15 +634,15 @@ func NoticeClientRegion(region string) {
 // disconnected; when count > 1, the core is connected.
 func NoticeTunnels(count int) {
 	singletonNoticeLogger.outputNotice(
-		"Tunnels", 0,
-		"count", count)
+		notices.Tunnels{Count: count},
+		0)
 }
 
 // NoticeSessionId is the session ID used across all tunnels established by the controller.
 func NoticeSessionId(sessionId string) {
 	singletonNoticeLogger.outputNotice(
-		"SessionId", noticeIsDiagnostic,
-		"sessionId", sessionId)
+		notices.SessionId{SessionId: sessionId},
+		noticeIsDiagnostic)
 }
 
 // NoticeUntunneled indicates than an address has been classified as untunneled and is being
@@ -652,38 +653,38 @@ func NoticeSessionId(sessionId string) {
 //
 func NoticeUntunneled(address string) {
 	singletonNoticeLogger.outputNotice(
-		"Untunneled", 0,
-		"address", address)
+		notices.Untunneled{Address: address},
+		0)
 }
 
 // NoticeSplitTunnelRegion reports that split tunnel is on for the given region.
 func NoticeSplitTunnelRegion(region string) {
 	singletonNoticeLogger.outputNotice(
-		"SplitTunnelRegion", 0,
-		"region", region)
+		notices.SplitTunnelRegion{Region: region},
+		0)
 }
 
 // NoticeUpstreamProxyError reports an error when connecting to an upstream proxy. The
 // user may have input, for example, an incorrect address or incorrect credentials.
 func NoticeUpstreamProxyError(err error) {
 	singletonNoticeLogger.outputNotice(
-		"UpstreamProxyError", 0,
-		"message", err.Error())
+		notices.UpstreamProxyError{Message: err.Error()},
+		0)
 }
 
 // NoticeClientUpgradeDownloadedBytes reports client upgrade download progress.
 func NoticeClientUpgradeDownloadedBytes(bytes int64) {
 	singletonNoticeLogger.outputNotice(
-		"ClientUpgradeDownloadedBytes", noticeIsDiagnostic,
-		"bytes", bytes)
+		notices.ClientUpgradeDownloadedBytes{Bytes: bytes},
+		noticeIsDiagnostic)
 }
 
 // NoticeClientUpgradeDownloaded indicates that a client upgrade download
 // is complete and available at the destination specified.
 func NoticeClientUpgradeDownloaded(filename string) {
 	singletonNoticeLogger.outputNotice(
-		"ClientUpgradeDownloaded", 0,
-		"filename", filename)
+		notices.ClientUpgradeDownloaded{Filename: filename},
+		0)
 }
 
 // NoticeBytesTransferred reports how many tunneled bytes have been
@@ -693,20 +694,41 @@ func NoticeClientUpgradeDownloaded(filename string) {
 // intended to be included with feedback.
 func NoticeBytesTransferred(diagnosticID string, sent, received int64) {
 	singletonNoticeLogger.outputNotice(
-		"BytesTransferred", 0,
-		"diagnosticID", diagnosticID,
-		"sent", sent,
-		"received", received)
+		notices.BytesTransferred{
+			DiagnosticID: diagnosticID,
+			Sent:         sent,
+			Received:     received,
+		},
+		0)
 }
 
 // NoticeTotalBytesTransferred reports how many tunneled bytes have been
 // transferred in total up to this point. This is a diagnostic notice.
 func NoticeTotalBytesTransferred(diagnosticID string, sent, received int64) {
 	singletonNoticeLogger.outputNotice(
-		"TotalBytesTransferred", noticeIsDiagnostic,
-		"diagnosticID", diagnosticID,
-		"sent", sent,
-		"received", received)
+		notices.TotalBytesTransferred{
+			DiagnosticID: diagnosticID,
+			Sent:         sent,
+			Received:     received,
+		},
+		noticeIsDiagnostic)
+}
+
+// NoticeLocalProxyBytesTransferred reports how many bytes have been
+// transferred through the specified local proxy, in total, by clients
+// authenticated with the specified LocalProxyCredentials username. sent is
+// bytes sent by local clients and received is bytes received by local
+// clients. This notice is not included with feedback, as usernames are
+// configured by the user app.
+func NoticeLocalProxyBytesTransferred(proxyType, username string, sent, received int64) {
+	singletonNoticeLogger.outputNotice(
+		notices.LocalProxyBytesTransferred{
+			ProxyType: proxyType,
+			Username:  username,
+			Sent:      sent,
+			Received:  received,
+		},
+		0)
 }
 
 // NoticeLocalProxyError reports a local proxy error message. Repetitive
@@ -725,22 +747,24 @@ func NoticeLocalProxyError(proxyType string, err error) {
 	}
 
 	outputRepetitiveNotice(
-		"LocalProxyError"+proxyType, repetitionMessage, 1,
-		"LocalProxyError", noticeIsDiagnostic,
-		"message", err.Error())
+		"LocalProxyError"+proxyType, repetitionMessage, 1, noticeIsDiagnostic,
+		func(repeats int) notices.Notice {
+			return notices.LocalProxyError{Message: err.Error(), Repeats: repeats}
+		})
 }
 
 // NoticeBuildInfo reports build version info.
 func NoticeBuildInfo() {
 	singletonNoticeLogger.outputNotice(
-		"BuildInfo", noticeIsDiagnostic,
-		"buildInfo", buildinfo.GetBuildInfo())
+		notices.BuildInfo{BuildInfo: buildinfo.GetBuildInfo()},
+		noticeIsDiagnostic)
 }
 
 // NoticeExiting indicates that tunnel-core is exiting imminently.
 func NoticeExiting() {
 	singletonNoticeLogger.outputNotice(
-		"Exiting", 0)
+		notices.Exiting{},
+		0)
 }
 
 // NoticeRemoteServerListResourceDownloadedBytes reports remote server list download progress.
@@ -749,9 +773,8 @@ func NoticeRemoteServerListResourceDownloadedBytes(url string, bytes int64) {
 		url = "[redacted]"
 	}
 	singletonNoticeLogger.outputNotice(
-		"RemoteServerListResourceDownloadedBytes", noticeIsDiagnostic,
-		"url", url,
-		"bytes", bytes)
+		notices.RemoteServerListResourceDownloadedBytes{URL: url, Bytes: bytes},
+		noticeIsDiagnostic)
 }
 
 // NoticeRemoteServerListResourceDownloaded indicates that a remote server list download
@@ -761,24 +784,23 @@ func NoticeRemoteServerListResourceDownloaded(url string) {
 		url = "[redacted]"
 	}
 	singletonNoticeLogger.outputNotice(
-		"RemoteServerListResourceDownloaded", noticeIsDiagnostic,
-		"url", url)
+		notices.RemoteServerListResourceDownloaded{URL: url},
+		noticeIsDiagnostic)
 }
 
 // NoticeSLOKSeeded indicates that the SLOK with the specified ID was received from
 // the Psiphon server. The "duplicate" flags indicates whether the SLOK was previously known.
 func NoticeSLOKSeeded(slokID string, duplicate bool) {
 	singletonNoticeLogger.outputNotice(
-		"SLOKSeeded", noticeIsDiagnostic,
-		"slokID", slokID,
-		"duplicate", duplicate)
+		notices.SLOKSeeded{SLOKID: slokID, Duplicate: duplicate},
+		noticeIsDiagnostic)
 }
 
 // NoticeServerTimestamp reports server side timestamp as seen in the handshake.
 func NoticeServerTimestamp(timestamp string) {
 	singletonNoticeLogger.outputNotice(
-		"ServerTimestamp", 0,
-		"timestamp", timestamp)
+		notices.ServerTimestamp{Timestamp: timestamp},
+		0)
 }
 
 // NoticeActiveAuthorizationIDs reports the authorizations the server has accepted.
@@ -791,61 +813,99 @@ func NoticeActiveAuthorizationIDs(activeAuthorizationIDs []string) {
 	}
 
 	singletonNoticeLogger.outputNotice(
-		"ActiveAuthorizationIDs", 0,
-		"IDs", activeAuthorizationIDs)
+		notices.ActiveAuthorizationIDs{IDs: activeAuthorizationIDs},
+		0)
 }
 
 func NoticeBindToDevice(deviceInfo string) {
 	outputRepetitiveNotice(
-		"BindToDevice", deviceInfo, 0,
-		"BindToDevice", 0, "deviceInfo", deviceInfo)
+		"BindToDevice", deviceInfo, 0, 0,
+		func(repeats int) notices.Notice {
+			return notices.BindToDevice{DeviceInfo: deviceInfo, Repeats: repeats}
+		})
 }
 
 func NoticeNetworkID(networkID string) {
 	outputRepetitiveNotice(
-		"NetworkID", networkID, 0,
-		"NetworkID", 0, "ID", networkID)
+		"NetworkID", networkID, 0, 0,
+		func(repeats int) notices.Notice {
+			return notices.NetworkID{ID: networkID, Repeats: repeats}
+		})
 }
 
 func NoticeLivenessTest(diagnosticID string, metrics *livenessTestMetrics, success bool) {
 	if GetEmitNetworkParameters() {
+		var noticeMetrics *notices.LivenessTestMetrics
+		if metrics != nil {
+			noticeMetrics = &notices.LivenessTestMetrics{
+				Duration:                metrics.Duration,
+				UpstreamBytes:           metrics.UpstreamBytes,
+				SentUpstreamBytes:       metrics.SentUpstreamBytes,
+				DownstreamBytes:         metrics.DownstreamBytes,
+				ReceivedDownstreamBytes: metrics.ReceivedDownstreamBytes,
+			}
+		}
 		singletonNoticeLogger.outputNotice(
-			"LivenessTest", noticeIsDiagnostic,
-			"diagnosticID", diagnosticID,
-			"metrics", metrics,
-			"success", success)
+			notices.LivenessTest{
+				DiagnosticID: diagnosticID,
+				Metrics:      noticeMetrics,
+				Success:      success,
+			},
+			noticeIsDiagnostic)
 	}
 }
 
+// NoticeTunnelResumed reports that a tunnel survived a failure of its network
+// connection, using the specified method.
+func NoticeTunnelResumed(diagnosticID, method string) {
+	singletonNoticeLogger.outputNotice(
+		notices.TunnelResumed{
+			DiagnosticID: diagnosticID,
+			Method:       method,
+		},
+		noticeIsDiagnostic)
+}
+
 func NoticePruneServerEntry(serverEntryTag string) {
 	singletonNoticeLogger.outputNotice(
-		"PruneServerEntry", noticeIsDiagnostic,
-		"serverEntryTag", serverEntryTag)
+		notices.PruneServerEntry{ServerEntryTag: serverEntryTag},
+		noticeIsDiagnostic)
 }
 
 // NoticeEstablishTunnelTimeout reports that the configured EstablishTunnelTimeout
 // duration was exceeded.
 func NoticeEstablishTunnelTimeout(timeout time.Duration) {
 	singletonNoticeLogger.outputNotice(
-		"EstablishTunnelTimeout", 0,
-		"timeout", timeout)
+		notices.EstablishTunnelTimeout{Timeout: timeout},
+		0)
 }
 
 func NoticeFragmentor(diagnosticID string, message string) {
 	if GetEmitNetworkParameters() {
 		singletonNoticeLogger.outputNotice(
-			"Fragmentor", noticeIsDiagnostic,
-			"diagnosticID", diagnosticID,
-			"message", message)
+			notices.Fragmentor{DiagnosticID: diagnosticID, Message: message},
+			noticeIsDiagnostic)
 	}
 }
 
+// NoticeMeekHTTP2Streaming reports the outcome of a meek HTTP/2 streaming
+// attempt.
+func NoticeMeekHTTP2Streaming(diagnosticID string, err error) {
+	notice := notices.MeekHTTP2Streaming{
+		DiagnosticID: diagnosticID,
+		Established:  err == nil,
+	}
+	if err != nil {
+		notice.Error = err.Error()
+	}
+	singletonNoticeLogger.outputNotice(notice, noticeIsDiagnostic)
+}
+
 func NoticeApplicationParameters(keyValues parameters.KeyValues) {
 	for key, value := range keyValues {
 		singletonNoticeLogger.outputNotice(
-			"ApplicationParameter", 0,
-			"key", key,
-			"value", value)
+			notices.ApplicationParameter{Key: key, Value: value},
+			0)
 	}
 }
 
@@ -853,8 +913,14 @@ func NoticeApplicationParameters(keyValues parameters.KeyValues) {
 // reported at most once per session.
 func NoticeServerAlert(alert protocol.AlertRequest) {
 	outputRepetitiveNotice(
-		"ServerAlert", fmt.Sprintf("%+v", alert), 0,
-		"ServerAlert", noticeIsDiagnostic, "reason", alert.Reason, "subject", alert.Subject)
+		"ServerAlert", fmt.Sprintf("%+v", alert), 0, noticeIsDiagnostic,
+		func(repeats int) notices.Notice {
+			return notices.ServerAlert{
+				Reason:  alert.Reason,
+				Subject: alert.Subject,
+				Repeats: repeats,
+			}
+		})
 }
 
 type repetitiveNoticeState struct {
@@ -868,10 +934,11 @@ var repetitiveNoticeStates = make(map[string]*repetitiveNoticeState)
 // outputRepetitiveNotice conditionally outputs a notice. Used for noticies which
 // often repeat in noisy bursts. For a repeat limit of N, the notice is emitted
 // with a "repeats" count on consecutive repeats up to the limit and then suppressed
-// until the repetitionMessage differs.
+// until the repetitionMessage differs. makeNotice is called with the repeats
+// count to create the notice to emit.
 func outputRepetitiveNotice(
 	repetitionKey, repetitionMessage string, repeatLimit int,
-	noticeType string, noticeFlags uint32, args ...interface{}) {
+	noticeFlags uint32, makeNotice func(repeats int) notices.Notice) {
 
 	repetitiveNoticeMutex.Lock()
 	defer repetitiveNoticeMutex.Unlock()
@@ -894,12 +961,8 @@ func outputRepetitiveNotice(
 	}
 
 	if emit {
-		if state.repeats > 0 {
-			args = append(args, "repeats", state.repeats)
-		}
 		singletonNoticeLogger.outputNotice(
-			noticeType, noticeFlags,
-			args...)
+			makeNotice(state.repeats), noticeFlags)
 	}
 }
 
@@ -920,6 +983,8 @@ type noticeObject struct {
 
 // GetNotice receives a JSON encoded object and attempts to parse it as a Notice.
 // The type is returned as a string and the payload as a generic map.
+//
+// Deprecated: use notices.Decode, which returns typed notices.
 func GetNotice(notice []byte) (
 	noticeType string, payload map[string]interface{}, err error) {
 
@@ -1005,8 +1070,12 @@ func NewNoticeWriter(noticeType string) *NoticeWriter {
 // Write implements io.Writer.
 func (writer *NoticeWriter) Write(p []byte) (n int, err error) {
 	singletonNoticeLogger.outputNotice(
-		writer.noticeType, noticeIsDiagnostic,
-		"message", string(p))
+		notices.Generic{
+			Type:    writer.noticeType,
+			Version: 1,
+			Data:    map[string]interface{}{"message": string(p)},
+		},
+		noticeIsDiagnostic)
 	return len(p), nil
 }
 
@@ -1035,12 +1104,16 @@ func (logger *commonLogger) WithTraceFields(fields common.LogFields) common.LogT
 
 func (logger *commonLogger) LogMetric(metric string, fields common.LogFields) {
 	singletonNoticeLogger.outputNotice(
-		metric, noticeIsDiagnostic,
-		listCommonFields(fields)...)
+		notices.Generic{
+			Type:    metric,
+			Version: 1,
+			Data:    formatCommonFields(fields),
+		},
+		noticeIsDiagnostic)
 }
 
-func listCommonFields(fields common.LogFields) []interface{} {
-	fieldList := make([]interface{}, 0)
+func formatCommonFields(fields common.LogFields) map[string]interface{} {
+	formattedFields := make(map[string]interface{})
 	for name, value := range fields {
 		var formattedValue string
 		if err, ok := value.(error); ok {
@@ -1048,9 +1121,9 @@ func listCommonFields(fields common.LogFields) []interface{} {
 		} else {
 			formattedValue = fmt.Sprintf("%#v", value)
 		}
-		fieldList = append(fieldList, name, formattedValue)
+		formattedFields[name] = formattedValue
 	}
-	return fieldList
+	return formattedFields
 }
 
 type commonLogTrace struct {
@@ -1058,16 +1131,12 @@ type commonLogTrace struct {
 	fields common.LogFields
 }
 
-func (log *commonLogTrace) outputNotice(
-	noticeType string, args ...interface{}) {
-
-	singletonNoticeLogger.outputNotice(
-		noticeType, noticeIsDiagnostic,
-		append(
-			[]interface{}{
-				"message", fmt.Sprint(args...),
-				"trace", log.trace},
-			listCommonFields(log.fields)...)...)
+func (log *commonLogTrace) getMessage(args ...interface{}) notices.Message {
+	return notices.Message{
+		Message: fmt.Sprint(args...),
+		Trace:   log.trace,
+		Fields:  formatCommonFields(log.fields),
+	}
 }
 
 func (log *commonLogTrace) Debug(args ...interface{}) {
@@ -1075,13 +1144,16 @@ func (log *commonLogTrace) Debug(args ...interface{}) {
 }
 
 func (log *commonLogTrace) Info(args ...interface{}) {
-	log.outputNotice("Info", args...)
+	singletonNoticeLogger.outputNotice(
+		notices.Info{Message: log.getMessage(args...)}, noticeIsDiagnostic)
 }
 
 func (log *commonLogTrace) Warning(args ...interface{}) {
-	log.outputNotice("Alert", args...)
+	singletonNoticeLogger.outputNotice(
+		notices.Alert{Message: log.getMessage(args...)}, noticeIsDiagnostic)
 }
 
 func (log *commonLogTrace) Error(args ...interface{}) {
-	log.outputNotice("Error", args...)
+	singletonNoticeLogger.outputNotice(
+		notices.Error{Message: log.getMessage(args...)}, noticeIsDiagnostic)
 }
@@ -215,8 +215,8 @@ func (p *PacketTunnelTransport) UseTunnel(tunnel *Tunnel) {
 
 		// channelConn is a net.Conn, since some layering has been applied
 		// (e.g., transferstats.Conn). PacketTunnelTransport assumes the
-		// channelConn is ultimately an ssh.Channel, which is not a fully
-		// functional net.Conn.
+		// channelConn is ultimately an ssh.Channel or a datagram channel,
+		// neither of which is a fully functional net.Conn.
 
 		channelConn, err := tunnel.DialPacketTunnelChannel()
 		if err != nil {
@@ -755,6 +755,7 @@ var baseRequestParams = []requestParamSpec{
 	{"server_entry_timestamp", isISO8601Date, requestParamOptional},
 	{tactics.APPLIED_TACTICS_TAG_PARAMETER_NAME, isAnyString, requestParamOptional},
 	{"dial_port_number", isIntString, requestParamOptional | requestParamLogStringAsInt},
+	{"dial_ip_version", isIPVersion, requestParamOptional | requestParamLogStringAsInt},
 	{"quic_version", isAnyString, requestParamOptional},
 	{"quic_dial_sni_address", isAnyString, requestParamOptional},
 	{"upstream_bytes_fragmented", isIntString, requestParamOptional | requestParamLogStringAsInt},
@@ -1264,7 +1265,7 @@ func isClientPlatform(_ *Config, value string) bool {
 }
 
 func isRelayProtocol(_ *Config, value string) bool {
-	return common.Contains(protocol.SupportedTunnelProtocols, value)
+	return protocol.IsSupportedTunnelProtocol(value)
 }
 
 func isBooleanFlag(_ *Config, value string) bool {
@@ -1286,18 +1287,19 @@ func isRegionCode(_ *Config, value string) bool {
 }
 
 func isDialAddress(_ *Config, value string) bool {
-	// "<host>:<port>", where <host> is a domain or IP address
-	parts := strings.Split(value, ":")
-	if len(parts) != 2 {
+	// "<host>:<port>", where <host> is a domain or IP address; IPv6
+	// addresses are bracketed
+	host, portStr, err := net.SplitHostPort(value)
+	if err != nil {
 		return false
 	}
-	if !isIPAddress(nil, parts[0]) && !isDomain(nil, parts[0]) {
+	if !isIPAddress(nil, host) && !isDomain(nil, host) {
 		return false
 	}
-	if !isDigits(nil, parts[1]) {
+	if !isDigits(nil, portStr) {
 		return false
 	}
-	port, err := strconv.Atoi(parts[1])
+	port, err := strconv.Atoi(portStr)
 	if err != nil {
 		return false
 	}
@@ -1339,12 +1341,20 @@ func isDomain(_ *Config, value string) bool {
 
 func isHostHeader(_ *Config, value string) bool {
 	// "<host>:<port>", where <host> is a domain or IP address and ":<port>" is optional
+	if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+		IP := net.ParseIP(value[1 : len(value)-1])
+		return IP != nil && IP.To4() == nil
+	}
 	if strings.Contains(value, ":") {
 		return isDialAddress(nil, value)
 	}
 	return isIPAddress(nil, value) || isDomain(nil, value)
 }
 
+func isIPVersion(_ *Config, value string) bool {
+	return value == "4" || value == "6"
+}
+
 func isServerEntrySource(_ *Config, value string) bool {
 	return common.Contains(protocol.SupportedServerEntrySources, value)
 }
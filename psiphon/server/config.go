@@ -101,6 +101,12 @@ type Config struct {
 	// ServerIPAddress is the public IP address of the server.
 	ServerIPAddress string
 
+	// ServerIPv6Address is an optional public IPv6 address of the server.
+	// When set, each TunnelProtocolPorts listener is also run on this
+	// address, with the exception of protocols which don't support IPv6
+	// listeners (MARIONETTE and TAPDANCE).
+	ServerIPv6Address string
+
 	// WebServerPort is the listening port of the web server.
 	// When <= 0, no web server component is run.
 	WebServerPort int
@@ -131,16 +137,41 @@ type Config struct {
 	// WebServerPortForwardAddress.
 	WebServerPortForwardRedirectAddress string
 
+	// TorORPortForwarding runs the server as a Tor pluggable transport
+	// server, a bridge, in managed proxy mode. psiphond must be launched by
+	// Tor, via ServerTransportPlugin, using the "psiphon" transport method
+	// name. In this mode, TCP port forwards to the transport address
+	// reported to Tor, which Tor clients use as the bridge address, are
+	// connected to Tor's extended ORPort, or ORPort. All other port forwards
+	// are handled, and subject to traffic rules, as usual.
+	//
+	// The transport address reported to Tor is ServerIPAddress with the
+	// port of the first tunnel protocol in TunnelProtocolPorts, in
+	// protocol.GetSupportedTunnelProtocols order, which clients dial directly
+	// over TCP; TunnelProtocolPorts must include at least one such protocol.
+	// The packet tunnel is not supported in this mode.
+	//
+	// The server's server entry should include the "tor-orport-forwarding"
+	// capability, which GenerateConfig adds, as Tor pluggable transport
+	// clients select only servers with this capability.
+	TorORPortForwarding bool
+
 	// TunnelProtocolPorts specifies which tunnel protocols to run
 	// and which ports to listen on for each protocol. Valid tunnel
 	// protocols include:
 	// "SSH", "OSSH", "UNFRONTED-MEEK-OSSH", "UNFRONTED-MEEK-HTTPS-OSSH",
 	// "UNFRONTED-MEEK-SESSION-TICKET-OSSH", "FRONTED-MEEK-OSSH",
 	// ""FRONTED-MEEK-QUIC-OSSH" FRONTED-MEEK-HTTP-OSSH", "QUIC-OSSH",
-	// ""MARIONETTE-OSSH", and TAPDANCE-OSSH".
+	// ""MARIONETTE-OSSH", TAPDANCE-OSSH", "WS-OSSH", "WSS-OSSH", and
+	// "FRONTED-WSS-OSSH".
 	//
 	// In the case of "MARIONETTE-OSSH" the port value is ignored and must be
 	// set to 0. The port value specified in the Marionette format is used.
+	//
+	// The WebSocket protocols are run by a meek server, which accepts both
+	// WebSocket upgrades and meek polling requests on any meek protocol
+	// port. Clients dial "WS-OSSH" and "WSS-OSSH" on the server entry
+	// WebSocket and WebSocket TLS ports, respectively.
 	TunnelProtocolPorts map[string]int
 
 	// TunnelProtocolPassthroughAddresses specifies passthrough addresses to be
@@ -244,6 +275,13 @@ type Config struct {
 	// is 0.
 	MeekCachedResponsePoolBufferCount int
 
+	// MeekEnableHTTP2Streaming enables HTTP/2 on meek HTTPS listeners.
+	// Clients which negotiate HTTP/2, end to end, may then relay tunnel
+	// traffic over a single, long-lived streaming request instead of
+	// polling. When HTTP/2 is not negotiated, as when a CDN connects to
+	// the meek server using HTTP/1.1, clients fall back to polling.
+	MeekEnableHTTP2Streaming bool
+
 	// UDPInterceptUdpgwServerAddress specifies the network address of
 	// a udpgw server which clients may be port forwarding to. When
 	// specified, these TCP port forwards are intercepted and handled
@@ -257,18 +295,70 @@ type Config struct {
 	// prohibited destination.
 	UDPInterceptUdpgwServerAddress string
 
+	// DatagramChannelPort specifies a UDP port, on ServerIPAddress, on
+	// which to receive obfuscated datagram channel traffic. When specified,
+	// clients may request datagram channel sessions, through the tunnel, to
+	// carry udpgw messages and packet tunnel packets unreliably, avoiding
+	// the head-of-line blocking of the tunnel stream. udpgw datagram
+	// channels require UDPInterceptUdpgwServerAddress, and packet tunnel
+	// datagram channels require RunPacketTunnel.
+	//
+	// The datagram channel port isn't bound on ServerIPv6Address: clients
+	// always send datagram channel traffic to the server entry IP address,
+	// ServerIPAddress, even when the tunnel uses IPv6.
+	DatagramChannelPort int
+
 	// DNSResolverIPAddress specifies the IP address of a DNS server
 	// to be used when "/etc/resolv.conf" doesn't exist or fails to
 	// parse. When blank, "/etc/resolv.conf" must contain a usable
 	// "nameserver" entry.
 	DNSResolverIPAddress string
 
+	// DNSResolverUpstreams specifies a list of upstream DNS resolvers which
+	// are used to resolve TCP port forward hostnames. See
+	// DNSResolverUpstream for the supported protocols. Each resolution tries
+	// the upstreams in a random order until one succeeds. When omitted, the
+	// system resolver is used.
+	//
+	// DNSResolverUpstreams doesn't apply to UDP DNS port forwards or packet
+	// tunnel transparent DNS, which use the DNSResolverIPAddress or
+	// "/etc/resolv.conf" resolver.
+	DNSResolverUpstreams []DNSResolverUpstream
+
+	// DNSResolverCacheMaxEntries specifies the maximum number of cached
+	// DNSResolverUpstreams responses. The cache is shared by all clients.
+	// When omitted, DEFAULT_DNS_RESOLVER_CACHE_MAX_ENTRIES is used. A value
+	// of 0 disables the cache.
+	DNSResolverCacheMaxEntries *int
+
+	// DNSResolverCacheMaxTTLSeconds specifies a cap on the TTL of cached
+	// responses. When omitted, DEFAULT_DNS_RESOLVER_CACHE_MAX_TTL_SECONDS is
+	// used. A value of 0 disables the cache.
+	DNSResolverCacheMaxTTLSeconds *int
+
 	// LoadMonitorPeriodSeconds indicates how frequently to log server
 	// load information (number of connected clients per tunnel protocol,
 	// number of running goroutines, amount of memory allocated, etc.)
 	// The default, 0, disables load logging.
 	LoadMonitorPeriodSeconds int
 
+	// MetricsServerAddress specifies a network address, host:port, on which
+	// to run an HTTP server which serves server load and tunnel metrics, at
+	// the path "/metrics", in the Prometheus text exposition format. The
+	// metrics include the load stats logged by the load monitor, meek
+	// session counts, SSH handshake concurrency, and port forward dial
+	// results.
+	//
+	// The metrics server uses plain HTTP and should listen only on a
+	// loopback or private network interface. The default, blank, disables
+	// the metrics server.
+	MetricsServerAddress string
+
+	// MetricsServerAuthorizationToken is an optional bearer token. When
+	// set, metrics requests must include the header
+	// "Authorization: Bearer <MetricsServerAuthorizationToken>".
+	MetricsServerAuthorizationToken string
+
 	// ProcessProfileOutputDirectory is the path of a directory to which
 	// process profiles will be written when signaled with SIGUSR2. The
 	// files are overwritten on each invocation. When set to the default
@@ -310,6 +400,15 @@ type Config struct {
 	// tun.ServerConfig.SudoNetworkConfigCommands.
 	PacketTunnelSudoNetworkConfigCommands bool
 
+	// PacketTunnelUserspaceStack specifies that packet tunnel client flows
+	// are to be terminated in a userspace TCP/IP stack, tun.Stack, and
+	// dialed as ordinary port forwards, subject to the same traffic rules,
+	// OSL seeding, and blocklist checks. In this mode, no tun device,
+	// network configuration, or NAT is required, and
+	// PacketTunnelEgressInterface, PacketTunnelSessionIdleExpirySeconds,
+	// and PacketTunnelSudoNetworkConfigCommands are ignored.
+	PacketTunnelUserspaceStack bool
+
 	// MaxConcurrentSSHHandshakes specifies a limit on the number of concurrent
 	// SSH handshake negotiations. This is set to mitigate spikes in memory
 	// allocations and CPU usage associated with SSH handshakes when many clients
@@ -360,6 +459,12 @@ type Config struct {
 	// addition to logging events.
 	BlocklistActive bool
 
+	// DataQuotaStateFilename is the path of a file in which traffic rules
+	// DataQuota usage is saved. Usage is loaded from this file on startup,
+	// so quotas are enforced across psiphond restarts. When omitted, usage
+	// is retained in memory only.
+	DataQuotaStateFilename string
+
 	// OwnEncodedServerEntries is a list of the server's own encoded server
 	// entries, idenfified by server entry tag. These values are used in the
 	// handshake API to update clients that don't yet have a signed copy of these
@@ -388,6 +493,11 @@ func (config *Config) RunLoadMonitor() bool {
 	return config.LoadMonitorPeriodSeconds > 0
 }
 
+// RunMetricsServer indicates whether to run a metrics server component.
+func (config *Config) RunMetricsServer() bool {
+	return config.MetricsServerAddress != ""
+}
+
 // RunPeriodicGarbageCollection indicates whether to run periodic garbage collection.
 func (config *Config) RunPeriodicGarbageCollection() bool {
 	return config.periodicGarbageCollection > 0
@@ -427,6 +537,13 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 		return nil, errors.TraceNew("ServerIPAddress is required")
 	}
 
+	if config.ServerIPv6Address != "" {
+		IP := net.ParseIP(config.ServerIPv6Address)
+		if IP == nil || IP.To4() != nil {
+			return nil, errors.TraceNew("invalid ServerIPv6Address")
+		}
+	}
+
 	if config.WebServerPort > 0 && (config.WebServerSecret == "" || config.WebServerCertificate == "" ||
 		config.WebServerPrivateKey == "") {
 
@@ -452,8 +569,23 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 		}
 	}
 
+	if config.TorORPortForwarding {
+		if getTorPluggableTransportMethodAddr(&config) == nil {
+			return nil, errors.TraceNew("TorORPortForwarding requires a direct TCP tunnel protocol")
+		}
+		if config.RunPacketTunnel {
+			return nil, errors.TraceNew("TorORPortForwarding is incompatible with RunPacketTunnel")
+		}
+	}
+
+	if config.MetricsServerAddress != "" {
+		if err := validateNetworkAddress(config.MetricsServerAddress, false); err != nil {
+			return nil, errors.TraceNew("MetricsServerAddress is invalid")
+		}
+	}
+
 	for tunnelProtocol, port := range config.TunnelProtocolPorts {
-		if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+		if !protocol.IsSupportedTunnelProtocol(tunnelProtocol) {
 			return nil, errors.Tracef("Unsupported tunnel protocol: %s", tunnelProtocol)
 		}
 		if protocol.TunnelProtocolUsesSSH(tunnelProtocol) ||
@@ -531,12 +663,27 @@ func LoadConfig(configJSON []byte) (*Config, error) {
 		}
 	}
 
+	if config.DatagramChannelPort < 0 || config.DatagramChannelPort > 65535 {
+		return nil, errors.TraceNew("DatagramChannelPort is invalid")
+	}
+
 	if config.DNSResolverIPAddress != "" {
 		if net.ParseIP(config.DNSResolverIPAddress) == nil {
 			return nil, errors.Tracef("DNSResolverIPAddress is invalid")
 		}
 	}
 
+	for _, upstream := range config.DNSResolverUpstreams {
+		if err := upstream.Validate(); err != nil {
+			return nil, errors.Tracef("DNSResolverUpstreams is invalid: %s", err)
+		}
+	}
+
+	if (config.DNSResolverCacheMaxEntries != nil && *config.DNSResolverCacheMaxEntries < 0) ||
+		(config.DNSResolverCacheMaxTTLSeconds != nil && *config.DNSResolverCacheMaxTTLSeconds < 0) {
+		return nil, errors.TraceNew("DNSResolverCache values must be >= 0")
+	}
+
 	config.periodicGarbageCollection = PERIODIC_GARBAGE_COLLECTION
 	if config.PeriodicGarbageCollectionSeconds != nil {
 		config.periodicGarbageCollection = time.Duration(*config.PeriodicGarbageCollectionSeconds) * time.Second
@@ -581,6 +728,7 @@ type GenerateConfigParams struct {
 	SkipPanickingLogWriter      bool
 	LogLevel                    string
 	ServerIPAddress             string
+	ServerIPv6Address           string
 	WebServerPort               int
 	EnableSSHAPIRequests        bool
 	TunnelProtocolPorts         map[string]int
@@ -590,6 +738,8 @@ type GenerateConfigParams struct {
 	TacticsConfigFilename       string
 	TacticsRequestPublicKey     string
 	TacticsRequestObfuscatedKey string
+	DatagramChannelPort         int
+	TorORPortForwarding         bool
 }
 
 // GenerateConfig creates a new Psiphon server config. It returns JSON encoded
@@ -611,6 +761,13 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		return nil, nil, nil, nil, nil, errors.TraceNew("invalid IP address")
 	}
 
+	if params.ServerIPv6Address != "" {
+		IP := net.ParseIP(params.ServerIPv6Address)
+		if IP == nil || IP.To4() != nil {
+			return nil, nil, nil, nil, nil, errors.TraceNew("invalid IPv6 address")
+		}
+	}
+
 	if len(params.TunnelProtocolPorts) == 0 {
 		return nil, nil, nil, nil, nil, errors.TraceNew("no tunnel protocols")
 	}
@@ -624,7 +781,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 
 	for tunnelProtocol, port := range params.TunnelProtocolPorts {
 
-		if !common.Contains(protocol.SupportedTunnelProtocols, tunnelProtocol) {
+		if !protocol.IsSupportedTunnelProtocol(tunnelProtocol) {
 			return nil, nil, nil, nil, nil, errors.TraceNew("invalid tunnel protocol")
 		}
 
@@ -759,6 +916,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		GeoIPDatabaseFilenames:         nil,
 		HostID:                         "example-host-id",
 		ServerIPAddress:                params.ServerIPAddress,
+		ServerIPv6Address:              params.ServerIPv6Address,
 		DiscoveryValueHMACKey:          discoveryValueHMACKey,
 		WebServerPort:                  params.WebServerPort,
 		WebServerSecret:                webServerSecret,
@@ -773,6 +931,8 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		TunnelProtocolPorts:            params.TunnelProtocolPorts,
 		DNSResolverIPAddress:           "8.8.8.8",
 		UDPInterceptUdpgwServerAddress: "127.0.0.1:7300",
+		DatagramChannelPort:            params.DatagramChannelPort,
+		TorORPortForwarding:            params.TorORPortForwarding,
 		MeekCookieEncryptionPrivateKey: meekCookieEncryptionPrivateKey,
 		MeekObfuscatedKey:              meekObfuscatedKey,
 		MeekProhibitedHeaders:          nil,
@@ -864,7 +1024,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		}
 	}
 
-	capabilities := []string{}
+	capabilities := []string{protocol.CAPABILITY_TUNNEL_RESUMPTION}
 
 	if params.EnableSSHAPIRequests {
 		capabilities = append(capabilities, protocol.CAPABILITY_SSH_API_REQUESTS)
@@ -874,6 +1034,14 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		capabilities = append(capabilities, protocol.CAPABILITY_UNTUNNELED_WEB_API_REQUESTS)
 	}
 
+	if params.DatagramChannelPort != 0 {
+		capabilities = append(capabilities, protocol.CAPABILITY_DATAGRAM_CHANNEL)
+	}
+
+	if params.TorORPortForwarding {
+		capabilities = append(capabilities, protocol.CAPABILITY_TOR_OR_PORT_FORWARDING)
+	}
+
 	for tunnelProtocol := range params.TunnelProtocolPorts {
 		capabilities = append(capabilities, protocol.GetCapability(tunnelProtocol))
 
@@ -899,6 +1067,9 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		meekPort = params.TunnelProtocolPorts["UNFRONTED-MEEK-SESSION-TICKET-OSSH"]
 	}
 
+	webSocketPort := params.TunnelProtocolPorts["WS-OSSH"]
+	webSocketTLSPort := params.TunnelProtocolPorts["WSS-OSSH"]
+
 	// Note: fronting params are a stub; this server entry will exercise
 	// client and server fronting code paths, but not actually traverse
 	// a fronting hop.
@@ -916,6 +1087,7 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 
 	serverEntry := &protocol.ServerEntry{
 		IpAddress:                     params.ServerIPAddress,
+		IPv6Address:                   params.ServerIPv6Address,
 		WebServerPort:                 serverEntryWebServerPort,
 		WebServerSecret:               webServerSecret,
 		WebServerCertificate:          strippedWebServerCertificate,
@@ -929,6 +1101,8 @@ func GenerateConfig(params *GenerateConfigParams) ([]byte, []byte, []byte, []byt
 		Capabilities:                  capabilities,
 		Region:                        "US",
 		MeekServerPort:                meekPort,
+		WebSocketServerPort:           webSocketPort,
+		WebSocketTLSServerPort:        webSocketTLSPort,
 		MeekCookieEncryptionPublicKey: meekCookieEncryptionPublicKey,
 		MeekObfuscatedKey:             meekObfuscatedKey,
 		MeekFrontingHosts:             []string{params.ServerIPAddress},
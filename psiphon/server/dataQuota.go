@@ -0,0 +1,314 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+const (
+	DATA_QUOTA_KEY_SESSION       = "session"
+	DATA_QUOTA_KEY_AUTHORIZATION = "authorization"
+
+	DATA_QUOTA_ACTION_THROTTLE = "throttle"
+	DATA_QUOTA_ACTION_CLOSE    = "close"
+	DATA_QUOTA_ACTION_ALERT    = "alert"
+
+	DATA_QUOTA_UPDATE_PERIOD     = 5 * time.Second
+	DATA_QUOTA_STATE_SAVE_PERIOD = 1 * time.Minute
+	DATA_QUOTA_RECORD_EXPIRY     = 30 * 24 * time.Hour
+)
+
+// DataQuota specifies a cumulative data transfer quota, counting all bytes
+// transferred in both directions, which applies across all tunnels with the
+// same quota key; and the actions to take when the quota is exceeded.
+type DataQuota struct {
+
+	// Key specifies how usage is tracked. When "session", usage is tracked
+	// per client session ID, which persists across tunnel reconnections.
+	// When "authorization", usage is tracked per authorization ID, which
+	// additionally persists across client sessions. Clients without an
+	// active authorization are not subject to "authorization" quotas.
+	Key string
+
+	// AuthorizedAccessType specifies which of the client's active
+	// authorizations identifies an "authorization" quota. When omitted, the
+	// client's first active authorization is used.
+	AuthorizedAccessType string
+
+	// Bytes is the quota. Bytes must be > 0; to exempt clients from a
+	// quota, omit DataQuota.
+	Bytes int64
+
+	// ResetPeriodSeconds specifies the period after which usage is reset to
+	// 0. The period starts with the first usage. When omitted or 0, usage is
+	// never reset.
+	ResetPeriodSeconds int
+
+	// Actions is a list of actions to take when the quota is exceeded:
+	// "throttle", which replaces the traffic rules rate limits with
+	// ThrottleBytesPerSecond; "close", which closes the tunnel; and "alert",
+	// which sends a "data-quota-exceeded" alert request to the client. When
+	// both "alert" and "close" are specified, the alert is sent on a
+	// best-effort basis before the tunnel is closed.
+	Actions []string
+
+	// ThrottleBytesPerSecond is the read and write rate limit applied by the
+	// "throttle" action.
+	ThrottleBytesPerSecond int64
+}
+
+// Validate checks for correct input formats in a DataQuota.
+func (quota *DataQuota) Validate() error {
+
+	if quota.Key != DATA_QUOTA_KEY_SESSION &&
+		quota.Key != DATA_QUOTA_KEY_AUTHORIZATION {
+		return errors.Tracef("invalid key: %s", quota.Key)
+	}
+
+	if quota.AuthorizedAccessType != "" &&
+		quota.Key != DATA_QUOTA_KEY_AUTHORIZATION {
+		return errors.TraceNew("unexpected authorized access type")
+	}
+
+	if quota.Bytes <= 0 {
+		return errors.TraceNew("Bytes must be > 0")
+	}
+
+	if quota.ResetPeriodSeconds < 0 {
+		return errors.TraceNew("ResetPeriodSeconds must be >= 0")
+	}
+
+	if len(quota.Actions) == 0 {
+		return errors.TraceNew("missing actions")
+	}
+
+	for _, action := range quota.Actions {
+		switch action {
+		case DATA_QUOTA_ACTION_THROTTLE:
+			if quota.ThrottleBytesPerSecond <= 0 {
+				return errors.TraceNew("ThrottleBytesPerSecond must be > 0")
+			}
+		case DATA_QUOTA_ACTION_CLOSE, DATA_QUOTA_ACTION_ALERT:
+		default:
+			return errors.Tracef("invalid action: %s", action)
+		}
+	}
+
+	return nil
+}
+
+func (quota *DataQuota) hasAction(action string) bool {
+	return common.Contains(quota.Actions, action)
+}
+
+// dataQuotaConn wraps a tunnel connection and counts all bytes read and
+// written. Counted bytes are periodically taken and applied to the tunnel's
+// data quota, if any.
+type dataQuotaConn struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	bytes int64
+	net.Conn
+}
+
+func newDataQuotaConn(conn net.Conn) *dataQuotaConn {
+	return &dataQuotaConn{Conn: conn}
+}
+
+func (conn *dataQuotaConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	atomic.AddInt64(&conn.bytes, int64(n))
+	return n, err
+}
+
+func (conn *dataQuotaConn) Write(buffer []byte) (int, error) {
+	n, err := conn.Conn.Write(buffer)
+	atomic.AddInt64(&conn.bytes, int64(n))
+	return n, err
+}
+
+// takeBytes returns the number of bytes transferred since the previous
+// takeBytes call.
+func (conn *dataQuotaConn) takeBytes() int64 {
+	return atomic.SwapInt64(&conn.bytes, 0)
+}
+
+// addBytes adds bytes counted elsewhere, such as by a previous connection of
+// a resumed tunnel, to be returned by the next takeBytes call.
+func (conn *dataQuotaConn) addBytes(bytes int64) {
+	atomic.AddInt64(&conn.bytes, bytes)
+}
+
+// DataQuotaStore tracks data quota usage. When configured with a state
+// filename, usage is loaded on startup and periodically saved, so that
+// usage is retained across psiphond restarts.
+type DataQuotaStore struct {
+	saveMutex sync.Mutex
+	mutex     sync.Mutex
+	filename  string
+	records   map[string]*dataQuotaRecord
+	modified  bool
+}
+
+type dataQuotaRecord struct {
+	Bytes        int64
+	PeriodStart  time.Time
+	LastModified time.Time
+}
+
+// NewDataQuotaStore initializes a DataQuotaStore, loading any existing state
+// from the specified file. When filename is "", usage is not persisted.
+func NewDataQuotaStore(filename string) (*DataQuotaStore, error) {
+
+	store := &DataQuotaStore{
+		filename: filename,
+		records:  make(map[string]*dataQuotaRecord),
+	}
+
+	if filename == "" {
+		return store, nil
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, errors.Trace(err)
+	}
+
+	err = json.Unmarshal(content, &store.records)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return store, nil
+}
+
+// makeDataQuotaKey returns the store key for the specified quota key type
+// and session or authorization ID.
+func makeDataQuotaKey(quotaKey, ID string) string {
+	return quotaKey + ":" + ID
+}
+
+// Add adds bytes to the usage for the specified key and returns the total
+// usage in the current reset period. Add with 0 bytes may be used to get the
+// current usage.
+func (store *DataQuotaStore) Add(
+	key string, bytes int64, resetPeriod time.Duration) int64 {
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+
+	record, ok := store.records[key]
+	if !ok {
+		if bytes == 0 {
+			return 0
+		}
+		record = &dataQuotaRecord{PeriodStart: now}
+		store.records[key] = record
+	}
+
+	if resetPeriod > 0 && !now.Before(record.PeriodStart.Add(resetPeriod)) {
+		record.Bytes = 0
+		record.PeriodStart = now
+	}
+
+	if bytes > 0 {
+		record.Bytes += bytes
+		record.LastModified = now
+		store.modified = true
+	}
+
+	return record.Bytes
+}
+
+// Save discards records that haven't been modified for
+// DATA_QUOTA_RECORD_EXPIRY and then writes the current usage to the state
+// file, if one is configured and if usage has changed since the last Save.
+func (store *DataQuotaStore) Save() error {
+
+	// saveMutex serializes concurrent Save calls, such as the periodic save
+	// and the save on shutdown, across the write and rename of the shared
+	// temporary file, so that one Save can't rename a file being written by
+	// another or replace newer state with an older snapshot. mutex is not
+	// held during the file write, so Add isn't blocked on file I/O.
+
+	store.saveMutex.Lock()
+	defer store.saveMutex.Unlock()
+
+	store.mutex.Lock()
+
+	expiry := time.Now().Add(-DATA_QUOTA_RECORD_EXPIRY)
+	for key, record := range store.records {
+		if record.LastModified.Before(expiry) {
+			delete(store.records, key)
+			store.modified = true
+		}
+	}
+
+	if store.filename == "" || !store.modified {
+		store.mutex.Unlock()
+		return nil
+	}
+
+	content, err := json.Marshal(store.records)
+	store.modified = false
+
+	store.mutex.Unlock()
+
+	if err == nil {
+
+		// Write to a temporary file and rename, so that a crash during the
+		// write won't corrupt the existing state.
+
+		tempFilename := store.filename + ".tmp"
+
+		err = ioutil.WriteFile(tempFilename, content, 0600)
+		if err == nil {
+			err = os.Rename(tempFilename, store.filename)
+		}
+	}
+
+	if err != nil {
+
+		// Retry on the next Save.
+		store.mutex.Lock()
+		store.modified = true
+		store.mutex.Unlock()
+
+		return errors.Trace(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDataQuota(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphond-data-quota-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	// Test: data quotas are validated with traffic rules
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+	trafficRulesJSON := `
+    {
+        "DefaultRules" : {
+            "DataQuota" : {"Key" : "session", "Bytes" : 1000, "Actions" : ["close"]}
+        },
+        "FilteredRules" : [
+            {
+                "Filter" : {"AuthorizedAccessTypes" : ["access-type"]},
+                "Rules" : {
+                    "DataQuota" : {
+                        "Key" : "authorization",
+                        "AuthorizedAccessType" : "access-type",
+                        "Bytes" : 2000,
+                        "ResetPeriodSeconds" : 86400,
+                        "Actions" : ["throttle", "alert"],
+                        "ThrottleBytesPerSecond" : 100
+                    }
+                }
+            }
+        ]
+    }
+    `
+
+	err = ioutil.WriteFile(trafficRulesFilename, []byte(trafficRulesJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	set, err := NewTrafficRulesSet(trafficRulesFilename)
+	if err != nil {
+		t.Fatalf("NewTrafficRulesSet failed: %s", err)
+	}
+
+	trafficRules := set.GetTrafficRules(
+		true, "OSSH", GeoIPData{}, handshakeState{})
+	if trafficRules.DataQuota == nil ||
+		trafficRules.DataQuota.Key != DATA_QUOTA_KEY_SESSION {
+		t.Fatalf("unexpected default data quota")
+	}
+
+	trafficRules = set.GetTrafficRules(
+		true, "OSSH", GeoIPData{},
+		handshakeState{
+			completed:             true,
+			authorizedAccessTypes: []string{"access-type"},
+		})
+	if trafficRules.DataQuota == nil ||
+		trafficRules.DataQuota.Key != DATA_QUOTA_KEY_AUTHORIZATION ||
+		!trafficRules.DataQuota.hasAction(DATA_QUOTA_ACTION_THROTTLE) {
+		t.Fatalf("unexpected filtered data quota")
+	}
+
+	invalidQuotas := []string{
+		`{"Key" : "unknown", "Actions" : ["close"]}`,
+		`{"Key" : "session", "Bytes" : 1000, "AuthorizedAccessType" : "access-type", "Actions" : ["close"]}`,
+		`{"Key" : "session", "Bytes" : -1, "Actions" : ["close"]}`,
+		`{"Key" : "session", "Bytes" : 0, "Actions" : ["close"]}`,
+		`{"Key" : "session", "Bytes" : 1000, "ResetPeriodSeconds" : -1, "Actions" : ["close"]}`,
+		`{"Key" : "session"}`,
+		`{"Key" : "session", "Bytes" : 1000, "Actions" : ["unknown"]}`,
+		`{"Key" : "session", "Bytes" : 1000, "Actions" : ["throttle"]}`,
+	}
+
+	for _, invalidQuota := range invalidQuotas {
+
+		err = ioutil.WriteFile(
+			trafficRulesFilename,
+			[]byte(`{"DefaultRules" : {"DataQuota" : `+invalidQuota+`}}`),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		_, err = set.Reload()
+		if err == nil {
+			t.Fatalf("unexpected Reload success: %s", invalidQuota)
+		}
+	}
+
+	// Test: usage accumulates and is reset after the reset period
+
+	stateFilename := filepath.Join(testDataDirName, "data_quota_state.json")
+
+	store, err := NewDataQuotaStore(stateFilename)
+	if err != nil {
+		t.Fatalf("NewDataQuotaStore failed: %s", err)
+	}
+
+	sessionKey := makeDataQuotaKey(DATA_QUOTA_KEY_SESSION, "session-ID")
+	authorizationKey := makeDataQuotaKey(DATA_QUOTA_KEY_AUTHORIZATION, "authorization-ID")
+
+	if store.Add(sessionKey, 0, 0) != 0 {
+		t.Fatalf("unexpected initial usage")
+	}
+
+	store.Add(sessionKey, 100, 0)
+	if store.Add(sessionKey, 200, 0) != 300 {
+		t.Fatalf("unexpected session usage")
+	}
+
+	resetPeriod := 100 * time.Millisecond
+
+	store.Add(authorizationKey, 100, resetPeriod)
+	if store.Add(authorizationKey, 0, resetPeriod) != 100 {
+		t.Fatalf("unexpected authorization usage")
+	}
+
+	time.Sleep(resetPeriod)
+
+	if store.Add(authorizationKey, 0, resetPeriod) != 0 {
+		t.Fatalf("unexpected authorization usage after reset")
+	}
+
+	store.Add(authorizationKey, 50, resetPeriod)
+
+	// Test: usage persists across store instances
+
+	err = store.Save()
+	if err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+
+	store, err = NewDataQuotaStore(stateFilename)
+	if err != nil {
+		t.Fatalf("NewDataQuotaStore failed: %s", err)
+	}
+
+	if store.Add(sessionKey, 0, 0) != 300 ||
+		store.Add(authorizationKey, 0, time.Hour) != 50 {
+		t.Fatalf("unexpected usage after reload")
+	}
+
+	// Test: records not modified for DATA_QUOTA_RECORD_EXPIRY are discarded
+
+	store.mutex.Lock()
+	store.records[sessionKey].LastModified = time.Now().Add(-DATA_QUOTA_RECORD_EXPIRY - time.Hour)
+	store.mutex.Unlock()
+
+	err = store.Save()
+	if err != nil {
+		t.Fatalf("Save failed: %s", err)
+	}
+
+	store, err = NewDataQuotaStore(stateFilename)
+	if err != nil {
+		t.Fatalf("NewDataQuotaStore failed: %s", err)
+	}
+
+	if store.Add(sessionKey, 0, 0) != 0 ||
+		store.Add(authorizationKey, 0, time.Hour) != 50 {
+		t.Fatalf("unexpected usage after expiry")
+	}
+
+	// Test: concurrent saves don't fail or leave corrupt state
+
+	var waitGroup sync.WaitGroup
+	saveErrors := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			store.Add(sessionKey, 1, 0)
+			saveErrors <- store.Save()
+		}()
+	}
+	waitGroup.Wait()
+	close(saveErrors)
+
+	for err := range saveErrors {
+		if err != nil {
+			t.Fatalf("Save failed: %s", err)
+		}
+	}
+
+	store, err = NewDataQuotaStore(stateFilename)
+	if err != nil {
+		t.Fatalf("NewDataQuotaStore failed: %s", err)
+	}
+
+	if store.Add(sessionKey, 0, 0) != 10 {
+		t.Fatalf("unexpected usage after concurrent saves")
+	}
+}
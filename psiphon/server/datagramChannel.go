@@ -0,0 +1,414 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/datagram"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpgw"
+	"github.com/juju/ratelimit"
+)
+
+// datagramChannel is a datagram channel session established by a client.
+//
+// Datagram channel traffic doesn't flow through the tunnel connection, so
+// each channel has its own data quota accounting, which tracks the client's
+// tunnel connection data quota. All of a client's datagram channels share
+// one datagramChannelThrottle, which applies the client's rate limits.
+//
+// datagramChannel implements io.Closer; Close closes and unregisters the
+// channel.
+type datagramChannel struct {
+	sshClient     *sshClient
+	dataQuotaConn *dataQuotaConn
+	conn          *throttledDatagramConn
+}
+
+// Close implements the io.Closer interface.
+func (channel *datagramChannel) Close() error {
+	channel.sshClient.removeDatagramChannel(channel)
+	return nil
+}
+
+// listenDatagramChannel creates the datagram channel listener, which
+// receives datagrams for all clients' datagram channel sessions.
+func listenDatagramChannel(localAddress string) (*datagram.Listener, error) {
+
+	packetConn, err := net.ListenPacket("udp", localAddress)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	listener, err := datagram.Listen(packetConn)
+	if err != nil {
+		packetConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return listener, nil
+}
+
+// handleDatagramChannelRequest creates a new datagram channel session, which
+// the client then connects to directly, over UDP, using the session
+// parameters in the response.
+//
+// A "udpgw" datagram channel runs the udpgw protocol, and replaces any
+// existing UDP channel, as handleUDPChannel does. A "packet-tunnel"
+// datagram channel is connected to the packet tunnel server, replacing any
+// existing packet tunnel channel.
+func (sshClient *sshClient) handleDatagramChannelRequest(
+	waitGroup *sync.WaitGroup, payload []byte) ([]byte, error) {
+
+	datagramListener := sshClient.sshServer.datagramListener
+	if datagramListener == nil {
+		return nil, errors.TraceNew("datagram channel not supported")
+	}
+
+	sshClient.Lock()
+	completed := sshClient.handshakeState.completed
+	sshClient.Unlock()
+
+	if !completed {
+		return nil, errors.TraceNew("handshake not completed")
+	}
+
+	var request protocol.DatagramChannelRequest
+	err := json.Unmarshal(payload, &request)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	config := sshClient.sshServer.support.Config
+
+	var frameSize datagram.FrameSize
+
+	switch request.Purpose {
+
+	case protocol.DATAGRAM_CHANNEL_PURPOSE_UDPGW:
+		if config.UDPInterceptUdpgwServerAddress == "" {
+			return nil, errors.TraceNew("udpgw not supported")
+		}
+		frameSize = udpgw.FrameSize
+
+	case protocol.DATAGRAM_CHANNEL_PURPOSE_PACKET_TUNNEL:
+
+		// The userspace packet tunnel stack enqueues TCP port forwards with
+		// the client's SSH channels, so only the packet tunnel server is
+		// supported.
+
+		if !config.RunPacketTunnel || config.PacketTunnelUserspaceStack {
+			return nil, errors.TraceNew("packet tunnel not supported")
+		}
+		frameSize = tun.ChannelFrameSize
+
+	default:
+		return nil, errors.Tracef("unknown purpose: %s", request.Purpose)
+	}
+
+	conn, params, err := datagramListener.NewSession()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	channel, err := sshClient.addDatagramChannel(datagram.NewFramedConn(conn, frameSize))
+	if err != nil {
+		conn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	// The channel replaces any existing UDP or packet tunnel channel. When
+	// the replaced channel is a datagram channel, it's also unregistered.
+
+	switch request.Purpose {
+
+	case protocol.DATAGRAM_CHANNEL_PURPOSE_UDPGW:
+
+		sshClient.setUDPChannel(channel)
+
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			defer sshClient.removeDatagramChannel(channel)
+			sshClient.runUDPPortForwardMultiplexer(channel.conn)
+		}()
+
+	case protocol.DATAGRAM_CHANNEL_PURPOSE_PACKET_TUNNEL:
+
+		sshClient.setPacketTunnelChannel(channel)
+
+		err = sshClient.connectPacketTunnelServer(channel.conn)
+		if err != nil {
+			sshClient.setPacketTunnelChannel(nil)
+			return nil, errors.Trace(err)
+		}
+	}
+
+	responsePayload, err := json.Marshal(
+		&protocol.DatagramChannelResponse{
+			Port:           config.DatagramChannelPort,
+			SessionID:      params.SessionID,
+			SessionKey:     params.SessionKey,
+			ObfuscationKey: params.ObfuscationKey,
+		})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return responsePayload, nil
+}
+
+// addDatagramChannel creates and registers a new datagram channel, over
+// conn, for throttling, data quota accounting, and cleanup.
+// addDatagramChannel fails when the tunnel has stopped or when the client
+// has MAX_DATAGRAM_CHANNELS channels.
+func (sshClient *sshClient) addDatagramChannel(conn net.Conn) (*datagramChannel, error) {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	if sshClient.runCtx.Err() != nil {
+		return nil, errors.TraceNew("tunnel stopped")
+	}
+
+	if len(sshClient.datagramChannels) >= MAX_DATAGRAM_CHANNELS {
+		return nil, errors.TraceNew("too many datagram channels")
+	}
+
+	if sshClient.datagramChannels == nil {
+		sshClient.datagramChannels = make(map[*datagramChannel]bool)
+		sshClient.datagramChannelThrottle = newDatagramChannelThrottle(
+			sshClient.getRateLimits())
+	}
+
+	dataQuotaConn := newDataQuotaConn(conn)
+
+	channel := &datagramChannel{
+		sshClient:     sshClient,
+		dataQuotaConn: dataQuotaConn,
+		conn: newThrottledDatagramConn(
+			dataQuotaConn, sshClient.datagramChannelThrottle),
+	}
+
+	sshClient.datagramChannels[channel] = true
+
+	return channel, nil
+}
+
+// removeDatagramChannel closes and unregisters a datagram channel. Bytes
+// transferred on the channel are added to the tunnel connection data quota
+// usage.
+func (sshClient *sshClient) removeDatagramChannel(channel *datagramChannel) {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	channel.conn.Close()
+
+	if !sshClient.datagramChannels[channel] {
+		return
+	}
+	delete(sshClient.datagramChannels, channel)
+
+	if sshClient.dataQuotaConn != nil {
+		sshClient.dataQuotaConn.addBytes(channel.dataQuotaConn.takeBytes())
+	}
+}
+
+// closeDatagramChannels closes all datagram channels. closeDatagramChannels
+// must be called after sshClient.stopRunning, which prevents new datagram
+// channels from being added.
+func (sshClient *sshClient) closeDatagramChannels() {
+	sshClient.Lock()
+	channels := make([]*datagramChannel, 0, len(sshClient.datagramChannels))
+	for channel := range sshClient.datagramChannels {
+		channels = append(channels, channel)
+	}
+	sshClient.Unlock()
+
+	for _, channel := range channels {
+		sshClient.removeDatagramChannel(channel)
+	}
+}
+
+// setDatagramChannelRateLimits applies the client's current rate limits to
+// its datagram channels.
+//
+// The caller must hold the sshClient lock.
+func (sshClient *sshClient) setDatagramChannelRateLimits() {
+	if sshClient.datagramChannelThrottle != nil {
+		sshClient.datagramChannelThrottle.setLimits(sshClient.getRateLimits())
+	}
+}
+
+// takeDatagramChannelBytes returns the number of bytes transferred on all
+// datagram channels since the previous takeDatagramChannelBytes call.
+//
+// The caller must hold the sshClient lock.
+func (sshClient *sshClient) takeDatagramChannelBytes() int64 {
+	var bytes int64
+	for channel := range sshClient.datagramChannels {
+		bytes += channel.dataQuotaConn.takeBytes()
+	}
+	return bytes
+}
+
+// datagramChannelThrottle applies rate limits to all of a client's datagram
+// channels in aggregate, with the same semantics as common.ThrottledConn;
+// otherwise, each additional channel would get the client's full rate.
+type datagramChannelThrottle struct {
+	mutex                 sync.Mutex
+	readUnthrottledBytes  int64
+	readRateLimiter       *ratelimit.Bucket
+	writeUnthrottledBytes int64
+	writeRateLimiter      *ratelimit.Bucket
+	closeAfterExhausted   bool
+}
+
+func newDatagramChannelThrottle(limits common.RateLimits) *datagramChannelThrottle {
+	throttle := &datagramChannelThrottle{}
+	throttle.setLimits(limits)
+	return throttle
+}
+
+// setLimits replaces the rate limits. Any existing throttling state is
+// reset.
+func (throttle *datagramChannelThrottle) setLimits(limits common.RateLimits) {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+
+	throttle.readUnthrottledBytes = limits.ReadUnthrottledBytes
+	throttle.readRateLimiter = newRateLimitBucket(limits.ReadBytesPerSecond)
+	throttle.writeUnthrottledBytes = limits.WriteUnthrottledBytes
+	throttle.writeRateLimiter = newRateLimitBucket(limits.WriteBytesPerSecond)
+	throttle.closeAfterExhausted = limits.CloseAfterExhausted
+}
+
+func newRateLimitBucket(bytesPerSecond int64) *ratelimit.Bucket {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return ratelimit.NewBucketWithRate(float64(bytesPerSecond), bytesPerSecond)
+}
+
+// take accounts for n bytes read or written and returns the delay which
+// enforces the rate limit. take returns false when the unthrottled bytes
+// are exhausted and the channel should be closed.
+func (throttle *datagramChannelThrottle) take(isRead bool, n int) (time.Duration, bool) {
+	throttle.mutex.Lock()
+
+	unthrottledBytes := &throttle.writeUnthrottledBytes
+	rateLimiter := throttle.writeRateLimiter
+	if isRead {
+		unthrottledBytes = &throttle.readUnthrottledBytes
+		rateLimiter = throttle.readRateLimiter
+	}
+
+	if *unthrottledBytes > 0 {
+		*unthrottledBytes -= int64(n)
+		throttle.mutex.Unlock()
+		return 0, true
+	}
+
+	if throttle.closeAfterExhausted {
+		throttle.mutex.Unlock()
+		return 0, false
+	}
+
+	throttle.mutex.Unlock()
+
+	if rateLimiter == nil {
+		return 0, true
+	}
+
+	// ratelimit.Bucket is safe for concurrent use.
+	return rateLimiter.Take(int64(n)), true
+}
+
+// throttledDatagramConn applies a client's datagramChannelThrottle to one
+// datagram channel.
+type throttledDatagramConn struct {
+	net.Conn
+	throttle      *datagramChannelThrottle
+	closeOnce     sync.Once
+	stopBroadcast chan struct{}
+}
+
+func newThrottledDatagramConn(
+	conn net.Conn, throttle *datagramChannelThrottle) *throttledDatagramConn {
+
+	return &throttledDatagramConn{
+		Conn:          conn,
+		throttle:      throttle,
+		stopBroadcast: make(chan struct{}),
+	}
+}
+
+func (conn *throttledDatagramConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if n > 0 {
+		throttleErr := conn.wait(true, n)
+		if throttleErr != nil {
+			return 0, errors.Trace(throttleErr)
+		}
+	}
+	return n, err
+}
+
+func (conn *throttledDatagramConn) Write(buffer []byte) (int, error) {
+	err := conn.wait(false, len(buffer))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return conn.Conn.Write(buffer)
+}
+
+func (conn *throttledDatagramConn) wait(isRead bool, n int) error {
+
+	delay, ok := conn.throttle.take(isRead, n)
+	if !ok {
+		conn.Close()
+		return errors.TraceNew("throttled conn exhausted")
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-conn.stopBroadcast:
+			return errors.TraceNew("throttled conn closed")
+		}
+	}
+
+	return nil
+}
+
+func (conn *throttledDatagramConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.stopBroadcast)
+	})
+	return conn.Conn.Close()
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+)
+
+func TestDatagramChannelThrottle(t *testing.T) {
+
+	// Test: the rate limit applies to all channels in aggregate
+
+	throttle := newDatagramChannelThrottle(
+		common.RateLimits{WriteBytesPerSecond: 1000})
+
+	newConn := func() net.Conn {
+		conn, peerConn := net.Pipe()
+		go io.Copy(ioutil.Discard, peerConn)
+		return newThrottledDatagramConn(conn, throttle)
+	}
+
+	conn1 := newConn()
+	defer conn1.Close()
+
+	conn2 := newConn()
+	defer conn2.Close()
+
+	buffer := make([]byte, 1000)
+
+	startTime := time.Now()
+
+	_, err := conn1.Write(buffer)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	_, err = conn2.Write(buffer)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	elapsedTime := time.Since(startTime)
+	if elapsedTime < 900*time.Millisecond {
+		t.Fatalf("unexpected elapsed time: %v", elapsedTime)
+	}
+
+	// Test: closing a channel interrupts throttling
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn2.Close()
+	}()
+
+	startTime = time.Now()
+
+	_, err = conn2.Write(buffer)
+	if err == nil {
+		t.Fatalf("unexpected Write success")
+	}
+
+	elapsedTime = time.Since(startTime)
+	if elapsedTime > 900*time.Millisecond {
+		t.Fatalf("unexpected elapsed time: %v", elapsedTime)
+	}
+
+	// Test: unthrottled bytes are exhausted across all channels
+
+	throttle.setLimits(common.RateLimits{
+		ReadUnthrottledBytes:  1000,
+		WriteUnthrottledBytes: 1000,
+		CloseAfterExhausted:   true,
+	})
+
+	_, err = conn1.Write(buffer)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	conn3 := newConn()
+	defer conn3.Close()
+
+	_, err = conn3.Write(buffer)
+	if err == nil {
+		t.Fatalf("unexpected Write success")
+	}
+}
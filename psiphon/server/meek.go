@@ -39,12 +39,14 @@ import (
 	"time"
 
 	"github.com/Psiphon-Labs/goarista/monotime"
+	"github.com/Psiphon-Labs/net/http2"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/values"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/websocket"
 	tris "github.com/Psiphon-Labs/tls-tris"
 	"golang.org/x/crypto/nacl/box"
 )
@@ -96,6 +98,12 @@ const (
 // MeekServer hooks into TunnelServer via the net.Conn interface by transforming the
 // HTTP payload traffic for a given session into net.Conn conforming Read()s and Write()s via
 // the meekConn struct.
+//
+// MeekServer also serves the WebSocket protocols: a WebSocket upgrade request carrying a meek
+// cookie is upgraded and the WebSocket connection is handed to TunnelServer as the client conn.
+//
+// When MeekEnableHTTP2Streaming is set, HTTPS meek listeners negotiate HTTP/2, and a client may
+// relay its meek session over a single, long-lived streaming request instead of polling.
 type MeekServer struct {
 	support                *SupportServices
 	listener               net.Listener
@@ -211,6 +219,9 @@ func (server *MeekServer) Run() error {
 	//   timeout net.Conn and didn't use http.Server timeouts. We could do the same
 	//   here (use ActivityMonitoredConn) but the stock http.Server timeouts should
 	//   now be sufficient.
+	// - For HTTP/2 streaming requests, WriteTimeout is applied to each response
+	//   write, as applying it to the entire request would terminate long-lived
+	//   streams; see http2DeadlineHandler.
 
 	httpServer := &http.Server{
 		ReadTimeout:  MEEK_HTTP_CLIENT_IO_TIMEOUT,
@@ -226,6 +237,12 @@ func (server *MeekServer) Run() error {
 	var err error
 	if server.tlsConfig != nil {
 		httpsServer := HTTPSServer{Server: httpServer}
+		if server.support.Config.MeekEnableHTTP2Streaming {
+			httpsServer.HTTP2Server = &http2.Server{
+				IdleTimeout: MEEK_HTTP_CLIENT_IO_TIMEOUT,
+			}
+			httpsServer.IsHTTP2StreamingRequest = isMeekStreamingRequest
+		}
 		err = httpsServer.ServeTLS(server.listener, server.tlsConfig)
 	} else {
 		err = httpServer.Serve(server.listener)
@@ -288,6 +305,15 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 		}
 	}
 
+	// A WebSocket upgrade request, with a meek cookie, establishes a tunnel
+	// relayed over the WebSocket connection instead of a polling meek
+	// session.
+
+	if websocket.IsUpgradeRequest(request) {
+		server.handleWebSocket(responseWriter, request, meekCookie)
+		return
+	}
+
 	// A valid meek cookie indicates which class of request this is:
 	//
 	// 1. A new meek session. Create a new session ID and proceed with
@@ -341,8 +367,17 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 	// TODO: interrupt an existing handler? The existing handler will be
 	// sending data to the cached response, but if that buffer fills, the
 	// session will be lost.
+	//
+	// The client continues to poll while a streaming request is pending, so
+	// streaming requests are not counted and are not discarded in favor of
+	// newer polling requests.
+
+	isStream := isMeekStreamingRequest(request)
 
-	requestNumber := atomic.AddInt64(&session.requestCount, 1)
+	var requestNumber int64
+	if !isStream {
+		requestNumber = atomic.AddInt64(&session.requestCount, 1)
+	}
 
 	// Wait for the existing request to complete.
 	session.lock.Lock()
@@ -355,11 +390,30 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 	// discard this request. The session is no longer valid, and the final call
 	// to session.cachedResponse.Reset may have already occured, so any further
 	// session.cachedResponse access may deplete resources (fail to refill the pool).
-	if atomic.LoadInt64(&session.requestCount) > requestNumber || session.deleted {
+	if (!isStream && atomic.LoadInt64(&session.requestCount) > requestNumber) ||
+		session.deleted {
+
 		common.TerminateHTTPConnection(responseWriter, request)
 		return
 	}
 
+	// Once a stream is established, it relays all tunnel traffic for the
+	// session. Any further request is rejected without reading its payload,
+	// and the client then sends that payload over the stream.
+
+	if session.streaming {
+		responseWriter.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	// A streaming request relays all further tunnel traffic for the
+	// session, in both directions, instead of a single poll.
+
+	if isStream {
+		server.handleStream(responseWriter, request, sessionID, meekCookie, session)
+		return
+	}
+
 	// pumpReads causes a TunnelServer/SSH goroutine blocking on a Read to
 	// read the request body as upstream traffic.
 	// TODO: run pumpReads and pumpWrites concurrently?
@@ -496,6 +550,74 @@ func (server *MeekServer) ServeHTTP(responseWriter http.ResponseWriter, request
 	}
 }
 
+// handleStream relays tunnel traffic for a meek session over a single,
+// long-lived request, concurrently reading the request body as upstream
+// traffic and streaming downstream traffic into the response body.
+//
+// The caller must hold the session lock. Once the stream is accepted,
+// handleStream releases the lock while relaying, so that concurrent polling
+// requests are promptly rejected, and reacquires it before returning.
+//
+// Streaming requires HTTP/2: the HTTP/1.1 server cannot continue to read a
+// request body once the response has started. A streaming request received
+// over HTTP/1.1, as when a CDN connects to the meek server using HTTP/1.1,
+// is rejected before any traffic is relayed, and the client then falls back
+// to polling.
+//
+// Streamed response payload is not retained in the cached response, so an
+// interrupted stream cannot be resumed and the session is deleted when the
+// stream ends.
+func (server *MeekServer) handleStream(
+	responseWriter http.ResponseWriter,
+	request *http.Request,
+	sessionID string,
+	meekCookie *http.Cookie,
+	session *meekSession) {
+
+	flusher, ok := responseWriter.(http.Flusher)
+	if !ok || request.ProtoMajor < 2 {
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	if session.meekProtocolVersion >= MEEK_PROTOCOL_VERSION_2 && !session.sessionIDSent {
+		http.SetCookie(responseWriter, &http.Cookie{Name: meekCookie.Name, Value: sessionID})
+		session.sessionIDSent = true
+	}
+
+	// Send the response headers immediately. The echoed header indicates to
+	// the client that the stream is accepted and that it may start sending
+	// upstream traffic.
+
+	session.streaming = true
+
+	responseWriter.Header().Set(protocol.MEEK_HTTP2_STREAMING_HEADER, "1")
+	responseWriter.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	session.lock.Unlock()
+
+	stopReading := make(chan struct{})
+	readResult := make(chan error, 1)
+	go func() {
+		readResult <- session.clientConn.pumpReadStream(request.Body, stopReading)
+	}()
+
+	err := session.clientConn.pumpWriteStream(responseWriter, flusher, readResult)
+	close(stopReading)
+
+	// Debug since errors such as "i/o timeout" occur during normal operation;
+	// also, golang network error messages may contain client IP.
+	log.WithTraceFields(LogFields{"error": err}).Debug("meek stream ended")
+
+	session.lock.Lock()
+	session.delete(true)
+}
+
+func isMeekStreamingRequest(request *http.Request) bool {
+	return request.Header.Get(protocol.MEEK_HTTP2_STREAMING_HEADER) != ""
+}
+
 func checkRangeHeader(request *http.Request) (int, bool) {
 	rangeHeader := request.Header.Get("Range")
 	if rangeHeader == "" {
@@ -522,6 +644,13 @@ func checkRangeHeader(request *http.Request) (int, bool) {
 	return position, true
 }
 
+// getSessionCount returns the number of current meek sessions.
+func (server *MeekServer) getSessionCount() int {
+	server.sessionsLock.RLock()
+	defer server.sessionsLock.RUnlock()
+	return len(server.sessions)
+}
+
 // getSessionOrEndpoint checks if the cookie corresponds to an existing tunnel
 // relay session ID. If no session is found, the cookie must be an obfuscated
 // meek cookie. A new session is created when the meek cookie indicates relay
@@ -543,30 +672,7 @@ func (server *MeekServer) getSessionOrEndpoint(
 		return existingSessionID, session, "", "", nil
 	}
 
-	// Determine the client remote address, which is used for geolocation
-	// and stats. When an intermediate proxy or CDN is in use, we may be
-	// able to determine the original client address by inspecting HTTP
-	// headers such as X-Forwarded-For.
-
-	clientIP := strings.Split(request.RemoteAddr, ":")[0]
-
-	if len(server.support.Config.MeekProxyForwardedForHeaders) > 0 {
-		for _, header := range server.support.Config.MeekProxyForwardedForHeaders {
-			value := request.Header.Get(header)
-			if len(value) > 0 {
-				// Some headers, such as X-Forwarded-For, are a comma-separated
-				// list of IPs (each proxy in a chain). The first IP should be
-				// the client IP.
-				proxyClientIP := strings.Split(value, ",")[0]
-				if net.ParseIP(proxyClientIP) != nil &&
-					server.support.GeoIPService.Lookup(proxyClientIP).Country != GEOIP_UNKNOWN_VALUE {
-
-					clientIP = proxyClientIP
-					break
-				}
-			}
-		}
-	}
+	clientIP := server.getClientIP(request)
 
 	if server.rateLimit(clientIP) {
 		return "", nil, "", "", errors.TraceNew("rate limit exceeded")
@@ -575,16 +681,7 @@ func (server *MeekServer) getSessionOrEndpoint(
 	// The session is new (or expired). Treat the cookie value as a new meek
 	// cookie, extract the payload, and create a new session.
 
-	payloadJSON, err := server.getMeekCookiePayload(clientIP, meekCookie.Value)
-	if err != nil {
-		return "", nil, "", "", errors.Trace(err)
-	}
-
-	// Note: this meek server ignores legacy values PsiphonClientSessionId
-	// and PsiphonServerAddress.
-	var clientSessionData protocol.MeekCookieData
-
-	err = json.Unmarshal(payloadJSON, &clientSessionData)
+	clientSessionData, err := server.getMeekCookieData(clientIP, meekCookie.Value)
 	if err != nil {
 		return "", nil, "", "", errors.Trace(err)
 	}
@@ -666,6 +763,120 @@ func (server *MeekServer) getSessionOrEndpoint(
 	return sessionID, session, "", "", nil
 }
 
+// handleWebSocket handles a WebSocket upgrade request. The meek cookie is
+// processed as it is for the first request of a new relay session,
+// including rate limiting, and then the WebSocket connection is handed to
+// the tunnel server as the client connection.
+//
+// No meek session is created: the WebSocket connection carries the tunnel
+// traffic directly, without polling, and the tunnel ends when the WebSocket
+// connection is closed.
+func (server *MeekServer) handleWebSocket(
+	responseWriter http.ResponseWriter,
+	request *http.Request,
+	meekCookie *http.Cookie) {
+
+	clientIP := server.getClientIP(request)
+
+	if server.rateLimit(clientIP) {
+		log.WithTrace().Debug("rate limit exceeded")
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	clientSessionData, err := server.getMeekCookieData(clientIP, meekCookie.Value)
+	if err != nil {
+		log.WithTraceFields(LogFields{"error": err}).Debug("invalid meek cookie")
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	// Endpoint requests, such as tactics requests, are HTTP round trips and
+	// are not made over WebSockets.
+
+	if clientSessionData.EndPoint != "" {
+		log.WithTrace().Debug("unexpected endpoint")
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	if server.support.TunnelServer != nil &&
+		!server.support.TunnelServer.CheckEstablishTunnels() {
+		log.WithTrace().Debug("not establishing tunnels")
+		common.TerminateHTTPConnection(responseWriter, request)
+		return
+	}
+
+	conn, err := websocket.Upgrade(responseWriter, request, nil)
+	if err != nil {
+		log.WithTraceFields(LogFields{"error": err}).Debug("upgrade failed")
+		return
+	}
+
+	// A meek server accepts WebSocket upgrades on any meek protocol port, so
+	// the listener protocol may be a meek polling protocol. The WebSocket
+	// protocol is determined by whether the listener is fronted and uses
+	// TLS.
+
+	tunnelProtocol := protocol.TUNNEL_PROTOCOL_WEBSOCKET
+	if protocol.TunnelProtocolUsesFrontedMeek(server.listenerTunnelProtocol) {
+		tunnelProtocol = protocol.TUNNEL_PROTOCOL_FRONTED_WEBSOCKET_TLS
+	} else if server.tlsConfig != nil {
+		tunnelProtocol = protocol.TUNNEL_PROTOCOL_WEBSOCKET_TLS
+	}
+
+	clientConn := &meekWebSocketConn{
+		Conn:           conn,
+		meekServer:     server,
+		tunnelProtocol: tunnelProtocol,
+		// Assumes clientIP is a valid IP address; the port value is a stub
+		// and is expected to be ignored.
+		remoteAddr: &net.TCPAddr{
+			IP:   net.ParseIP(clientIP),
+			Port: 0,
+		},
+	}
+
+	// The hijacked connection is no longer tracked by httpConnStateCallback,
+	// so it's tracked here to ensure it's closed when the server stops.
+
+	if !server.openConns.Add(clientConn) {
+		clientConn.Close()
+		return
+	}
+
+	server.clientHandler(clientSessionData.ClientTunnelProtocol, clientConn)
+}
+
+// getClientIP determines the client remote address, which is used for
+// geolocation and stats. When an intermediate proxy or CDN is in use, we may
+// be able to determine the original client address by inspecting HTTP
+// headers such as X-Forwarded-For.
+func (server *MeekServer) getClientIP(request *http.Request) string {
+
+	clientIP := strings.Split(request.RemoteAddr, ":")[0]
+
+	if len(server.support.Config.MeekProxyForwardedForHeaders) > 0 {
+		for _, header := range server.support.Config.MeekProxyForwardedForHeaders {
+			value := request.Header.Get(header)
+			if len(value) > 0 {
+				// Some headers, such as X-Forwarded-For, are a comma-separated
+				// list of IPs (each proxy in a chain). The first IP should be
+				// the client IP.
+				proxyClientIP := strings.Split(value, ",")[0]
+				if net.ParseIP(proxyClientIP) != nil &&
+					server.support.GeoIPService.Lookup(proxyClientIP).Country != GEOIP_UNKNOWN_VALUE {
+
+					clientIP = proxyClientIP
+					break
+				}
+			}
+		}
+	}
+
+	return clientIP
+}
+
 func (server *MeekServer) rateLimit(clientIP string) bool {
 
 	historySize, thresholdSeconds, regions, ISPs, cities, GCTriggerCount, _ :=
@@ -868,6 +1079,27 @@ func (server *MeekServer) httpConnStateCallback(conn net.Conn, connState http.Co
 	}
 }
 
+// getMeekCookieData extracts and unmarshals the payload of a meek cookie.
+func (server *MeekServer) getMeekCookieData(
+	clientIP string, cookieValue string) (*protocol.MeekCookieData, error) {
+
+	payloadJSON, err := server.getMeekCookiePayload(clientIP, cookieValue)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Note: this meek server ignores legacy values PsiphonClientSessionId
+	// and PsiphonServerAddress.
+	var clientSessionData protocol.MeekCookieData
+
+	err = json.Unmarshal(payloadJSON, &clientSessionData)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &clientSessionData, nil
+}
+
 // getMeekCookiePayload extracts the payload from a meek cookie. The cookie
 // payload is base64 encoded, obfuscated, and NaCl encrypted.
 func (server *MeekServer) getMeekCookiePayload(
@@ -966,6 +1198,10 @@ func (server *MeekServer) makeMeekTLSConfig(
 		UseExtendedMasterSecret: true,
 	}
 
+	if server.support.Config.MeekEnableHTTP2Streaming {
+		config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+
 	if isFronted {
 		// This is a reordering of the supported CipherSuites in golang 1.6[*]. Non-ephemeral key
 		// CipherSuites greatly reduce server load, and we try to select these since the meek
@@ -1105,6 +1341,7 @@ type meekSession struct {
 	metricCachedResponseMissPosition int64
 	lock                             sync.Mutex
 	deleted                          bool
+	streaming                        bool
 	clientConn                       *meekConn
 	meekProtocolVersion              int
 	sessionIDSent                    bool
@@ -1388,6 +1625,81 @@ func (conn *meekConn) pumpWrites(writer io.Writer) (int, error) {
 	}
 }
 
+// pumpReadStream causes goroutines blocking on meekConn.Read() to read
+// from the specified stream reader as upstream traffic arrives. Unlike
+// pumpReads, there are no payload checksums, as streams are not retried.
+// This function blocks until the reader fails, stopBroadcast is closed, or
+// the meekConn is closed.
+// Note: assumes only one concurrent call to pumpReads or pumpReadStream
+func (conn *meekConn) pumpReadStream(
+	reader io.Reader, stopBroadcast <-chan struct{}) error {
+
+	buffer := make([]byte, MEEK_MAX_REQUEST_PAYLOAD_LENGTH)
+
+	for {
+
+		// Read before obtaining the read buffer, so that Read() callers are
+		// not blocked while awaiting upstream traffic.
+
+		n, err := reader.Read(buffer)
+
+		if n > 0 {
+			var readBuffer *bytes.Buffer
+			select {
+			case readBuffer = <-conn.emptyReadBuffer:
+			case readBuffer = <-conn.partialReadBuffer:
+			case <-stopBroadcast:
+				return nil
+			case <-conn.closeBroadcast:
+				return errors.Trace(errMeekConnectionHasClosed)
+			}
+			readBuffer.Write(buffer[:n])
+			conn.replaceReadBuffer(readBuffer)
+		}
+
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// pumpWriteStream causes goroutines blocking on meekConn.Write() to write
+// to the specified stream writer, flushing after each write so that
+// downstream traffic is delivered immediately. This function blocks until
+// a write fails, a pumpReadStream result is received from readResult, or
+// the meekConn is closed. As the meek session receives no further requests
+// while streaming, the session is kept alive here.
+// Note: channel scheme assumes only one concurrent call to pumpWrites or
+// pumpWriteStream
+func (conn *meekConn) pumpWriteStream(
+	writer io.Writer, flusher http.Flusher, readResult <-chan error) error {
+
+	ticker := time.NewTicker(MEEK_MAX_SESSION_STALENESS / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case buffer := <-conn.nextWriteBuffer:
+			_, err := writer.Write(buffer)
+			if err == nil {
+				flusher.Flush()
+			}
+			// Note: always send the err to writeResult,
+			// as the Write() caller is blocking on this.
+			conn.writeResult <- err
+			if err != nil {
+				return errors.Trace(err)
+			}
+		case err := <-readResult:
+			return err
+		case <-ticker.C:
+			conn.meekSession.touch()
+		case <-conn.closeBroadcast:
+			return errors.Trace(errMeekConnectionHasClosed)
+		}
+	}
+}
+
 // Write writes the buffer to the meekConn. It blocks until the
 // entire buffer is written to or the meekConn closes. Under the
 // hood, it waits for sufficient pumpWrites calls to consume the
@@ -1501,3 +1813,35 @@ func (conn *meekConn) GetMetrics() common.LogFields {
 	}
 	return logFields
 }
+
+// meekWebSocketConn is the client connection for a tunnel relayed over a
+// WebSocket connection. meekWebSocketConn reports the client IP determined
+// by the meek server, which, for fronted protocols, is not the WebSocket
+// connection peer address. tunnelProtocol is the WebSocket tunnel protocol
+// used by the client, which is logged instead of the listener protocol.
+type meekWebSocketConn struct {
+	net.Conn
+	meekServer     *MeekServer
+	tunnelProtocol string
+	remoteAddr     net.Addr
+}
+
+func (conn *meekWebSocketConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *meekWebSocketConn) Close() error {
+	// Remove must be invoked asynchronously, as this Close may be called by
+	// openConns.CloseAll, leading to a reentrant lock situation.
+	go conn.meekServer.openConns.Remove(conn)
+	return conn.Conn.Close()
+}
+
+// GetMetrics implements the common.MetricsSource interface.
+func (conn *meekWebSocketConn) GetMetrics() common.LogFields {
+	logFields := make(common.LogFields)
+	if conn.meekServer.passthroughAddress != "" {
+		logFields["passthrough_address"] = conn.meekServer.passthroughAddress
+	}
+	return logFields
+}
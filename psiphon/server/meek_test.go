@@ -23,18 +23,24 @@ import (
 	"bytes"
 	"context"
 	crypto_rand "crypto/rand"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
 	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/Psiphon-Labs/net/http2"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+	tris "github.com/Psiphon-Labs/tls-tris"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -550,3 +556,152 @@ func TestMeekRateLimiter(t *testing.T) {
 	// This wait will hang if shutdown is broken, and the test will ultimately panic
 	serverWaitGroup.Wait()
 }
+
+func TestHTTP2StreamWriteTimeout(t *testing.T) {
+
+	writeTimeout := 500 * time.Millisecond
+	streamDuration := 4 * writeTimeout
+	writeInterval := writeTimeout / 4
+	expectedWrites := int(streamDuration / writeInterval)
+
+	stalledWriteErrors := make(chan error, 1)
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		switch r.URL.Path {
+		case "/stream":
+			w.WriteHeader(http.StatusOK)
+			for i := 0; i < expectedWrites; i++ {
+				_, err := w.Write([]byte{byte(i)})
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+				time.Sleep(writeInterval)
+			}
+		case "/stalled":
+			w.WriteHeader(http.StatusOK)
+			flusher.Flush()
+			buffer := make([]byte, 65536)
+			for {
+				_, err := w.Write(buffer)
+				if err != nil {
+					stalledWriteErrors <- err
+					return
+				}
+				flusher.Flush()
+			}
+		default:
+			time.Sleep(2 * writeTimeout)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte{0})
+		}
+	}
+
+	certificate, privateKey, err := common.GenerateWebServerCertificate("example.com")
+	if err != nil {
+		t.Fatalf("GenerateWebServerCertificate failed: %s", err)
+	}
+
+	tlsCertificate, err := tris.X509KeyPair([]byte(certificate), []byte(privateKey))
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %s", err)
+	}
+
+	tlsConfig := &tris.Config{
+		Certificates: []tris.Certificate{tlsCertificate},
+		NextProtos:   []string{http2.NextProtoTLS, "http/1.1"},
+		MaxVersion:   tris.VersionTLS12,
+		CipherSuites: []uint16{tris.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+
+	server := &HTTPSServer{
+		Server: &http.Server{
+			ReadTimeout:  writeTimeout,
+			WriteTimeout: writeTimeout,
+			Handler:      http.HandlerFunc(handler),
+		},
+		HTTP2Server: &http2.Server{},
+		IsHTTP2StreamingRequest: func(r *http.Request) bool {
+			return r.URL.Path != "/poll"
+		},
+	}
+
+	serveErrors := make(chan error, 1)
+	go func() {
+		serveErrors <- server.ServeTLS(listener, tlsConfig)
+	}()
+
+	// Each request uses its own client, and so its own HTTP/2 connection, as
+	// exceeding a deadline closes the connection.
+
+	get := func(path string) (*http.Response, error) {
+		client := &http.Client{
+			Transport: &http2.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+		response, err := client.Get(fmt.Sprintf("https://%s%s", listener.Addr(), path))
+		if err != nil {
+			return nil, err
+		}
+		if response.ProtoMajor != 2 {
+			response.Body.Close()
+			t.Fatalf("unexpected protocol: %s", response.Proto)
+		}
+		return response, nil
+	}
+
+	// Test: a streaming response may remain open well past the WriteTimeout.
+
+	response, err := get("/stream")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+
+	startTime := time.Now()
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("ReadAll failed after %s: %s", time.Since(startTime), err)
+	}
+
+	if len(body) != expectedWrites {
+		t.Fatalf("unexpected body length: %d", len(body))
+	}
+
+	// Test: the WriteTimeout still applies to non-streaming requests.
+
+	response, err = get("/poll")
+	if err == nil {
+		_, err = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+	}
+	if err == nil {
+		t.Fatalf("unexpected non-streaming response after WriteTimeout")
+	}
+
+	// Test: a streaming response write fails, rather than blocking
+	// indefinitely, when the client stops reading.
+
+	response, err = get("/stalled")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+
+	select {
+	case <-stalledWriteErrors:
+	case <-time.After(20 * writeTimeout):
+		t.Fatalf("stalled write didn't fail")
+	}
+
+	response.Body.Close()
+
+	listener.Close()
+	<-serveErrors
+}
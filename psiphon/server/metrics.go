@@ -0,0 +1,506 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	golanglog "log"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+const (
+	METRICS_SERVER_IO_TIMEOUT   = 10 * time.Second
+	METRICS_NAME_PREFIX         = "psiphond_"
+	METRICS_EXPOSITION_MIMETYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// loadStatsGauges are the ProtocolStats and RegionStats values which are
+// reported as metrics. Other load stats values, the quality metrics, are
+// periodic counts that are reset by the load monitor; the equivalent
+// cumulative counts are reported from portForwardMetrics.
+var loadStatsGauges = []string{
+	"accepted_clients",
+	"established_clients",
+	"dialing_tcp_port_forwards",
+	"tcp_port_forwards",
+	"total_tcp_port_forwards",
+	"udp_port_forwards",
+	"total_udp_port_forwards",
+}
+
+// TunnelServerMetrics is a snapshot of tunnel server state reported by the
+// metrics server.
+type TunnelServerMetrics struct {
+	ProtocolStats                  ProtocolStats
+	RegionStats                    RegionStats
+	EstablishTunnels               bool
+	EstablishLimitedCount          int64
+	SSHHandshakesInProgress        int64
+	SSHHandshakeAcquireFailedCount int64
+	MeekSessions                   map[string]int64
+	PortForwardDials               map[PortForwardDialMetricsKey]PortForwardDialMetrics
+	PortForwardRejections          map[PortForwardRejectedMetricsKey]int64
+}
+
+// PortForwardDialMetricsKey identifies a set of TCP port forward dial
+// results. IPVersion is "4", "6", or "unknown", when the dial failed before
+// the destination was resolved.
+type PortForwardDialMetricsKey struct {
+	TunnelProtocol string
+	IPVersion      string
+	Success        bool
+}
+
+// PortForwardDialMetrics are cumulative TCP port forward dial results.
+type PortForwardDialMetrics struct {
+	Count    int64
+	Duration time.Duration
+}
+
+// PortForwardRejectedMetricsKey identifies a set of rejected port forwards.
+// Type is "tcp" or "udp"; Reason is "dialing_limit" or "disallowed".
+type PortForwardRejectedMetricsKey struct {
+	TunnelProtocol string
+	Type           string
+	Reason         string
+}
+
+// portForwardMetrics accumulates port forward results across all clients.
+// Unlike the per-client qualityMetrics, these counts are never reset, as
+// required for Prometheus counters, and include results from clients that
+// have since disconnected.
+type portForwardMetrics struct {
+	mutex    sync.Mutex
+	dials    map[PortForwardDialMetricsKey]PortForwardDialMetrics
+	rejected map[PortForwardRejectedMetricsKey]int64
+}
+
+func newPortForwardMetrics() *portForwardMetrics {
+	return &portForwardMetrics{
+		dials:    make(map[PortForwardDialMetricsKey]PortForwardDialMetrics),
+		rejected: make(map[PortForwardRejectedMetricsKey]int64),
+	}
+}
+
+func (metrics *portForwardMetrics) addDialResult(
+	tunnelProtocol string, success bool, dialDuration time.Duration, IP net.IP) {
+
+	ipVersion := "unknown"
+	if IP.To4() != nil {
+		ipVersion = "4"
+	} else if IP != nil {
+		ipVersion = "6"
+	}
+
+	key := PortForwardDialMetricsKey{
+		TunnelProtocol: tunnelProtocol,
+		IPVersion:      ipVersion,
+		Success:        success,
+	}
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	dial := metrics.dials[key]
+	dial.Count += 1
+	dial.Duration += dialDuration
+	metrics.dials[key] = dial
+}
+
+func (metrics *portForwardMetrics) addRejected(
+	tunnelProtocol, portForwardType, reason string) {
+
+	key := PortForwardRejectedMetricsKey{
+		TunnelProtocol: tunnelProtocol,
+		Type:           portForwardType,
+		Reason:         reason,
+	}
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.rejected[key] += 1
+}
+
+func (metrics *portForwardMetrics) snapshot() (
+	map[PortForwardDialMetricsKey]PortForwardDialMetrics,
+	map[PortForwardRejectedMetricsKey]int64) {
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	dials := make(map[PortForwardDialMetricsKey]PortForwardDialMetrics)
+	for key, value := range metrics.dials {
+		dials[key] = value
+	}
+
+	rejected := make(map[PortForwardRejectedMetricsKey]int64)
+	for key, value := range metrics.rejected {
+		rejected[key] = value
+	}
+
+	return dials, rejected
+}
+
+func (sshServer *sshServer) getMetrics() *TunnelServerMetrics {
+
+	protocolStats, regionStats := sshServer.getLoadStats(false)
+
+	meekSessions := make(map[string]int64)
+	sshServer.meekServersMutex.Lock()
+	for _, meekServer := range sshServer.meekServers {
+		meekSessions[meekServer.listenerTunnelProtocol] +=
+			int64(meekServer.getSessionCount())
+	}
+	sshServer.meekServersMutex.Unlock()
+
+	dials, rejected := sshServer.portForwardMetrics.snapshot()
+
+	return &TunnelServerMetrics{
+		ProtocolStats:                  protocolStats,
+		RegionStats:                    regionStats,
+		EstablishTunnels:               atomic.LoadInt32(&sshServer.establishTunnels) == 1,
+		EstablishLimitedCount:          atomic.LoadInt64(&sshServer.totalEstablishLimitedCount),
+		SSHHandshakesInProgress:        atomic.LoadInt64(&sshServer.sshHandshakesInProgress),
+		SSHHandshakeAcquireFailedCount: atomic.LoadInt64(&sshServer.sshHandshakeAcquireFailed),
+		MeekSessions:                   meekSessions,
+		PortForwardDials:               dials,
+		PortForwardRejections:          rejected,
+	}
+}
+
+// RunMetricsServer runs an HTTP server which serves psiphond metrics in the
+// Prometheus text exposition format. RunMetricsServer blocks until
+// shutdownBroadcast is signaled or the server fails.
+func RunMetricsServer(
+	support *SupportServices,
+	shutdownBroadcast <-chan struct{}) error {
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metricsHandler(support, w, r)
+	})
+
+	logWriter := NewLogWriter()
+	defer logWriter.Close()
+
+	server := &http.Server{
+		Handler:      serveMux,
+		ReadTimeout:  METRICS_SERVER_IO_TIMEOUT,
+		WriteTimeout: METRICS_SERVER_IO_TIMEOUT,
+		ErrorLog:     golanglog.New(logWriter, "", 0),
+	}
+
+	localAddress := support.Config.MetricsServerAddress
+
+	listener, err := net.Listen("tcp", localAddress)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	log.WithTraceFields(
+		LogFields{"localAddress": localAddress}).Info("starting metrics server")
+
+	err = nil
+	errorChannel := make(chan error)
+	waitGroup := new(sync.WaitGroup)
+
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+
+		// Note: will be interrupted by listener.Close()
+		err := server.Serve(listener)
+
+		select {
+		case <-shutdownBroadcast:
+		default:
+			if err != nil {
+				select {
+				case errorChannel <- errors.Trace(err):
+				default:
+				}
+			}
+		}
+	}()
+
+	select {
+	case <-shutdownBroadcast:
+	case err = <-errorChannel:
+	}
+
+	listener.Close()
+
+	waitGroup.Wait()
+
+	log.WithTraceFields(
+		LogFields{"localAddress": localAddress}).Info("metrics server exiting")
+
+	return err
+}
+
+func metricsHandler(
+	support *SupportServices, w http.ResponseWriter, r *http.Request) {
+
+	token := support.Config.MetricsServerAuthorizationToken
+	if token != "" {
+		expected := "Bearer " + token
+		if subtle.ConstantTimeCompare(
+			[]byte(r.Header.Get("Authorization")), []byte(expected)) != 1 {
+
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var writer metricsWriter
+
+	writeRuntimeMetrics(&writer)
+
+	// support.TunnelServer is set in RunServices before any services are
+	// started.
+	if support.TunnelServer != nil {
+		writeTunnelServerMetrics(
+			&writer,
+			support.Config,
+			support.TunnelServer.GetMetrics())
+	}
+
+	w.Header().Set("Content-Type", METRICS_EXPOSITION_MIMETYPE)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(writer.Bytes())
+}
+
+func writeRuntimeMetrics(writer *metricsWriter) {
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	writer.gauge("goroutines", "Number of goroutines.", nil, int64(runtime.NumGoroutine()))
+	writer.gauge("heap_alloc_bytes", "Bytes of allocated heap objects.", nil, int64(memStats.HeapAlloc))
+	writer.gauge("heap_sys_bytes", "Bytes of heap memory obtained from the OS.", nil, int64(memStats.HeapSys))
+	writer.gauge("heap_idle_bytes", "Bytes in idle heap spans.", nil, int64(memStats.HeapIdle))
+	writer.gauge("heap_inuse_bytes", "Bytes in in-use heap spans.", nil, int64(memStats.HeapInuse))
+	writer.gauge("heap_released_bytes", "Bytes of heap memory returned to the OS.", nil, int64(memStats.HeapReleased))
+	writer.gauge("heap_objects", "Number of allocated heap objects.", nil, int64(memStats.HeapObjects))
+	writer.counter("gc_total", "Number of completed GC cycles.", nil, int64(memStats.NumGC))
+	writer.counter("forced_gc_total", "Number of forced GC cycles.", nil, int64(memStats.NumForcedGC))
+}
+
+func writeTunnelServerMetrics(
+	writer *metricsWriter, config *Config, metrics *TunnelServerMetrics) {
+
+	for _, name := range loadStatsGauges {
+
+		help := fmt.Sprintf("Current %s, by tunnel protocol.", strings.Replace(name, "_", " ", -1))
+		var samples []metricsSample
+		for tunnelProtocol, stats := range metrics.ProtocolStats {
+			if tunnelProtocol == "ALL" {
+				continue
+			}
+			samples = append(samples, metricsSample{
+				labels: []string{"protocol", tunnelProtocol},
+				value:  stats[name],
+			})
+		}
+		writer.samples(name, help, "gauge", samples)
+
+		help = fmt.Sprintf("Current %s, by client region and tunnel protocol.", strings.Replace(name, "_", " ", -1))
+		samples = nil
+		for region, protocolStats := range metrics.RegionStats {
+			for tunnelProtocol, stats := range protocolStats {
+				if tunnelProtocol == "ALL" {
+					continue
+				}
+				samples = append(samples, metricsSample{
+					labels: []string{"region", region, "protocol", tunnelProtocol},
+					value:  stats[name],
+				})
+			}
+		}
+		writer.samples("region_"+name, help, "gauge", samples)
+	}
+
+	establishTunnels := int64(0)
+	if metrics.EstablishTunnels {
+		establishTunnels = 1
+	}
+	writer.gauge(
+		"establish_tunnels",
+		"Whether new tunnels may be established.",
+		nil, establishTunnels)
+	writer.counter(
+		"establish_tunnels_limited_total",
+		"Number of tunnels rejected while not establishing.",
+		nil, metrics.EstablishLimitedCount)
+
+	writer.gauge(
+		"ssh_handshakes_in_progress",
+		"Number of SSH handshakes in progress.",
+		nil, metrics.SSHHandshakesInProgress)
+	writer.gauge(
+		"ssh_handshakes_max",
+		"Maximum number of concurrent SSH handshakes; 0 when unlimited.",
+		nil, int64(config.MaxConcurrentSSHHandshakes))
+	writer.counter(
+		"ssh_handshake_acquire_failed_total",
+		"Number of clients disconnected while waiting to begin an SSH handshake.",
+		nil, metrics.SSHHandshakeAcquireFailedCount)
+
+	var samples []metricsSample
+	for tunnelProtocol, count := range metrics.MeekSessions {
+		samples = append(samples, metricsSample{
+			labels: []string{"protocol", tunnelProtocol},
+			value:  count,
+		})
+	}
+	writer.samples(
+		"meek_sessions", "Current meek sessions, by listener tunnel protocol.", "gauge", samples)
+
+	var countSamples, durationSamples []metricsSample
+	for key, dial := range metrics.PortForwardDials {
+		result := "failed"
+		if key.Success {
+			result = "dialed"
+		}
+		labels := []string{
+			"protocol", key.TunnelProtocol,
+			"ip_version", key.IPVersion,
+			"result", result,
+		}
+		countSamples = append(countSamples, metricsSample{
+			labels: labels,
+			value:  dial.Count,
+		})
+		durationSamples = append(durationSamples, metricsSample{
+			labels: labels,
+			value:  int64(dial.Duration / time.Millisecond),
+		})
+	}
+	writer.samples(
+		"tcp_port_forward_dials_total",
+		"Number of TCP port forward dials, by result.",
+		"counter", countSamples)
+	writer.samples(
+		"tcp_port_forward_dial_duration_milliseconds_total",
+		"Total duration of TCP port forward dials, by result.",
+		"counter", durationSamples)
+
+	samples = nil
+	for key, count := range metrics.PortForwardRejections {
+		samples = append(samples, metricsSample{
+			labels: []string{
+				"protocol", key.TunnelProtocol,
+				"type", key.Type,
+				"reason", key.Reason,
+			},
+			value: count,
+		})
+	}
+	writer.samples(
+		"port_forward_rejected_total",
+		"Number of rejected port forwards, by reason.",
+		"counter", samples)
+}
+
+// metricsWriter emits metrics in the Prometheus text exposition format:
+// https://prometheus.io/docs/instrumenting/exposition_formats/.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+// metricsSample is a single metric value. labels is a list of label name and
+// value pairs.
+type metricsSample struct {
+	labels []string
+	value  int64
+}
+
+func (writer *metricsWriter) gauge(name, help string, labels []string, value int64) {
+	writer.samples(name, help, "gauge", []metricsSample{{labels: labels, value: value}})
+}
+
+func (writer *metricsWriter) counter(name, help string, labels []string, value int64) {
+	writer.samples(name, help, "counter", []metricsSample{{labels: labels, value: value}})
+}
+
+// samples writes a metric family. Samples are sorted by label values so
+// that output is stable. No output is written when samples is empty.
+func (writer *metricsWriter) samples(
+	name, help, metricType string, samples []metricsSample) {
+
+	if len(samples) == 0 {
+		return
+	}
+
+	name = METRICS_NAME_PREFIX + name
+
+	fmt.Fprintf(writer, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(writer, "# TYPE %s %s\n", name, metricType)
+
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labels, "\x00") <
+			strings.Join(samples[j].labels, "\x00")
+	})
+
+	for _, sample := range samples {
+		writer.WriteString(name)
+		if len(sample.labels) > 0 {
+			writer.WriteByte('{')
+			for i := 0; i+1 < len(sample.labels); i += 2 {
+				if i > 0 {
+					writer.WriteByte(',')
+				}
+				writer.WriteString(sample.labels[i])
+				writer.WriteString("=\"")
+				writer.WriteString(escapeMetricsLabelValue(sample.labels[i+1]))
+				writer.WriteByte('"')
+			}
+			writer.WriteByte('}')
+		}
+		writer.WriteByte(' ')
+		writer.WriteString(strconv.FormatInt(sample.value, 10))
+		writer.WriteByte('\n')
+	}
+}
+
+var metricsLabelValueEscaper = strings.NewReplacer(
+	"\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func escapeMetricsLabelValue(value string) string {
+	return metricsLabelValueEscaper.Replace(value)
+}
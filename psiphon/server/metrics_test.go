@@ -0,0 +1,120 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+
+	portForwardMetrics := newPortForwardMetrics()
+	portForwardMetrics.addDialResult("OSSH", true, 10*time.Millisecond, net.ParseIP("192.0.2.1"))
+	portForwardMetrics.addDialResult("OSSH", true, 20*time.Millisecond, net.ParseIP("192.0.2.2"))
+	portForwardMetrics.addDialResult("OSSH", false, 5*time.Millisecond, net.ParseIP("2001:db8::1"))
+	portForwardMetrics.addDialResult("OSSH", false, 5*time.Millisecond, nil)
+	portForwardMetrics.addRejected("OSSH", "udp", "disallowed")
+
+	dials, rejected := portForwardMetrics.snapshot()
+
+	metrics := &TunnelServerMetrics{
+		ProtocolStats: ProtocolStats{
+			"ALL":  {"established_clients": 3},
+			"OSSH": {"established_clients": 3},
+		},
+		RegionStats: RegionStats{
+			"CA": {
+				"ALL":  {"established_clients": 3},
+				"OSSH": {"established_clients": 3},
+			},
+		},
+		EstablishTunnels:      true,
+		MeekSessions:          map[string]int64{"UNFRONTED-MEEK-OSSH": 2},
+		PortForwardDials:      dials,
+		PortForwardRejections: rejected,
+	}
+
+	var writer metricsWriter
+	writeTunnelServerMetrics(&writer, &Config{MaxConcurrentSSHHandshakes: 10}, metrics)
+	output := writer.String()
+
+	expectedLines := []string{
+		"# TYPE psiphond_established_clients gauge",
+		`psiphond_established_clients{protocol="OSSH"} 3`,
+		`psiphond_region_established_clients{region="CA",protocol="OSSH"} 3`,
+		"psiphond_establish_tunnels 1",
+		"psiphond_ssh_handshakes_max 10",
+		`psiphond_meek_sessions{protocol="UNFRONTED-MEEK-OSSH"} 2`,
+		"# TYPE psiphond_tcp_port_forward_dials_total counter",
+		`psiphond_tcp_port_forward_dials_total{protocol="OSSH",ip_version="4",result="dialed"} 2`,
+		`psiphond_tcp_port_forward_dials_total{protocol="OSSH",ip_version="6",result="failed"} 1`,
+		`psiphond_tcp_port_forward_dials_total{protocol="OSSH",ip_version="unknown",result="failed"} 1`,
+		`psiphond_tcp_port_forward_dial_duration_milliseconds_total{protocol="OSSH",ip_version="4",result="dialed"} 30`,
+		`psiphond_port_forward_rejected_total{protocol="OSSH",type="udp",reason="disallowed"} 1`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("missing metrics line: %s", line)
+		}
+	}
+
+	if strings.Contains(output, `protocol="ALL"`) {
+		t.Errorf("unexpected ALL protocol metrics")
+	}
+
+	if escapeMetricsLabelValue("a\"b\\c\nd") != `a\"b\\c\nd` {
+		t.Errorf("unexpected label escaping")
+	}
+
+	support := &SupportServices{
+		Config: &Config{MetricsServerAuthorizationToken: "token"},
+	}
+
+	for _, authorization := range []string{"", "Bearer invalid", "Bearer token"} {
+
+		request := httptest.NewRequest("GET", "/metrics", nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+
+		metricsHandler(support, recorder, request)
+
+		expectedStatus := http.StatusUnauthorized
+		if authorization == "Bearer token" {
+			expectedStatus = http.StatusOK
+		}
+
+		if recorder.Code != expectedStatus {
+			t.Errorf("unexpected status for %q: %d", authorization, recorder.Code)
+		}
+
+		if recorder.Code == http.StatusOK &&
+			!strings.Contains(recorder.Body.String(), "# TYPE psiphond_goroutines gauge\n") {
+			t.Errorf("missing runtime metrics")
+		}
+	}
+}
@@ -53,7 +53,10 @@ package server
 import (
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/Psiphon-Labs/net/http2"
 	tris "github.com/Psiphon-Labs/tls-tris"
 )
 
@@ -61,6 +64,17 @@ import (
 // ServeTLS function.
 type HTTPSServer struct {
 	*http.Server
+
+	// HTTP2Server, when set, serves connections which negotiate HTTP/2.
+	// The tris.Config passed to ServeTLS must then offer the "h2"
+	// application protocol.
+	HTTP2Server *http2.Server
+
+	// IsHTTP2StreamingRequest, when set, identifies long-lived HTTP/2
+	// streaming requests. The http.Server WriteTimeout is applied to each
+	// response write of a streaming request, rather than to the entire
+	// request.
+	IsHTTP2StreamingRequest func(*http.Request) bool
 }
 
 // ServeTLS is similar to http.Serve, but uses TLS.
@@ -75,5 +89,221 @@ type HTTPSServer struct {
 // parameter is used intead.
 func (server *HTTPSServer) ServeTLS(listener net.Listener, config *tris.Config) error {
 	tlsListener := tris.NewListener(listener, config)
+	if server.HTTP2Server != nil {
+		tlsListener = newHTTP2Listener(tlsListener, server)
+	}
 	return server.Serve(tlsListener)
 }
+
+// http2Listener wraps a TLS listener and performs the TLS handshake for
+// each accepted connection. Connections which negotiate HTTP/2 are served
+// by the HTTPSServer.HTTP2Server, and all other connections are returned
+// by Accept, to be served by the http.Server.
+//
+// The http.Server automatic HTTP/2 support is activated only for
+// crypto/tls connections, and so doesn't apply to tris connections.
+type http2Listener struct {
+	net.Listener
+	server        *HTTPSServer
+	baseConfig    *http.Server
+	acceptedConns chan net.Conn
+	acceptErrors  chan error
+	stopOnce      sync.Once
+	stopBroadcast chan struct{}
+	stopErr       error
+}
+
+func newHTTP2Listener(listener net.Listener, server *HTTPSServer) *http2Listener {
+
+	// The http2.Server applies the BaseConfig WriteTimeout as a deadline for
+	// each stream, resetting any stream which is still open when the timeout
+	// expires. This would terminate long-lived streaming responses, so the
+	// HTTP/2 connections get a base config without WriteTimeout, and the
+	// WriteTimeout is instead enforced by http2DeadlineHandler. The
+	// ReadTimeout still limits the time to read each request's headers, and
+	// HTTP2Server.IdleTimeout closes connections with no open streams.
+
+	baseConfig := &http.Server{
+		Handler:        server.Handler,
+		ReadTimeout:    server.ReadTimeout,
+		IdleTimeout:    server.IdleTimeout,
+		MaxHeaderBytes: server.MaxHeaderBytes,
+		ConnState:      server.ConnState,
+		ErrorLog:       server.ErrorLog,
+	}
+
+	http2Listener := &http2Listener{
+		Listener:      listener,
+		server:        server,
+		baseConfig:    baseConfig,
+		acceptedConns: make(chan net.Conn),
+		acceptErrors:  make(chan error),
+		stopBroadcast: make(chan struct{}),
+	}
+
+	go http2Listener.acceptConns()
+
+	return http2Listener
+}
+
+// Accept returns the next connection which didn't negotiate HTTP/2.
+func (listener *http2Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.acceptedConns:
+		return conn, nil
+	case err := <-listener.acceptErrors:
+		return nil, err
+	case <-listener.stopBroadcast:
+		return nil, listener.stopErr
+	}
+}
+
+func (listener *http2Listener) acceptConns() {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				select {
+				case listener.acceptErrors <- err:
+					continue
+				case <-listener.stopBroadcast:
+					return
+				}
+			}
+			listener.stopOnce.Do(func() {
+				listener.stopErr = err
+				close(listener.stopBroadcast)
+			})
+			return
+		}
+		go listener.handshake(conn)
+	}
+}
+
+func (listener *http2Listener) handshake(conn net.Conn) {
+
+	tlsConn, ok := conn.(*tris.Conn)
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	// As with the http.Server, the TLS handshake must complete within the
+	// read timeout. In the passthrough case, the handshake fails and
+	// ownership of the underlying conn is transferred to the passthrough
+	// relay, so closing tlsConn here is safe.
+
+	if listener.server.ReadTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(listener.server.ReadTimeout))
+	}
+
+	err := tlsConn.Handshake()
+	if err != nil {
+		tlsConn.Close()
+		return
+	}
+
+	tlsConn.SetDeadline(time.Time{})
+
+	if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		select {
+		case listener.acceptedConns <- tlsConn:
+		case <-listener.stopBroadcast:
+			tlsConn.Close()
+		}
+		return
+	}
+
+	// http2.Server.ServeConn invokes the http.Server ConnState callback only
+	// for active and idle state changes, so the new and closed states are
+	// reported here.
+
+	connState := listener.server.ConnState
+	if connState != nil {
+		connState(tlsConn, http.StateNew)
+	}
+
+	listener.server.HTTP2Server.ServeConn(
+		tlsConn,
+		&http2.ServeConnOpts{
+			BaseConfig: listener.baseConfig,
+			Handler: &http2DeadlineHandler{
+				server: listener.server,
+				conn:   tlsConn,
+			},
+		})
+
+	tlsConn.Close()
+
+	if connState != nil {
+		connState(tlsConn, http.StateClosed)
+	}
+}
+
+// http2DeadlineHandler enforces the http.Server WriteTimeout for requests
+// served over an HTTP/2 connection. Without a deadline, a handler writing to
+// a client which has stopped reading blocks indefinitely, once the stream
+// flow control window is exhausted.
+//
+// As with the http.Server WriteTimeout for HTTP/1.1, when a deadline is
+// exceeded, the connection is closed; this unblocks and fails any pending
+// writes. For non-streaming requests, the deadline is WriteTimeout after the
+// request is received. For streaming requests, which may remain open
+// indefinitely, each response write must complete within WriteTimeout.
+type http2DeadlineHandler struct {
+	server *HTTPSServer
+	conn   net.Conn
+}
+
+func (handler *http2DeadlineHandler) ServeHTTP(
+	responseWriter http.ResponseWriter, request *http.Request) {
+
+	timeout := handler.server.WriteTimeout
+
+	if timeout <= 0 {
+		handler.server.Handler.ServeHTTP(responseWriter, request)
+		return
+	}
+
+	if handler.server.IsHTTP2StreamingRequest != nil &&
+		handler.server.IsHTTP2StreamingRequest(request) {
+
+		handler.server.Handler.ServeHTTP(
+			&http2DeadlineResponseWriter{
+				ResponseWriter: responseWriter,
+				conn:           handler.conn,
+				timeout:        timeout,
+			},
+			request)
+		return
+	}
+
+	timer := time.AfterFunc(timeout, func() { handler.conn.Close() })
+	defer timer.Stop()
+
+	handler.server.Handler.ServeHTTP(responseWriter, request)
+}
+
+// http2DeadlineResponseWriter closes the HTTP/2 connection when a response
+// write or flush doesn't complete within the timeout.
+type http2DeadlineResponseWriter struct {
+	http.ResponseWriter
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (writer *http2DeadlineResponseWriter) Write(buffer []byte) (int, error) {
+	timer := time.AfterFunc(writer.timeout, func() { writer.conn.Close() })
+	defer timer.Stop()
+	return writer.ResponseWriter.Write(buffer)
+}
+
+func (writer *http2DeadlineResponseWriter) Flush() {
+	flusher, ok := writer.ResponseWriter.(http.Flusher)
+	if !ok {
+		return
+	}
+	timer := time.AfterFunc(writer.timeout, func() { writer.conn.Close() })
+	defer timer.Stop()
+	flusher.Flush()
+}
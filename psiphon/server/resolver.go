@@ -0,0 +1,458 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	lrucache "github.com/cognusion/go-cache-lru"
+)
+
+const (
+	DNS_RESOLVER_PROTOCOL_PLAIN                = "dns"
+	DNS_RESOLVER_PROTOCOL_DOT                  = "dot"
+	DNS_RESOLVER_PROTOCOL_DOH                  = "doh"
+	DEFAULT_DNS_RESOLVER_CACHE_MAX_ENTRIES     = 10000
+	DEFAULT_DNS_RESOLVER_CACHE_MAX_TTL_SECONDS = 300
+	DNS_RESOLVER_CACHE_CLEANUP_INTERVAL        = 1 * time.Minute
+	DNS_RESOLVER_UDP_PAYLOAD_SIZE              = 1232
+	DNS_RESOLVER_MESSAGE_CONTENT_TYPE          = "application/dns-message"
+)
+
+// DNSResolverUpstream specifies an upstream DNS resolver used by
+// HostResolver.
+type DNSResolverUpstream struct {
+
+	// Protocol is one of "dns", for plain DNS over UDP, with a TCP retry
+	// when a response is truncated; "dot", for DNS-over-TLS (RFC 7858); or
+	// "doh", for DNS-over-HTTPS (RFC 8484).
+	Protocol string
+
+	// Address is the "<IP>:<port>" address of a "dns" or "dot" upstream, or
+	// the "https://" URL of a "doh" upstream. A "doh" URL host should be an
+	// IP address, as any domain name is resolved with the system resolver.
+	Address string
+
+	// ServerName is the name used to verify a "dot" or "doh" upstream's
+	// certificate. When blank, the Address host is used.
+	ServerName string
+}
+
+// Validate checks that the DNSResolverUpstream is well-formed.
+func (upstream *DNSResolverUpstream) Validate() error {
+
+	switch upstream.Protocol {
+
+	case DNS_RESOLVER_PROTOCOL_PLAIN, DNS_RESOLVER_PROTOCOL_DOT:
+		host, _, err := net.SplitHostPort(upstream.Address)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if net.ParseIP(host) == nil {
+			return errors.TraceNew("invalid IP address")
+		}
+
+	case DNS_RESOLVER_PROTOCOL_DOH:
+		dohURL, err := url.Parse(upstream.Address)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if dohURL.Scheme != "https" || dohURL.Host == "" {
+			return errors.TraceNew("invalid URL")
+		}
+
+	default:
+		return errors.Tracef("invalid protocol: %s", upstream.Protocol)
+	}
+
+	return nil
+}
+
+// HostResolver resolves TCP port forward hostnames to IP addresses.
+//
+// When configured with DNSResolverUpstreams, A and AAAA requests are sent to
+// the upstreams, and the results are stored in a cache which is shared by
+// all clients. Cache entries expire according to the response TTLs, capped
+// by DNSResolverCacheMaxTTLSeconds. When no upstreams are configured, the
+// system resolver is used and results are not cached.
+//
+// Resolved IP addresses are shuffled, so that port forwards are spread
+// across all the addresses for a hostname, and ordered by IP address family
+// preference.
+type HostResolver struct {
+	upstreams   []*hostResolverUpstream
+	cache       *lrucache.Cache
+	cacheMaxTTL time.Duration
+}
+
+type hostResolverUpstream struct {
+	DNSResolverUpstream
+	udpClient  *dns.Client
+	tcpClient  *dns.Client
+	httpClient *http.Client
+}
+
+type hostResolverCacheEntry struct {
+	IPs []net.IP
+}
+
+// NewHostResolver initializes a new HostResolver using the
+// DNSResolverUpstreams configuration.
+func NewHostResolver(config *Config) (*HostResolver, error) {
+
+	resolver := &HostResolver{}
+
+	for _, configUpstream := range config.DNSResolverUpstreams {
+
+		err := configUpstream.Validate()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		upstream := &hostResolverUpstream{
+			DNSResolverUpstream: configUpstream,
+		}
+
+		switch upstream.Protocol {
+
+		case DNS_RESOLVER_PROTOCOL_PLAIN:
+			upstream.udpClient = &dns.Client{Net: "udp"}
+			upstream.tcpClient = &dns.Client{Net: "tcp"}
+
+		case DNS_RESOLVER_PROTOCOL_DOT:
+			serverName := upstream.ServerName
+			if serverName == "" {
+				serverName, _, _ = net.SplitHostPort(upstream.Address)
+			}
+			upstream.tcpClient = &dns.Client{
+				Net:       "tcp-tls",
+				TLSConfig: &tls.Config{ServerName: serverName},
+			}
+
+		case DNS_RESOLVER_PROTOCOL_DOH:
+			upstream.httpClient = &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{ServerName: upstream.ServerName},
+				},
+			}
+		}
+
+		resolver.upstreams = append(resolver.upstreams, upstream)
+	}
+
+	if len(resolver.upstreams) > 0 {
+
+		cacheMaxEntries := DEFAULT_DNS_RESOLVER_CACHE_MAX_ENTRIES
+		if config.DNSResolverCacheMaxEntries != nil {
+			cacheMaxEntries = *config.DNSResolverCacheMaxEntries
+		}
+
+		cacheMaxTTLSeconds := DEFAULT_DNS_RESOLVER_CACHE_MAX_TTL_SECONDS
+		if config.DNSResolverCacheMaxTTLSeconds != nil {
+			cacheMaxTTLSeconds = *config.DNSResolverCacheMaxTTLSeconds
+		}
+
+		if cacheMaxEntries > 0 && cacheMaxTTLSeconds > 0 {
+			resolver.cache = lrucache.NewWithLRU(
+				lrucache.NoExpiration,
+				DNS_RESOLVER_CACHE_CLEANUP_INTERVAL,
+				cacheMaxEntries)
+			resolver.cacheMaxTTL = time.Duration(cacheMaxTTLSeconds) * time.Second
+		}
+	}
+
+	return resolver, nil
+}
+
+// ResolveIP resolves hostname to a list of IP addresses. Addresses of the
+// preferred IP address family, IPv4 unless preferIPv6 is set, are listed
+// first; addresses within each family are shuffled. ResolveIP also returns
+// whether the result was obtained entirely from the cache.
+//
+// When hostname is an IP address, it's returned as is.
+func (resolver *HostResolver) ResolveIP(
+	ctx context.Context, hostname string, preferIPv6 bool) ([]net.IP, bool, error) {
+
+	IP := net.ParseIP(hostname)
+	if IP != nil {
+		return []net.IP{IP}, false, nil
+	}
+
+	var IPv4s, IPv6s []net.IP
+	isCacheHit := false
+
+	if len(resolver.upstreams) == 0 {
+
+		IPAddrs, err := (&net.Resolver{}).LookupIPAddr(ctx, hostname)
+		if err != nil {
+			return nil, false, errors.Trace(err)
+		}
+		for _, IPAddr := range IPAddrs {
+			if IPAddr.IP.To4() != nil {
+				IPv4s = append(IPv4s, IPAddr.IP)
+			} else {
+				IPv6s = append(IPv6s, IPAddr.IP)
+			}
+		}
+
+	} else {
+
+		// The A and AAAA requests are made concurrently. The resolution fails
+		// only when both requests fail.
+
+		type lookupResult struct {
+			IPs        []net.IP
+			isCacheHit bool
+			err        error
+		}
+
+		IPv6ResultChannel := make(chan *lookupResult, 1)
+		go func() {
+			IPs, isCacheHit, err := resolver.lookup(ctx, hostname, dns.TypeAAAA)
+			IPv6ResultChannel <- &lookupResult{IPs, isCacheHit, err}
+		}()
+
+		var isIPv4CacheHit bool
+		var IPv4Err error
+		IPv4s, isIPv4CacheHit, IPv4Err = resolver.lookup(ctx, hostname, dns.TypeA)
+
+		IPv6Result := <-IPv6ResultChannel
+		IPv6s = IPv6Result.IPs
+
+		if IPv4Err != nil && IPv6Result.err != nil {
+			return nil, false, errors.Trace(IPv4Err)
+		}
+
+		isCacheHit = isIPv4CacheHit && IPv6Result.isCacheHit
+	}
+
+	if len(IPv4s) == 0 && len(IPv6s) == 0 {
+		return nil, isCacheHit, errors.TraceNew("no IP address")
+	}
+
+	shuffleIPs(IPv4s)
+	shuffleIPs(IPv6s)
+
+	IPs := make([]net.IP, 0, len(IPv4s)+len(IPv6s))
+	if preferIPv6 {
+		IPs = append(append(IPs, IPv6s...), IPv4s...)
+	} else {
+		IPs = append(append(IPs, IPv4s...), IPv6s...)
+	}
+
+	return IPs, isCacheHit, nil
+}
+
+// lookup returns the IP addresses in the response to a request of type
+// qtype for hostname. Upstreams are tried in a random order, until one
+// returns a successful or NXDOMAIN response. The returned slice may be
+// modified by the caller.
+func (resolver *HostResolver) lookup(
+	ctx context.Context, hostname string, qtype uint16) ([]net.IP, bool, error) {
+
+	fqdn := dns.Fqdn(strings.ToLower(hostname))
+
+	cacheKey := fmt.Sprintf("%s/%d", fqdn, qtype)
+
+	if resolver.cache != nil {
+		value, ok := resolver.cache.Get(cacheKey)
+		if ok {
+			IPs := value.(*hostResolverCacheEntry).IPs
+			return append([]net.IP(nil), IPs...), true, nil
+		}
+	}
+
+	request := new(dns.Msg)
+	request.SetQuestion(fqdn, qtype)
+	request.RecursionDesired = true
+	request.SetEdns0(DNS_RESOLVER_UDP_PAYLOAD_SIZE, false)
+
+	var response *dns.Msg
+	var err error
+
+	for _, i := range rand.Perm(len(resolver.upstreams)) {
+		response, err = resolver.upstreams[i].exchange(ctx, request)
+		if err == nil &&
+			response.Rcode != dns.RcodeSuccess &&
+			response.Rcode != dns.RcodeNameError {
+			err = errors.Tracef(
+				"unexpected response code: %s", dns.RcodeToString[response.Rcode])
+		}
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	var IPs []net.IP
+	var TTL uint32
+	hasTTL := false
+
+	updateTTL := func(recordTTL uint32) {
+		if !hasTTL || recordTTL < TTL {
+			TTL = recordTTL
+		}
+		hasTTL = true
+	}
+
+	for _, record := range response.Answer {
+		switch r := record.(type) {
+		case *dns.A:
+			if qtype == dns.TypeA {
+				IPs = append(IPs, r.A)
+			}
+		case *dns.AAAA:
+			if qtype == dns.TypeAAAA {
+				IPs = append(IPs, r.AAAA)
+			}
+		}
+		updateTTL(record.Header().Ttl)
+	}
+
+	// Negative responses are cached using the SOA TTL, as in RFC 2308.
+
+	if len(IPs) == 0 {
+		for _, record := range response.Ns {
+			if soa, ok := record.(*dns.SOA); ok {
+				updateTTL(soa.Hdr.Ttl)
+				updateTTL(soa.Minttl)
+			}
+		}
+	}
+
+	if resolver.cache != nil && hasTTL && TTL > 0 {
+		cacheTTL := time.Duration(TTL) * time.Second
+		if cacheTTL > resolver.cacheMaxTTL {
+			cacheTTL = resolver.cacheMaxTTL
+		}
+		resolver.cache.Set(
+			cacheKey,
+			&hostResolverCacheEntry{IPs: append([]net.IP(nil), IPs...)},
+			cacheTTL)
+	}
+
+	return IPs, false, nil
+}
+
+func (upstream *hostResolverUpstream) exchange(
+	ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+
+	switch upstream.Protocol {
+
+	case DNS_RESOLVER_PROTOCOL_PLAIN:
+		// A truncated UDP response may also result in dns.ErrTruncated.
+		response, _, err := upstream.udpClient.ExchangeContext(ctx, request, upstream.Address)
+		if (err == nil || err == dns.ErrTruncated) && response != nil && response.Truncated {
+			response, _, err = upstream.tcpClient.ExchangeContext(ctx, request, upstream.Address)
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return response, nil
+
+	case DNS_RESOLVER_PROTOCOL_DOT:
+		response, _, err := upstream.tcpClient.ExchangeContext(ctx, request, upstream.Address)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return response, nil
+
+	case DNS_RESOLVER_PROTOCOL_DOH:
+		response, err := upstream.exchangeDoH(ctx, request)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return response, nil
+	}
+
+	return nil, errors.TraceNew("unexpected protocol")
+}
+
+func (upstream *hostResolverUpstream) exchangeDoH(
+	ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+
+	// As recommended in RFC 8484, the DNS ID is 0 in DNS-over-HTTPS requests.
+
+	dohRequest := request.Copy()
+	dohRequest.Id = 0
+
+	requestPacket, err := dohRequest.Pack()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	httpRequest, err := http.NewRequest(
+		"POST", upstream.Address, bytes.NewReader(requestPacket))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	httpRequest = httpRequest.WithContext(ctx)
+	httpRequest.Header.Set("Content-Type", DNS_RESOLVER_MESSAGE_CONTENT_TYPE)
+	httpRequest.Header.Set("Accept", DNS_RESOLVER_MESSAGE_CONTENT_TYPE)
+
+	httpResponse, err := upstream.httpClient.Do(httpRequest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, errors.Tracef("unexpected HTTP status code: %d", httpResponse.StatusCode)
+	}
+
+	responsePacket, err := ioutil.ReadAll(
+		io.LimitReader(httpResponse.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	response := new(dns.Msg)
+	err = response.Unpack(responsePacket)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return response, nil
+}
+
+func shuffleIPs(IPs []net.IP) {
+	for i := len(IPs) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		IPs[i], IPs[j] = IPs[j], IPs[i]
+	}
+}
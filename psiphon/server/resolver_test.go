@@ -0,0 +1,292 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Psiphon-Labs/dns"
+)
+
+func TestHostResolver(t *testing.T) {
+
+	var requestCount int32
+
+	handleRequest := func(request *dns.Msg, isUDP bool) *dns.Msg {
+		atomic.AddInt32(&requestCount, 1)
+		return makeTestHostResolverResponse(request, isUDP)
+	}
+
+	// Plain DNS upstream, with UDP and TCP listeners on the same port.
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %s", err)
+	}
+	defer packetConn.Close()
+
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		buffer := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := packetConn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			request := new(dns.Msg)
+			if request.Unpack(buffer[:n]) != nil {
+				continue
+			}
+			responsePacket, _ := handleRequest(request, true).Pack()
+			packetConn.WriteTo(responsePacket, addr)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dnsConn := &dns.Conn{Conn: conn}
+				request, err := dnsConn.ReadMsg()
+				if err != nil {
+					return
+				}
+				dnsConn.WriteMsg(handleRequest(request, false))
+			}()
+		}
+	}()
+
+	// DNS-over-HTTPS upstream.
+
+	dohServer := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requestPacket, err := ioutil.ReadAll(r.Body)
+			request := new(dns.Msg)
+			if err == nil {
+				err = request.Unpack(requestPacket)
+			}
+			if err != nil || request.Id != 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			responsePacket, _ := handleRequest(request, false).Pack()
+			w.Header().Set("Content-Type", DNS_RESOLVER_MESSAGE_CONTENT_TYPE)
+			w.Write(responsePacket)
+		}))
+	defer dohServer.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(dohServer.Certificate())
+
+	testCases := []struct {
+		description string
+		upstream    DNSResolverUpstream
+	}{
+		{
+			"plain DNS",
+			DNSResolverUpstream{
+				Protocol: DNS_RESOLVER_PROTOCOL_PLAIN,
+				Address:  packetConn.LocalAddr().String(),
+			},
+		},
+		{
+			"DNS-over-HTTPS",
+			DNSResolverUpstream{
+				Protocol: DNS_RESOLVER_PROTOCOL_DOH,
+				Address:  dohServer.URL + "/dns-query",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.description, func(t *testing.T) {
+
+			atomic.StoreInt32(&requestCount, 0)
+
+			resolver, err := NewHostResolver(
+				&Config{DNSResolverUpstreams: []DNSResolverUpstream{testCase.upstream}})
+			if err != nil {
+				t.Fatalf("NewHostResolver failed: %s", err)
+			}
+
+			if testCase.upstream.Protocol == DNS_RESOLVER_PROTOCOL_DOH {
+				resolver.upstreams[0].httpClient.Transport.(*http.Transport).
+					TLSClientConfig.RootCAs = rootCAs
+			}
+
+			ctx := context.Background()
+
+			// Test: IPv4 is preferred by default; both A and AAAA requests
+			// are sent.
+
+			IPs, isCacheHit, err := resolver.ResolveIP(ctx, "www.example.org", false)
+			if err != nil {
+				t.Fatalf("ResolveIP failed: %s", err)
+			}
+			if isCacheHit || len(IPs) != 3 ||
+				IPs[0].To4() == nil || IPs[1].To4() == nil || IPs[2].To4() != nil {
+				t.Fatalf("unexpected result: %v %v", IPs, isCacheHit)
+			}
+			if atomic.LoadInt32(&requestCount) != 2 {
+				t.Fatalf("unexpected request count: %d", requestCount)
+			}
+
+			// Test: cached results, with IPv6 preferred.
+
+			IPs, isCacheHit, err = resolver.ResolveIP(ctx, "WWW.example.org", true)
+			if err != nil {
+				t.Fatalf("ResolveIP failed: %s", err)
+			}
+			if !isCacheHit || len(IPs) != 3 || IPs[0].To4() != nil {
+				t.Fatalf("unexpected result: %v %v", IPs, isCacheHit)
+			}
+			if atomic.LoadInt32(&requestCount) != 2 {
+				t.Fatalf("unexpected request count: %d", requestCount)
+			}
+
+			// Test: negative results are cached.
+
+			for i := 0; i < 2; i++ {
+				_, isCacheHit, err = resolver.ResolveIP(ctx, "nxdomain.example.org", false)
+				if err == nil || isCacheHit != (i == 1) {
+					t.Fatalf("unexpected result: %v %v", err, isCacheHit)
+				}
+			}
+			if atomic.LoadInt32(&requestCount) != 4 {
+				t.Fatalf("unexpected request count: %d", requestCount)
+			}
+
+			// Test: large responses are retried over TCP.
+
+			IPs, _, err = resolver.ResolveIP(ctx, "large.example.org", false)
+			if err != nil {
+				t.Fatalf("ResolveIP failed: %s", err)
+			}
+			if len(IPs) != testHostResolverLargeResponseSize+1 {
+				t.Fatalf("unexpected result: %v", IPs)
+			}
+
+			// Test: IP addresses are not resolved.
+
+			IPs, _, err = resolver.ResolveIP(ctx, "192.0.2.100", false)
+			if err != nil {
+				t.Fatalf("ResolveIP failed: %s", err)
+			}
+			if len(IPs) != 1 || !IPs[0].Equal(net.ParseIP("192.0.2.100")) {
+				t.Fatalf("unexpected result: %v", IPs)
+			}
+		})
+	}
+
+	// Test: invalid upstreams are rejected.
+
+	for _, upstream := range []DNSResolverUpstream{
+		{Protocol: DNS_RESOLVER_PROTOCOL_PLAIN, Address: "example.org:53"},
+		{Protocol: DNS_RESOLVER_PROTOCOL_DOT, Address: "192.0.2.1"},
+		{Protocol: DNS_RESOLVER_PROTOCOL_DOH, Address: "http://192.0.2.1/dns-query"},
+		{Protocol: "invalid", Address: "192.0.2.1:53"},
+	} {
+		err := upstream.Validate()
+		if err == nil {
+			t.Fatalf("unexpected valid upstream: %+v", upstream)
+		}
+	}
+}
+
+const testHostResolverLargeResponseSize = 100
+
+// makeTestHostResolverResponse answers A requests with 2 IPv4 addresses and
+// AAAA requests with 1 IPv6 address. "nxdomain.example.org." is answered
+// with NXDOMAIN, and "large.example.org." with a response that requires TCP.
+func makeTestHostResolverResponse(request *dns.Msg, isUDP bool) *dns.Msg {
+
+	response := new(dns.Msg).SetReply(request)
+
+	question := request.Question[0]
+
+	header := dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: question.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    60,
+	}
+
+	switch question.Name {
+
+	case "nxdomain.example.org.":
+		response.Rcode = dns.RcodeNameError
+		response.Ns = []dns.RR{
+			&dns.SOA{
+				Hdr: dns.RR_Header{
+					Name:   "example.org.",
+					Rrtype: dns.TypeSOA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				Ns:     "ns.example.org.",
+				Mbox:   "hostmaster.example.org.",
+				Minttl: 60,
+			},
+		}
+
+	case "large.example.org.":
+		if question.Qtype != dns.TypeA {
+			break
+		}
+		if isUDP {
+			response.Truncated = true
+			break
+		}
+		for i := 0; i <= testHostResolverLargeResponseSize; i++ {
+			response.Answer = append(response.Answer,
+				&dns.A{Hdr: header, A: net.IPv4(198, 51, 100, byte(i)).To4()})
+		}
+
+	default:
+		if question.Qtype == dns.TypeA {
+			response.Answer = []dns.RR{
+				&dns.A{Hdr: header, A: net.ParseIP("192.0.2.1").To4()},
+				&dns.A{Hdr: header, A: net.ParseIP("192.0.2.2").To4()},
+			}
+		} else if question.Qtype == dns.TypeAAAA {
+			response.Answer = []dns.RR{
+				&dns.AAAA{Hdr: header, AAAA: net.ParseIP("2001:db8::1")},
+			}
+		}
+	}
+
+	return response
+}
@@ -21,15 +21,18 @@ package server
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -38,6 +41,7 @@ import (
 	"testing"
 	"time"
 
+	socks "github.com/Psiphon-Labs/goptlib"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/accesscontrol"
@@ -47,6 +51,7 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpgw"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/values"
 	"golang.org/x/net/proxy"
 )
@@ -55,9 +60,22 @@ var serverIPAddress, testDataDirName string
 var mockWebServerURL, mockWebServerExpectedResponse string
 var mockWebServerPort = 8080
 
+const multiHopEntryServerConfigEnvVar = "PSIPHON_TEST_MULTI_HOP_ENTRY_SERVER_CONFIG"
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
+	// When run as a multi-hop entry server subprocess, run only the server.
+	// See runMultiHopEntryServer.
+	if serverConfigJSON := os.Getenv(multiHopEntryServerConfigEnvVar); serverConfigJSON != "" {
+		err := RunServices([]byte(serverConfigJSON))
+		if err != nil {
+			fmt.Printf("error running multi-hop entry server: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	serverIPv4Address, serverIPv6Address, err := common.GetRoutableInterfaceIPAddresses()
 	if err != nil {
 		fmt.Printf("error getting server IP address: %s\n", err)
@@ -152,6 +170,26 @@ func TestOSSH(t *testing.T) {
 		})
 }
 
+func TestOSSHTunnelResumption(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:       "OSSH",
+			enableSSHAPIRequests: true,
+			doHotReload:          false,
+			doDefaultSponsorID:   false,
+			denyTrafficRules:     false,
+			requireAuthorization: true,
+			omitAuthorization:    false,
+			doTunneledWebRequest: true,
+			doTunneledNTPRequest: false,
+			forceFragmenting:     false,
+			forceLivenessTest:    false,
+			doPruneServerEntries: false,
+			doDanglingTCPConn:    false,
+			doTunnelResumption:   true,
+		})
+}
+
 func TestFragmentedOSSH(t *testing.T) {
 	runServer(t,
 		&runServerConfig{
@@ -270,6 +308,109 @@ func TestUnfrontedMeekSessionTicketTLS13(t *testing.T) {
 		})
 }
 
+func TestWebSocket(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:       "WS-OSSH",
+			enableSSHAPIRequests: true,
+			doHotReload:          false,
+			doDefaultSponsorID:   false,
+			denyTrafficRules:     false,
+			requireAuthorization: true,
+			omitAuthorization:    false,
+			doTunneledWebRequest: true,
+			doTunneledNTPRequest: false,
+			forceFragmenting:     false,
+			forceLivenessTest:    false,
+			doPruneServerEntries: false,
+			doDanglingTCPConn:    true,
+		})
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:       "WSS-OSSH",
+			tlsProfile:           protocol.TLS_PROFILE_CHROME_70,
+			enableSSHAPIRequests: true,
+			doHotReload:          false,
+			doDefaultSponsorID:   false,
+			denyTrafficRules:     false,
+			requireAuthorization: true,
+			omitAuthorization:    false,
+			doTunneledWebRequest: true,
+			doTunneledNTPRequest: false,
+			forceFragmenting:     false,
+			forceLivenessTest:    false,
+			doPruneServerEntries: false,
+			doDanglingTCPConn:    true,
+		})
+}
+
+func TestUnfrontedMeekHTTPSHTTP2Streaming(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:       "UNFRONTED-MEEK-HTTPS-OSSH",
+			tlsProfile:           protocol.TLS_PROFILE_CHROME_70,
+			enableSSHAPIRequests: true,
+			doHotReload:          false,
+			doDefaultSponsorID:   false,
+			denyTrafficRules:     false,
+			requireAuthorization: true,
+			omitAuthorization:    false,
+			doTunneledWebRequest: true,
+			doTunneledNTPRequest: false,
+			forceFragmenting:     false,
+			forceLivenessTest:    false,
+			doPruneServerEntries: false,
+			doDanglingTCPConn:    true,
+			doHTTP2Streaming:     true,
+		})
+}
+
+func TestMultiHop(t *testing.T) {
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:       "OSSH",
+			enableSSHAPIRequests: true,
+			doHotReload:          false,
+			doDefaultSponsorID:   false,
+			denyTrafficRules:     false,
+			requireAuthorization: true,
+			omitAuthorization:    false,
+			doTunneledWebRequest: true,
+			doTunneledNTPRequest: false,
+			forceFragmenting:     false,
+			forceLivenessTest:    false,
+			doPruneServerEntries: false,
+			doDanglingTCPConn:    false,
+			doMultiHop:           true,
+		})
+}
+
+func TestPacketTunnelUserspaceStack(t *testing.T) {
+	if net.ParseIP(serverIPAddress).To4() == nil {
+		t.Skip("IPv4 server address required")
+	}
+	runServer(t,
+		&runServerConfig{
+			tunnelProtocol:               "OSSH",
+			enableSSHAPIRequests:         true,
+			doHotReload:                  false,
+			doDefaultSponsorID:           false,
+			denyTrafficRules:             false,
+			requireAuthorization:         true,
+			omitAuthorization:            false,
+			doTunneledWebRequest:         true,
+			doTunneledNTPRequest:         false,
+			forceFragmenting:             false,
+			forceLivenessTest:            false,
+			doPruneServerEntries:         false,
+			doDanglingTCPConn:            false,
+			doPacketTunnelUserspaceStack: true,
+		})
+}
+
 func TestQUICOSSH(t *testing.T) {
 	if !quic.Enabled() {
 		t.Skip("QUIC is not enabled")
@@ -538,6 +679,11 @@ type runServerConfig struct {
 	forceLivenessTest    bool
 	doPruneServerEntries bool
 	doDanglingTCPConn    bool
+	doTunnelResumption   bool
+	doHTTP2Streaming     bool
+
+	doPacketTunnelUserspaceStack bool
+	doMultiHop                   bool
 }
 
 var (
@@ -688,6 +834,17 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	// Exercise this option.
 	serverConfig["PeriodicGarbageCollectionSeconds"] = 1
 
+	// Meek clients are configured, via tactics, to attempt HTTP/2 streaming
+	// whenever HTTP/2 is negotiated.
+	if runConfig.doHTTP2Streaming {
+		serverConfig["MeekEnableHTTP2Streaming"] = true
+	}
+
+	if runConfig.doPacketTunnelUserspaceStack {
+		serverConfig["RunPacketTunnel"] = true
+		serverConfig["PacketTunnelUserspaceStack"] = true
+	}
+
 	serverConfigJSON, _ = json.Marshal(serverConfig)
 
 	serverConnectedLog := make(chan map[string]interface{}, 1)
@@ -762,6 +919,15 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 		}
 	}()
 
+	// In multi-hop mode, the server under test is the exit server.
+
+	var multiHopEntryServerEntryFields protocol.ServerEntryFields
+	if runConfig.doMultiHop {
+		var stopEntryServer func()
+		multiHopEntryServerEntryFields, stopEntryServer = runMultiHopEntryServer(t)
+		defer stopEntryServer()
+	}
+
 	// TODO: monitor logs for more robust wait-until-loaded. For example,
 	// especially with the race detector on, QUIC-OSSH tests can fail as the
 	// client sends its initial packet before the server is ready.
@@ -856,6 +1022,43 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 		clientConfig.Authorizations = []string{clientAuthorization}
 	}
 
+	var disruptor *disruptorProxy
+	if runConfig.doTunnelResumption {
+		disruptor = newDisruptorProxy(t)
+		defer disruptor.close()
+		clientConfig.UpstreamProxyURL = disruptor.proxyURL()
+	}
+
+	if runConfig.doMultiHop {
+		clientConfig.EnableMultiHop = true
+		clientConfig.MultiHopEntryRegion = multiHopEntryServerRegion
+	}
+
+	var packetTunnelDeviceConn net.Conn
+	if runConfig.doPacketTunnelUserspaceStack {
+
+		// A Unix datagram socket pair stands in for the client tun device:
+		// as with a tun device, each read and write is a single IP packet.
+		// The client relays packets to the server, which terminates the
+		// flows in its userspace stack.
+
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+		if err != nil {
+			t.Fatalf("Socketpair failed: %s", err)
+		}
+		defer syscall.Close(fds[1])
+
+		deviceFile := os.NewFile(uintptr(fds[0]), "device")
+		packetTunnelDeviceConn, err = net.FileConn(deviceFile)
+		deviceFile.Close()
+		if err != nil {
+			t.Fatalf("FileConn failed: %s", err)
+		}
+		defer packetTunnelDeviceConn.Close()
+
+		clientConfig.PacketTunnelTunFileDescriptor = fds[1]
+	}
+
 	err = clientConfig.Commit(false)
 	if err != nil {
 		t.Fatalf("error committing configuration file: %s", err)
@@ -920,6 +1123,13 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	// Clear SLOKs from previous test runs.
 	psiphon.DeleteSLOKs()
 
+	if runConfig.doMultiHop {
+		err = psiphon.StoreServerEntry(multiHopEntryServerEntryFields, true)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
 	// Store prune server entry test server entries and failed tunnel records.
 	storePruneServerEntriesTest(
 		t, runConfig, testDataDirName, pruneServerEntryTestCases)
@@ -933,6 +1143,9 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	tunnelsEstablished := make(chan struct{}, 1)
 	homepageReceived := make(chan struct{}, 1)
 	slokSeeded := make(chan struct{}, 1)
+	tunnelResumed := make(chan struct{}, 1)
+	http2StreamingEstablished := make(chan struct{}, 1)
+	multiHopTunnelActive := make(chan struct{}, 1)
 
 	numPruneNotices := 0
 	pruneServerEntriesNoticesEmitted := make(chan struct{}, 1)
@@ -971,6 +1184,21 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 			case "SLOKSeeded":
 				sendNotificationReceived(slokSeeded)
 
+			case "TunnelResumed":
+				sendNotificationReceived(tunnelResumed)
+
+			case "ActiveTunnel":
+				entryDiagnosticID, _ := payload["multiHopEntryDiagnosticID"].(string)
+				if entryDiagnosticID != "" &&
+					entryDiagnosticID == multiHopEntryServerEntryFields.GetDiagnosticID() {
+					sendNotificationReceived(multiHopTunnelActive)
+				}
+
+			case "MeekHTTP2Streaming":
+				if payload["established"].(bool) {
+					sendNotificationReceived(http2StreamingEstablished)
+				}
+
 			case "PruneServerEntry":
 				numPruneNotices += 1
 				if numPruneNotices == expectedNumPruneNotices {
@@ -1034,6 +1262,14 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 	waitOnNotification(t, tunnelsEstablished, timeoutSignal, "tunnel established timeout exceeded")
 	waitOnNotification(t, homepageReceived, timeoutSignal, "homepage received timeout exceeded")
 
+	if runConfig.doHTTP2Streaming {
+		waitOnNotification(t, http2StreamingEstablished, timeoutSignal, "HTTP/2 streaming established timeout exceeded")
+	}
+
+	if runConfig.doMultiHop {
+		waitOnNotification(t, multiHopTunnelActive, timeoutSignal, "multi-hop tunnel active timeout exceeded")
+	}
+
 	expectTrafficFailure := runConfig.denyTrafficRules || (runConfig.omitAuthorization && runConfig.requireAuthorization)
 
 	if runConfig.doTunneledWebRequest {
@@ -1054,6 +1290,48 @@ func runServer(t *testing.T, runConfig *runServerConfig) {
 		}
 	}
 
+	if runConfig.doPacketTunnelUserspaceStack {
+
+		// Test: packet tunnel TCP flows are port forwarded, subject to
+		// traffic rules. The server completes the TCP handshake only after
+		// the port forward is established, and resets flows to disallowed
+		// ports.
+
+		flags, err := makePacketTunnelTCPConnectAttempt(
+			packetTunnelDeviceConn, 40000, mockWebServerPort)
+		if err != nil {
+			t.Fatalf("packet tunnel TCP connect failed: %s", err)
+		}
+		if flags != tcpFlagSYN|tcpFlagACK {
+			t.Fatalf("unexpected packet tunnel TCP flags: %x", flags)
+		}
+
+		flags, err = makePacketTunnelTCPConnectAttempt(
+			packetTunnelDeviceConn, 40001, mockWebServerPort+1)
+		if err != nil {
+			t.Fatalf("packet tunnel TCP connect failed: %s", err)
+		}
+		if flags&tcpFlagRST == 0 {
+			t.Fatalf("unexpected packet tunnel TCP flags: %x", flags)
+		}
+	}
+
+	if runConfig.doTunnelResumption {
+
+		// Test: the tunnel survives the failure of its network connection and
+		// the tunnel remains usable
+
+		disruptor.disrupt()
+
+		waitOnNotification(t, tunnelResumed, timeoutSignal, "tunnel resumed timeout exceeded")
+
+		err = makeTunneledWebRequest(
+			t, localHTTPProxyPort, mockWebServerURL, mockWebServerExpectedResponse)
+		if err != nil {
+			t.Fatalf("tunneled web request after resumption failed: %s", err)
+		}
+	}
+
 	if runConfig.doTunneledNTPRequest {
 
 		// Test: tunneled UDP packets
@@ -1383,6 +1661,163 @@ func makeTunneledWebRequest(
 	return nil
 }
 
+// multiHopEntryServerRegion is the region of the multi-hop entry server. The
+// client selects entry servers from only this region, excluding any other
+// server entries stored by previous tests.
+const multiHopEntryServerRegion = "ZZ"
+
+// runMultiHopEntryServer runs a psiphond, in a subprocess, to be used as the
+// multi-hop entry server; the server under test is the exit server. A
+// subprocess is used as psiphond logging and signal handling are global.
+// The entry server listens on the loopback address, so that its IP address
+// differs from the exit server IP address. The returned server entry fields
+// are to be stored by the client, and the returned func stops the server.
+func runMultiHopEntryServer(t *testing.T) (protocol.ServerEntryFields, func()) {
+
+	serverConfigJSON, _, _, _, encodedServerEntry, err := GenerateConfig(
+		&GenerateConfigParams{
+			ServerIPAddress:      "127.0.0.1",
+			EnableSSHAPIRequests: true,
+			WebServerPort:        8001,
+			TunnelProtocolPorts:  map[string]int{"OSSH": 4001},
+		})
+	if err != nil {
+		t.Fatalf("error generating multi-hop entry server config: %s", err)
+	}
+
+	var serverConfig map[string]interface{}
+	json.Unmarshal(serverConfigJSON, &serverConfig)
+	serverConfig["LogFilename"] = filepath.Join(testDataDirName, "psiphond-multi-hop-entry.log")
+	serverConfig["LogLevel"] = "debug"
+	serverConfigJSON, _ = json.Marshal(serverConfig)
+
+	serverEntryFields, err := protocol.DecodeServerEntryFields(
+		string(encodedServerEntry),
+		common.GetCurrentTimestamp(),
+		protocol.SERVER_ENTRY_SOURCE_REMOTE)
+	if err != nil {
+		t.Fatalf("DecodeServerEntryFields failed: %s", err)
+	}
+	serverEntryFields["region"] = multiHopEntryServerRegion
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(
+		os.Environ(),
+		fmt.Sprintf("%s=%s", multiHopEntryServerConfigEnvVar, serverConfigJSON))
+
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("error running multi-hop entry server: %s", err)
+	}
+
+	stopServer := func() {
+
+		cmd.Process.Signal(os.Interrupt)
+
+		stopped := make(chan struct{})
+		go func() {
+			cmd.Wait()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Errorf("multi-hop entry server shutdown timeout exceeded")
+			cmd.Process.Kill()
+			<-stopped
+		}
+	}
+
+	return serverEntryFields, stopServer
+}
+
+const (
+	tcpFlagSYN = 0x02
+	tcpFlagRST = 0x04
+	tcpFlagACK = 0x10
+)
+
+// makePacketTunnelTCPConnectAttempt writes an IPv4 TCP SYN packet, from a
+// private client address to the server IP address, to the packet tunnel
+// device and returns the TCP flags of the response.
+func makePacketTunnelTCPConnectAttempt(
+	deviceConn net.Conn, sourcePort, destinationPort int) (byte, error) {
+
+	sourceIP := net.ParseIP("10.0.0.2").To4()
+	destinationIP := net.ParseIP(serverIPAddress).To4()
+
+	packet := make([]byte, 40)
+
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = syscall.IPPROTO_TCP
+	copy(packet[12:16], sourceIP)
+	copy(packet[16:20], destinationIP)
+	binary.BigEndian.PutUint16(packet[10:12], packetChecksum(0, packet[0:20]))
+
+	segment := packet[20:]
+	binary.BigEndian.PutUint16(segment[0:2], uint16(sourcePort))
+	binary.BigEndian.PutUint16(segment[2:4], uint16(destinationPort))
+	binary.BigEndian.PutUint32(segment[4:8], 1000)
+	segment[12] = 5 << 4
+	segment[13] = tcpFlagSYN
+	binary.BigEndian.PutUint16(segment[14:16], 0xFFFF)
+
+	pseudoHeader := make([]byte, 12)
+	copy(pseudoHeader[0:4], sourceIP)
+	copy(pseudoHeader[4:8], destinationIP)
+	pseudoHeader[9] = syscall.IPPROTO_TCP
+	binary.BigEndian.PutUint16(pseudoHeader[10:12], uint16(len(segment)))
+
+	binary.BigEndian.PutUint16(
+		segment[16:18], packetChecksum(packetChecksumSum(0, pseudoHeader), segment))
+
+	_, err := deviceConn.Write(packet)
+	if err != nil {
+		return 0, fmt.Errorf("error writing packet: %s", err)
+	}
+
+	buffer := make([]byte, 65536)
+	deviceConn.SetReadDeadline(time.Now().Add(20 * time.Second))
+
+	for {
+		n, err := deviceConn.Read(buffer)
+		if err != nil {
+			return 0, fmt.Errorf("error reading packet: %s", err)
+		}
+		packet := buffer[:n]
+
+		// Skip any packets that aren't a response to the SYN.
+		if len(packet) < 40 || packet[0] != 0x45 ||
+			packet[9] != syscall.IPPROTO_TCP ||
+			int(binary.BigEndian.Uint16(packet[22:24])) != sourcePort {
+			continue
+		}
+
+		return packet[33], nil
+	}
+}
+
+func packetChecksumSum(sum uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+func packetChecksum(sum uint32, data []byte) uint16 {
+	sum = packetChecksumSum(sum, data)
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
+
 func makeTunneledNTPRequest(t *testing.T, localSOCKSProxyPort int, udpgwServerAddress string) error {
 
 	timeout := 20 * time.Second
@@ -1429,7 +1864,7 @@ func makeTunneledNTPRequestAttempt(
 		defer serverUDPConn.Close()
 
 		udpgwPreambleSize := 11 // see writeUdpgwPreamble
-		buffer := make([]byte, udpgwProtocolMaxMessageSize)
+		buffer := make([]byte, udpgw.PROTOCOL_MAX_MESSAGE_SIZE)
 		packetSize, clientAddr, err := serverUDPConn.ReadFromUDP(
 			buffer[udpgwPreambleSize:])
 		if err != nil {
@@ -1454,7 +1889,7 @@ func makeTunneledNTPRequestAttempt(
 
 		flags := uint8(0)
 		if destinationPort == 53 {
-			flags = udpgwProtocolFlagDNS
+			flags = udpgw.PROTOCOL_FLAG_DNS
 		}
 
 		err = writeUdpgwPreamble(
@@ -1868,6 +2303,7 @@ func paveTacticsConfigFile(
           "LivenessTestMaxUpstreamBytes" : %d,
           "LivenessTestMinDownstreamBytes" : %d,
           "LivenessTestMaxDownstreamBytes" : %d,
+          "MeekHTTP2StreamingProbability" : 1.0,
           "BPFServerTCPProgram": {
             "Name" : "test-server-bpf",
               "Instructions" : [
@@ -1933,6 +2369,79 @@ func paveBlocklistFile(t *testing.T, blocklistFilename string) {
 	}
 }
 
+// disruptorProxy is a SOCKS proxy which relays client connections and which
+// can close all relayed connections to simulate a network failure.
+type disruptorProxy struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	conns    []net.Conn
+}
+
+func newDisruptorProxy(t *testing.T) *disruptorProxy {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen failed: %s", err)
+	}
+
+	disruptor := &disruptorProxy{listener: listener}
+
+	go func() {
+		socksListener := socks.NewSocksListener(listener)
+		for {
+			localConn, err := socksListener.AcceptSocks()
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Temporary() {
+					continue
+				}
+				return
+			}
+			go func() {
+				defer localConn.Close()
+				remoteConn, err := net.Dial("tcp", localConn.Req.Target)
+				if err != nil {
+					return
+				}
+				defer remoteConn.Close()
+				err = localConn.Grant(&net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: 0})
+				if err != nil {
+					return
+				}
+
+				disruptor.mutex.Lock()
+				disruptor.conns = append(disruptor.conns, localConn, remoteConn)
+				disruptor.mutex.Unlock()
+
+				go func() {
+					_, _ = io.Copy(remoteConn, localConn)
+					remoteConn.Close()
+				}()
+				_, _ = io.Copy(localConn, remoteConn)
+			}()
+		}
+	}()
+
+	return disruptor
+}
+
+func (disruptor *disruptorProxy) proxyURL() string {
+	return "socks4a://" + disruptor.listener.Addr().String()
+}
+
+func (disruptor *disruptorProxy) disrupt() {
+	disruptor.mutex.Lock()
+	defer disruptor.mutex.Unlock()
+	for _, conn := range disruptor.conns {
+		conn.Close()
+	}
+	disruptor.conns = nil
+}
+
+func (disruptor *disruptorProxy) close() {
+	disruptor.listener.Close()
+	disruptor.disrupt()
+}
+
 func sendNotificationReceived(c chan<- struct{}) {
 	select {
 	case c <- struct{}{}:
@@ -2121,7 +2630,8 @@ func storePruneServerEntriesTest(
 			},
 			serverEntry,
 			false,
-			0)
+			0,
+			false)
 		if err != nil {
 			t.Fatalf("MakeDialParameters failed: %s", err)
 		}
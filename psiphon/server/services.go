@@ -84,7 +84,7 @@ func RunServices(configJSON []byte) error {
 
 	supportServices.TunnelServer = tunnelServer
 
-	if config.RunPacketTunnel {
+	if config.RunPacketTunnel && !config.PacketTunnelUserspaceStack {
 
 		packetTunnelServer, err := tun.NewServer(&tun.ServerConfig{
 			Logger:                      CommonLogger(log),
@@ -107,7 +107,7 @@ func RunServices(configJSON []byte) error {
 	// orderly shutdown should flow through to the end of the function to ensure
 	// all workers are synchronously stopped.
 
-	if config.RunPacketTunnel {
+	if supportServices.PacketTunnelServer != nil {
 		supportServices.PacketTunnelServer.Start()
 		waitGroup.Add(1)
 		go func() {
@@ -151,6 +151,52 @@ func RunServices(configJSON []byte) error {
 		}()
 	}
 
+	// Traffic rules time window filters start and end on UTC hour
+	// boundaries, so established client traffic rules are re-selected at
+	// each boundary. The check for time filters is made at each boundary,
+	// as traffic rules may be hot reloaded.
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		for {
+			now := time.Now()
+			timer := time.NewTimer(now.UTC().Truncate(time.Hour).Add(time.Hour).Sub(now))
+			select {
+			case <-shutdownBroadcast:
+				timer.Stop()
+				return
+			case <-timer.C:
+				if supportServices.TrafficRulesSet.HasTimeFilters() {
+					tunnelServer.ReselectAllClientTrafficRules()
+				}
+			}
+		}
+	}()
+
+	// Periodically apply client data transfer to traffic rules data quotas,
+	// and save quota usage.
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		updateTicker := time.NewTicker(DATA_QUOTA_UPDATE_PERIOD)
+		defer updateTicker.Stop()
+		saveTicker := time.NewTicker(DATA_QUOTA_STATE_SAVE_PERIOD)
+		defer saveTicker.Stop()
+		for {
+			select {
+			case <-shutdownBroadcast:
+				return
+			case <-updateTicker.C:
+				tunnelServer.UpdateAllClientDataQuotas()
+			case <-saveTicker.C:
+				err := supportServices.DataQuotaStore.Save()
+				if err != nil {
+					log.WithTraceFields(LogFields{"error": err}).Warning("save data quota state failed")
+				}
+			}
+		}
+	}()
+
 	if config.RunWebServer() {
 		waitGroup.Add(1)
 		go func() {
@@ -163,6 +209,18 @@ func RunServices(configJSON []byte) error {
 		}()
 	}
 
+	if config.RunMetricsServer() {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			err := RunMetricsServer(supportServices, shutdownBroadcast)
+			select {
+			case errorChannel <- err:
+			default:
+			}
+		}()
+	}
+
 	// The tunnel server is always run; it launches multiple
 	// listeners, depending on which tunnel protocols are enabled.
 	waitGroup.Add(1)
@@ -282,6 +340,12 @@ loop:
 	close(shutdownBroadcast)
 	waitGroup.Wait()
 
+	// All clients have stopped and recorded their final data quota usage.
+	saveErr := supportServices.DataQuotaStore.Save()
+	if saveErr != nil {
+		log.WithTraceFields(LogFields{"error": saveErr}).Warning("save data quota state failed")
+	}
+
 	close(signalProfileDumperStop)
 
 	return err
@@ -386,16 +450,19 @@ func logIrregularTunnel(
 // components, which allows these data components to be refreshed
 // without restarting the server process.
 type SupportServices struct {
-	Config             *Config
-	TrafficRulesSet    *TrafficRulesSet
-	OSLConfig          *osl.Config
-	PsinetDatabase     *psinet.Database
-	GeoIPService       *GeoIPService
-	DNSResolver        *DNSResolver
-	TunnelServer       *TunnelServer
-	PacketTunnelServer *tun.Server
-	TacticsServer      *tactics.Server
-	Blocklist          *Blocklist
+	Config                *Config
+	TrafficRulesSet       *TrafficRulesSet
+	OSLConfig             *osl.Config
+	PsinetDatabase        *psinet.Database
+	GeoIPService          *GeoIPService
+	DNSResolver           *DNSResolver
+	HostResolver          *HostResolver
+	TunnelServer          *TunnelServer
+	PacketTunnelServer    *tun.Server
+	TacticsServer         *tactics.Server
+	Blocklist             *Blocklist
+	DataQuotaStore        *DataQuotaStore
+	TorPluggableTransport *TorPluggableTransport
 }
 
 // NewSupportServices initializes a new SupportServices.
@@ -427,11 +494,21 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 		return nil, errors.Trace(err)
 	}
 
+	hostResolver, err := NewHostResolver(config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	blocklist, err := NewBlocklist(config.BlocklistFilename)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
+	dataQuotaStore, err := NewDataQuotaStore(config.DataQuotaStateFilename)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
 	tacticsServer, err := tactics.NewServer(
 		CommonLogger(log),
 		getTacticsAPIParameterLogFieldFormatter(),
@@ -441,15 +518,26 @@ func NewSupportServices(config *Config) (*SupportServices, error) {
 		return nil, errors.Trace(err)
 	}
 
+	var torPluggableTransport *TorPluggableTransport
+	if config.TorORPortForwarding {
+		torPluggableTransport, err = NewTorPluggableTransport(config)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
 	return &SupportServices{
-		Config:          config,
-		TrafficRulesSet: trafficRulesSet,
-		OSLConfig:       oslConfig,
-		PsinetDatabase:  psinetDatabase,
-		GeoIPService:    geoIPService,
-		DNSResolver:     dnsResolver,
-		TacticsServer:   tacticsServer,
-		Blocklist:       blocklist,
+		Config:                config,
+		TrafficRulesSet:       trafficRulesSet,
+		OSLConfig:             oslConfig,
+		PsinetDatabase:        psinetDatabase,
+		GeoIPService:          geoIPService,
+		DNSResolver:           dnsResolver,
+		HostResolver:          hostResolver,
+		TacticsServer:         tacticsServer,
+		Blocklist:             blocklist,
+		DataQuotaStore:        dataQuotaStore,
+		TorPluggableTransport: torPluggableTransport,
 	}, nil
 }
 
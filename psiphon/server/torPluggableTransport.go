@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"net"
+	"sync"
+
+	pt "github.com/Psiphon-Labs/goptlib"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+const (
+	TOR_PLUGGABLE_TRANSPORT_METHOD_NAME = "psiphon"
+)
+
+// TorPluggableTransport implements the server side of the Tor pluggable
+// transport managed proxy protocol, for TorORPortForwarding. The protocol
+// messages are written to stdout, which Tor reads; psiphond logs are
+// written to stderr and don't interfere.
+type TorPluggableTransport struct {
+	serverInfo pt.ServerInfo
+	methodAddr *net.TCPAddr
+	reportOnce sync.Once
+}
+
+// NewTorPluggableTransport reads the managed proxy configuration which Tor
+// provides in the environment. Errors are reported to Tor before
+// NewTorPluggableTransport returns.
+func NewTorPluggableTransport(config *Config) (*TorPluggableTransport, error) {
+
+	serverInfo, err := pt.ServerSetup(
+		[]string{TOR_PLUGGABLE_TRANSPORT_METHOD_NAME})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Tor may request methods other than "psiphon", including for other
+	// transports run by other processes; only the "psiphon" method is
+	// reported and any others are rejected.
+
+	reportMethod := false
+	for _, bindaddr := range serverInfo.Bindaddrs {
+		if bindaddr.MethodName == TOR_PLUGGABLE_TRANSPORT_METHOD_NAME {
+			reportMethod = true
+		} else {
+			pt.SmethodError(bindaddr.MethodName, "no such method")
+		}
+	}
+	if !reportMethod {
+		pt.SmethodsDone()
+		return nil, errors.Tracef(
+			"Tor did not request the %s method", TOR_PLUGGABLE_TRANSPORT_METHOD_NAME)
+	}
+
+	// The Tor bindaddr is ignored; clients connect to the Psiphon tunnel
+	// protocol listeners, which are configured by TunnelProtocolPorts.
+
+	methodAddr := getTorPluggableTransportMethodAddr(config)
+	if methodAddr == nil {
+		pt.SmethodError(TOR_PLUGGABLE_TRANSPORT_METHOD_NAME, "no direct TCP tunnel protocol")
+		pt.SmethodsDone()
+		return nil, errors.TraceNew("no direct TCP tunnel protocol")
+	}
+
+	return &TorPluggableTransport{
+		serverInfo: serverInfo,
+		methodAddr: methodAddr,
+	}, nil
+}
+
+// getTorPluggableTransportMethodAddr returns the transport address to report
+// to Tor: ServerIPAddress with the port of the first tunnel protocol, in
+// GetSupportedTunnelProtocols order, which clients dial directly over TCP.
+// Fronted protocols, which clients reach through a CDN, and UDP protocols
+// are skipped, as are protocols with no listening port. nil is returned when
+// there is no such tunnel protocol.
+func getTorPluggableTransportMethodAddr(config *Config) *net.TCPAddr {
+
+	for _, tunnelProtocol := range protocol.GetSupportedTunnelProtocols() {
+
+		port := config.TunnelProtocolPorts[tunnelProtocol]
+
+		if port == 0 ||
+			!protocol.TunnelProtocolUsesTCP(tunnelProtocol) ||
+			protocol.TunnelProtocolUsesFrontedMeek(tunnelProtocol) ||
+			protocol.TunnelProtocolUsesTapdance(tunnelProtocol) {
+			continue
+		}
+
+		return &net.TCPAddr{
+			IP:   net.ParseIP(config.ServerIPAddress),
+			Port: port,
+		}
+	}
+
+	return nil
+}
+
+// ReportMethods reports the "psiphon" transport method to Tor. ReportMethods
+// should be called once the tunnel protocol listeners are running, and only
+// the first call has any effect.
+func (t *TorPluggableTransport) ReportMethods() {
+	t.reportOnce.Do(func() {
+		pt.Smethod(TOR_PLUGGABLE_TRANSPORT_METHOD_NAME, t.methodAddr)
+		pt.SmethodsDone()
+	})
+}
+
+// IsMethodAddress returns true when the host and port are the transport
+// address reported to Tor, which Tor clients dial as the bridge address.
+func (t *TorPluggableTransport) IsMethodAddress(host string, port int) bool {
+	IP := net.ParseIP(host)
+	return IP != nil && IP.Equal(t.methodAddr.IP) && port == t.methodAddr.Port
+}
+
+// ORPortAddress returns the address, either the extended ORPort or the
+// ORPort, which DialORPort connects to.
+func (t *TorPluggableTransport) ORPortAddress() *net.TCPAddr {
+	if t.serverInfo.ExtendedOrAddr != nil && t.serverInfo.AuthCookie != nil {
+		return t.serverInfo.ExtendedOrAddr
+	}
+	return t.serverInfo.OrAddr
+}
+
+// DialORPort connects to Tor. When Tor provides an extended ORPort,
+// DialORPort authenticates and identifies the "psiphon" transport.
+//
+// The client IP address is not sent to Tor: sshClient doesn't retain client
+// IP addresses, and Tor's per-country bridge statistics are not worth
+// disclosing them for.
+func (t *TorPluggableTransport) DialORPort() (net.Conn, error) {
+	conn, err := pt.DialOr(&t.serverInfo, "", TOR_PLUGGABLE_TRANSPORT_METHOD_NAME)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	pt "github.com/Psiphon-Labs/goptlib"
+)
+
+func TestTorPluggableTransport(t *testing.T) {
+
+	stateDirectory, err := ioutil.TempDir("", "psiphon-tor-pt-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(stateDirectory)
+
+	// The test ORPort echoes all received data.
+
+	ORPortListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ORPortListener.Close()
+
+	go func() {
+		for {
+			conn, err := ORPortListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	environment := map[string]string{
+		"TOR_PT_MANAGED_TRANSPORT_VER": "1",
+		"TOR_PT_STATE_LOCATION":        stateDirectory,
+		"TOR_PT_SERVER_TRANSPORTS":     "psiphon,obfs4",
+		"TOR_PT_SERVER_BINDADDR":       "psiphon-127.0.0.1:9001,obfs4-127.0.0.1:9002",
+		"TOR_PT_ORPORT":                ORPortListener.Addr().String(),
+	}
+	for key, value := range environment {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	var output bytes.Buffer
+	savedStdout := pt.Stdout
+	pt.Stdout = &output
+	defer func() { pt.Stdout = savedStdout }()
+
+	// The reported transport address is the port of a directly dialed TCP
+	// tunnel protocol, not a fronted or UDP protocol.
+
+	config := &Config{
+		ServerIPAddress: "127.0.0.1",
+		TunnelProtocolPorts: map[string]int{
+			"FRONTED-MEEK-OSSH": 443,
+			"OSSH":              4000,
+			"QUIC-OSSH":         4001,
+		},
+	}
+
+	torPluggableTransport, err := NewTorPluggableTransport(config)
+	if err != nil {
+		t.Fatalf("NewTorPluggableTransport failed: %s", err)
+	}
+
+	torPluggableTransport.ReportMethods()
+	torPluggableTransport.ReportMethods()
+
+	expectedOutput := "VERSION 1\n" +
+		"SMETHOD-ERROR obfs4 no such method\n" +
+		"SMETHOD psiphon 127.0.0.1:4000\n" +
+		"SMETHODS DONE\n"
+
+	if output.String() != expectedOutput {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+
+	// Only port forwards to the reported transport address are connected to
+	// Tor.
+
+	if !torPluggableTransport.IsMethodAddress("127.0.0.1", 4000) ||
+		torPluggableTransport.IsMethodAddress("127.0.0.1", 443) ||
+		torPluggableTransport.IsMethodAddress("127.0.0.2", 4000) ||
+		torPluggableTransport.IsMethodAddress("localhost", 4000) {
+		t.Fatalf("unexpected IsMethodAddress result")
+	}
+
+	if torPluggableTransport.ORPortAddress().String() != ORPortListener.Addr().String() {
+		t.Fatalf("unexpected ORPort address: %s", torPluggableTransport.ORPortAddress())
+	}
+
+	conn, err := torPluggableTransport.DialORPort()
+	if err != nil {
+		t.Fatalf("DialORPort failed: %s", err)
+	}
+	defer conn.Close()
+
+	sendData := []byte("test")
+	_, err = conn.Write(sendData)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	receiveData := make([]byte, len(sendData))
+	_, err = io.ReadFull(conn, receiveData)
+	if err != nil {
+		t.Fatalf("ReadFull failed: %s", err)
+	}
+
+	if !bytes.Equal(sendData, receiveData) {
+		t.Fatalf("unexpected received data")
+	}
+
+	// When there's no directly dialed TCP tunnel protocol, setup fails and
+	// the failure is reported to Tor.
+
+	output.Reset()
+
+	_, err = NewTorPluggableTransport(
+		&Config{
+			ServerIPAddress: "127.0.0.1",
+			TunnelProtocolPorts: map[string]int{
+				"FRONTED-MEEK-OSSH": 443,
+				"QUIC-OSSH":         4001,
+			},
+		})
+	if err == nil {
+		t.Fatalf("unexpected NewTorPluggableTransport success")
+	}
+
+	expectedOutput = "VERSION 1\n" +
+		"SMETHOD-ERROR obfs4 no such method\n" +
+		"SMETHOD-ERROR psiphon no direct TCP tunnel protocol\n" +
+		"SMETHODS DONE\n"
+
+	if output.String() != expectedOutput {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+
+	// When Tor doesn't request the "psiphon" method, setup fails.
+
+	os.Setenv("TOR_PT_SERVER_TRANSPORTS", "obfs4")
+	output.Reset()
+
+	_, err = NewTorPluggableTransport(config)
+	if err == nil {
+		t.Fatalf("unexpected NewTorPluggableTransport success")
+	}
+
+	expectedOutput = "VERSION 1\n" +
+		"SMETHOD-ERROR obfs4 no such method\n" +
+		"SMETHODS DONE\n"
+
+	if output.String() != expectedOutput {
+		t.Fatalf("unexpected output: %s", output.String())
+	}
+}
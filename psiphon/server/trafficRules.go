@@ -22,6 +22,7 @@ package server
 import (
 	"encoding/json"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
@@ -112,6 +113,8 @@ type TrafficRulesSet struct {
 	// A default of 600 is used when
 	// MeekRateLimiterReapHistoryFrequencySeconds is 0.
 	MeekRateLimiterReapHistoryFrequencySeconds int
+
+	hasTimeFilters bool
 }
 
 // TrafficRulesFilter defines a filter to match against client attributes.
@@ -157,9 +160,28 @@ type TrafficRulesFilter struct {
 	// revoked. When omitted or false, this field is ignored.
 	AuthorizationsRevoked bool
 
+	// UTCHours is a list of hours, 0-23 in UTC, at least one of which must
+	// contain the current time in order to match this filter. When omitted
+	// or empty, any hour matches.
+	UTCHours []int
+
+	// Weekdays is a list of days of the week, "Sunday" through "Saturday" in
+	// UTC, at least one of which must contain the current time in order to
+	// match this filter. When omitted or empty, any day matches.
+	Weekdays []string
+
+	// StartDate and EndDate specify a range of dates, in the form
+	// "2006-01-02" in UTC, which must contain the current time in order to
+	// match this filter. The range includes both StartDate and EndDate.
+	// Either may be omitted, leaving that end of the range open.
+	StartDate string
+	EndDate   string
+
 	regionLookup map[string]bool
 	ispLookup    map[string]bool
 	cityLookup   map[string]bool
+	startTime    time.Time
+	endTime      time.Time
 }
 
 // TrafficRules specify the limits placed on client traffic.
@@ -242,6 +264,40 @@ type TrafficRules struct {
 	// AllowSubnets.
 	AllowSubnets []string
 
+	// AllowDomains specifies a list of domain patterns for which all TCP and
+	// UDP ports are allowed. As with AllowSubnets, this list is consulted if
+	// a port is disallowed by the AllowTCPPorts or AllowUDPPorts
+	// configuration. A pattern is either an exact domain, such as
+	// "example.com", or a wildcard, such as "*.example.com", which matches
+	// all subdomains of example.com but not example.com itself. Matching is
+	// case-insensitive.
+	//
+	// Port forward domains are the domains sent by the client in TCP port
+	// forward requests and, for packet tunnel flows, the domain most
+	// recently resolved to the flow destination IP address via transparent
+	// DNS. UDP port forwards, and flows to IP addresses not resolved via
+	// transparent DNS, have no domain and never match.
+	AllowDomains []string
+
+	// DisallowDomains specifies a list of domain patterns, in the same
+	// format as AllowDomains, which are not permitted for port forwarding.
+	// DisallowDomains takes priority over all other allow rules.
+	//
+	// Limitation: a client may bypass DisallowDomains by connecting by IP
+	// address, or by using its own DNS resolver in packet tunnel mode.
+	DisallowDomains []string
+
+	// PreferIPv6 specifies that, when a TCP port forward hostname resolves to
+	// both IPv4 and IPv6 addresses, IPv6 addresses are dialed first. By
+	// default, IPv4 is preferred in case the host has limited IPv6 routing.
+	PreferIPv6 *bool
+
+	// DataQuota specifies a cumulative data transfer quota which persists
+	// across tunnels and, when configured with DataQuotaStateFilename,
+	// across psiphond restarts. See DataQuota for more details. When
+	// omitted, no quota applies.
+	DataQuota *DataQuota
+
 	allowTCPPortsLookup    map[int]bool
 	allowUDPPortsLookup    map[int]bool
 	disallowTCPPortsLookup map[int]bool
@@ -358,6 +414,21 @@ func (set *TrafficRulesSet) Validate() error {
 			}
 		}
 
+		for _, domain := range append(
+			append([]string(nil), rules.AllowDomains...), rules.DisallowDomains...) {
+
+			if !isValidDomainPattern(domain) {
+				return errors.Tracef("invalid domain: %s", domain)
+			}
+		}
+
+		if rules.DataQuota != nil {
+			err := rules.DataQuota.Validate()
+			if err != nil {
+				return errors.Tracef("invalid data quota: %s", err)
+			}
+		}
+
 		return nil
 	}
 
@@ -381,7 +452,36 @@ func (set *TrafficRulesSet) Validate() error {
 			}
 		}
 
-		err := validateTrafficRules(&filteredRule.Rules)
+		for _, hour := range filteredRule.Filter.UTCHours {
+			if hour < 0 || hour > 23 {
+				return errors.Tracef("invalid hour: %d", hour)
+			}
+		}
+
+		for _, weekday := range filteredRule.Filter.Weekdays {
+			if !common.Contains(trafficRulesWeekdays, weekday) {
+				return errors.Tracef("invalid weekday: %s", weekday)
+			}
+		}
+
+		var startDate, endDate time.Time
+		if filteredRule.Filter.StartDate != "" {
+			startDate, err = time.Parse(trafficRulesDateFormat, filteredRule.Filter.StartDate)
+			if err != nil {
+				return errors.Tracef("invalid start date: %s", err)
+			}
+		}
+		if filteredRule.Filter.EndDate != "" {
+			endDate, err = time.Parse(trafficRulesDateFormat, filteredRule.Filter.EndDate)
+			if err != nil {
+				return errors.Tracef("invalid end date: %s", err)
+			}
+		}
+		if !startDate.IsZero() && !endDate.IsZero() && endDate.Before(startDate) {
+			return errors.TraceNew("end date is before start date")
+		}
+
+		err = validateTrafficRules(&filteredRule.Rules)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -390,6 +490,18 @@ func (set *TrafficRulesSet) Validate() error {
 	return nil
 }
 
+const trafficRulesDateFormat = "2006-01-02"
+
+var trafficRulesWeekdays = []string{
+	time.Sunday.String(),
+	time.Monday.String(),
+	time.Tuesday.String(),
+	time.Wednesday.String(),
+	time.Thursday.String(),
+	time.Friday.String(),
+	time.Saturday.String(),
+}
+
 const stringLookupThreshold = 5
 const intLookupThreshold = 10
 
@@ -451,18 +563,80 @@ func (set *TrafficRulesSet) initLookups() {
 				filter.cityLookup[city] = true
 			}
 		}
+
+		// Note: ignoring errors as config has been validated.
+
+		if filter.StartDate != "" {
+			filter.startTime, _ = time.Parse(trafficRulesDateFormat, filter.StartDate)
+		}
+
+		if filter.EndDate != "" {
+			endDate, _ := time.Parse(trafficRulesDateFormat, filter.EndDate)
+			filter.endTime = endDate.Add(24 * time.Hour)
+		}
 	}
 
 	initTrafficRulesLookups(&set.DefaultRules)
 
+	set.hasTimeFilters = false
+
 	for i := range set.FilteredRules {
 		initTrafficRulesFilterLookups(&set.FilteredRules[i].Filter)
 		initTrafficRulesLookups(&set.FilteredRules[i].Rules)
+
+		if set.FilteredRules[i].Filter.hasTimeFilter() {
+			set.hasTimeFilters = true
+		}
 	}
 
 	// TODO: add lookups for MeekRateLimiter?
 }
 
+// hasTimeFilter returns true when the filter has any time window criteria.
+func (filter *TrafficRulesFilter) hasTimeFilter() bool {
+	return len(filter.UTCHours) > 0 ||
+		len(filter.Weekdays) > 0 ||
+		filter.StartDate != "" ||
+		filter.EndDate != ""
+}
+
+// matchesTime returns true when the specified time is within the filter's
+// time window criteria.
+func (filter *TrafficRulesFilter) matchesTime(now time.Time) bool {
+
+	now = now.UTC()
+
+	if len(filter.UTCHours) > 0 && !common.ContainsInt(filter.UTCHours, now.Hour()) {
+		return false
+	}
+
+	if len(filter.Weekdays) > 0 && !common.Contains(filter.Weekdays, now.Weekday().String()) {
+		return false
+	}
+
+	if !filter.startTime.IsZero() && now.Before(filter.startTime) {
+		return false
+	}
+
+	if !filter.endTime.IsZero() && !now.Before(filter.endTime) {
+		return false
+	}
+
+	return true
+}
+
+// HasTimeFilters returns true when any FilteredRules filter has time window
+// criteria, in which case the selected traffic rules may change over time
+// and should be re-selected at each UTC hour boundary. All time window
+// criteria start and end on UTC hour boundaries.
+func (set *TrafficRulesSet) HasTimeFilters() bool {
+
+	set.ReloadableFile.RLock()
+	defer set.ReloadableFile.RUnlock()
+
+	return set.hasTimeFilters
+}
+
 // GetTrafficRules determines the traffic rules for a client based on its attributes.
 // For the return value TrafficRules, all pointer and slice fields are initialized,
 // so nil checks are not required. The caller must not modify the returned TrafficRules.
@@ -472,6 +646,22 @@ func (set *TrafficRulesSet) GetTrafficRules(
 	geoIPData GeoIPData,
 	state handshakeState) TrafficRules {
 
+	trafficRules, _ := set.selectTrafficRules(
+		time.Now(), isFirstTunnelInSession, tunnelProtocol, geoIPData, state)
+
+	return trafficRules
+}
+
+// selectTrafficRules is GetTrafficRules with a specified current time for
+// evaluating time window filters. selectTrafficRules also returns the index
+// of the selected FilteredRules, or -1 when only DefaultRules apply.
+func (set *TrafficRulesSet) selectTrafficRules(
+	now time.Time,
+	isFirstTunnelInSession bool,
+	tunnelProtocol string,
+	geoIPData GeoIPData,
+	state handshakeState) (TrafficRules, int) {
+
 	set.ReloadableFile.RLock()
 	defer set.ReloadableFile.RUnlock()
 
@@ -563,8 +753,22 @@ func (set *TrafficRulesSet) GetTrafficRules(
 		trafficRules.AllowSubnets = make([]string, 0)
 	}
 
+	if trafficRules.AllowDomains == nil {
+		trafficRules.AllowDomains = make([]string, 0)
+	}
+
+	if trafficRules.DisallowDomains == nil {
+		trafficRules.DisallowDomains = make([]string, 0)
+	}
+
+	if trafficRules.PreferIPv6 == nil {
+		trafficRules.PreferIPv6 = new(bool)
+	}
+
+	selectedIndex := -1
+
 	// TODO: faster lookup?
-	for _, filteredRules := range set.FilteredRules {
+	for i, filteredRules := range set.FilteredRules {
 
 		log.WithTraceFields(LogFields{"filter": filteredRules.Filter}).Debug("filter check")
 
@@ -660,6 +864,10 @@ func (set *TrafficRulesSet) GetTrafficRules(
 			}
 		}
 
+		if !filteredRules.Filter.matchesTime(now) {
+			continue
+		}
+
 		log.WithTraceFields(LogFields{"filter": filteredRules.Filter}).Debug("filter match")
 
 		// This is the first match. Override defaults using provided fields from selected rules, and return result.
@@ -736,6 +944,24 @@ func (set *TrafficRulesSet) GetTrafficRules(
 			trafficRules.AllowSubnets = filteredRules.Rules.AllowSubnets
 		}
 
+		if filteredRules.Rules.AllowDomains != nil {
+			trafficRules.AllowDomains = filteredRules.Rules.AllowDomains
+		}
+
+		if filteredRules.Rules.DisallowDomains != nil {
+			trafficRules.DisallowDomains = filteredRules.Rules.DisallowDomains
+		}
+
+		if filteredRules.Rules.PreferIPv6 != nil {
+			trafficRules.PreferIPv6 = filteredRules.Rules.PreferIPv6
+		}
+
+		if filteredRules.Rules.DataQuota != nil {
+			trafficRules.DataQuota = filteredRules.Rules.DataQuota
+		}
+
+		selectedIndex = i
+
 		break
 	}
 
@@ -746,10 +972,14 @@ func (set *TrafficRulesSet) GetTrafficRules(
 
 	log.WithTraceFields(LogFields{"trafficRules": trafficRules}).Debug("selected traffic rules")
 
-	return trafficRules
+	return trafficRules, selectedIndex
 }
 
-func (rules *TrafficRules) AllowTCPPort(remoteIP net.IP, port int) bool {
+func (rules *TrafficRules) AllowTCPPort(domain string, remoteIP net.IP, port int) bool {
+
+	if matchDomain(rules.DisallowDomains, domain) {
+		return false
+	}
 
 	if len(rules.DisallowTCPPorts) > 0 {
 		if rules.disallowTCPPortsLookup != nil {
@@ -781,10 +1011,14 @@ func (rules *TrafficRules) AllowTCPPort(remoteIP net.IP, port int) bool {
 		}
 	}
 
-	return rules.allowSubnet(remoteIP)
+	return rules.allowSubnet(remoteIP) || matchDomain(rules.AllowDomains, domain)
 }
 
-func (rules *TrafficRules) AllowUDPPort(remoteIP net.IP, port int) bool {
+func (rules *TrafficRules) AllowUDPPort(domain string, remoteIP net.IP, port int) bool {
+
+	if matchDomain(rules.DisallowDomains, domain) {
+		return false
+	}
 
 	if len(rules.DisallowUDPPorts) > 0 {
 		if rules.disallowUDPPortsLookup != nil {
@@ -816,7 +1050,7 @@ func (rules *TrafficRules) AllowUDPPort(remoteIP net.IP, port int) bool {
 		}
 	}
 
-	return rules.allowSubnet(remoteIP)
+	return rules.allowSubnet(remoteIP) || matchDomain(rules.AllowDomains, domain)
 }
 
 func (rules *TrafficRules) allowSubnet(remoteIP net.IP) bool {
@@ -832,6 +1066,49 @@ func (rules *TrafficRules) allowSubnet(remoteIP net.IP) bool {
 	return false
 }
 
+// isValidDomainPattern checks that a traffic rules domain pattern is an
+// exact domain or a "*." wildcard prefix followed by a domain.
+func isValidDomainPattern(pattern string) bool {
+
+	pattern = strings.TrimPrefix(pattern, "*.")
+
+	if pattern == "" || len(pattern) > 253 {
+		return false
+	}
+
+	for _, label := range strings.Split(pattern, ".") {
+		if label == "" || len(label) > 63 || strings.Contains(label, "*") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchDomain returns true when the domain matches any of the domain
+// patterns. An empty domain matches no pattern.
+func matchDomain(patterns []string, domain string) bool {
+
+	if domain == "" || len(patterns) == 0 {
+		return false
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(domain, pattern[1:]) {
+				return true
+			}
+		} else if domain == pattern {
+			return true
+		}
+	}
+
+	return false
+}
+
 // GetMeekRateLimiterConfig gets a snapshot of the meek rate limiter
 // configuration values.
 func (set *TrafficRulesSet) GetMeekRateLimiterConfig() (int, int, []string, []string, []string, int, int) {
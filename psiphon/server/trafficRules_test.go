@@ -0,0 +1,249 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrafficRulesTimeFilters(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphond-traffic-rules-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+	trafficRulesJSON := `
+    {
+        "DefaultRules" : {
+            "RateLimits" : {"ReadBytesPerSecond" : 1}
+        },
+        "FilteredRules" : [
+            {
+                "Filter" : {"UTCHours" : [22, 23], "Weekdays" : ["Saturday", "Sunday"]},
+                "Rules" : {"RateLimits" : {"ReadBytesPerSecond" : 2}}
+            },
+            {
+                "Filter" : {"StartDate" : "2020-06-01", "EndDate" : "2020-06-30"},
+                "Rules" : {"RateLimits" : {"ReadBytesPerSecond" : 3}}
+            }
+        ]
+    }
+    `
+
+	err = ioutil.WriteFile(trafficRulesFilename, []byte(trafficRulesJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	set, err := NewTrafficRulesSet(trafficRulesFilename)
+	if err != nil {
+		t.Fatalf("NewTrafficRulesSet failed: %s", err)
+	}
+
+	if !set.HasTimeFilters() {
+		t.Fatalf("unexpected HasTimeFilters result")
+	}
+
+	testCases := []struct {
+		now                string
+		expectedIndex      int
+		expectedReadLimits int64
+	}{
+		// Saturday
+		{"2020-05-30T21:59:59Z", -1, 1},
+		{"2020-05-30T22:00:00Z", 0, 2},
+		{"2020-05-30T23:59:59Z", 0, 2},
+		// Sunday in UTC; Saturday in UTC-5
+		{"2020-05-31T18:30:00-05:00", 0, 2},
+		// Monday
+		{"2020-06-01T00:00:00Z", 1, 3},
+		{"2020-06-01T22:00:00Z", 1, 3},
+		// Saturday in June: first match applies
+		{"2020-06-06T22:00:00Z", 0, 2},
+		{"2020-06-06T21:00:00Z", 1, 3},
+		{"2020-06-30T23:59:59Z", 1, 3},
+		// Wednesday
+		{"2020-07-01T00:00:00Z", -1, 1},
+	}
+
+	for _, testCase := range testCases {
+
+		now, err := time.Parse(time.RFC3339, testCase.now)
+		if err != nil {
+			t.Fatalf("time.Parse failed: %s", err)
+		}
+
+		trafficRules, index := set.selectTrafficRules(
+			now, true, "OSSH", GeoIPData{}, handshakeState{})
+
+		if index != testCase.expectedIndex ||
+			*trafficRules.RateLimits.ReadBytesPerSecond != testCase.expectedReadLimits {
+
+			t.Fatalf("unexpected traffic rules for %s: %d %d",
+				testCase.now, index, *trafficRules.RateLimits.ReadBytesPerSecond)
+		}
+	}
+
+	// Test: invalid time filters are rejected
+
+	invalidFilters := []string{
+		`{"UTCHours" : [24]}`,
+		`{"Weekdays" : ["monday"]}`,
+		`{"StartDate" : "2020-06-31"}`,
+		`{"StartDate" : "2020-06-02", "EndDate" : "2020-06-01"}`,
+	}
+
+	for _, invalidFilter := range invalidFilters {
+
+		err = ioutil.WriteFile(
+			trafficRulesFilename,
+			[]byte(`{"FilteredRules" : [{"Filter" : `+invalidFilter+`}]}`),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		_, err = set.Reload()
+		if err == nil {
+			t.Fatalf("unexpected Reload success: %s", invalidFilter)
+		}
+	}
+
+	// Test: time filters are cleared on reload
+
+	err = ioutil.WriteFile(
+		trafficRulesFilename,
+		[]byte(`{"FilteredRules" : [{"Filter" : {"Regions" : ["US"]}}]}`),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	_, err = set.Reload()
+	if err != nil {
+		t.Fatalf("Reload failed: %s", err)
+	}
+
+	if set.HasTimeFilters() {
+		t.Fatalf("unexpected HasTimeFilters result")
+	}
+}
+
+func TestTrafficRulesDomains(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphond-traffic-rules-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	trafficRulesFilename := filepath.Join(testDataDirName, "traffic_rules.json")
+
+	trafficRulesJSON := `
+    {
+        "DefaultRules" : {
+            "AllowTCPPorts" : [443],
+            "AllowUDPPorts" : [53],
+            "AllowSubnets" : ["192.0.2.0/24"],
+            "AllowDomains" : ["allowed.example.com", "*.allowed.example.org"],
+            "DisallowDomains" : ["*.Disallowed.example.com"]
+        }
+    }
+    `
+
+	err = ioutil.WriteFile(trafficRulesFilename, []byte(trafficRulesJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	set, err := NewTrafficRulesSet(trafficRulesFilename)
+	if err != nil {
+		t.Fatalf("NewTrafficRulesSet failed: %s", err)
+	}
+
+	trafficRules := set.GetTrafficRules(true, "OSSH", GeoIPData{}, handshakeState{})
+
+	IP := net.ParseIP("198.51.100.1")
+	subnetIP := net.ParseIP("192.0.2.1")
+
+	testCases := []struct {
+		domain   string
+		IP       net.IP
+		port     int
+		expected bool
+	}{
+		{"", IP, 443, true},
+		{"", IP, 80, false},
+		{"allowed.example.com", IP, 80, true},
+		{"ALLOWED.example.com.", IP, 80, true},
+		{"www.allowed.example.com", IP, 80, false},
+		{"allowed.example.org", IP, 80, false},
+		{"www.allowed.example.org", IP, 80, true},
+		{"www.disallowed.example.com", IP, 443, false},
+		{"www.disallowed.example.com", subnetIP, 80, false},
+		{"disallowed.example.com", IP, 443, true},
+		{"", subnetIP, 80, true},
+	}
+
+	for _, testCase := range testCases {
+		if trafficRules.AllowTCPPort(testCase.domain, testCase.IP, testCase.port) != testCase.expected {
+			t.Fatalf("unexpected AllowTCPPort result: %+v", testCase)
+		}
+	}
+
+	if trafficRules.AllowUDPPort("www.disallowed.example.com", IP, 53) ||
+		!trafficRules.AllowUDPPort("allowed.example.com", IP, 123) {
+		t.Fatalf("unexpected AllowUDPPort result")
+	}
+
+	// Test: invalid domain patterns are rejected
+
+	invalidDomains := []string{
+		`""`,
+		`"*"`,
+		`"www.*.example.com"`,
+		`"example..com"`,
+	}
+
+	for _, invalidDomain := range invalidDomains {
+
+		err = ioutil.WriteFile(
+			trafficRulesFilename,
+			[]byte(`{"DefaultRules" : {"DisallowDomains" : [`+invalidDomain+`]}}`),
+			0600)
+		if err != nil {
+			t.Fatalf("WriteFile failed: %s", err)
+		}
+
+		_, err = set.Reload()
+		if err == nil {
+			t.Fatalf("unexpected Reload success: %s", invalidDomain)
+		}
+	}
+}
@@ -40,16 +40,17 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/accesscontrol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/datagram"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/fragmentor"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/marionette"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/osl"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/resumption"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tapdance"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/transports"
+	_ "github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/transports/builtin"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
 	"github.com/marusama/semaphore"
 	cache "github.com/patrickmn/go-cache"
@@ -67,10 +68,13 @@ const (
 	SSH_SEND_OSL_INITIAL_RETRY_DELAY      = 30 * time.Second
 	SSH_SEND_OSL_RETRY_FACTOR             = 2
 	OSL_SESSION_CACHE_TTL                 = 5 * time.Minute
+	TUNNEL_RESUMPTION_TIMEOUT             = 45 * time.Second
 	MAX_AUTHORIZATIONS                    = 16
 	PRE_HANDSHAKE_RANDOM_STREAM_MAX_COUNT = 1
 	RANDOM_STREAM_MAX_BYTES               = 10485760
 	ALERT_REQUEST_QUEUE_BUFFER_SIZE       = 16
+	MAX_TCP_PORT_FORWARD_DIAL_ATTEMPTS    = 3
+	MAX_DATAGRAM_CHANNELS                 = 4
 )
 
 // TunnelServer is the main server that accepts Psiphon client
@@ -144,44 +148,108 @@ func (server *TunnelServer) Run() error {
 
 	var listeners []*sshListener
 
-	for tunnelProtocol, listenPort := range support.Config.TunnelProtocolPorts {
+	listenIPAddresses := []string{support.Config.ServerIPAddress}
+	if support.Config.ServerIPv6Address != "" {
+		listenIPAddresses = append(listenIPAddresses, support.Config.ServerIPv6Address)
+	}
 
-		localAddress := fmt.Sprintf(
-			"%s:%d", support.Config.ServerIPAddress, listenPort)
+	for tunnelProtocol, listenPort := range support.Config.TunnelProtocolPorts {
+		for _, listenIPAddress := range listenIPAddresses {
 
-		var listener net.Listener
-		var BPFProgramName string
-		var err error
+			isIPv6 := listenIPAddress == support.Config.ServerIPv6Address
 
-		if protocol.TunnelProtocolUsesFrontedMeekQUIC(tunnelProtocol) {
+			localAddress := net.JoinHostPort(
+				listenIPAddress, strconv.Itoa(listenPort))
 
-			// For FRONTED-MEEK-QUIC-OSSH, no listener implemented. The edge-to-server
-			// hop uses HTTPS and the client tunnel protocol is distinguished using
-			// protocol.MeekCookieData.ClientTunnelProtocol.
-			continue
+			if isIPv6 && !protocol.TunnelProtocolSupportsServerIPv6Address(tunnelProtocol) {
+				log.WithTraceFields(
+					LogFields{
+						"localAddress":   localAddress,
+						"tunnelProtocol": tunnelProtocol,
+					}).Info("skipping IPv6 listener")
+				continue
+			}
 
-		} else if protocol.TunnelProtocolUsesQUIC(tunnelProtocol) {
+			transport := transports.Get(tunnelProtocol)
+			if transport == nil {
+				for _, existingListener := range listeners {
+					existingListener.Listener.Close()
+				}
+				return errors.Tracef("no transport for tunnel protocol: %s", tunnelProtocol)
+			}
 
-			listener, err = quic.Listen(
-				CommonLogger(log),
-				localAddress,
-				support.Config.ObfuscatedSSHKey)
+			var BPFProgramName string
+
+			listener, err := transport.Listen(
+				&transports.ListenArgs{
+					TunnelProtocol:   tunnelProtocol,
+					ListenIPAddress:  listenIPAddress,
+					ListenAddress:    localAddress,
+					ObfuscatedKey:    support.Config.ObfuscatedSSHKey,
+					MarionetteFormat: support.Config.MarionetteFormat,
+					ListenTCP: func() (net.Listener, error) {
+						listener, programName, err := newTCPListenerWithBPF(support, localAddress)
+						if err != nil {
+							return nil, errors.Trace(err)
+						}
+						BPFProgramName = programName
+						return listener, nil
+					},
+					Logger: CommonLogger(log),
+				})
 
-		} else if protocol.TunnelProtocolUsesMarionette(tunnelProtocol) {
+			if err != nil {
+				for _, existingListener := range listeners {
+					existingListener.Listener.Close()
+				}
+				return errors.Trace(err)
+			}
 
-			listener, err = marionette.Listen(
-				support.Config.ServerIPAddress,
-				support.Config.MarionetteFormat)
+			if listener == nil {
 
-		} else {
+				// The tunnel protocol has no listener of its own; for example,
+				// FRONTED-MEEK-QUIC-OSSH.
+				continue
+			}
 
-			listener, BPFProgramName, err = newTCPListenerWithBPF(support, localAddress)
+			tacticsListener := tactics.NewListener(
+				listener,
+				support.TacticsServer,
+				tunnelProtocol,
+				func(IPAddress string) common.GeoIPData {
+					return common.GeoIPData(support.GeoIPService.Lookup(IPAddress))
+				})
 
-			if protocol.TunnelProtocolUsesTapdance(tunnelProtocol) {
-				listener, err = tapdance.Listen(listener)
-			}
+			log.WithTraceFields(
+				LogFields{
+					"localAddress":   localAddress,
+					"tunnelProtocol": tunnelProtocol,
+					"BPFProgramName": BPFProgramName,
+				}).Info("listening")
+
+			listeners = append(
+				listeners,
+				&sshListener{
+					Listener:       tacticsListener,
+					localAddress:   localAddress,
+					port:           listenPort,
+					tunnelProtocol: tunnelProtocol,
+					BPFProgramName: BPFProgramName,
+				})
 		}
+	}
 
+	// The datagram channel listener receives UDP datagrams for all datagram
+	// channel sessions, which clients request through their tunnels. Only
+	// ServerIPAddress is bound; see the DatagramChannelPort comment.
+
+	if support.Config.DatagramChannelPort != 0 {
+
+		localAddress := net.JoinHostPort(
+			support.Config.ServerIPAddress,
+			strconv.Itoa(support.Config.DatagramChannelPort))
+
+		datagramListener, err := listenDatagramChannel(localAddress)
 		if err != nil {
 			for _, existingListener := range listeners {
 				existingListener.Listener.Close()
@@ -189,30 +257,17 @@ func (server *TunnelServer) Run() error {
 			return errors.Trace(err)
 		}
 
-		tacticsListener := tactics.NewListener(
-			listener,
-			support.TacticsServer,
-			tunnelProtocol,
-			func(IPAddress string) common.GeoIPData {
-				return common.GeoIPData(support.GeoIPService.Lookup(IPAddress))
-			})
-
 		log.WithTraceFields(
-			LogFields{
-				"localAddress":   localAddress,
-				"tunnelProtocol": tunnelProtocol,
-				"BPFProgramName": BPFProgramName,
-			}).Info("listening")
-
-		listeners = append(
-			listeners,
-			&sshListener{
-				Listener:       tacticsListener,
-				localAddress:   localAddress,
-				port:           listenPort,
-				tunnelProtocol: tunnelProtocol,
-				BPFProgramName: BPFProgramName,
-			})
+			LogFields{"localAddress": localAddress}).Info("listening for datagram channels")
+
+		server.sshServer.datagramListener = datagramListener
+	}
+
+	// In TorORPortForwarding mode, report the transport method to Tor once
+	// all listeners are bound.
+
+	if support.TorPluggableTransport != nil {
+		support.TorPluggableTransport.ReportMethods()
 	}
 
 	for _, listener := range listeners {
@@ -251,6 +306,10 @@ func (server *TunnelServer) Run() error {
 	server.sshServer.stopClients()
 	server.runWaitGroup.Wait()
 
+	if server.sshServer.datagramListener != nil {
+		server.sshServer.datagramListener.Close()
+	}
+
 	log.WithTrace().Info("stopped")
 
 	return err
@@ -261,7 +320,15 @@ func (server *TunnelServer) Run() error {
 // include current connected client count, total number of current port
 // forwards.
 func (server *TunnelServer) GetLoadStats() (ProtocolStats, RegionStats) {
-	return server.sshServer.getLoadStats()
+	return server.sshServer.getLoadStats(true)
+}
+
+// GetMetrics returns a snapshot of tunnel server state for the metrics
+// endpoint. Unlike GetLoadStats, GetMetrics doesn't reset any periodic
+// counters, so it may be called at any frequency without affecting load
+// logging.
+func (server *TunnelServer) GetMetrics() *TunnelServerMetrics {
+	return server.sshServer.getMetrics()
 }
 
 // GetEstablishedClientCount returns the number of currently established
@@ -277,6 +344,21 @@ func (server *TunnelServer) ResetAllClientTrafficRules() {
 	server.sshServer.resetAllClientTrafficRules()
 }
 
+// ReselectAllClientTrafficRules re-selects established client traffic rules
+// using the current time. Unlike ResetAllClientTrafficRules, new rules are
+// applied, and throttling state is reset, only for clients whose selected
+// rules have changed; for example, when a traffic rules time window filter
+// starts or ends.
+func (server *TunnelServer) ReselectAllClientTrafficRules() {
+	server.sshServer.reselectAllClientTrafficRules()
+}
+
+// UpdateAllClientDataQuotas applies recent data transfer to all established
+// client data quotas, and takes quota actions as required.
+func (server *TunnelServer) UpdateAllClientDataQuotas() {
+	server.sshServer.updateAllClientDataQuotas()
+}
+
 // ResetAllClientOSLConfigs resets all established client OSL state to use
 // the latest OSL config. Any existing OSL state is lost, including partial
 // progress towards SLOKs.
@@ -354,6 +436,9 @@ type sshServer struct {
 	lastAuthLog                  int64
 	authFailedCount              int64
 	establishLimitedCount        int64
+	totalEstablishLimitedCount   int64
+	sshHandshakesInProgress      int64
+	sshHandshakeAcquireFailed    int64
 	support                      *SupportServices
 	establishTunnels             int32
 	concurrentSSHHandshakes      semaphore.Semaphore
@@ -368,6 +453,11 @@ type sshServer struct {
 	authorizationSessionIDsMutex sync.Mutex
 	authorizationSessionIDs      map[string]string
 	obfuscatorSeedHistory        *obfuscator.SeedHistory
+	meekServersMutex             sync.Mutex
+	meekServers                  []*MeekServer
+	portForwardMetrics           *portForwardMetrics
+	resumptionSessions           *resumption.Sessions
+	datagramListener             *datagram.Listener
 }
 
 func newSSHServer(
@@ -414,6 +504,8 @@ func newSSHServer(
 		oslSessionCache:         oslSessionCache,
 		authorizationSessionIDs: make(map[string]string),
 		obfuscatorSeedHistory:   obfuscator.NewSeedHistory(nil),
+		portForwardMetrics:      newPortForwardMetrics(),
+		resumptionSessions:      resumption.NewSessions(TUNNEL_RESUMPTION_TIMEOUT),
 	}, nil
 }
 
@@ -440,6 +532,7 @@ func (sshServer *sshServer) checkEstablishTunnels() bool {
 	establishTunnels := atomic.LoadInt32(&sshServer.establishTunnels) == 1
 	if !establishTunnels {
 		atomic.AddInt64(&sshServer.establishLimitedCount, 1)
+		atomic.AddInt64(&sshServer.totalEstablishLimitedCount, 1)
 	}
 	return establishTunnels
 }
@@ -495,6 +588,13 @@ func (sshServer *sshServer) runListener(sshListener *sshListener, listenerError
 			}
 		}
 
+		// Meek servers accept WebSocket upgrades on any meek protocol port,
+		// so the listener protocol doesn't distinguish WebSocket tunnels.
+		// The meek server determines the WebSocket protocol.
+		if webSocketConn, ok := clientConn.(*meekWebSocketConn); ok {
+			tunnelProtocol = webSocketConn.tunnelProtocol
+		}
+
 		// sshListener.tunnelProtocol indictes the tunnel protocol run by the
 		// listener. For direct protocols, this is also the client tunnel protocol.
 		// For fronted protocols, the client may use a different protocol to connect
@@ -536,6 +636,10 @@ func (sshServer *sshServer) runListener(sshListener *sshListener, listenerError
 			sshServer.shutdownBroadcast)
 
 		if err == nil {
+			sshServer.meekServersMutex.Lock()
+			sshServer.meekServers = append(sshServer.meekServers, meekServer)
+			sshServer.meekServersMutex.Unlock()
+
 			err = meekServer.Run()
 		}
 
@@ -714,7 +818,12 @@ func (sshServer *sshServer) unregisterEstablishedClient(client *sshClient) {
 type ProtocolStats map[string]map[string]int64
 type RegionStats map[string]map[string]map[string]int64
 
-func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
+// getLoadStats returns load stats by protocol and region. The quality
+// metrics counters in the stats are the counts since the last call with
+// resetQualityMetrics set; when resetQualityMetrics is set, these counters
+// are reset to zero.
+func (sshServer *sshServer) getLoadStats(
+	resetQualityMetrics bool) (ProtocolStats, RegionStats) {
 
 	sshServer.clientsMutex.Lock()
 	defer sshServer.clientsMutex.Unlock()
@@ -839,23 +948,9 @@ func (sshServer *sshServer) getLoadStats() (ProtocolStats, RegionStats) {
 				int64(client.qualityMetrics.TCPIPv6PortForwardFailedDuration / time.Millisecond)
 		}
 
-		client.qualityMetrics.TCPPortForwardDialedCount = 0
-		client.qualityMetrics.TCPPortForwardDialedDuration = 0
-		client.qualityMetrics.TCPPortForwardFailedCount = 0
-		client.qualityMetrics.TCPPortForwardFailedDuration = 0
-		client.qualityMetrics.TCPPortForwardRejectedDialingLimitCount = 0
-		client.qualityMetrics.TCPPortForwardRejectedDisallowedCount = 0
-		client.qualityMetrics.UDPPortForwardRejectedDisallowedCount = 0
-
-		client.qualityMetrics.TCPIPv4PortForwardDialedCount = 0
-		client.qualityMetrics.TCPIPv4PortForwardDialedDuration = 0
-		client.qualityMetrics.TCPIPv4PortForwardFailedCount = 0
-		client.qualityMetrics.TCPIPv4PortForwardFailedDuration = 0
-
-		client.qualityMetrics.TCPIPv6PortForwardDialedCount = 0
-		client.qualityMetrics.TCPIPv6PortForwardDialedDuration = 0
-		client.qualityMetrics.TCPIPv6PortForwardFailedCount = 0
-		client.qualityMetrics.TCPIPv6PortForwardFailedDuration = 0
+		if resetQualityMetrics {
+			client.qualityMetrics = qualityMetrics{}
+		}
 
 		client.Unlock()
 	}
@@ -884,6 +979,34 @@ func (sshServer *sshServer) resetAllClientTrafficRules() {
 	}
 }
 
+func (sshServer *sshServer) reselectAllClientTrafficRules() {
+
+	sshServer.clientsMutex.Lock()
+	clients := make(map[string]*sshClient)
+	for sessionID, client := range sshServer.clients {
+		clients[sessionID] = client
+	}
+	sshServer.clientsMutex.Unlock()
+
+	for _, client := range clients {
+		client.reselectTrafficRules()
+	}
+}
+
+func (sshServer *sshServer) updateAllClientDataQuotas() {
+
+	sshServer.clientsMutex.Lock()
+	clients := make(map[string]*sshClient)
+	for sessionID, client := range sshServer.clients {
+		clients[sessionID] = client
+	}
+	sshServer.clientsMutex.Unlock()
+
+	for _, client := range clients {
+		client.updateDataQuota()
+	}
+}
+
 func (sshServer *sshServer) resetAllClientOSLConfigs() {
 
 	// Flush cached seed state. This has the same effect
@@ -1012,6 +1135,83 @@ func (sshServer *sshServer) stopClients() {
 	}
 }
 
+// adoptResumedConn finds the established client whose tunnel is the
+// resumed session and transfers the activity monitoring, data quota, rate
+// limiting, and metrics of the tunnel to the layers of the new network
+// connection. adoptResumedConn returns false when no established client
+// owns the session, as is the case when the session is resumed before the
+// SSH handshake completes.
+//
+// The resumption preamble, including the session secret, is protected only
+// by the obfuscated SSH layer and isn't bound to the SSH session keys. An
+// adversary that has the server entry obfuscation key and observes the
+// initial connection can resume the session and take over the transport.
+// The SSH layer still prevents reading or modifying tunneled traffic, so
+// the impact is limited to disrupting or redirecting the encrypted stream.
+func (sshServer *sshServer) adoptResumedConn(
+	resumptionConn *resumption.Conn,
+	activityConn *common.ActivityMonitoredConn,
+	dataQuotaConn *dataQuotaConn,
+	throttledConn *common.ThrottledConn,
+	metricsSources []common.MetricsSource) bool {
+
+	if resumptionConn == nil {
+		return false
+	}
+
+	var owner *sshClient
+
+	// sshClient.resumptionConn is set before the client is registered and
+	// isn't modified afterwards.
+	sshServer.clientsMutex.Lock()
+	for _, client := range sshServer.clients {
+		if client.resumptionConn == resumptionConn {
+			owner = client
+			break
+		}
+	}
+	sshServer.clientsMutex.Unlock()
+
+	if owner == nil {
+		return false
+	}
+
+	owner.Lock()
+	defer owner.Unlock()
+
+	// Bytes counted by the previous connection and not yet applied to the
+	// data quota are carried over.
+	if owner.dataQuotaConn != nil {
+		dataQuotaConn.addBytes(owner.dataQuotaConn.takeBytes())
+	}
+	owner.activityConn = activityConn
+	owner.dataQuotaConn = dataQuotaConn
+	owner.throttledConn = throttledConn
+	owner.throttledConn.SetLimits(owner.getRateLimits())
+	owner.metricsSources = metricsSources
+
+	return true
+}
+
+// closeSignalConn is a net.Conn which signals when it's closed.
+type closeSignalConn struct {
+	net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newCloseSignalConn(conn net.Conn) *closeSignalConn {
+	return &closeSignalConn{
+		Conn:   conn,
+		closed: make(chan struct{}),
+	}
+}
+
+func (conn *closeSignalConn) Close() error {
+	conn.closeOnce.Do(func() { close(conn.closed) })
+	return conn.Conn.Close()
+}
+
 func (sshServer *sshServer) handleClient(
 	sshListener *sshListener, tunnelProtocol string, clientConn net.Conn) {
 
@@ -1094,6 +1294,7 @@ func (sshServer *sshServer) handleClient(
 
 		err := sshServer.concurrentSSHHandshakes.Acquire(ctx, 1)
 		if err != nil {
+			atomic.AddInt64(&sshServer.sshHandshakeAcquireFailed, 1)
 			clientConn.Close()
 			// This is a debug log as the only possible error is context timeout.
 			log.WithTraceFields(LogFields{"error": err}).Debug(
@@ -1106,6 +1307,17 @@ func (sshServer *sshServer) handleClient(
 		}
 	}
 
+	// sshHandshakesInProgress is reported in metrics. Handshakes waiting to
+	// acquire the semaphore are not included.
+	atomic.AddInt64(&sshServer.sshHandshakesInProgress, 1)
+	releaseSemaphore := onSSHHandshakeFinished
+	onSSHHandshakeFinished = func() {
+		atomic.AddInt64(&sshServer.sshHandshakesInProgress, -1)
+		if releaseSemaphore != nil {
+			releaseSemaphore()
+		}
+	}
+
 	sshClient := newSshClient(
 		sshServer,
 		sshListener,
@@ -1154,14 +1366,21 @@ type sshClient struct {
 	sshConn                              ssh.Conn
 	activityConn                         *common.ActivityMonitoredConn
 	throttledConn                        *common.ThrottledConn
+	dataQuotaConn                        *dataQuotaConn
+	resumptionConn                       *resumption.Conn
+	tunnelStartTime                      time.Time
+	metricsSources                       []common.MetricsSource
+	dataQuotaExceeded                    bool
 	geoIPData                            GeoIPData
 	sessionID                            string
 	isFirstTunnelInSession               bool
 	supportsServerRequests               bool
 	handshakeState                       handshakeState
-	udpChannel                           ssh.Channel
-	packetTunnelChannel                  ssh.Channel
+	udpChannel                           io.Closer
+	packetTunnelChannel                  io.Closer
+	packetTunnelStack                    *tun.Stack
 	trafficRules                         TrafficRules
+	trafficRulesIndex                    int
 	tcpTrafficState                      trafficState
 	udpTrafficState                      trafficState
 	qualityMetrics                       qualityMetrics
@@ -1176,8 +1395,11 @@ type sshClient struct {
 	stopTimer                            *time.Timer
 	preHandshakeRandomStreamMetrics      randomStreamMetrics
 	postHandshakeRandomStreamMetrics     randomStreamMetrics
+	dnsResolutionMetrics                 dnsResolutionMetrics
 	sendAlertRequests                    chan protocol.AlertRequest
 	sentAlertRequests                    map[protocol.AlertRequest]bool
+	datagramChannels                     map[*datagramChannel]bool
+	datagramChannelThrottle              *datagramChannelThrottle
 }
 
 type trafficState struct {
@@ -1199,6 +1421,15 @@ type randomStreamMetrics struct {
 	sentDownstreamBytes   int
 }
 
+// dnsResolutionMetrics records TCP port forward hostname resolutions, which
+// are reported in the server_tunnel log.
+type dnsResolutionMetrics struct {
+	count         int64
+	cacheHitCount int64
+	failedCount   int64
+	duration      time.Duration
+}
+
 // qualityMetrics records upstream TCP dial attempts and
 // elapsed time. Elapsed time includes the full TCP handshake
 // and, in aggregate, is a measure of the quality of the
@@ -1223,12 +1454,13 @@ type qualityMetrics struct {
 }
 
 type handshakeState struct {
-	completed             bool
-	apiProtocol           string
-	apiParams             common.APIParameters
-	authorizedAccessTypes []string
-	authorizationsRevoked bool
-	expectDomainBytes     bool
+	completed              bool
+	apiProtocol            string
+	apiParams              common.APIParameters
+	activeAuthorizationIDs []string
+	authorizedAccessTypes  []string
+	authorizationsRevoked  bool
+	expectDomainBytes      bool
 }
 
 func newSshClient(
@@ -1305,6 +1537,11 @@ func (sshClient *sshClient) run(
 	}
 	conn = activityConn
 
+	// Count all bytes transferred, for traffic rules data quotas.
+
+	dataQuotaConn := newDataQuotaConn(conn)
+	conn = dataQuotaConn
+
 	// Further wrap the connection in a rate limiting ThrottledConn.
 
 	throttledConn := common.NewThrottledConn(conn, sshClient.rateLimits())
@@ -1317,6 +1554,9 @@ func (sshClient *sshClient) run(
 
 	type sshNewServerConnResult struct {
 		obfuscatedSSHConn *obfuscator.ObfuscatedSSHConn
+		resumptionConn    *resumption.Conn
+		isResumed         bool
+		resumedClosed     <-chan struct{}
 		sshConn           *ssh.ServerConn
 		channels          <-chan ssh.NewChannel
 		requests          <-chan *ssh.Request
@@ -1408,7 +1648,29 @@ func (sshClient *sshClient) run(
 			}
 		}
 
-		if err == nil {
+		// Clients using tunnel resumption obfuscate in stream mode and send
+		// a resumption preamble following the obfuscator seed message. When
+		// the client is resuming an existing session, the connection is
+		// attached to that session and there's no new SSH handshake.
+		if err == nil && protocol.TunnelProtocolSupportsResumption(sshClient.tunnelProtocol) {
+			var isStream bool
+			isStream, err = result.obfuscatedSSHConn.DetectStreamMode(
+				[]byte(resumption.PREAMBLE_MAGIC))
+			if err != nil {
+				err = errors.Trace(err)
+			} else if isStream {
+				signalConn := newCloseSignalConn(conn)
+				conn, result.isResumed, err = sshClient.sshServer.resumptionSessions.Accept(signalConn)
+				if err != nil {
+					err = errors.Trace(err)
+				} else {
+					result.resumptionConn, _ = conn.(*resumption.Conn)
+					result.resumedClosed = signalConn.closed
+				}
+			}
+		}
+
+		if err == nil && !result.isResumed {
 			result.sshConn, result.channels, result.requests, err =
 				ssh.NewServerConn(conn, sshServerConfig)
 			if err != nil {
@@ -1452,10 +1714,55 @@ func (sshClient *sshClient) run(
 	}
 	onSSHHandshakeFinished = nil
 
+	// Some conns report additional metrics. Meek conns report resiliency
+	// metrics and fragmentor.Conns report fragmentor configs.
+	//
+	// Limitation: for meek, GetMetrics from underlying fragmentor.Conn(s)
+	// should be called in order to log fragmentor metrics for meek sessions.
+
+	var metricsSources []common.MetricsSource
+	if metricsSource, ok := baseConn.(common.MetricsSource); ok {
+		metricsSources = append(metricsSources, metricsSource)
+	}
+	if result.obfuscatedSSHConn != nil {
+		metricsSources = append(metricsSources, result.obfuscatedSSHConn)
+	}
+
+	if result.isResumed {
+
+		// The connection now carries the existing tunnel of another
+		// sshClient, which adopts the activity monitoring, data quota,
+		// throttling, and metrics layers of this connection. This sshClient
+		// doesn't run a tunnel, but remains running until the connection
+		// is closed, when it's replaced or the tunnel stops, so that the
+		// connection is included in accepted client counts.
+
+		if !sshClient.sshServer.adoptResumedConn(
+			result.resumptionConn,
+			activityConn,
+			dataQuotaConn,
+			throttledConn,
+			metricsSources) {
+
+			log.WithTrace().Debug("resumed tunnel not established")
+		}
+
+		select {
+		case <-result.resumedClosed:
+		case <-sshClient.sshServer.shutdownBroadcast:
+			conn.Close()
+		}
+		return
+	}
+
 	sshClient.Lock()
 	sshClient.sshConn = result.sshConn
 	sshClient.activityConn = activityConn
 	sshClient.throttledConn = throttledConn
+	sshClient.dataQuotaConn = dataQuotaConn
+	sshClient.resumptionConn = result.resumptionConn
+	sshClient.tunnelStartTime = activityConn.GetStartTime()
+	sshClient.metricsSources = metricsSources
 	sshClient.Unlock()
 
 	if !sshClient.sshServer.registerEstablishedClient(sshClient) {
@@ -1471,21 +1778,20 @@ func (sshClient *sshClient) run(
 
 	sshClient.sshServer.unregisterEstablishedClient(sshClient)
 
-	// Some conns report additional metrics. Meek conns report resiliency
-	// metrics and fragmentor.Conns report fragmentor configs.
-	//
-	// Limitation: for meek, GetMetrics from underlying fragmentor.Conn(s)
-	// should be called in order to log fragmentor metrics for meek sessions.
+	// Record any data quota usage since the last periodic update.
+
+	sshClient.updateDataQuota()
+
+	// When the tunnel was resumed, metrics are reported by the layers of the
+	// most recent connection.
 
+	sshClient.Lock()
 	var additionalMetrics []LogFields
-	if metricsSource, ok := baseConn.(common.MetricsSource); ok {
+	for _, metricsSource := range sshClient.metricsSources {
 		additionalMetrics = append(
 			additionalMetrics, LogFields(metricsSource.GetMetrics()))
 	}
-	if result.obfuscatedSSHConn != nil {
-		additionalMetrics = append(
-			additionalMetrics, LogFields(result.obfuscatedSSHConn.GetMetrics()))
-	}
+	sshClient.Unlock()
 
 	sshClient.logTunnel(additionalMetrics)
 
@@ -1664,7 +1970,7 @@ func (sshClient *sshClient) runTunnel(
 	waitGroup.Add(1)
 	go func() {
 		defer waitGroup.Done()
-		sshClient.handleSSHRequests(requests)
+		sshClient.handleSSHRequests(waitGroup, requests)
 	}()
 
 	// Start request senders
@@ -1710,7 +2016,7 @@ func (sshClient *sshClient) runTunnel(
 		case protocol.RANDOM_STREAM_CHANNEL_TYPE:
 			sshClient.handleNewRandomStreamChannel(waitGroup, newChannel)
 		case protocol.PACKET_TUNNEL_CHANNEL_TYPE:
-			sshClient.handleNewPacketTunnelChannel(waitGroup, newChannel)
+			sshClient.handleNewPacketTunnelChannel(waitGroup, newChannel, newTCPPortForwards)
 		case "direct-tcpip":
 			sshClient.handleNewTCPPortForwardChannel(waitGroup, newChannel, newTCPPortForwards)
 		default:
@@ -1722,13 +2028,21 @@ func (sshClient *sshClient) runTunnel(
 	// The channel loop is interrupted by a client
 	// disconnect or by calling sshClient.stop().
 
+	// Stop any userspace packet tunnel stack, which enqueues new TCP port
+	// forwards, before stopping the TCP port forward manager.
+	sshClient.setPacketTunnelStack(nil)
+
 	// Stop the TCP port forward manager
 	close(newTCPPortForwards)
 
 	// Stop all other worker goroutines
 	sshClient.stopRunning()
 
-	if sshClient.sshServer.support.Config.RunPacketTunnel {
+	// Stop datagram channel workers. Datagram channels aren't closed along
+	// with the SSH connection.
+	sshClient.closeDatagramChannels()
+
+	if sshClient.sshServer.support.PacketTunnelServer != nil {
 		// PacketTunnelServer.ClientDisconnected stops packet tunnel workers.
 		sshClient.sshServer.support.PacketTunnelServer.ClientDisconnected(
 			sshClient.sessionID)
@@ -1739,7 +2053,8 @@ func (sshClient *sshClient) runTunnel(
 	sshClient.cleanupAuthorizations()
 }
 
-func (sshClient *sshClient) handleSSHRequests(requests <-chan *ssh.Request) {
+func (sshClient *sshClient) handleSSHRequests(
+	waitGroup *sync.WaitGroup, requests <-chan *ssh.Request) {
 
 	for request := range requests {
 
@@ -1754,6 +2069,12 @@ func (sshClient *sshClient) handleSSHRequests(requests <-chan *ssh.Request) {
 			responsePayload, err = tactics.MakeSpeedTestResponse(
 				SSH_KEEP_ALIVE_PAYLOAD_MIN_BYTES, SSH_KEEP_ALIVE_PAYLOAD_MAX_BYTES)
 
+		} else if request.Type == protocol.PSIPHON_API_DATAGRAM_CHANNEL_REQUEST_NAME {
+
+			// Datagram channel requests start workers bound to this client.
+			responsePayload, err = sshClient.handleDatagramChannelRequest(
+				waitGroup, request.Payload)
+
 		} else {
 
 			// All other requests are assumed to be API requests.
@@ -1790,10 +2111,12 @@ func (sshClient *sshClient) handleSSHRequests(requests <-chan *ssh.Request) {
 }
 
 type newTCPPortForward struct {
-	enqueueTime   time.Time
-	hostToConnect string
-	portToConnect int
-	newChannel    ssh.NewChannel
+	enqueueTime      time.Time
+	hostToConnect    string
+	portToConnect    int
+	hostname         string
+	isTransparentDNS bool
+	newChannel       ssh.NewChannel
 }
 
 func (sshClient *sshClient) handleTCPPortForwards(
@@ -1917,6 +2240,8 @@ func (sshClient *sshClient) handleTCPPortForwards(
 				remainingDialTimeout,
 				newPortForward.hostToConnect,
 				newPortForward.portToConnect,
+				newPortForward.hostname,
+				newPortForward.isTransparentDNS,
 				newPortForward.newChannel)
 		}(remainingDialTimeout, newPortForward)
 	}
@@ -2039,10 +2364,12 @@ func (sshClient *sshClient) handleNewRandomStreamChannel(
 }
 
 func (sshClient *sshClient) handleNewPacketTunnelChannel(
-	waitGroup *sync.WaitGroup, newChannel ssh.NewChannel) {
+	waitGroup *sync.WaitGroup, newChannel ssh.NewChannel,
+	newTCPPortForwards chan *newTCPPortForward) {
 
 	// packet tunnel channels are handled by the packet tunnel server
-	// component. Each client may have at most one packet tunnel channel.
+	// component or, in userspace stack mode, by a per-client tun.Stack.
+	// Each client may have at most one packet tunnel channel.
 
 	if !sshClient.sshServer.support.Config.RunPacketTunnel {
 		sshClient.rejectNewChannel(newChannel, "unsupported packet tunnel channel type")
@@ -2063,15 +2390,38 @@ func (sshClient *sshClient) handleNewPacketTunnelChannel(
 
 	sshClient.setPacketTunnelChannel(packetTunnelChannel)
 
+	if sshClient.sshServer.support.Config.PacketTunnelUserspaceStack {
+		sshClient.runPacketTunnelStack(
+			waitGroup, packetTunnelChannel, newTCPPortForwards)
+		return
+	}
+
+	err = sshClient.connectPacketTunnelServer(packetTunnelChannel)
+	if err != nil {
+		log.WithTraceFields(LogFields{"error": err}).Warning("start packet tunnel client failed")
+		sshClient.setPacketTunnelChannel(nil)
+	}
+}
+
+// connectPacketTunnelServer connects the client's packet tunnel transport,
+// an SSH channel or a datagram channel, to the packet tunnel server.
+func (sshClient *sshClient) connectPacketTunnelServer(transport io.ReadWriteCloser) error {
+
 	// PacketTunnelServer will run the client's packet tunnel. If necessary, ClientConnected
 	// will stop packet tunnel workers for any previous packet tunnel channel.
 
-	checkAllowedTCPPortFunc := func(upstreamIPAddress net.IP, port int) bool {
-		return sshClient.isPortForwardPermitted(portForwardTypeTCP, upstreamIPAddress, port)
+	checkAllowedTCPPortFunc := func(
+		upstreamHostname string, upstreamIPAddress net.IP, port int) bool {
+
+		return sshClient.isPortForwardPermitted(
+			portForwardTypeTCP, upstreamHostname, upstreamIPAddress, port)
 	}
 
-	checkAllowedUDPPortFunc := func(upstreamIPAddress net.IP, port int) bool {
-		return sshClient.isPortForwardPermitted(portForwardTypeUDP, upstreamIPAddress, port)
+	checkAllowedUDPPortFunc := func(
+		upstreamHostname string, upstreamIPAddress net.IP, port int) bool {
+
+		return sshClient.isPortForwardPermitted(
+			portForwardTypeUDP, upstreamHostname, upstreamIPAddress, port)
 	}
 
 	flowActivityUpdaterMaker := func(
@@ -2097,17 +2447,18 @@ func (sshClient *sshClient) handleNewPacketTunnelChannel(
 		sshClient.Unlock()
 	}
 
-	err = sshClient.sshServer.support.PacketTunnelServer.ClientConnected(
+	err := sshClient.sshServer.support.PacketTunnelServer.ClientConnected(
 		sshClient.sessionID,
-		packetTunnelChannel,
+		transport,
 		checkAllowedTCPPortFunc,
 		checkAllowedUDPPortFunc,
 		flowActivityUpdaterMaker,
 		metricUpdater)
 	if err != nil {
-		log.WithTraceFields(LogFields{"error": err}).Warning("start packet tunnel client failed")
-		sshClient.setPacketTunnelChannel(nil)
+		return errors.Trace(err)
 	}
+
+	return nil
 }
 
 func (sshClient *sshClient) handleNewTCPPortForwardChannel(
@@ -2190,26 +2541,49 @@ func (sshClient *sshClient) cleanupAuthorizations() {
 // setPacketTunnelChannel sets the single packet tunnel channel
 // for this sshClient. Any existing packet tunnel channel is
 // closed.
-func (sshClient *sshClient) setPacketTunnelChannel(channel ssh.Channel) {
+func (sshClient *sshClient) setPacketTunnelChannel(channel io.Closer) {
 	sshClient.Lock()
-	if sshClient.packetTunnelChannel != nil {
-		sshClient.packetTunnelChannel.Close()
-	}
+	previousChannel := sshClient.packetTunnelChannel
 	sshClient.packetTunnelChannel = channel
 	sshClient.Unlock()
+
+	// Closing a datagram channel unregisters it, which requires the
+	// sshClient lock, so the previous channel isn't closed while holding
+	// the lock.
+	if previousChannel != nil {
+		previousChannel.Close()
+	}
+}
+
+// setPacketTunnelStack sets the single userspace packet tunnel stack for
+// this sshClient. Any existing stack is stopped.
+func (sshClient *sshClient) setPacketTunnelStack(stack *tun.Stack) {
+	sshClient.Lock()
+	previousStack := sshClient.packetTunnelStack
+	sshClient.packetTunnelStack = stack
+	sshClient.Unlock()
+
+	// Stack.Stop blocks until the stack's workers exit, so it's not called
+	// while holding the sshClient lock.
+	if previousStack != nil {
+		previousStack.Stop()
+	}
 }
 
 // setUDPChannel sets the single UDP channel for this sshClient.
 // Each sshClient may have only one concurrent UDP channel. Each
 // UDP channel multiplexes many UDP port forwards via the udpgw
 // protocol. Any existing UDP channel is closed.
-func (sshClient *sshClient) setUDPChannel(channel ssh.Channel) {
+func (sshClient *sshClient) setUDPChannel(channel io.Closer) {
 	sshClient.Lock()
-	if sshClient.udpChannel != nil {
-		sshClient.udpChannel.Close()
-	}
+	previousChannel := sshClient.udpChannel
 	sshClient.udpChannel = channel
 	sshClient.Unlock()
+
+	// See comment in setPacketTunnelChannel.
+	if previousChannel != nil {
+		previousChannel.Close()
+	}
 }
 
 var serverTunnelStatParams = append(
@@ -2249,8 +2623,12 @@ func (sshClient *sshClient) logTunnel(additionalMetrics []LogFields) {
 	}
 	logFields["session_id"] = sshClient.sessionID
 	logFields["handshake_completed"] = sshClient.handshakeState.completed
-	logFields["start_time"] = sshClient.activityConn.GetStartTime()
-	logFields["duration"] = int64(sshClient.activityConn.GetActiveDuration() / time.Millisecond)
+	// When the tunnel was resumed, activityConn is the most recent
+	// connection, and the duration spans all connections.
+	logFields["start_time"] = sshClient.tunnelStartTime
+	logFields["duration"] = int64(
+		(sshClient.activityConn.GetStartTime().Sub(sshClient.tunnelStartTime) +
+			sshClient.activityConn.GetActiveDuration()) / time.Millisecond)
 	logFields["bytes_up_tcp"] = sshClient.tcpTrafficState.bytesUp
 	logFields["bytes_down_tcp"] = sshClient.tcpTrafficState.bytesDown
 	logFields["peak_concurrent_dialing_port_forward_count_tcp"] = sshClient.tcpTrafficState.peakConcurrentDialingPortForwardCount
@@ -2273,6 +2651,11 @@ func (sshClient *sshClient) logTunnel(additionalMetrics []LogFields) {
 	logFields["random_stream_downstream_bytes"] = sshClient.postHandshakeRandomStreamMetrics.downstreamBytes
 	logFields["random_stream_sent_downstream_bytes"] = sshClient.postHandshakeRandomStreamMetrics.sentDownstreamBytes
 
+	logFields["dns_resolution_count"] = sshClient.dnsResolutionMetrics.count
+	logFields["dns_resolution_cache_hit_count"] = sshClient.dnsResolutionMetrics.cacheHitCount
+	logFields["dns_resolution_failed_count"] = sshClient.dnsResolutionMetrics.failedCount
+	logFields["dns_resolution_duration"] = int64(sshClient.dnsResolutionMetrics.duration / time.Millisecond)
+
 	// Pre-calculate a total-tunneled-bytes field. This total is used
 	// extensively in analytics and is more performant when pre-calculated.
 	logFields["bytes"] = sshClient.tcpTrafficState.bytesUp +
@@ -2625,6 +3008,7 @@ func (sshClient *sshClient) setHandshakeState(
 
 		// Make the authorizedAccessTypes available for traffic rules filtering.
 
+		sshClient.handshakeState.activeAuthorizationIDs = authorizationIDs
 		sshClient.handshakeState.authorizedAccessTypes = authorizedAccessTypes
 
 		// On exit, sshClient.runTunnel will call releaseAuthorizations, which
@@ -2656,6 +3040,12 @@ func (sshClient *sshClient) setHandshakeState(
 	sshClient.setTrafficRules()
 	sshClient.setOSLConfig()
 
+	// Immediately apply any data quota selected by the post-handshake
+	// traffic rules, so that a client which has already exceeded its quota
+	// in a previous tunnel doesn't get a fresh allowance until the next
+	// periodic update.
+	sshClient.updateDataQuota()
+
 	return authorizationIDs, authorizedAccessTypes, nil
 }
 
@@ -2723,17 +3113,48 @@ func (sshClient *sshClient) setTrafficRules() {
 	sshClient.Lock()
 	defer sshClient.Unlock()
 
-	sshClient.trafficRules = sshClient.sshServer.support.TrafficRulesSet.GetTrafficRules(
-		sshClient.isFirstTunnelInSession,
-		sshClient.tunnelProtocol,
-		sshClient.geoIPData,
-		sshClient.handshakeState)
+	sshClient.trafficRules, sshClient.trafficRulesIndex =
+		sshClient.sshServer.support.TrafficRulesSet.selectTrafficRules(
+			time.Now(),
+			sshClient.isFirstTunnelInSession,
+			sshClient.tunnelProtocol,
+			sshClient.geoIPData,
+			sshClient.handshakeState)
+
+	if sshClient.throttledConn != nil {
+		// Any existing throttling state is reset.
+		sshClient.throttledConn.SetLimits(sshClient.getRateLimits())
+	}
+	sshClient.setDatagramChannelRateLimits()
+}
+
+// reselectTrafficRules is setTrafficRules, except that the client's traffic
+// rules, and throttling state, are left unchanged when the same traffic
+// rules are selected.
+func (sshClient *sshClient) reselectTrafficRules() {
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	trafficRules, trafficRulesIndex :=
+		sshClient.sshServer.support.TrafficRulesSet.selectTrafficRules(
+			time.Now(),
+			sshClient.isFirstTunnelInSession,
+			sshClient.tunnelProtocol,
+			sshClient.geoIPData,
+			sshClient.handshakeState)
+
+	if trafficRulesIndex == sshClient.trafficRulesIndex {
+		return
+	}
+
+	sshClient.trafficRules = trafficRules
+	sshClient.trafficRulesIndex = trafficRulesIndex
 
 	if sshClient.throttledConn != nil {
 		// Any existing throttling state is reset.
-		sshClient.throttledConn.SetLimits(
-			sshClient.trafficRules.RateLimits.CommonRateLimits())
+		sshClient.throttledConn.SetLimits(sshClient.getRateLimits())
 	}
+	sshClient.setDatagramChannelRateLimits()
 }
 
 // setOSLConfig resets the client's OSL seed state based on the latest OSL config
@@ -2823,9 +3244,132 @@ func (sshClient *sshClient) rateLimits() common.RateLimits {
 	sshClient.Lock()
 	defer sshClient.Unlock()
 
+	return sshClient.getRateLimits()
+}
+
+// getRateLimits returns the rate limits specified by the client's traffic
+// rules or, when the client has exceeded its data quota and the quota
+// specifies the "throttle" action, the quota throttle rate limits.
+//
+// The caller must hold the sshClient lock.
+func (sshClient *sshClient) getRateLimits() common.RateLimits {
+
+	quota := sshClient.trafficRules.DataQuota
+	if sshClient.dataQuotaExceeded &&
+		quota != nil &&
+		quota.hasAction(DATA_QUOTA_ACTION_THROTTLE) {
+
+		return common.RateLimits{
+			ReadBytesPerSecond:  quota.ThrottleBytesPerSecond,
+			WriteBytesPerSecond: quota.ThrottleBytesPerSecond,
+		}
+	}
+
 	return sshClient.trafficRules.RateLimits.CommonRateLimits()
 }
 
+// getDataQuotaKey returns the DataQuotaStore key for the specified quota, or
+// "" when the quota doesn't apply to the client.
+//
+// The caller must hold the sshClient lock.
+func (sshClient *sshClient) getDataQuotaKey(quota *DataQuota) string {
+
+	switch quota.Key {
+
+	case DATA_QUOTA_KEY_SESSION:
+		if sshClient.sessionID == "" {
+			return ""
+		}
+		return makeDataQuotaKey(DATA_QUOTA_KEY_SESSION, sshClient.sessionID)
+
+	case DATA_QUOTA_KEY_AUTHORIZATION:
+		if sshClient.handshakeState.authorizationsRevoked {
+			return ""
+		}
+		for i, accessType := range sshClient.handshakeState.authorizedAccessTypes {
+			if quota.AuthorizedAccessType == "" || quota.AuthorizedAccessType == accessType {
+				return makeDataQuotaKey(
+					DATA_QUOTA_KEY_AUTHORIZATION,
+					sshClient.handshakeState.activeAuthorizationIDs[i])
+			}
+		}
+	}
+
+	return ""
+}
+
+// updateDataQuota adds the bytes transferred since the previous update to
+// the usage for the client's data quota, if any. When the quota is first
+// exceeded, the quota actions are taken. When the quota is no longer
+// exceeded, due to a reset period or a traffic rules change, any quota
+// throttling is removed.
+//
+// Usage is recorded, but no actions are taken, once the tunnel has stopped.
+func (sshClient *sshClient) updateDataQuota() {
+
+	sshClient.Lock()
+
+	var bytes int64
+	if sshClient.dataQuotaConn != nil {
+		bytes = sshClient.dataQuotaConn.takeBytes()
+	}
+	bytes += sshClient.takeDatagramChannelBytes()
+
+	quota := sshClient.trafficRules.DataQuota
+	var key string
+	if quota != nil {
+		key = sshClient.getDataQuotaKey(quota)
+	}
+
+	wasExceeded := sshClient.dataQuotaExceeded
+
+	sshClient.Unlock()
+
+	// Bytes transferred when no quota applies are not counted.
+
+	exceeded := false
+	var usage int64
+	if key != "" {
+		usage = sshClient.sshServer.support.DataQuotaStore.Add(
+			key, bytes, time.Duration(quota.ResetPeriodSeconds)*time.Second)
+		exceeded = usage >= quota.Bytes
+	}
+
+	if exceeded == wasExceeded || sshClient.runCtx.Err() != nil {
+		return
+	}
+
+	sshClient.Lock()
+	sshClient.dataQuotaExceeded = exceeded
+	if sshClient.throttledConn != nil {
+		sshClient.throttledConn.SetLimits(sshClient.getRateLimits())
+	}
+	sshClient.setDatagramChannelRateLimits()
+	sshClient.Unlock()
+
+	if !exceeded {
+		return
+	}
+
+	log.WithTraceFields(
+		LogFields{
+			"sessionID": sshClient.sessionID,
+			"key":       quota.Key,
+			"usage":     usage,
+			"actions":   quota.Actions}).Info("data quota exceeded")
+
+	if quota.hasAction(DATA_QUOTA_ACTION_ALERT) {
+		sshClient.enqueueAlertRequest(protocol.AlertRequest{
+			Reason:  protocol.PSIPHON_API_ALERT_DATA_QUOTA_EXCEEDED,
+			Subject: quota.Key,
+		})
+	}
+
+	if quota.hasAction(DATA_QUOTA_ACTION_CLOSE) {
+		sshClient.stop()
+	}
+}
+
 func (sshClient *sshClient) idleTCPPortForwardTimeout() time.Duration {
 	sshClient.Lock()
 	defer sshClient.Unlock()
@@ -2852,8 +3396,41 @@ const (
 	portForwardTypeUDP
 )
 
+// isDomainPermitted checks the domain against the domain blocklist, logging
+// any hits. When the domain is not permitted, isDomainPermitted returns false
+// and the reason.
+func (sshClient *sshClient) isDomainPermitted(domain string) (bool, string) {
+
+	// We're not doing comprehensive validation, to avoid overhead per port
+	// forward. This is a simple sanity check to ensure we don't process
+	// blantantly invalid input.
+	//
+	// TODO: validate with dns.IsDomainName?
+	if len(domain) > 255 {
+		return false, "invalid domain name"
+	}
+
+	tags := sshClient.sshServer.support.Blocklist.LookupDomain(domain)
+	if len(tags) > 0 {
+
+		sshClient.logBlocklistHits(nil, domain, tags)
+
+		if sshClient.sshServer.support.Config.BlocklistActive {
+			// Actively alert and block
+			sshClient.enqueueUnsafeTrafficAlertRequest(tags)
+			return false, "port forward not permitted"
+		}
+	}
+
+	return true, ""
+}
+
+// isPortForwardPermitted checks the client's traffic rules for a port
+// forward to remoteIP:port. domain is the domain name that resolved to
+// remoteIP, when known, and is "" otherwise.
 func (sshClient *sshClient) isPortForwardPermitted(
 	portForwardType int,
+	domain string,
 	remoteIP net.IP,
 	port int) bool {
 
@@ -2898,11 +3475,11 @@ func (sshClient *sshClient) isPortForwardPermitted(
 		// Traffic rules checks.
 		switch portForwardType {
 		case portForwardTypeTCP:
-			if !sshClient.trafficRules.AllowTCPPort(remoteIP, port) {
+			if !sshClient.trafficRules.AllowTCPPort(domain, remoteIP, port) {
 				allowed = false
 			}
 		case portForwardTypeUDP:
-			if !sshClient.trafficRules.AllowUDPPort(remoteIP, port) {
+			if !sshClient.trafficRules.AllowUDPPort(domain, remoteIP, port) {
 				allowed = false
 			}
 		}
@@ -2925,8 +3502,9 @@ func (sshClient *sshClient) isPortForwardPermitted(
 
 	log.WithTraceFields(
 		LogFields{
-			"type": portForwardType,
-			"port": port,
+			"type":   portForwardType,
+			"domain": domain,
+			"port":   port,
 		}).Debug("port forward denied by traffic rules")
 
 	return false
@@ -2955,6 +3533,25 @@ func (sshClient *sshClient) getTCPPortForwardQueueSize() int {
 		*sshClient.trafficRules.MaxTCPDialingPortForwardCount
 }
 
+func (sshClient *sshClient) getPacketTunnelStackMaxFlows() int {
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	// When either TCP or UDP port forwards are unlimited, return 0 and the
+	// tun.Stack default applies.
+
+	maxTCP := *sshClient.trafficRules.MaxTCPPortForwardCount
+	maxUDP := *sshClient.trafficRules.MaxUDPPortForwardCount
+	if maxTCP == 0 || maxUDP == 0 {
+		return 0
+	}
+
+	return maxTCP +
+		*sshClient.trafficRules.MaxTCPDialingPortForwardCount +
+		maxUDP
+}
+
 func (sshClient *sshClient) getDialTCPPortForwardTimeoutMilliseconds() int {
 
 	sshClient.Lock()
@@ -3127,6 +3724,9 @@ func (sshClient *sshClient) updateQualityMetricsWithDialResult(
 	sshClient.Lock()
 	defer sshClient.Unlock()
 
+	sshClient.sshServer.portForwardMetrics.addDialResult(
+		sshClient.tunnelProtocol, tcpPortForwardDialSuccess, dialDuration, IP)
+
 	if tcpPortForwardDialSuccess {
 		sshClient.qualityMetrics.TCPPortForwardDialedCount += 1
 		sshClient.qualityMetrics.TCPPortForwardDialedDuration += dialDuration
@@ -3150,12 +3750,31 @@ func (sshClient *sshClient) updateQualityMetricsWithDialResult(
 	}
 }
 
+func (sshClient *sshClient) updateDNSResolutionMetrics(
+	success bool, isCacheHit bool, duration time.Duration) {
+
+	sshClient.Lock()
+	defer sshClient.Unlock()
+
+	sshClient.dnsResolutionMetrics.count += 1
+	if isCacheHit {
+		sshClient.dnsResolutionMetrics.cacheHitCount += 1
+	}
+	if !success {
+		sshClient.dnsResolutionMetrics.failedCount += 1
+	}
+	sshClient.dnsResolutionMetrics.duration += duration
+}
+
 func (sshClient *sshClient) updateQualityMetricsWithRejectedDialingLimit() {
 
 	sshClient.Lock()
 	defer sshClient.Unlock()
 
 	sshClient.qualityMetrics.TCPPortForwardRejectedDialingLimitCount += 1
+
+	sshClient.sshServer.portForwardMetrics.addRejected(
+		sshClient.tunnelProtocol, "tcp", "dialing_limit")
 }
 
 func (sshClient *sshClient) updateQualityMetricsWithTCPRejectedDisallowed() {
@@ -3164,6 +3783,9 @@ func (sshClient *sshClient) updateQualityMetricsWithTCPRejectedDisallowed() {
 	defer sshClient.Unlock()
 
 	sshClient.qualityMetrics.TCPPortForwardRejectedDisallowedCount += 1
+
+	sshClient.sshServer.portForwardMetrics.addRejected(
+		sshClient.tunnelProtocol, "tcp", "disallowed")
 }
 
 func (sshClient *sshClient) updateQualityMetricsWithUDPRejectedDisallowed() {
@@ -3172,17 +3794,27 @@ func (sshClient *sshClient) updateQualityMetricsWithUDPRejectedDisallowed() {
 	defer sshClient.Unlock()
 
 	sshClient.qualityMetrics.UDPPortForwardRejectedDisallowedCount += 1
+
+	sshClient.sshServer.portForwardMetrics.addRejected(
+		sshClient.tunnelProtocol, "udp", "disallowed")
 }
 
 func (sshClient *sshClient) handleTCPChannel(
 	remainingDialTimeout time.Duration,
 	hostToConnect string,
 	portToConnect int,
+	hostname string,
+	isTransparentDNS bool,
 	newChannel ssh.NewChannel) {
 
 	// Assumptions:
 	// - sshClient.dialingTCPPortForward() has been called
 	// - remainingDialTimeout > 0
+	//
+	// hostname and isTransparentDNS are set only for userspace packet tunnel
+	// flows. hostname is the domain, resolved via transparent DNS, associated
+	// with the IP address hostToConnect. Transparent DNS flows bypass traffic
+	// rules checks, as in the udpgw and tun.Server cases.
 
 	established := false
 	defer func() {
@@ -3209,6 +3841,27 @@ func (sshClient *sshClient) handleTCPChannel(
 		}
 	}
 
+	// In TorORPortForwarding mode, connect port forwards to the transport
+	// address, which is the bridge address Tor clients dial, to Tor. The
+	// destination is replaced with the ORPort address, which is exempt from
+	// the domain blocklist and traffic rules checks, and the dial is made
+	// with DialORPort, which performs any extended ORPort handshake. All
+	// other port forwards, including transparent DNS flows, are handled as
+	// usual.
+
+	isTorORPortForward := false
+	torPluggableTransport := sshClient.sshServer.support.TorPluggableTransport
+	if !isWebServerPortForward &&
+		torPluggableTransport != nil &&
+		torPluggableTransport.IsMethodAddress(hostToConnect, portToConnect) {
+
+		isTorORPortForward = true
+		ORPortAddress := torPluggableTransport.ORPortAddress()
+		hostToConnect = ORPortAddress.IP.String()
+		portToConnect = ORPortAddress.Port
+		hostname = ""
+	}
+
 	// Validate the domain name and check the domain blocklist before dialing.
 	//
 	// The IP blocklist is checked in isPortForwardPermitted, which also provides
@@ -3218,36 +3871,22 @@ func (sshClient *sshClient) handleTCPChannel(
 	// check.
 	//
 	// Limitation: at this time, only clients that send domains in hostToConnect
-	// are subject to domain blocklist checks. Both the udpgw and packet tunnel
-	// modes perform tunneled DNS and send only IPs in hostToConnect.
+	// are subject to domain blocklist checks. Both the udpgw and kernel packet
+	// tunnel modes perform tunneled DNS and send only IPs in hostToConnect. The
+	// userspace packet tunnel mode provides the domain, when known, in
+	// hostname.
 
-	if !isWebServerPortForward &&
-		net.ParseIP(hostToConnect) == nil {
+	domain := hostname
+	if net.ParseIP(hostToConnect) == nil {
+		domain = hostToConnect
+	}
 
-		// We're not doing comprehensive validation, to avoid overhead per port
-		// forward. This is a simple sanity check to ensure we don't process
-		// blantantly invalid input.
-		//
-		// TODO: validate with dns.IsDomainName?
-		if len(hostToConnect) > 255 {
+	if !isWebServerPortForward && !isTorORPortForward && domain != "" {
+		if ok, reason := sshClient.isDomainPermitted(domain); !ok {
 			// Note: not recording a port forward failure in this case
-			sshClient.rejectNewChannel(newChannel, "invalid domain name")
+			sshClient.rejectNewChannel(newChannel, reason)
 			return
 		}
-
-		tags := sshClient.sshServer.support.Blocklist.LookupDomain(hostToConnect)
-		if len(tags) > 0 {
-
-			sshClient.logBlocklistHits(nil, hostToConnect, tags)
-
-			if sshClient.sshServer.support.Config.BlocklistActive {
-				// Actively alert and block
-				// Note: not recording a port forward failure in this case
-				sshClient.enqueueUnsafeTrafficAlertRequest(tags)
-				sshClient.rejectNewChannel(newChannel, "port forward not permitted")
-				return
-			}
-		}
 	}
 
 	// Dial the remote address.
@@ -3263,36 +3902,25 @@ func (sshClient *sshClient) handleTCPChannel(
 
 	log.WithTraceFields(LogFields{"hostToConnect": hostToConnect}).Debug("resolving")
 
+	sshClient.Lock()
+	preferIPv6 := *sshClient.trafficRules.PreferIPv6
+	sshClient.Unlock()
+
 	ctx, cancelCtx := context.WithTimeout(sshClient.runCtx, remainingDialTimeout)
-	IPs, err := (&net.Resolver{}).LookupIPAddr(ctx, hostToConnect)
+	IPs, isCacheHit, err := sshClient.sshServer.support.HostResolver.ResolveIP(
+		ctx, hostToConnect, preferIPv6)
 	cancelCtx() // "must be called or the new context will remain live until its parent context is cancelled"
 
-	// IPv4 is preferred in case the host has limited IPv6 routing. IPv6 is
-	// selected and attempted only when there's no IPv4 option.
-	// TODO: shuffle list to try other IPs?
-
-	var IP net.IP
-	for _, ip := range IPs {
-		if ip.IP.To4() != nil {
-			IP = ip.IP
-			break
-		}
-	}
-	if IP == nil && len(IPs) > 0 {
-		// If there are no IPv4 IPs, the first IP is IPv6.
-		IP = IPs[0].IP
-	}
+	resolveElapsedTime := time.Since(dialStartTime)
 
-	if err == nil && IP == nil {
-		err = std_errors.New("no IP address")
+	if net.ParseIP(hostToConnect) == nil {
+		sshClient.updateDNSResolutionMetrics(err == nil, isCacheHit, resolveElapsedTime)
 	}
 
-	resolveElapsedTime := time.Since(dialStartTime)
-
 	if err != nil {
 
 		// Record a port forward failure
-		sshClient.updateQualityMetricsWithDialResult(false, resolveElapsedTime, IP)
+		sshClient.updateQualityMetricsWithDialResult(false, resolveElapsedTime, nil)
 
 		sshClient.rejectNewChannel(newChannel, fmt.Sprintf("LookupIP failed: %s", err))
 		return
@@ -3305,36 +3933,75 @@ func (sshClient *sshClient) handleTCPChannel(
 		return
 	}
 
-	// Enforce traffic rules, using the resolved IP address.
+	// TCP dial.
+	//
+	// The resolved IPs are ordered by address family preference and shuffled
+	// by ResolveIP. When a dial fails, the next IP is tried, up to
+	// MAX_TCP_PORT_FORWARD_DIAL_ATTEMPTS, while dial time remains.
+	//
+	// Traffic rules are enforced for each IP before it's dialed, using the
+	// IP address and, for AllowDomains and DisallowDomains, the requested
+	// domain. When the first IP is not permitted, the port forward is
+	// rejected; when a subsequent IP is not permitted, no further IPs are
+	// tried.
 
-	if !isWebServerPortForward &&
-		!sshClient.isPortForwardPermitted(
-			portForwardTypeTCP,
-			IP,
-			portToConnect) {
-		// Note: not recording a port forward failure in this case
-		sshClient.rejectNewChannel(newChannel, "port forward not permitted")
-		return
-	}
+	var IP net.IP
+	var remoteAddr string
+	var fwdConn net.Conn
 
-	// TCP dial.
+	dialDeadline := time.Now().Add(remainingDialTimeout)
 
-	remoteAddr := net.JoinHostPort(IP.String(), strconv.Itoa(portToConnect))
+	for i := 0; i < len(IPs) && i < MAX_TCP_PORT_FORWARD_DIAL_ATTEMPTS; i++ {
 
-	log.WithTraceFields(LogFields{"remoteAddr": remoteAddr}).Debug("dialing")
+		if i > 0 && !time.Now().Before(dialDeadline) {
+			break
+		}
 
-	ctx, cancelCtx = context.WithTimeout(sshClient.runCtx, remainingDialTimeout)
-	fwdConn, err := (&net.Dialer{}).DialContext(ctx, "tcp", remoteAddr)
-	cancelCtx() // "must be called or the new context will remain live until its parent context is cancelled"
+		if !isWebServerPortForward &&
+			!isTorORPortForward &&
+			!isTransparentDNS &&
+			!sshClient.isPortForwardPermitted(
+				portForwardTypeTCP,
+				domain,
+				IPs[i],
+				portToConnect) {
 
-	// Record port forward success or failure
-	sshClient.updateQualityMetricsWithDialResult(err == nil, time.Since(dialStartTime), IP)
+			if i == 0 {
+				// Note: not recording a port forward failure in this case
+				sshClient.rejectNewChannel(newChannel, "port forward not permitted")
+				return
+			}
+			break
+		}
 
-	if err != nil {
+		IP = IPs[i]
+
+		remoteAddr = net.JoinHostPort(IP.String(), strconv.Itoa(portToConnect))
+
+		log.WithTraceFields(LogFields{"remoteAddr": remoteAddr}).Debug("dialing")
+
+		if isTorORPortForward {
+			// The ORPort is a local address, and DialORPort applies its own
+			// timeout to the extended ORPort handshake.
+			fwdConn, err = torPluggableTransport.DialORPort()
+		} else {
+			ctx, cancelCtx = context.WithDeadline(sshClient.runCtx, dialDeadline)
+			fwdConn, err = (&net.Dialer{}).DialContext(ctx, "tcp", remoteAddr)
+			cancelCtx() // "must be called or the new context will remain live until its parent context is cancelled"
+		}
+
+		if err == nil {
+			break
+		}
 
 		// Monitor for low resource error conditions
 		sshClient.sshServer.monitorPortForwardDialError(err)
+	}
 
+	// Record port forward success or failure
+	sshClient.updateQualityMetricsWithDialResult(err == nil, time.Since(dialStartTime), IP)
+
+	if err != nil {
 		sshClient.rejectNewChannel(newChannel, fmt.Sprintf("DialTimeout failed: %s", err))
 		return
 	}
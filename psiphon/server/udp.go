@@ -32,6 +32,7 @@ import (
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpgw"
 )
 
 // handleUDPChannel implements UDP port forwarding. A single UDP
@@ -59,9 +60,16 @@ func (sshClient *sshClient) handleUDPChannel(newChannel ssh.NewChannel) {
 
 	sshClient.setUDPChannel(sshChannel)
 
+	sshClient.runUDPPortForwardMultiplexer(sshChannel)
+}
+
+// runUDPPortForwardMultiplexer runs the udpgw protocol over the specified
+// channel, which is either an SSH channel or a datagram channel.
+func (sshClient *sshClient) runUDPPortForwardMultiplexer(channel io.ReadWriteCloser) {
+
 	multiplexer := &udpPortForwardMultiplexer{
 		sshClient:      sshClient,
-		sshChannel:     sshChannel,
+		channel:        channel,
 		portForwards:   make(map[uint16]*udpPortForward),
 		portForwardLRU: common.NewLRUConns(),
 		relayWaitGroup: new(sync.WaitGroup),
@@ -70,13 +78,13 @@ func (sshClient *sshClient) handleUDPChannel(newChannel ssh.NewChannel) {
 }
 
 type udpPortForwardMultiplexer struct {
-	sshClient            *sshClient
-	sshChannelWriteMutex sync.Mutex
-	sshChannel           ssh.Channel
-	portForwardsMutex    sync.Mutex
-	portForwards         map[uint16]*udpPortForward
-	portForwardLRU       *common.LRUConns
-	relayWaitGroup       *sync.WaitGroup
+	sshClient         *sshClient
+	channelWriteMutex sync.Mutex
+	channel           io.ReadWriteCloser
+	portForwardsMutex sync.Mutex
+	portForwards      map[uint16]*udpPortForward
+	portForwardLRU    *common.LRUConns
+	relayWaitGroup    *sync.WaitGroup
 }
 
 func (mux *udpPortForwardMultiplexer) run() {
@@ -101,11 +109,11 @@ func (mux *udpPortForwardMultiplexer) run() {
 		}
 	}()
 
-	buffer := make([]byte, udpgwProtocolMaxMessageSize)
+	buffer := make([]byte, udpgw.PROTOCOL_MAX_MESSAGE_SIZE)
 	for {
 		// Note: message.packet points to the reusable memory in "buffer".
 		// Each readUdpgwMessage call will overwrite the last message.packet.
-		message, err := readUdpgwMessage(mux.sshChannel, buffer)
+		message, err := readUdpgwMessage(mux.channel, buffer)
 		if err != nil {
 			if err != io.EOF {
 				// Debug since I/O errors occur during normal operation
@@ -152,7 +160,7 @@ func (mux *udpPortForwardMultiplexer) run() {
 				dialPort = DNS_RESOLVER_PORT
 
 			} else if !mux.sshClient.isPortForwardPermitted(
-				portForwardTypeUDP, dialIP, int(message.remotePort)) {
+				portForwardTypeUDP, "", dialIP, int(message.remotePort)) {
 				// The udpgw protocol has no error response, so
 				// we just discard the message and read another.
 				continue
@@ -293,12 +301,12 @@ func (portForward *udpPortForward) relayDownstream() {
 	// Note: there is one downstream buffer per UDP port forward,
 	// while for upstream there is one buffer per client.
 	// TODO: is the buffer size larger than necessary?
-	buffer := make([]byte, udpgwProtocolMaxMessageSize)
-	packetBuffer := buffer[portForward.preambleSize:udpgwProtocolMaxMessageSize]
+	buffer := make([]byte, udpgw.PROTOCOL_MAX_MESSAGE_SIZE)
+	packetBuffer := buffer[portForward.preambleSize:udpgw.PROTOCOL_MAX_MESSAGE_SIZE]
 	for {
 		// TODO: if read buffer is too small, excess bytes are discarded?
 		packetSize, err := portForward.conn.Read(packetBuffer)
-		if packetSize > udpgwProtocolMaxPayloadSize {
+		if packetSize > udpgw.PROTOCOL_MAX_PAYLOAD_SIZE {
 			err = fmt.Errorf("unexpected packet size: %d", packetSize)
 		}
 		if err != nil {
@@ -321,14 +329,14 @@ func (portForward *udpPortForward) relayDownstream() {
 			// ssh.Channel.Write cannot be called concurrently.
 			// See: https://github.com/Psiphon-Inc/crypto/blob/82d98b4c7c05e81f92545f6fddb45d4541e6da00/ssh/channel.go#L272,
 			// https://codereview.appspot.com/136420043/diff/80002/ssh/channel.go
-			portForward.mux.sshChannelWriteMutex.Lock()
-			_, err = portForward.mux.sshChannel.Write(buffer[0 : portForward.preambleSize+packetSize])
-			portForward.mux.sshChannelWriteMutex.Unlock()
+			portForward.mux.channelWriteMutex.Lock()
+			_, err = portForward.mux.channel.Write(buffer[0 : portForward.preambleSize+packetSize])
+			portForward.mux.channelWriteMutex.Unlock()
 		}
 
 		if err != nil {
 			// Close the channel, which will interrupt the main loop.
-			portForward.mux.sshChannel.Close()
+			portForward.mux.channel.Close()
 			log.WithTraceFields(LogFields{"error": err}).Debug("downstream UDP relay failed")
 			break
 		}
@@ -357,18 +365,6 @@ func (portForward *udpPortForward) relayDownstream() {
 			"connID":    portForward.connID}).Debug("exiting")
 }
 
-// TODO: express and/or calculate udpgwProtocolMaxPayloadSize as function of MTU?
-const (
-	udpgwProtocolFlagKeepalive = 1 << 0
-	udpgwProtocolFlagRebind    = 1 << 1
-	udpgwProtocolFlagDNS       = 1 << 2
-	udpgwProtocolFlagIPv6      = 1 << 3
-
-	udpgwProtocolMaxPreambleSize = 23
-	udpgwProtocolMaxPayloadSize  = 32768
-	udpgwProtocolMaxMessageSize  = udpgwProtocolMaxPreambleSize + udpgwProtocolMaxPayloadSize
-)
-
 type udpgwProtocolMessage struct {
 	connID              uint16
 	preambleSize        int
@@ -417,7 +413,7 @@ func readUdpgwMessage(
 
 		// Ignore udpgw keep-alive messages -- read another message
 
-		if flags&udpgwProtocolFlagKeepalive == udpgwProtocolFlagKeepalive {
+		if flags&udpgw.PROTOCOL_FLAG_KEEPALIVE == udpgw.PROTOCOL_FLAG_KEEPALIVE {
 			continue
 		}
 
@@ -427,7 +423,7 @@ func readUdpgwMessage(
 		var remotePort uint16
 		var packetStart, packetEnd int
 
-		if flags&udpgwProtocolFlagIPv6 == udpgwProtocolFlagIPv6 {
+		if flags&udpgw.PROTOCOL_FLAG_IPV6 == udpgw.PROTOCOL_FLAG_IPV6 {
 
 			if size < 21 {
 				return nil, errors.TraceNew("invalid udpgw message size")
@@ -460,8 +456,8 @@ func readUdpgwMessage(
 			preambleSize:        packetStart,
 			remoteIP:            remoteIP,
 			remotePort:          remotePort,
-			discardExistingConn: flags&udpgwProtocolFlagRebind == udpgwProtocolFlagRebind,
-			forwardDNS:          flags&udpgwProtocolFlagDNS == udpgwProtocolFlagDNS,
+			discardExistingConn: flags&udpgw.PROTOCOL_FLAG_REBIND == udpgw.PROTOCOL_FLAG_REBIND,
+			forwardDNS:          flags&udpgw.PROTOCOL_FLAG_DNS == udpgw.PROTOCOL_FLAG_DNS,
 			packet:              buffer[packetStart:packetEnd],
 		}
 
@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpgw"
+)
+
+// runPacketTunnelStack runs a userspace packet tunnel for the client. The
+// client's packet tunnel flows are terminated in a tun.Stack and each flow
+// is then handled as an ordinary port forward: TCP flows are dispatched
+// via the TCP port forward manager queue, and UDP flows are relayed in the
+// same manner as udpgw port forwards. As a result, traffic rules, OSL
+// seeding, blocklist checks, and port forward limits and metrics all apply
+// as usual.
+func (sshClient *sshClient) runPacketTunnelStack(
+	waitGroup *sync.WaitGroup,
+	channel ssh.Channel,
+	newTCPPortForwards chan *newTCPPortForward) {
+
+	// Each packet tunnel has its own UDP port forward LRU, as with each
+	// udpgw channel.
+	UDPPortForwardLRU := common.NewLRUConns()
+
+	// The stack flow limit is set to the traffic rules port forward limits,
+	// so that each flow's buffers are allocated only for flows that may be
+	// port forwarded. As with the TCP port forward queue size, the limit is
+	// set once and doesn't change, for this client, when traffic rules are
+	// reloaded.
+
+	stack, err := tun.NewStack(&tun.StackConfig{
+		Logger:    CommonLogger(log),
+		Transport: channel,
+		DownstreamPacketQueueSize: sshClient.sshServer.support.Config.
+			PacketTunnelDownstreamPacketQueueSize,
+		MaxFlows: sshClient.getPacketTunnelStackMaxFlows(),
+		HandleTCPConn: func(conn *tun.StackTCPConn) {
+			sshClient.handlePacketTunnelTCPConn(conn, newTCPPortForwards)
+		},
+		HandleUDPConn: func(conn *tun.StackUDPConn) {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				sshClient.handlePacketTunnelUDPConn(conn, UDPPortForwardLRU)
+			}()
+		},
+	})
+	if err != nil {
+		log.WithTraceFields(LogFields{"error": err}).Warning("start packet tunnel stack failed")
+		sshClient.setPacketTunnelChannel(nil)
+		return
+	}
+
+	// Any previous stack is stopped by setPacketTunnelStack, which must be
+	// called before runTunnel stops the TCP port forward manager.
+
+	stack.Start()
+
+	sshClient.setPacketTunnelStack(stack)
+}
+
+func (sshClient *sshClient) handlePacketTunnelTCPConn(
+	conn *tun.StackTCPConn,
+	newTCPPortForwards chan *newTCPPortForward) {
+
+	// This is called from the tun.Stack packet processing goroutine, so the
+	// new port forward is enqueued without blocking and rejected, with a TCP
+	// reset, when the queue is full.
+
+	localAddr := conn.LocalAddr().(*net.TCPAddr)
+
+	hostToConnect := localAddr.IP.String()
+	portToConnect := localAddr.Port
+
+	isTransparentDNS := conn.IsTransparentDNS()
+	if isTransparentDNS {
+		hostToConnect = sshClient.sshServer.support.DNSResolver.Get().String()
+		portToConnect = DNS_RESOLVER_PORT
+	}
+
+	newChannel := &packetTunnelNewChannel{conn: conn}
+
+	tcpPortForward := &newTCPPortForward{
+		enqueueTime:      time.Now(),
+		hostToConnect:    hostToConnect,
+		portToConnect:    portToConnect,
+		hostname:         conn.Hostname(),
+		isTransparentDNS: isTransparentDNS,
+		newChannel:       newChannel,
+	}
+
+	select {
+	case newTCPPortForwards <- tcpPortForward:
+	default:
+		sshClient.updateQualityMetricsWithRejectedDialingLimit()
+		sshClient.rejectNewChannel(newChannel, "TCP port forward dial queue full")
+	}
+}
+
+func (sshClient *sshClient) handlePacketTunnelUDPConn(
+	conn *tun.StackUDPConn,
+	portForwardLRU *common.LRUConns) {
+
+	defer conn.Close()
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	dialIP := localAddr.IP
+	dialPort := localAddr.Port
+
+	if conn.IsTransparentDNS() {
+		// Transparent DNS forwarding. In this case, traffic rules
+		// checks are bypassed, since DNS is essential.
+		dialIP = sshClient.sshServer.support.DNSResolver.Get()
+		dialPort = DNS_RESOLVER_PORT
+
+	} else {
+
+		// As with udpgw, there's no error response when the port forward is
+		// not permitted; the flow is dropped. Unlike udpgw, the domain, when
+		// known, is also checked against the domain blocklist, as is done
+		// for TCP flows in handleTCPChannel.
+
+		hostname := conn.Hostname()
+		if hostname != "" {
+			if ok, _ := sshClient.isDomainPermitted(hostname); !ok {
+				return
+			}
+		}
+
+		if !sshClient.isPortForwardPermitted(
+			portForwardTypeUDP, hostname, dialIP, dialPort) {
+			return
+		}
+	}
+
+	// establishedPortForward increments the concurrent UDP port
+	// forward counter and closes the LRU existing UDP port forward
+	// when already at the limit.
+
+	sshClient.establishedPortForward(portForwardTypeUDP, portForwardLRU)
+
+	var bytesUp, bytesDown int64
+	defer func() {
+		sshClient.closedPortForward(
+			portForwardTypeUDP, atomic.LoadInt64(&bytesUp), atomic.LoadInt64(&bytesDown))
+	}()
+
+	udpConn, err := net.DialUDP(
+		"udp", nil, &net.UDPAddr{IP: dialIP, Port: dialPort})
+	if err != nil {
+
+		// Monitor for low resource error conditions
+		sshClient.sshServer.monitorPortForwardDialError(err)
+
+		// Note: Debug level, as logMessage may contain user traffic destination address information
+		log.WithTraceFields(LogFields{"error": err}).Debug("DialUDP failed")
+		return
+	}
+
+	lruEntry := portForwardLRU.Add(udpConn)
+	defer lruEntry.Remove()
+
+	// Ensure nil interface if newClientSeedPortForward returns nil
+	var updater common.ActivityUpdater
+	seedUpdater := sshClient.newClientSeedPortForward(dialIP)
+	if seedUpdater != nil {
+		updater = seedUpdater
+	}
+
+	fwdConn, err := common.NewActivityMonitoredConn(
+		udpConn,
+		sshClient.idleUDPPortForwardTimeout(),
+		true,
+		updater,
+		lruEntry)
+	if err != nil {
+		udpConn.Close()
+		log.WithTraceFields(LogFields{"error": err}).Error("NewActivityMonitoredConn failed")
+		return
+	}
+	defer fwdConn.Close()
+
+	// Relay datagrams. Each Read and Write on both conns is a single
+	// datagram. The relay ends when either conn is closed or, via
+	// ActivityMonitoredConn, when the port forward is idle.
+
+	relayWaitGroup := new(sync.WaitGroup)
+	relayWaitGroup.Add(1)
+	go func() {
+		defer relayWaitGroup.Done()
+		buffer := make([]byte, udpgw.PROTOCOL_MAX_PAYLOAD_SIZE)
+		for {
+			n, err := fwdConn.Read(buffer)
+			if err == nil {
+				_, err = conn.Write(buffer[:n])
+			}
+			if err != nil {
+				if err != io.EOF {
+					// Debug since errors such as "use of closed network connection" occur during normal operation
+					log.WithTraceFields(LogFields{"error": err}).Debug("downstream UDP relay failed")
+				}
+				break
+			}
+			atomic.AddInt64(&bytesDown, int64(n))
+		}
+		// Interrupt the upstream relay.
+		conn.Close()
+	}()
+
+	buffer := make([]byte, udpgw.PROTOCOL_MAX_PAYLOAD_SIZE)
+	for {
+		n, err := conn.Read(buffer)
+		if err == nil {
+			_, err = fwdConn.Write(buffer[:n])
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.WithTraceFields(LogFields{"error": err}).Debug("upstream UDP relay failed")
+			}
+			break
+		}
+		atomic.AddInt64(&bytesUp, int64(n))
+	}
+	// Interrupt the downstream relay.
+	fwdConn.Close()
+
+	relayWaitGroup.Wait()
+}
+
+// packetTunnelNewChannel adapts a tun.StackTCPConn to the ssh.NewChannel
+// interface, so that userspace packet tunnel TCP flows may be handled by
+// the TCP port forward manager and handleTCPChannel. Accepting the channel
+// completes the TCP handshake with the client and rejecting it resets the
+// flow.
+type packetTunnelNewChannel struct {
+	conn *tun.StackTCPConn
+}
+
+func (newChannel *packetTunnelNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	err := newChannel.conn.Accept()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	requests := make(chan *ssh.Request)
+	close(requests)
+	return &packetTunnelTCPChannel{StackTCPConn: newChannel.conn}, requests, nil
+}
+
+func (newChannel *packetTunnelNewChannel) Reject(_ ssh.RejectionReason, _ string) error {
+	newChannel.conn.Reject()
+	return nil
+}
+
+func (newChannel *packetTunnelNewChannel) ChannelType() string {
+	return "direct-tcpip"
+}
+
+func (newChannel *packetTunnelNewChannel) ExtraData() []byte {
+	return nil
+}
+
+// packetTunnelTCPChannel implements ssh.Channel for an accepted
+// tun.StackTCPConn. There are no channel requests or extended data.
+type packetTunnelTCPChannel struct {
+	*tun.StackTCPConn
+}
+
+func (channel *packetTunnelTCPChannel) SendRequest(
+	_ string, _ bool, _ []byte) (bool, error) {
+
+	return false, errors.TraceNew("not supported")
+}
+
+func (channel *packetTunnelTCPChannel) Stderr() io.ReadWriter {
+	return struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(""), ioutil.Discard}
+}
@@ -89,7 +89,7 @@ func RunWebServer(
 	// https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts
 
 	server := &HTTPSServer{
-		&http.Server{
+		Server: &http.Server{
 			MaxHeaderBytes: MAX_API_PARAMS_SIZE,
 			Handler:        serveMux,
 			ReadTimeout:    WEB_SERVER_IO_TIMEOUT,
@@ -207,8 +207,23 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		return errors.Trace(err)
 	}
 
-	serverContext.clientRegion = handshakeResponse.ClientRegion
-	NoticeClientRegion(serverContext.clientRegion)
+	// For multi-hop tunnels, the entry server sees the client IP address
+	// and reports the client region, while the exit server sees the entry
+	// server IP address. So only the entry handshake reports the client
+	// region, which the exit tunnel also uses, and only the exit handshake,
+	// made through the active tunnel, reports user-facing values such as
+	// homepages.
+
+	isMultiHopEntry := serverContext.tunnel.dialParams.IsMultiHopEntry
+	isMultiHopExit := serverContext.tunnel.dialParams.MultiHopEntryTunnel != nil
+
+	if isMultiHopExit {
+		serverContext.clientRegion =
+			serverContext.tunnel.dialParams.MultiHopEntryTunnel.serverContext.clientRegion
+	} else {
+		serverContext.clientRegion = handshakeResponse.ClientRegion
+		NoticeClientRegion(serverContext.clientRegion)
+	}
 
 	var serverEntries []protocol.ServerEntryFields
 
@@ -256,13 +271,17 @@ func (serverContext *ServerContext) doHandshakeRequest(
 		return errors.Trace(err)
 	}
 
-	NoticeHomepages(handshakeResponse.Homepages)
-
 	serverContext.clientUpgradeVersion = handshakeResponse.UpgradeClientVersion
-	if handshakeResponse.UpgradeClientVersion != "" {
-		NoticeClientUpgradeAvailable(handshakeResponse.UpgradeClientVersion)
-	} else {
-		NoticeClientIsLatestVersion("")
+
+	if !isMultiHopEntry {
+
+		NoticeHomepages(handshakeResponse.Homepages)
+
+		if handshakeResponse.UpgradeClientVersion != "" {
+			NoticeClientUpgradeAvailable(handshakeResponse.UpgradeClientVersion)
+		} else {
+			NoticeClientIsLatestVersion("")
+		}
 	}
 
 	if !ignoreStatsRegexps {
@@ -910,6 +929,11 @@ func getBaseAPIParameters(
 		params["dial_port_number"] = dialParams.DialPortNumber
 	}
 
+	dialIPVersion := dialParams.GetIPVersionForMetrics()
+	if dialIPVersion != "" {
+		params["dial_ip_version"] = dialIPVersion
+	}
+
 	if dialParams.QUICVersion != "" {
 		params["quic_version"] = dialParams.QUICVersion
 	}
@@ -20,22 +20,44 @@
 package psiphon
 
 import (
+	"encoding/binary"
+	std_errors "errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Psiphon-Labs/goarista/monotime"
 	socks "github.com/Psiphon-Labs/goptlib"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpgw"
 )
 
 // SocksProxy is a SOCKS server that accepts local host connections
 // and, for each connection, establishes a port forward through
 // the tunnel SSH client and relays traffic through the port
 // forward.
+//
+// When config.UdpgwServerAddress is set, SocksProxy also supports the SOCKS5
+// UDP ASSOCIATE command. UDP datagrams sent by the local client are relayed
+// through the tunnel using the udpgw protocol.
+//
+// When config.LocalProxyCredentials is set, SocksProxy requires SOCKS5
+// username/password authentication.
 type SocksProxy struct {
+	config                 *Config
 	tunneler               Tunneler
+	authenticator          *localProxyAuthenticator
+	udpgwClient            *udpgwClient
+	ownsUdpgwClient        bool
+	splitTunnelPolicy      *SplitTunnelPolicy
 	listener               *socks.SocksListener
 	serveWaitGroup         *sync.WaitGroup
 	openConns              *common.Conns
@@ -52,6 +74,33 @@ func NewSocksProxy(
 	tunneler Tunneler,
 	listenIP string) (proxy *SocksProxy, err error) {
 
+	var client *udpgwClient
+	if config.UdpgwServerAddress != "" {
+		client = newUdpgwClient(tunneler, config.UdpgwServerAddress)
+	}
+
+	proxy, err = newSocksProxy(config, tunneler, client, nil, listenIP)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	proxy.ownsUdpgwClient = client != nil
+
+	return proxy, nil
+}
+
+// newSocksProxy initializes a new SOCKS server which relays UDP ASSOCIATE
+// flows through the specified udpgwClient, which may be shared with other
+// udpgw users. When udpgwClient is nil, UDP ASSOCIATE is not supported.
+//
+// splitTunnelPolicy, when not nil, is applied to UDP ASSOCIATE flows. TCP
+// CONNECT destinations are classified by the tunneler.
+func newSocksProxy(
+	config *Config,
+	tunneler Tunneler,
+	udpgwClient *udpgwClient,
+	splitTunnelPolicy *SplitTunnelPolicy,
+	listenIP string) (proxy *SocksProxy, err error) {
+
 	listener, err := socks.ListenSocks(
 		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalSocksProxyPort))
 	if err != nil {
@@ -61,12 +110,22 @@ func NewSocksProxy(
 		return nil, errors.Trace(err)
 	}
 	proxy = &SocksProxy{
+		config:                 config,
 		tunneler:               tunneler,
+		authenticator:          newLocalProxyAuthenticator(config, _SOCKS_PROXY_TYPE),
+		udpgwClient:            udpgwClient,
+		splitTunnelPolicy:      splitTunnelPolicy,
 		listener:               listener,
 		serveWaitGroup:         new(sync.WaitGroup),
 		openConns:              common.NewConns(),
 		stopListeningBroadcast: make(chan struct{}),
 	}
+	if proxy.authenticator != nil {
+		listener.Authenticate = func(username, password string) bool {
+			_, ok := proxy.authenticator.authenticate(username, password)
+			return ok
+		}
+	}
 	proxy.serveWaitGroup.Add(1)
 	go proxy.serve()
 	NoticeListeningSocksProxyPort(proxy.listener.Addr().(*net.TCPAddr).Port)
@@ -80,6 +139,12 @@ func (proxy *SocksProxy) Close() {
 	proxy.listener.Close()
 	proxy.serveWaitGroup.Wait()
 	proxy.openConns.CloseAll()
+	if proxy.ownsUdpgwClient {
+		proxy.udpgwClient.close()
+	}
+	if proxy.authenticator != nil {
+		proxy.authenticator.close()
+	}
 }
 
 func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err error) {
@@ -88,6 +153,18 @@ func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err
 
 	proxy.openConns.Add(localConn)
 
+	// The listener has already authenticated the client, so the username is
+	// valid and is used only to select the stats.
+
+	var stats *localProxyCredentialStats
+	if proxy.authenticator != nil {
+		stats = proxy.authenticator.stats[localConn.Req.Username]
+	}
+
+	if localConn.Req.Command == socks.SocksCmdUDPAssociate {
+		return proxy.socksUDPAssociateHandler(localConn, stats)
+	}
+
 	// Using downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
 	// This ensures that the downstream client (e.g., web browser) doesn't keep waiting on the
 	// open connection for data which will never arrive.
@@ -100,6 +177,8 @@ func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err
 		// TODO: retain error type and check for ssh.OpenChannelError
 		if strings.Contains(err.Error(), "ssh: rejected") {
 			reason = byte(socks.SocksRepConnectionRefused)
+		} else if std_errors.Is(err, errSplitTunnelPolicyBlocked) {
+			reason = byte(socks.SocksRepConnectionNotAllowed)
 		}
 
 		_ = localConn.RejectReason(reason)
@@ -113,11 +192,330 @@ func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err
 		return errors.Trace(err)
 	}
 
-	LocalProxyRelay(_SOCKS_PROXY_TYPE, localConn, remoteConn)
+	var relayConn net.Conn = localConn
+	if stats != nil {
+		relayConn = newLocalProxyAccountingConn(localConn, stats)
+	}
+
+	LocalProxyRelay(_SOCKS_PROXY_TYPE, relayConn, remoteConn)
 
 	return nil
 }
 
+// socksUDPAssociateHandler handles a SOCKS5 UDP ASSOCIATE request. A local
+// UDP relay socket is opened and its address is returned to the client. UDP
+// datagrams received from the client are relayed to their destinations
+// through udpgw, and UDP datagrams received from destinations are relayed
+// back to the client.
+//
+// As specified in RFC 1928, the association ends when the TCP control
+// connection, localConn, is closed. The association also ends when no
+// datagrams are relayed in either direction for the
+// SOCKSProxyUDPAssociationIdleTimeout period.
+//
+// When stats is not nil, relayed UDP payload bytes are counted.
+func (proxy *SocksProxy) socksUDPAssociateHandler(
+	localConn *socks.SocksConn, stats *localProxyCredentialStats) error {
+
+	if proxy.udpgwClient == nil {
+		_ = localConn.RejectReason(byte(socks.SocksRepCommandNotSupported))
+		return errors.TraceNew("UDP ASSOCIATE not supported")
+	}
+
+	// The UDP relay socket listens on the same local IP address as the
+	// SOCKS proxy.
+
+	localIP := localConn.LocalAddr().(*net.TCPAddr).IP
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP, Port: 0})
+	if err != nil {
+		_ = localConn.Reject()
+		return errors.Trace(err)
+	}
+	defer udpConn.Close()
+
+	proxy.openConns.Add(udpConn)
+	defer proxy.openConns.Remove(udpConn)
+
+	err = localConn.GrantUDPAssociate(udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	association := &socksUDPAssociation{
+		proxy:      proxy,
+		udpConn:    udpConn,
+		clientIP:   localConn.RemoteAddr().(*net.TCPAddr).IP,
+		stats:      stats,
+		flows:      make(map[string]*udpgwFlow),
+		lastActive: int64(monotime.Now()),
+	}
+	defer association.closeFlows()
+
+	// The control connection carries no further data. Any read result,
+	// including EOF, ends the association.
+
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, localConn)
+		udpConn.Close()
+	}()
+
+	err = association.relayUpstream()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// socksUDPAssociation is the state of a single SOCKS5 UDP association.
+type socksUDPAssociation struct {
+	proxy      *SocksProxy
+	udpConn    *net.UDPConn
+	clientIP   net.IP
+	stats      *localProxyCredentialStats
+	lastActive int64
+
+	mutex      sync.Mutex
+	clientAddr *net.UDPAddr
+	flows      map[string]*udpgwFlow
+}
+
+// relayUpstream reads and relays UDP datagrams from the client until the
+// association is closed or idle.
+func (association *socksUDPAssociation) relayUpstream() error {
+
+	p := association.proxy.config.GetClientParameters().Get()
+	idleTimeout := p.Duration(parameters.SOCKSProxyUDPAssociationIdleTimeout)
+
+	buffer := make([]byte, udpgw.PROTOCOL_MAX_PAYLOAD_SIZE+socksUDPMaxHeaderSize)
+
+	for {
+
+		// Set a read deadline to check for idle timeout. lastActive is also
+		// updated by downstream relay activity, so the association isn't
+		// considered idle when only downstream datagrams are flowing.
+
+		lastActive := monotime.Time(atomic.LoadInt64(&association.lastActive))
+		err := association.udpConn.SetReadDeadline(
+			time.Now().Add(idleTimeout - monotime.Since(lastActive)))
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		n, clientAddr, err := association.udpConn.ReadFromUDP(buffer)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				lastActive := monotime.Time(atomic.LoadInt64(&association.lastActive))
+				if monotime.Since(lastActive) < idleTimeout {
+					continue
+				}
+				NoticeInfo("SOCKS UDP association idle timeout")
+				return nil
+			}
+			// Other read errors, including "use of closed network
+			// connection" when the control connection is closed, end the
+			// association as normal.
+			return nil
+		}
+
+		// Datagrams are accepted only from the client host that established
+		// the association. The first accepted datagram fixes the client
+		// port; subsequent datagrams from other ports are dropped.
+
+		if !clientAddr.IP.Equal(association.clientIP) {
+			continue
+		}
+
+		association.mutex.Lock()
+		if association.clientAddr == nil {
+			association.clientAddr = clientAddr
+		}
+		expectedClientAddr := association.clientAddr
+		association.mutex.Unlock()
+
+		if clientAddr.Port != expectedClientAddr.Port {
+			continue
+		}
+
+		remoteIP, remotePort, packet, err := parseSocksUDPDatagram(buffer[:n])
+		if err != nil {
+			// Malformed, fragmented, and domain name datagrams are dropped.
+			continue
+		}
+
+		atomic.StoreInt64(&association.lastActive, int64(monotime.Now()))
+
+		flow, err := association.getFlow(remoteIP, remotePort)
+		if err != nil {
+			// Only this datagram is dropped; the association and its other
+			// flows remain.
+			if std_errors.Is(err, errSplitTunnelPolicyBlocked) {
+				continue
+			}
+			NoticeWarning("SOCKS UDP flow failed: %s", errors.Trace(err))
+			continue
+		}
+
+		if association.stats != nil {
+			atomic.AddInt64(&association.stats.bytesSent, int64(len(packet)))
+		}
+
+		err = flow.send(packet)
+		if err != nil {
+			// The udpgw port forward will be redialed on the next send, so
+			// this datagram is dropped, as with any UDP packet loss.
+			NoticeWarning("SOCKS UDP relay failed: %s", errors.Trace(err))
+		}
+	}
+}
+
+// getFlow returns the udpgw flow for the specified destination, creating a
+// new flow as required.
+func (association *socksUDPAssociation) getFlow(
+	remoteIP net.IP, remotePort int) (*udpgwFlow, error) {
+
+	key := net.JoinHostPort(remoteIP.String(), strconv.Itoa(remotePort))
+
+	association.mutex.Lock()
+	defer association.mutex.Unlock()
+
+	flow, ok := association.flows[key]
+	if ok {
+		return flow, nil
+	}
+
+	// As Controller.Dial does for TCP port forwards, apply the local split
+	// tunnel policy. Since udpgw flows are always tunneled, destinations
+	// classified as direct are tunneled. Blocked destinations get no flow, so
+	// the policy is applied to each datagram and a policy reload takes effect
+	// for subsequent datagrams.
+
+	policy := association.proxy.splitTunnelPolicy
+	if policy != nil &&
+		policy.Classify(remoteIP.String(), remotePort) == SPLIT_TUNNEL_POLICY_ACTION_BLOCK {
+
+		return nil, errors.Trace(errSplitTunnelPolicyBlocked)
+	}
+
+	header := makeSocksUDPHeader(remoteIP, remotePort)
+
+	flow, err := association.proxy.udpgwClient.newFlow(
+		remoteIP,
+		remotePort,
+		false,
+		func(packet []byte) {
+			association.relayDownstream(header, packet)
+		})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	association.flows[key] = flow
+
+	return flow, nil
+}
+
+// relayDownstream sends a UDP datagram, received from a destination, to the
+// client. relayDownstream is called from the udpgwClient read goroutine.
+func (association *socksUDPAssociation) relayDownstream(header, packet []byte) {
+
+	association.mutex.Lock()
+	clientAddr := association.clientAddr
+	association.mutex.Unlock()
+
+	if clientAddr == nil {
+		return
+	}
+
+	atomic.StoreInt64(&association.lastActive, int64(monotime.Now()))
+
+	datagram := make([]byte, len(header)+len(packet))
+	copy(datagram, header)
+	copy(datagram[len(header):], packet)
+
+	// Errors are ignored; as with any UDP packet loss, the client must
+	// handle dropped datagrams.
+	_, err := association.udpConn.WriteToUDP(datagram, clientAddr)
+	if err == nil && association.stats != nil {
+		atomic.AddInt64(&association.stats.bytesReceived, int64(len(packet)))
+	}
+}
+
+func (association *socksUDPAssociation) closeFlows() {
+	association.mutex.Lock()
+	defer association.mutex.Unlock()
+
+	for _, flow := range association.flows {
+		flow.close()
+	}
+	association.flows = make(map[string]*udpgwFlow)
+}
+
+const (
+	socksUDPAddressTypeIPv4       = 0x01
+	socksUDPAddressTypeDomainName = 0x03
+	socksUDPAddressTypeIPv6       = 0x04
+	socksUDPMaxHeaderSize         = 4 + net.IPv6len + 2
+)
+
+// parseSocksUDPDatagram parses a SOCKS5 UDP request header, as specified in
+// RFC 1928 section 7, and returns the destination address and the payload.
+// Fragmentation and domain name destinations are not supported.
+//
+// | RSV (2) | FRAG (1) | ATYP (1) | DST.ADDR (variable) | DST.PORT (2) | DATA |
+func parseSocksUDPDatagram(datagram []byte) (net.IP, int, []byte, error) {
+
+	if len(datagram) < 4 {
+		return nil, 0, nil, errors.TraceNew("invalid datagram")
+	}
+
+	if datagram[2] != 0 {
+		return nil, 0, nil, errors.TraceNew("fragmentation not supported")
+	}
+
+	var addressSize int
+	switch datagram[3] {
+	case socksUDPAddressTypeIPv4:
+		addressSize = net.IPv4len
+	case socksUDPAddressTypeIPv6:
+		addressSize = net.IPv6len
+	case socksUDPAddressTypeDomainName:
+		return nil, 0, nil, errors.TraceNew("domain name address not supported")
+	default:
+		return nil, 0, nil, errors.TraceNew("invalid address type")
+	}
+
+	headerSize := 4 + addressSize + 2
+	if len(datagram) < headerSize {
+		return nil, 0, nil, errors.TraceNew("invalid datagram")
+	}
+
+	remoteIP := make(net.IP, addressSize)
+	copy(remoteIP, datagram[4:4+addressSize])
+	remotePort := int(binary.BigEndian.Uint16(datagram[4+addressSize : headerSize]))
+
+	return remoteIP, remotePort, datagram[headerSize:], nil
+}
+
+// makeSocksUDPHeader returns a SOCKS5 UDP header for the specified source
+// address, which is prepended to datagrams relayed to the client.
+func makeSocksUDPHeader(remoteIP net.IP, remotePort int) []byte {
+
+	addressType := byte(socksUDPAddressTypeIPv6)
+	if ipv4 := remoteIP.To4(); ipv4 != nil {
+		addressType = socksUDPAddressTypeIPv4
+		remoteIP = ipv4
+	}
+
+	header := make([]byte, 4+len(remoteIP)+2)
+	header[3] = addressType
+	copy(header[4:], remoteIP)
+	binary.BigEndian.PutUint16(header[4+len(remoteIP):], uint16(remotePort))
+
+	return header
+}
+
 func (proxy *SocksProxy) serve() {
 	defer proxy.listener.Close()
 	defer proxy.serveWaitGroup.Done()
@@ -0,0 +1,457 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/datagram"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpgw"
+)
+
+func TestSocksUDPAssociate(t *testing.T) {
+	runSocksUDPAssociateTest(t, false)
+}
+
+func TestSocksUDPAssociateDatagramChannel(t *testing.T) {
+	runSocksUDPAssociateTest(t, true)
+}
+
+func runSocksUDPAssociateTest(t *testing.T, supportsDatagramChannel bool) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-socks-udp-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	config := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataRootDirectory:    testDataDirName,
+		UdpgwServerAddress:   "127.0.0.1:7300",
+	}
+
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	tunneler := &testUdpgwTunneler{
+		supportsDatagramChannel: supportsDatagramChannel,
+	}
+	defer tunneler.close()
+
+	policyFilename := filepath.Join(testDataDirName, "policy.json")
+
+	err = ioutil.WriteFile(
+		policyFilename,
+		[]byte(`{"Rules" : [{"Action" : "block", "CIDRs" : ["192.0.2.4/32"]}]}`),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	policy, err := NewSplitTunnelPolicy(policyFilename)
+	if err != nil {
+		t.Fatalf("NewSplitTunnelPolicy failed: %s", err)
+	}
+
+	proxy, err := NewSocksProxy(config, tunneler, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	proxy.splitTunnelPolicy = policy
+
+	controlConn, err := net.Dial("tcp", proxy.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer controlConn.Close()
+
+	relayAddr, err := testSocksUDPAssociate(controlConn)
+	if err != nil {
+		t.Fatalf("testSocksUDPAssociate failed: %s", err)
+	}
+
+	udpConn, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("DialUDP failed: %s", err)
+	}
+	defer udpConn.Close()
+
+	destinations := []struct {
+		IP   net.IP
+		Port int
+	}{
+		{net.ParseIP("192.0.2.1"), 53},
+		{net.ParseIP("192.0.2.2"), 123},
+		{net.ParseIP("2001:db8::1"), 443},
+	}
+
+	for i, destination := range destinations {
+
+		payload := bytes.Repeat([]byte{byte(i)}, 100+i)
+
+		datagram := append(
+			makeSocksUDPHeader(destination.IP, destination.Port), payload...)
+
+		_, err = udpConn.Write(datagram)
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+
+		buffer := make([]byte, 65536)
+		udpConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := udpConn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Read failed: %s", err)
+		}
+
+		remoteIP, remotePort, echoPayload, err := parseSocksUDPDatagram(buffer[:n])
+		if err != nil {
+			t.Fatalf("parseSocksUDPDatagram failed: %s", err)
+		}
+
+		if !remoteIP.Equal(destination.IP) || remotePort != destination.Port {
+			t.Fatalf("unexpected source address: %s:%d", remoteIP, remotePort)
+		}
+
+		if !bytes.Equal(echoPayload, payload) {
+			t.Fatalf("unexpected payload")
+		}
+	}
+
+	echo := func(destinationIndex int, payload []byte) error {
+		destination := destinations[destinationIndex]
+		datagram := append(
+			makeSocksUDPHeader(destination.IP, destination.Port), payload...)
+		_, err := udpConn.Write(datagram)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		buffer := make([]byte, 65536)
+		udpConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err := udpConn.Read(buffer)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		_, _, echoPayload, err := parseSocksUDPDatagram(buffer[:n])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !bytes.Equal(echoPayload, payload) {
+			return errors.TraceNew("unexpected payload")
+		}
+		return nil
+	}
+
+	// When a new flow can't be created, only that datagram is dropped, and
+	// the association and its existing flows remain.
+
+	udpgwClient := proxy.udpgwClient
+	var fillerConnIDs []uint16
+	udpgwClient.mutex.Lock()
+	for connID := 0; len(udpgwClient.flows) < 65536; connID++ {
+		if _, ok := udpgwClient.flows[uint16(connID)]; !ok {
+			udpgwClient.flows[uint16(connID)] = &udpgwFlow{}
+			fillerConnIDs = append(fillerConnIDs, uint16(connID))
+		}
+	}
+	udpgwClient.mutex.Unlock()
+
+	destinations = append(destinations, struct {
+		IP   net.IP
+		Port int
+	}{net.ParseIP("192.0.2.3"), 53})
+
+	err = echo(len(destinations)-1, []byte{1})
+	if err == nil {
+		t.Fatalf("unexpected response for new flow")
+	}
+
+	err = echo(0, []byte{2})
+	if err != nil {
+		t.Fatalf("echo failed: %s", err)
+	}
+
+	udpgwClient.mutex.Lock()
+	for _, connID := range fillerConnIDs {
+		delete(udpgwClient.flows, connID)
+	}
+	udpgwClient.mutex.Unlock()
+
+	err = echo(len(destinations)-1, []byte{3})
+	if err != nil {
+		t.Fatalf("echo failed: %s", err)
+	}
+
+	// Datagrams to destinations blocked by the split tunnel policy are
+	// dropped, and no flow is created.
+
+	udpgwClient.mutex.Lock()
+	flowCount := len(udpgwClient.flows)
+	udpgwClient.mutex.Unlock()
+
+	destinations = append(destinations, struct {
+		IP   net.IP
+		Port int
+	}{net.ParseIP("192.0.2.4"), 53})
+
+	err = echo(len(destinations)-1, []byte{4})
+	if err == nil {
+		t.Fatalf("unexpected response for blocked destination")
+	}
+
+	udpgwClient.mutex.Lock()
+	newFlowCount := len(udpgwClient.flows)
+	udpgwClient.mutex.Unlock()
+
+	if newFlowCount != flowCount {
+		t.Fatalf("unexpected flow for blocked destination")
+	}
+
+	err = echo(0, []byte{5})
+	if err != nil {
+		t.Fatalf("echo failed: %s", err)
+	}
+
+	// Fragmented datagrams are dropped.
+
+	datagram := makeSocksUDPHeader(destinations[0].IP, destinations[0].Port)
+	datagram[2] = 1
+	_, err = udpConn.Write(append(datagram, 0))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	udpConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = udpConn.Read(make([]byte, 65536))
+	if err == nil {
+		t.Fatalf("unexpected fragmented datagram response")
+	}
+
+	// Closing the control connection ends the association.
+
+	controlConn.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	datagram = makeSocksUDPHeader(destinations[0].IP, destinations[0].Port)
+	_, _ = udpConn.Write(append(datagram, 0))
+
+	udpConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = udpConn.Read(make([]byte, 65536))
+	if err == nil {
+		t.Fatalf("unexpected response after association closed")
+	}
+
+	// udpgw uses a datagram channel, when supported, instead of a port
+	// forward.
+
+	tunneler.mutex.Lock()
+	portForwardCount := tunneler.portForwardCount
+	datagramChannelCount := tunneler.datagramChannelCount
+	tunneler.mutex.Unlock()
+
+	if supportsDatagramChannel {
+		if portForwardCount != 0 || datagramChannelCount != 1 {
+			t.Fatalf("unexpected udpgw dials: %d, %d", portForwardCount, datagramChannelCount)
+		}
+	} else {
+		if portForwardCount != 1 || datagramChannelCount != 0 {
+			t.Fatalf("unexpected udpgw dials: %d, %d", portForwardCount, datagramChannelCount)
+		}
+	}
+}
+
+// testSocksUDPAssociate performs a SOCKS5 handshake and UDP ASSOCIATE
+// request and returns the relay address.
+func testSocksUDPAssociate(conn net.Conn) (*net.UDPAddr, error) {
+
+	_, err := conn.Write([]byte{0x05, 0x01, 0x00})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	response := make([]byte, 2)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !bytes.Equal(response, []byte{0x05, 0x00}) {
+		return nil, errors.TraceNew("unexpected auth response")
+	}
+
+	_, err = conn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	response = make([]byte, 10)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if response[1] != 0x00 || response[3] != 0x01 {
+		return nil, errors.TraceNew("unexpected UDP ASSOCIATE response")
+	}
+
+	return &net.UDPAddr{
+		IP:   net.IP(response[4:8]),
+		Port: int(binary.BigEndian.Uint16(response[8:10])),
+	}, nil
+}
+
+// testUdpgwTunneler is a Tunneler which handles udpgw port forwards, and
+// optionally udpgw datagram channels, with an in-process udpgw echo server.
+type testUdpgwTunneler struct {
+	supportsDatagramChannel bool
+
+	mutex                sync.Mutex
+	portForwardCount     int
+	datagramChannelCount int
+	datagramListeners    []*datagram.Listener
+}
+
+func (tunneler *testUdpgwTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	if remoteAddr != "127.0.0.1:7300" || !alwaysTunnel {
+		return nil, errors.TraceNew("unexpected dial")
+	}
+
+	tunneler.mutex.Lock()
+	tunneler.portForwardCount++
+	tunneler.mutex.Unlock()
+
+	clientConn, serverConn := net.Pipe()
+
+	go tunneler.echoUdpgw(serverConn)
+
+	return clientConn, nil
+}
+
+func (tunneler *testUdpgwTunneler) DialDatagramChannel(purpose string) (net.Conn, error) {
+
+	if !tunneler.supportsDatagramChannel {
+		return nil, errors.TraceNew("not supported")
+	}
+
+	if purpose != protocol.DATAGRAM_CHANNEL_PURPOSE_UDPGW {
+		return nil, errors.TraceNew("unexpected purpose")
+	}
+
+	serverPacketConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	listener, err := datagram.Listen(serverPacketConn)
+	if err != nil {
+		serverPacketConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	tunneler.mutex.Lock()
+	tunneler.datagramChannelCount++
+	tunneler.datagramListeners = append(tunneler.datagramListeners, listener)
+	tunneler.mutex.Unlock()
+
+	serverConn, params, err := listener.NewSession()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	clientPacketConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFunc()
+
+	clientConn, err := datagram.Dial(
+		ctx, clientPacketConn, listener.Addr(), params, 1*time.Second, 5*time.Second)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	go tunneler.echoUdpgw(datagram.NewFramedConn(serverConn, udpgw.FrameSize))
+
+	return datagram.NewFramedConn(clientConn, udpgw.FrameSize), nil
+}
+
+func (tunneler *testUdpgwTunneler) close() {
+	tunneler.mutex.Lock()
+	defer tunneler.mutex.Unlock()
+
+	for _, listener := range tunneler.datagramListeners {
+		listener.Close()
+	}
+}
+
+func (tunneler *testUdpgwTunneler) DirectDial(remoteAddr string) (net.Conn, error) {
+	return nil, errors.TraceNew("not supported")
+}
+
+func (tunneler *testUdpgwTunneler) SignalComponentFailure() {
+}
+
+// echoUdpgw echoes each udpgw message back to the client. As the Psiphon
+// server does, downstream messages omit the udpgw flags.
+func (tunneler *testUdpgwTunneler) echoUdpgw(conn net.Conn) {
+	defer conn.Close()
+
+	buffer := make([]byte, udpgw.PROTOCOL_MAX_MESSAGE_SIZE)
+
+	for {
+		_, err := io.ReadFull(conn, buffer[0:2])
+		if err != nil {
+			return
+		}
+		size := int(binary.LittleEndian.Uint16(buffer[0:2]))
+		_, err = io.ReadFull(conn, buffer[2:2+size])
+		if err != nil {
+			return
+		}
+		buffer[2] = 0
+		_, err = conn.Write(buffer[0 : 2+size])
+		if err != nil {
+			return
+		}
+	}
+}
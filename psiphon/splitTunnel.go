@@ -42,7 +42,9 @@ import (
 // to determine if a given IP is to be tunneled or not. If presented
 // with a hostname, the classifier performs a tunneled (uncensored)
 // DNS request to first determine the IP address for that hostname;
-// then a classification is made based on the IP address.
+// then a classification is made based on the IP address. When a
+// tunneled DNS-over-HTTPS or DNS-over-TLS resolver is configured, it is
+// used for these DNS requests in place of SplitTunnelDNSServer.
 //
 // Classification results (both the hostname resolution and the
 // following IP address classification) are cached for the duration
@@ -71,6 +73,7 @@ type SplitTunnelClassifier struct {
 	clientParameters     *parameters.ClientParameters
 	userAgent            string
 	dnsTunneler          Tunneler
+	dnsResolver          *tunneledDNSResolver
 	fetchRoutesWaitGroup *sync.WaitGroup
 	isRoutesSet          bool
 	cache                map[string]*classification
@@ -83,10 +86,21 @@ type classification struct {
 }
 
 func NewSplitTunnelClassifier(config *Config, tunneler Tunneler) *SplitTunnelClassifier {
+	return newSplitTunnelClassifier(config, tunneler, nil)
+}
+
+// newSplitTunnelClassifier initializes a SplitTunnelClassifier which, when
+// dnsResolver is not nil, uses dnsResolver to resolve hostnames.
+func newSplitTunnelClassifier(
+	config *Config,
+	tunneler Tunneler,
+	dnsResolver *tunneledDNSResolver) *SplitTunnelClassifier {
+
 	return &SplitTunnelClassifier{
 		clientParameters:     config.clientParameters,
 		userAgent:            MakePsiphonUserAgent(config),
 		dnsTunneler:          tunneler,
+		dnsResolver:          dnsResolver,
 		fetchRoutesWaitGroup: new(sync.WaitGroup),
 		isRoutesSet:          false,
 		cache:                make(map[string]*classification),
@@ -109,7 +123,7 @@ func (classifier *SplitTunnelClassifier) Start(fetchRoutesTunnel *Tunnel) {
 	routesSignaturePublicKey := p.String(parameters.SplitTunnelRoutesSignaturePublicKey)
 	fetchRoutesUrlFormat := p.String(parameters.SplitTunnelRoutesURLFormat)
 
-	if dnsServerAddress == "" ||
+	if (dnsServerAddress == "" && classifier.dnsResolver == nil) ||
 		routesSignaturePublicKey == "" ||
 		fetchRoutesUrlFormat == "" {
 		// Split tunnel capability is not configured
@@ -160,7 +174,7 @@ func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string) bool
 
 	dnsServerAddress := classifier.clientParameters.Get().String(
 		parameters.SplitTunnelDNSServer)
-	if dnsServerAddress == "" {
+	if dnsServerAddress == "" && classifier.dnsResolver == nil {
 		// Split tunnel has been disabled.
 		return false
 	}
@@ -172,8 +186,15 @@ func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string) bool
 		return cachedClassification.isUntunneled
 	}
 
-	ipAddr, ttl, err := tunneledLookupIP(
-		dnsServerAddress, classifier.dnsTunneler, targetAddress)
+	var ipAddr net.IP
+	var ttl time.Duration
+	var err error
+	if classifier.dnsResolver != nil {
+		ipAddr, ttl, err = classifier.dnsResolver.lookupIP(targetAddress)
+	} else {
+		ipAddr, ttl, err = tunneledLookupIP(
+			dnsServerAddress, classifier.dnsTunneler, targetAddress)
+	}
 	if err != nil {
 		NoticeWarning("failed to resolve address for split tunnel classification: %s", err)
 		return false
@@ -0,0 +1,207 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	std_errors "errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/wildcard"
+)
+
+const (
+	SPLIT_TUNNEL_POLICY_ACTION_TUNNEL = "tunnel"
+	SPLIT_TUNNEL_POLICY_ACTION_DIRECT = "direct"
+	SPLIT_TUNNEL_POLICY_ACTION_BLOCK  = "block"
+)
+
+// errSplitTunnelPolicyBlocked is returned by Controller.Dial, and by the SOCKS
+// proxy UDP relay, when the destination is blocked by the split tunnel policy.
+// The local proxies check for this error to send an appropriate rejection to
+// the client, or to silently drop blocked datagrams.
+var errSplitTunnelPolicyBlocked = std_errors.New("blocked by split tunnel policy")
+
+// SplitTunnelPolicy is a local, user-specified set of rules that determines
+// whether a destination is accessed through the tunnel, accessed directly,
+// or blocked. The policy is loaded from a JSON file and may be reloaded while
+// running.
+//
+// Rules are evaluated in order and the first matching rule's action applies.
+// When no rule matches, the destination is classified by the region-based
+// SplitTunnelClassifier, if enabled, and is otherwise tunneled.
+type SplitTunnelPolicy struct {
+	common.ReloadableFile
+
+	// Rules is the ordered list of policy rules.
+	Rules []SplitTunnelPolicyRule
+
+	networks [][]*net.IPNet
+}
+
+// SplitTunnelPolicyRule is a single split tunnel policy rule. A rule matches
+// a destination when the destination host matches any of Domains or CIDRs,
+// and the destination port is in Ports. An empty Domains and CIDRs matches
+// any host, and an empty Ports matches any port.
+type SplitTunnelPolicyRule struct {
+
+	// Action is one of "tunnel", "direct", or "block".
+	Action string
+
+	// Domains is a list of domain patterns. A pattern without a "*" matches
+	// the domain and all of its subdomains; so "example.com" matches both
+	// "example.com" and "www.example.com". A pattern with a "*" is matched
+	// using common/wildcard against the full host name.
+	Domains []string
+
+	// CIDRs is a list of IPv4 or IPv6 CIDRs. CIDRs only match destinations
+	// specified as IP addresses; domain destinations are not resolved for
+	// policy matching, as that would require a DNS request before the
+	// tunnel or direct choice is made.
+	CIDRs []string
+
+	// Ports is a list of destination ports.
+	Ports []int
+}
+
+// NewSplitTunnelPolicy initializes a SplitTunnelPolicy with the rules
+// loaded from the specified file.
+func NewSplitTunnelPolicy(filename string) (*SplitTunnelPolicy, error) {
+
+	policy := &SplitTunnelPolicy{}
+
+	policy.ReloadableFile = common.NewReloadableFile(
+		filename,
+		true,
+		func(fileContent []byte, _ time.Time) error {
+			var newPolicy SplitTunnelPolicy
+			err := json.Unmarshal(fileContent, &newPolicy)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			networks, err := newPolicy.validate()
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// Modify actual policy only after validation
+			policy.Rules = newPolicy.Rules
+			policy.networks = networks
+
+			return nil
+		})
+
+	_, err := policy.Reload()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return policy, nil
+}
+
+// validate checks for correct input formats in a SplitTunnelPolicy and
+// returns the parsed CIDRs for each rule.
+func (policy *SplitTunnelPolicy) validate() ([][]*net.IPNet, error) {
+
+	networks := make([][]*net.IPNet, len(policy.Rules))
+
+	for i, rule := range policy.Rules {
+
+		switch rule.Action {
+		case SPLIT_TUNNEL_POLICY_ACTION_TUNNEL,
+			SPLIT_TUNNEL_POLICY_ACTION_DIRECT,
+			SPLIT_TUNNEL_POLICY_ACTION_BLOCK:
+		default:
+			return nil, errors.Tracef("invalid action: %s", rule.Action)
+		}
+
+		for _, domain := range rule.Domains {
+			if domain == "" {
+				return nil, errors.TraceNew("invalid domain")
+			}
+		}
+
+		for _, CIDR := range rule.CIDRs {
+			_, network, err := net.ParseCIDR(CIDR)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			networks[i] = append(networks[i], network)
+		}
+
+		for _, port := range rule.Ports {
+			if port < 1 || port > 65535 {
+				return nil, errors.Tracef("invalid port: %d", port)
+			}
+		}
+	}
+
+	return networks, nil
+}
+
+// Classify returns the action of the first rule matching the destination
+// host and port, or "" when no rule matches.
+func (policy *SplitTunnelPolicy) Classify(host string, port int) string {
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	IP := net.ParseIP(host)
+
+	policy.ReloadableFile.RLock()
+	defer policy.ReloadableFile.RUnlock()
+
+	for i, rule := range policy.Rules {
+
+		if len(rule.Ports) > 0 && !common.ContainsInt(rule.Ports, port) {
+			continue
+		}
+
+		if len(rule.Domains) == 0 && len(rule.CIDRs) == 0 {
+			return rule.Action
+		}
+
+		if IP != nil {
+			for _, network := range policy.networks[i] {
+				if network.Contains(IP) {
+					return rule.Action
+				}
+			}
+			continue
+		}
+
+		for _, domain := range rule.Domains {
+			if matchSplitTunnelPolicyDomain(strings.ToLower(domain), host) {
+				return rule.Action
+			}
+		}
+	}
+
+	return ""
+}
+
+func matchSplitTunnelPolicyDomain(pattern, host string) bool {
+	if strings.Contains(pattern, "*") {
+		return wildcard.Match(pattern, host)
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitTunnelPolicy(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-split-tunnel-policy-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	policyFilename := filepath.Join(testDataDirName, "policy.json")
+
+	policyJSON := `
+    {
+        "Rules" : [
+            {"Action" : "block", "Domains" : ["ads.example.com"]},
+            {"Action" : "direct", "Domains" : ["example.com", "*.example.org"]},
+            {"Action" : "direct", "CIDRs" : ["192.168.0.0/16", "fd00::/8"]},
+            {"Action" : "tunnel", "CIDRs" : ["10.0.0.0/8"], "Ports" : [443]},
+            {"Action" : "direct", "CIDRs" : ["10.0.0.0/8"]},
+            {"Action" : "block", "Ports" : [25]}
+        ]
+    }
+    `
+
+	err = ioutil.WriteFile(policyFilename, []byte(policyJSON), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	policy, err := NewSplitTunnelPolicy(policyFilename)
+	if err != nil {
+		t.Fatalf("NewSplitTunnelPolicy failed: %s", err)
+	}
+
+	testCases := []struct {
+		host           string
+		port           int
+		expectedAction string
+	}{
+		{"ads.example.com", 443, SPLIT_TUNNEL_POLICY_ACTION_BLOCK},
+		{"example.com", 443, SPLIT_TUNNEL_POLICY_ACTION_DIRECT},
+		{"WWW.Example.com.", 80, SPLIT_TUNNEL_POLICY_ACTION_DIRECT},
+		{"notexample.com", 443, ""},
+		{"www.example.org", 443, SPLIT_TUNNEL_POLICY_ACTION_DIRECT},
+		{"example.org", 443, ""},
+		{"192.168.1.1", 80, SPLIT_TUNNEL_POLICY_ACTION_DIRECT},
+		{"fd00::1", 80, SPLIT_TUNNEL_POLICY_ACTION_DIRECT},
+		{"10.0.0.1", 443, SPLIT_TUNNEL_POLICY_ACTION_TUNNEL},
+		{"10.0.0.1", 80, SPLIT_TUNNEL_POLICY_ACTION_DIRECT},
+		{"172.16.0.1", 80, ""},
+		{"mail.example.net", 25, SPLIT_TUNNEL_POLICY_ACTION_BLOCK},
+	}
+
+	for _, testCase := range testCases {
+		action := policy.Classify(testCase.host, testCase.port)
+		if action != testCase.expectedAction {
+			t.Fatalf("unexpected action for %s:%d: %s",
+				testCase.host, testCase.port, action)
+		}
+	}
+
+	// Test: invalid policy is rejected and previous policy is retained
+
+	err = ioutil.WriteFile(
+		policyFilename, []byte(`{"Rules" : [{"Action" : "invalid"}]}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	_, err = policy.Reload()
+	if err == nil {
+		t.Fatalf("unexpected reload success")
+	}
+
+	if policy.Classify("example.com", 443) != SPLIT_TUNNEL_POLICY_ACTION_DIRECT {
+		t.Fatalf("unexpected action after failed reload")
+	}
+
+	// Test: reload replaces policy
+
+	err = ioutil.WriteFile(
+		policyFilename, []byte(`{"Rules" : [{"Action" : "tunnel", "Domains" : ["example.com"]}]}`), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	reloaded, err := policy.Reload()
+	if err != nil || !reloaded {
+		t.Fatalf("Reload failed: %v %s", reloaded, err)
+	}
+
+	if policy.Classify("example.com", 443) != SPLIT_TUNNEL_POLICY_ACTION_TUNNEL ||
+		policy.Classify("192.168.1.1", 80) != "" {
+		t.Fatalf("unexpected action after reload")
+	}
+}
@@ -29,21 +29,26 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/crypto/ssh"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/datagram"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/marionette"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/obfuscator"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/quic"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/resumption"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tactics"
-	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tapdance"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/transports"
+	_ "github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/transports/builtin"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpgw"
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/transferstats"
 )
 
@@ -82,6 +87,11 @@ type TunnelOwner interface {
 // tunnel includes a network connection to the specified server
 // and an SSH session built on top of that transport.
 type Tunnel struct {
+	// Note: 64-bit ints used with atomic operations are placed
+	// at the start of struct to ensure 64-bit alignment.
+	// (https://golang.org/pkg/sync/atomic/#pkg-note-BUG)
+	totalBytesUp               int64
+	totalBytesDown             int64
 	mutex                      *sync.Mutex
 	config                     *Config
 	isActivated                bool
@@ -91,6 +101,8 @@ type Tunnel struct {
 	livenessTestMetrics        *livenessTestMetrics
 	serverContext              *ServerContext
 	conn                       *common.ActivityMonitoredConn
+	resumableConn              *resumption.Conn
+	quicConn                   *quic.Conn
 	sshClient                  *ssh.Client
 	sshServerRequests          <-chan *ssh.Request
 	operateWaitGroup           *sync.WaitGroup
@@ -98,10 +110,13 @@ type Tunnel struct {
 	stopOperate                context.CancelFunc
 	signalPortForwardFailure   chan struct{}
 	totalPortForwardFailures   int
+	quality                    tunnelQuality
 	adjustedEstablishStartTime time.Time
 	establishDuration          time.Duration
 	establishedTime            time.Time
 	handledSSHKeepAliveFailure int32
+	useDatagramChannel         bool
+	failedDatagramChannels     map[string]bool
 }
 
 // getCustomClientParameters helpers wrap the verbose function call chain
@@ -150,20 +165,32 @@ func ConnectTunnel(
 		return nil, errors.Trace(err)
 	}
 
+	// Whether to use datagram channels is selected once per tunnel.
+	useDatagramChannel := getCustomClientParameters(config, dialParams).WeightedCoinFlip(
+		parameters.DatagramChannelProbability)
+
 	// The tunnel is now connected
-	return &Tunnel{
+	tunnel := &Tunnel{
 		mutex:               new(sync.Mutex),
 		config:              config,
 		dialParams:          dialParams,
 		livenessTestMetrics: dialResult.livenessTestMetrics,
 		conn:                dialResult.monitoredConn,
+		resumableConn:       dialResult.resumableConn,
+		quicConn:            dialResult.quicConn,
 		sshClient:           dialResult.sshClient,
 		sshServerRequests:   dialResult.sshRequests,
 		// A buffer allows at least one signal to be sent even when the receiver is
 		// not listening. Senders should not block.
 		signalPortForwardFailure:   make(chan struct{}, 1),
 		adjustedEstablishStartTime: adjustedEstablishStartTime,
-	}, nil
+		useDatagramChannel:         useDatagramChannel,
+		failedDatagramChannels:     make(map[string]bool),
+	}
+
+	tunnel.quality.recordLivenessTest(dialResult.livenessTestMetrics)
+
+	return tunnel, nil
 }
 
 // Activate completes the tunnel establishment, performing the handshake
@@ -260,6 +287,7 @@ func (tunnel *Tunnel) Activate(
 	// In this case, abort here, to ensure that the operateTunnel goroutine
 	// will not be launched after Close is called.
 	if tunnel.isClosed {
+		tunnel.mutex.Unlock()
 		return errors.TraceNew("tunnel is closed")
 	}
 
@@ -332,6 +360,13 @@ func (tunnel *Tunnel) Close(isDiscarded bool) {
 		if err != nil {
 			NoticeWarning("close tunnel ssh error: %s", err)
 		}
+
+		// The multi-hop entry tunnel is owned by its exit tunnel, and is
+		// closed only after the exit tunnel, allowing any final exit status
+		// request to be relayed.
+		if tunnel.dialParams.MultiHopEntryTunnel != nil {
+			tunnel.dialParams.MultiHopEntryTunnel.Close(isDiscarded)
+		}
 	}
 }
 
@@ -349,6 +384,14 @@ func (tunnel *Tunnel) IsDiscarded() bool {
 	return tunnel.isDiscarded
 }
 
+// GetTotalBytesTransferred returns the total bytes sent and received
+// through the tunnel, as of the most recent once-per-second transferstats
+// update.
+func (tunnel *Tunnel) GetTotalBytesTransferred() (int64, int64) {
+	return atomic.LoadInt64(&tunnel.totalBytesUp),
+		atomic.LoadInt64(&tunnel.totalBytesDown)
+}
+
 // SendAPIRequest sends an API request as an SSH request through the tunnel.
 // This function blocks awaiting a response. Only one request may be in-flight
 // at once; a concurrent SendAPIRequest will block until an active request
@@ -432,6 +475,15 @@ func (tunnel *Tunnel) DialPacketTunnelChannel() (net.Conn, error) {
 	if !tunnel.IsActivated() {
 		return nil, errors.TraceNew("tunnel is not activated")
 	}
+
+	// Prefer a datagram channel, which avoids head-of-line blocking of
+	// packets, and fall back to the SSH channel.
+
+	conn, err := tunnel.DialDatagramChannel(protocol.DATAGRAM_CHANNEL_PURPOSE_PACKET_TUNNEL)
+	if err == nil {
+		return conn, nil
+	}
+
 	channel, requests, err := tunnel.sshClient.OpenChannel(
 		protocol.PACKET_TUNNEL_CHANNEL_TYPE, nil)
 	if err != nil {
@@ -445,7 +497,7 @@ func (tunnel *Tunnel) DialPacketTunnelChannel() (net.Conn, error) {
 	}
 	go ssh.DiscardRequests(requests)
 
-	conn := newChannelConn(channel)
+	conn = newChannelConn(channel)
 
 	// wrapWithTransferStats will track bytes transferred for the
 	// packet tunnel. It will count packet overhead (TCP/UDP/IP headers).
@@ -459,6 +511,143 @@ func (tunnel *Tunnel) DialPacketTunnelChannel() (net.Conn, error) {
 	return tunnel.wrapWithTransferStats(conn), nil
 }
 
+// DialDatagramChannel establishes a datagram channel, for the specified
+// purpose, with the tunnel's server. The returned conn carries the same
+// udpgw message or packet tunnel packet stream as the corresponding tunnel
+// channel, but each message or packet is sent in its own UDP datagram,
+// outside of the tunnel, so a lost packet doesn't delay subsequent packets.
+//
+// DialDatagramChannel fails when the server doesn't support datagram
+// channels, and, for the remaining lifetime of the tunnel, after any failure
+// to establish a datagram channel for the same purpose; for example, when
+// UDP is blocked. Callers should fall back to the tunnel channel.
+func (tunnel *Tunnel) DialDatagramChannel(purpose string) (net.Conn, error) {
+
+	if !tunnel.IsActivated() {
+		return nil, errors.TraceNew("tunnel is not activated")
+	}
+
+	// The server requires a completed handshake, and UDP can't be relayed
+	// through an upstream proxy.
+	//
+	// The datagram channel is sent directly to the server IP address. This
+	// would reveal the server IP address to a network observer when the
+	// tunnel protocol doesn't itself dial the server IP address, as with
+	// fronted meek and TapDance; and, for a multi-hop exit tunnel, would
+	// reveal the client IP address to the exit server.
+
+	if !tunnel.useDatagramChannel ||
+		tunnel.serverContext == nil ||
+		tunnel.config.UseUpstreamProxy() ||
+		!tunnel.dialParams.ServerEntry.SupportsDatagramChannel() ||
+		!protocolDialsServerIPAddress(tunnel.dialParams.TunnelProtocol) ||
+		tunnel.dialParams.MultiHopEntryTunnel != nil {
+
+		return nil, errors.TraceNew("datagram channel not supported")
+	}
+
+	var frameSize datagram.FrameSize
+	switch purpose {
+	case protocol.DATAGRAM_CHANNEL_PURPOSE_UDPGW:
+		frameSize = udpgw.FrameSize
+	case protocol.DATAGRAM_CHANNEL_PURPOSE_PACKET_TUNNEL:
+		frameSize = tun.ChannelFrameSize
+	default:
+		return nil, errors.Tracef("unknown purpose: %s", purpose)
+	}
+
+	tunnel.mutex.Lock()
+	failed := tunnel.failedDatagramChannels[purpose]
+	tunnel.mutex.Unlock()
+
+	if failed {
+		return nil, errors.TraceNew("datagram channel failed")
+	}
+
+	conn, err := tunnel.dialDatagramChannel(purpose)
+	if err != nil {
+
+		tunnel.mutex.Lock()
+		tunnel.failedDatagramChannels[purpose] = true
+		tunnel.mutex.Unlock()
+
+		NoticeWarning("dial %s datagram channel failed: %s", purpose, errors.Trace(err))
+		return nil, errors.Trace(err)
+	}
+
+	NoticeInfo("established %s datagram channel", purpose)
+
+	// As with DialPacketTunnelChannel, transferstats counts bytes
+	// transferred, including the framing overhead, and indicates recent
+	// activity to Tunnel.operateTunnel.
+
+	return tunnel.wrapWithTransferStats(datagram.NewFramedConn(conn, frameSize)), nil
+}
+
+func (tunnel *Tunnel) dialDatagramChannel(purpose string) (*datagram.Conn, error) {
+
+	requestPayload, err := json.Marshal(
+		&protocol.DatagramChannelRequest{Purpose: purpose})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	responsePayload, err := tunnel.SendAPIRequest(
+		protocol.PSIPHON_API_DATAGRAM_CHANNEL_REQUEST_NAME, requestPayload)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var response protocol.DatagramChannelResponse
+	err = json.Unmarshal(responsePayload, &response)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	p := tunnel.getCustomClientParameters()
+	establishTimeout := p.Duration(parameters.DatagramChannelEstablishTimeout)
+	keepAlivePeriod := p.Duration(parameters.DatagramChannelKeepAlivePeriod)
+	idleTimeout := p.Duration(parameters.DatagramChannelIdleTimeout)
+
+	ctx, cancelFunc := context.WithTimeout(tunnel.operateCtx, establishTimeout)
+	defer cancelFunc()
+
+	// The datagram channel UDP socket is created with the tunnel's dial
+	// config, including any device binder, but without the resolved IP
+	// callback, as the tunnel dial resolved IP address is already recorded.
+	// The server IP address is the one selected for the tunnel dial, which
+	// may be the server IPv6 address.
+
+	dialConfig := *tunnel.dialParams.GetDialConfig()
+	dialConfig.ResolvedIPCallback = nil
+
+	packetConn, serverAddr, err := NewUDPConn(
+		ctx,
+		net.JoinHostPort(
+			tunnel.dialParams.ServerIPAddress, strconv.Itoa(response.Port)),
+		&dialConfig)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	conn, err := datagram.Dial(
+		ctx,
+		packetConn,
+		serverAddr,
+		&datagram.SessionParameters{
+			SessionID:      response.SessionID,
+			SessionKey:     response.SessionKey,
+			ObfuscationKey: response.ObfuscationKey,
+		},
+		keepAlivePeriod,
+		idleTimeout)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return conn, nil
+}
+
 func (tunnel *Tunnel) wrapWithTransferStats(conn net.Conn) net.Conn {
 
 	// Tunnel does not have a serverContext when DisableApi is set. We still use
@@ -527,6 +716,8 @@ func (conn *TunneledConn) Close() error {
 type dialResult struct {
 	dialConn            net.Conn
 	monitoredConn       *common.ActivityMonitoredConn
+	resumableConn       *resumption.Conn
+	quicConn            *quic.Conn
 	sshClient           *ssh.Client
 	sshRequests         <-chan *ssh.Request
 	livenessTestMetrics *livenessTestMetrics
@@ -561,6 +752,7 @@ func dialTunnel(
 	livenessTestMaxUpstreamBytes := p.Int(parameters.LivenessTestMaxUpstreamBytes)
 	livenessTestMinDownstreamBytes := p.Int(parameters.LivenessTestMinDownstreamBytes)
 	livenessTestMaxDownstreamBytes := p.Int(parameters.LivenessTestMaxDownstreamBytes)
+	resumptionTimeout := p.Duration(parameters.TunnelResumptionTimeout)
 	p.Close()
 
 	// Ensure that, unless the base context is cancelled, any replayed dial
@@ -608,74 +800,42 @@ func dialTunnel(
 
 	NoticeConnectingServer(dialParams)
 
-	// Create the base transport: meek or direct connection
+	// Create the base transport. Multi-hop exit connections are dialed
+	// through the entry tunnel; otherwise, the registered transport for the
+	// tunnel protocol dials the server.
 
 	var dialConn net.Conn
+	var quicConn *quic.Conn
 
-	if protocol.TunnelProtocolUsesMeek(dialParams.TunnelProtocol) {
-
-		dialConn, err = DialMeek(
-			ctx,
-			dialParams.GetMeekConfig(),
-			dialParams.GetDialConfig())
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-
-	} else if protocol.TunnelProtocolUsesQUIC(dialParams.TunnelProtocol) {
+	if dialParams.MultiHopEntryTunnel != nil {
 
-		packetConn, remoteAddr, err := NewUDPConn(
-			ctx,
-			dialParams.DirectDialAddress,
-			dialParams.GetDialConfig())
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
+		// The multi-hop exit server is dialed through a port forward
+		// established via the entry tunnel. The dial config, including any
+		// upstream proxy, BPF program, and fragmentor, applies only to the
+		// entry server connection.
 
-		dialConn, err = quic.Dial(
-			ctx,
-			packetConn,
-			remoteAddr,
-			dialParams.QUICDialSNIAddress,
-			dialParams.QUICVersion,
-			dialParams.ServerEntry.SshObfuscatedKey,
-			dialParams.ObfuscatedQUICPaddingSeed)
+		dialConn, err = dialParams.MultiHopEntryTunnel.Dial(
+			dialParams.DirectDialAddress, true, nil)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
 
-	} else if protocol.TunnelProtocolUsesMarionette(dialParams.TunnelProtocol) {
+	} else {
 
-		dialConn, err = marionette.Dial(
-			ctx,
-			NewNetDialer(dialParams.GetDialConfig()),
-			dialParams.ServerEntry.MarionetteFormat,
-			dialParams.DirectDialAddress)
-		if err != nil {
-			return nil, errors.Trace(err)
+		transport := transports.Get(dialParams.TunnelProtocol)
+		if transport == nil {
+			return nil, errors.Tracef(
+				"no transport for tunnel protocol: %s", dialParams.TunnelProtocol)
 		}
 
-	} else if protocol.TunnelProtocolUsesTapdance(dialParams.TunnelProtocol) {
-
-		dialConn, err = tapdance.Dial(
-			ctx,
-			config.EmitTapdanceLogs,
-			config.GetTapdanceDirectory(),
-			NewNetDialer(dialParams.GetDialConfig()),
-			dialParams.DirectDialAddress)
+		dialConn, err = transport.Dial(ctx, makeTransportDialArgs(config, dialParams))
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
+	}
 
-	} else {
-
-		dialConn, err = DialTCP(
-			ctx,
-			dialParams.DirectDialAddress,
-			dialParams.GetDialConfig())
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
+	if dialParams.TunnelResumption {
+		quicConn, _ = dialConn.(*quic.Conn)
 	}
 
 	// Some conns report additional metrics. fragmentor.Conns report
@@ -700,8 +860,64 @@ func dialTunnel(
 		}
 	}()
 
+	// With tunnel resumption, each network connection is obfuscated in stream
+	// mode, and the resumable session, which carries SSH, is layered on top.
+	// Activity monitoring and throttling then apply to the session, which may
+	// span multiple network connections.
+	var transportConn net.Conn = dialConn
+	var resumableConn *resumption.Conn
+	if dialParams.TunnelResumption &&
+		protocol.TunnelProtocolSupportsResumption(dialParams.TunnelProtocol) {
+
+		newObfuscatedStreamConn := func(conn net.Conn) (*obfuscator.ObfuscatedSSHConn, error) {
+			return obfuscator.NewClientObfuscatedStreamConn(
+				conn,
+				dialParams.ServerEntry.SshObfuscatedKey,
+				dialParams.ObfuscatorPaddingSeed,
+				&obfuscatedSSHMinPadding,
+				&obfuscatedSSHMaxPadding)
+		}
+
+		obfuscatedStreamConn, err := newObfuscatedStreamConn(dialConn)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		dialParams.ObfuscatedSSHConnMetrics = obfuscatedStreamConn
+
+		diagnosticID := dialParams.ServerEntry.GetDiagnosticID()
+
+		resumableConn, err = resumption.NewClientConn(
+			obfuscatedStreamConn,
+			&resumption.ClientConfig{
+				Dial: func(ctx context.Context) (net.Conn, error) {
+					conn, err := redialTunnelTransport(ctx, dialParams)
+					if err != nil {
+						return nil, errors.Trace(err)
+					}
+					obfuscatedConn, err := newObfuscatedStreamConn(conn)
+					if err != nil {
+						conn.Close()
+						return nil, errors.Trace(err)
+					}
+					return obfuscatedConn, nil
+				},
+				ResumeTimeout: resumptionTimeout,
+				OnResumed: func() {
+					NoticeTunnelResumed(diagnosticID, "resumption")
+				},
+			})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		// Closing the resumable conn closes the current network connection
+		// and stops any resume in progress.
+		cleanupConn = resumableConn
+		transportConn = resumableConn
+	}
+
 	// Activity monitoring is used to measure tunnel duration
-	monitoredConn, err := common.NewActivityMonitoredConn(dialConn, 0, false, nil, nil)
+	monitoredConn, err := common.NewActivityMonitoredConn(transportConn, 0, false, nil, nil)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -713,7 +929,9 @@ func dialTunnel(
 
 	// Add obfuscated SSH layer
 	var sshConn net.Conn = throttledConn
-	if protocol.TunnelProtocolUsesObfuscatedSSH(dialParams.TunnelProtocol) {
+	if protocol.TunnelProtocolUsesObfuscatedSSH(dialParams.TunnelProtocol) &&
+		resumableConn == nil {
+
 		obfuscatedSSHConn, err := obfuscator.NewClientObfuscatedSSHConn(
 			throttledConn,
 			dialParams.ServerEntry.SshObfuscatedKey,
@@ -904,12 +1122,102 @@ func dialTunnel(
 	return &dialResult{
 			dialConn:            dialConn,
 			monitoredConn:       monitoredConn,
+			resumableConn:       resumableConn,
+			quicConn:            quicConn,
 			sshClient:           result.sshClient,
 			sshRequests:         result.sshRequests,
 			livenessTestMetrics: result.livenessTestMetrics},
 		nil
 }
 
+// makeTransportDialArgs returns the inputs to transports.Transport.Dial for
+// the specified dial parameters.
+func makeTransportDialArgs(
+	config *Config, dialParams *DialParameters) *transports.DialArgs {
+
+	dialConfig := dialParams.GetDialConfig()
+
+	return &transports.DialArgs{
+		TunnelProtocol:   dialParams.TunnelProtocol,
+		DialAddress:      dialParams.DirectDialAddress,
+		ObfuscatedKey:    dialParams.ServerEntry.SshObfuscatedKey,
+		MarionetteFormat: dialParams.ServerEntry.MarionetteFormat,
+		NetDialer:        NewNetDialer(dialConfig),
+		DialUDP: func(ctx context.Context) (net.PacketConn, *net.UDPAddr, error) {
+			return NewUDPConn(ctx, dialParams.DirectDialAddress, dialConfig)
+		},
+		DialMeek: func(ctx context.Context) (net.Conn, error) {
+			return DialMeek(ctx, dialParams.GetMeekConfig(), dialConfig)
+		},
+		DataDirectory:             config.GetTapdanceDirectory(),
+		EmitDiagnosticLogs:        config.EmitTapdanceLogs,
+		QUICDialSNIAddress:        dialParams.QUICDialSNIAddress,
+		QUICVersion:               dialParams.QUICVersion,
+		ObfuscatedQUICPaddingSeed: dialParams.ObfuscatedQUICPaddingSeed,
+	}
+}
+
+// redialTunnelTransport makes a new network connection to the server for a
+// resumed tunnel. Only the direct TCP and multi-hop transports of the
+// protocols that support resumption are handled.
+func redialTunnelTransport(
+	ctx context.Context, dialParams *DialParameters) (net.Conn, error) {
+
+	if dialParams.MultiHopEntryTunnel != nil {
+		conn, err := dialParams.MultiHopEntryTunnel.Dial(
+			dialParams.DirectDialAddress, true, nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return conn, nil
+	}
+
+	conn, err := DialTCP(
+		ctx,
+		dialParams.DirectDialAddress,
+		dialParams.GetDialConfig())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return conn, nil
+}
+
+// resumeTransport attempts to keep the tunnel alive after its network
+// connection has failed or the network has changed. A resumable tunnel
+// begins resuming over a new network connection, and a QUIC tunnel migrates
+// to a new UDP socket. resumeTransport returns false when the tunnel doesn't
+// support resumption or the attempt couldn't be started.
+func (tunnel *Tunnel) resumeTransport() bool {
+
+	if tunnel.resumableConn != nil {
+		return tunnel.resumableConn.Interrupt()
+	}
+
+	if tunnel.quicConn != nil {
+
+		packetConn, _, err := NewUDPConn(
+			tunnel.operateCtx,
+			tunnel.dialParams.DirectDialAddress,
+			tunnel.dialParams.GetDialConfig())
+		if err != nil {
+			NoticeWarning("resumeTransport: NewUDPConn failed: %s", errors.Trace(err))
+			return false
+		}
+
+		err = tunnel.quicConn.Migrate(packetConn)
+		if err != nil {
+			NoticeWarning("resumeTransport: Migrate failed: %s", errors.Trace(err))
+			return false
+		}
+
+		NoticeTunnelResumed(
+			tunnel.dialParams.ServerEntry.GetDiagnosticID(), "migration")
+		return true
+	}
+
+	return false
+}
+
 // Fields are exported for JSON encoding in NoticeLivenessTest.
 type livenessTestMetrics struct {
 	Duration                string
@@ -1149,6 +1457,8 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 
 			bytesUp := atomic.AddInt64(&totalSent, sent)
 			bytesDown := atomic.AddInt64(&totalReceived, received)
+			atomic.StoreInt64(&tunnel.totalBytesUp, bytesUp)
+			atomic.StoreInt64(&tunnel.totalBytesDown, bytesDown)
 
 			p := tunnel.getCustomClientParameters()
 			noticePeriod := p.Duration(parameters.TotalBytesTransferredNoticePeriod)
@@ -1208,6 +1518,7 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 		case <-tunnel.signalPortForwardFailure:
 			// Note: no mutex on portForwardFailureTotal; only referenced here
 			tunnel.totalPortForwardFailures++
+			tunnel.quality.recordPortForwardFailure()
 			NoticeInfo("port forward failures for %s: %d",
 				tunnel.dialParams.ServerEntry.GetDiagnosticID(),
 				tunnel.totalPortForwardFailures)
@@ -1318,6 +1629,8 @@ func (tunnel *Tunnel) sendSshKeepAlive(
 	resetOnFailure := p.WeightedCoinFlip(
 		parameters.SSHKeepAliveResetOnFailureProbability)
 
+	resumptionTimeout := p.Duration(parameters.TunnelResumptionTimeout)
+
 	p.Close()
 
 	// Note: there is no request context since SSH requests cannot be interrupted
@@ -1325,8 +1638,9 @@ func (tunnel *Tunnel) sendSshKeepAlive(
 	// to unblock this function, but the goroutine may not exit until the tunnel
 	// is closed.
 
-	// Use a buffer of 1 as there are two senders and only one guaranteed receive.
-	errChannel := make(chan error, 1)
+	// Use a buffer of 2 as there are up to three senders, when the timeout is
+	// extended to await a resumed tunnel, and only one guaranteed receive.
+	errChannel := make(chan error, 2)
 
 	afterFunc := time.AfterFunc(timeout, func() {
 		errChannel <- errors.TraceNew("timed out")
@@ -1346,6 +1660,10 @@ func (tunnel *Tunnel) sendSshKeepAlive(
 
 		errChannel <- err
 
+		if err == nil && requestOk {
+			tunnel.quality.recordKeepAlive(elapsedTime)
+		}
+
 		// Record the keep alive round trip as a speed test sample. The first
 		// periodic keep alive is always recorded, as many tunnels are short-lived
 		// and we want to ensure that some data is gathered. Subsequent keep alives
@@ -1355,6 +1673,8 @@ func (tunnel *Tunnel) sendSshKeepAlive(
 
 		if err == nil && requestOk && speedTestSample {
 
+			tunnel.quality.recordSpeedTestSample(elapsedTime, request, response)
+
 			err = tactics.AddSpeedTestSample(
 				tunnel.config.GetClientParameters(),
 				GetTacticsStorer(),
@@ -1392,20 +1712,39 @@ func (tunnel *Tunnel) sendSshKeepAlive(
 	continuousNetworkConnectivity := true
 	networkID := tunnel.config.GetNetworkID()
 
+	// When the tunnel supports resumption, a keep alive failure or a network
+	// change first triggers resuming the tunnel over a new network connection,
+	// and the keep alive is given one more timeout period, long enough to
+	// resume, to succeed. A resumed tunnel is likely to be on a different
+	// network, so network connectivity is considered not continuous.
+
+	resumed := false
+
 	var err error
 loop:
 	for {
 		select {
 		case err = <-errChannel:
+			if err != nil && !resumed && tunnel.resumeTransport() {
+				resumed = true
+				continuousNetworkConnectivity = false
+				afterFunc.Reset(resumptionTimeout)
+				continue
+			}
 			break loop
 		case <-ticker.C:
 			connectivityChecker := tunnel.config.NetworkConnectivityChecker
+			networkChanged := networkID != tunnel.config.GetNetworkID()
 			if (connectivityChecker != nil &&
 				connectivityChecker.HasNetworkConnectivity() != 1) ||
-				(networkID != tunnel.config.GetNetworkID()) {
+				networkChanged {
 
 				continuousNetworkConnectivity = false
 			}
+			if networkChanged && !resumed && tunnel.resumeTransport() {
+				resumed = true
+				afterFunc.Reset(resumptionTimeout)
+			}
 		}
 	}
 
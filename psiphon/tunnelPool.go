@@ -0,0 +1,216 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/prng"
+)
+
+const (
+	TUNNEL_POOL_POLICY_ROUND_ROBIN = "round-robin"
+	TUNNEL_POOL_POLICY_WEIGHTED    = "weighted"
+
+	// TUNNEL_QUALITY_SMOOTHING_FACTOR is the weight given to each new
+	// measurement in the exponentially weighted moving averages of tunnel
+	// round trip time and throughput.
+	TUNNEL_QUALITY_SMOOTHING_FACTOR = 0.3
+)
+
+// tunnelQuality tracks measurements of a tunnel's performance which are
+// used to weight tunnel selection when the tunnel pool policy is
+// TUNNEL_POOL_POLICY_WEIGHTED.
+//
+// The round trip time is measured by SSH keep alives. Throughput is
+// initially measured by the liveness test and is then updated by SSH keep
+// alives recorded as tactics speed test samples, which carry padding
+// payloads. A tunnel is considered degraded when a port forward
+// has failed since the last successful keep alive; a failed port forward
+// triggers a keep alive probe, so this state is cleared as soon as the
+// tunnel is confirmed to be healthy.
+type tunnelQuality struct {
+	mutex               sync.Mutex
+	roundTripTime       time.Duration
+	throughput          float64
+	portForwardFailures int
+}
+
+// recordLivenessTest sets the initial throughput estimate, in bytes per
+// second, from the liveness test performed when the tunnel was established.
+// recordLivenessTest is a no-op when no liveness test bytes were exchanged.
+func (quality *tunnelQuality) recordLivenessTest(metrics *livenessTestMetrics) {
+
+	if metrics == nil {
+		return
+	}
+
+	duration, err := time.ParseDuration(metrics.Duration)
+	if err != nil || duration <= 0 {
+		return
+	}
+
+	bytes := metrics.SentUpstreamBytes + metrics.ReceivedDownstreamBytes
+	if bytes == 0 {
+		return
+	}
+
+	quality.recordThroughput(float64(bytes) / duration.Seconds())
+}
+
+// recordSpeedTestSample updates the throughput estimate, in bytes per
+// second, from an SSH keep alive round trip recorded as a speed test sample,
+// counting the request and response payloads.
+func (quality *tunnelQuality) recordSpeedTestSample(
+	roundTripTime time.Duration, request, response []byte) {
+
+	bytes := len(request) + len(response)
+	if roundTripTime <= 0 || bytes == 0 {
+		return
+	}
+
+	quality.recordThroughput(float64(bytes) / roundTripTime.Seconds())
+}
+
+func (quality *tunnelQuality) recordThroughput(bytesPerSecond float64) {
+	quality.mutex.Lock()
+	defer quality.mutex.Unlock()
+
+	if quality.throughput == 0 {
+		quality.throughput = bytesPerSecond
+		return
+	}
+	quality.throughput +=
+		TUNNEL_QUALITY_SMOOTHING_FACTOR * (bytesPerSecond - quality.throughput)
+}
+
+// recordKeepAlive records the round trip time of a successful SSH keep
+// alive and clears the degraded state.
+func (quality *tunnelQuality) recordKeepAlive(roundTripTime time.Duration) {
+	quality.mutex.Lock()
+	defer quality.mutex.Unlock()
+
+	quality.portForwardFailures = 0
+
+	if quality.roundTripTime == 0 {
+		quality.roundTripTime = roundTripTime
+		return
+	}
+	quality.roundTripTime += time.Duration(
+		TUNNEL_QUALITY_SMOOTHING_FACTOR * float64(roundTripTime-quality.roundTripTime))
+}
+
+func (quality *tunnelQuality) recordPortForwardFailure() {
+	quality.mutex.Lock()
+	defer quality.mutex.Unlock()
+
+	quality.portForwardFailures++
+}
+
+func (quality *tunnelQuality) get() (time.Duration, float64, bool) {
+	quality.mutex.Lock()
+	defer quality.mutex.Unlock()
+
+	return quality.roundTripTime, quality.throughput, quality.portForwardFailures > 0
+}
+
+// isDegraded indicates whether the tunnel has recent port forward failures
+// or is in the process of resuming its underlying transport.
+func (tunnel *Tunnel) isDegraded() bool {
+	_, _, degraded := tunnel.quality.get()
+	return degraded ||
+		(tunnel.resumableConn != nil && tunnel.resumableConn.IsResuming())
+}
+
+// selectWeightedTunnel selects a tunnel at random, where each tunnel's
+// probability of selection is proportional to its throughput and inversely
+// proportional to its round trip time. Degraded tunnels are excluded unless
+// all tunnels are degraded.
+//
+// Each measurement is scaled relative to the mean of that measurement across
+// the candidate tunnels, so that throughput and round trip time contribute
+// equally and no calibration is required. A tunnel with no measurement of
+// either type receives a neutral, average weight for that factor.
+func selectWeightedTunnel(tunnels []*Tunnel) *Tunnel {
+
+	if len(tunnels) == 0 {
+		return nil
+	}
+
+	type candidate struct {
+		tunnel        *Tunnel
+		roundTripTime time.Duration
+		throughput    float64
+	}
+
+	candidates := make([]candidate, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		if tunnel.isDegraded() {
+			continue
+		}
+		roundTripTime, throughput, _ := tunnel.quality.get()
+		candidates = append(candidates, candidate{tunnel, roundTripTime, throughput})
+	}
+	if len(candidates) == 0 {
+		for _, tunnel := range tunnels {
+			roundTripTime, throughput, _ := tunnel.quality.get()
+			candidates = append(candidates, candidate{tunnel, roundTripTime, throughput})
+		}
+	}
+
+	var sumRoundTripTime, sumThroughput float64
+	var countRoundTripTime, countThroughput int
+	for _, c := range candidates {
+		if c.roundTripTime > 0 {
+			sumRoundTripTime += c.roundTripTime.Seconds()
+			countRoundTripTime++
+		}
+		if c.throughput > 0 {
+			sumThroughput += c.throughput
+			countThroughput++
+		}
+	}
+
+	weights := make([]float64, len(candidates))
+	var totalWeight float64
+	for i, c := range candidates {
+		weight := 1.0
+		if c.roundTripTime > 0 {
+			weight *= (sumRoundTripTime / float64(countRoundTripTime)) /
+				c.roundTripTime.Seconds()
+		}
+		if c.throughput > 0 {
+			weight *= c.throughput / (sumThroughput / float64(countThroughput))
+		}
+		weights[i] = weight
+		totalWeight += weight
+	}
+
+	r := totalWeight * float64(prng.Int63n(1<<53)) / (1 << 53)
+	for i, weight := range weights {
+		if r < weight {
+			return candidates[i].tunnel
+		}
+		r -= weight
+	}
+
+	return candidates[len(candidates)-1].tunnel
+}
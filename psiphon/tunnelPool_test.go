@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectWeightedTunnel(t *testing.T) {
+
+	fastTunnel := &Tunnel{}
+	fastTunnel.quality.recordLivenessTest(
+		&livenessTestMetrics{Duration: "1s", ReceivedDownstreamBytes: 1000000})
+	fastTunnel.quality.recordKeepAlive(100 * time.Millisecond)
+
+	slowTunnel := &Tunnel{}
+	slowTunnel.quality.recordLivenessTest(
+		&livenessTestMetrics{Duration: "1s", ReceivedDownstreamBytes: 250000})
+	slowTunnel.quality.recordKeepAlive(400 * time.Millisecond)
+
+	degradedTunnel := &Tunnel{}
+	degradedTunnel.quality.recordKeepAlive(10 * time.Millisecond)
+	degradedTunnel.quality.recordPortForwardFailure()
+
+	unmeasuredTunnel := &Tunnel{}
+
+	countSelections := func(tunnels []*Tunnel) map[*Tunnel]int {
+		counts := make(map[*Tunnel]int)
+		for i := 0; i < 10000; i++ {
+			counts[selectWeightedTunnel(tunnels)]++
+		}
+		return counts
+	}
+
+	// Test: weights favor higher throughput and lower round trip time, and
+	// degraded tunnels are excluded.
+
+	counts := countSelections([]*Tunnel{fastTunnel, slowTunnel, degradedTunnel})
+
+	if counts[degradedTunnel] != 0 {
+		t.Fatalf("unexpected degraded tunnel selections: %d", counts[degradedTunnel])
+	}
+	if counts[fastTunnel] < 9000 || counts[slowTunnel] == 0 {
+		t.Fatalf("unexpected selections: %d, %d", counts[fastTunnel], counts[slowTunnel])
+	}
+
+	// Test: unmeasured tunnels receive a neutral weight.
+
+	counts = countSelections([]*Tunnel{unmeasuredTunnel, &Tunnel{}})
+
+	if counts[unmeasuredTunnel] < 4000 || counts[unmeasuredTunnel] > 6000 {
+		t.Fatalf("unexpected selections: %d", counts[unmeasuredTunnel])
+	}
+
+	// Test: when all tunnels are degraded, a tunnel is still selected.
+
+	if selectWeightedTunnel([]*Tunnel{degradedTunnel}) != degradedTunnel {
+		t.Fatalf("unexpected selection")
+	}
+
+	// Test: a successful keep alive clears the degraded state.
+
+	degradedTunnel.quality.recordKeepAlive(10 * time.Millisecond)
+
+	if degradedTunnel.isDegraded() {
+		t.Fatalf("unexpected degraded state")
+	}
+
+	if selectWeightedTunnel(nil) != nil {
+		t.Fatalf("unexpected selection")
+	}
+
+	// Test: speed test samples set and then smooth the throughput estimate.
+
+	sampledTunnel := &Tunnel{}
+	sampledTunnel.quality.recordSpeedTestSample(
+		time.Second, make([]byte, 400), make([]byte, 600))
+
+	_, throughput, _ := sampledTunnel.quality.get()
+	if throughput != 1000 {
+		t.Fatalf("unexpected throughput: %f", throughput)
+	}
+
+	sampledTunnel.quality.recordSpeedTestSample(
+		500*time.Millisecond, make([]byte, 1000), make([]byte, 1000))
+
+	_, throughput, _ = sampledTunnel.quality.get()
+	expectedThroughput := 1000 + TUNNEL_QUALITY_SMOOTHING_FACTOR*(4000-1000)
+	if throughput != expectedThroughput {
+		t.Fatalf("unexpected throughput: %f", throughput)
+	}
+
+	sampledTunnel.quality.recordSpeedTestSample(0, nil, nil)
+
+	_, throughput, _ = sampledTunnel.quality.get()
+	if throughput != expectedThroughput {
+		t.Fatalf("unexpected throughput: %f", throughput)
+	}
+}
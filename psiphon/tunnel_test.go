@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+)
+
+func TestDialDatagramChannelNotSupported(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-datagram-channel-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	config := &Config{
+		PropagationChannelId: "0",
+		SponsorId:            "0",
+		DataRootDirectory:    testDataDirName,
+	}
+
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	// Test: the datagram channel, which is sent directly to the server IP
+	// address, is refused for tunnel protocols which don't dial the server
+	// IP address and for multi-hop exit tunnels.
+
+	testCases := []struct {
+		tunnelProtocol string
+		isMultiHopExit bool
+	}{
+		{protocol.TUNNEL_PROTOCOL_FRONTED_MEEK, false},
+		{protocol.TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP, false},
+		{protocol.TUNNEL_PROTOCOL_TAPDANCE_OBFUSCATED_SSH, false},
+		{protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH, true},
+	}
+
+	for _, testCase := range testCases {
+
+		dialParams := &DialParameters{
+			ServerEntry: &protocol.ServerEntry{
+				IpAddress:    "192.0.2.1",
+				Capabilities: []string{protocol.CAPABILITY_DATAGRAM_CHANNEL},
+			},
+			ServerIPAddress: "192.0.2.1",
+			TunnelProtocol:  testCase.tunnelProtocol,
+		}
+		if testCase.isMultiHopExit {
+			dialParams.MultiHopEntryTunnel = &Tunnel{}
+		}
+
+		tunnel := &Tunnel{
+			mutex:              new(sync.Mutex),
+			config:             config,
+			dialParams:         dialParams,
+			isActivated:        true,
+			serverContext:      &ServerContext{},
+			useDatagramChannel: true,
+		}
+
+		_, err := tunnel.DialDatagramChannel(protocol.DATAGRAM_CHANNEL_PURPOSE_UDPGW)
+		if err == nil || !strings.Contains(err.Error(), "not supported") {
+			t.Fatalf("unexpected result for %s: %v", testCase.tunnelProtocol, err)
+		}
+	}
+
+	if !protocolDialsServerIPAddress(protocol.TUNNEL_PROTOCOL_OBFUSCATED_SSH) ||
+		!protocolDialsServerIPAddress(protocol.TUNNEL_PROTOCOL_UNFRONTED_MEEK) {
+		t.Fatalf("unexpected protocolDialsServerIPAddress result")
+	}
+}
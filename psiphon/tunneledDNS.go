@@ -0,0 +1,602 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	lrucache "github.com/cognusion/go-cache-lru"
+)
+
+const (
+	tunneledDNSMaxIdleConns         = 4
+	tunneledDNSStreamIdleTimeout    = 30 * time.Second
+	tunneledDNSMessageContentType   = "application/dns-message"
+	tunneledDNSCacheCleanupInterval = 1 * time.Minute
+)
+
+// tunneledDNSResolver resolves DNS requests using a DNS-over-HTTPS or
+// DNS-over-TLS resolver. All resolver connections are port forwards, so the
+// requests are both tunneled and encrypted end-to-end: neither the local
+// network nor the Psiphon server observes the DNS traffic.
+//
+// Responses are cached, keyed by question, for the minimum TTL of the
+// response records, capped by TunneledDNSCacheMaxTTL. Cached responses are
+// returned with TTLs reduced by the time spent in the cache.
+type tunneledDNSResolver struct {
+	config        *Config
+	tunneler      Tunneler
+	tlsConfig     *tls.Config
+	dohURL        string
+	dohTransport  *http.Transport
+	dohClient     *http.Client
+	dotAddress    string
+	dotMutex      sync.Mutex
+	dotIdleConns  []net.Conn
+	dotIsShutdown bool
+	cache         *lrucache.Cache
+}
+
+type tunneledDNSCacheEntry struct {
+	response *dns.Msg
+	cachedAt time.Time
+}
+
+// newTunneledDNSResolver initializes a tunneledDNSResolver using the
+// TunneledDNSOverHTTPSURL or TunneledDNSOverTLSServerAddress resolver.
+// Resolver connections are established on demand, with tunneler.
+func newTunneledDNSResolver(
+	config *Config, tunneler Tunneler) (*tunneledDNSResolver, error) {
+
+	if !config.hasTunneledDNSResolver() {
+		return nil, errors.TraceNew("missing tunneled DNS resolver")
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if config.TrustedCACertificatesFilename != "" {
+		rootCAs := x509.NewCertPool()
+		certData, err := ioutil.ReadFile(config.TrustedCACertificatesFilename)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rootCAs.AppendCertsFromPEM(certData)
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	resolver := &tunneledDNSResolver{
+		config:   config,
+		tunneler: tunneler,
+	}
+
+	if config.TunneledDNSOverHTTPSURL != "" {
+
+		// As in MakeTunneledHTTPClient, there is no dial context since port
+		// forward dials cannot be interrupted directly. The request timeout
+		// still applies once the port forward is established.
+
+		resolver.dohURL = config.TunneledDNSOverHTTPSURL
+		resolver.dohTransport = &http.Transport{
+			Dial: func(_, addr string) (net.Conn, error) {
+				return tunneler.Dial(addr, true, nil)
+			},
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: tunneledDNSMaxIdleConns,
+		}
+		resolver.dohClient = &http.Client{
+			Transport: resolver.dohTransport,
+		}
+
+	} else {
+
+		host, _, err := net.SplitHostPort(config.TunneledDNSOverTLSServerAddress)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		tlsConfig.ServerName = host
+
+		resolver.dotAddress = config.TunneledDNSOverTLSServerAddress
+	}
+
+	resolver.tlsConfig = tlsConfig
+
+	p := config.GetClientParameters().Get()
+	cacheMaxEntries := p.Int(parameters.TunneledDNSCacheMaxEntries)
+
+	if cacheMaxEntries > 0 {
+		resolver.cache = lrucache.NewWithLRU(
+			lrucache.NoExpiration,
+			tunneledDNSCacheCleanupInterval,
+			cacheMaxEntries)
+	}
+
+	return resolver, nil
+}
+
+// close closes all idle resolver connections. In-flight requests are not
+// interrupted.
+func (resolver *tunneledDNSResolver) close() {
+
+	if resolver.dohTransport != nil {
+		resolver.dohTransport.CloseIdleConnections()
+	}
+
+	resolver.dotMutex.Lock()
+	idleConns := resolver.dotIdleConns
+	resolver.dotIdleConns = nil
+	resolver.dotIsShutdown = true
+	resolver.dotMutex.Unlock()
+
+	for _, conn := range idleConns {
+		conn.Close()
+	}
+}
+
+// resolve sends the DNS request to the resolver, or uses a cached response,
+// and returns a response with the same ID as the request.
+func (resolver *tunneledDNSResolver) resolve(request *dns.Msg) (*dns.Msg, error) {
+
+	if len(request.Question) != 1 {
+		return nil, errors.TraceNew("unexpected question count")
+	}
+
+	cacheKey := tunneledDNSCacheKey(request)
+
+	response := resolver.getCachedResponse(cacheKey)
+	if response != nil {
+		response.Id = request.Id
+		return response, nil
+	}
+
+	p := resolver.config.GetClientParameters().Get()
+	requestTimeout := p.Duration(parameters.TunneledDNSRequestTimeout)
+	cacheMaxTTL := p.Duration(parameters.TunneledDNSCacheMaxTTL)
+
+	var err error
+	if resolver.dohURL != "" {
+		response, err = resolver.exchangeDoH(request, requestTimeout)
+	} else {
+		response, err = resolver.exchangeDoT(request, requestTimeout)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resolver.setCachedResponse(cacheKey, response, cacheMaxTTL)
+
+	response.Id = request.Id
+
+	return response, nil
+}
+
+// lookupIP resolves host to an IPv4 address. The address TTL is also
+// returned. lookupIP is equivalent to tunneledLookupIP.
+func (resolver *tunneledDNSResolver) lookupIP(host string) (net.IP, time.Duration, error) {
+
+	ipAddr := net.ParseIP(host)
+	if ipAddr != nil {
+		// maxDuration from golang.org/src/time/time.go
+		return ipAddr, time.Duration(1<<63 - 1), nil
+	}
+
+	request := new(dns.Msg)
+	request.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	request.RecursionDesired = true
+
+	response, err := resolver.resolve(request)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return nil, 0, errors.Tracef(
+			"unexpected response code: %s", dns.RcodeToString[response.Rcode])
+	}
+
+	for _, answer := range response.Answer {
+		if a, ok := answer.(*dns.A); ok {
+			return a.A, time.Duration(a.Hdr.Ttl) * time.Second, nil
+		}
+	}
+
+	return nil, 0, errors.TraceNew("no IP address")
+}
+
+// handleRequestPacket resolves a packed DNS request and returns the packed
+// response. Requests which fail to resolve receive a SERVFAIL response. For
+// UDP, responses exceeding the request's maximum UDP payload size are
+// replaced with a truncated response, signaling the client to retry over
+// TCP. Malformed requests, which receive no response, result in an error.
+func (resolver *tunneledDNSResolver) handleRequestPacket(
+	requestPacket []byte, isUDP bool) ([]byte, error) {
+
+	request := new(dns.Msg)
+	err := request.Unpack(requestPacket)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var response *dns.Msg
+
+	if request.Response {
+		return nil, errors.TraceNew("unexpected response message")
+
+	} else if request.Opcode != dns.OpcodeQuery {
+		response = new(dns.Msg).SetRcode(request, dns.RcodeNotImplemented)
+
+	} else if len(request.Question) != 1 {
+		response = new(dns.Msg).SetRcode(request, dns.RcodeFormatError)
+
+	} else {
+		response, err = resolver.resolve(request)
+		if err != nil {
+			NoticeWarning("tunneled DNS request failed: %s", errors.Trace(err))
+			response = new(dns.Msg).SetRcode(request, dns.RcodeServerFailure)
+		}
+	}
+
+	responsePacket, err := response.Pack()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if isUDP {
+		maxSize := dns.MinMsgSize
+		opt := request.IsEdns0()
+		if opt != nil && int(opt.UDPSize()) > maxSize {
+			maxSize = int(opt.UDPSize())
+		}
+		if len(responsePacket) > maxSize {
+			truncated := new(dns.Msg).SetReply(request)
+			truncated.Truncated = true
+			responsePacket, err = truncated.Pack()
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	}
+
+	return responsePacket, nil
+}
+
+// serveStream handles DNS-over-TCP requests read from conn. serveStream
+// returns when conn is closed or idle for tunneledDNSStreamIdleTimeout.
+// Requests are handled sequentially.
+func (resolver *tunneledDNSResolver) serveStream(conn net.Conn) error {
+
+	dnsConn := &dns.Conn{Conn: conn}
+
+	for {
+
+		err := conn.SetReadDeadline(time.Now().Add(tunneledDNSStreamIdleTimeout))
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		requestPacket, err := dnsConn.ReadMsgHeader(nil)
+		if err != nil {
+			// Read fails when the client closes the stream or the idle
+			// timeout is reached; either ends the stream as normal.
+			return nil
+		}
+
+		responsePacket, err := resolver.handleRequestPacket(requestPacket, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err = dnsConn.Write(responsePacket)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+func (resolver *tunneledDNSResolver) exchangeDoH(
+	request *dns.Msg, requestTimeout time.Duration) (*dns.Msg, error) {
+
+	// As recommended in RFC 8484, the DNS ID is 0 in DNS-over-HTTPS requests.
+
+	dohRequest := request.Copy()
+	dohRequest.Id = 0
+
+	requestPacket, err := dohRequest.Pack()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancelFunc()
+
+	httpRequest, err := http.NewRequest(
+		"POST", resolver.dohURL, bytes.NewReader(requestPacket))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	httpRequest = httpRequest.WithContext(ctx)
+	httpRequest.Header.Set("Content-Type", tunneledDNSMessageContentType)
+	httpRequest.Header.Set("Accept", tunneledDNSMessageContentType)
+
+	httpResponse, err := resolver.dohClient.Do(httpRequest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, errors.Tracef("unexpected HTTP status code: %d", httpResponse.StatusCode)
+	}
+
+	responsePacket, err := ioutil.ReadAll(
+		io.LimitReader(httpResponse.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	response := new(dns.Msg)
+	err = response.Unpack(responsePacket)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return response, nil
+}
+
+func (resolver *tunneledDNSResolver) exchangeDoT(
+	request *dns.Msg, requestTimeout time.Duration) (*dns.Msg, error) {
+
+	// Idle connections are reused. As the resolver may have closed an idle
+	// connection, a request which fails on an idle connection is retried
+	// with another connection.
+
+	for {
+
+		conn := resolver.getIdleDoTConn()
+		isIdleConn := conn != nil
+
+		if !isIdleConn {
+			var err error
+			conn, err = resolver.dialDoT(requestTimeout)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		response, err := exchangeDoTConn(conn, request, requestTimeout)
+		if err != nil {
+			conn.Close()
+			if isIdleConn {
+				continue
+			}
+			return nil, errors.Trace(err)
+		}
+
+		resolver.putIdleDoTConn(conn)
+
+		return response, nil
+	}
+}
+
+func (resolver *tunneledDNSResolver) dialDoT(requestTimeout time.Duration) (net.Conn, error) {
+
+	conn, err := resolver.tunneler.Dial(resolver.dotAddress, true, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Port forward conns don't support deadlines, so the TLS handshake is
+	// interrupted, on timeout, by closing the conn.
+
+	tlsConn := tls.Client(conn, resolver.tlsConfig)
+
+	timer := time.AfterFunc(requestTimeout, func() { tlsConn.Close() })
+	err = tlsConn.Handshake()
+	if !timer.Stop() && err == nil {
+		err = errors.TraceNew("TLS handshake timeout")
+	}
+	if err != nil {
+		tlsConn.Close()
+		return nil, errors.Trace(err)
+	}
+
+	return tlsConn, nil
+}
+
+func exchangeDoTConn(
+	conn net.Conn, request *dns.Msg, requestTimeout time.Duration) (*dns.Msg, error) {
+
+	timer := time.AfterFunc(requestTimeout, func() { conn.Close() })
+
+	dnsConn := &dns.Conn{Conn: conn}
+
+	err := dnsConn.WriteMsg(request)
+	var response *dns.Msg
+	if err == nil {
+		response, err = dnsConn.ReadMsg()
+	}
+
+	if !timer.Stop() && err == nil {
+		err = errors.TraceNew("DNS request timeout")
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if response.Id != request.Id {
+		return nil, errors.TraceNew("unexpected DNS ID")
+	}
+
+	return response, nil
+}
+
+func (resolver *tunneledDNSResolver) getIdleDoTConn() net.Conn {
+	resolver.dotMutex.Lock()
+	defer resolver.dotMutex.Unlock()
+
+	count := len(resolver.dotIdleConns)
+	if count == 0 {
+		return nil
+	}
+	conn := resolver.dotIdleConns[count-1]
+	resolver.dotIdleConns = resolver.dotIdleConns[:count-1]
+	return conn
+}
+
+func (resolver *tunneledDNSResolver) putIdleDoTConn(conn net.Conn) {
+	resolver.dotMutex.Lock()
+	defer resolver.dotMutex.Unlock()
+
+	if resolver.dotIsShutdown ||
+		len(resolver.dotIdleConns) >= tunneledDNSMaxIdleConns {
+		conn.Close()
+		return
+	}
+	resolver.dotIdleConns = append(resolver.dotIdleConns, conn)
+}
+
+func (resolver *tunneledDNSResolver) getCachedResponse(cacheKey string) *dns.Msg {
+
+	if resolver.cache == nil {
+		return nil
+	}
+
+	value, ok := resolver.cache.Get(cacheKey)
+	if !ok {
+		return nil
+	}
+	entry := value.(*tunneledDNSCacheEntry)
+
+	response := entry.response.Copy()
+
+	elapsed := uint32(time.Since(entry.cachedAt) / time.Second)
+
+	for _, records := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range records {
+			header := record.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if header.Ttl > elapsed {
+				header.Ttl -= elapsed
+			} else {
+				header.Ttl = 0
+			}
+		}
+	}
+
+	return response
+}
+
+func (resolver *tunneledDNSResolver) setCachedResponse(
+	cacheKey string, response *dns.Msg, cacheMaxTTL time.Duration) {
+
+	if resolver.cache == nil {
+		return
+	}
+
+	ttl, ok := tunneledDNSResponseTTL(response)
+	if !ok {
+		return
+	}
+	if ttl > cacheMaxTTL {
+		ttl = cacheMaxTTL
+	}
+
+	resolver.cache.Set(
+		cacheKey,
+		&tunneledDNSCacheEntry{
+			response: response.Copy(),
+			cachedAt: time.Now(),
+		},
+		ttl)
+}
+
+// tunneledDNSCacheKey returns a cache key for the request. In addition to
+// the question, the key includes the request flags which may change the
+// response contents.
+func tunneledDNSCacheKey(request *dns.Msg) string {
+
+	question := request.Question[0]
+
+	isDNSSECOK := false
+	opt := request.IsEdns0()
+	if opt != nil {
+		isDNSSECOK = opt.Do()
+	}
+
+	return fmt.Sprintf(
+		"%s/%d/%d/%t/%t",
+		strings.ToLower(question.Name),
+		question.Qtype,
+		question.Qclass,
+		request.CheckingDisabled,
+		isDNSSECOK)
+}
+
+// tunneledDNSResponseTTL returns the cache TTL for the response, which is
+// the minimum TTL of all its records. Following RFC 2308, the TTL of a SOA
+// record, as used in negative responses, is capped by the SOA minimum TTL.
+// Only successful and NXDOMAIN responses with records are cached.
+func tunneledDNSResponseTTL(response *dns.Msg) (time.Duration, bool) {
+
+	if response.Truncated ||
+		(response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+
+	var minTTL uint32
+	hasRecords := false
+
+	for _, records := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range records {
+			header := record.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			ttl := header.Ttl
+			if soa, ok := record.(*dns.SOA); ok && soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			if !hasRecords || ttl < minTTL {
+				minTTL = ttl
+			}
+			hasRecords = true
+		}
+	}
+
+	if !hasRecords || minTTL == 0 {
+		return 0, false
+	}
+
+	return time.Duration(minTTL) * time.Second, true
+}
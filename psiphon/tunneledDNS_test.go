@@ -0,0 +1,345 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Psiphon-Labs/dns"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+)
+
+func TestTunneledDNSOverHTTPS(t *testing.T) {
+	testTunneledDNS(t, true)
+}
+
+func TestTunneledDNSOverTLS(t *testing.T) {
+	testTunneledDNS(t, false)
+}
+
+func testTunneledDNS(t *testing.T, useDoH bool) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-tunneled-dns-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	var requestCount int32
+
+	handleRequest := func(request *dns.Msg) *dns.Msg {
+		atomic.AddInt32(&requestCount, 1)
+		return makeTestDNSResponse(request)
+	}
+
+	// The DoH server and the DoT server share the httptest certificate, which
+	// is valid for 127.0.0.1.
+
+	dohServer := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requestPacket, err := ioutil.ReadAll(r.Body)
+			request := new(dns.Msg)
+			if err == nil {
+				err = request.Unpack(requestPacket)
+			}
+			if err != nil ||
+				r.Method != "POST" ||
+				r.Header.Get("Content-Type") != "application/dns-message" ||
+				request.Id != 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			responsePacket, _ := handleRequest(request).Pack()
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(responsePacket)
+		}))
+	defer dohServer.Close()
+
+	dotListener, err := tls.Listen(
+		"tcp", "127.0.0.1:0", &tls.Config{Certificates: dohServer.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("tls.Listen failed: %s", err)
+	}
+	defer dotListener.Close()
+
+	go func() {
+		for {
+			conn, err := dotListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dnsConn := &dns.Conn{Conn: conn}
+				for {
+					request, err := dnsConn.ReadMsg()
+					if err != nil {
+						return
+					}
+					err = dnsConn.WriteMsg(handleRequest(request))
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	caCertificatesFilename := filepath.Join(testDataDirName, "ca.pem")
+	err = ioutil.WriteFile(
+		caCertificatesFilename,
+		pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: dohServer.Certificate().Raw,
+		}),
+		0600)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %s", err)
+	}
+
+	config := &Config{
+		PropagationChannelId:          "0",
+		SponsorId:                     "0",
+		DataRootDirectory:             testDataDirName,
+		TrustedCACertificatesFilename: caCertificatesFilename,
+		LocalDNSProxyAddress:          "127.0.0.1:0",
+	}
+	if useDoH {
+		config.TunneledDNSOverHTTPSURL = dohServer.URL + "/dns-query"
+	} else {
+		config.TunneledDNSOverTLSServerAddress = dotListener.Addr().String()
+	}
+
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	tunneler := &testTunneledDNSTunneler{}
+
+	resolver, err := newTunneledDNSResolver(config, tunneler)
+	if err != nil {
+		t.Fatalf("newTunneledDNSResolver failed: %s", err)
+	}
+	defer resolver.close()
+
+	// Test: resolve, then resolve from cache.
+
+	for i := 0; i < 2; i++ {
+
+		request := new(dns.Msg)
+		request.SetQuestion("example.org.", dns.TypeA)
+
+		response, err := resolver.resolve(request)
+		if err != nil {
+			t.Fatalf("resolve failed: %s", err)
+		}
+
+		if response.Id != request.Id || len(response.Answer) != 1 {
+			t.Fatalf("unexpected response: %s", response)
+		}
+		a, ok := response.Answer[0].(*dns.A)
+		if !ok || !a.A.Equal(net.ParseIP("192.0.2.1")) || a.Hdr.Ttl > 60 {
+			t.Fatalf("unexpected answer: %s", response.Answer[0])
+		}
+	}
+
+	if atomic.LoadInt32(&requestCount) != 1 {
+		t.Fatalf("unexpected request count: %d", requestCount)
+	}
+
+	if atomic.LoadInt32(&tunneler.dialCount) != 1 {
+		t.Fatalf("unexpected dial count: %d", tunneler.dialCount)
+	}
+
+	// Test: split tunnel lookup.
+
+	ipAddr, ttl, err := resolver.lookupIP("www.example.org")
+	if err != nil {
+		t.Fatalf("lookupIP failed: %s", err)
+	}
+	if !ipAddr.Equal(net.ParseIP("192.0.2.1")) || ttl <= 0 {
+		t.Fatalf("unexpected lookupIP result: %s %s", ipAddr, ttl)
+	}
+
+	// Test: resolver connections are reused.
+
+	if atomic.LoadInt32(&tunneler.dialCount) != 1 {
+		t.Fatalf("unexpected dial count: %d", tunneler.dialCount)
+	}
+
+	// Test: local DNS proxy, over UDP and TCP, including negative responses.
+
+	dnsProxy, err := newLocalDNSProxy(config, tunneler, resolver)
+	if err != nil {
+		t.Fatalf("newLocalDNSProxy failed: %s", err)
+	}
+	defer dnsProxy.close()
+
+	proxyAddress := dnsProxy.packetConn.LocalAddr().String()
+
+	for _, network := range []string{"udp", "tcp"} {
+
+		conn, err := net.Dial(network, proxyAddress)
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+
+		dnsConn := &dns.Conn{Conn: conn}
+
+		request := new(dns.Msg)
+		request.SetQuestion(network+".example.org.", dns.TypeA)
+		err = dnsConn.WriteMsg(request)
+		if err != nil {
+			t.Fatalf("WriteMsg failed: %s", err)
+		}
+		response, err := dnsConn.ReadMsg()
+		if err != nil {
+			t.Fatalf("ReadMsg failed: %s", err)
+		}
+		if response.Id != request.Id || response.Rcode != dns.RcodeSuccess ||
+			len(response.Answer) != 1 {
+			t.Fatalf("unexpected response: %s", response)
+		}
+
+		request = new(dns.Msg)
+		request.SetQuestion("nxdomain.example.org.", dns.TypeA)
+		err = dnsConn.WriteMsg(request)
+		if err != nil {
+			t.Fatalf("WriteMsg failed: %s", err)
+		}
+		response, err = dnsConn.ReadMsg()
+		if err != nil {
+			t.Fatalf("ReadMsg failed: %s", err)
+		}
+		if response.Id != request.Id || response.Rcode != dns.RcodeNameError {
+			t.Fatalf("unexpected response: %s", response)
+		}
+
+		conn.Close()
+	}
+
+	// The NXDOMAIN response is cached, per the SOA minimum TTL.
+
+	if atomic.LoadInt32(&requestCount) != 5 {
+		t.Fatalf("unexpected request count: %d", requestCount)
+	}
+
+	// Test: resolver failures result in SERVFAIL.
+
+	config.TrustedCACertificatesFilename = ""
+	failingResolver, err := newTunneledDNSResolver(config, tunneler)
+	if err != nil {
+		t.Fatalf("newTunneledDNSResolver failed: %s", err)
+	}
+	defer failingResolver.close()
+
+	request := new(dns.Msg)
+	request.SetQuestion("servfail.example.org.", dns.TypeA)
+	requestPacket, _ := request.Pack()
+
+	responsePacket, err := failingResolver.handleRequestPacket(requestPacket, true)
+	if err != nil {
+		t.Fatalf("handleRequestPacket failed: %s", err)
+	}
+	response := new(dns.Msg)
+	err = response.Unpack(responsePacket)
+	if err != nil {
+		t.Fatalf("Unpack failed: %s", err)
+	}
+	if response.Id != request.Id || response.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("unexpected response: %s", response)
+	}
+}
+
+// makeTestDNSResponse answers A requests with 192.0.2.1, except for
+// "nxdomain.example.org.", which is answered with NXDOMAIN.
+func makeTestDNSResponse(request *dns.Msg) *dns.Msg {
+
+	response := new(dns.Msg).SetReply(request)
+
+	question := request.Question[0]
+
+	if question.Name == "nxdomain.example.org." {
+		response.Rcode = dns.RcodeNameError
+		response.Ns = []dns.RR{
+			&dns.SOA{
+				Hdr: dns.RR_Header{
+					Name:   "example.org.",
+					Rrtype: dns.TypeSOA,
+					Class:  dns.ClassINET,
+					Ttl:    3600,
+				},
+				Ns:     "ns.example.org.",
+				Mbox:   "hostmaster.example.org.",
+				Minttl: 60,
+			},
+		}
+		return response
+	}
+
+	response.Answer = []dns.RR{
+		&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   question.Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: net.ParseIP("192.0.2.1").To4(),
+		},
+	}
+
+	return response
+}
+
+// testTunneledDNSTunneler is a Tunneler which makes direct TCP connections
+// in place of port forwards.
+type testTunneledDNSTunneler struct {
+	dialCount int32
+}
+
+func (tunneler *testTunneledDNSTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	if !alwaysTunnel {
+		return nil, errors.TraceNew("unexpected dial")
+	}
+	atomic.AddInt32(&tunneler.dialCount, 1)
+	return net.Dial("tcp", remoteAddr)
+}
+
+func (tunneler *testTunneledDNSTunneler) DirectDial(remoteAddr string) (net.Conn, error) {
+	return nil, errors.TraceNew("not supported")
+}
+
+func (tunneler *testTunneledDNSTunneler) SignalComponentFailure() {
+}
@@ -0,0 +1,372 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/protocol"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpgw"
+)
+
+// datagramChannelDialer is implemented by Tunnelers which support datagram
+// channels; see Tunnel.DialDatagramChannel.
+type datagramChannelDialer interface {
+	DialDatagramChannel(purpose string) (net.Conn, error)
+}
+
+// udpgwClient is a client for the udpgw protocol, which multiplexes many UDP
+// flows over a single port forward to the udpgw server address. The Psiphon
+// server intercepts port forwards to its configured udpgw server address and
+// relays the UDP flows itself; see handleUDPChannel in psiphon/server/udp.go.
+//
+// The server retains only one udpgw channel per client tunnel, so all local
+// users of udpgw must share a single udpgwClient.
+//
+// The udpgw port forward is dialed on demand, when a flow first sends a
+// packet, and is redialed after any failure, which will typically be due to
+// the underlying tunnel failing and being replaced. Flows are retained across
+// redials. The udpgw port forward is made with Tunneler.Dial, so bytes
+// transferred are counted in transferstats and port forward failures are
+// reported to the tunnel monitor, as with any other port forward.
+//
+// When the Tunneler supports datagram channels, a udpgw datagram channel is
+// preferred over the udpgw port forward, so that a lost UDP packet doesn't
+// delay packets in other flows.
+type udpgwClient struct {
+	tunneler      Tunneler
+	serverAddress string
+
+	dialMutex sync.Mutex
+
+	mutex      sync.Mutex
+	isClosed   bool
+	conn       net.Conn
+	nextConnID uint16
+	flows      map[uint16]*udpgwFlow
+
+	writeMutex  sync.Mutex
+	writeBuffer []byte
+
+	readWaitGroup *sync.WaitGroup
+}
+
+// udpgwFlow is a single UDP flow, from a local source to a single remote
+// destination, multiplexed over a udpgwClient.
+type udpgwFlow struct {
+	client     *udpgwClient
+	connID     uint16
+	remoteIP   net.IP
+	remotePort uint16
+	forwardDNS bool
+	receiver   func(packet []byte)
+	isNew      bool
+}
+
+func newUdpgwClient(tunneler Tunneler, serverAddress string) *udpgwClient {
+	return &udpgwClient{
+		tunneler:      tunneler,
+		serverAddress: serverAddress,
+		flows:         make(map[uint16]*udpgwFlow),
+		writeBuffer:   make([]byte, udpgw.PROTOCOL_MAX_MESSAGE_SIZE),
+		readWaitGroup: new(sync.WaitGroup),
+	}
+}
+
+// newFlow creates a new flow to the specified remote address. Downstream
+// packets received for the flow are passed to receiver, which is called from
+// the udpgwClient read goroutine and must not block; the packet buffer is
+// reused after receiver returns.
+//
+// When forwardDNS is set, the flow is a DNS flow and the server relays its
+// packets to the server's own DNS resolver instead of to the remote address.
+func (client *udpgwClient) newFlow(
+	remoteIP net.IP,
+	remotePort int,
+	forwardDNS bool,
+	receiver func(packet []byte)) (*udpgwFlow, error) {
+
+	if ipv4 := remoteIP.To4(); ipv4 != nil {
+		remoteIP = ipv4
+	} else if len(remoteIP) != net.IPv6len {
+		return nil, errors.TraceNew("invalid remote IP address")
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.isClosed {
+		return nil, errors.TraceNew("udpgw client is closed")
+	}
+
+	if len(client.flows) >= 65536 {
+		return nil, errors.TraceNew("too many udpgw flows")
+	}
+
+	connID := client.nextConnID
+	for {
+		if _, ok := client.flows[connID]; !ok {
+			break
+		}
+		connID++
+	}
+	client.nextConnID = connID + 1
+
+	flow := &udpgwFlow{
+		client:     client,
+		connID:     connID,
+		remoteIP:   remoteIP,
+		remotePort: uint16(remotePort),
+		forwardDNS: forwardDNS,
+		receiver:   receiver,
+		isNew:      true,
+	}
+
+	client.flows[connID] = flow
+
+	return flow, nil
+}
+
+// close closes the udpgw port forward and stops the read goroutine. All
+// flows are discarded.
+func (client *udpgwClient) close() {
+
+	client.mutex.Lock()
+	client.isClosed = true
+	conn := client.conn
+	client.conn = nil
+	client.flows = make(map[uint16]*udpgwFlow)
+	client.mutex.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+
+	client.readWaitGroup.Wait()
+}
+
+// getConn returns the current udpgw port forward, dialing a new one when
+// there is none. isNewConn indicates that a new port forward was dialed.
+func (client *udpgwClient) getConn() (net.Conn, bool, error) {
+
+	// dialMutex serializes dials, so concurrent senders await the result of
+	// a single dial, which is bounded by DatagramChannelEstablishTimeout and
+	// TunnelPortForwardDialTimeout. client.mutex isn't held during the dial,
+	// so creating and closing flows, relaying downstream packets, and close
+	// aren't blocked.
+
+	client.dialMutex.Lock()
+	defer client.dialMutex.Unlock()
+
+	client.mutex.Lock()
+	isClosed := client.isClosed
+	conn := client.conn
+	client.mutex.Unlock()
+
+	if isClosed {
+		return nil, false, errors.TraceNew("udpgw client is closed")
+	}
+
+	if conn != nil {
+		return conn, false, nil
+	}
+
+	conn, err := client.dial()
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if client.isClosed {
+		conn.Close()
+		return nil, false, errors.TraceNew("udpgw client is closed")
+	}
+
+	client.conn = conn
+
+	client.readWaitGroup.Add(1)
+	go client.readDownstream(conn)
+
+	return conn, true, nil
+}
+
+// dial dials a udpgw datagram channel or, when that's not supported or
+// fails, a udpgw port forward.
+func (client *udpgwClient) dial() (net.Conn, error) {
+
+	if dialer, ok := client.tunneler.(datagramChannelDialer); ok {
+		conn, err := dialer.DialDatagramChannel(protocol.DATAGRAM_CHANNEL_PURPOSE_UDPGW)
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	conn, err := client.tunneler.Dial(client.serverAddress, true, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return conn, nil
+}
+
+// resetConn closes and clears the current udpgw port forward, if it's
+// conn. The next send will dial a new port forward.
+func (client *udpgwClient) resetConn(conn net.Conn) {
+
+	client.mutex.Lock()
+	if client.conn == conn {
+		client.conn = nil
+	}
+	client.mutex.Unlock()
+
+	conn.Close()
+}
+
+func (client *udpgwClient) readDownstream(conn net.Conn) {
+	defer client.readWaitGroup.Done()
+
+	buffer := make([]byte, udpgw.PROTOCOL_MAX_MESSAGE_SIZE)
+
+	for {
+
+		// udpgw message layout:
+		//
+		// | 2 byte size | 3 byte header | 6 or 18 byte address | variable length packet |
+
+		_, err := io.ReadFull(conn, buffer[0:2])
+		if err != nil {
+			break
+		}
+
+		size := int(binary.LittleEndian.Uint16(buffer[0:2]))
+		if size < 3 || size > len(buffer)-2 {
+			NoticeWarning("udpgw: invalid message size: %d", size)
+			break
+		}
+
+		_, err = io.ReadFull(conn, buffer[2:2+size])
+		if err != nil {
+			break
+		}
+
+		flags := buffer[2]
+		connID := binary.LittleEndian.Uint16(buffer[3:5])
+
+		if flags&udpgw.PROTOCOL_FLAG_KEEPALIVE == udpgw.PROTOCOL_FLAG_KEEPALIVE {
+			continue
+		}
+
+		client.mutex.Lock()
+		flow := client.flows[connID]
+		client.mutex.Unlock()
+
+		if flow == nil {
+			// The flow has been closed; discard the packet.
+			continue
+		}
+
+		// The server does not always set udpgw.PROTOCOL_FLAG_IPV6 on downstream
+		// messages, so the address length is determined from the flow's own
+		// remote address.
+
+		packetStart := 2 + 3 + len(flow.remoteIP) + 2
+		if packetStart > 2+size {
+			NoticeWarning("udpgw: invalid message size: %d", size)
+			break
+		}
+
+		flow.receiver(buffer[packetStart : 2+size])
+	}
+
+	client.resetConn(conn)
+}
+
+// send sends a single upstream packet for the flow. Packets that exceed the
+// udpgw maximum payload size are rejected. When the udpgw port forward
+// fails, it's closed and send returns an error; the next send will redial.
+func (flow *udpgwFlow) send(packet []byte) error {
+
+	if len(packet) > udpgw.PROTOCOL_MAX_PAYLOAD_SIZE {
+		return errors.TraceNew("packet too large")
+	}
+
+	client := flow.client
+
+	conn, isNewConn, err := client.getConn()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+
+	// When a flow is new, or the udpgw port forward is new, set the rebind
+	// flag. This instructs the server to discard any existing UDP port
+	// forward for the same connID, which may be a stale port forward for a
+	// previous flow with a different destination.
+
+	var flags uint8
+	if flow.isNew || isNewConn {
+		flags |= udpgw.PROTOCOL_FLAG_REBIND
+		flow.isNew = false
+	}
+	if flow.forwardDNS {
+		flags |= udpgw.PROTOCOL_FLAG_DNS
+	}
+	if len(flow.remoteIP) == net.IPv6len {
+		flags |= udpgw.PROTOCOL_FLAG_IPV6
+	}
+
+	buffer := client.writeBuffer
+	preambleSize := 7 + len(flow.remoteIP)
+
+	binary.LittleEndian.PutUint16(buffer[0:2], uint16(preambleSize-2+len(packet)))
+	buffer[2] = flags
+	binary.LittleEndian.PutUint16(buffer[3:5], flow.connID)
+	copy(buffer[5:5+len(flow.remoteIP)], flow.remoteIP)
+	binary.BigEndian.PutUint16(
+		buffer[5+len(flow.remoteIP):preambleSize], flow.remotePort)
+	copy(buffer[preambleSize:], packet)
+
+	_, err = conn.Write(buffer[0 : preambleSize+len(packet)])
+	if err != nil {
+		client.resetConn(conn)
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// close removes the flow from its udpgwClient. No udpgw message is sent; the
+// server will close the corresponding UDP port forward when it's idle or
+// when its connID is reused.
+func (flow *udpgwFlow) close() {
+	flow.client.mutex.Lock()
+	if flow.client.flows[flow.connID] == flow {
+		delete(flow.client.flows, flow.connID)
+	}
+	flow.client.mutex.Unlock()
+}
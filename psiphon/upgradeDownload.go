@@ -43,6 +43,9 @@ import (
 // remote entity's UpgradeDownloadClientVersionHeader. A HEAD request is made to check the
 // version before proceeding with a full download.
 //
+// When stripeTunnels is not empty, a tunneled download may be striped across tunnel and
+// stripeTunnels; see ResumeStripedDownload.
+//
 // NOTE: This code does not check that any existing file at config.GetUpgradeDownloadFilename()
 // is actually the version specified in handshakeVersion.
 //
@@ -60,6 +63,7 @@ func DownloadUpgrade(
 	attempt int,
 	handshakeVersion string,
 	tunnel *Tunnel,
+	stripeTunnels []*Tunnel,
 	untunneledDialConfig *DialConfig) error {
 
 	// Note: this downloader doesn't use ETags since many client binaries, with
@@ -96,6 +100,18 @@ func DownloadUpgrade(
 		return errors.Trace(err)
 	}
 
+	httpClients := []*http.Client{httpClient}
+	if tunnel != nil {
+		for _, stripeTunnel := range stripeTunnels {
+			stripeHTTPClient, err := MakeTunneledHTTPClient(
+				config, stripeTunnel, skipVerify)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			httpClients = append(httpClients, stripeHTTPClient)
+		}
+	}
+
 	// If no handshake version is supplied, make an initial HEAD request
 	// to get the current version from the version header.
 
@@ -156,9 +172,9 @@ func DownloadUpgrade(
 	downloadFilename := fmt.Sprintf(
 		"%s.%s", config.GetUpgradeDownloadFilename(), availableClientVersion)
 
-	n, _, err := ResumeDownload(
+	n, _, err := ResumeStripedDownload(
 		ctx,
-		httpClient,
+		httpClients,
 		downloadURL,
 		MakePsiphonUserAgent(config),
 		downloadFilename,
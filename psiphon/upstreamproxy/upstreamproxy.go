@@ -54,6 +54,20 @@ func (u *UpstreamProxyConfig) Dial(network, addr string) (net.Conn, error) {
 	return u.ForwardDialFunc(network, addr)
 }
 
+// ValidateProxyURI checks that proxyURIString is a well-formed proxy URI
+// with a supported scheme.
+func ValidateProxyURI(proxyURIString string) error {
+	proxyURI, err := url.Parse(proxyURIString)
+	if err != nil {
+		return proxyError(fmt.Errorf("proxyURI url.Parse: %v", err))
+	}
+	_, err = proxy.FromURL(proxyURI, &UpstreamProxyConfig{})
+	if err != nil {
+		return proxyError(fmt.Errorf("proxy.FromURL: %v", err))
+	}
+	return nil
+}
+
 func NewProxyDialFunc(config *UpstreamProxyConfig) DialFunc {
 	if config.ProxyURIString == "" {
 		return config.ForwardDialFunc
@@ -0,0 +1,275 @@
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/parameters"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/tun"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpgw"
+)
+
+var _USERSPACE_PACKET_TUNNEL_TYPE = "PacketTunnel"
+
+// userspacePacketTunnel runs a packet tunnel in which the TCP and UDP flows
+// read from a tun device are terminated locally, in a userspace tun.Stack,
+// rather than relayed to the server's packet tunnel as in tun.Client. Each
+// TCP flow is sent through a port forward, as with the local SOCKS proxy, and
+// UDP flows are sent through the shared udpgw port forward.
+//
+// As port forwards are dialed per flow, the packet tunnel works across tunnel
+// reestablishments and with any TunnelPoolSize, and it doesn't require the
+// server to run a packet tunnel.
+//
+// When a tunneled DNS resolver is configured, UDP and TCP DNS flows are
+// answered locally, using the resolver, instead of being relayed to the
+// server's DNS resolver.
+type userspacePacketTunnel struct {
+	config      *Config
+	tunneler    Tunneler
+	stack       *tun.Stack
+	udpgwClient *udpgwClient
+	dnsResolver *tunneledDNSResolver
+	workers     *sync.WaitGroup
+}
+
+// newUserspacePacketTunnel initializes a userspacePacketTunnel using the
+// config.PacketTunnelTunFileDescriptor tun device.
+func newUserspacePacketTunnel(
+	config *Config, tunneler Tunneler) (*userspacePacketTunnel, error) {
+
+	device, err := tun.NewClientDeviceFromFD(&tun.ClientConfig{
+		Logger:            NoticeCommonLogger(),
+		TunFileDescriptor: config.PacketTunnelTunFileDescriptor,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	packetTunnel := &userspacePacketTunnel{
+		config:   config,
+		tunneler: tunneler,
+		workers:  new(sync.WaitGroup),
+	}
+
+	stack, err := tun.NewStack(&tun.StackConfig{
+		Logger:                         NoticeCommonLogger(),
+		Device:                         device,
+		AllowPrivateSubnetDestinations: true,
+		HandleTCPConn:                  packetTunnel.handleTCPConn,
+		HandleUDPConn:                  packetTunnel.handleUDPConn,
+	})
+	if err != nil {
+		device.Close()
+		return nil, errors.Trace(err)
+	}
+
+	packetTunnel.stack = stack
+
+	return packetTunnel, nil
+}
+
+// start starts relaying flows. UDP flows are relayed through udpgwClient,
+// which may be shared with other udpgw users. When dnsResolver is not nil,
+// DNS flows are resolved with dnsResolver.
+func (packetTunnel *userspacePacketTunnel) start(
+	udpgwClient *udpgwClient, dnsResolver *tunneledDNSResolver) {
+
+	packetTunnel.udpgwClient = udpgwClient
+	packetTunnel.dnsResolver = dnsResolver
+	packetTunnel.stack.Start()
+}
+
+// stop stops the packet tunnel, closing all flows and the tun device.
+func (packetTunnel *userspacePacketTunnel) stop() {
+	packetTunnel.stack.Stop()
+	packetTunnel.workers.Wait()
+}
+
+func (packetTunnel *userspacePacketTunnel) handleTCPConn(conn *tun.StackTCPConn) {
+
+	// handleTCPConn is called from the tun.Stack packet processing
+	// goroutine, so the port forward is dialed in a new goroutine.
+
+	packetTunnel.workers.Add(1)
+	go func() {
+		defer packetTunnel.workers.Done()
+		err := packetTunnel.relayTCPConn(conn)
+		if err != nil {
+			NoticeLocalProxyError(_USERSPACE_PACKET_TUNNEL_TYPE, errors.Trace(err))
+		}
+	}()
+}
+
+func (packetTunnel *userspacePacketTunnel) relayTCPConn(conn *tun.StackTCPConn) error {
+
+	// As with tun.Client, all flows are tunneled. Local split tunnel
+	// classification isn't applied, since untunneled dials would typically
+	// be routed back through the tun device.
+	//
+	// The client's TCP handshake is completed only once the port forward is
+	// established, so a rejected port forward results in a TCP reset.
+
+	remoteAddr := conn.LocalAddr().(*net.TCPAddr)
+
+	if remoteAddr.Port == DNS_PORT && packetTunnel.dnsResolver != nil {
+		err := conn.Accept()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer conn.Close()
+		return errors.Trace(packetTunnel.dnsResolver.serveStream(conn))
+	}
+
+	remoteConn, err := packetTunnel.tunneler.Dial(
+		net.JoinHostPort(remoteAddr.IP.String(), strconv.Itoa(remoteAddr.Port)),
+		true,
+		conn)
+	if err != nil {
+		conn.Reject()
+		return errors.Trace(err)
+	}
+	defer remoteConn.Close()
+
+	err = conn.Accept()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	LocalProxyRelay(_USERSPACE_PACKET_TUNNEL_TYPE, conn, remoteConn)
+
+	return nil
+}
+
+func (packetTunnel *userspacePacketTunnel) handleUDPConn(conn *tun.StackUDPConn) {
+
+	packetTunnel.workers.Add(1)
+	go func() {
+		defer packetTunnel.workers.Done()
+		err := packetTunnel.relayUDPConn(conn)
+		if err != nil {
+			NoticeLocalProxyError(_USERSPACE_PACKET_TUNNEL_TYPE, errors.Trace(err))
+		}
+	}()
+}
+
+func (packetTunnel *userspacePacketTunnel) relayUDPConn(conn *tun.StackUDPConn) error {
+
+	defer conn.Close()
+
+	remoteAddr := conn.LocalAddr().(*net.UDPAddr)
+
+	if remoteAddr.Port == DNS_PORT && packetTunnel.dnsResolver != nil {
+		return errors.Trace(packetTunnel.resolveUDPConn(conn))
+	}
+
+	// All UDP DNS flows, whatever the resolver address configured on the
+	// host, are relayed to the server's DNS resolver. The server bypasses
+	// traffic rules for DNS.
+
+	forwardDNS := remoteAddr.Port == DNS_PORT
+
+	// Downstream packets are written to conn, which queues them to be
+	// written to the tun device without blocking.
+
+	flow, err := packetTunnel.udpgwClient.newFlow(
+		remoteAddr.IP,
+		remoteAddr.Port,
+		forwardDNS,
+		func(packet []byte) {
+			_, _ = conn.Write(packet)
+		})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer flow.close()
+
+	p := packetTunnel.config.GetClientParameters().Get()
+	idleTimeout := p.Duration(parameters.PacketTunnelUDPFlowIdleTimeout)
+
+	// The flow ends when no upstream packets are sent for the idle timeout
+	// period or when the Stack is stopped.
+
+	buffer := make([]byte, udpgw.PROTOCOL_MAX_PAYLOAD_SIZE)
+
+	for {
+
+		err := conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		n, err := conn.Read(buffer)
+		if err != nil {
+			// Read fails on the idle timeout or when the Stack is stopped;
+			// either ends the flow as normal.
+			return nil
+		}
+
+		err = flow.send(buffer[:n])
+		if err != nil {
+			// The udpgw port forward will be redialed on the next send, so
+			// this packet is dropped, as with any UDP packet loss.
+			NoticeWarning("packet tunnel UDP relay failed: %s", errors.Trace(err))
+		}
+	}
+}
+
+func (packetTunnel *userspacePacketTunnel) resolveUDPConn(conn *tun.StackUDPConn) error {
+
+	p := packetTunnel.config.GetClientParameters().Get()
+	idleTimeout := p.Duration(parameters.PacketTunnelUDPFlowIdleTimeout)
+
+	// Requests within a flow, which has a single client source port, are
+	// resolved sequentially.
+
+	buffer := make([]byte, udpgw.PROTOCOL_MAX_PAYLOAD_SIZE)
+
+	for {
+
+		err := conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil
+		}
+
+		responsePacket, err := packetTunnel.dnsResolver.handleRequestPacket(
+			buffer[:n], true)
+		if err != nil {
+			// Malformed requests are dropped.
+			NoticeWarning("packet tunnel DNS request failed: %s", errors.Trace(err))
+			continue
+		}
+
+		_, err = conn.Write(responsePacket)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+// +build linux
+
+/*
+ * Copyright (c) 2020, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/errors"
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/common/udpgw"
+)
+
+func TestUserspacePacketTunnel(t *testing.T) {
+
+	testDataDirName, err := ioutil.TempDir("", "psiphon-userspace-packet-tunnel-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(testDataDirName)
+
+	SetNoticeWriter(ioutil.Discard)
+
+	// A Unix datagram socket pair stands in for the tun device: as with a
+	// Linux tun device, each read and write is a single IP packet.
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %s", err)
+	}
+	defer syscall.Close(fds[1])
+
+	deviceFile := os.NewFile(uintptr(fds[0]), "device")
+	deviceConn, err := net.FileConn(deviceFile)
+	deviceFile.Close()
+	if err != nil {
+		t.Fatalf("FileConn failed: %s", err)
+	}
+	defer deviceConn.Close()
+
+	config := &Config{
+		PropagationChannelId:          "0",
+		SponsorId:                     "0",
+		DataRootDirectory:             testDataDirName,
+		UdpgwServerAddress:            "127.0.0.1:7300",
+		PacketTunnelTunFileDescriptor: fds[1],
+		PacketTunnelUserspaceStack:    true,
+		TunnelPoolSize:                2,
+	}
+
+	err = config.Commit(false)
+	if err != nil {
+		t.Fatalf("error committing configuration file: %s", err)
+	}
+
+	tunneler := &testPacketTunnelTunneler{
+		udpgwFlags: make(chan byte, 16),
+	}
+
+	packetTunnel, err := newUserspacePacketTunnel(config, tunneler)
+	if err != nil {
+		t.Fatalf("newUserspacePacketTunnel failed: %s", err)
+	}
+
+	udpgwClient := newUdpgwClient(tunneler, config.UdpgwServerAddress)
+	defer udpgwClient.close()
+
+	packetTunnel.start(udpgwClient, nil)
+	defer packetTunnel.stop()
+
+	clientIP := net.ParseIP("10.0.0.1").To4()
+	serverIP := net.ParseIP("192.0.2.1").To4()
+
+	// Test: UDP DNS to a local network resolver is relayed through udpgw,
+	// with the DNS flag set.
+
+	resolverIP := net.ParseIP("192.168.1.1").To4()
+
+	_, err = deviceConn.Write(
+		makeTestPacket(clientIP, resolverIP, 5353, 53, syscall.IPPROTO_UDP, 0, 0, 0, []byte("query")))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	select {
+	case flags := <-tunneler.udpgwFlags:
+		if flags&udpgw.PROTOCOL_FLAG_DNS == 0 {
+			t.Fatalf("unexpected udpgw flags: %x", flags)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout awaiting udpgw message")
+	}
+
+	packet, err := readTestPacket(deviceConn)
+	if err != nil {
+		t.Fatalf("readTestPacket failed: %s", err)
+	}
+	if !packet.sourceIP.Equal(resolverIP) || packet.sourcePort != 53 ||
+		packet.destinationPort != 5353 || string(packet.payload) != "query" {
+		t.Fatalf("unexpected UDP packet: %+v", packet)
+	}
+
+	// Test: TCP flows are relayed through port forwards.
+
+	_, err = deviceConn.Write(
+		makeTestPacket(clientIP, serverIP, 40000, 80, syscall.IPPROTO_TCP, 1000, 0, tcpSYN, nil))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	packet, err = readTestPacket(deviceConn)
+	if err != nil {
+		t.Fatalf("readTestPacket failed: %s", err)
+	}
+	if packet.flags != tcpSYN|tcpACK || packet.ack != 1001 {
+		t.Fatalf("unexpected SYN-ACK packet: %+v", packet)
+	}
+	serverSeq := packet.seq + 1
+
+	_, err = deviceConn.Write(
+		makeTestPacket(clientIP, serverIP, 40000, 80, syscall.IPPROTO_TCP, 1001, serverSeq, tcpACK, []byte("hello")))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	// Skip any pure ACKs.
+	for {
+		packet, err = readTestPacket(deviceConn)
+		if err != nil {
+			t.Fatalf("readTestPacket failed: %s", err)
+		}
+		if len(packet.payload) > 0 {
+			break
+		}
+	}
+	if packet.seq != serverSeq || string(packet.payload) != "hello" {
+		t.Fatalf("unexpected TCP data packet: %+v", packet)
+	}
+
+	// Test: failed port forwards result in a TCP reset.
+
+	_, err = deviceConn.Write(
+		makeTestPacket(clientIP, serverIP, 40001, 81, syscall.IPPROTO_TCP, 2000, 0, tcpSYN, nil))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	packet, err = readTestPacket(deviceConn)
+	if err != nil {
+		t.Fatalf("readTestPacket failed: %s", err)
+	}
+	if packet.destinationPort != 40001 || packet.flags&tcpRST == 0 {
+		t.Fatalf("unexpected reset packet: %+v", packet)
+	}
+}
+
+const (
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpACK = 0x10
+)
+
+type testPacket struct {
+	sourceIP        net.IP
+	sourcePort      uint16
+	destinationPort uint16
+	seq             uint32
+	ack             uint32
+	flags           byte
+	payload         []byte
+}
+
+// makeTestPacket makes an IPv4 TCP or UDP packet with valid checksums.
+func makeTestPacket(
+	sourceIP, destinationIP net.IP,
+	sourcePort, destinationPort uint16,
+	protocol int,
+	seq, ack uint32,
+	flags byte,
+	payload []byte) []byte {
+
+	headerSize := 8
+	if protocol == syscall.IPPROTO_TCP {
+		headerSize = 20
+	}
+
+	packet := make([]byte, 20+headerSize+len(payload))
+
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = byte(protocol)
+	copy(packet[12:16], sourceIP)
+	copy(packet[16:20], destinationIP)
+	binary.BigEndian.PutUint16(packet[10:12], testChecksum(0, packet[0:20]))
+
+	segment := packet[20:]
+	binary.BigEndian.PutUint16(segment[0:2], sourcePort)
+	binary.BigEndian.PutUint16(segment[2:4], destinationPort)
+	copy(segment[headerSize:], payload)
+
+	checksumOffset := 6
+	if protocol == syscall.IPPROTO_TCP {
+		binary.BigEndian.PutUint32(segment[4:8], seq)
+		binary.BigEndian.PutUint32(segment[8:12], ack)
+		segment[12] = 5 << 4
+		segment[13] = flags
+		binary.BigEndian.PutUint16(segment[14:16], 0xFFFF)
+		checksumOffset = 16
+	} else {
+		binary.BigEndian.PutUint16(segment[4:6], uint16(len(segment)))
+	}
+
+	pseudoHeader := make([]byte, 12)
+	copy(pseudoHeader[0:4], sourceIP)
+	copy(pseudoHeader[4:8], destinationIP)
+	pseudoHeader[9] = byte(protocol)
+	binary.BigEndian.PutUint16(pseudoHeader[10:12], uint16(len(segment)))
+
+	checksum := testChecksum(testChecksumSum(0, pseudoHeader), segment)
+	binary.BigEndian.PutUint16(segment[checksumOffset:checksumOffset+2], checksum)
+
+	return packet
+}
+
+func readTestPacket(conn net.Conn) (*testPacket, error) {
+
+	buffer := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	packet := buffer[:n]
+
+	if len(packet) < 28 || packet[0] != 0x45 {
+		return nil, errors.TraceNew("unexpected packet")
+	}
+
+	segment := packet[20:]
+	parsedPacket := &testPacket{
+		sourceIP:        net.IP(packet[12:16]),
+		sourcePort:      binary.BigEndian.Uint16(segment[0:2]),
+		destinationPort: binary.BigEndian.Uint16(segment[2:4]),
+	}
+
+	if packet[9] == syscall.IPPROTO_TCP {
+		if len(segment) < 20 {
+			return nil, errors.TraceNew("unexpected TCP segment")
+		}
+		parsedPacket.seq = binary.BigEndian.Uint32(segment[4:8])
+		parsedPacket.ack = binary.BigEndian.Uint32(segment[8:12])
+		parsedPacket.flags = segment[13]
+		parsedPacket.payload = segment[int(segment[12]>>4)*4:]
+	} else {
+		parsedPacket.payload = segment[8:]
+	}
+
+	return parsedPacket, nil
+}
+
+func testChecksumSum(sum uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+func testChecksum(sum uint32, data []byte) uint16 {
+	sum = testChecksumSum(sum, data)
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
+
+// testPacketTunnelTunneler is a Tunneler which echoes TCP port forwards to
+// port 80, rejects other TCP port forwards, and handles udpgw port forwards
+// with a udpgw echo server that reports the flags of each upstream message.
+type testPacketTunnelTunneler struct {
+	udpgwFlags chan byte
+}
+
+func (tunneler *testPacketTunnelTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	if !alwaysTunnel {
+		return nil, errors.TraceNew("unexpected dial")
+	}
+
+	clientConn, serverConn := net.Pipe()
+
+	switch remoteAddr {
+	case "127.0.0.1:7300":
+		go tunneler.echoUdpgw(serverConn)
+	case "192.0.2.1:80":
+		go func() {
+			defer serverConn.Close()
+			_, _ = io.Copy(serverConn, serverConn)
+		}()
+	default:
+		return nil, errors.TraceNew("ssh: rejected")
+	}
+
+	return clientConn, nil
+}
+
+func (tunneler *testPacketTunnelTunneler) DirectDial(remoteAddr string) (net.Conn, error) {
+	return nil, errors.TraceNew("not supported")
+}
+
+func (tunneler *testPacketTunnelTunneler) SignalComponentFailure() {
+}
+
+func (tunneler *testPacketTunnelTunneler) echoUdpgw(conn net.Conn) {
+	defer conn.Close()
+
+	buffer := make([]byte, udpgw.PROTOCOL_MAX_MESSAGE_SIZE)
+
+	for {
+		_, err := io.ReadFull(conn, buffer[0:2])
+		if err != nil {
+			return
+		}
+		size := int(binary.LittleEndian.Uint16(buffer[0:2]))
+		_, err = io.ReadFull(conn, buffer[2:2+size])
+		if err != nil {
+			return
+		}
+		select {
+		case tunneler.udpgwFlags <- buffer[2]:
+		default:
+		}
+		buffer[2] = 0
+		_, err = conn.Write(buffer[0 : 2+size])
+		if err != nil {
+			return
+		}
+	}
+}
@@ -171,9 +171,11 @@ func RedactNetError(err error) error {
 // SyncFileWriter wraps a file and exposes an io.Writer. At predefined
 // steps, the file is synced (flushed to disk) while writing.
 type SyncFileWriter struct {
-	file  *os.File
-	step  int
-	count int
+	file    *os.File
+	step    int
+	count   int
+	writeAt bool
+	offset  int64
 }
 
 // NewSyncFileWriter creates a SyncFileWriter.
@@ -184,9 +186,26 @@ func NewSyncFileWriter(file *os.File) *SyncFileWriter {
 		count: 0}
 }
 
+// NewSyncFileWriterAt creates a SyncFileWriter which writes sequentially
+// from the specified file offset using WriteAt. Multiple writers may write
+// distinct ranges of the same file concurrently.
+func NewSyncFileWriterAt(file *os.File, offset int64) *SyncFileWriter {
+	return &SyncFileWriter{
+		file:    file,
+		step:    2 << 16,
+		count:   0,
+		writeAt: true,
+		offset:  offset}
+}
+
 // Write implements io.Writer with periodic file syncing.
 func (writer *SyncFileWriter) Write(p []byte) (n int, err error) {
-	n, err = writer.file.Write(p)
+	if writer.writeAt {
+		n, err = writer.file.WriteAt(p, writer.offset)
+		writer.offset += int64(n)
+	} else {
+		n, err = writer.file.Write(p)
+	}
 	if err != nil {
 		return
 	}